@@ -0,0 +1,302 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// A11yViolation is a single finding of the accessibility checker. Rule names
+// follow the axe-core rule IDs where an equivalent exists, so reports can be
+// compared with a browser-based audit.
+type A11yViolation struct {
+	Rule    string `json:"rule"`
+	Impact  string `json:"impact"`
+	Page    string `json:"page"`
+	Element string `json:"element,omitempty"`
+	Message string `json:"message"`
+}
+
+type a11yReport struct {
+	SiteName   string          `json:"siteName"`
+	BuildID    string          `json:"buildId,omitempty"`
+	CheckedAt  string          `json:"checkedAt,omitempty"`
+	Violations []A11yViolation `json:"violations"`
+}
+
+// checkAccessibility runs the static WCAG checks on every HTML file below dir.
+// Page paths in the result are relative to dir.
+func checkAccessibility(dir string) ([]A11yViolation, error) {
+	violations := []A11yViolation{}
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !strings.HasSuffix(strings.ToLower(d.Name()), ".html") {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		found, err := checkPageAccessibility(path, filepath.ToSlash(rel))
+		if err != nil {
+			return err
+		}
+		violations = append(violations, found...)
+		return nil
+	})
+	return violations, err
+}
+
+func checkPageAccessibility(path, page string) ([]A11yViolation, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	doc, err := html.Parse(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", page, err)
+	}
+
+	c := &a11yChecker{page: page, ids: map[string]int{}, labelled: map[string]bool{}}
+	c.walk(doc)
+	c.finish()
+	return c.violations, nil
+}
+
+type a11yChecker struct {
+	page        string
+	violations  []A11yViolation
+	hasTitle    bool
+	lang        string
+	lastHeading int
+	ids         map[string]int
+	labelled    map[string]bool // ids referenced by <label for="...">
+	controls    []*html.Node    // form controls without an inline label
+}
+
+func (c *a11yChecker) add(rule, impact string, n *html.Node, msg string) {
+	c.violations = append(c.violations, A11yViolation{
+		Rule:    rule,
+		Impact:  impact,
+		Page:    c.page,
+		Element: describeNode(n),
+		Message: msg,
+	})
+}
+
+func (c *a11yChecker) walk(n *html.Node) {
+	if n.Type == html.ElementNode {
+		c.checkElement(n)
+	}
+	for child := n.FirstChild; child != nil; child = child.NextSibling {
+		c.walk(child)
+	}
+}
+
+func (c *a11yChecker) checkElement(n *html.Node) {
+	if id := attr(n, "id"); id != "" {
+		c.ids[id]++
+		if c.ids[id] == 2 {
+			c.add("duplicate-id", "minor", n, fmt.Sprintf("id %q is used more than once", id))
+		}
+	}
+
+	switch n.DataAtom {
+	case atom.Html:
+		c.lang = strings.TrimSpace(attr(n, "lang"))
+	case atom.Title:
+		if strings.TrimSpace(textContent(n)) != "" {
+			c.hasTitle = true
+		}
+	case atom.Img:
+		if _, ok := attrOK(n, "alt"); !ok && attr(n, "role") != "presentation" {
+			c.add("image-alt", "critical", n, "images must have an alt attribute")
+		}
+	case atom.A:
+		if _, ok := attrOK(n, "href"); ok && accessibleName(n) == "" {
+			c.add("link-name", "serious", n, "links must have discernible text")
+		}
+	case atom.Button:
+		if accessibleName(n) == "" {
+			c.add("button-name", "critical", n, "buttons must have discernible text")
+		}
+	case atom.Input, atom.Select, atom.Textarea:
+		switch strings.ToLower(attr(n, "type")) {
+		case "hidden", "submit", "reset", "button", "image":
+			return
+		}
+		if attr(n, "aria-label") != "" || attr(n, "aria-labelledby") != "" || hasAncestor(n, atom.Label) {
+			return
+		}
+		c.controls = append(c.controls, n)
+	case atom.Label:
+		if target := attr(n, "for"); target != "" {
+			c.labelled[target] = true
+		}
+	case atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6:
+		level := int(n.Data[1] - '0')
+		if c.lastHeading > 0 && level > c.lastHeading+1 {
+			c.add("heading-order", "moderate", n, fmt.Sprintf("heading level jumps from h%d to h%d", c.lastHeading, level))
+		}
+		c.lastHeading = level
+		if strings.TrimSpace(textContent(n)) == "" {
+			c.add("empty-heading", "minor", n, "headings must not be empty")
+		}
+	}
+}
+
+// finish runs the checks that need the whole document to be seen first.
+func (c *a11yChecker) finish() {
+	if c.lang == "" {
+		c.add("html-has-lang", "serious", nil, "the <html> element must have a lang attribute")
+	}
+	if !c.hasTitle {
+		c.add("document-title", "serious", nil, "documents must have a non-empty <title>")
+	}
+	for _, n := range c.controls {
+		if id := attr(n, "id"); id != "" && c.labelled[id] {
+			continue
+		}
+		c.add("label", "critical", n, "form elements must have a label")
+	}
+}
+
+func attr(n *html.Node, key string) string {
+	v, _ := attrOK(n, key)
+	return v
+}
+
+func attrOK(n *html.Node, key string) (string, bool) {
+	for _, a := range n.Attr {
+		if a.Namespace == "" && a.Key == key {
+			return a.Val, true
+		}
+	}
+	return "", false
+}
+
+func hasAncestor(n *html.Node, a atom.Atom) bool {
+	for p := n.Parent; p != nil; p = p.Parent {
+		if p.DataAtom == a {
+			return true
+		}
+	}
+	return false
+}
+
+func textContent(n *html.Node) string {
+	var sb strings.Builder
+	var collect func(*html.Node)
+	collect = func(n *html.Node) {
+		if n.Type == html.TextNode {
+			sb.WriteString(n.Data)
+		}
+		for child := n.FirstChild; child != nil; child = child.NextSibling {
+			collect(child)
+		}
+	}
+	collect(n)
+	return sb.String()
+}
+
+// accessibleName approximates the accessible name computation: aria-label,
+// title, text content, or the alt text of contained images.
+func accessibleName(n *html.Node) string {
+	for _, key := range []string{"aria-label", "aria-labelledby", "title"} {
+		if v := strings.TrimSpace(attr(n, key)); v != "" {
+			return v
+		}
+	}
+	if text := strings.TrimSpace(textContent(n)); text != "" {
+		return text
+	}
+	var alt string
+	var find func(*html.Node)
+	find = func(n *html.Node) {
+		if n.DataAtom == atom.Img && alt == "" {
+			alt = strings.TrimSpace(attr(n, "alt"))
+		}
+		for child := n.FirstChild; child != nil; child = child.NextSibling {
+			find(child)
+		}
+	}
+	find(n)
+	return alt
+}
+
+func describeNode(n *html.Node) string {
+	if n == nil {
+		return ""
+	}
+	desc := "<" + n.Data
+	if id := attr(n, "id"); id != "" {
+		desc += fmt.Sprintf(" id=%q", id)
+	}
+	if src := attr(n, "src"); src != "" {
+		desc += fmt.Sprintf(" src=%q", src)
+	}
+	if href := attr(n, "href"); href != "" {
+		desc += fmt.Sprintf(" href=%q", href)
+	}
+	return desc + ">"
+}
+
+// a11ySummary counts the accessibility violations of a build by impact, for
+// the site detail.
+type a11ySummary struct {
+	BuildID    string         `json:"buildId"`
+	CheckedAt  string         `json:"checkedAt"`
+	Violations int            `json:"violations"`
+	ByImpact   map[string]int `json:"byImpact"`
+}
+
+func summarizeAccessibility(record *BuildRecord) *a11ySummary {
+	summary := &a11ySummary{
+		BuildID:    record.ID,
+		CheckedAt:  record.FinishedAt.Format(time.RFC3339),
+		Violations: len(record.Accessibility),
+		ByImpact:   map[string]int{},
+	}
+	for _, v := range record.Accessibility {
+		summary.ByImpact[v.Impact]++
+	}
+	return summary
+}
+
+// getAccessibilityHandler returns the accessibility violations of the latest
+// build of a site.
+func getAccessibilityHandler(w http.ResponseWriter, r *http.Request) {
+	siteName, ok := siteNameFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	record, err := latestBuildRecord(siteName)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error reading build record", "site", siteName, "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	report := a11yReport{SiteName: siteName, Violations: []A11yViolation{}}
+	if record != nil {
+		report.BuildID = record.ID
+		report.CheckedAt = record.FinishedAt.Format(time.RFC3339)
+		if record.Accessibility != nil {
+			report.Violations = record.Accessibility
+		}
+	}
+	respondJSON(w, report)
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+const siteLogDir = "logs" // access.log of the self-hosted mode, with rotated backups
+
+// accessLogEntry is one request to a served site.
+type accessLogEntry struct {
+	Time      time.Time `json:"time"`
+	RemoteIP  string    `json:"remoteIp"`
+	Method    string    `json:"method"`
+	URI       string    `json:"uri"`
+	Proto     string    `json:"proto"`
+	Status    int       `json:"status"`
+	Bytes     int64     `json:"bytes"`
+	Referer   string    `json:"referer,omitempty"`
+	UserAgent string    `json:"userAgent,omitempty"`
+	Duration  float64   `json:"durationMs"`
+}
+
+// combined formats the entry in the combined log format of Apache and nginx.
+func (e accessLogEntry) combined() string {
+	size := "-"
+	if e.Bytes > 0 {
+		size = strconv.FormatInt(e.Bytes, 10)
+	}
+	return fmt.Sprintf("%s - - [%s] \"%s %s %s\" %d %s \"%s\" \"%s\"\n",
+		e.RemoteIP, e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		e.Method, escapeLogField(e.URI), e.Proto, e.Status, size,
+		escapeLogField(cmp.Or(e.Referer, "-")), escapeLogField(cmp.Or(e.UserAgent, "-")))
+}
+
+// escapeLogField escapes quotes, backslashes and control characters the way
+// nginx does, so a request cannot forge log lines.
+func escapeLogField(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"' || c == '\\' || c < 0x20 || c >= 0x7f:
+			fmt.Fprintf(&b, `\x%02X`, c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// accessLogs holds the open log of every site that was requested.
+var (
+	accessLogsMu sync.Mutex
+	accessLogs   = map[string]io.Writer{}
+)
+
+func siteAccessLog(siteName string) io.Writer {
+	accessLogsMu.Lock()
+	defer accessLogsMu.Unlock()
+	w, ok := accessLogs[siteName]
+	if !ok {
+		w = &lumberjack.Logger{
+			Filename:   filepath.Join(sitesBaseDir, siteName, siteLogDir, "access.log"),
+			MaxSize:    config.Hosting.AccessLogMaxSize,
+			MaxBackups: config.Hosting.AccessLogMaxBackups,
+			Compress:   true,
+		}
+		accessLogs[siteName] = w
+	}
+	return w
+}
+
+func writeAccessLog(siteName string, e accessLogEntry) {
+	var line []byte
+	if config.Hosting.AccessLog == "json" {
+		data, err := json.Marshal(e)
+		if err != nil {
+			return
+		}
+		line = append(data, '\n')
+	} else {
+		line = []byte(e.combined())
+	}
+	if _, err := siteAccessLog(siteName).Write(line); err != nil {
+		slog.Error("error writing access log", "site", siteName, "error", err)
+	}
+}
+
+// pageviewFromAccess counts successful page loads by visitors as pageviews,
+// so sites have statistics even where the beacon script is blocked.
+func pageviewFromAccess(siteName string, r *http.Request, e accessLogEntry) (Pageview, bool) {
+	if e.Method != http.MethodGet || e.Status != http.StatusOK || isBot(e.UserAgent) || r.Header.Get("DNT") == "1" {
+		return Pageview{}, false
+	}
+	// Pages are directories or .html files; assets are not views.
+	if ext := path.Ext(r.URL.Path); ext != "" && ext != ".html" {
+		return Pageview{}, false
+	}
+	return Pageview{
+		Time:     e.Time.UTC(),
+		Path:     r.URL.Path,
+		Referrer: referrerHost(siteName, e.Referer),
+		Country:  countryForIP(e.RemoteIP),
+	}, true
+}
+
+// statusRecorder captures what a handler wrote, for the access log.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	if s.status == 0 {
+		s.status = status
+	}
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusRecorder) Write(p []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	n, err := s.ResponseWriter.Write(p)
+	s.bytes += int64(n)
+	return n, err
+}
+
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+// accessLogMiddleware writes the access log of served sites and records
+// server-side pageviews. Requests for unknown hosts are not logged per site.
+func accessLogMiddleware(next http.Handler) http.Handler {
+	if config.Hosting.AccessLog == "off" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+
+		siteName, ok := siteForHost(r.Host)
+		if !ok {
+			return
+		}
+		e := accessLogEntry{
+			Time:      start,
+			RemoteIP:  clientIP(r),
+			Method:    r.Method,
+			URI:       r.RequestURI,
+			Proto:     r.Proto,
+			Status:    max(rec.status, http.StatusOK),
+			Bytes:     rec.bytes,
+			Referer:   r.Referer(),
+			UserAgent: r.UserAgent(),
+			Duration:  float64(time.Since(start).Microseconds()) / 1000,
+		}
+		writeAccessLog(siteName, e)
+		if pv, ok := pageviewFromAccess(siteName, r, e); ok {
+			if err := recordPageview(siteName, pageviewSourceServer, pv); err != nil {
+				slog.Error("error recording pageview", "site", siteName, "error", err)
+			}
+		}
+	})
+}
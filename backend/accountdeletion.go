@@ -0,0 +1,532 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Account deletion, the right to erasure: DELETE /api/v1/auth/me, confirmed
+// with the account's email, schedules the deletion of the account and
+// everything it owns after auth.deletion_grace. Until then the user can
+// log in and cancel it; a mail tells them when the deletion happens. Admins
+// schedule deletions with DELETE /api/v1/admin/users/{userId}, or run them
+// at once with ?immediate=true.
+//
+// When the grace period is over, the scheduler deletes the account:
+//
+//   - every site it owns is deleted like with DELETE /api/v1/sites/{siteName}
+//     (DNS records, vhost, data), after its Stripe payment links were
+//     deactivated and its certificate revoked,
+//   - the archives of its sites are purged, also those of sites deleted
+//     earlier,
+//   - its premium name purchases and organization memberships are removed,
+//   - the account itself is removed, which ends its sessions,
+//
+// then the account.deleted webhook event tells the billing system to
+// cancel the subscriptions and a final mail confirms the deletion. A
+// deletion that fails part way is retried on the next run; what was done
+// is not undone. The audit log keeps the entries of the account, they are
+// a security record.
+
+const accountDeletionsFile = ".account-deletions.json" // in sitesBaseDir
+
+// accountDeletion is a scheduled deletion of an account.
+type accountDeletion struct {
+	UserID      string    `json:"userId"`
+	Email       string    `json:"email,omitempty"`
+	Provider    string    `json:"provider"`    // password or oidc
+	RequestedBy string    `json:"requestedBy"` // user or admin
+	RequestedAt time.Time `json:"requestedAt"`
+	DeleteAt    time.Time `json:"deleteAt"`
+	// Sites are those the account owns, as of the request.
+	Sites []string `json:"sites"`
+	// LastError is why the last attempt failed; it is retried.
+	LastError string `json:"lastError,omitempty"`
+}
+
+// accountDeletionReport is what deleting an account did.
+type accountDeletionReport struct {
+	UserID   string                 `json:"userId"`
+	Sites    []siteDeletionResponse `json:"sites"`
+	Archives int                    `json:"archives"` // purged
+	Complete bool                   `json:"complete"`
+	Error    string                 `json:"error,omitempty"`
+}
+
+// Serializes the changes of the deletions file and the deletions
+// themselves.
+var accountDeletionsMu sync.Mutex
+
+func readAccountDeletions() (map[string]*accountDeletion, error) {
+	deletions := map[string]*accountDeletion{}
+	data, err := os.ReadFile(filepath.Join(sitesBaseDir, accountDeletionsFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return deletions, nil
+		}
+		return nil, err
+	}
+	err = json.Unmarshal(data, &deletions)
+	return deletions, err
+}
+
+func writeAccountDeletions(deletions map[string]*accountDeletion) error {
+	data, err := json.MarshalIndent(deletions, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(sitesBaseDir, accountDeletionsFile), data, 0600)
+}
+
+// ownedSites returns the names of the sites of a user.
+func ownedSites(userID string) ([]string, error) {
+	siteNames, err := listSiteNames()
+	if err != nil {
+		return nil, err
+	}
+	owned := []string{}
+	for _, siteName := range siteNames {
+		sc, err := readSiteConfig(siteName)
+		if err != nil {
+			slog.Error("error reading site config", "site", siteName, "error", err)
+			continue
+		}
+		if sc.UserID == userID {
+			owned = append(owned, siteName)
+		}
+	}
+	return owned, nil
+}
+
+// scheduleAccountDeletion schedules the deletion of an account, or
+// returns the one scheduled already.
+func scheduleAccountDeletion(ctx context.Context, d accountDeletion) (*accountDeletion, error) {
+	sites, err := ownedSites(d.UserID)
+	if err != nil {
+		return nil, err
+	}
+	accountDeletionsMu.Lock()
+	defer accountDeletionsMu.Unlock()
+	deletions, err := readAccountDeletions()
+	if err != nil {
+		return nil, err
+	}
+	if scheduled, ok := deletions[d.UserID]; ok {
+		return scheduled, nil
+	}
+	d.RequestedAt = time.Now().UTC()
+	d.DeleteAt = d.RequestedAt.Add(currentConfig().Auth.DeletionGrace)
+	d.Sites = sites
+	deletions[d.UserID] = &d
+	if err := writeAccountDeletions(deletions); err != nil {
+		return nil, err
+	}
+	writeAuditEntry(ctx, auditEntry{Action: "account.delete_request", Target: d.UserID})
+	fireWebhooks("", SiteEvent{Type: "account.deletion_scheduled", Message: d.UserID + " on " + d.DeleteAt.Format(time.RFC3339)})
+	slog.InfoContext(ctx, "scheduled account deletion", "user", d.UserID, "deleteAt", d.DeleteAt, "sites", len(sites))
+	if d.Email != "" {
+		err := sendTemplateEmail(d.Email, "account_deletion_scheduled", map[string]any{
+			"Email":    d.Email,
+			"DeleteAt": d.DeleteAt.Format(time.RFC1123),
+			"Sites":    strings.Join(sites, ", "),
+		})
+		if err != nil {
+			slog.ErrorContext(ctx, "error sending account deletion mail", "user", d.UserID, "error", err)
+		}
+	}
+	return &d, nil
+}
+
+// cancelAccountDeletion drops a scheduled deletion; false if there was
+// none.
+func cancelAccountDeletion(ctx context.Context, userID string) (bool, error) {
+	accountDeletionsMu.Lock()
+	defer accountDeletionsMu.Unlock()
+	deletions, err := readAccountDeletions()
+	if err != nil {
+		return false, err
+	}
+	if _, ok := deletions[userID]; !ok {
+		return false, nil
+	}
+	delete(deletions, userID)
+	if err := writeAccountDeletions(deletions); err != nil {
+		return false, err
+	}
+	writeAuditEntry(ctx, auditEntry{Action: "account.delete_cancel", Target: userID})
+	slog.InfoContext(ctx, "canceled account deletion", "user", userID)
+	return true, nil
+}
+
+// runAccountDeletions deletes the accounts whose grace period is over; the
+// scheduler calls it.
+func runAccountDeletions(now time.Time) {
+	accountDeletionsMu.Lock()
+	defer accountDeletionsMu.Unlock()
+	deletions, err := readAccountDeletions()
+	if err != nil {
+		slog.Error("error reading account deletions", "error", err)
+		return
+	}
+	for _, d := range deletions {
+		if d.DeleteAt.After(now) {
+			continue
+		}
+		report := deleteAccount(context.Background(), d)
+		if report.Complete {
+			delete(deletions, d.UserID)
+		} else {
+			d.LastError = report.Error
+		}
+		if err := writeAccountDeletions(deletions); err != nil {
+			slog.Error("error writing account deletions", "error", err)
+			return
+		}
+	}
+}
+
+// deleteAccount deletes an account with everything it owns. The caller
+// holds accountDeletionsMu and removes d when the report is complete.
+func deleteAccount(ctx context.Context, d *accountDeletion) accountDeletionReport {
+	report := accountDeletionReport{UserID: d.UserID, Sites: []siteDeletionResponse{}}
+	fail := func(err error) accountDeletionReport {
+		slog.ErrorContext(ctx, "error deleting account", "user", d.UserID, "error", err)
+		report.Error = err.Error()
+		return report
+	}
+
+	sites, err := ownedSites(d.UserID)
+	if err != nil {
+		return fail(err)
+	}
+	var failed []string
+	for _, siteName := range sites {
+		sc, err := readSiteConfig(siteName)
+		if err != nil {
+			return fail(err)
+		}
+		deactivateSitePaymentLinks(ctx, siteName)
+		if err := revokeSiteCertificate(ctx, siteName, sc); err != nil {
+			// The certificate expires on its own, the deletion goes on.
+			slog.ErrorContext(ctx, "error revoking certificate", "site", siteName, "error", err)
+		}
+		resp := deleteSite(ctx, siteName)
+		report.Sites = append(report.Sites, resp)
+		if !resp.Deleted {
+			failed = append(failed, siteName)
+		}
+	}
+	if len(failed) > 0 {
+		return fail(fmt.Errorf("the sites %s could not be deleted", strings.Join(failed, ", ")))
+	}
+	if report.Archives, err = purgeUserArchives(d.UserID); err != nil {
+		return fail(err)
+	}
+	if err := removePremiumPurchases(d.UserID, d.Email); err != nil {
+		return fail(err)
+	}
+	if err := removeOrgMember(d.UserID, d.Email); err != nil {
+		return fail(err)
+	}
+	if err := removeUser(d.UserID); err != nil {
+		return fail(err)
+	}
+
+	report.Complete = true
+	writeAuditEntry(ctx, auditEntry{Action: "account.delete", Target: d.UserID})
+	fireWebhooks("", SiteEvent{Type: "account.deleted", Message: d.UserID})
+	slog.InfoContext(ctx, "deleted account", "user", d.UserID, "sites", len(report.Sites), "archives", report.Archives)
+	if d.Email != "" {
+		if err := sendTemplateEmail(d.Email, "account_deleted", map[string]any{"Email": d.Email, "Sites": strings.Join(sites, ", ")}); err != nil {
+			slog.ErrorContext(ctx, "error sending account deletion mail", "user", d.UserID, "error", err)
+		}
+	}
+	return report
+}
+
+// deactivateSitePaymentLinks stops the Stripe payment links of a site's
+// products; failures are logged, the links lead to a deleted site anyway.
+func deactivateSitePaymentLinks(ctx context.Context, siteName string) {
+	productsMu.Lock()
+	products, err := readProducts(siteName)
+	productsMu.Unlock()
+	if err != nil {
+		slog.ErrorContext(ctx, "error reading products", "site", siteName, "error", err)
+		return
+	}
+	for _, p := range products {
+		if p.StripePaymentLinkID == "" {
+			continue
+		}
+		if err := deactivateStripePaymentLink(p.StripePaymentLinkID); err != nil {
+			slog.ErrorContext(ctx, "error deactivating payment link", "site", siteName, "link", p.StripePaymentLinkID, "error", err)
+		}
+	}
+}
+
+// purgeUserArchives removes the archives of the sites a user owned and
+// returns how many there were.
+func purgeUserArchives(userID string) (int, error) {
+	archives, err := listSiteArchives("")
+	if err != nil {
+		return 0, err
+	}
+	purged := 0
+	for _, a := range archives {
+		detail, err := readArchiveDetail(a.SiteName, a.ID)
+		if err != nil {
+			return purged, err
+		}
+		if detail.Config.UserID != userID {
+			continue
+		}
+		if err := os.RemoveAll(siteArchivePath(a.SiteName, a.ID)); err != nil {
+			return purged, err
+		}
+		os.Remove(filepath.Dir(siteArchivePath(a.SiteName, a.ID)))
+		purged++
+	}
+	return purged, nil
+}
+
+// removePremiumPurchases drops the premium name purchases of a buyer.
+func removePremiumPurchases(userID, email string) error {
+	premiumNamesMu.Lock()
+	defer premiumNamesMu.Unlock()
+	purchases, err := readPremiumPurchases()
+	if err != nil {
+		return err
+	}
+	n := len(purchases)
+	for name, p := range purchases {
+		if p.Buyer != "" && (p.Buyer == userID || email != "" && strings.EqualFold(p.Buyer, email)) {
+			delete(purchases, name)
+		}
+	}
+	if len(purchases) == n {
+		return nil
+	}
+	return writePremiumPurchases(purchases)
+}
+
+// removeOrgMember takes a user out of the organizations.
+func removeOrgMember(userID, email string) error {
+	orgsMu.Lock()
+	defer orgsMu.Unlock()
+	orgs, err := readOrgs()
+	if err != nil {
+		return err
+	}
+	changed := false
+	for _, o := range orgs {
+		members := slices.DeleteFunc(o.Members, func(m string) bool {
+			return m == userID || email != "" && strings.EqualFold(m, email)
+		})
+		changed = changed || len(members) != len(o.Members)
+		o.Members = members
+	}
+	if !changed {
+		return nil
+	}
+	return writeOrgs(orgs)
+}
+
+// removeUser removes a local account; OIDC users have none.
+func removeUser(userID string) error {
+	usersMu.Lock()
+	defer usersMu.Unlock()
+	users, err := readUsers()
+	if err != nil {
+		return err
+	}
+	if _, ok := users[userID]; !ok {
+		return nil
+	}
+	delete(users, userID)
+	return writeUsers(users)
+}
+
+// lookupAccountDeletion returns the scheduled deletion of a user, nil if
+// there is none.
+func lookupAccountDeletion(userID string) (*accountDeletion, error) {
+	accountDeletionsMu.Lock()
+	defer accountDeletionsMu.Unlock()
+	deletions, err := readAccountDeletions()
+	if err != nil {
+		return nil, err
+	}
+	return deletions[userID], nil
+}
+
+// --- Handlers ---
+
+type accountDeletionRequest struct {
+	Confirm string `json:"confirm"` // the account's email
+}
+
+// deleteCurrentUserHandler schedules the deletion of the logged-in user's
+// account.
+func deleteCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireLogin(w, r) {
+		return
+	}
+	session := currentSession(r)
+	var req accountDeletionRequest
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON request", http.StatusBadRequest)
+		return
+	}
+	if session.Email == "" || !strings.EqualFold(strings.TrimSpace(req.Confirm), session.Email) {
+		apiError(w, r, http.StatusBadRequest, codeInvalidField, "Deleting the account deletes all its sites, confirm with \"confirm\": \"<your email>\"")
+		return
+	}
+	provider := "password"
+	if session.isOIDCSession() {
+		provider = "oidc"
+	}
+	d, err := scheduleAccountDeletion(r.Context(), accountDeletion{UserID: session.Subject, Email: session.Email, Provider: provider, RequestedBy: "user"})
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error scheduling account deletion", "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	respondJSONStatus(w, http.StatusAccepted, d)
+}
+
+// getAccountDeletionHandler returns the scheduled deletion of the
+// logged-in user's account.
+func getAccountDeletionHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireLogin(w, r) {
+		return
+	}
+	d, err := lookupAccountDeletion(currentUserID(r))
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error reading account deletions", "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if d == nil {
+		http.Error(w, "No deletion of this account is scheduled", http.StatusNotFound)
+		return
+	}
+	respondJSON(w, d)
+}
+
+// cancelAccountDeletionHandler cancels the deletion of the logged-in
+// user's account, or with {userId} that of any account.
+func cancelAccountDeletionHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.PathValue("userId")
+	if userID == "" {
+		if !requireLogin(w, r) {
+			return
+		}
+		userID = currentUserID(r)
+	}
+	canceled, err := cancelAccountDeletion(r.Context(), userID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error canceling account deletion", "user", userID, "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if !canceled {
+		http.Error(w, "No deletion of this account is scheduled", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// listAccountDeletionsHandler returns the scheduled deletions, the next
+// first.
+func listAccountDeletionsHandler(w http.ResponseWriter, r *http.Request) {
+	accountDeletionsMu.Lock()
+	deletions, err := readAccountDeletions()
+	accountDeletionsMu.Unlock()
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error reading account deletions", "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	list := []*accountDeletion{}
+	for _, d := range deletions {
+		list = append(list, d)
+	}
+	slices.SortFunc(list, func(a, b *accountDeletion) int { return a.DeleteAt.Compare(b.DeleteAt) })
+	respondJSON(w, list)
+}
+
+// deleteUserHandler schedules the deletion of any account, a local one or
+// the OIDC subject owning sites; with ?immediate=true it is deleted now
+// and the report returned.
+func deleteUserHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.PathValue("userId")
+	usersMu.Lock()
+	users, err := readUsers()
+	usersMu.Unlock()
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error reading users", "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	d := accountDeletion{UserID: userID, Provider: "password", RequestedBy: "admin"}
+	if user, ok := users[userID]; ok {
+		d.Email = user.Email
+	} else {
+		sites, err := ownedSites(userID)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "error listing sites", "error", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		if len(sites) == 0 {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+		d.Provider = "oidc"
+	}
+
+	if r.URL.Query().Get("immediate") != "true" {
+		scheduled, err := scheduleAccountDeletion(r.Context(), d)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "error scheduling account deletion", "user", userID, "error", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		respondJSONStatus(w, http.StatusAccepted, scheduled)
+		return
+	}
+
+	accountDeletionsMu.Lock()
+	defer accountDeletionsMu.Unlock()
+	deletions, err := readAccountDeletions()
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error reading account deletions", "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if scheduled, ok := deletions[userID]; ok {
+		d = *scheduled
+	}
+	report := deleteAccount(r.Context(), &d)
+	if report.Complete && deletions[userID] != nil {
+		delete(deletions, userID)
+		err = writeAccountDeletions(deletions)
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error writing account deletions", "error", err)
+	}
+	if !report.Complete {
+		respondJSONStatus(w, http.StatusInternalServerError, report)
+		return
+	}
+	respondJSON(w, report)
+}
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+)
+
+// Sites get certificates from an ACME CA (Let's Encrypt by default) with
+// acme.enabled. Ownership of <site>.<dns.domain> is proven with a DNS-01
+// challenge written through the DNS provider, so no web server needs to be
+// reachable yet. The scheduler issues certificates for sites without one
+// and renews them acme.renew_before their expiry; the status is kept in the
+// site config and the files in <site>/certs.
+
+const (
+	siteCertsDir      = "certs" // in the site directory
+	siteCertFile      = "fullchain.pem"
+	siteKeyFile       = "privkey.pem"
+	acmeAccountKey    = ".acme-account.key" // in sitesBaseDir
+	acmeRetryInterval = time.Hour           // after a failed attempt
+)
+
+// CertificateStatus is the state of a site's certificate.
+type CertificateStatus struct {
+	Status      string     `json:"status"` // issued or failed
+	Domains     []string   `json:"domains,omitempty"`
+	IssuedAt    *time.Time `json:"issuedAt,omitempty"`
+	NotAfter    *time.Time `json:"notAfter,omitempty"`
+	LastAttempt time.Time  `json:"lastAttempt"`
+	Error       string     `json:"error,omitempty"`
+}
+
+func siteCertPaths(siteName string) (certFile, keyFile string) {
+	dir := filepath.Join(sitesBaseDir, siteName, siteCertsDir)
+	return filepath.Join(dir, siteCertFile), filepath.Join(dir, siteKeyFile)
+}
+
+// hasCertificate reports whether a site has certificate files to serve.
+func (sc SiteConfig) hasCertificate() bool {
+	return sc.Certificate != nil && sc.Certificate.NotAfter != nil
+}
+
+var acmeState struct {
+	mu     sync.Mutex
+	client *acme.Client
+	// running guards against a renewal run overlapping the next tick.
+	running bool
+}
+
+// acmeClient returns the client with the registered account, creating the
+// account key on first use.
+func acmeClient(ctx context.Context) (*acme.Client, error) {
+	acmeState.mu.Lock()
+	defer acmeState.mu.Unlock()
+	if acmeState.client != nil {
+		return acmeState.client, nil
+	}
+	key, err := loadOrCreateKey(filepath.Join(sitesBaseDir, acmeAccountKey))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load ACME account key: %v", err)
+	}
+	client := &acme.Client{Key: key, DirectoryURL: config.ACME.DirectoryURL, UserAgent: "flox-backend/" + Version}
+	account := &acme.Account{}
+	if config.ACME.Email != "" {
+		account.Contact = []string{"mailto:" + config.ACME.Email}
+	}
+	if _, err := client.Register(ctx, account, acme.AcceptTOS); err != nil && !errors.Is(err, acme.ErrAccountAlreadyExists) {
+		return nil, fmt.Errorf("failed to register ACME account: %v", err)
+	}
+	acmeState.client = client
+	return client, nil
+}
+
+func loadOrCreateKey(path string) (crypto.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("%s is not PEM", path)
+		}
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeFileAtomic(path, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// issueCertificate orders a certificate for the site's subdomain, stores it
+// in the site directory and enables it in the vhost. The outcome is recorded
+// in the site config either way. ctx is that of the API request, if any.
+func issueCertificate(ctx context.Context, siteName string) error {
+	endRun := beginRun(ctx, siteName, "certificate")
+	start := time.Now()
+	host := siteName + "." + config.DNS.Domain
+	certPEM, keyPEM, leaf, err := orderCertificate(ctx, siteName, host)
+	if err == nil {
+		err = writeSiteCertificate(siteName, certPEM, keyPEM)
+	}
+	logStep(siteName, "certificate.issue", host, start, err)
+	endRun(err)
+
+	siteConfig, werr := updateSiteConfig(siteName, func(siteConfig *SiteConfig) error {
+		status := &CertificateStatus{Status: "failed", Domains: []string{host}, LastAttempt: time.Now().UTC()}
+		if err != nil {
+			status.Error = err.Error()
+			// Keep serving the previous certificate until it expires.
+			if prev := siteConfig.Certificate; prev != nil {
+				status.IssuedAt, status.NotAfter = prev.IssuedAt, prev.NotAfter
+			}
+		} else {
+			issuedAt, notAfter := leaf.NotBefore.UTC(), leaf.NotAfter.UTC()
+			status.Status, status.IssuedAt, status.NotAfter = "issued", &issuedAt, &notAfter
+		}
+		siteConfig.Certificate = status
+		return nil
+	})
+	if werr != nil {
+		return werr
+	}
+	if err != nil {
+		recordSiteEvent(siteName, SiteEvent{Type: "certificate.failed", Message: err.Error()})
+		return err
+	}
+	recordSiteEvent(siteName, SiteEvent{Type: "certificate.issued", Message: "valid until " + siteConfig.Certificate.NotAfter.Format(time.DateOnly)})
+	return applyVhost(siteConfig)
+}
+
+// orderCertificate runs the ACME order for host with DNS-01 challenges.
+func orderCertificate(ctx context.Context, siteName, host string) (certPEM, keyPEM []byte, leaf *x509.Certificate, err error) {
+	if err := injectFault(siteName, "certificate.issue"); err != nil {
+		return nil, nil, nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 10*time.Minute)
+	defer cancel()
+	client, err := acmeClient(ctx)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	order, err := client.AuthorizeOrder(ctx, acme.DomainIDs(host))
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to create order: %v", err)
+	}
+	for _, authzURL := range order.AuthzURLs {
+		if err := authorizeDNS01(ctx, client, siteName, authzURL); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	order, err = client.WaitOrder(ctx, order.URI)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("order failed: %v", err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: host},
+		DNSNames: []string{host},
+	}, key)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	chain, _, err := client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to finalize order: %v", err)
+	}
+	if leaf, err = x509.ParseCertificate(chain[0]); err != nil {
+		return nil, nil, nil, err
+	}
+	for _, der := range chain {
+		certPEM = append(certPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM, leaf, nil
+}
+
+// authorizeDNS01 answers the DNS-01 challenge of one authorization with a
+// TXT record at _acme-challenge.<site>, removed again afterwards.
+func authorizeDNS01(ctx context.Context, client *acme.Client, siteName, authzURL string) error {
+	authz, err := client.GetAuthorization(ctx, authzURL)
+	if err != nil {
+		return fmt.Errorf("failed to get authorization: %v", err)
+	}
+	if authz.Status == acme.StatusValid {
+		return nil
+	}
+	var chal *acme.Challenge
+	for _, c := range authz.Challenges {
+		if c.Type == "dns-01" {
+			chal = c
+		}
+	}
+	if chal == nil {
+		return errors.New("the CA offers no dns-01 challenge")
+	}
+	value, err := client.DNS01ChallengeRecord(chal.Token)
+	if err != nil {
+		return err
+	}
+
+	subname := "_acme-challenge." + siteName
+	start := time.Now()
+	err = applyRRSet(ctx, rrset{Subname: subname, Type: "TXT", TTL: 60, Records: []string{`"` + value + `"`}, Owner: siteRecordOwner(siteName)})
+	logStep(siteName, "dns.create", fmt.Sprintf("%s TXT %s", config.DNS.Provider, subname), start, err)
+	if err != nil {
+		return fmt.Errorf("failed to create challenge record: %w", err)
+	}
+	defer func() {
+		start := time.Now()
+		err := deleteRecord(ctx, subname, "TXT")
+		logStep(siteName, "dns.delete", fmt.Sprintf("%s TXT %s", config.DNS.Provider, subname), start, err)
+		if err != nil {
+			slog.Error("error deleting ACME challenge record", "site", siteName, "error", err)
+		}
+	}()
+
+	// Give the provider time to publish the record on all name servers.
+	select {
+	case <-time.After(config.ACME.PropagationWait):
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if _, err := client.Accept(ctx, chal); err != nil {
+		return fmt.Errorf("failed to accept challenge: %v", err)
+	}
+	if _, err := client.WaitAuthorization(ctx, authz.URI); err != nil {
+		return fmt.Errorf("authorization failed: %v", err)
+	}
+	return nil
+}
+
+// writeSiteCertificate replaces the certificate files of a site.
+func writeSiteCertificate(siteName string, certPEM, keyPEM []byte) error {
+	certFile, keyFile := siteCertPaths(siteName)
+	if err := os.MkdirAll(filepath.Dir(certFile), 0755); err != nil {
+		return err
+	}
+	for _, f := range []struct {
+		path string
+		data []byte
+		perm os.FileMode
+	}{{keyFile, keyPEM, 0600}, {certFile, certPEM, 0644}} {
+		if err := writeFileAtomic(f.path, f.data, f.perm); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// revokeSiteCertificate revokes the certificate of a site that goes away
+// for good, e.g. with its owner's account. Expired certificates need no
+// revocation.
+func revokeSiteCertificate(ctx context.Context, siteName string, sc SiteConfig) error {
+	if !sc.hasCertificate() || !sc.Certificate.NotAfter.After(time.Now()) {
+		return nil
+	}
+	certFile, _ := siteCertPaths(siteName)
+	data, err := os.ReadFile(certFile)
+	if err != nil {
+		return err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return fmt.Errorf("%s holds no certificate", certFile)
+	}
+	client, err := acmeClient(ctx)
+	if err != nil {
+		return err
+	}
+	return client.RevokeCert(ctx, nil, block.Bytes, acme.CRLReasonCessationOfOperation)
+}
+
+// certificateDue reports whether the scheduler should (re)issue a site's
+// certificate: none yet, expiring within acme.renew_before, or the last
+// attempt failed more than acmeRetryInterval ago.
+func certificateDue(sc SiteConfig, now time.Time) bool {
+	if sc.Unverified || sc.DNSPending || sc.DNSDelegation != nil {
+		return false
+	}
+	c := sc.Certificate
+	if c == nil {
+		return true
+	}
+	if c.Status == "failed" && now.Sub(c.LastAttempt) < acmeRetryInterval {
+		return false
+	}
+	return c.NotAfter == nil || c.NotAfter.Sub(now) < config.ACME.RenewBefore
+}
+
+// runCertificateRenewals issues the due certificates one after the other in
+// the background. It is called by the scheduler.
+func runCertificateRenewals(now time.Time) {
+	if !config.ACME.Enabled {
+		return
+	}
+	acmeState.mu.Lock()
+	if acmeState.running {
+		acmeState.mu.Unlock()
+		return
+	}
+	acmeState.running = true
+	acmeState.mu.Unlock()
+
+	go func() {
+		defer func() {
+			acmeState.mu.Lock()
+			acmeState.running = false
+			acmeState.mu.Unlock()
+		}()
+		siteNames, err := listSiteNames()
+		if err != nil {
+			slog.Error("scheduler: error listing sites", "error", err)
+			return
+		}
+		for _, siteName := range siteNames {
+			siteConfig, err := readSiteConfig(siteName)
+			if err != nil || !certificateDue(siteConfig, now) {
+				continue
+			}
+			if err := issueCertificate(context.Background(), siteName); err != nil {
+				slog.Error("scheduler: error issuing certificate", "site", siteName, "error", err)
+			}
+		}
+	}()
+}
+
+// issueCertificateHandler requests a new certificate for the site now,
+// e.g. after a failure was fixed.
+func issueCertificateHandler(w http.ResponseWriter, r *http.Request) {
+	siteName, ok := siteNameFromPath(w, r)
+	if !ok {
+		return
+	}
+	if !config.ACME.Enabled {
+		http.Error(w, "Certificates are not enabled (acme.enabled)", http.StatusNotFound)
+		return
+	}
+	siteConfig, err := readSiteConfig(siteName)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error reading site config", "site", siteName, "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if siteConfig.Unverified {
+		http.Error(w, errSiteUnverified.Error(), http.StatusConflict)
+		return
+	}
+	if siteConfig.DNSDelegation != nil {
+		http.Error(w, "The subdomain is delegated, certificates come from its nameservers' operator", http.StatusConflict)
+		return
+	}
+	issueErr := issueCertificate(r.Context(), siteName)
+	if issueErr != nil {
+		slog.ErrorContext(r.Context(), "error issuing certificate", "site", siteName, "error", issueErr)
+	}
+	siteConfig, err = readSiteConfig(siteName)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error reading site config", "site", siteName, "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if issueErr != nil {
+		respondJSONStatus(w, http.StatusBadGateway, siteConfig.Certificate)
+		return
+	}
+	respondJSON(w, siteConfig.Certificate)
+}
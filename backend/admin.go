@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+// Administrative subcommands that work on the sites directory and the DNS
+// API directly, for when the HTTP API is unavailable.
+
+var siteCommand = command{
+	subcommands: map[string]command{
+		"list": {
+			usage: "site list [--json]",
+			flags: func(fs *pflag.FlagSet) {
+				fs.BoolVar(&adminOptions.json, "json", false, "Print JSON instead of a table")
+			},
+			run: runSiteList,
+		},
+		"assign": {
+			usage: "site assign <siteName> <email or OIDC subject>",
+			run:   runSiteAssign,
+		},
+		"plan": {
+			usage: "site plan <siteName> <plan>",
+			run:   runSitePlan,
+		},
+		"check": {
+			usage: "site check [--json]",
+			flags: func(fs *pflag.FlagSet) {
+				fs.BoolVar(&adminOptions.json, "json", false, "Print JSON instead of a table")
+			},
+			run: runSiteCheck,
+		},
+		"restore-config": {
+			usage: "site restore-config <siteName>",
+			run:   runSiteRestoreConfig,
+		},
+		"accept-config": {
+			usage: "site accept-config <siteName>",
+			run:   runSiteAcceptConfig,
+		},
+	},
+}
+
+var dnsCommand = command{
+	subcommands: map[string]command{
+		"reconcile": {
+			usage: "dns reconcile [--dry-run] [--delete-orphans]",
+			flags: func(fs *pflag.FlagSet) {
+				fs.BoolVar(&adminOptions.dryRun, "dry-run", false, "Only report the differences")
+				fs.BoolVar(&adminOptions.deleteOrphans, "delete-orphans", false, "Delete A records of subdomains without a site")
+			},
+			run: runDNSReconcile,
+		},
+	},
+}
+
+var adminOptions struct {
+	json          bool
+	dryRun        bool
+	deleteOrphans bool
+}
+
+type siteSummary struct {
+	SiteName  string    `json:"siteName"`
+	URL       string    `json:"url"`
+	Style     string    `json:"style,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+	LastBuild time.Time `json:"lastBuild,omitzero"`
+	// BuildError is the error of the last build, if it failed.
+	BuildError string `json:"buildError,omitempty"`
+}
+
+func runSiteList(args []string) error {
+	siteNames, err := listSiteNames()
+	if err != nil {
+		return err
+	}
+	slices.Sort(siteNames)
+	summaries := []siteSummary{}
+	for _, siteName := range siteNames {
+		sc, err := readSiteConfig(siteName)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error reading site config for %s: %v\n", siteName, err)
+			continue
+		}
+		s := siteSummary{SiteName: siteName, URL: siteURL(siteName), Style: sc.Style, CreatedAt: sc.CreatedAt}
+		if build, err := latestBuildRecord(siteName); err == nil && build != nil {
+			s.LastBuild = build.StartedAt
+			s.BuildError = build.Error
+		}
+		summaries = append(summaries, s)
+	}
+
+	if adminOptions.json {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(summaries)
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tSTYLE\tCREATED\tLAST BUILD\tSTATUS")
+	for _, s := range summaries {
+		lastBuild, status := "-", "-"
+		if !s.LastBuild.IsZero() {
+			lastBuild, status = s.LastBuild.Format(time.DateTime), "ok"
+			if s.BuildError != "" {
+				status = "failed"
+			}
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", s.SiteName, s.Style, s.CreatedAt.Format(time.DateOnly), lastBuild, status)
+	}
+	return tw.Flush()
+}
+
+// runDNSReconcile makes the A (and with dns.ipv6 AAAA) records, or the NS
+// records of delegated sites, match the sites: missing records are
+// created, records pointing elsewhere are updated, and records of
+// subdomains without a site are reported (or deleted with
+// --delete-orphans). Only records tagged as created by this
+// instance count as orphans; records of the sites are tagged on the way.
+// All changes are sent as one batch.
+func runDNSReconcile(args []string) error {
+	siteIP := os.Getenv("SITE_IP")
+	if siteIP == "" {
+		return errors.New("SITE_IP is not set in environment")
+	}
+	siteNames, err := listSiteNames()
+	if err != nil {
+		return err
+	}
+	sets, err := listRRSets(context.Background())
+	if err != nil {
+		return err
+	}
+	recordTypes := []string{"A", "NS"}
+	if config.DNS.IPv6 != "" {
+		recordTypes = append(recordTypes, "AAAA")
+	}
+	owners, err := readDNSOwners()
+	if err != nil {
+		return err
+	}
+	// existing record sets by type and subname
+	existing := map[string]map[string]rrset{}
+	for _, t := range recordTypes {
+		existing[t] = map[string]rrset{}
+	}
+	for _, rr := range sets {
+		if byName, ok := existing[rr.Type]; ok {
+			byName[rr.Subname] = rr
+		}
+	}
+
+	var changes, adopted []rrset
+	for _, siteName := range siteNames {
+		siteConfig, _ := readSiteConfig(siteName)
+		for _, want := range wantedSiteRecords(siteConfig, siteName, siteIP) {
+			rr, ok := existing[want.Type][siteName]
+			delete(existing[want.Type], siteName)
+			switch {
+			case !ok:
+				fmt.Printf("create %s %s -> %s\n", want.Type, siteName, want.Records[0])
+			case !slices.Equal(rr.Records, want.Records):
+				fmt.Printf("update %s %s %v -> %s\n", want.Type, siteName, rr.Records, want.Records[0])
+			default:
+				if _, owned := recordOwnerOf(rr, owners); !owned {
+					adopted = append(adopted, want)
+				}
+				continue
+			}
+			changes = append(changes, want)
+		}
+	}
+
+	unmanaged := 0
+	for _, recordType := range recordTypes {
+		orphans := make([]string, 0, len(existing[recordType]))
+		for subname, rr := range existing[recordType] {
+			// The apex and www belong to the flox website itself.
+			if subname == "" || subname == "www" {
+				continue
+			}
+			// Records created by hand or by another instance are not ours
+			// to report or delete.
+			if owner, ok := recordOwnerOf(rr, owners); !ok || !owner.ours() {
+				unmanaged++
+				continue
+			}
+			orphans = append(orphans, subname)
+		}
+		slices.Sort(orphans)
+		for _, subname := range orphans {
+			records := existing[recordType][subname].Records
+			if !adminOptions.deleteOrphans {
+				fmt.Printf("orphan %s %s %v (no site; --delete-orphans removes it)\n", recordType, subname, records)
+				continue
+			}
+			fmt.Printf("delete %s %s %v\n", recordType, subname, records)
+			changes = append(changes, rrset{Subname: subname, Type: recordType, Records: []string{}})
+		}
+	}
+	if unmanaged > 0 {
+		fmt.Printf("%d record sets not created by this instance left alone\n", unmanaged)
+	}
+	if len(adopted) > 0 && !adminOptions.dryRun {
+		ownRecords(adopted)
+		fmt.Printf("%d existing site record sets tagged\n", len(adopted))
+	}
+
+	if adminOptions.dryRun || len(changes) == 0 {
+		fmt.Printf("%d changes", len(changes))
+		if adminOptions.dryRun {
+			fmt.Print(" (dry run, nothing applied)")
+		}
+		fmt.Println()
+		return nil
+	}
+	result := applyRRSets(context.Background(), changes)
+	for _, f := range result.Failed {
+		fmt.Fprintf(os.Stderr, "failed: %s %s: %s\n", f.RRSet.Type, f.RRSet.Subname, f.Error)
+	}
+	fmt.Printf("%d changes applied, %d failed\n", len(result.Applied), len(result.Failed))
+	if len(result.Failed) > 0 {
+		return fmt.Errorf("%d changes failed", len(result.Failed))
+	}
+	return nil
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"cmp"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Site names are unique across all instances serving the same base domain.
+// One instance allocates them (registry.allocator_url points at it, empty
+// means this instance); the others reserve a name there before creating the
+// site and release it if creation fails.
+
+const allocationsFile = ".allocations.json"
+
+var errNameTaken error = &APIError{Code: codeSiteExists, Message: "site name already exists"}
+
+type nameAllocation struct {
+	SiteName    string    `json:"siteName"`
+	Instance    string    `json:"instance"`
+	AllocatedAt time.Time `json:"allocatedAt"`
+}
+
+// allocationsMu serializes the read-modify-write of the allocations file.
+var allocationsMu sync.Mutex
+
+var allocatorClient = &http.Client{Timeout: 10 * time.Second}
+
+func readAllocations() (map[string]nameAllocation, error) {
+	allocations := map[string]nameAllocation{}
+	data, err := os.ReadFile(filepath.Join(sitesBaseDir, allocationsFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return allocations, nil
+		}
+		return nil, err
+	}
+	err = json.Unmarshal(data, &allocations)
+	return allocations, err
+}
+
+func writeAllocations(allocations map[string]nameAllocation) error {
+	data, err := json.MarshalIndent(allocations, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(sitesBaseDir, allocationsFile)
+	return writeFileAtomic(path, data, 0644)
+}
+
+// lookupAllocationLocal also treats sites created before allocation existed
+// as allocated to this instance.
+func lookupAllocationLocal(siteName string) (nameAllocation, bool, error) {
+	allocations, err := readAllocations()
+	if err != nil {
+		return nameAllocation{}, false, err
+	}
+	if a, ok := allocations[siteName]; ok {
+		return a, true, nil
+	}
+	exists, err := siteExists(siteName)
+	return nameAllocation{SiteName: siteName, Instance: config.Registry.Instance}, exists, err
+}
+
+func allocateNameLocal(siteName, instance string) (nameAllocation, error) {
+	allocationsMu.Lock()
+	defer allocationsMu.Unlock()
+	if _, taken, err := lookupAllocationLocal(siteName); err != nil || taken {
+		return nameAllocation{}, cmp.Or(err, errNameTaken)
+	}
+	allocations, err := readAllocations()
+	if err != nil {
+		return nameAllocation{}, err
+	}
+	a := nameAllocation{SiteName: siteName, Instance: instance, AllocatedAt: time.Now().UTC()}
+	allocations[siteName] = a
+	return a, writeAllocations(allocations)
+}
+
+// releaseNameLocal frees a name, but only for the instance that holds it.
+func releaseNameLocal(siteName, instance string) error {
+	allocationsMu.Lock()
+	defer allocationsMu.Unlock()
+	allocations, err := readAllocations()
+	if err != nil {
+		return err
+	}
+	a, ok := allocations[siteName]
+	if !ok {
+		return nil
+	}
+	if a.Instance != instance {
+		return fmt.Errorf("%s is allocated to instance %s", siteName, a.Instance)
+	}
+	delete(allocations, siteName)
+	return writeAllocations(allocations)
+}
+
+// --- Client side ---
+
+func allocatorRequest(method, siteName string, query url.Values) (*http.Response, error) {
+	// The unversioned path: an allocator of the previous release has no
+	// /api/v1 yet. Move with the removal of the aliases.
+	u := strings.TrimSuffix(config.Registry.AllocatorURL, "/") + "/api/allocations/" + url.PathEscape(siteName)
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(method, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+config.Registry.Token)
+	resp, err := allocatorClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("name allocator unreachable: %v", err)
+	}
+	return resp, nil
+}
+
+// siteNameAllocated reports whether any instance holds the name.
+func siteNameAllocated(siteName string) (bool, error) {
+	siteName = strings.ToLower(siteName)
+	if config.Registry.AllocatorURL == "" {
+		_, taken, err := lookupAllocationLocal(siteName)
+		return taken, err
+	}
+	resp, err := allocatorRequest(http.MethodGet, siteName, nil)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	}
+	return false, fmt.Errorf("name allocator: unexpected status code: %d", resp.StatusCode)
+}
+
+// allocateSiteName reserves a name for this instance before the site is
+// created. It fails with errNameTaken if any instance already has it.
+func allocateSiteName(siteName string) error {
+	siteName = strings.ToLower(siteName)
+	if err := injectFault(siteName, "name.allocate"); err != nil {
+		return err
+	}
+	if config.Registry.AllocatorURL == "" {
+		_, err := allocateNameLocal(siteName, config.Registry.Instance)
+		return err
+	}
+	resp, err := allocatorRequest(http.MethodPut, siteName, url.Values{"instance": {config.Registry.Instance}})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusCreated:
+		return nil
+	case http.StatusConflict:
+		return errNameTaken
+	}
+	return fmt.Errorf("name allocator: unexpected status code: %d", resp.StatusCode)
+}
+
+// releaseSiteName gives a name back, after a failed creation or a deletion.
+// Failures are logged; a leaked allocation only blocks the name.
+func releaseSiteName(siteName string) {
+	siteName = strings.ToLower(siteName)
+	if config.Registry.AllocatorURL == "" {
+		if err := releaseNameLocal(siteName, config.Registry.Instance); err != nil {
+			slog.Error("error releasing site name", "site", siteName, "error", err)
+		}
+		return
+	}
+	resp, err := allocatorRequest(http.MethodDelete, siteName, url.Values{"instance": {config.Registry.Instance}})
+	if err != nil {
+		slog.Error("error releasing site name", "site", siteName, "error", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		slog.Error("error releasing site name: unexpected status code", "site", siteName, "status", resp.StatusCode)
+	}
+}
+
+// --- Allocator endpoints, registered when registry.token is set ---
+
+func allocatorAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(config.Registry.Token)) != 1 {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+func allocationNameFromPath(w http.ResponseWriter, r *http.Request) (string, bool) {
+	siteName := strings.ToLower(r.PathValue("siteName"))
+	if !siteNameRegex.MatchString(siteName) {
+		http.Error(w, "Invalid site name", http.StatusBadRequest)
+		return "", false
+	}
+	return siteName, true
+}
+
+func getAllocationHandler(w http.ResponseWriter, r *http.Request) {
+	siteName, ok := allocationNameFromPath(w, r)
+	if !ok {
+		return
+	}
+	a, taken, err := lookupAllocationLocal(siteName)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error reading allocations", "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if !taken {
+		http.Error(w, "Not allocated", http.StatusNotFound)
+		return
+	}
+	respondJSON(w, a)
+}
+
+func putAllocationHandler(w http.ResponseWriter, r *http.Request) {
+	siteName, ok := allocationNameFromPath(w, r)
+	if !ok {
+		return
+	}
+	instance := r.URL.Query().Get("instance")
+	if instance == "" {
+		http.Error(w, "instance is required", http.StatusBadRequest)
+		return
+	}
+	a, err := allocateNameLocal(siteName, instance)
+	if errors.Is(err, errNameTaken) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error allocating", "site", siteName, "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	respondJSONStatus(w, http.StatusCreated, a)
+}
+
+func deleteAllocationHandler(w http.ResponseWriter, r *http.Request) {
+	siteName, ok := allocationNameFromPath(w, r)
+	if !ok {
+		return
+	}
+	if err := releaseNameLocal(siteName, r.URL.Query().Get("instance")); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
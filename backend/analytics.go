@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	siteAnalyticsDir      = "analytics" // one JSONL file of pageviews per day and source
+	defaultAnalyticsRange = 30 * 24 * time.Hour
+	maxAnalyticsRange     = 366 * 24 * time.Hour
+	analyticsTopN         = 50 // rows per dimension in the JSON response
+)
+
+// Pageview is a single collected page view. No IP addresses or other
+// identifiers are stored.
+type Pageview struct {
+	Time     time.Time `json:"time"`
+	Path     string    `json:"path"`
+	Referrer string    `json:"referrer,omitempty"` // host only
+	Country  string    `json:"country,omitempty"`  // ISO code
+}
+
+// Pageview sources. Beacon views come from the script in generated pages,
+// server views from the access log of the self-hosted mode.
+const (
+	pageviewSourceBeacon = "beacon"
+	pageviewSourceServer = "server"
+)
+
+type pageviewRequest struct {
+	Path     string `json:"path"`
+	Referrer string `json:"referrer"`
+}
+
+type analyticsCount struct {
+	Key   string `json:"key"`
+	Count int    `json:"count"`
+}
+
+type analyticsReport struct {
+	Source     string           `json:"source"`
+	From       time.Time        `json:"from"`
+	To         time.Time        `json:"to"`
+	Pageviews  int              `json:"pageviews"`
+	ByDay      []analyticsCount `json:"byDay"`
+	ByPage     []analyticsCount `json:"byPage"`
+	ByReferrer []analyticsCount `json:"byReferrer"`
+	ByCountry  []analyticsCount `json:"byCountry"`
+}
+
+var pageviewsMu sync.Mutex
+
+var botMarkers = []string{"bot", "crawl", "spider", "slurp", "headless", "lighthouse"}
+
+func isBot(userAgent string) bool {
+	ua := strings.ToLower(userAgent)
+	return ua == "" || slices.ContainsFunc(botMarkers, func(m string) bool { return strings.Contains(ua, m) })
+}
+
+func analyticsFile(siteName, source string, day time.Time) string {
+	name := day.UTC().Format(dateLayout) + ".jsonl"
+	if source != pageviewSourceBeacon {
+		name = source + "-" + name
+	}
+	return filepath.Join(sitesBaseDir, siteName, siteAnalyticsDir, name)
+}
+
+func recordPageview(siteName, source string, pv Pageview) error {
+	path := analyticsFile(siteName, source, pv.Time)
+	data, err := json.Marshal(pv)
+	if err != nil {
+		return err
+	}
+	pageviewsMu.Lock()
+	defer pageviewsMu.Unlock()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(append(data, '\n'))
+	return err
+}
+
+// readPageviews returns the pageviews in [from, to).
+func readPageviews(siteName, source string, from, to time.Time) ([]Pageview, error) {
+	var views []Pageview
+	for day := from.UTC().Truncate(24 * time.Hour); day.Before(to); day = day.AddDate(0, 0, 1) {
+		f, err := os.Open(analyticsFile(siteName, source, day))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			var pv Pageview
+			if err := json.Unmarshal(scanner.Bytes(), &pv); err != nil {
+				continue // skip lines torn by a crash
+			}
+			if !pv.Time.Before(from) && pv.Time.Before(to) {
+				views = append(views, pv)
+			}
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return views, nil
+}
+
+// parseAnalyticsRange parses ranges like "30d" or "24h".
+func parseAnalyticsRange(s string) (time.Duration, error) {
+	if s == "" {
+		return defaultAnalyticsRange, nil
+	}
+	n, err := strconv.Atoi(s[:len(s)-1])
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid range %q, use e.g. 7d or 24h", s)
+	}
+	var d time.Duration
+	switch s[len(s)-1] {
+	case 'd':
+		d = time.Duration(n) * 24 * time.Hour
+	case 'h':
+		d = time.Duration(n) * time.Hour
+	default:
+		return 0, fmt.Errorf("invalid range %q, use e.g. 7d or 24h", s)
+	}
+	if d > maxAnalyticsRange {
+		return 0, fmt.Errorf("range must be at most %d days", int(maxAnalyticsRange.Hours()/24))
+	}
+	return d, nil
+}
+
+// countBy aggregates views by key, most frequent first.
+func countBy(views []Pageview, key func(Pageview) string) []analyticsCount {
+	counts := map[string]int{}
+	for _, pv := range views {
+		counts[key(pv)]++
+	}
+	result := make([]analyticsCount, 0, len(counts))
+	for k, n := range counts {
+		result = append(result, analyticsCount{Key: k, Count: n})
+	}
+	slices.SortFunc(result, func(a, b analyticsCount) int {
+		return cmp.Or(b.Count-a.Count, strings.Compare(a.Key, b.Key))
+	})
+	return result
+}
+
+func buildAnalyticsReport(views []Pageview, source string, from, to time.Time) analyticsReport {
+	orUnknown := func(s string) string { return cmp.Or(s, "(unknown)") }
+	report := analyticsReport{
+		Source:     source,
+		From:       from,
+		To:         to,
+		Pageviews:  len(views),
+		ByPage:     countBy(views, func(pv Pageview) string { return pv.Path }),
+		ByReferrer: countBy(views, func(pv Pageview) string { return cmp.Or(pv.Referrer, "(direct)") }),
+		ByCountry:  countBy(views, func(pv Pageview) string { return orUnknown(pv.Country) }),
+		ByDay:      countBy(views, func(pv Pageview) string { return pv.Time.UTC().Format(dateLayout) }),
+	}
+	slices.SortFunc(report.ByDay, func(a, b analyticsCount) int { return strings.Compare(a.Key, b.Key) })
+	return report
+}
+
+// --- Handlers ---
+
+// collectPageviewHandler receives the beacon sent by generated pages. It is
+// sent with navigator.sendBeacon, so the body is JSON with a text/plain
+// content type.
+func collectPageviewHandler(w http.ResponseWriter, r *http.Request) {
+	siteName, ok := siteNameFromPath(w, r)
+	if !ok {
+		return
+	}
+	if isBot(r.UserAgent()) || r.Header.Get("DNT") == "1" {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	var req pageviewRequest
+	defer r.Body.Close()
+	if err := json.NewDecoder(io.LimitReader(r.Body, 4096)).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON request", http.StatusBadRequest)
+		return
+	}
+	if !strings.HasPrefix(req.Path, "/") || len(req.Path) > 512 {
+		http.Error(w, "invalid path", http.StatusBadRequest)
+		return
+	}
+
+	pv := Pageview{
+		Time:    time.Now().UTC(),
+		Path:    req.Path,
+		Country: countryForIP(clientIP(r)),
+	}
+	pv.Referrer = referrerHost(siteName, req.Referrer)
+	if err := recordPageview(siteName, pageviewSourceBeacon, pv); err != nil {
+		slog.ErrorContext(r.Context(), "error recording pageview", "site", siteName, "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// referrerHost keeps only the referring host, and drops internal navigation.
+func referrerHost(siteName, referrer string) string {
+	ref, err := url.Parse(referrer)
+	if err != nil || ref.Host == "" || ref.Host == strings.TrimPrefix(siteURL(siteName), "https://") {
+		return ""
+	}
+	return ref.Host
+}
+
+// getAnalyticsHandler aggregates the pageviews of ?range= (default 30d) by
+// page, referrer, country and day. ?source=server reports the views taken
+// from the access log instead of the beacon. ?format=csv exports the full
+// aggregation.
+func getAnalyticsHandler(w http.ResponseWriter, r *http.Request) {
+	siteName, ok := siteNameFromPath(w, r)
+	if !ok {
+		return
+	}
+	d, err := parseAnalyticsRange(r.URL.Query().Get("range"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	source := cmp.Or(r.URL.Query().Get("source"), pageviewSourceBeacon)
+	if source != pageviewSourceBeacon && source != pageviewSourceServer {
+		http.Error(w, `source must be "beacon" or "server"`, http.StatusBadRequest)
+		return
+	}
+	to := time.Now().UTC()
+	from := to.Add(-d)
+	views, err := readPageviews(siteName, source, from, to)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error reading pageviews", "site", siteName, "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	report := buildAnalyticsReport(views, source, from, to)
+
+	if r.URL.Query().Get("format") != "csv" {
+		truncate := func(c []analyticsCount) []analyticsCount { return c[:min(len(c), analyticsTopN)] }
+		report.ByPage = truncate(report.ByPage)
+		report.ByReferrer = truncate(report.ByReferrer)
+		report.ByCountry = truncate(report.ByCountry)
+		respondJSON(w, report)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", siteName+"-analytics.csv"))
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"dimension", "key", "pageviews"})
+	for _, dim := range []struct {
+		name   string
+		counts []analyticsCount
+	}{{"day", report.ByDay}, {"page", report.ByPage}, {"referrer", report.ByReferrer}, {"country", report.ByCountry}} {
+		for _, c := range dim.counts {
+			cw.Write([]string{dim.name, csvSafe(c.Key), strconv.Itoa(c.Count)})
+		}
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		slog.ErrorContext(r.Context(), "error writing analytics CSV", "site", siteName, "error", err)
+	}
+}
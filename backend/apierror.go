@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"strings"
+	"unicode"
+)
+
+// API errors: every error response of the API is a JSON APIError,
+//
+//	{"code": "SITE_EXISTS", "message": "site name already exists", "requestId": "f3c8..."}
+//
+// with details where they help, e.g. the plans including a feature. Clients
+// branch on code, which stays the same across releases; message is for
+// people and may change. Handlers report an error with a specific code by
+// returning or writing an *APIError; plain http.Error responses are
+// converted by apiErrors and get the code of their status, e.g. NOT_FOUND
+// or INTERNAL_SERVER_ERROR. Browsers asking for HTML, like visitors posting
+// a site's form without JavaScript, still get the message as text.
+
+// Codes of specific errors; the others are those of their status.
+const (
+	codeSiteExists            = "SITE_EXISTS"
+	codeSiteNotFound          = "SITE_NOT_FOUND"
+	codeSiteForbidden         = "SITE_FORBIDDEN"
+	codeSiteManaged           = "SITE_MANAGED"
+	codeJobNotFound           = "JOB_NOT_FOUND"
+	codeNameInvalid           = "NAME_INVALID"
+	codeNameReserved          = "NAME_RESERVED"
+	codeNameTaken             = "NAME_TAKEN"
+	codeNameCollision         = "NAME_COLLISION"
+	codePremiumName           = "PREMIUM_NAME"
+	codeInvalidField          = "INVALID_FIELD"
+	codeInvalidCoupon         = "INVALID_COUPON"
+	codePlanRequired          = "PLAN_REQUIRED"
+	codeFeatureUnavailable    = "FEATURE_UNAVAILABLE"
+	codeQuotaExceeded         = "QUOTA_EXCEEDED"
+	codeCreationLimited       = "CREATION_LIMITED"
+	codeDNSProvisionFailed    = "DNS_PROVISION_FAILED"
+	codeLoginRequired         = "LOGIN_REQUIRED"
+	codeInvalidToken          = "INVALID_TOKEN"
+	codeAdminRequired         = "ADMIN_REQUIRED"
+	codeRateLimited           = "RATE_LIMITED"
+	codeReadOnly              = "READ_ONLY"
+	codeVersionUnsupported    = "API_VERSION_UNSUPPORTED"
+	codeIdempotencyKeyInvalid = "IDEMPOTENCY_KEY_INVALID"
+	codeIdempotencyKeyReused  = "IDEMPOTENCY_KEY_REUSED"
+	codeIdempotencyConflict   = "IDEMPOTENCY_CONFLICT"
+)
+
+// APIError is the body of an error response. As an error, it carries its
+// code to the handler answering the request.
+type APIError struct {
+	Code      string         `json:"code"`
+	Message   string         `json:"message"`
+	Details   map[string]any `json:"details,omitempty"`
+	RequestID string         `json:"requestId,omitempty"`
+}
+
+func (e *APIError) Error() string {
+	return e.Message
+}
+
+// statusErrorCode is the code of errors without a specific one, the status
+// text in upper snake case.
+func statusErrorCode(status int) string {
+	text := http.StatusText(status)
+	if text == "" {
+		return "ERROR"
+	}
+	return strings.Join(strings.FieldsFunc(strings.ToUpper(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}), "_")
+}
+
+// errorCode returns the code of an *APIError in err's chain, fallback for
+// other errors.
+func errorCode(err error, fallback string) string {
+	var e *APIError
+	if errors.As(err, &e) {
+		return e.Code
+	}
+	return fallback
+}
+
+// apiError answers a request with an error with a specific code.
+func apiError(w http.ResponseWriter, r *http.Request, status int, code, message string) {
+	writeAPIError(w, r, status, &APIError{Code: code, Message: message})
+}
+
+// writeAPIError answers a request with e, as text to browsers asking for
+// HTML.
+func writeAPIError(w http.ResponseWriter, r *http.Request, status int, e *APIError) {
+	if prefersHTML(r) {
+		http.Error(w, e.Message, status)
+		return
+	}
+	body := *e
+	if body.Code == "" {
+		body.Code = statusErrorCode(status)
+	}
+	body.RequestID = requestIDFrom(r.Context())
+	respondJSONStatus(w, status, body)
+}
+
+// prefersHTML reports whether the client asked for HTML and not for JSON.
+func prefersHTML(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	return strings.Contains(accept, "text/html") && !strings.Contains(accept, "application/json")
+}
+
+// apiErrors converts the plain text error responses of the API to
+// APIErrors.
+func apiErrors(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/api/") || prefersHTML(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ew := &apiErrorWriter{ResponseWriter: w}
+		next.ServeHTTP(ew, r)
+		if ew.status != 0 {
+			h := w.Header()
+			h.Del("Content-Length")
+			h.Del("X-Content-Type-Options")
+			writeAPIError(w, r, ew.status, &APIError{Message: strings.TrimSpace(ew.body.String())})
+		}
+	})
+}
+
+// apiErrorWriter holds back a text/plain error response; status is set
+// while it does.
+type apiErrorWriter struct {
+	http.ResponseWriter
+	status  int
+	body    bytes.Buffer
+	written bool
+}
+
+func (ew *apiErrorWriter) WriteHeader(status int) {
+	if ew.written {
+		return
+	}
+	ew.written = true
+	if status >= http.StatusBadRequest && strings.HasPrefix(ew.Header().Get("Content-Type"), "text/plain") {
+		ew.status = status
+		return
+	}
+	ew.ResponseWriter.WriteHeader(status)
+}
+
+func (ew *apiErrorWriter) Write(p []byte) (int, error) {
+	if !ew.written {
+		ew.WriteHeader(http.StatusOK)
+	}
+	if ew.status != 0 {
+		return ew.body.Write(p)
+	}
+	return ew.ResponseWriter.Write(p)
+}
+
+func (ew *apiErrorWriter) Unwrap() http.ResponseWriter {
+	return ew.ResponseWriter
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// API versions: the routes live under /api/<version>/, so a breaking change
+// gets a new version next to the old one instead of stranding the frontends
+// and generated sites built against it. Every API response names the
+// version it was served by in API-Version. A client may send API-Version
+// too, to state the version it was written for; a version this instance
+// does not serve is refused with 406 and the list of supported versions.
+//
+// The unversioned paths /api/... of earlier releases are deprecated aliases
+// of /api/v1/... and are removed in the next release. Their responses carry
+// "Deprecation: true" and a Link to the successor version, and they are
+// counted per route in flox_api_deprecated_requests_total, so operators see
+// which clients still need updating. Sites built before the move post their
+// forms to the old paths until they are rebuilt.
+
+const (
+	apiVersionHeader           = "API-Version"
+	apiSupportedVersionsHeader = "API-Supported-Versions"
+)
+
+// apiVersions are the served API versions, oldest first; a version in
+// deprecatedAPIVersions is still served with the Deprecation header.
+var (
+	apiVersions           = []string{"v1"}
+	deprecatedAPIVersions = map[string]bool{}
+)
+
+// currentAPIVersion is the version the unversioned paths alias.
+const currentAPIVersion = "v1"
+
+var apiVersionPath = regexp.MustCompile(`^/api/(v[0-9]+)(/|$)`)
+
+// apiVersioning serves the unversioned aliases and sets the version headers
+// of the API; next is mux with its middleware.
+func apiVersioning(mux *http.ServeMux, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/api/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set(apiSupportedVersionsHeader, strings.Join(apiVersions, ", "))
+		if requested := r.Header.Get(apiVersionHeader); requested != "" && !slices.Contains(apiVersions, requested) {
+			unsupportedAPIVersion(w, r, requested, http.StatusNotAcceptable)
+			return
+		}
+		if m := apiVersionPath.FindStringSubmatch(r.URL.Path); m != nil {
+			version := m[1]
+			if !slices.Contains(apiVersions, version) {
+				unsupportedAPIVersion(w, r, version, http.StatusNotFound)
+				return
+			}
+			w.Header().Set(apiVersionHeader, version)
+			if deprecatedAPIVersions[version] {
+				w.Header().Set("Deprecation", "true")
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// An unversioned path, served like http.StripPrefix does, with a copy
+		// of the request, so the access log keeps the path the client used.
+		r2 := new(http.Request)
+		*r2 = *r
+		r2.URL = new(url.URL)
+		*r2.URL = *r.URL
+		r2.URL.Path = "/api/" + currentAPIVersion + strings.TrimPrefix(r.URL.Path, "/api")
+		if r.URL.RawPath != "" {
+			r2.URL.RawPath = "/api/" + currentAPIVersion + strings.TrimPrefix(r.URL.RawPath, "/api")
+		}
+		w.Header().Set(apiVersionHeader, currentAPIVersion)
+		w.Header().Set("Deprecation", "true")
+		w.Header().Add("Link", fmt.Sprintf("<%s>; rel=\"successor-version\"", r2.URL.EscapedPath()))
+		if _, pattern := mux.Handler(r2); pattern != "" {
+			deprecatedAPIRequests.inc(pattern)
+		}
+		next.ServeHTTP(w, r2)
+	})
+}
+
+func unsupportedAPIVersion(w http.ResponseWriter, r *http.Request, version string, status int) {
+	writeAPIError(w, r, status, &APIError{
+		Code:    codeVersionUnsupported,
+		Message: fmt.Sprintf("API version %q is not supported, supported are %s", version, strings.Join(apiVersions, ", ")),
+		Details: map[string]any{"supported": apiVersions},
+	})
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"encoding/json"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// With sites.archive_deleted, deleting a site moves its directory to
+// .archive/<siteName>/<archive ID> instead of removing it, so support can
+// still answer what was on a deleted site. Archives are read-only: the API
+// shows the config, the last build, the timeline and what the directory
+// contained, and the retention purge removes them after
+// retention.archive_days.
+
+const (
+	siteArchiveDir      = ".archive" // in sitesBaseDir
+	archiveIDLayout     = "20060102T150405.000000000Z"
+	maxArchivedFileList = 1000
+)
+
+var archiveIDRegex = regexp.MustCompile(`^\d{8}T\d{6}\.\d{9}Z$`)
+
+// archivedSite is an archive in listings.
+type archivedSite struct {
+	ID          string    `json:"id"`
+	SiteName    string    `json:"siteName"`
+	ArchivedAt  time.Time `json:"archivedAt"`
+	CreatedAt   time.Time `json:"createdAt"`
+	Description string    `json:"description,omitempty"`
+	Bytes       int64     `json:"bytes"`
+}
+
+// archivedContent summarizes one top-level entry of the site directory
+// (public, posts, forms, ...).
+type archivedContent struct {
+	Files int   `json:"files"`
+	Bytes int64 `json:"bytes"`
+}
+
+type archivedFile struct {
+	Path    string    `json:"path"`
+	Bytes   int64     `json:"bytes"`
+	ModTime time.Time `json:"modTime"`
+}
+
+type archiveDetail struct {
+	archivedSite
+	Config    SiteConfig                 `json:"config"`
+	LastBuild *BuildRecord               `json:"lastBuild"`
+	Contents  map[string]archivedContent `json:"contents"`
+	// Files are the published files (the public directory), at most
+	// maxArchivedFileList.
+	Files  []archivedFile `json:"files"`
+	Events []SiteEvent    `json:"events"`
+}
+
+func siteArchivePath(siteName, id string) string {
+	return filepath.Join(sitesBaseDir, siteArchiveDir, siteName, id)
+}
+
+// archiveSiteDir moves a deleted site into the archive and returns the
+// archive ID.
+func archiveSiteDir(siteName string) (string, error) {
+	id := time.Now().UTC().Format(archiveIDLayout)
+	dest := siteArchivePath(siteName, id)
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return "", err
+	}
+	return id, os.Rename(filepath.Join(sitesBaseDir, siteName), dest)
+}
+
+// listSiteArchives returns the archives of siteName, or of all sites if it
+// is empty, newest first.
+func listSiteArchives(siteName string) ([]archivedSite, error) {
+	siteNames := []string{siteName}
+	if siteName == "" {
+		entries, err := os.ReadDir(filepath.Join(sitesBaseDir, siteArchiveDir))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		siteNames = nil
+		for _, e := range entries {
+			if e.IsDir() && siteNameRegex.MatchString(e.Name()) {
+				siteNames = append(siteNames, e.Name())
+			}
+		}
+	}
+	archives := []archivedSite{}
+	for _, name := range siteNames {
+		entries, err := os.ReadDir(filepath.Join(sitesBaseDir, siteArchiveDir, name))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		for _, e := range entries {
+			if !e.IsDir() || !archiveIDRegex.MatchString(e.Name()) {
+				continue
+			}
+			a, err := readArchivedSite(name, e.Name())
+			if err != nil {
+				slog.Error("error reading archive", "site", name, "archive", e.Name(), "error", err)
+				continue
+			}
+			archives = append(archives, a)
+		}
+	}
+	slices.SortFunc(archives, func(a, b archivedSite) int { return b.ArchivedAt.Compare(a.ArchivedAt) })
+	return archives, nil
+}
+
+func readArchivedSite(siteName, id string) (archivedSite, error) {
+	a := archivedSite{ID: id, SiteName: siteName}
+	a.ArchivedAt, _ = time.Parse(archiveIDLayout, id)
+	dir := siteArchivePath(siteName, id)
+	var sc SiteConfig
+	data, err := os.ReadFile(filepath.Join(dir, "config.json"))
+	if err == nil {
+		err = json.Unmarshal(data, &sc)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return a, err
+	}
+	a.CreatedAt = sc.CreatedAt
+	a.Description = sc.Description
+	err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		info, err := d.Info()
+		if err == nil {
+			a.Bytes += info.Size()
+		}
+		return err
+	})
+	return a, err
+}
+
+// readArchiveDetail reads everything the API shows of an archive.
+func readArchiveDetail(siteName, id string) (*archiveDetail, error) {
+	a, err := readArchivedSite(siteName, id)
+	if err != nil {
+		return nil, err
+	}
+	dir := siteArchivePath(siteName, id)
+	detail := &archiveDetail{archivedSite: a, Contents: map[string]archivedContent{}, Files: []archivedFile{}, Events: []SiteEvent{}}
+	if data, err := os.ReadFile(filepath.Join(dir, "config.json")); err == nil {
+		var sc SiteConfig
+		if err := json.Unmarshal(data, &sc); err != nil {
+			return nil, err
+		}
+		detail.Config = sc.public()
+	}
+	if detail.LastBuild, err = readLatestBuildRecord(filepath.Join(dir, siteBuildsDir)); err != nil {
+		return nil, err
+	}
+	if detail.Events, err = readEventsFile(siteName, filepath.Join(dir, siteEventsFile)); err != nil {
+		return nil, err
+	}
+	err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, path)
+		top, rest, _ := strings.Cut(filepath.ToSlash(rel), "/")
+		c := detail.Contents[top]
+		c.Files++
+		c.Bytes += info.Size()
+		detail.Contents[top] = c
+		if top == sitePublicDir && len(detail.Files) < maxArchivedFileList {
+			detail.Files = append(detail.Files, archivedFile{Path: rest, Bytes: info.Size(), ModTime: info.ModTime().UTC()})
+		}
+		return nil
+	})
+	return detail, err
+}
+
+// purgeArchives removes the archives of sites deleted before cutoff, for the
+// retention purge. The counts are per site name.
+func purgeArchives(cutoff time.Time, dryRun bool) (map[string]purgeCount, error) {
+	archives, err := listSiteArchives("")
+	if err != nil {
+		return nil, err
+	}
+	counts := map[string]purgeCount{}
+	for _, a := range archives {
+		if !a.ArchivedAt.Before(cutoff) {
+			continue
+		}
+		if !dryRun {
+			if err := os.RemoveAll(siteArchivePath(a.SiteName, a.ID)); err != nil {
+				return counts, err
+			}
+			// Drops the site's directory once its last archive is gone.
+			os.Remove(filepath.Dir(siteArchivePath(a.SiteName, a.ID)))
+		}
+		c := counts[a.SiteName]
+		c.add(purgeCount{Items: 1, Bytes: a.Bytes})
+		counts[a.SiteName] = c
+	}
+	return counts, nil
+}
+
+// --- Handlers ---
+
+// listArchivesHandler lists the archived sites, newest first, optionally
+// only those of ?siteName=.
+func listArchivesHandler(w http.ResponseWriter, r *http.Request) {
+	siteName := r.URL.Query().Get("siteName")
+	if siteName != "" && !siteNameRegex.MatchString(siteName) {
+		http.Error(w, "Invalid site name", http.StatusBadRequest)
+		return
+	}
+	archives, err := listSiteArchives(siteName)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error listing archives", "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	respondJSON(w, map[string]any{"archives": archives})
+}
+
+// getArchiveHandler returns an archived site: its config without
+// credentials, last build, timeline and the files it contained.
+func getArchiveHandler(w http.ResponseWriter, r *http.Request) {
+	siteName, id := r.PathValue("siteName"), r.PathValue("archiveId")
+	if !siteNameRegex.MatchString(siteName) || !archiveIDRegex.MatchString(id) {
+		http.Error(w, "Archive not found", http.StatusNotFound)
+		return
+	}
+	if _, err := os.Stat(siteArchivePath(siteName, id)); err != nil {
+		if os.IsNotExist(err) {
+			http.Error(w, "Archive not found", http.StatusNotFound)
+			return
+		}
+		slog.ErrorContext(r.Context(), "error reading archive", "site", siteName, "archive", id, "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	detail, err := readArchiveDetail(siteName, id)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error reading archive", "site", siteName, "archive", id, "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	respondJSON(w, detail)
+}
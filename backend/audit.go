@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Audit log: every site creation, update and deletion, every change of a
+// DNS record set, of an organization (see orgs.go) and of a premium name
+// purchase (see premium.go) is appended to a
+// JSONL file per day in audit.dir (by default .audit in the sites
+// directory), with the actor, client IP and request ID of the API request
+// and a digest of its payload. Entries are
+// only ever appended; GET /api/v1/admin/audit reads them back, and day files
+// older than retention.audit_days are removed by the retention purge. Changes
+// made without an API request (the scheduler, the command line) have the
+// actor "system".
+
+const (
+	auditDir             = ".audit" // in sitesBaseDir unless audit.dir is set
+	defaultAuditPageSize = 100
+	maxAuditPageSize     = 1000
+)
+
+// Audit actors besides user IDs.
+const (
+	auditActorAdminToken = "admin-token"
+	auditActorAnonymous  = "anonymous"
+	auditActorSystem     = "system"
+)
+
+type auditEntry struct {
+	Time      time.Time `json:"time"`
+	Action    string    `json:"action"` // site.create, site.update, site.delete, dns.create, dns.update, dns.delete, dns.apply, org.update, org.delete, account.delete_request, account.delete_cancel or account.delete
+	SiteName  string    `json:"siteName,omitempty"`
+	Target    string    `json:"target,omitempty"` // the record set of DNS changes, e.g. "A mysite", the organization ID or the user ID
+	Actor     string    `json:"actor"`            // user ID, admin-token, anonymous or system
+	Email     string    `json:"email,omitempty"`  // of the user
+	ClientIP  string    `json:"clientIp,omitempty"`
+	RequestID string    `json:"requestId,omitempty"`
+	Digest    string    `json:"digest,omitempty"` // sha256:<hex> of the payload as JSON
+	Error     string    `json:"error,omitempty"`  // of a DNS change that failed, it may have been partly applied
+}
+
+var auditMu sync.Mutex
+
+func auditLogDir() string {
+	return cmp.Or(config.Audit.Dir, filepath.Join(sitesBaseDir, auditDir))
+}
+
+func auditFile(day time.Time) string {
+	return filepath.Join(auditLogDir(), day.UTC().Format(dateLayout)+".jsonl")
+}
+
+// purgeAuditLog removes the day files of the audit log before cutoff, for
+// retention.audit_days.
+func purgeAuditLog(cutoff time.Time, dryRun bool) (purgeCount, error) {
+	var count purgeCount
+	dir := auditLogDir()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return count, nil
+		}
+		return count, err
+	}
+	cutoffDay := cutoff.UTC().Truncate(24 * time.Hour)
+	for _, e := range entries {
+		day, err := time.Parse(dateLayout, strings.TrimSuffix(e.Name(), ".jsonl"))
+		if err != nil || e.IsDir() || !day.Before(cutoffDay) {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			return count, err
+		}
+		if !dryRun {
+			if err := os.Remove(filepath.Join(dir, e.Name())); err != nil {
+				return count, err
+			}
+		}
+		count.Items++
+		count.Bytes += info.Size()
+	}
+	return count, nil
+}
+
+type adminTokenKey struct{}
+
+// setActor fills in who made a change from the context of its API request.
+func (e *auditEntry) setActor(ctx context.Context) {
+	l := requestLogFrom(ctx)
+	if l == nil {
+		e.Actor = auditActorSystem
+		return
+	}
+	e.ClientIP, e.RequestID = l.remote, l.id
+	claims, _ := ctx.Value(userContextKey{}).(sessionClaims)
+	switch {
+	case claims.Subject != "":
+		e.Actor, e.Email = claims.Subject, claims.Email
+	case ctx.Value(adminTokenKey{}) != nil:
+		e.Actor = auditActorAdminToken
+	default:
+		e.Actor = auditActorAnonymous
+	}
+}
+
+// payloadDigest returns the SHA-256 of payload encoded as JSON, "" without
+// one.
+func payloadDigest(payload any) string {
+	if payload == nil {
+		return ""
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// recordAudit appends an entry for a change made for ctx. The write is
+// synced, but failures are only logged: the change has already happened.
+func recordAudit(ctx context.Context, action, siteName string, payload any) {
+	writeAuditEntry(ctx, auditEntry{Action: action, SiteName: siteName, Digest: payloadDigest(payload)})
+}
+
+// recordDNSAudit appends an entry for a change of a record set.
+func recordDNSAudit(ctx context.Context, action string, rr rrset, err error) {
+	e := auditEntry{Action: action, Target: strings.TrimSpace(rr.Type + " " + rr.Subname), Digest: payloadDigest(rr)}
+	if action == "dns.delete" {
+		e.Digest = ""
+	}
+	if rr.Owner != nil {
+		e.SiteName = rr.Owner.Site
+	} else if siteNameRegex.MatchString(rr.Subname) {
+		e.SiteName = rr.Subname // a site record being deleted
+	}
+	if err != nil {
+		e.Error = redactSecrets(err.Error())
+	}
+	writeAuditEntry(ctx, e)
+}
+
+func writeAuditEntry(ctx context.Context, e auditEntry) {
+	e.Time = time.Now().UTC()
+	e.setActor(ctx)
+	data, err := json.Marshal(e)
+	if err != nil {
+		slog.ErrorContext(ctx, "error encoding audit entry", "action", e.Action, "error", err)
+		return
+	}
+	auditMu.Lock()
+	defer auditMu.Unlock()
+	path := auditFile(e.Time)
+	if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+		slog.ErrorContext(ctx, "error writing audit entry", "action", e.Action, "error", err)
+		return
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0640)
+	if err != nil {
+		slog.ErrorContext(ctx, "error writing audit entry", "action", e.Action, "error", err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		slog.ErrorContext(ctx, "error writing audit entry", "action", e.Action, "error", err)
+		return
+	}
+	if err := f.Sync(); err != nil {
+		slog.ErrorContext(ctx, "error syncing audit log", "file", path, "error", err)
+	}
+}
+
+// auditFilter selects entries; empty fields match everything. An action
+// ending in "." matches by prefix, e.g. "dns.".
+type auditFilter struct {
+	siteName, actor, action string
+	since, until            time.Time
+	limit                   int
+}
+
+func (f auditFilter) match(e auditEntry) bool {
+	switch {
+	case f.siteName != "" && e.SiteName != f.siteName,
+		f.actor != "" && e.Actor != f.actor && e.Email != f.actor,
+		f.action != "" && e.Action != f.action && !(strings.HasSuffix(f.action, ".") && strings.HasPrefix(e.Action, f.action)),
+		!f.since.IsZero() && e.Time.Before(f.since),
+		!f.until.IsZero() && !e.Time.Before(f.until):
+		return false
+	}
+	return true
+}
+
+// readAuditEntries returns the matching entries, newest first.
+func readAuditEntries(f auditFilter) ([]auditEntry, error) {
+	dirEntries, err := os.ReadDir(auditLogDir())
+	if os.IsNotExist(err) {
+		return []auditEntry{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var days []string
+	for _, de := range dirEntries {
+		if day, ok := strings.CutSuffix(de.Name(), ".jsonl"); ok && !de.IsDir() {
+			days = append(days, day)
+		}
+	}
+	slices.Sort(days)
+	entries := []auditEntry{}
+	for _, day := range slices.Backward(days) {
+		if !f.since.IsZero() && day < f.since.UTC().Format(dateLayout) {
+			break
+		}
+		if !f.until.IsZero() && day > f.until.UTC().Format(dateLayout) {
+			continue
+		}
+		dayEntries, err := readAuditFile(filepath.Join(auditLogDir(), day+".jsonl"), f)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range slices.Backward(dayEntries) {
+			entries = append(entries, e)
+			if len(entries) == f.limit {
+				return entries, nil
+			}
+		}
+	}
+	return entries, nil
+}
+
+func readAuditFile(path string, f auditFilter) ([]auditEntry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var entries []auditEntry
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var e auditEntry
+		if json.Unmarshal(scanner.Bytes(), &e) == nil && f.match(e) {
+			entries = append(entries, e)
+		}
+	}
+	return entries, scanner.Err()
+}
+
+// parseAuditTime accepts RFC 3339 timestamps and dates (midnight UTC).
+func parseAuditTime(s string) (time.Time, error) {
+	if t, err := time.Parse(dateLayout, s); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// getAuditHandler returns audit entries newest first, filtered by ?site=,
+// ?actor= (user ID or email), ?action= and ?since= / ?until=, at most
+// ?limit= of them.
+func getAuditHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	f := auditFilter{siteName: q.Get("site"), actor: q.Get("actor"), action: q.Get("action")}
+	limit, ok := positiveIntParam(r, "limit", defaultAuditPageSize)
+	if !ok || limit > maxAuditPageSize {
+		http.Error(w, "limit must be between 1 and "+strconv.Itoa(maxAuditPageSize), http.StatusBadRequest)
+		return
+	}
+	f.limit = limit
+	for name, t := range map[string]*time.Time{"since": &f.since, "until": &f.until} {
+		if s := q.Get(name); s != "" {
+			var err error
+			if *t, err = parseAuditTime(s); err != nil {
+				http.Error(w, name+" must be a date (2006-01-02) or an RFC 3339 time", http.StatusBadRequest)
+				return
+			}
+		}
+	}
+	entries, err := readAuditEntries(f)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error reading audit log", "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	respondJSON(w, map[string]any{"entries": entries})
+}
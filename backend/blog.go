@@ -0,0 +1,642 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/yuin/goldmark"
+)
+
+const (
+	sitePostsDir    = "posts" // one JSON file per post
+	blogOutputDir   = "blog"  // below the public dir
+	postsPerPage    = 10
+	postsInFeed     = 20
+	maxPostBytes    = 200 << 10
+	maxTagsPerPost  = 20
+	recentPostLimit = 3
+)
+
+var postSlugRegex = regexp.MustCompile(`^[a-z0-9][a-z0-9\-]{0,99}$`)
+
+// Post is a blog post. Posts without PublishedAt are drafts; posts with a
+// future PublishedAt are published by the scheduler.
+type Post struct {
+	Slug        string     `json:"slug"`
+	Title       string     `json:"title"`
+	Content     string     `json:"content"` // Markdown
+	Tags        []string   `json:"tags,omitempty"`
+	PublishedAt *time.Time `json:"publishedAt,omitempty"`
+	CreatedAt   time.Time  `json:"createdAt"`
+	UpdatedAt   time.Time  `json:"updatedAt"`
+}
+
+type postRequest struct {
+	Slug        string     `json:"slug,omitempty"`
+	Title       string     `json:"title"`
+	Content     string     `json:"content"`
+	Tags        []string   `json:"tags,omitempty"`
+	PublishedAt *time.Time `json:"publishedAt,omitempty"`
+}
+
+func (p Post) publishedAt(t time.Time) bool {
+	return p.PublishedAt != nil && !p.PublishedAt.After(t)
+}
+
+func (req *postRequest) validate() error {
+	req.Title = strings.TrimSpace(req.Title)
+	if req.Title == "" || len(req.Title) > 200 {
+		return errors.New("title must be 1-200 characters")
+	}
+	if len(req.Content) > maxPostBytes {
+		return fmt.Errorf("content must be at most %d bytes", maxPostBytes)
+	}
+	if len(req.Tags) > maxTagsPerPost {
+		return fmt.Errorf("at most %d tags are allowed", maxTagsPerPost)
+	}
+	tags := []string{}
+	for _, tag := range req.Tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" || len(tag) > 50 {
+			return errors.New("tags must be 1-50 characters")
+		}
+		if !slices.Contains(tags, tag) {
+			tags = append(tags, tag)
+		}
+	}
+	req.Tags = tags
+	return nil
+}
+
+var nonSlugChars = regexp.MustCompile(`[^a-z0-9]+`)
+
+func slugify(title string) string {
+	slug := strings.Trim(nonSlugChars.ReplaceAllString(strings.ToLower(title), "-"), "-")
+	if len(slug) > 100 {
+		slug = strings.TrimRight(slug[:100], "-")
+	}
+	return slug
+}
+
+// --- Storage ---
+
+func postPath(siteName, slug string) string {
+	return filepath.Join(sitesBaseDir, siteName, sitePostsDir, slug+".json")
+}
+
+func readPost(siteName, slug string) (Post, error) {
+	var post Post
+	data, err := os.ReadFile(postPath(siteName, slug))
+	if err != nil {
+		return post, err
+	}
+	err = json.Unmarshal(data, &post)
+	return post, err
+}
+
+func writePost(siteName string, post Post) error {
+	if err := os.MkdirAll(filepath.Join(sitesBaseDir, siteName, sitePostsDir), 0755); err != nil {
+		return err
+	}
+	return writeJSONAtomic(postPath(siteName, post.Slug), post, 0644)
+}
+
+// readPosts returns all posts of a site, newest first; drafts come last.
+func readPosts(siteName string) ([]Post, error) {
+	posts := []Post{}
+	entries, err := os.ReadDir(filepath.Join(sitesBaseDir, siteName, sitePostsDir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return posts, nil
+		}
+		return nil, err
+	}
+	for _, e := range entries {
+		slug, ok := strings.CutSuffix(e.Name(), ".json")
+		if !ok || e.IsDir() {
+			continue
+		}
+		post, err := readPost(siteName, slug)
+		if err != nil {
+			slog.Warn("skipping unreadable post", "site", siteName, "slug", slug, "error", err)
+			continue
+		}
+		posts = append(posts, post)
+	}
+	sort.SliceStable(posts, func(i, j int) bool {
+		a, b := posts[i].PublishedAt, posts[j].PublishedAt
+		if a == nil || b == nil {
+			return b == nil && a != nil
+		}
+		return a.After(*b)
+	})
+	return posts, nil
+}
+
+func publishedPosts(posts []Post, t time.Time) []Post {
+	published := []Post{}
+	for _, p := range posts {
+		if p.publishedAt(t) {
+			published = append(published, p)
+		}
+	}
+	return published
+}
+
+// --- Build output ---
+
+type blogPostView struct {
+	Post
+	URL  string
+	HTML template.HTML
+}
+
+type blogPageData struct {
+	Site     SiteConfig
+	Title    string
+	Posts    []blogPostView
+	Post     blogPostView
+	Page     int
+	PrevURL  string
+	NextURL  string
+	FeedURL  string
+	AtomURL  string
+	BlogRoot string
+
+	Comments      []Comment
+	CommentsOpen  bool
+	CommentAction string
+}
+
+var blogTemplates = template.Must(template.New("blog").Parse(`
+{{define "head"}}<!DOCTYPE html>
+<html lang="en">
+<head>
+  <meta charset="utf-8">
+  <meta name="viewport" content="width=device-width, initial-scale=1">
+  <title>{{.Title}}</title>
+  <link rel="alternate" type="application/rss+xml" title="{{.Site.SiteName}}" href="{{.FeedURL}}">
+  <link rel="alternate" type="application/atom+xml" title="{{.Site.SiteName}}" href="{{.AtomURL}}">
+  {{range .Site.ThemeAssets}}
+  {{if eq .Type "css"}}<link rel="stylesheet" href="{{.URL}}" integrity="{{.Integrity}}" crossorigin="anonymous">{{else}}<script src="{{.URL}}" integrity="{{.Integrity}}" crossorigin="anonymous" defer></script>{{end}}
+  {{- end}}
+</head>
+<body class="theme-{{.Site.Style}}">
+  <header>
+    <p><a href="/">{{.Site.SiteName}}</a></p>
+  </header>
+{{end}}
+{{define "list"}}{{template "head" .}}
+  <main>
+    <h1>Blog</h1>
+    {{range .Posts}}
+    <article>
+      <h2><a href="{{.URL}}">{{.Title}}</a></h2>
+      <p><time datetime="{{.PublishedAt.Format "2006-01-02"}}">{{.PublishedAt.Format "January 2, 2006"}}</time></p>
+    </article>
+    {{else}}
+    <p>No posts yet.</p>
+    {{end}}
+    <nav aria-label="Pagination">
+      {{with .PrevURL}}<a href="{{.}}" rel="prev">Newer posts</a>{{end}}
+      {{with .NextURL}}<a href="{{.}}" rel="next">Older posts</a>{{end}}
+    </nav>
+  </main>
+</body>
+</html>
+{{end}}
+{{define "post"}}{{template "head" .}}
+  <main>
+    <article>
+      <h1>{{.Post.Title}}</h1>
+      <p><time datetime="{{.Post.PublishedAt.Format "2006-01-02"}}">{{.Post.PublishedAt.Format "January 2, 2006"}}</time>
+      {{range .Post.Tags}} <span class="tag">#{{.}}</span>{{end}}</p>
+      {{.Post.HTML}}
+    </article>
+    {{if or .Comments .CommentsOpen}}
+    <section id="comments">
+      <h2>Comments</h2>
+      {{range .Comments}}
+      <article class="comment">
+        <p><strong>{{.AuthorName}}</strong> <time datetime="{{.CreatedAt.Format "2006-01-02"}}">{{.CreatedAt.Format "January 2, 2006"}}</time></p>
+        <p>{{.Content}}</p>
+      </article>
+      {{end}}
+      {{if .CommentsOpen}}
+      <form method="post" action="{{.CommentAction}}">
+        <label for="comment-name">Name</label>
+        <input type="text" id="comment-name" name="authorName" maxlength="100" required>
+        <label for="comment-email">Email (not published)</label>
+        <input type="email" id="comment-email" name="authorEmail">
+        <label for="comment-content">Comment</label>
+        <textarea id="comment-content" name="content" maxlength="5000" required></textarea>
+        <button type="submit">Post comment</button>
+      </form>
+      {{end}}
+    </section>
+    {{end}}
+    <p><a href="{{.BlogRoot}}">All posts</a></p>
+  </main>
+</body>
+</html>
+{{end}}
+`))
+
+func renderMarkdown(src string) (template.HTML, error) {
+	var buf bytes.Buffer
+	// goldmark escapes raw HTML unless html.WithUnsafe is set, so the output
+	// is safe to embed.
+	if err := goldmark.Convert([]byte(src), &buf); err != nil {
+		return "", err
+	}
+	return template.HTML(buf.String()), nil
+}
+
+// renderBlog writes the post pages, the paginated listing and the feeds into
+// publicDir/blog. The directory is recreated on every build so deleted and
+// unpublished posts disappear.
+func renderBlog(siteConfig SiteConfig, publicDir string, posts []Post, comments map[string][]Comment, record *BuildRecord) error {
+	outDir := filepath.Join(publicDir, blogOutputDir)
+	if err := os.RemoveAll(outDir); err != nil {
+		return err
+	}
+
+	root := "/" + blogOutputDir + "/"
+	views := make([]blogPostView, 0, len(posts))
+	for _, p := range posts {
+		body, err := renderMarkdown(p.Content)
+		if err != nil {
+			return fmt.Errorf("failed to render post %s: %v", p.Slug, err)
+		}
+		views = append(views, blogPostView{Post: p, URL: root + p.Slug + "/", HTML: body})
+	}
+	base := blogPageData{
+		Site:     siteConfig,
+		FeedURL:  root + "feed.xml",
+		AtomURL:  root + "atom.xml",
+		BlogRoot: root,
+	}
+
+	for _, v := range views {
+		data := base
+		data.Title = v.Title + " – " + siteConfig.SiteName
+		data.Post = v
+		data.Comments = comments[v.Slug]
+		data.CommentsOpen = siteConfig.commentMode() != commentsClosed
+		data.CommentAction = fmt.Sprintf("%s/api/v1/sites/%s/posts/%s/comments",
+			strings.TrimSuffix(config.Server.PublicURL, "/"), siteConfig.SiteName, v.Slug)
+		rel := filepath.Join(blogOutputDir, v.Slug, "index.html")
+		if err := executeToFile(blogTemplates, "post", filepath.Join(publicDir, rel), data); err != nil {
+			return err
+		}
+		record.Pages = append(record.Pages, filepath.ToSlash(rel))
+	}
+
+	pages := max(1, (len(views)+postsPerPage-1)/postsPerPage)
+	for page := 1; page <= pages; page++ {
+		data := base
+		data.Title = "Blog – " + siteConfig.SiteName
+		data.Page = page
+		data.Posts = views[(page-1)*postsPerPage : min(page*postsPerPage, len(views))]
+		if page > 1 {
+			data.PrevURL = blogPageURL(page - 1)
+		}
+		if page < pages {
+			data.NextURL = blogPageURL(page + 1)
+		}
+		rel := filepath.Join(strings.TrimPrefix(blogPageURL(page), "/"), "index.html")
+		if err := executeToFile(blogTemplates, "list", filepath.Join(publicDir, rel), data); err != nil {
+			return err
+		}
+		record.Pages = append(record.Pages, filepath.ToSlash(rel))
+	}
+
+	feedViews := views[:min(postsInFeed, len(views))]
+	siteLink := siteURL(siteConfig.SiteName)
+	if err := writeXMLFile(filepath.Join(outDir, "feed.xml"), buildRSSFeed(siteConfig, siteLink, feedViews)); err != nil {
+		return err
+	}
+	return writeXMLFile(filepath.Join(outDir, "atom.xml"), buildAtomFeed(siteConfig, siteLink, feedViews))
+}
+
+func blogPageURL(page int) string {
+	if page == 1 {
+		return "/" + blogOutputDir + "/"
+	}
+	return fmt.Sprintf("/%s/page/%d/", blogOutputDir, page)
+}
+
+func executeToFile(t *template.Template, name, path string, data any) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if err := t.ExecuteTemplate(&buf, name, data); err != nil {
+		return fmt.Errorf("failed to render %s: %v", path, err)
+	}
+	return writeFileAtomic(path, buf.Bytes(), 0644)
+}
+
+// --- Feeds ---
+
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title       string    `xml:"title"`
+	Link        string    `xml:"link"`
+	Description string    `xml:"description"`
+	Items       []rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	Title       string   `xml:"title"`
+	Link        string   `xml:"link"`
+	GUID        string   `xml:"guid"`
+	PubDate     string   `xml:"pubDate"`
+	Description string   `xml:"description"`
+	Categories  []string `xml:"category"`
+}
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Updated string      `xml:"updated"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+}
+
+type atomEntry struct {
+	Title      string         `xml:"title"`
+	ID         string         `xml:"id"`
+	Published  string         `xml:"published"`
+	Updated    string         `xml:"updated"`
+	Link       atomLink       `xml:"link"`
+	Content    atomContent    `xml:"content"`
+	Categories []atomCategory `xml:"category"`
+}
+
+type atomContent struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+type atomCategory struct {
+	Term string `xml:"term,attr"`
+}
+
+func buildRSSFeed(siteConfig SiteConfig, siteLink string, posts []blogPostView) rssFeed {
+	channel := rssChannel{
+		Title:       siteConfig.SiteName,
+		Link:        siteLink + "/" + blogOutputDir + "/",
+		Description: siteConfig.Description,
+	}
+	for _, p := range posts {
+		link := siteLink + p.URL
+		channel.Items = append(channel.Items, rssItem{
+			Title:       p.Title,
+			Link:        link,
+			GUID:        link,
+			PubDate:     p.PublishedAt.Format(time.RFC1123Z),
+			Description: string(p.HTML),
+			Categories:  p.Tags,
+		})
+	}
+	return rssFeed{Version: "2.0", Channel: channel}
+}
+
+func buildAtomFeed(siteConfig SiteConfig, siteLink string, posts []blogPostView) atomFeed {
+	blogLink := siteLink + "/" + blogOutputDir + "/"
+	feed := atomFeed{
+		Title: siteConfig.SiteName,
+		ID:    blogLink,
+		Links: []atomLink{{Href: blogLink}, {Href: blogLink + "atom.xml", Rel: "self"}},
+	}
+	var updated time.Time
+	for _, p := range posts {
+		if p.UpdatedAt.After(updated) {
+			updated = p.UpdatedAt
+		}
+		entry := atomEntry{
+			Title:     p.Title,
+			ID:        siteLink + p.URL,
+			Published: p.PublishedAt.Format(time.RFC3339),
+			Updated:   p.UpdatedAt.Format(time.RFC3339),
+			Link:      atomLink{Href: siteLink + p.URL},
+			Content:   atomContent{Type: "html", Body: string(p.HTML)},
+		}
+		for _, tag := range p.Tags {
+			entry.Categories = append(entry.Categories, atomCategory{Term: tag})
+		}
+		feed.Entries = append(feed.Entries, entry)
+	}
+	if updated.IsZero() {
+		updated = siteConfig.CreatedAt
+	}
+	feed.Updated = updated.Format(time.RFC3339)
+	return feed
+}
+
+func writeXMLFile(path string, v any) error {
+	buf := bytes.NewBufferString(xml.Header)
+	encoder := xml.NewEncoder(buf)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(v); err != nil {
+		return err
+	}
+	return writeFileAtomic(path, buf.Bytes(), 0644)
+}
+
+// --- Handlers ---
+
+// postFromPath loads the {slug} post of the {siteName} site. On failure an
+// error response has already been written.
+func postFromPath(w http.ResponseWriter, r *http.Request) (string, Post, bool) {
+	siteName, ok := siteNameFromPath(w, r)
+	if !ok {
+		return "", Post{}, false
+	}
+	slug := r.PathValue("slug")
+	if !postSlugRegex.MatchString(slug) {
+		http.Error(w, "Post not found", http.StatusNotFound)
+		return "", Post{}, false
+	}
+	post, err := readPost(siteName, slug)
+	if err != nil {
+		if os.IsNotExist(err) {
+			http.Error(w, "Post not found", http.StatusNotFound)
+		} else {
+			slog.ErrorContext(r.Context(), "error reading post", "site", siteName, "slug", slug, "error", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		}
+		return "", Post{}, false
+	}
+	return siteName, post, true
+}
+
+// listPostsHandler returns all posts including drafts, optionally filtered
+// with ?tag=.
+func listPostsHandler(w http.ResponseWriter, r *http.Request) {
+	siteName, ok := siteNameFromPath(w, r)
+	if !ok {
+		return
+	}
+	posts, err := readPosts(siteName)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error reading posts", "site", siteName, "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if tag := strings.ToLower(r.URL.Query().Get("tag")); tag != "" {
+		filtered := []Post{}
+		for _, p := range posts {
+			if slices.Contains(p.Tags, tag) {
+				filtered = append(filtered, p)
+			}
+		}
+		posts = filtered
+	}
+	respondJSON(w, posts)
+}
+
+func getPostHandler(w http.ResponseWriter, r *http.Request) {
+	_, post, ok := postFromPath(w, r)
+	if !ok {
+		return
+	}
+	respondJSON(w, post)
+}
+
+func createPostHandler(w http.ResponseWriter, r *http.Request) {
+	siteName, ok := siteNameFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	var req postRequest
+	r.Body = http.MaxBytesReader(w, r.Body, 2*maxPostBytes)
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON request", http.StatusBadRequest)
+		return
+	}
+	if err := req.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Slug == "" {
+		req.Slug = slugify(req.Title)
+	}
+	if !postSlugRegex.MatchString(req.Slug) {
+		http.Error(w, "slug must be 1-100 lowercase letters, digits or hyphens", http.StatusBadRequest)
+		return
+	}
+	if _, err := os.Stat(postPath(siteName, req.Slug)); err == nil {
+		http.Error(w, "A post with this slug already exists", http.StatusConflict)
+		return
+	}
+
+	now := time.Now().UTC()
+	post := Post{
+		Slug:        req.Slug,
+		Title:       req.Title,
+		Content:     req.Content,
+		Tags:        req.Tags,
+		PublishedAt: req.PublishedAt,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+	if err := writePost(siteName, post); err != nil {
+		slog.ErrorContext(r.Context(), "error writing post", "site", siteName, "slug", post.Slug, "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	recordSiteEvent(siteName, SiteEvent{Type: "post.created", Message: post.Slug})
+	rebuildForPost(siteName, post, now)
+	respondJSONStatus(w, http.StatusCreated, post)
+}
+
+func updatePostHandler(w http.ResponseWriter, r *http.Request) {
+	siteName, post, ok := postFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	var req postRequest
+	r.Body = http.MaxBytesReader(w, r.Body, 2*maxPostBytes)
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON request", http.StatusBadRequest)
+		return
+	}
+	if err := req.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now().UTC()
+	wasPublished := post.publishedAt(now)
+	post.Title = req.Title
+	post.Content = req.Content
+	post.Tags = req.Tags
+	post.PublishedAt = req.PublishedAt
+	post.UpdatedAt = now
+	if err := writePost(siteName, post); err != nil {
+		slog.ErrorContext(r.Context(), "error writing post", "site", siteName, "slug", post.Slug, "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	recordSiteEvent(siteName, SiteEvent{Type: "post.updated", Message: post.Slug})
+	if wasPublished || post.publishedAt(now) {
+		rebuildForPost(siteName, post, now)
+	}
+	respondJSON(w, post)
+}
+
+func deletePostHandler(w http.ResponseWriter, r *http.Request) {
+	siteName, post, ok := postFromPath(w, r)
+	if !ok {
+		return
+	}
+	if err := os.Remove(postPath(siteName, post.Slug)); err != nil {
+		slog.ErrorContext(r.Context(), "error deleting post", "site", siteName, "slug", post.Slug, "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	recordSiteEvent(siteName, SiteEvent{Type: "post.deleted", Message: post.Slug})
+	rebuildForPost(siteName, post, time.Now().UTC())
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// rebuildForPost rebuilds the site if the change is visible right away;
+// future posts are picked up by the scheduler.
+func rebuildForPost(siteName string, post Post, now time.Time) {
+	if post.PublishedAt != nil && post.PublishedAt.After(now) {
+		return
+	}
+	if _, err := buildSite(siteName); err != nil {
+		slog.Error("error building site", "site", siteName, "error", err)
+	}
+}
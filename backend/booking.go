@@ -0,0 +1,508 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	siteBookingsFile    = "bookings.json"
+	defaultSlotMinutes  = 30
+	defaultHorizonDays  = 30
+	calendarCacheMaxAge = 5 * time.Minute
+)
+
+// BookingConfig describes when visitors can book appointments on a site.
+type BookingConfig struct {
+	Timezone    string         `json:"timezone,omitempty"` // IANA name, defaults to UTC
+	SlotMinutes int            `json:"slotMinutes,omitempty"`
+	HorizonDays int            `json:"horizonDays,omitempty"` // how far ahead slots are offered
+	Hours       []BookingHours `json:"hours"`
+	// iCalendar feed of the owner's calendar (Google Calendar secret address,
+	// CalDAV export URL, ...). Events in it block the overlapping slots. The
+	// CalDAV protocol and the Google Calendar API are not supported.
+	CalendarURL string `json:"calendarUrl,omitempty"`
+	NotifyEmail string `json:"notifyEmail,omitempty"`
+}
+
+// BookingHours is a weekly recurring range in which slots are offered.
+type BookingHours struct {
+	Weekday time.Weekday `json:"weekday"` // 0 = Sunday
+	Start   string       `json:"start"`   // "09:00"
+	End     string       `json:"end"`     // "17:00"
+}
+
+type Booking struct {
+	ID        string    `json:"id"`
+	Start     time.Time `json:"start"`
+	End       time.Time `json:"end"`
+	Name      string    `json:"name"`
+	Email     string    `json:"email"`
+	Note      string    `json:"note,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+type bookingRequest struct {
+	Start time.Time `json:"start"`
+	Name  string    `json:"name"`
+	Email string    `json:"email"`
+	Note  string    `json:"note,omitempty"`
+}
+
+type bookingSlot struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+type busyRange struct {
+	start, end time.Time
+}
+
+var bookingsMu sync.Mutex
+
+func (bc *BookingConfig) location() *time.Location {
+	if bc.Timezone == "" {
+		return time.UTC
+	}
+	loc, err := time.LoadLocation(bc.Timezone)
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
+func (bc *BookingConfig) slotLength() time.Duration {
+	if bc.SlotMinutes <= 0 {
+		return defaultSlotMinutes * time.Minute
+	}
+	return time.Duration(bc.SlotMinutes) * time.Minute
+}
+
+func (bc *BookingConfig) validate() error {
+	if bc.Timezone != "" {
+		if _, err := time.LoadLocation(bc.Timezone); err != nil {
+			return fmt.Errorf("unknown timezone %q", bc.Timezone)
+		}
+	}
+	if bc.SlotMinutes < 0 || bc.SlotMinutes > 24*60 {
+		return errors.New("slotMinutes must be between 1 and 1440")
+	}
+	if bc.HorizonDays < 0 || bc.HorizonDays > 365 {
+		return errors.New("horizonDays must be between 1 and 365")
+	}
+	for _, h := range bc.Hours {
+		if h.Weekday < time.Sunday || h.Weekday > time.Saturday {
+			return fmt.Errorf("invalid weekday %d", h.Weekday)
+		}
+		start, err1 := parseClock(h.Start)
+		end, err2 := parseClock(h.End)
+		if err1 != nil || err2 != nil || end <= start {
+			return fmt.Errorf("invalid hours %s-%s", h.Start, h.End)
+		}
+	}
+	if bc.CalendarURL != "" {
+		if err := validateOwnerURL(bc.CalendarURL, "calendarUrl"); err != nil {
+			return err
+		}
+	}
+	if bc.NotifyEmail != "" {
+		if _, err := mail.ParseAddress(bc.NotifyEmail); err != nil {
+			return errors.New("invalid notifyEmail")
+		}
+	}
+	return nil
+}
+
+// parseClock parses "HH:MM" into an offset from midnight.
+func parseClock(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// availableSlots lists the free slots between from and to, excluding booked
+// slots, calendar events and slots that already started.
+func availableSlots(bc *BookingConfig, bookings []Booking, busy []busyRange, from, to, now time.Time) []bookingSlot {
+	loc := bc.location()
+	length := bc.slotLength()
+	slots := []bookingSlot{}
+
+	day := time.Date(from.In(loc).Year(), from.In(loc).Month(), from.In(loc).Day(), 0, 0, 0, 0, loc)
+	for ; day.Before(to); day = day.AddDate(0, 0, 1) {
+		for _, h := range bc.Hours {
+			if day.Weekday() != h.Weekday {
+				continue
+			}
+			startOffset, _ := parseClock(h.Start)
+			endOffset, _ := parseClock(h.End)
+			// Compute wall clock times with time.Date so DST changes are handled.
+			rangeEnd := day.Add(endOffset)
+			for start := day.Add(startOffset); !start.Add(length).After(rangeEnd); start = start.Add(length) {
+				end := start.Add(length)
+				if start.Before(now) || start.Before(from) || !start.Before(to) {
+					continue
+				}
+				if slotTaken(start, end, bookings, busy) {
+					continue
+				}
+				slots = append(slots, bookingSlot{Start: start, End: end})
+			}
+		}
+	}
+	return slots
+}
+
+func slotTaken(start, end time.Time, bookings []Booking, busy []busyRange) bool {
+	for _, b := range bookings {
+		if start.Before(b.End) && b.Start.Before(end) {
+			return true
+		}
+	}
+	for _, b := range busy {
+		if start.Before(b.end) && b.start.Before(end) {
+			return true
+		}
+	}
+	return false
+}
+
+func readBookings(siteName string) ([]Booking, error) {
+	bookings := []Booking{}
+	data, err := os.ReadFile(filepath.Join(sitesBaseDir, siteName, siteBookingsFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return bookings, nil
+		}
+		return nil, err
+	}
+	err = json.Unmarshal(data, &bookings)
+	return bookings, err
+}
+
+func writeBookings(siteName string, bookings []Booking) error {
+	return writeJSONAtomic(filepath.Join(sitesBaseDir, siteName, siteBookingsFile), bookings, 0640)
+}
+
+// --- Calendar feed ---
+
+type calendarCacheEntry struct {
+	fetchedAt time.Time
+	busy      []busyRange
+}
+
+var (
+	calendarCacheMu sync.Mutex
+	calendarCache   = map[string]calendarCacheEntry{}
+)
+
+// calendarBusyRanges fetches the events of an iCalendar feed, cached for a
+// few minutes so the public slots endpoint does not hit the calendar on
+// every request. Recurring events (RRULE) are not expanded.
+func calendarBusyRanges(url string) ([]busyRange, error) {
+	if url == "" {
+		return nil, nil
+	}
+	calendarCacheMu.Lock()
+	entry, ok := calendarCache[url]
+	calendarCacheMu.Unlock()
+	if ok && time.Since(entry.fetchedAt) < calendarCacheMaxAge {
+		return entry.busy, nil
+	}
+
+	resp, err := ownerURLClient.Get(url)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch calendar: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch calendar: unexpected status code: %d", resp.StatusCode)
+	}
+
+	busy, err := parseICalendarBusy(bufio.NewScanner(resp.Body))
+	if err != nil {
+		return nil, err
+	}
+	calendarCacheMu.Lock()
+	calendarCache[url] = calendarCacheEntry{fetchedAt: time.Now(), busy: busy}
+	calendarCacheMu.Unlock()
+	return busy, nil
+}
+
+func parseICalendarBusy(scanner *bufio.Scanner) ([]busyRange, error) {
+	// Unfold continuation lines (RFC 5545 3.1) first.
+	var lines []string
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) && len(lines) > 0 {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		lines = append(lines, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	var busy []busyRange
+	var inEvent, transparent bool
+	var start, end time.Time
+	for _, line := range lines {
+		name, params, value := splitICalLine(line)
+		switch {
+		case name == "BEGIN" && value == "VEVENT":
+			inEvent, transparent = true, false
+			start, end = time.Time{}, time.Time{}
+		case name == "END" && value == "VEVENT":
+			inEvent = false
+			if start.IsZero() || transparent {
+				continue
+			}
+			if end.IsZero() {
+				end = start.AddDate(0, 0, 1) // all-day event without DTEND
+			}
+			busy = append(busy, busyRange{start: start, end: end})
+		case inEvent && name == "DTSTART":
+			start, _ = parseICalTime(params, value)
+		case inEvent && name == "DTEND":
+			end, _ = parseICalTime(params, value)
+		case inEvent && name == "TRANSP":
+			transparent = value == "TRANSPARENT"
+		}
+	}
+	return busy, nil
+}
+
+func splitICalLine(line string) (name string, params map[string]string, value string) {
+	head, value, _ := strings.Cut(line, ":")
+	parts := strings.Split(head, ";")
+	params = map[string]string{}
+	for _, p := range parts[1:] {
+		if k, v, ok := strings.Cut(p, "="); ok {
+			params[strings.ToUpper(k)] = strings.Trim(v, `"`)
+		}
+	}
+	return strings.ToUpper(parts[0]), params, value
+}
+
+func parseICalTime(params map[string]string, value string) (time.Time, error) {
+	loc := time.UTC
+	if tzid := params["TZID"]; tzid != "" {
+		if l, err := time.LoadLocation(tzid); err == nil {
+			loc = l
+		}
+	}
+	switch {
+	case params["VALUE"] == "DATE" || len(value) == 8:
+		return time.ParseInLocation("20060102", value, loc)
+	case strings.HasSuffix(value, "Z"):
+		return time.Parse("20060102T150405Z", value)
+	default:
+		return time.ParseInLocation("20060102T150405", value, loc)
+	}
+}
+
+// --- Handlers ---
+
+func putBookingConfigHandler(w http.ResponseWriter, r *http.Request) {
+	siteName, ok := siteNameFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	var bc BookingConfig
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&bc); err != nil {
+		http.Error(w, "Invalid JSON request", http.StatusBadRequest)
+		return
+	}
+	if err := bc.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if _, err := updateSiteConfig(siteName, func(siteConfig *SiteConfig) error {
+		siteConfig.Booking = &bc
+		return nil
+	}); err != nil {
+		writeSiteUpdateError(w, r, siteName, err)
+		return
+	}
+	recordSiteEvent(siteName, SiteEvent{Type: "booking.configured"})
+
+	if _, err := buildSite(siteName); err != nil {
+		slog.ErrorContext(r.Context(), "error building site", "site", siteName, "error", err)
+	}
+	respondJSON(w, bc)
+}
+
+// loadBookingState reads everything needed to compute free slots. On failure
+// an error response has already been written.
+func loadBookingState(w http.ResponseWriter, siteName string) (*BookingConfig, []Booking, []busyRange, bool) {
+	siteConfig, err := readSiteConfig(siteName)
+	if err != nil {
+		slog.Error("error reading site config", "site", siteName, "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return nil, nil, nil, false
+	}
+	if siteConfig.Booking == nil {
+		http.Error(w, "Booking is not enabled for this site", http.StatusNotFound)
+		return nil, nil, nil, false
+	}
+	bookings, err := readBookings(siteName)
+	if err != nil {
+		slog.Error("error reading bookings", "site", siteName, "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return nil, nil, nil, false
+	}
+	busy, err := calendarBusyRanges(siteConfig.Booking.CalendarURL)
+	if err != nil {
+		// Offering slots that might collide is worse than offering none.
+		slog.Error("error reading calendar", "site", siteName, "error", err)
+		http.Error(w, "Calendar temporarily unavailable", http.StatusServiceUnavailable)
+		return nil, nil, nil, false
+	}
+	return siteConfig.Booking, bookings, busy, true
+}
+
+// getBookingSlotsHandler is public: ?from=YYYY-MM-DD&days=N (default today, 7).
+func getBookingSlotsHandler(w http.ResponseWriter, r *http.Request) {
+	siteName, ok := siteNameFromPath(w, r)
+	if !ok {
+		return
+	}
+	bc, bookings, busy, ok := loadBookingState(w, siteName)
+	if !ok {
+		return
+	}
+
+	now := time.Now()
+	from := now
+	if s := r.URL.Query().Get("from"); s != "" {
+		t, err := time.ParseInLocation("2006-01-02", s, bc.location())
+		if err != nil {
+			http.Error(w, "Invalid from date", http.StatusBadRequest)
+			return
+		}
+		from = t
+	}
+	days := 7
+	if s := r.URL.Query().Get("days"); s != "" {
+		if _, err := fmt.Sscanf(s, "%d", &days); err != nil || days < 1 || days > 31 {
+			http.Error(w, "days must be between 1 and 31", http.StatusBadRequest)
+			return
+		}
+	}
+	horizon := bc.HorizonDays
+	if horizon <= 0 {
+		horizon = defaultHorizonDays
+	}
+	to := from.AddDate(0, 0, days)
+	if limit := now.AddDate(0, 0, horizon); to.After(limit) {
+		to = limit
+	}
+
+	respondJSON(w, availableSlots(bc, bookings, busy, from, to, now))
+}
+
+// createBookingHandler is the public booking endpoint.
+func createBookingHandler(w http.ResponseWriter, r *http.Request) {
+	siteName, ok := siteNameFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	var req bookingRequest
+	r.Body = http.MaxBytesReader(w, r.Body, maxSubmissionBytes)
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON request", http.StatusBadRequest)
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" || len(req.Name) > 200 {
+		http.Error(w, "name is required", http.StatusBadRequest)
+		return
+	}
+	addr, err := mail.ParseAddress(req.Email)
+	if err != nil {
+		http.Error(w, "invalid email address", http.StatusBadRequest)
+		return
+	}
+	if len(req.Note) > defaultFieldMaxChars {
+		http.Error(w, "note is too long", http.StatusBadRequest)
+		return
+	}
+
+	bookingsMu.Lock()
+	defer bookingsMu.Unlock()
+	bc, bookings, busy, ok := loadBookingState(w, siteName)
+	if !ok {
+		return
+	}
+	start := req.Start
+	end := start.Add(bc.slotLength())
+	free := availableSlots(bc, bookings, busy, start, end, time.Now())
+	if len(free) == 0 || !free[0].Start.Equal(start) {
+		respondJSONStatus(w, http.StatusConflict, map[string]string{"error": "slot is not available"})
+		return
+	}
+
+	booking := Booking{
+		ID:        newID(),
+		Start:     start,
+		End:       end,
+		Name:      req.Name,
+		Email:     addr.Address,
+		Note:      req.Note,
+		CreatedAt: time.Now().UTC(),
+	}
+	if err := writeBookings(siteName, append(bookings, booking)); err != nil {
+		slog.ErrorContext(r.Context(), "error writing bookings", "site", siteName, "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	recordSiteEvent(siteName, SiteEvent{Type: "booking.created", Message: booking.ID})
+	fireRESTHooks(siteName, "booking.created", booking.ID, "", booking)
+
+	when := booking.Start.In(bc.location()).Format("Mon, 02 Jan 2006 15:04 MST")
+	go func() {
+		data := map[string]any{"Name": booking.Name, "SiteURL": siteURL(siteName), "When": when}
+		if err := sendTemplateEmail(booking.Email, "booking_confirmation", data); err != nil {
+			slog.ErrorContext(r.Context(), "error sending booking confirmation", "site", siteName, "error", err)
+		}
+		if bc.NotifyEmail != "" {
+			data := map[string]any{"SiteName": siteName, "Name": booking.Name, "Email": booking.Email, "When": when, "Note": booking.Note}
+			if err := sendTemplateEmail(bc.NotifyEmail, "booking_notification", data); err != nil {
+				slog.ErrorContext(r.Context(), "error sending booking notification", "site", siteName, "error", err)
+			}
+		}
+	}()
+
+	respondJSONStatus(w, http.StatusCreated, booking)
+}
+
+func listBookingsHandler(w http.ResponseWriter, r *http.Request) {
+	siteName, ok := siteNameFromPath(w, r)
+	if !ok {
+		return
+	}
+	bookings, err := readBookings(siteName)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error reading bookings", "site", siteName, "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	respondJSON(w, bookings)
+}
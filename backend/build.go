@@ -0,0 +1,450 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	sitePublicDir = "public" // generated pages, served as the site's web root
+	siteBuildsDir = "builds" // one JSON record per build
+)
+
+// BuildRecord describes a single build of a site's public pages.
+type BuildRecord struct {
+	ID            string          `json:"id"`
+	SiteName      string          `json:"siteName"`
+	StartedAt     time.Time       `json:"startedAt"`
+	FinishedAt    time.Time       `json:"finishedAt"`
+	Pages         []string        `json:"pages"`
+	Sections      []string        `json:"sections"`               // sections published at build time
+	ThemeVersion  string          `json:"themeVersion,omitempty"` // of the theme assets the pages link
+	Accessibility []A11yViolation `json:"accessibility"`
+	Error         string          `json:"error,omitempty"`
+}
+
+type sitePageData struct {
+	Site        SiteConfig
+	Title       string
+	Sections    []sectionView
+	Nav         []navItem // empty for one-pagers
+	APIBase     string    // prefix for form actions and other API calls
+	BuildID     string    // checked by the warm-up, see warmup.go
+	RecentPosts []Post
+	SocialPosts map[string][]SocialPost // by feed ID
+	Location    *locationView
+	Hours       *openingHoursView
+}
+
+type sectionView struct {
+	ID   string
+	Name string
+}
+
+var defaultSiteTemplate = template.Must(template.New("site").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+  <meta charset="utf-8">
+  <meta name="viewport" content="width=device-width, initial-scale=1">
+  <title>{{.Title}}</title>
+  {{with .BuildID}}<meta name="flox-build" content="{{.}}">{{end}}
+  {{with .Site.Description}}<meta name="description" content="{{.}}">{{end}}
+  {{range .Site.ThemeAssets}}
+  {{if eq .Type "css"}}<link rel="stylesheet" href="{{.URL}}" integrity="{{.Integrity}}" crossorigin="anonymous">{{else}}<script src="{{.URL}}" integrity="{{.Integrity}}" crossorigin="anonymous" defer></script>{{end}}
+  {{- end}}
+</head>
+<body class="theme-{{.Site.Style}}">
+  <header>
+    <h1>{{.Site.SiteName}}</h1>
+    {{with .Site.Description}}<p>{{.}}</p>{{end}}
+    {{if .Nav}}
+    <nav aria-label="Main">
+      <ul>
+        {{range .Nav}}<li><a href="{{.URL}}"{{if .Current}} aria-current="page"{{end}}>{{.Title}}</a></li>
+        {{end}}
+      </ul>
+    </nav>
+    {{end}}
+  </header>
+  <main>
+    {{range .Sections}}
+    <section id="{{.ID}}">
+      <h2>{{.Name}}</h2>
+      {{if eq .ID "form"}}{{range $.Site.Forms}}{{$form := .}}
+      <form method="post" action="{{$.APIBase}}/api/v1/sites/{{$.Site.SiteName}}/forms/{{.ID}}/submissions">
+        <h3>{{.Title}}</h3>
+        {{range .Fields}}
+        <div>
+          {{if eq .Type "checkbox"}}
+          <input type="checkbox" id="form-{{$form.ID}}-{{.Name}}" name="{{.Name}}"{{if .Required}} required{{end}}>
+          <label for="form-{{$form.ID}}-{{.Name}}">{{.Label}}</label>
+          {{else if eq .Type "select"}}
+          <label for="form-{{$form.ID}}-{{.Name}}">{{.Label}}</label>
+          <select id="form-{{$form.ID}}-{{.Name}}" name="{{.Name}}"{{if .Required}} required{{end}}>
+            <option value=""></option>
+            {{range .Options}}<option>{{.}}</option>{{end}}
+          </select>
+          {{else}}
+          <label for="form-{{$form.ID}}-{{.Name}}">{{.Label}}</label>
+          <input type="text" id="form-{{$form.ID}}-{{.Name}}" name="{{.Name}}"{{if .MaxLength}} maxlength="{{.MaxLength}}"{{end}}{{if .Required}} required{{end}}>
+          {{end}}
+        </div>
+        {{end}}
+        <button type="submit">{{or .SubmitLabel "Send"}}</button>
+      </form>
+      {{end}}{{end}}
+      {{if eq .ID "blog"}}
+      <ul>
+        {{range $.RecentPosts}}<li><a href="/blog/{{.Slug}}/">{{.Title}}</a></li>{{end}}
+      </ul>
+      <p><a href="/blog/">All posts</a></p>
+      {{end}}
+      {{if and (eq .ID "newsletter") $.Site.Newsletter}}
+      <form method="post" action="{{$.APIBase}}/api/v1/sites/{{$.Site.SiteName}}/newsletter/subscribe">
+        <label for="newsletter-email">Email</label>
+        <input type="email" id="newsletter-email" name="email" required>
+        <button type="submit">Subscribe</button>
+      </form>
+      {{end}}
+      {{if eq .ID "social"}}{{range $.Site.SocialFeeds}}
+      <ul class="social-feed social-{{.Provider}}">
+        {{range index $.SocialPosts .ID}}
+        <li>
+          {{if .ImageURL}}<img src="{{.ImageURL}}" alt="" loading="lazy">{{end}}
+          {{with .Text}}<p>{{.}}</p>{{end}}
+          <a href="{{.URL}}" rel="noopener"><time datetime="{{.PublishedAt.Format "2006-01-02T15:04:05Z07:00"}}">{{.PublishedAt.Format "2 Jan 2006"}}</time></a>
+        </li>
+        {{end}}
+      </ul>
+      {{end}}{{end}}
+      {{if and (eq .ID "location") $.Location}}{{with $.Location}}
+      <address>{{.Address}}</address>
+      {{if .StaticMap}}
+      <img src="/{{.StaticMap}}" alt="Map showing {{.Address}}" width="640" height="320">
+      <p class="map-attribution"><small>Map data &copy; Google</small></p>
+      {{else}}
+      <iframe title="Map showing {{.Address}}" src="{{.EmbedURL}}" width="640" height="320" loading="lazy"></iframe>
+      <p class="map-attribution"><small>&copy; <a href="https://www.openstreetmap.org/copyright" rel="noopener">OpenStreetMap</a> contributors</small></p>
+      {{end}}
+      <p><a href="{{.MapURL}}" rel="noopener">View larger map</a></p>
+      {{end}}{{end}}
+      {{if and (eq .ID "hours") $.Hours}}{{with $.Hours}}
+      <table class="opening-hours">
+        {{range .Rows}}<tr><th scope="row">{{.Day}}</th><td>{{range $i, $h := .Hours}}{{if $i}}, {{end}}{{$h}}{{else}}Closed{{end}}</td></tr>
+        {{end}}
+      </table>
+      {{if .Exceptions}}
+      <ul class="opening-exceptions">
+        {{range .Exceptions}}<li>{{.From}}{{if ne .Until .From}} – {{.Until}}{{end}}: {{if .Opens}}{{.Opens}}–{{.Closes}}{{else}}Closed{{end}}{{with .Note}} ({{.}}){{end}}</li>
+        {{end}}
+      </ul>
+      {{end}}
+      <script type="application/ld+json">{{.JSONLD}}</script>
+      {{end}}{{end}}
+      {{if eq .ID "shop"}}
+      <p><a href="/shop/">Visit the shop</a></p>
+      {{end}}
+      {{if and (eq .ID "booking") $.Site.Booking}}
+      <div class="booking" data-endpoint="{{$.APIBase}}/api/v1/sites/{{$.Site.SiteName}}/booking">
+        <label for="booking-slot">Available times</label>
+        <select id="booking-slot"></select>
+        <label for="booking-name">Name</label>
+        <input type="text" id="booking-name" required>
+        <label for="booking-email">Email</label>
+        <input type="email" id="booking-email" required>
+        <button type="button" id="booking-submit">Book</button>
+        <p id="booking-status" role="status"></p>
+      </div>
+      <script>
+        (function () {
+          var api = document.querySelector(".booking").dataset.endpoint;
+          var slot = document.getElementById("booking-slot");
+          var status = document.getElementById("booking-status");
+          fetch(api + "/slots?days=14").then(function (r) { return r.json(); }).then(function (slots) {
+            slots.forEach(function (s) {
+              var o = document.createElement("option");
+              o.value = s.start;
+              o.textContent = new Date(s.start).toLocaleString();
+              slot.appendChild(o);
+            });
+          });
+          document.getElementById("booking-submit").addEventListener("click", function () {
+            fetch(api + "/bookings", {
+              method: "POST",
+              headers: {"Content-Type": "application/json"},
+              body: JSON.stringify({
+                start: slot.value,
+                name: document.getElementById("booking-name").value,
+                email: document.getElementById("booking-email").value
+              })
+            }).then(function (r) {
+              status.textContent = r.ok ? "Booked! Check your email for the confirmation." : "Sorry, this time could not be booked.";
+            });
+          });
+        })();
+      </script>
+      {{end}}
+    </section>
+    {{end}}
+  </main>
+  <script>
+    navigator.sendBeacon && navigator.sendBeacon("{{.APIBase}}/api/v1/sites/{{.Site.SiteName}}/pageviews",
+      JSON.stringify({path: location.pathname, referrer: document.referrer}));
+  </script>
+</body>
+</html>
+`))
+
+// siteBuildLocks let one build of a site run at a time: builds share the
+// public directory and the build records. A build may take the site's config
+// lock (moderation suspends sites), so builds are never started while
+// holding it.
+var siteBuildLocks = &siteLocks{sites: map[string]*sync.Mutex{}}
+
+// buildSite renders the public pages of a site from its config.json and runs
+// the post-build checks. The resulting record is stored under builds/ in the
+// site directory, also when the build failed.
+func buildSite(siteName string) (*BuildRecord, error) {
+	started := time.Now().UTC()
+	if siteConfig, err := readSiteConfig(siteName); err == nil && siteConfig.Unverified {
+		return &BuildRecord{SiteName: siteName, StartedAt: started, Error: errSiteUnverified.Error()}, errSiteUnverified
+	}
+	defer siteBuildLocks.lock(siteName)()
+	record := &BuildRecord{
+		ID:        started.Format("20060102T150405.000000000Z"),
+		SiteName:  siteName,
+		StartedAt: started,
+	}
+
+	endRun := beginRun(context.Background(), siteName, "build")
+	err := renderSite(siteName, record)
+	logStep(siteName, "build", fmt.Sprintf("%d pages, sections %s", len(record.Pages), strings.Join(record.Sections, ",")), started, err)
+	var warmupErr error
+	if err == nil && siteHasRecords(siteName) {
+		warmupErr = warmUpBuild(context.Background(), siteName, record.ID)
+	}
+	endRun(cmp.Or(err, warmupErr))
+	if err != nil {
+		record.Error = err.Error()
+		recordSiteEvent(siteName, SiteEvent{Type: "build.failed", Message: record.Error})
+	} else {
+		recordSiteEvent(siteName, SiteEvent{Type: "build.succeeded", Message: record.ID})
+	}
+	record.FinishedAt = time.Now().UTC()
+
+	if werr := writeBuildRecord(record); werr != nil {
+		slog.Error("error writing build record", "site", siteName, "error", werr)
+	}
+	siteDetails.invalidate(siteName) // it shows the accessibility summary
+	return record, err
+}
+
+func renderSite(siteName string, record *BuildRecord) error {
+	if err := injectFault(siteName, "build"); err != nil {
+		return err
+	}
+	siteConfig, err := readSiteConfig(siteName)
+	if err != nil {
+		return fmt.Errorf("failed to read site config: %v", err)
+	}
+
+	publicDir := filepath.Join(sitesBaseDir, siteName, sitePublicDir)
+	if err := os.MkdirAll(publicDir, 0755); err != nil {
+		return fmt.Errorf("failed to create public directory: %v", err)
+	}
+
+	record.Sections = siteConfig.publishedSections(record.StartedAt)
+	theme, err := publishTheme(siteConfig.Style)
+	if err != nil {
+		return err
+	}
+	record.ThemeVersion = theme.Version
+	data := sitePageData{
+		Site:    siteConfig,
+		Title:   siteConfig.SiteName,
+		APIBase: strings.TrimSuffix(config.Server.PublicURL, "/"),
+		BuildID: record.ID,
+	}
+
+	if slices.Contains(record.Sections, "blog") {
+		posts, err := readPosts(siteName)
+		if err != nil {
+			return fmt.Errorf("failed to read posts: %v", err)
+		}
+		posts = publishedPosts(posts, record.StartedAt)
+		comments, err := readComments(siteName)
+		if err != nil {
+			return fmt.Errorf("failed to read comments: %v", err)
+		}
+		if err := renderBlog(siteConfig, publicDir, posts, approvedComments(comments), record); err != nil {
+			return err
+		}
+		data.RecentPosts = posts[:min(recentPostLimit, len(posts))]
+	} else if err := os.RemoveAll(filepath.Join(publicDir, blogOutputDir)); err != nil {
+		return err
+	}
+
+	if slices.Contains(record.Sections, "shop") {
+		products, err := readProducts(siteName)
+		if err != nil {
+			return fmt.Errorf("failed to read products: %v", err)
+		}
+		if err := renderShop(siteConfig, publicDir, products, record); err != nil {
+			return err
+		}
+	} else if err := os.RemoveAll(filepath.Join(publicDir, shopOutputDir)); err != nil {
+		return err
+	}
+	if slices.Contains(record.Sections, "social") {
+		data.SocialPosts = map[string][]SocialPost{}
+		for _, feed := range siteConfig.SocialFeeds {
+			start := time.Now()
+			posts, _, err := socialFeedPosts(siteName, feed, record.StartedAt)
+			logStep(siteName, "social.fetch", feed.Provider+" "+feed.ID, start, err)
+			if err != nil {
+				// A broken feed should not fail the whole build.
+				slog.Error("error fetching feed", "provider", feed.Provider, "feed", feed.ID, "site", siteName, "error", err)
+			}
+			data.SocialPosts[feed.ID] = posts
+		}
+	}
+
+	if slices.Contains(record.Sections, "location") && siteConfig.Location != nil {
+		view := newLocationView(*siteConfig.Location)
+		if siteConfig.Location.MapStyle == "static" {
+			start := time.Now()
+			err := renderStaticMap(*siteConfig.Location, publicDir)
+			logStep(siteName, "map.static", siteConfig.Location.Address, start, err)
+			if err != nil {
+				slog.Error("error rendering static map, falling back to embed", "site", siteName, "error", err)
+			} else {
+				view.StaticMap = staticMapFile
+			}
+		}
+		data.Location = &view
+	}
+
+	if slices.Contains(record.Sections, "hours") && siteConfig.OpeningHours != nil {
+		if data.Hours, err = newOpeningHoursView(siteConfig, record.StartedAt); err != nil {
+			return fmt.Errorf("failed to render opening hours: %v", err)
+		}
+	}
+
+	if err := renderPages(siteConfig, publicDir, data, record.Sections, record); err != nil {
+		return err
+	}
+
+	// A scan failure must not take the site down; it is logged and the
+	// build published as it is.
+	if currentConfig().Moderation.Enabled {
+		if _, err := moderateBuild(context.Background(), &siteConfig, publicDir, record.ID); err != nil {
+			slog.Error("error scanning site content", "site", siteName, "error", err)
+		}
+	}
+
+	if err := applyVhost(siteConfig); err != nil {
+		return err
+	}
+
+	violations, err := checkAccessibility(publicDir)
+	if err != nil {
+		return fmt.Errorf("accessibility check failed: %v", err)
+	}
+	record.Accessibility = violations
+	return nil
+}
+
+func sectionViews(ids []string) []sectionView {
+	views := make([]sectionView, 0, len(ids))
+	for _, id := range ids {
+		name := id
+		if section, ok := findSection(id); ok {
+			name = section.Name
+		}
+		views = append(views, sectionView{ID: id, Name: name})
+	}
+	return views
+}
+
+func writeBuildRecord(record *BuildRecord) error {
+	dir := filepath.Join(sitesBaseDir, record.SiteName, siteBuildsDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	return writeJSONAtomic(filepath.Join(dir, record.ID+".json"), record, 0644)
+}
+
+// latestBuildRecord returns the most recent build of a site, or nil if the
+// site has never been built.
+func latestBuildRecord(siteName string) (*BuildRecord, error) {
+	return readLatestBuildRecord(filepath.Join(sitesBaseDir, siteName, siteBuildsDir))
+}
+
+// readLatestBuildRecord returns the most recent record in a builds
+// directory, or nil if there is none.
+func readLatestBuildRecord(dir string) (*BuildRecord, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var names []string
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasSuffix(e.Name(), ".json") {
+			names = append(names, e.Name())
+		}
+	}
+	if len(names) == 0 {
+		return nil, nil
+	}
+	// Build IDs are UTC timestamps, so lexical order is chronological.
+	sort.Strings(names)
+
+	data, err := os.ReadFile(filepath.Join(dir, names[len(names)-1]))
+	if err != nil {
+		return nil, err
+	}
+	var record BuildRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+func buildSiteHandler(w http.ResponseWriter, r *http.Request) {
+	siteName, ok := siteNameFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	siteConfig, _ := readSiteConfig(siteName)
+	release := acquireJobSlot(siteName, jobClassFor(r, siteConfig))
+	record, err := buildSite(siteName)
+	release()
+	if errors.Is(err, errSiteUnverified) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error building site", "site", siteName, "error", err)
+		respondJSONStatus(w, http.StatusInternalServerError, record)
+		return
+	}
+	respondJSON(w, record)
+}
@@ -0,0 +1,455 @@
+package main
+
+import (
+	"crypto/hmac"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Calendar feeds list what the platform has scheduled, as iCalendar
+// (RFC 5545) that operators subscribe to in their team calendar: section
+// publishes and unpublishes, scheduled blog posts, certificate renewals and
+// expiries, expiring verification links and social feed tokens, and the
+// maintenance windows of maintenance.windows. The admin feed covers all
+// sites and adds coupon expiries; an organization's feed covers the sites
+// with its prefixes and is open to its members.
+//
+// Calendar apps cannot send a bearer token, so GET /api/v1/calendar hands a
+// logged-in user the URLs of their feeds with a signed token in the query.
+// The token does not expire, but access is checked again on every fetch: a
+// user who left the organization, lost the admin role or was deleted gets
+// 403. Admins of the OIDC provider cannot be looked up without their
+// provider token, for them the signature counts; changing auth.jwt_secret
+// revokes all feed URLs.
+
+const (
+	calendarIssuer   = "flox-calendar"
+	calendarAdmin    = "admin"
+	calendarOrgFeed  = "org:"
+	calendarPast     = 7 * 24 * time.Hour   // events shown after they happened
+	calendarHorizon  = 180 * 24 * time.Hour // events shown before they happen
+	calendarEventLen = time.Hour            // of events that are a point in time
+)
+
+// maintenanceWindow is an entry of maintenance.windows. Start and End are
+// RFC 3339 times, kept as strings because viper does not decode times.
+type maintenanceWindow struct {
+	Start       string `mapstructure:"start" json:"start"`
+	End         string `mapstructure:"end" json:"end"`
+	Description string `mapstructure:"description" json:"description"`
+}
+
+func (mw maintenanceWindow) times() (start, end time.Time, err error) {
+	if start, err = time.Parse(time.RFC3339, mw.Start); err != nil {
+		return start, end, err
+	}
+	end, err = time.Parse(time.RFC3339, mw.End)
+	return start, end, err
+}
+
+// validateMaintenance checks the maintenance windows of a config.
+func validateMaintenance(c *Config) error {
+	for i, mw := range c.Maintenance.Windows {
+		start, end, err := mw.times()
+		if err != nil {
+			return fmt.Errorf("maintenance.windows[%d]: start and end must be RFC 3339 times like 2026-01-02T03:00:00Z: %w", i, err)
+		}
+		if !end.After(start) {
+			return fmt.Errorf("maintenance.windows[%d]: end must be after start", i)
+		}
+	}
+	return nil
+}
+
+// calendarClaims are the payload of a feed token, signed like a session
+// token but with an issuer no session has.
+type calendarClaims struct {
+	Subject  string `json:"sub"`
+	Email    string `json:"email,omitempty"`
+	Issuer   string `json:"iss"`
+	Feed     string `json:"feed"` // calendarAdmin or calendarOrgFeed + org ID
+	OIDC     bool   `json:"oidc,omitempty"`
+	IssuedAt int64  `json:"iat"`
+}
+
+func issueCalendarToken(claims sessionClaims, feed string) (string, error) {
+	key, err := jwtSigningKey()
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(calendarClaims{
+		Subject:  claims.Subject,
+		Email:    claims.Email,
+		Issuer:   calendarIssuer,
+		Feed:     feed,
+		OIDC:     claims.isOIDCSession(),
+		IssuedAt: time.Now().Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	signed := jwtHeader + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return signed + "." + jwtSignature(key, signed), nil
+}
+
+func parseCalendarToken(token, feed string) (calendarClaims, error) {
+	var claims calendarClaims
+	key, err := jwtSigningKey()
+	if err != nil {
+		return claims, err
+	}
+	header, rest, ok := strings.Cut(token, ".")
+	if !ok || header != jwtHeader {
+		return claims, errInvalidToken
+	}
+	payload, signature, ok := strings.Cut(rest, ".")
+	if !ok || !hmac.Equal([]byte(signature), []byte(jwtSignature(key, header+"."+payload))) {
+		return claims, errInvalidToken
+	}
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil || json.Unmarshal(data, &claims) != nil {
+		return claims, errInvalidToken
+	}
+	if claims.Issuer != calendarIssuer || claims.Subject == "" || claims.Feed != feed {
+		return claims, errInvalidToken
+	}
+	return claims, nil
+}
+
+// role returns the current role of the token's user; errInvalidToken if
+// the user no longer exists.
+func (c calendarClaims) role() (string, error) {
+	if c.OIDC {
+		if !oidcEnabled() {
+			return "", errInvalidToken
+		}
+		return roleAdmin, nil // checked when the URL was handed out
+	}
+	return localUserRole(c.Subject)
+}
+
+// --- Events ---
+
+type calendarEvent struct {
+	UID         string
+	Start, End  time.Time
+	Summary     string
+	Description string
+}
+
+// pointEvent is an event at a point in time, shown calendarEventLen long.
+func pointEvent(uid string, t time.Time, summary, description string) calendarEvent {
+	return calendarEvent{UID: uid, Start: t, End: t.Add(calendarEventLen), Summary: summary, Description: description}
+}
+
+// siteCalendarEvents returns the scheduled events of a site between from
+// and to.
+func siteCalendarEvents(siteName string, from, to time.Time) ([]calendarEvent, error) {
+	sc, err := readSiteConfig(siteName)
+	if err != nil {
+		return nil, err
+	}
+	var events []calendarEvent
+	add := func(kind string, t time.Time, summary, description string) {
+		if t.Before(from) || t.After(to) {
+			return
+		}
+		uid := fmt.Sprintf("%s-%s-%d@%s", siteName, kind, t.Unix(), calendarIssuer)
+		events = append(events, pointEvent(uid, t, siteName+": "+summary, description))
+	}
+
+	for _, e := range upcomingScheduleEvents(sc, from) {
+		verb := "published"
+		if e.Type == "section.unpublished" {
+			verb = "unpublished"
+		}
+		add(e.Type+"-"+e.Section, e.Time, fmt.Sprintf("section %s %s", e.Section, verb), "Scheduled in the section's publish window; the site is rebuilt then.")
+	}
+	posts, err := readPosts(siteName)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range posts {
+		if p.PublishedAt != nil {
+			add("post-"+p.Slug, *p.PublishedAt, fmt.Sprintf("post %q published", p.Title), "Scheduled blog post "+p.Slug+".")
+		}
+	}
+	if c := sc.Certificate; c != nil && c.NotAfter != nil {
+		if renewBefore := currentConfig().ACME.RenewBefore; renewBefore > 0 && currentConfig().ACME.Enabled {
+			add("cert-renewal", c.NotAfter.Add(-renewBefore), "certificate renewal due", "The scheduler renews the certificate from now on.")
+		}
+		add("cert-expiry", *c.NotAfter, "certificate expires", "The site's certificate is no longer valid after this time.")
+	}
+	if sc.Unverified {
+		v, err := readSiteVerification(siteName)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		if err == nil {
+			add("verification", v.ExpiresAt, "verification link expires", "The site was not verified yet; after this the owner needs a new link.")
+		}
+	}
+	for _, feed := range sc.SocialFeeds {
+		if feed.TokenExpiresAt != nil {
+			add("social-"+feed.ID, *feed.TokenExpiresAt, feed.Provider+" token expires", "The social feed stops updating unless the token is refreshed or replaced.")
+		}
+	}
+	return events, nil
+}
+
+func maintenanceCalendarEvents(from, to time.Time) []calendarEvent {
+	var events []calendarEvent
+	for _, mw := range currentConfig().Maintenance.Windows {
+		start, end, err := mw.times()
+		if err != nil || end.Before(from) || start.After(to) {
+			continue
+		}
+		summary := "Maintenance"
+		if mw.Description != "" {
+			summary += ": " + mw.Description
+		}
+		uid := fmt.Sprintf("maintenance-%d-%d@%s", start.Unix(), end.Unix(), calendarIssuer)
+		events = append(events, calendarEvent{UID: uid, Start: start, End: end, Summary: summary, Description: mw.Description})
+	}
+	return events
+}
+
+func couponCalendarEvents(from, to time.Time) ([]calendarEvent, error) {
+	couponsMu.Lock()
+	coupons, err := readCoupons()
+	couponsMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	var events []calendarEvent
+	for _, c := range coupons {
+		if c.ExpiresAt == nil || c.ExpiresAt.Before(from) || c.ExpiresAt.After(to) {
+			continue
+		}
+		uid := fmt.Sprintf("coupon-%s-%d@%s", c.Code, c.ExpiresAt.Unix(), calendarIssuer)
+		events = append(events, pointEvent(uid, *c.ExpiresAt, fmt.Sprintf("%s %s expires", c.Kind, c.Code), c.Description))
+	}
+	return events, nil
+}
+
+// calendarEvents returns the events of the sites for which include is true,
+// the maintenance windows and, for the admin feed, the coupon expiries,
+// sorted by start.
+func calendarEvents(now time.Time, admin bool, include func(siteName string) bool) ([]calendarEvent, error) {
+	from, to := now.Add(-calendarPast), now.Add(calendarHorizon)
+	siteNames, err := listSiteNames()
+	if err != nil {
+		return nil, err
+	}
+	events := maintenanceCalendarEvents(from, to)
+	for _, siteName := range siteNames {
+		if !include(siteName) {
+			continue
+		}
+		siteEvents, err := siteCalendarEvents(siteName, from, to)
+		if err != nil {
+			slog.Warn("calendar: skipping site", "site", siteName, "error", err)
+			continue
+		}
+		events = append(events, siteEvents...)
+	}
+	if admin {
+		couponEvents, err := couponCalendarEvents(from, to)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, couponEvents...)
+	}
+	slices.SortStableFunc(events, func(a, b calendarEvent) int { return a.Start.Compare(b.Start) })
+	return events, nil
+}
+
+// --- iCalendar ---
+
+var iCalEscaper = strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`)
+
+// writeICalLine writes a content line, folded after 75 octets without splitting
+// a UTF-8 sequence.
+func writeICalLine(b *strings.Builder, line string) {
+	for len(line) > 75 {
+		cut := 75
+		for cut > 0 && line[cut]&0xC0 == 0x80 {
+			cut--
+		}
+		b.WriteString(line[:cut] + "\r\n ")
+		line = line[cut:]
+	}
+	b.WriteString(line + "\r\n")
+}
+
+func formatICalTime(t time.Time) string {
+	return t.UTC().Format("20060102T150405Z")
+}
+
+func renderICalendar(name string, events []calendarEvent, now time.Time) string {
+	var b strings.Builder
+	writeICalLine(&b, "BEGIN:VCALENDAR")
+	writeICalLine(&b, "VERSION:2.0")
+	writeICalLine(&b, "PRODID:-//flox//flox-backend//EN")
+	writeICalLine(&b, "CALSCALE:GREGORIAN")
+	writeICalLine(&b, "METHOD:PUBLISH")
+	writeICalLine(&b, "X-WR-CALNAME:"+iCalEscaper.Replace(name))
+	for _, e := range events {
+		writeICalLine(&b, "BEGIN:VEVENT")
+		writeICalLine(&b, "UID:"+e.UID)
+		writeICalLine(&b, "DTSTAMP:"+formatICalTime(now))
+		writeICalLine(&b, "DTSTART:"+formatICalTime(e.Start))
+		writeICalLine(&b, "DTEND:"+formatICalTime(e.End))
+		writeICalLine(&b, "SUMMARY:"+iCalEscaper.Replace(e.Summary))
+		if e.Description != "" {
+			writeICalLine(&b, "DESCRIPTION:"+iCalEscaper.Replace(e.Description))
+		}
+		writeICalLine(&b, "TRANSP:TRANSPARENT")
+		writeICalLine(&b, "END:VEVENT")
+	}
+	writeICalLine(&b, "END:VCALENDAR")
+	return b.String()
+}
+
+func respondICalendar(w http.ResponseWriter, filename, calendar string) {
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=%q", filename))
+	w.Header().Set("Cache-Control", "private, max-age=300")
+	w.Write([]byte(calendar))
+}
+
+// --- Handlers ---
+
+type calendarFeed struct {
+	Name  string `json:"name"`
+	OrgID string `json:"orgId,omitempty"` // empty for the admin feed
+	URL   string `json:"url"`             // contains the feed's secret token
+}
+
+type calendarFeedsResponse struct {
+	Feeds []calendarFeed `json:"feeds"`
+}
+
+// listCalendarFeedsHandler returns the feed URLs of the logged-in user: the
+// admin feed for admins and one per organization they belong to.
+func listCalendarFeedsHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireLogin(w, r) {
+		return
+	}
+	claims := currentSession(r)
+	base := apiBaseURL(r) + "/api/v1/calendar"
+	feeds := []calendarFeed{}
+	addFeed := func(name, orgID, feed, path string) bool {
+		token, err := issueCalendarToken(claims, feed)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "error issuing calendar token", "error", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return false
+		}
+		feeds = append(feeds, calendarFeed{Name: name, OrgID: orgID, URL: base + path + "?token=" + url.QueryEscape(token)})
+		return true
+	}
+	if isAdmin(r) && !addFeed("Platform", "", calendarAdmin, "/admin/events.ics") {
+		return
+	}
+	orgs, err := readOrgs()
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error reading organizations", "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	for _, id := range slices.Sorted(maps.Keys(orgs)) {
+		if org := orgs[id]; org.isMember(claims) && !addFeed(org.Name, id, calendarOrgFeed+id, "/orgs/"+id+"/events.ics") {
+			return
+		}
+	}
+	respondJSON(w, calendarFeedsResponse{Feeds: feeds})
+}
+
+// calendarClaimsFromQuery checks the token of a feed request; on failure an
+// error response has already been written.
+func calendarClaimsFromQuery(w http.ResponseWriter, r *http.Request, feed string) (calendarClaims, bool) {
+	claims, err := parseCalendarToken(r.URL.Query().Get("token"), feed)
+	if err != nil {
+		if !errors.Is(err, errInvalidToken) {
+			slog.ErrorContext(r.Context(), "error checking calendar token", "error", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return claims, false
+		}
+		http.Error(w, "Invalid calendar token, get a new feed URL from /api/v1/calendar", http.StatusUnauthorized)
+		return claims, false
+	}
+	return claims, true
+}
+
+// adminCalendarHandler serves the admin feed.
+func adminCalendarHandler(w http.ResponseWriter, r *http.Request) {
+	claims, ok := calendarClaimsFromQuery(w, r, calendarAdmin)
+	if !ok {
+		return
+	}
+	role, err := claims.role()
+	if err != nil && !errors.Is(err, errInvalidToken) {
+		slog.ErrorContext(r.Context(), "error reading user role", "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if role != roleAdmin {
+		http.Error(w, "Only admins may see this calendar", http.StatusForbidden)
+		return
+	}
+	now := time.Now().UTC()
+	events, err := calendarEvents(now, true, func(string) bool { return true })
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error collecting calendar events", "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	respondICalendar(w, "flox.ics", renderICalendar("flox", events, now))
+}
+
+// orgCalendarHandler serves the feed of an organization.
+func orgCalendarHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("orgId")
+	claims, ok := calendarClaimsFromQuery(w, r, calendarOrgFeed+id)
+	if !ok {
+		return
+	}
+	_, err := claims.role()
+	if err != nil && !errors.Is(err, errInvalidToken) {
+		slog.ErrorContext(r.Context(), "error reading user role", "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	orgs, rerr := readOrgs()
+	if rerr != nil {
+		slog.ErrorContext(r.Context(), "error reading organizations", "error", rerr)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	org, found := orgs[id]
+	if err != nil || !found || !org.isMember(sessionClaims{Subject: claims.Subject, Email: claims.Email}) {
+		http.Error(w, "Only members of the organization may see this calendar", http.StatusForbidden)
+		return
+	}
+	now := time.Now().UTC()
+	events, err := calendarEvents(now, false, func(siteName string) bool {
+		return slices.ContainsFunc(org.Prefixes, func(p string) bool { return strings.HasPrefix(siteName, p) })
+	})
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error collecting calendar events", "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	respondICalendar(w, id+".ics", renderICalendar("flox: "+org.Name, events, now))
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/spf13/pflag"
+)
+
+// command is an administrative subcommand run instead of the server, e.g.
+// "flox-backend seed --sites 50". It shares the config loading of the server.
+type command struct {
+	usage string
+	// flags registers the command's flags before parsing.
+	flags func(fs *pflag.FlagSet)
+	run   func(args []string) error
+	// subcommands, e.g. "site list"; commands with subcommands have no run.
+	subcommands map[string]command
+}
+
+// commands are registered here rather than in init functions, which would
+// run after main.go's init has already parsed the arguments.
+var commands = map[string]command{
+	"dns":            dnsCommand,
+	"hooks":          hooksCommand,
+	"k8s-controller": k8sControllerCommand,
+	"migrate":        migrateCommand,
+	"purge":          purgeCommand,
+	"seed":           seedCommand,
+	"serve-sites":    serveSitesCommand,
+	"site":           siteCommand,
+	"themes":         themesCommand,
+	"user":           userCommand,
+}
+
+// selectedCommand is set when os.Args names a subcommand.
+var (
+	selectedCommand *command
+	commandName     string
+)
+
+// commandArgs picks the subcommand from args, registers its flags and returns
+// the arguments left for flag parsing.
+func commandArgs(args []string) []string {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return args
+	}
+	cmd := lookupCommand(commands, args[0])
+	commandName = args[0]
+	args = args[1:]
+	for cmd.subcommands != nil {
+		if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+			fmt.Fprintf(os.Stderr, "%s needs a subcommand: %s\n", commandName, commandNames(cmd.subcommands))
+			os.Exit(2)
+		}
+		cmd = lookupCommand(cmd.subcommands, args[0])
+		commandName += " " + args[0]
+		args = args[1:]
+	}
+	selectedCommand = &cmd
+	if cmd.flags != nil {
+		cmd.flags(pflag.CommandLine)
+	}
+	pflag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s %s\n", os.Args[0], cmd.usage)
+		pflag.PrintDefaults()
+	}
+	return args
+}
+
+func lookupCommand(cmds map[string]command, name string) command {
+	cmd, ok := cmds[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q, available: %s\n", name, commandNames(cmds))
+		os.Exit(2)
+	}
+	return cmd
+}
+
+func commandNames(cmds map[string]command) string {
+	names := make([]string, 0, len(cmds))
+	for name := range cmds {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return strings.Join(names, ", ")
+}
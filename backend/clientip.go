@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// Client addresses: behind a reverse proxy every request comes from the
+// proxy, so the address of the client is taken from X-Forwarded-For (or
+// X-Real-IP) when the peer is one of server.trusted_proxies (addresses or
+// CIDR ranges, by default the loopback addresses of a proxy on the same
+// host) or the request came over the Unix socket, which only the proxy can
+// connect to. X-Forwarded-For is read from the right, skipping trusted
+// proxies, so a client cannot choose its address by sending the header
+// itself. Other peers are the client. The address is that of the rate
+// limits, the access and audit logs, analytics, the GeoIP rules and the
+// comment spam check.
+
+// clientIP returns the address of the client of r.
+func clientIP(r *http.Request) string {
+	peer := peerIP(r)
+	if !trustedProxy(r, peer) {
+		return peer
+	}
+	if forwarded := r.Header.Values("X-Forwarded-For"); len(forwarded) > 0 {
+		hops := strings.Split(strings.Join(forwarded, ","), ",")
+		client := peer
+		for i := len(hops) - 1; i >= 0; i-- {
+			addr, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+			if err != nil {
+				break
+			}
+			client = addr.Unmap().String()
+			if !trustedProxyAddr(addr) {
+				break
+			}
+		}
+		return client
+	}
+	if addr, err := netip.ParseAddr(strings.TrimSpace(r.Header.Get("X-Real-IP"))); err == nil {
+		return addr.Unmap().String()
+	}
+	return peer
+}
+
+// peerIP is the address the connection came from.
+func peerIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// trustedProxy reports whether the peer of r may name the client.
+func trustedProxy(r *http.Request, peer string) bool {
+	if _, ok := r.Context().Value(http.LocalAddrContextKey).(*net.UnixAddr); ok {
+		return true
+	}
+	addr, err := netip.ParseAddr(peer)
+	return err == nil && trustedProxyAddr(addr)
+}
+
+func trustedProxyAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, proxy := range currentConfig().Server.TrustedProxies {
+		if prefix, err := parseTrustedProxy(proxy); err == nil && prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseTrustedProxy reads an entry of server.trusted_proxies, an address
+// or a CIDR range.
+func parseTrustedProxy(proxy string) (netip.Prefix, error) {
+	if strings.Contains(proxy, "/") {
+		prefix, err := netip.ParsePrefix(proxy)
+		return prefix.Masked(), err
+	}
+	addr, err := netip.ParseAddr(proxy)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+func validateTrustedProxies(c *Config) error {
+	for _, proxy := range c.Server.TrustedProxies {
+		if _, err := parseTrustedProxy(proxy); err != nil {
+			return fmt.Errorf("server.trusted_proxies: %q is not an address or CIDR range", proxy)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,450 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const siteCommentsFile = "comments.json"
+
+const (
+	commentsClosed    = "closed" // default
+	commentsModerated = "moderated"
+	commentsOpen      = "open"
+
+	commentPending  = "pending"
+	commentApproved = "approved"
+	commentSpam     = "spam"
+)
+
+// CommentSettings controls whether visitors can comment on blog posts and
+// whether their comments need approval first.
+type CommentSettings struct {
+	Mode        string `json:"mode"`
+	NotifyEmail string `json:"notifyEmail,omitempty"`
+}
+
+type Comment struct {
+	ID          string    `json:"id"`
+	PostSlug    string    `json:"postSlug"`
+	AuthorName  string    `json:"authorName"`
+	AuthorEmail string    `json:"authorEmail,omitempty"`
+	Content     string    `json:"content"`
+	Status      string    `json:"status"`
+	CreatedAt   time.Time `json:"createdAt"`
+	ClientIP    string    `json:"clientIp,omitempty"`
+	UserAgent   string    `json:"userAgent,omitempty"`
+}
+
+// publicComment is what visitors get to see of a comment.
+type publicComment struct {
+	ID         string    `json:"id"`
+	AuthorName string    `json:"authorName"`
+	Content    string    `json:"content"`
+	CreatedAt  time.Time `json:"createdAt"`
+}
+
+type commentRequest struct {
+	AuthorName  string `json:"authorName"`
+	AuthorEmail string `json:"authorEmail,omitempty"`
+	Content     string `json:"content"`
+}
+
+var commentsMu sync.Mutex
+
+func (sc SiteConfig) commentMode() string {
+	if sc.Comments == nil || sc.Comments.Mode == "" {
+		return commentsClosed
+	}
+	return sc.Comments.Mode
+}
+
+func readComments(siteName string) ([]Comment, error) {
+	comments := []Comment{}
+	data, err := os.ReadFile(filepath.Join(sitesBaseDir, siteName, siteCommentsFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return comments, nil
+		}
+		return nil, err
+	}
+	err = json.Unmarshal(data, &comments)
+	return comments, err
+}
+
+func writeComments(siteName string, comments []Comment) error {
+	return writeJSONAtomic(filepath.Join(sitesBaseDir, siteName, siteCommentsFile), comments, 0640)
+}
+
+// approvedComments groups the approved comments by post slug, oldest first.
+func approvedComments(comments []Comment) map[string][]Comment {
+	byPost := map[string][]Comment{}
+	for _, c := range comments {
+		if c.Status == commentApproved {
+			byPost[c.PostSlug] = append(byPost[c.PostSlug], c)
+		}
+	}
+	return byPost
+}
+
+// isSpam asks an Akismet-compatible comment-check endpoint whether a comment
+// is spam. Without an API key every comment passes.
+func isSpam(siteName string, c Comment) (bool, error) {
+	if config.Comments.SpamCheckKey == "" {
+		return false, nil
+	}
+	form := url.Values{
+		"api_key":              {config.Comments.SpamCheckKey},
+		"blog":                 {siteURL(siteName)},
+		"permalink":            {siteURL(siteName) + "/" + blogOutputDir + "/" + c.PostSlug + "/"},
+		"user_ip":              {c.ClientIP},
+		"user_agent":           {c.UserAgent},
+		"comment_type":         {"comment"},
+		"comment_author":       {c.AuthorName},
+		"comment_author_email": {c.AuthorEmail},
+		"comment_content":      {c.Content},
+	}
+	client := http.Client{Timeout: 5 * time.Second}
+	resp, err := client.PostForm(config.Comments.SpamCheckURL, form)
+	if err != nil {
+		return false, fmt.Errorf("spam check failed: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if err != nil {
+		return false, fmt.Errorf("spam check failed: %v", err)
+	}
+	switch strings.TrimSpace(string(body)) {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	default:
+		return false, fmt.Errorf("spam check failed: unexpected response %q (status %d)", body, resp.StatusCode)
+	}
+}
+
+// --- Handlers ---
+
+func putCommentSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	siteName, ok := siteNameFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	var settings CommentSettings
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&settings); err != nil {
+		http.Error(w, "Invalid JSON request", http.StatusBadRequest)
+		return
+	}
+	if !slices.Contains([]string{commentsClosed, commentsModerated, commentsOpen}, settings.Mode) {
+		http.Error(w, "mode must be closed, moderated or open", http.StatusBadRequest)
+		return
+	}
+	if settings.NotifyEmail != "" {
+		if _, err := mail.ParseAddress(settings.NotifyEmail); err != nil {
+			http.Error(w, "invalid notifyEmail", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if _, err := updateSiteConfig(siteName, func(siteConfig *SiteConfig) error {
+		siteConfig.Comments = &settings
+		return nil
+	}); err != nil {
+		writeSiteUpdateError(w, r, siteName, err)
+		return
+	}
+	recordSiteEvent(siteName, SiteEvent{Type: "comments.configured", Message: settings.Mode})
+
+	if _, err := buildSite(siteName); err != nil {
+		slog.ErrorContext(r.Context(), "error building site", "site", siteName, "error", err)
+	}
+	respondJSON(w, settings)
+}
+
+// listPostCommentsHandler is public and only returns approved comments.
+func listPostCommentsHandler(w http.ResponseWriter, r *http.Request) {
+	siteName, post, ok := postFromPath(w, r)
+	if !ok {
+		return
+	}
+	comments, err := readComments(siteName)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error reading comments", "site", siteName, "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	visible := []publicComment{}
+	for _, c := range approvedComments(comments)[post.Slug] {
+		visible = append(visible, publicComment{ID: c.ID, AuthorName: c.AuthorName, Content: c.Content, CreatedAt: c.CreatedAt})
+	}
+	respondJSON(w, visible)
+}
+
+// createCommentHandler is the public endpoint for new comments. Like form
+// submissions it accepts JSON and urlencoded posts from the generated pages.
+func createCommentHandler(w http.ResponseWriter, r *http.Request) {
+	siteName, post, ok := postFromPath(w, r)
+	if !ok {
+		return
+	}
+	siteConfig, err := readSiteConfig(siteName)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error reading site config", "site", siteName, "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	mode := siteConfig.commentMode()
+	if mode == commentsClosed || !post.publishedAt(time.Now()) {
+		http.Error(w, "Comments are closed", http.StatusForbidden)
+		return
+	}
+
+	var req commentRequest
+	r.Body = http.MaxBytesReader(w, r.Body, maxSubmissionBytes)
+	defer r.Body.Close()
+	isJSON := false
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "application/json" {
+		isJSON = true
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON request", http.StatusBadRequest)
+			return
+		}
+	} else {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, "Invalid form data", http.StatusBadRequest)
+			return
+		}
+		req = commentRequest{
+			AuthorName:  r.PostForm.Get("authorName"),
+			AuthorEmail: r.PostForm.Get("authorEmail"),
+			Content:     r.PostForm.Get("content"),
+		}
+	}
+	if err := req.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	comment := Comment{
+		ID:          newID(),
+		PostSlug:    post.Slug,
+		AuthorName:  req.AuthorName,
+		AuthorEmail: req.AuthorEmail,
+		Content:     req.Content,
+		Status:      commentPending,
+		CreatedAt:   time.Now().UTC(),
+		ClientIP:    clientIP(r),
+		UserAgent:   r.UserAgent(),
+	}
+	spam, err := isSpam(siteName, comment)
+	if err != nil {
+		// Fall back to manual moderation rather than dropping the comment.
+		slog.ErrorContext(r.Context(), "error checking comment for spam", "site", siteName, "error", err)
+	}
+	switch {
+	case spam:
+		comment.Status = commentSpam
+	case mode == commentsOpen && err == nil:
+		comment.Status = commentApproved
+	}
+
+	commentsMu.Lock()
+	comments, err := readComments(siteName)
+	if err == nil {
+		err = writeComments(siteName, append(comments, comment))
+	}
+	commentsMu.Unlock()
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error storing comment", "site", siteName, "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	recordSiteEvent(siteName, SiteEvent{Type: "comment.created", Message: comment.ID + " (" + comment.Status + ")"})
+	if comment.Status != commentSpam {
+		fireRESTHooks(siteName, "comment.created", comment.ID, "", comment.restHookData())
+	}
+
+	if comment.Status == commentApproved {
+		if _, err := buildSite(siteName); err != nil {
+			slog.ErrorContext(r.Context(), "error building site", "site", siteName, "error", err)
+		}
+	}
+	if comment.Status != commentSpam && siteConfig.Comments.NotifyEmail != "" {
+		go func() {
+			data := map[string]any{"PostTitle": post.Title, "Status": comment.Status, "AuthorName": comment.AuthorName, "Content": comment.Content}
+			if err := sendTemplateEmail(siteConfig.Comments.NotifyEmail, "comment_notification", data); err != nil {
+				slog.ErrorContext(r.Context(), "error sending comment notification", "site", siteName, "error", err)
+			}
+		}()
+	}
+
+	if referer := r.Referer(); !isJSON && referer != "" {
+		http.Redirect(w, r, referer, http.StatusSeeOther)
+		return
+	}
+	// Spam is reported like a pending comment so spammers learn nothing.
+	status := comment.Status
+	if status == commentSpam {
+		status = commentPending
+	}
+	respondJSONStatus(w, http.StatusCreated, map[string]string{"id": comment.ID, "status": status})
+}
+
+func (req *commentRequest) validate() error {
+	req.AuthorName = strings.TrimSpace(req.AuthorName)
+	req.Content = strings.TrimSpace(req.Content)
+	req.AuthorEmail = strings.TrimSpace(req.AuthorEmail)
+	if req.AuthorName == "" || len(req.AuthorName) > 100 {
+		return errors.New("authorName must be 1-100 characters")
+	}
+	if req.Content == "" || len(req.Content) > 5000 {
+		return errors.New("content must be 1-5000 characters")
+	}
+	if req.AuthorEmail != "" {
+		addr, err := mail.ParseAddress(req.AuthorEmail)
+		if err != nil {
+			return errors.New("invalid authorEmail")
+		}
+		req.AuthorEmail = addr.Address
+	}
+	return nil
+}
+
+// listCommentsHandler is the moderation queue: all comments of a site,
+// optionally filtered with ?status=pending|approved|spam.
+func listCommentsHandler(w http.ResponseWriter, r *http.Request) {
+	siteName, ok := siteNameFromPath(w, r)
+	if !ok {
+		return
+	}
+	comments, err := readComments(siteName)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error reading comments", "site", siteName, "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if status := r.URL.Query().Get("status"); status != "" {
+		filtered := []Comment{}
+		for _, c := range comments {
+			if c.Status == status {
+				filtered = append(filtered, c)
+			}
+		}
+		comments = filtered
+	}
+	respondJSON(w, comments)
+}
+
+type commentModerationRequest struct {
+	Status string `json:"status"`
+}
+
+// moderateCommentHandler changes the status of a comment.
+func moderateCommentHandler(w http.ResponseWriter, r *http.Request) {
+	siteName, ok := siteNameFromPath(w, r)
+	if !ok {
+		return
+	}
+	var req commentModerationRequest
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON request", http.StatusBadRequest)
+		return
+	}
+	if !slices.Contains([]string{commentPending, commentApproved, commentSpam}, req.Status) {
+		http.Error(w, "status must be pending, approved or spam", http.StatusBadRequest)
+		return
+	}
+
+	updated, found, changedVisibility, err := updateComment(siteName, r.PathValue("commentId"), func(c *Comment) {
+		c.Status = req.Status
+	})
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error updating comment", "site", siteName, "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.Error(w, "Comment not found", http.StatusNotFound)
+		return
+	}
+	recordSiteEvent(siteName, SiteEvent{Type: "comment.moderated", Message: updated.ID + " (" + updated.Status + ")"})
+	if changedVisibility {
+		if _, err := buildSite(siteName); err != nil {
+			slog.ErrorContext(r.Context(), "error building site", "site", siteName, "error", err)
+		}
+	}
+	respondJSON(w, updated)
+}
+
+func deleteCommentHandler(w http.ResponseWriter, r *http.Request) {
+	siteName, ok := siteNameFromPath(w, r)
+	if !ok {
+		return
+	}
+	commentID := r.PathValue("commentId")
+
+	commentsMu.Lock()
+	comments, err := readComments(siteName)
+	i := -1
+	if err == nil {
+		i = slices.IndexFunc(comments, func(c Comment) bool { return c.ID == commentID })
+		if i >= 0 {
+			err = writeComments(siteName, slices.Delete(slices.Clone(comments), i, i+1))
+		}
+	}
+	commentsMu.Unlock()
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error deleting comment", "site", siteName, "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if i < 0 {
+		http.Error(w, "Comment not found", http.StatusNotFound)
+		return
+	}
+	recordSiteEvent(siteName, SiteEvent{Type: "comment.deleted", Message: commentID})
+	if comments[i].Status == commentApproved {
+		if _, err := buildSite(siteName); err != nil {
+			slog.ErrorContext(r.Context(), "error building site", "site", siteName, "error", err)
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// updateComment applies fn to the comment with the given ID. It reports
+// whether the comment was found and whether its public visibility changed.
+func updateComment(siteName, commentID string, fn func(*Comment)) (Comment, bool, bool, error) {
+	commentsMu.Lock()
+	defer commentsMu.Unlock()
+	comments, err := readComments(siteName)
+	if err != nil {
+		return Comment{}, false, false, err
+	}
+	i := slices.IndexFunc(comments, func(c Comment) bool { return c.ID == commentID })
+	if i < 0 {
+		return Comment{}, false, false, nil
+	}
+	wasVisible := comments[i].Status == commentApproved
+	fn(&comments[i])
+	if err := writeComments(siteName, comments); err != nil {
+		return Comment{}, true, false, err
+	}
+	return comments[i], true, wasVisible != (comments[i].Status == commentApproved), nil
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// Config bundles keep the instances of a fleet configured alike. The export
+// is the effective configuration (config files, environment and defaults)
+// with secrets redacted; an import is validated like the config at startup
+// and written into the base config file. Redacted secrets and the settings
+// that belong to one instance (its name, addresses, directories) are left
+// alone, so a bundle exported on one instance applies to the others. The
+// reloadable settings of an import take effect once the file is written
+// (see reload.go), the others on the next restart.
+
+const (
+	configBundleFormat = "flox-config/1"
+	redactedValue      = "<redacted>"
+	maxConfigBundleLen = 1 << 20
+)
+
+// instanceConfigKeys differ between the instances of a fleet and are
+// exported but not imported.
+var instanceConfigKeys = []string{
+	"registry.instance", "server.listen_address", "server.port", "server.listen", "server.socket_mode", "server.socket_group", "server.public_url",
+	"server.tls.cert_file", "server.tls.key_file", "server.tls.autocert_host",
+	"sites.base_dir", "dns.ipv6", "faults.enabled", "faults.rules",
+}
+
+type configBundle struct {
+	Format     string         `json:"format"`
+	Instance   string         `json:"instance,omitempty"`
+	Version    string         `json:"version,omitempty"`
+	Profile    string         `json:"profile,omitempty"`
+	ExportedAt time.Time      `json:"exportedAt"`
+	Config     map[string]any `json:"config"`
+}
+
+type configChange struct {
+	Key  string `json:"key"`
+	From any    `json:"from"`
+	To   any    `json:"to"`
+}
+
+type configOverride struct {
+	Key string `json:"key"`
+	By  string `json:"by"` // environment variable or profile config file
+}
+
+type configImportResult struct {
+	DryRun  bool           `json:"dryRun"`
+	File    string         `json:"file,omitempty"`
+	Changes []configChange `json:"changes"`
+	// Skipped are redacted secrets and instance settings of the bundle.
+	Skipped []string `json:"skipped"`
+	// Overridden are imported keys that the environment or the profile
+	// config file set on this instance, so the file value has no effect.
+	Overridden      []configOverride `json:"overridden"`
+	RestartRequired bool             `json:"restartRequired"` // some changes are not reloadable
+}
+
+// isSecretConfigKey reports whether a key holds a credential, by its name.
+func isSecretConfigKey(key string) bool {
+	name := key[strings.LastIndex(key, ".")+1:]
+	return name == "password" || name == "token" || name == "api_auth" ||
+		strings.HasSuffix(name, "_key") || strings.HasSuffix(name, "_secret") || strings.HasSuffix(name, "_token")
+}
+
+// configValues flattens a config to its keys ("dns.route53.region") and
+// values as they are written in a config file, durations as strings.
+func configValues(c *Config) map[string]any {
+	values := map[string]any{}
+	var walk func(v reflect.Value, prefix string)
+	walk = func(v reflect.Value, prefix string) {
+		for i := range v.NumField() {
+			field := v.Type().Field(i)
+			key := prefix + field.Tag.Get("mapstructure")
+			if field.Type.Kind() == reflect.Struct {
+				walk(v.Field(i), key+".")
+				continue
+			}
+			if d, ok := v.Field(i).Interface().(time.Duration); ok {
+				values[key] = d.String()
+			} else {
+				values[key] = v.Field(i).Interface()
+			}
+		}
+	}
+	walk(reflect.ValueOf(c).Elem(), "")
+	return values
+}
+
+// redactConfigValue hides a non-empty secret.
+func redactConfigValue(key string, value any) any {
+	if s, ok := value.(string); ok && s != "" && isSecretConfigKey(key) {
+		return redactedValue
+	}
+	return value
+}
+
+// nestConfigValues turns flat keys into the nested maps of a config file.
+func nestConfigValues(values map[string]any) map[string]any {
+	nested := map[string]any{}
+	for key, value := range values {
+		m := nested
+		parts := strings.Split(key, ".")
+		for _, part := range parts[:len(parts)-1] {
+			next, ok := m[part].(map[string]any)
+			if !ok {
+				next = map[string]any{}
+				m[part] = next
+			}
+			m = next
+		}
+		m[parts[len(parts)-1]] = value
+	}
+	return nested
+}
+
+// flattenBundleConfig returns the keys and values of an imported config,
+// rejecting keys the config does not have.
+func flattenBundleConfig(bundleConfig, known map[string]any) (map[string]any, error) {
+	values := map[string]any{}
+	var unknown []string
+	var walk func(m map[string]any, prefix string)
+	walk = func(m map[string]any, prefix string) {
+		for k, v := range m {
+			key := prefix + strings.ToLower(k)
+			if _, ok := known[key]; ok {
+				values[key] = v
+			} else if sub, ok := v.(map[string]any); ok {
+				walk(sub, key+".")
+			} else {
+				unknown = append(unknown, key)
+			}
+		}
+	}
+	walk(bundleConfig, "")
+	if len(unknown) > 0 {
+		slices.Sort(unknown)
+		return nil, fmt.Errorf("unknown config keys: %s", strings.Join(unknown, ", "))
+	}
+	return values, nil
+}
+
+// envConfigVariable is the environment variable viper reads a key from.
+func envConfigVariable(key string) string {
+	return "FLOX_" + strings.ToUpper(strings.ReplaceAll(key, ".", "_"))
+}
+
+var configImportMu sync.Mutex
+
+// planConfigImport validates a bundle against the running config and
+// returns what importing it changes and the changed values, which are all
+// that is written: settings the bundle agrees with stay where they are set
+// now (defaults, environment, file).
+func planConfigImport(bundle configBundle) (configImportResult, map[string]any, error) {
+	result := configImportResult{File: baseConfigFile, Changes: []configChange{}, Skipped: []string{}, Overridden: []configOverride{}}
+	if bundle.Format != "" && bundle.Format != configBundleFormat {
+		return result, nil, fmt.Errorf("unsupported bundle format %q, expected %s", bundle.Format, configBundleFormat)
+	}
+	if len(bundle.Config) == 0 {
+		return result, nil, errors.New("the bundle has no config")
+	}
+	current := configValues(currentConfig())
+	imported, err := flattenBundleConfig(bundle.Config, current)
+	if err != nil {
+		return result, nil, err
+	}
+	for key, value := range imported {
+		// An empty secret is one the exporting instance does not use, which
+		// says nothing about this instance.
+		if (isSecretConfigKey(key) && (value == redactedValue || value == "")) || slices.Contains(instanceConfigKeys, key) {
+			result.Skipped = append(result.Skipped, key)
+			delete(imported, key)
+		}
+	}
+	slices.Sort(result.Skipped)
+
+	// The candidate is the running config with the bundle applied, decoded
+	// and checked like at startup.
+	v := viper.New()
+	for key, value := range current {
+		v.Set(key, value)
+	}
+	for key, value := range imported {
+		v.Set(key, value)
+	}
+	var candidate Config
+	if err := v.Unmarshal(&candidate); err != nil {
+		return result, nil, fmt.Errorf("invalid config: %w", err)
+	}
+	if err := validateConfig(&candidate); err != nil {
+		return result, nil, fmt.Errorf("invalid config: %w", err)
+	}
+	next := configValues(&candidate)
+
+	var profileFile *viper.Viper
+	if profileConfigFile != "" {
+		profileFile = viper.New()
+		profileFile.SetConfigFile(profileConfigFile)
+		if err := profileFile.ReadInConfig(); err != nil {
+			return result, nil, err
+		}
+	}
+	changed := map[string]any{}
+	for _, key := range slices.Sorted(maps.Keys(imported)) {
+		if reflect.DeepEqual(current[key], next[key]) {
+			continue
+		}
+		changed[key] = next[key]
+		result.Changes = append(result.Changes, configChange{
+			Key:  key,
+			From: redactConfigValue(key, current[key]),
+			To:   redactConfigValue(key, next[key]),
+		})
+		if _, ok := os.LookupEnv(envConfigVariable(key)); ok {
+			result.Overridden = append(result.Overridden, configOverride{Key: key, By: envConfigVariable(key)})
+		} else if profileFile != nil && profileFile.IsSet(key) {
+			result.Overridden = append(result.Overridden, configOverride{Key: key, By: profileConfigFile})
+		}
+	}
+	result.RestartRequired = slices.ContainsFunc(slices.Collect(maps.Keys(changed)), func(key string) bool { return !isReloadableConfigKey(key) })
+	return result, changed, nil
+}
+
+// writeConfigFile sets values in a config file, keeping the previous file as
+// <file>.bak. The file is rewritten, so its comments are lost.
+func writeConfigFile(path string, values map[string]any) error {
+	v := viper.New()
+	v.SetConfigFile(path)
+	if err := v.ReadInConfig(); err != nil {
+		return err
+	}
+	for key, value := range values {
+		v.Set(key, value)
+	}
+	previous, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path+".bak", previous, 0600); err != nil {
+		return err
+	}
+	// The temporary file keeps the extension, which selects the format.
+	tmp := filepath.Join(filepath.Dir(path), ".import-"+filepath.Base(path))
+	if err := v.WriteConfigAs(tmp); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// --- Admin endpoints ---
+
+// exportConfigHandler returns the effective configuration as a bundle.
+func exportConfigHandler(w http.ResponseWriter, r *http.Request) {
+	values := configValues(currentConfig())
+	for key, value := range values {
+		values[key] = redactConfigValue(key, value)
+	}
+	respondJSON(w, configBundle{
+		Format:     configBundleFormat,
+		Instance:   config.Registry.Instance,
+		Version:    Version,
+		Profile:    profile,
+		ExportedAt: time.Now().UTC().Truncate(time.Second),
+		Config:     nestConfigValues(values),
+	})
+}
+
+// importConfigHandler validates a bundle and writes it into the config file;
+// with ?dryRun=true it only reports what would change.
+func importConfigHandler(w http.ResponseWriter, r *http.Request) {
+	var bundle configBundle
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxConfigBundleLen)).Decode(&bundle); err != nil {
+		http.Error(w, "Invalid JSON request", http.StatusBadRequest)
+		return
+	}
+	configImportMu.Lock()
+	defer configImportMu.Unlock()
+	result, values, err := planConfigImport(bundle)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if result.DryRun = r.URL.Query().Get("dryRun") == "true"; result.DryRun {
+		respondJSON(w, result)
+		return
+	}
+	if baseConfigFile == "" {
+		http.Error(w, "This instance has no config file to import into, create one (e.g. /etc/flox/backend.yaml) and restart", http.StatusConflict)
+		return
+	}
+	if len(values) == 0 {
+		respondJSON(w, result)
+		return
+	}
+	if err := writeConfigFile(baseConfigFile, values); err != nil {
+		slog.ErrorContext(r.Context(), "error importing config bundle", "file", baseConfigFile, "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	slog.InfoContext(r.Context(), "imported config bundle", "instance", bundle.Instance, "file", baseConfigFile, "changes", len(result.Changes))
+	respondJSON(w, result)
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/rs/cors"
+)
+
+// The API has two CORS policies. The dashboard routes only accept the
+// origins of server.cors (the flox frontends by default, so self-hosters
+// list their own) and allow credentials. Public routes are called from
+// generated sites and embedded widgets (availability check, contact forms,
+// comments, ...) on any origin, so they allow every origin but no
+// credentials; registering a route as public must not loosen CORS for the
+// rest of the API.
+
+// dashboardCORSHeaders are allowed besides server.cors.allowed_headers,
+// the dashboard needs them.
+var dashboardCORSHeaders = []string{funnelSessionHeader, requestIDHeader, apiVersionHeader, idempotencyKeyHeader, "Prefer"}
+
+// corsExposedHeaders are the response headers scripts may read: the request
+// ID, the API version headers, so a frontend notices deprecations, and
+// whether a response is a replay (see idempotency.go).
+var corsExposedHeaders = []string{requestIDHeader, apiVersionHeader, apiSupportedVersionsHeader, "Deprecation", "Link", idempotentReplayedHeader}
+
+// publicRoutes are the mux patterns registered with handlePublic.
+var publicRoutes = map[string]bool{}
+
+// handlePublic registers a route of the public group.
+func handlePublic(mux *http.ServeMux, pattern string, handler http.HandlerFunc) {
+	mux.HandleFunc(pattern, handler)
+	publicRoutes[pattern] = true
+}
+
+// validateCORS checks server.cors of a config.
+func validateCORS(c *Config) error {
+	for _, origin := range c.Server.CORS.AllowedOrigins {
+		if origin == "*" {
+			if c.Server.CORS.AllowCredentials {
+				return fmt.Errorf("server.cors.allowed_origins \"*\" needs server.cors.allow_credentials: false")
+			}
+			continue
+		}
+		u, err := url.Parse(strings.Replace(origin, "*", "x", 1))
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" || (u.Path != "" && u.Path != "/") || strings.Count(origin, "*") > 1 {
+			return fmt.Errorf("server.cors.allowed_origins: %q is not an origin like https://app.example.com", origin)
+		}
+	}
+	for _, method := range c.Server.CORS.AllowedMethods {
+		if method == "" || strings.ToUpper(method) != method || strings.ContainsAny(method, " ,") {
+			return fmt.Errorf("server.cors.allowed_methods: %q is not an HTTP method", method)
+		}
+	}
+	return nil
+}
+
+// dashboardCORSCache holds the dashboard policy of a config snapshot, so a
+// reloaded server.cors applies to the next request.
+var dashboardCORSCache struct {
+	sync.Mutex
+	config *Config
+	cors   *cors.Cors
+}
+
+func dashboardCORS() *cors.Cors {
+	c := currentConfig()
+	dashboardCORSCache.Lock()
+	defer dashboardCORSCache.Unlock()
+	if dashboardCORSCache.config == c {
+		return dashboardCORSCache.cors
+	}
+	dashboardCORSCache.config = c
+	dashboardCORSCache.cors = cors.New(cors.Options{
+		AllowedOrigins:   c.Server.CORS.AllowedOrigins,
+		AllowedMethods:   c.Server.CORS.AllowedMethods,
+		AllowedHeaders:   slices.Concat(c.Server.CORS.AllowedHeaders, dashboardCORSHeaders),
+		ExposedHeaders:   corsExposedHeaders,
+		AllowCredentials: c.Server.CORS.AllowCredentials,
+		Debug:            c.Server.CORSDebug, // on in the dev profile
+		Logger:           corsLog(),
+	})
+	return dashboardCORSCache.cors
+}
+
+func publicCORS() *cors.Cors {
+	return cors.New(cors.Options{
+		AllowedOrigins: []string{"*"},
+		AllowedMethods: []string{"GET", "POST", "OPTIONS"},
+		AllowedHeaders: []string{"Content-Type", requestIDHeader, apiVersionHeader},
+		ExposedHeaders: corsExposedHeaders,
+		Debug:          config.Server.CORSDebug,
+		Logger:         corsLog(),
+	})
+}
+
+// corsLog passes the lines of server.cors_debug to slog.
+func corsLog() *log.Logger {
+	return slog.NewLogLogger(slog.Default().Handler(), slog.LevelInfo)
+}
+
+// corsHandler applies the public policy to the public routes of mux and the
+// dashboard policy, looked up per request, to everything else; next is mux
+// with its middleware.
+func corsHandler(mux *http.ServeMux, next http.Handler, dashboard func() *cors.Cors, public *cors.Cors) http.Handler {
+	publicHandler := public.Handler(next)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lookup := r
+		// A preflight is matched as the request it announces.
+		if method := r.Header.Get("Access-Control-Request-Method"); r.Method == http.MethodOptions && method != "" {
+			lookup = r.Clone(r.Context())
+			lookup.Method = method
+		}
+		if _, pattern := mux.Handler(lookup); publicRoutes[pattern] {
+			publicHandler.ServeHTTP(w, r)
+			return
+		}
+		dashboard().Handler(next).ServeHTTP(w, r)
+	})
+}
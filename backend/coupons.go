@@ -0,0 +1,259 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Referral and coupon codes are managed by admins and may be given when a
+// site is created. The code is stored with the site and every redemption is
+// counted for the campaign statistics.
+
+const couponsFile = ".coupons.json" // in sitesBaseDir
+
+var couponCodeRegex = regexp.MustCompile(`^[A-Z0-9_-]{3,32}$`)
+
+var (
+	errCouponUnknown   = errors.New("unknown code")
+	errCouponExpired   = errors.New("this code has expired")
+	errCouponExhausted = errors.New("this code has been used up")
+)
+
+type Coupon struct {
+	Code        string     `json:"code"`
+	Kind        string     `json:"kind"` // coupon or referral
+	Description string     `json:"description,omitempty"`
+	MaxUses     int        `json:"maxUses,omitempty"` // 0 is unlimited
+	ExpiresAt   *time.Time `json:"expiresAt,omitempty"`
+	CreatedAt   time.Time  `json:"createdAt"`
+	// Redemptions are filled by site creation, not by the admin.
+	Redemptions []CouponRedemption `json:"redemptions"`
+}
+
+type CouponRedemption struct {
+	SiteName   string    `json:"siteName"`
+	RedeemedAt time.Time `json:"redeemedAt"`
+}
+
+func (c *Coupon) validate() error {
+	if !couponCodeRegex.MatchString(c.Code) {
+		return errors.New("code must be 3-32 letters, digits, - or _")
+	}
+	if c.Kind != "coupon" && c.Kind != "referral" {
+		return errors.New(`kind must be "coupon" or "referral"`)
+	}
+	if c.MaxUses < 0 {
+		return errors.New("maxUses must not be negative")
+	}
+	if len(c.Description) > 500 {
+		return errors.New("description must be at most 500 characters")
+	}
+	return nil
+}
+
+// usable reports why a coupon cannot be redeemed now, if it cannot.
+func (c *Coupon) usable(now time.Time) error {
+	if c.ExpiresAt != nil && !now.Before(*c.ExpiresAt) {
+		return errCouponExpired
+	}
+	if c.MaxUses > 0 && len(c.Redemptions) >= c.MaxUses {
+		return errCouponExhausted
+	}
+	return nil
+}
+
+func normalizeCouponCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+// couponsMu serializes the read-modify-write of the coupons file, so usage
+// limits hold under concurrent creations.
+var couponsMu sync.Mutex
+
+func readCoupons() (map[string]*Coupon, error) {
+	coupons := map[string]*Coupon{}
+	data, err := os.ReadFile(filepath.Join(sitesBaseDir, couponsFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return coupons, nil
+		}
+		return nil, err
+	}
+	err = json.Unmarshal(data, &coupons)
+	return coupons, err
+}
+
+func writeCoupons(coupons map[string]*Coupon) error {
+	data, err := json.MarshalIndent(coupons, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(sitesBaseDir, couponsFile)
+	return writeFileAtomic(path, data, 0644)
+}
+
+// redeemCoupon records the use of a code by a new site, or explains why it
+// cannot be used.
+func redeemCoupon(code, siteName string) error {
+	couponsMu.Lock()
+	defer couponsMu.Unlock()
+	coupons, err := readCoupons()
+	if err != nil {
+		return err
+	}
+	c, ok := coupons[normalizeCouponCode(code)]
+	if !ok {
+		return errCouponUnknown
+	}
+	now := time.Now().UTC()
+	if err := c.usable(now); err != nil {
+		return err
+	}
+	c.Redemptions = append(c.Redemptions, CouponRedemption{SiteName: siteName, RedeemedAt: now})
+	return writeCoupons(coupons)
+}
+
+// unredeemCoupon takes back a redemption when the site creation failed.
+func unredeemCoupon(code, siteName string) {
+	couponsMu.Lock()
+	defer couponsMu.Unlock()
+	coupons, err := readCoupons()
+	if err == nil {
+		if c, ok := coupons[normalizeCouponCode(code)]; ok {
+			c.Redemptions = slices.DeleteFunc(c.Redemptions, func(r CouponRedemption) bool { return r.SiteName == siteName })
+			err = writeCoupons(coupons)
+		}
+	}
+	if err != nil {
+		slog.Error("error taking back redemption", "code", code, "site", siteName, "error", err)
+	}
+}
+
+func isCouponError(err error) bool {
+	return errors.Is(err, errCouponUnknown) || errors.Is(err, errCouponExpired) || errors.Is(err, errCouponExhausted)
+}
+
+// --- Handlers ---
+
+type couponStats struct {
+	*Coupon
+	Uses      int  `json:"uses"`
+	Remaining *int `json:"remaining,omitempty"` // nil if unlimited
+	Active    bool `json:"active"`
+}
+
+func statsFor(c *Coupon, now time.Time) couponStats {
+	s := couponStats{Coupon: c, Uses: len(c.Redemptions), Active: c.usable(now) == nil}
+	if c.MaxUses > 0 {
+		remaining := max(c.MaxUses-len(c.Redemptions), 0)
+		s.Remaining = &remaining
+	}
+	return s
+}
+
+// listCouponsHandler returns all codes with their redemption statistics.
+func listCouponsHandler(w http.ResponseWriter, r *http.Request) {
+	coupons, err := readCoupons()
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error reading coupons", "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	now := time.Now().UTC()
+	stats := make([]couponStats, 0, len(coupons))
+	for _, c := range coupons {
+		stats = append(stats, statsFor(c, now))
+	}
+	slices.SortFunc(stats, func(a, b couponStats) int { return strings.Compare(a.Code, b.Code) })
+	respondJSON(w, stats)
+}
+
+// putCouponHandler creates or updates a code. Redemptions are kept.
+func putCouponHandler(w http.ResponseWriter, r *http.Request) {
+	var c Coupon
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+		http.Error(w, "Invalid JSON request", http.StatusBadRequest)
+		return
+	}
+	c.Code = normalizeCouponCode(r.PathValue("code"))
+	if err := c.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	couponsMu.Lock()
+	defer couponsMu.Unlock()
+	coupons, err := readCoupons()
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error reading coupons", "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	c.CreatedAt = time.Now().UTC()
+	c.Redemptions = []CouponRedemption{}
+	if existing, ok := coupons[c.Code]; ok {
+		c.CreatedAt = existing.CreatedAt
+		c.Redemptions = existing.Redemptions
+	}
+	coupons[c.Code] = &c
+	if err := writeCoupons(coupons); err != nil {
+		slog.ErrorContext(r.Context(), "error writing coupons", "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	respondJSON(w, statsFor(&c, time.Now().UTC()))
+}
+
+func deleteCouponHandler(w http.ResponseWriter, r *http.Request) {
+	code := normalizeCouponCode(r.PathValue("code"))
+	couponsMu.Lock()
+	defer couponsMu.Unlock()
+	coupons, err := readCoupons()
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error reading coupons", "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if _, ok := coupons[code]; !ok {
+		http.Error(w, "Code not found", http.StatusNotFound)
+		return
+	}
+	delete(coupons, code)
+	if err := writeCoupons(coupons); err != nil {
+		slog.ErrorContext(r.Context(), "error writing coupons", "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// checkCouponHandler lets the wizard check a code before creating the site.
+// It reveals nothing but whether the code can be used.
+func checkCouponHandler(w http.ResponseWriter, r *http.Request) {
+	coupons, err := readCoupons()
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error reading coupons", "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	c, ok := coupons[normalizeCouponCode(r.PathValue("code"))]
+	err = errCouponUnknown
+	if ok {
+		err = c.usable(time.Now().UTC())
+	}
+	if err != nil {
+		respondJSON(w, validationResponse{Valid: false, Error: err.Error(), Code: codeInvalidCoupon})
+		return
+	}
+	respondJSON(w, validationResponse{Valid: true})
+}
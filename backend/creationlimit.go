@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Site creation is limited instance-wide to limits.site_creations_per_hour,
+// so runaway automation cannot create sites (and DNS records, which can get
+// the DNS provider account suspended) faster than anyone notices. Over the
+// limit, limits.site_creation_policy "reject" answers creations with 429;
+// "queue" creates the sites but queues their DNS records like during a
+// provider outage, and the scheduler creates them as the limit allows.
+// Hitting the limit is logged as an error, mailed to limits.alert_email
+// (once per hour) and reported by /api/v1/health.
+
+const siteCreationWindow = time.Hour
+
+// errCreationLimited is the cause of records queued by the "queue" policy.
+var errCreationLimited = errors.New("the site creation limit is reached")
+
+var creationLimit struct {
+	mu        sync.Mutex
+	times     []time.Time // counted creations within the window, oldest first
+	limitedAt time.Time   // when the limit was last hit
+	alertedAt time.Time
+}
+
+// pruneCreations drops the creations that left the window; the caller holds
+// creationLimit.mu.
+func pruneCreations(now time.Time) {
+	i := 0
+	for i < len(creationLimit.times) && now.Sub(creationLimit.times[i]) >= siteCreationWindow {
+		i++
+	}
+	creationLimit.times = creationLimit.times[i:]
+}
+
+// takeCreationSlot counts a creation of the site against the limit and
+// reports whether it is within it.
+func takeCreationSlot(siteName string) bool {
+	limit := currentConfig().Limits.SiteCreationsPerHour
+	if limit <= 0 {
+		return true
+	}
+	now := time.Now()
+	creationLimit.mu.Lock()
+	defer creationLimit.mu.Unlock()
+	pruneCreations(now)
+	if len(creationLimit.times) < limit {
+		creationLimit.times = append(creationLimit.times, now)
+		return true
+	}
+	creationLimit.limitedAt = now
+	if now.Sub(creationLimit.alertedAt) >= siteCreationWindow {
+		creationLimit.alertedAt = now
+		go alertCreationLimit(siteName, limit)
+	}
+	return false
+}
+
+// creationRetryAfter returns when the next creation will be within the
+// limit.
+func creationRetryAfter() time.Duration {
+	now := time.Now()
+	creationLimit.mu.Lock()
+	defer creationLimit.mu.Unlock()
+	pruneCreations(now)
+	if len(creationLimit.times) == 0 {
+		return 0
+	}
+	return siteCreationWindow - now.Sub(creationLimit.times[0])
+}
+
+func alertCreationLimit(siteName string, limit int) {
+	limits := currentConfig().Limits
+	slog.Error("error: site creation limit per hour reached", "limit", limit, "site", siteName, "policy", limits.SiteCreationPolicy)
+	if limits.AlertEmail == "" {
+		return
+	}
+	effect := "rejected"
+	if limits.SiteCreationPolicy == "queue" {
+		effect = "created with their DNS records queued"
+	}
+	data := map[string]any{"Instance": config.Registry.Instance, "Limit": limit, "SiteName": siteName, "Effect": effect}
+	if err := sendTemplateEmail(limits.AlertEmail, "creation_limit", data); err != nil {
+		slog.Error("error sending creation limit alert", "to", limits.AlertEmail, "error", err)
+	}
+}
+
+// creationLimitHealth is the creation limit status of the health endpoint,
+// unhealthy while the limit was hit within the last hour.
+func creationLimitHealth() (status string, healthy bool) {
+	limit := currentConfig().Limits.SiteCreationsPerHour
+	if limit <= 0 {
+		return "OK (no limit)", true
+	}
+	now := time.Now()
+	creationLimit.mu.Lock()
+	defer creationLimit.mu.Unlock()
+	pruneCreations(now)
+	if !creationLimit.limitedAt.IsZero() && now.Sub(creationLimit.limitedAt) < siteCreationWindow {
+		return fmt.Sprintf("limit of %d per hour reached at %s", limit, creationLimit.limitedAt.UTC().Format(time.RFC3339)), false
+	}
+	return fmt.Sprintf("OK (%d of %d in the last hour)", len(creationLimit.times), limit), true
+}
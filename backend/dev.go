@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// devMode is set by --dev: a fake DNS API, a temporary sites dir, demo sites
+// and permissive CORS, so the frontend can be developed against one binary.
+var devMode bool
+
+const devDNSToken = "Token dev"
+
+type fakeRRSet struct {
+	Subname string   `json:"subname"`
+	Type    string   `json:"type"`
+	TTL     int      `json:"ttl"`
+	Records []string `json:"records"`
+}
+
+// fakeDNS imitates the deSEC rrsets API closely enough for the site records.
+type fakeDNS struct {
+	mu     sync.Mutex
+	rrsets []fakeRRSet
+}
+
+func (f *fakeDNS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != devDNSToken {
+		http.Error(w, `{"detail": "Invalid token."}`, http.StatusUnauthorized)
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch r.Method {
+	case http.MethodGet:
+		respondJSON(w, f.rrsets)
+	case http.MethodPost:
+		var rr fakeRRSet
+		if err := json.NewDecoder(r.Body).Decode(&rr); err != nil || rr.Type == "" || len(rr.Records) == 0 {
+			http.Error(w, `{"detail": "Invalid RRset."}`, http.StatusBadRequest)
+			return
+		}
+		if slices.ContainsFunc(f.rrsets, func(x fakeRRSet) bool { return x.Subname == rr.Subname && x.Type == rr.Type }) {
+			http.Error(w, `{"non_field_errors": ["Another RRset with the same subdomain and type exists for this domain."]}`, http.StatusBadRequest)
+			return
+		}
+		f.rrsets = append(f.rrsets, rr)
+		slog.InfoContext(r.Context(), "dev DNS: created", "type", rr.Type, "subname", rr.Subname, "records", rr.Records)
+		respondJSONStatus(w, http.StatusCreated, rr)
+	case http.MethodPatch:
+		if strings.HasSuffix(r.URL.Path, "/rrsets/") {
+			f.bulkPatch(w, r)
+			return
+		}
+		// .../rrsets/{subname}/{type}/
+		parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		i := slices.IndexFunc(f.rrsets, func(x fakeRRSet) bool {
+			return len(parts) >= 2 && x.Subname == parts[len(parts)-2] && x.Type == parts[len(parts)-1]
+		})
+		if i < 0 {
+			http.Error(w, `{"detail": "Not found."}`, http.StatusNotFound)
+			return
+		}
+		var patch fakeRRSet
+		if err := json.NewDecoder(r.Body).Decode(&patch); err != nil || len(patch.Records) == 0 {
+			http.Error(w, `{"detail": "Invalid RRset."}`, http.StatusBadRequest)
+			return
+		}
+		f.rrsets[i].Records = patch.Records
+		respondJSON(w, f.rrsets[i])
+	case http.MethodDelete:
+		// .../rrsets/{subname}/{type}/
+		parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		if len(parts) < 2 {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+		subname, typ := parts[len(parts)-2], parts[len(parts)-1]
+		f.rrsets = slices.DeleteFunc(f.rrsets, func(x fakeRRSet) bool { return x.Subname == subname && x.Type == typ })
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// bulkPatch applies a list of record sets all or nothing; empty records
+// delete. Like deSEC it reports invalid entries with one error object per
+// entry.
+func (f *fakeDNS) bulkPatch(w http.ResponseWriter, r *http.Request) {
+	var sets []fakeRRSet
+	if err := json.NewDecoder(r.Body).Decode(&sets); err != nil {
+		http.Error(w, `{"detail": "Invalid JSON."}`, http.StatusBadRequest)
+		return
+	}
+	itemErrors := make([]map[string]any, len(sets))
+	invalid := false
+	for i, rr := range sets {
+		itemErrors[i] = map[string]any{}
+		if rr.Type == "" || !siteNameRegex.MatchString(rr.Subname) {
+			itemErrors[i]["subname"] = []string{"Invalid subname or type."}
+			invalid = true
+		}
+	}
+	if invalid {
+		respondJSONStatus(w, http.StatusBadRequest, itemErrors)
+		return
+	}
+	for _, rr := range sets {
+		match := func(x fakeRRSet) bool { return x.Subname == rr.Subname && x.Type == rr.Type }
+		f.rrsets = slices.DeleteFunc(f.rrsets, match)
+		if len(rr.Records) > 0 {
+			f.rrsets = append(f.rrsets, rr)
+		}
+	}
+	slog.InfoContext(r.Context(), "dev DNS: bulk update", "rrsets", len(sets))
+	respondJSON(w, sets)
+}
+
+// selfSignedCert creates a short-lived certificate for 127.0.0.1/localhost.
+func selfSignedCert() (tls.Certificate, *x509.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 62))
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "flox dev"},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(7 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, leaf, nil
+}
+
+// startFakeDNS serves the fake DNS API over TLS with a self-signed
+// certificate and makes the DNS client trust it.
+func startFakeDNS() (addr string, err error) {
+	cert, leaf, err := selfSignedCert()
+	if err != nil {
+		return "", fmt.Errorf("failed to create certificate: %v", err)
+	}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		return "", err
+	}
+	go func() {
+		if err := http.Serve(listener, &fakeDNS{}); err != nil {
+			slog.Info("dev DNS: server stopped", "error", err)
+		}
+	}()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+	dnsHTTPClient.Transport = &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}
+	return listener.Addr().String(), nil
+}
+
+// devSeedSites are created on every start in dev mode.
+var devSeedSites = []SiteConfig{
+	{SiteName: "demo", Description: "A demo one-pager", Style: "light", InitialContent: []string{"header", "hero", "features", "testimonials", "contact", "footer"}},
+	{SiteName: "demo-bakery", Description: "Fresh bread every morning", Style: "material", InitialContent: []string{"header", "hero", "hours", "location", "footer"}},
+	{SiteName: "demo-blog", Description: "Notes and news", Style: "dark", InitialContent: []string{"header", "blog", "newsletter", "footer"}},
+}
+
+// seedSite creates a site like the create endpoint does, optionally including
+// the DNS record. The caller builds the site once its content is in place.
+func seedSite(sc SiteConfig, withDNS bool) error {
+	if exists, err := siteExists(sc.SiteName); err != nil || exists {
+		return err
+	}
+	if err := createSiteDir(sc.SiteName); err != nil {
+		return err
+	}
+	if sc.CreatedAt.IsZero() {
+		sc.CreatedAt = time.Now().UTC()
+	}
+	if err := writeSiteConfig(sitesBaseDir, sc.SiteName, sc); err != nil {
+		return err
+	}
+	recordSiteEvent(sc.SiteName, SiteEvent{Time: sc.CreatedAt, Type: "site.created", Message: "seeded"})
+	if withDNS {
+		if err := createSiteRecords(context.Background(), sc.SiteName, os.Getenv("SITE_IP"), nil); err != nil {
+			slog.Error("failed to create DNS records", "site", sc.SiteName, "error", err)
+		}
+	}
+	return nil
+}
+
+func startDevEnvironment() {
+	addr, err := startFakeDNS()
+	if err != nil {
+		fatal("Failed to start dev DNS", "error", err)
+	}
+	dnsProvider = &desecProvider{}
+	os.Setenv("DNS_API_RRSETS", addr+"/api/v1/domains/"+config.DNS.Domain+"/rrsets/")
+	os.Setenv("DNS_API_AUTH", devDNSToken)
+	if os.Getenv("SITE_IP") == "" {
+		os.Setenv("SITE_IP", "127.0.0.1")
+	}
+	slog.Info("Dev mode: fake DNS API (self-signed)", "url", "https://"+addr, "sites_dir", sitesBaseDir)
+
+	for _, sc := range devSeedSites {
+		if err := seedSite(sc, true); err != nil {
+			slog.Error("error seeding", "site", sc.SiteName, "error", err)
+			continue
+		}
+		if _, err := buildSite(sc.SiteName); err != nil {
+			slog.Error("error building site", "site", sc.SiteName, "error", err)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// The disk monitor checks the free space and inodes of the sites volume
+// every disk.check_interval. Below disk.min_free_percent or
+// disk.min_free_inodes_percent the API turns read-only: requests that write
+// (site creation, edits, public submissions) are answered with 503 until
+// there is room again, since a full disk truncates config.json and the other
+// state files instead of failing loudly. Reads and deletions, which free
+// space, go on. Switching to read-only is logged as an error and mailed to
+// limits.alert_email; /api/v1/health reports the volume.
+
+type diskUsage struct {
+	FreeBytes, TotalBytes   uint64
+	FreeInodes, TotalInodes uint64
+}
+
+func (u diskUsage) freePercent() float64 {
+	if u.TotalBytes == 0 {
+		return 100
+	}
+	return float64(u.FreeBytes) / float64(u.TotalBytes) * 100
+}
+
+func (u diskUsage) freeInodesPercent() float64 {
+	if u.TotalInodes == 0 {
+		return 100 // file systems without inode limit, e.g. btrfs
+	}
+	return float64(u.FreeInodes) / float64(u.TotalInodes) * 100
+}
+
+func statDisk(path string) (diskUsage, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return diskUsage{}, err
+	}
+	bsize := uint64(st.Bsize)
+	return diskUsage{
+		FreeBytes:   uint64(st.Bavail) * bsize, // available to unprivileged users
+		TotalBytes:  uint64(st.Blocks) * bsize,
+		FreeInodes:  uint64(st.Ffree),
+		TotalInodes: uint64(st.Files),
+	}, nil
+}
+
+var diskState struct {
+	sync.Mutex
+	usage     diskUsage
+	checkedAt time.Time
+	err       error
+	readOnly  string // why the API is read-only, empty if it is not
+}
+
+// diskShortage returns why the usage is below the thresholds, or "".
+func diskShortage(u diskUsage) string {
+	switch {
+	case u.freePercent() < config.Disk.MinFreePercent:
+		return fmt.Sprintf("%.1f%% disk space free (%s), below disk.min_free_percent %g%%", u.freePercent(), formatBytes(u.FreeBytes), config.Disk.MinFreePercent)
+	case u.freeInodesPercent() < config.Disk.MinFreeInodesPercent:
+		return fmt.Sprintf("%.1f%% inodes free (%d), below disk.min_free_inodes_percent %g%%", u.freeInodesPercent(), u.FreeInodes, config.Disk.MinFreeInodesPercent)
+	}
+	return ""
+}
+
+func formatBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := uint64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// checkDisk measures the sites volume and switches read-only on or off.
+func checkDisk() {
+	usage, err := statDisk(sitesBaseDir)
+	diskState.Lock()
+	defer diskState.Unlock()
+	diskState.checkedAt = time.Now()
+	diskState.err = err
+	if err != nil {
+		// Leave the mode as it is, a failing check says nothing about space.
+		slog.Error("error checking disk space", "dir", sitesBaseDir, "error", err)
+		return
+	}
+	diskState.usage = usage
+	shortage := diskShortage(usage)
+	switch {
+	case shortage != "" && diskState.readOnly == "":
+		slog.Error("error: the sites volume is almost full, the API is read-only", "dir", sitesBaseDir, "shortage", shortage)
+		go alertDiskShortage(shortage)
+	case shortage == "" && diskState.readOnly != "":
+		slog.Info("The sites volume has room again, the API accepts changes", "dir", sitesBaseDir)
+	}
+	diskState.readOnly = shortage
+}
+
+func alertDiskShortage(shortage string) {
+	to := currentConfig().Limits.AlertEmail
+	if to == "" {
+		return
+	}
+	data := map[string]any{"Dir": sitesBaseDir, "Instance": config.Registry.Instance, "Shortage": shortage}
+	if err := sendTemplateEmail(to, "disk_alert", data); err != nil {
+		slog.Error("error sending disk alert", "to", to, "error", err)
+	}
+}
+
+// runDiskMonitor checks the volume at startup and every interval.
+func runDiskMonitor(interval time.Duration) {
+	if interval <= 0 {
+		slog.Info("Disk monitor disabled (disk.check_interval <= 0)")
+		return
+	}
+	checkDisk()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		checkDisk()
+	}
+}
+
+// diskReadOnly returns why the API is read-only, or "".
+func diskReadOnly() string {
+	diskState.Lock()
+	defer diskState.Unlock()
+	return diskState.readOnly
+}
+
+// readOnlyExempt are the write methods' routes that do not write.
+var readOnlyExempt = map[string]bool{
+	"POST /api/v1/sites/validate-name": true,
+	"POST /api/v1/auth/login":          true,
+}
+
+// readOnlyGuard rejects requests that write while the volume is almost
+// full; next is mux with its middleware.
+func readOnlyGuard(mux *http.ServeMux, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPost, http.MethodPut, http.MethodPatch:
+			if reason := diskReadOnly(); reason != "" {
+				if _, pattern := mux.Handler(r); !readOnlyExempt[pattern] {
+					w.Header().Set("Retry-After", fmt.Sprint(int(config.Disk.CheckInterval.Seconds())))
+					apiError(w, r, http.StatusServiceUnavailable, codeReadOnly, "The server is low on disk space and read-only for now, please try again later")
+					return
+				}
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// diskHealth is the volume status of the health endpoint.
+func diskHealth() (status string, healthy bool) {
+	if config.Disk.CheckInterval <= 0 {
+		return "not monitored", true
+	}
+	diskState.Lock()
+	defer diskState.Unlock()
+	switch {
+	case diskState.checkedAt.IsZero():
+		return "not checked yet", true
+	case diskState.readOnly != "":
+		return "read-only: " + diskState.readOnly, false
+	case diskState.err != nil:
+		return "check failed: " + diskState.err.Error(), false
+	}
+	u := diskState.usage
+	return fmt.Sprintf("OK (%s free, %.1f%%; %.1f%% inodes free)", formatBytes(u.FreeBytes), u.freePercent(), u.freeInodesPercent()), true
+}
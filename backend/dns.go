@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// rrset is a DNS record set: all records of one type for one name. Subname
+// is relative to dns.domain, "" for the apex.
+type rrset struct {
+	Subname string   `json:"subname"`
+	Type    string   `json:"type"`
+	TTL     int      `json:"ttl"`
+	Records []string `json:"records"`
+	// Owner tags record sets created by flox, see dnsowner.go. Providers
+	// with record metadata store it and return it from ListRecords.
+	Owner *recordOwner `json:"-"`
+}
+
+// DNSProvider manages the record sets of dns.domain at a DNS provider,
+// selected with dns.provider. Failures are DNSErrors classified by the
+// provider. The context is that of the API request or job the calls are
+// made for; its request ID is passed on to the provider.
+type DNSProvider interface {
+	// CreateRecord adds a record set. It fails with kind exists if the name
+	// already has one of the type.
+	CreateRecord(ctx context.Context, rr rrset) error
+	// DeleteRecord removes a record set. A missing one is not an error.
+	DeleteRecord(ctx context.Context, subname, recordType string) error
+	// ListRecords returns all record sets of the zone.
+	ListRecords(ctx context.Context) ([]rrset, error)
+}
+
+// dnsUpdater is implemented by providers that can replace the records of a
+// set in place. It fails with kind not_found if there is no such set.
+// Without it a set is deleted and created again.
+type dnsUpdater interface {
+	UpdateRecord(ctx context.Context, rr rrset) error
+}
+
+// dnsBatcher is implemented by providers with a bulk endpoint, used with
+// dns.bulk. Empty records delete a set. The provider applies a batch all or
+// nothing; if it rejects some of the sets their messages are returned by
+// index and nothing is applied.
+type dnsBatcher interface {
+	ApplyRecords(ctx context.Context, sets []rrset) (rejected map[int]string, err error)
+}
+
+// dnsChecker is implemented by providers with a cheap authenticated request
+// for the pre-flight check; for the others the zone is listed.
+type dnsChecker interface {
+	Check(ctx context.Context) error
+}
+
+// dnsProvider is set from dns.provider at startup.
+var dnsProvider DNSProvider = &desecProvider{}
+
+func newDNSProvider(name string) (DNSProvider, error) {
+	switch name {
+	case "", "desec":
+		return &desecProvider{}, nil
+	case "cloudflare":
+		return &cloudflareProvider{}, nil
+	case "route53":
+		return &route53Provider{}, nil
+	case "mock":
+		return &mockProvider{}, nil
+	}
+	return nil, fmt.Errorf("unknown dns.provider %q, use desec, cloudflare, route53 or mock", name)
+}
+
+// dnsPacer spaces out requests to the DNS API by dns.min_interval, shared
+// by all callers so bulk work cannot starve interactive site creation of
+// the provider's rate limit.
+var dnsPacer struct {
+	mu   sync.Mutex
+	last time.Time
+}
+
+func waitForDNSSlot() {
+	dnsPacer.mu.Lock()
+	defer dnsPacer.mu.Unlock()
+	if wait := time.Until(dnsPacer.last.Add(currentConfig().DNS.MinInterval)); wait > 0 {
+		time.Sleep(wait)
+	}
+	dnsPacer.last = time.Now()
+}
+
+// retryAfter returns the delay requested by a 429 response.
+func retryAfter(resp *http.Response) time.Duration {
+	if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	return time.Second
+}
+
+// dnsDo sends a request to a DNS provider API, paced by dns.min_interval.
+// newRequest is called for every attempt, so signed requests get a fresh
+// signature. Throttled requests are retried after the delay the API asks
+// for, up to dns.max_retries times as long as the delay is at most
+// dns.max_retry_wait. The request ID of ctx is sent as X-Request-ID; ctx
+// does not cancel the request, a client going away must not leave a site
+// half provisioned.
+func dnsDo(ctx context.Context, newRequest func() (*http.Request, error)) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		req, err := newRequest()
+		if err != nil {
+			return nil, fmt.Errorf("failed to create request: %v", err)
+		}
+		if id := requestIDFrom(ctx); id != "" {
+			req.Header.Set(requestIDHeader, id)
+		}
+		waitForDNSSlot()
+		start := time.Now()
+		resp, err := dnsHTTPClient.Do(req)
+		countDNSRequest(req.Method, resp, time.Since(start))
+		if err != nil {
+			return nil, &DNSError{Kind: dnsErrUnavailable, Detail: err.Error()}
+		}
+		if resp.StatusCode != http.StatusTooManyRequests || attempt >= currentConfig().DNS.MaxRetries {
+			return resp, nil
+		}
+		wait := retryAfter(resp)
+		if wait > currentConfig().DNS.MaxRetryWait {
+			return resp, nil
+		}
+		resp.Body.Close()
+		slog.WarnContext(ctx, "DNS API throttled, retrying", "method", req.Method, "url", req.URL.Redacted(), "wait", wait)
+		time.Sleep(wait)
+	}
+}
+
+// listRRSets returns all record sets of the domain.
+func listRRSets(ctx context.Context) ([]rrset, error) {
+	return dnsProvider.ListRecords(ctx)
+}
+
+// siteRecords are the record sets pointing a site at this server: an A
+// record for SITE_IP and, on dual-stack servers, an AAAA record for
+// dns.ipv6 (SITE_IPV6).
+func siteRecords(siteName, siteIP string) []rrset {
+	owner := siteRecordOwner(siteName)
+	sets := []rrset{{Subname: siteName, Type: "A", TTL: 3600, Records: []string{siteIP}, Owner: owner}}
+	if config.DNS.IPv6 != "" {
+		sets = append(sets, rrset{Subname: siteName, Type: "AAAA", TTL: 3600, Records: []string{config.DNS.IPv6}, Owner: owner})
+	}
+	return sets
+}
+
+// siteRecordTypes returns the record types created for a site. Sites
+// created before the types were stored only have an A record.
+func siteRecordTypes(siteConfig SiteConfig) []string {
+	if len(siteConfig.DNSRecords) == 0 {
+		return []string{"A"}
+	}
+	types := make([]string, len(siteConfig.DNSRecords))
+	for i, rr := range siteConfig.DNSRecords {
+		types[i] = rr.Type
+	}
+	return types
+}
+
+// createRecord, updateRecord and deleteRecord change a record set at the
+// provider and record the change in the audit log.
+func createRecord(ctx context.Context, rr rrset) error {
+	err := dnsProvider.CreateRecord(ctx, rr)
+	recordDNSAudit(ctx, "dns.create", rr, err)
+	return err
+}
+
+func updateRecord(ctx context.Context, rr rrset) error {
+	var err error
+	if u, ok := dnsProvider.(dnsUpdater); ok {
+		err = u.UpdateRecord(ctx, rr)
+	} else if err = dnsProvider.DeleteRecord(ctx, rr.Subname, rr.Type); err == nil {
+		err = dnsProvider.CreateRecord(ctx, rr)
+	}
+	recordDNSAudit(ctx, "dns.update", rr, err)
+	return err
+}
+
+func deleteRecord(ctx context.Context, subdomain, recordType string) error {
+	err := dnsProvider.DeleteRecord(ctx, subdomain, recordType)
+	recordDNSAudit(ctx, "dns.delete", rrset{Subname: subdomain, Type: recordType}, err)
+	if err == nil {
+		ownRecords([]rrset{{Subname: subdomain, Type: recordType}})
+	}
+	return err
+}
+
+// checkDNSProvider is the request of the pre-flight check.
+func checkDNSProvider(ctx context.Context) error {
+	if c, ok := dnsProvider.(dnsChecker); ok {
+		return c.Check(ctx)
+	}
+	_, err := dnsProvider.ListRecords(ctx)
+	return err
+}
+
+// rrsetFailure is a record set the provider rejected in a batch.
+type rrsetFailure struct {
+	RRSet rrset  `json:"rrset"`
+	Error string `json:"error"`
+}
+
+type batchResult struct {
+	Applied []rrset        `json:"applied"`
+	Failed  []rrsetFailure `json:"failed"`
+}
+
+// applyRRSets creates, replaces or (with empty records) deletes record sets.
+// With dns.bulk and a provider supporting it they are sent in chunks of
+// dns.batch_size. A chunk the provider rejects because of some of its record
+// sets is retried without them, so one bad record does not fail the rest.
+// Otherwise every record set is a request of its own.
+func applyRRSets(ctx context.Context, changes []rrset) (result batchResult) {
+	defer func() { ownRecords(result.Applied) }()
+	batcher, ok := dnsProvider.(dnsBatcher)
+	if !currentConfig().DNS.Bulk || !ok {
+		for _, rr := range changes {
+			if err := applyRRSet(ctx, rr); err != nil {
+				result.Failed = append(result.Failed, rrsetFailure{RRSet: rr, Error: err.Error()})
+			} else {
+				result.Applied = append(result.Applied, rr)
+			}
+		}
+		return result
+	}
+	for len(changes) > 0 {
+		chunk := changes[:min(len(changes), max(currentConfig().DNS.BatchSize, 1))]
+		changes = changes[len(chunk):]
+		for len(chunk) > 0 {
+			rejected, err := batcher.ApplyRecords(ctx, chunk)
+			if err != nil {
+				// Nothing in this chunk was applied.
+				for _, rr := range chunk {
+					result.Failed = append(result.Failed, rrsetFailure{RRSet: rr, Error: err.Error()})
+				}
+				break
+			}
+			if len(rejected) == 0 {
+				for _, rr := range chunk {
+					recordDNSAudit(ctx, "dns.apply", rr, nil)
+				}
+				result.Applied = append(result.Applied, chunk...)
+				break
+			}
+			// Drop the rejected record sets and send the rest again.
+			var rest []rrset
+			for i, rr := range chunk {
+				if msg, ok := rejected[i]; ok {
+					result.Failed = append(result.Failed, rrsetFailure{RRSet: rr, Error: msg})
+				} else {
+					rest = append(rest, rr)
+				}
+			}
+			chunk = rest
+		}
+	}
+	return result
+}
+
+// applyRRSet is the single-request equivalent of a bulk entry: it updates
+// the record set, or creates it if it does not exist yet.
+func applyRRSet(ctx context.Context, rr rrset) error {
+	if len(rr.Records) == 0 {
+		err := dnsProvider.DeleteRecord(ctx, rr.Subname, rr.Type)
+		recordDNSAudit(ctx, "dns.delete", rr, err)
+		return err
+	}
+	err := updateRecord(ctx, rr)
+	if errors.Is(err, &DNSError{Kind: dnsErrNotFound}) {
+		return createRecord(ctx, rr)
+	}
+	return err
+}
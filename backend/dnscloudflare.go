@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// cloudflareProvider manages the zone dns.cloudflare.zone_id through the
+// Cloudflare API v4 with an API token (permission Zone.DNS:Edit).
+// Cloudflare stores single records, they are grouped into record sets here.
+// The owner tag of a set is kept in the comment of its records.
+type cloudflareProvider struct{}
+
+// cloudflareAPIURL is a variable for tests against a fake API.
+var cloudflareAPIURL = "https://api.cloudflare.com/client/v4"
+
+type cloudflareRecord struct {
+	ID      string `json:"id,omitempty"`
+	Type    string `json:"type"`
+	Name    string `json:"name"`
+	Content string `json:"content"`
+	TTL     int    `json:"ttl"`
+	Comment string `json:"comment,omitempty"`
+}
+
+type cloudflareResponse struct {
+	Success bool `json:"success"`
+	Errors  []struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"errors"`
+	Result     json.RawMessage `json:"result"`
+	ResultInfo struct {
+		Page       int `json:"page"`
+		TotalPages int `json:"total_pages"`
+	} `json:"result_info"`
+}
+
+// cloudflareErrorKinds maps Cloudflare's error codes.
+var cloudflareErrorKinds = map[int]dnsErrorKind{
+	81053: dnsErrExists, // a record of another type with that name exists
+	81057: dnsErrExists, // identical record exists
+	81058: dnsErrExists,
+	81045: dnsErrQuota, // record quota exceeded
+	1004:  dnsErrInvalidName,
+	9005:  dnsErrInvalidName, // invalid content
+	9000:  dnsErrInvalidName, // invalid name
+	10000: dnsErrAuth,
+	6003:  dnsErrAuth,   // invalid request headers, e.g. a malformed token
+	7003:  dnsErrConfig, // could not route, e.g. an unknown zone ID
+	81044: dnsErrNotFound,
+}
+
+func (p *cloudflareProvider) request(ctx context.Context, method, path string, query url.Values, body any) (*cloudflareResponse, error) {
+	zoneID, token := config.DNS.Cloudflare.ZoneID, config.DNS.Cloudflare.APIToken
+	if zoneID == "" || token == "" {
+		return nil, &DNSError{Kind: dnsErrConfig, Detail: "dns.cloudflare.zone_id or dns.cloudflare.api_token missing"}
+	}
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			return nil, fmt.Errorf("failed to marshal JSON: %v", err)
+		}
+	}
+	apiURL := cloudflareAPIURL + "/zones/" + url.PathEscape(zoneID) + path
+	if len(query) > 0 {
+		apiURL += "?" + query.Encode()
+	}
+	resp, err := dnsDo(ctx, func() (*http.Request, error) {
+		req, err := http.NewRequest(method, apiURL, bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("Content-Type", "application/json")
+		return req, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, 16<<20))
+	if err != nil {
+		return nil, &DNSError{Kind: dnsErrUnavailable, Status: resp.StatusCode, Detail: err.Error()}
+	}
+	var cr cloudflareResponse
+	if json.Unmarshal(raw, &cr) != nil || !cr.Success || resp.StatusCode >= 300 {
+		return nil, classifyCloudflareResponse(resp.StatusCode, cr, raw)
+	}
+	return &cr, nil
+}
+
+func classifyCloudflareResponse(status int, cr cloudflareResponse, raw []byte) *DNSError {
+	detail := strings.TrimSpace(string(raw))
+	if len(detail) > 2048 {
+		detail = detail[:2048]
+	}
+	e := &DNSError{Kind: dnsErrUnknown, Status: status, Detail: detail}
+	for _, ce := range cr.Errors {
+		if kind, ok := cloudflareErrorKinds[ce.Code]; ok {
+			e.Kind = kind
+			return e
+		}
+	}
+	switch {
+	case status == http.StatusTooManyRequests:
+		e.Kind = dnsErrThrottled
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		e.Kind = dnsErrAuth
+	case status == http.StatusNotFound:
+		e.Kind = dnsErrNotFound
+	case status == http.StatusBadRequest:
+		e.Kind = dnsErrInvalidName
+	case status >= 500:
+		e.Kind = dnsErrUnavailable
+	}
+	return e
+}
+
+func (p *cloudflareProvider) fqdn(subname string) string {
+	if subname == "" {
+		return config.DNS.Domain
+	}
+	return subname + "." + config.DNS.Domain
+}
+
+// records returns the records matching query, all pages.
+func (p *cloudflareProvider) records(ctx context.Context, query url.Values) ([]cloudflareRecord, error) {
+	if query == nil {
+		query = url.Values{}
+	}
+	query.Set("per_page", "1000")
+	var all []cloudflareRecord
+	for page := 1; ; page++ {
+		query.Set("page", fmt.Sprint(page))
+		cr, err := p.request(ctx, http.MethodGet, "/dns_records", query, nil)
+		if err != nil {
+			return nil, err
+		}
+		var records []cloudflareRecord
+		if err := json.Unmarshal(cr.Result, &records); err != nil {
+			return nil, fmt.Errorf("failed to decode records: %v", err)
+		}
+		all = append(all, records...)
+		if page >= cr.ResultInfo.TotalPages {
+			return all, nil
+		}
+	}
+}
+
+func (p *cloudflareProvider) recordsOf(ctx context.Context, subname, recordType string) ([]cloudflareRecord, error) {
+	return p.records(ctx, url.Values{"type": {recordType}, "name": {p.fqdn(subname)}})
+}
+
+func (p *cloudflareProvider) CreateRecord(ctx context.Context, rr rrset) error {
+	// Cloudflare accepts a second A record for a name, so check first.
+	existing, err := p.recordsOf(ctx, rr.Subname, rr.Type)
+	if err != nil {
+		return err
+	}
+	if len(existing) > 0 {
+		return &DNSError{Kind: dnsErrExists, Detail: fmt.Sprintf("%s %s exists", rr.Type, p.fqdn(rr.Subname))}
+	}
+	for _, content := range rr.Records {
+		record := cloudflareRecord{Type: rr.Type, Name: p.fqdn(rr.Subname), Content: content, TTL: rr.TTL}
+		if rr.Owner != nil {
+			record.Comment = rr.Owner.comment()
+		}
+		if _, err := p.request(ctx, http.MethodPost, "/dns_records", nil, record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *cloudflareProvider) DeleteRecord(ctx context.Context, subname, recordType string) error {
+	existing, err := p.recordsOf(ctx, subname, recordType)
+	if err != nil {
+		return err
+	}
+	for _, record := range existing {
+		if _, err := p.request(ctx, http.MethodDelete, "/dns_records/"+url.PathEscape(record.ID), nil, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *cloudflareProvider) ListRecords(ctx context.Context) ([]rrset, error) {
+	records, err := p.records(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	var sets []rrset
+	index := map[[2]string]int{}
+	for _, record := range records {
+		subname, ok := strings.CutSuffix(record.Name, "."+config.DNS.Domain)
+		if !ok {
+			if record.Name != config.DNS.Domain {
+				continue
+			}
+			subname = ""
+		}
+		key := [2]string{subname, record.Type}
+		i, ok := index[key]
+		if !ok {
+			i = len(sets)
+			index[key] = i
+			sets = append(sets, rrset{Subname: subname, Type: record.Type, TTL: record.TTL, Owner: parseRecordOwner(record.Comment)})
+		}
+		sets[i].Records = append(sets[i].Records, record.Content)
+	}
+	return sets, nil
+}
+
+// Check reads the zone, which needs a valid token with access to it.
+func (p *cloudflareProvider) Check(ctx context.Context) error {
+	_, err := p.request(ctx, http.MethodGet, "", nil, nil)
+	return err
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Delegation: a site whose owner runs its own DNS can have its subdomain
+// delegated to their nameservers with
+// PUT /api/v1/sites/{siteName}/dns/delegation, which replaces the site's
+// A/AAAA records by an NS record set. Since a wrong delegation takes the
+// site offline, the request must repeat the hostname as confirmation and
+// every nameserver must already answer for the hostname (unless forced).
+// DELETE restores the A/AAAA records. An NS record set cannot sit next to
+// other records, so the old records are removed first and created again
+// if the new ones fail, which leaves the site as it was. Delegated sites get no certificates from us: the DNS-01 challenge record
+// would be hidden by the delegation.
+
+const (
+	minDelegationNameservers = 2
+	maxDelegationNameservers = 8
+	delegationTTL            = 3600
+)
+
+// DNSDelegation is the delegation of a site's subdomain.
+type DNSDelegation struct {
+	Nameservers []string  `json:"nameservers"`
+	DelegatedAt time.Time `json:"delegatedAt"`
+}
+
+type delegationView struct {
+	ID          string     `json:"id"` // the site name
+	Hostname    string     `json:"hostname"`
+	Delegated   bool       `json:"delegated"`
+	Nameservers []string   `json:"nameservers"`
+	DelegatedAt *time.Time `json:"delegatedAt,omitempty"`
+}
+
+func newDelegationView(siteName string, sc SiteConfig) delegationView {
+	v := delegationView{ID: siteName, Hostname: siteName + "." + config.DNS.Domain, Nameservers: []string{}}
+	if d := sc.DNSDelegation; d != nil {
+		v.Delegated, v.Nameservers, v.DelegatedAt = true, d.Nameservers, &d.DelegatedAt
+	}
+	return v
+}
+
+// delegationRecord is the NS record set delegating a site's subdomain.
+func delegationRecord(siteName string, nameservers []string) rrset {
+	records := make([]string, len(nameservers))
+	for i, ns := range nameservers {
+		records[i] = ns + "."
+	}
+	return rrset{Subname: siteName, Type: "NS", TTL: delegationTTL, Records: records, Owner: siteRecordOwner(siteName)}
+}
+
+// wantedSiteRecords returns the record sets a site should have: the NS
+// record set if it is delegated, otherwise its A/AAAA records.
+func wantedSiteRecords(sc SiteConfig, siteName, siteIP string) []rrset {
+	if sc.DNSDelegation != nil {
+		return []rrset{delegationRecord(siteName, sc.DNSDelegation.Nameservers)}
+	}
+	return siteRecords(siteName, siteIP)
+}
+
+// normalizeNameservers validates the nameservers of a delegation of
+// hostname and returns them lowercased, without trailing dots.
+func normalizeNameservers(hostname string, nameservers []string) ([]string, error) {
+	if len(nameservers) < minDelegationNameservers || len(nameservers) > maxDelegationNameservers {
+		return nil, fmt.Errorf("between %d and %d nameservers are needed", minDelegationNameservers, maxDelegationNameservers)
+	}
+	var result []string
+	for _, ns := range nameservers {
+		ns = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(ns), "."))
+		labels := strings.Split(ns, ".")
+		if len(ns) > 253 || len(labels) < 2 || slices.ContainsFunc(labels, func(l string) bool { return !domainLabelRegex.MatchString(l) }) {
+			return nil, fmt.Errorf("%q is not a valid nameserver name", ns)
+		}
+		// Those would need glue records in our zone.
+		if ns == hostname || strings.HasSuffix(ns, "."+hostname) {
+			return nil, fmt.Errorf("nameserver %s is inside the delegated name, use one outside %s", ns, hostname)
+		}
+		if slices.Contains(result, ns) {
+			return nil, fmt.Errorf("nameserver %s is listed twice", ns)
+		}
+		result = append(result, ns)
+	}
+	return result, nil
+}
+
+// checkNameservers asks every nameserver for the NS records of hostname, so
+// a delegation to servers that do not serve the zone yet is refused.
+func checkNameservers(ctx context.Context, hostname string, nameservers []string) error {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	for _, ns := range nameservers {
+		addr := net.JoinHostPort(ns, "53")
+		resolver := &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, addr)
+			},
+		}
+		records, err := resolver.LookupNS(ctx, hostname)
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) {
+			return fmt.Errorf("nameserver %s does not answer for %s: %s", ns, hostname, dnsErr.Err)
+		}
+		if err != nil {
+			return fmt.Errorf("nameserver %s does not answer for %s: %w", ns, hostname, err)
+		}
+		if len(records) == 0 {
+			return fmt.Errorf("nameserver %s has no NS records for %s", ns, hostname)
+		}
+	}
+	return nil
+}
+
+// replaceSiteRecords replaces the site's record sets have by want. An NS
+// record set cannot exist next to other records at the same name, so when
+// delegating or undelegating the record sets going away are deleted first
+// and want is created after; if creating fails, the record sets created so
+// far are deleted and the old ones created again. Otherwise want is created
+// first and the rest of have deleted after, and a failure only deletes what
+// was created. Errors while rolling back or deleting afterwards are logged,
+// the records are left to dns-reconcile.
+func replaceSiteRecords(ctx context.Context, siteName string, have, want []rrset) error {
+	var stale []rrset
+	for _, rr := range have {
+		if !slices.ContainsFunc(want, func(w rrset) bool { return w.Type == rr.Type }) {
+			stale = append(stale, rr)
+		}
+	}
+	conflicting := len(stale) > 0 && (hasRecordType(have, "NS") || hasRecordType(want, "NS"))
+	if conflicting {
+		deleteSiteRecords(ctx, siteName, stale)
+	}
+	var applied []rrset
+	for _, rr := range want {
+		if err := applyRRSet(ctx, rr); err != nil {
+			for _, created := range applied {
+				if hasRecordType(have, created.Type) {
+					continue
+				}
+				if derr := deleteRecord(ctx, siteName, created.Type); derr != nil {
+					slog.ErrorContext(ctx, "error deleting DNS record", "site", siteName, "type", created.Type, "error", derr)
+				}
+			}
+			if conflicting {
+				restoreSiteRecords(ctx, siteName, stale)
+			}
+			return err
+		}
+		applied = append(applied, rr)
+	}
+	ownRecords(applied)
+	if !conflicting {
+		deleteSiteRecords(ctx, siteName, stale)
+	}
+	return nil
+}
+
+func hasRecordType(sets []rrset, recordType string) bool {
+	return slices.ContainsFunc(sets, func(rr rrset) bool { return rr.Type == recordType })
+}
+
+// deleteSiteRecords deletes record sets of a site, logging failures.
+func deleteSiteRecords(ctx context.Context, siteName string, sets []rrset) {
+	for _, rr := range sets {
+		err := deleteRecord(ctx, siteName, rr.Type)
+		if err != nil && !errors.Is(err, &DNSError{Kind: dnsErrNotFound}) {
+			slog.ErrorContext(ctx, "error deleting DNS record", "site", siteName, "type", rr.Type, "error", err)
+		}
+	}
+}
+
+// restoreSiteRecords creates record sets deleted by replaceSiteRecords
+// again, logging failures.
+func restoreSiteRecords(ctx context.Context, siteName string, sets []rrset) {
+	var restored []rrset
+	for _, rr := range sets {
+		if len(rr.Records) == 0 {
+			slog.ErrorContext(ctx, "cannot restore DNS record, its records are unknown", "site", siteName, "type", rr.Type)
+			continue
+		}
+		rr.Owner = siteRecordOwner(siteName)
+		if err := applyRRSet(ctx, rr); err != nil {
+			slog.ErrorContext(ctx, "error restoring DNS record", "site", siteName, "type", rr.Type, "error", err)
+			continue
+		}
+		restored = append(restored, rr)
+	}
+	ownRecords(restored)
+}
+
+// currentSiteRecords returns the record sets a site has. Sites created
+// before they were stored only have an A record, pointing at SITE_IP.
+func currentSiteRecords(siteName string, siteConfig SiteConfig) []rrset {
+	if len(siteConfig.DNSRecords) > 0 {
+		return siteConfig.DNSRecords
+	}
+	rr := rrset{Subname: siteName, Type: "A", TTL: 3600}
+	if siteIP := os.Getenv("SITE_IP"); siteIP != "" {
+		rr.Records = []string{siteIP}
+	}
+	return []rrset{rr}
+}
+
+// setSiteRecords stores the record sets and delegation of a site after
+// replaceSiteRecords.
+func setSiteRecords(siteName string, records []rrset, delegation *DNSDelegation) (SiteConfig, error) {
+	return updateSiteConfig(siteName, func(siteConfig *SiteConfig) error {
+		siteConfig.DNSRecords, siteConfig.DNSDelegation = records, delegation
+		return nil
+	})
+}
+
+// getDelegationHandler returns the delegation of a site's subdomain.
+func getDelegationHandler(w http.ResponseWriter, r *http.Request) {
+	siteName, ok := siteNameFromPath(w, r)
+	if !ok {
+		return
+	}
+	siteConfig, err := readSiteConfig(siteName)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error reading site config", "site", siteName, "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	respondJSON(w, newDelegationView(siteName, siteConfig))
+}
+
+type delegationRequest struct {
+	Nameservers []string `json:"nameservers"`
+	Confirm     string   `json:"confirm"` // the hostname
+	Force       bool     `json:"force"`   // skip the nameserver check
+}
+
+// putDelegationHandler delegates a site's subdomain to the given
+// nameservers, or changes the nameservers of a delegation.
+func putDelegationHandler(w http.ResponseWriter, r *http.Request) {
+	siteName, ok := siteNameFromPath(w, r)
+	if !ok {
+		return
+	}
+	var req delegationRequest
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON request", http.StatusBadRequest)
+		return
+	}
+	hostname := siteName + "." + config.DNS.Domain
+	nameservers, err := normalizeNameservers(hostname, req.Nameservers)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if strings.ToLower(strings.TrimSuffix(req.Confirm, ".")) != hostname {
+		http.Error(w, "Delegating takes the site off our servers, confirm with \"confirm\": \""+hostname+"\"", http.StatusBadRequest)
+		return
+	}
+	siteConfig, err := readSiteConfig(siteName)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error reading site config", "site", siteName, "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	switch {
+	case siteConfig.Unverified:
+		http.Error(w, errSiteUnverified.Error(), http.StatusConflict)
+		return
+	case siteConfig.DNSPending:
+		http.Error(w, "The site's DNS record is still queued", http.StatusConflict)
+		return
+	}
+	if err := checkDelegationEntitlement(siteConfig); err != nil {
+		writeEntitlementError(w, r, err)
+		return
+	}
+	if !req.Force {
+		if err := checkNameservers(r.Context(), hostname, nameservers); err != nil {
+			slog.InfoContext(r.Context(), "delegation check failed", "site", siteName, "error", err)
+			http.Error(w, err.Error()+"; set up the zone there first, or set \"force\": true", http.StatusUnprocessableEntity)
+			return
+		}
+	}
+
+	want := []rrset{delegationRecord(siteName, nameservers)}
+	if err := replaceSiteRecords(r.Context(), siteName, currentSiteRecords(siteName, siteConfig), want); err != nil {
+		slog.ErrorContext(r.Context(), "error delegating subdomain", "site", siteName, "error", err)
+		writeDNSError(w, r, err)
+		return
+	}
+	delegation := &DNSDelegation{Nameservers: nameservers, DelegatedAt: time.Now().UTC()}
+	siteConfig, err = setSiteRecords(siteName, want, delegation)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error writing site config", "site", siteName, "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	message := strings.Join(nameservers, ", ")
+	if req.Force {
+		message += " (unchecked)"
+	}
+	recordSiteEvent(siteName, SiteEvent{Type: "dns.delegated", Message: message})
+	slog.InfoContext(r.Context(), "delegated subdomain", "site", siteName, "nameservers", nameservers, "force", req.Force)
+	respondJSON(w, newDelegationView(siteName, siteConfig))
+}
+
+// deleteDelegationHandler rolls a delegation back: the site's A/AAAA
+// records replace the NS record set.
+func deleteDelegationHandler(w http.ResponseWriter, r *http.Request) {
+	siteName, ok := siteNameFromPath(w, r)
+	if !ok {
+		return
+	}
+	siteConfig, err := readSiteConfig(siteName)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error reading site config", "site", siteName, "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if siteConfig.DNSDelegation == nil {
+		http.Error(w, "The subdomain is not delegated", http.StatusNotFound)
+		return
+	}
+	siteIP := os.Getenv("SITE_IP")
+	if siteIP == "" {
+		slog.ErrorContext(r.Context(), "SITE_IP is not set in environment", "site", siteName)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	want := siteRecords(siteName, siteIP)
+	if err := replaceSiteRecords(r.Context(), siteName, currentSiteRecords(siteName, siteConfig), want); err != nil {
+		slog.ErrorContext(r.Context(), "error restoring site records", "site", siteName, "error", err)
+		writeDNSError(w, r, err)
+		return
+	}
+	siteConfig, err = setSiteRecords(siteName, want, nil)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error writing site config", "site", siteName, "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	recordSiteEvent(siteName, SiteEvent{Type: "dns.undelegated"})
+	slog.InfoContext(r.Context(), "undelegated subdomain", "site", siteName)
+	respondJSON(w, newDelegationView(siteName, siteConfig))
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// desecProvider talks to the deSEC rrsets API (and compatible ones) at
+// DNS_API_RRSETS, authenticated with DNS_API_AUTH. Both are read per request
+// since dev mode points them at its fake API after startup.
+type desecProvider struct{}
+
+// dnsRequest sends a request to the rrsets API; path is relative to
+// DNS_API_RRSETS, e.g. "shop/A/".
+func dnsRequest(ctx context.Context, method, path string, body any) (*http.Response, error) {
+	apiURL := os.Getenv("DNS_API_RRSETS")
+	apiToken := strings.Trim(os.Getenv("DNS_API_AUTH"), `"`)
+	if apiURL == "" || apiToken == "" {
+		return nil, &DNSError{Kind: dnsErrConfig, Detail: "DNS_API_RRSETS or DNS_API_AUTH missing"}
+	}
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			return nil, fmt.Errorf("failed to marshal JSON: %v", err)
+		}
+	}
+	return dnsDo(ctx, func() (*http.Request, error) {
+		req, err := http.NewRequest(method, "https://"+apiURL+path, bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", apiToken)
+		req.Header.Set("Content-Type", "application/json")
+		return req, nil
+	})
+}
+
+// expectStatus closes the response and classifies any other status.
+func expectStatus(resp *http.Response, status int) error {
+	defer resp.Body.Close()
+	if resp.StatusCode != status {
+		return classifyDNSResponse(resp)
+	}
+	return nil
+}
+
+func (p *desecProvider) CreateRecord(ctx context.Context, rr rrset) error {
+	resp, err := dnsRequest(ctx, http.MethodPost, "", rr)
+	if err != nil {
+		return err
+	}
+	return expectStatus(resp, http.StatusCreated)
+}
+
+func (p *desecProvider) UpdateRecord(ctx context.Context, rr rrset) error {
+	resp, err := dnsRequest(ctx, http.MethodPatch, rr.Subname+"/"+rr.Type+"/", map[string]any{"ttl": rr.TTL, "records": rr.Records})
+	if err != nil {
+		return err
+	}
+	return expectStatus(resp, http.StatusOK)
+}
+
+// DeleteRecord relies on deSEC answering 204 for missing record sets too.
+func (p *desecProvider) DeleteRecord(ctx context.Context, subname, recordType string) error {
+	resp, err := dnsRequest(ctx, http.MethodDelete, subname+"/"+recordType+"/", nil)
+	if err != nil {
+		return err
+	}
+	return expectStatus(resp, http.StatusNoContent)
+}
+
+func (p *desecProvider) ListRecords(ctx context.Context) ([]rrset, error) {
+	resp, err := dnsRequest(ctx, http.MethodGet, "", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, classifyDNSResponse(resp)
+	}
+	var sets []rrset
+	if err := json.NewDecoder(resp.Body).Decode(&sets); err != nil {
+		return nil, fmt.Errorf("failed to decode rrsets: %v", err)
+	}
+	return sets, nil
+}
+
+// Check filters for a name that does not exist, the cheapest authenticated
+// request whatever the size of the zone.
+func (p *desecProvider) Check(ctx context.Context) error {
+	resp, err := dnsRequest(ctx, http.MethodGet, "?subname=_flox-preflight", nil)
+	if err != nil {
+		return err
+	}
+	return expectStatus(resp, http.StatusOK)
+}
+
+// ApplyRecords sends one bulk request. On a 400 the API answers with one
+// error object per record set, empty for the valid ones.
+func (p *desecProvider) ApplyRecords(ctx context.Context, sets []rrset) (map[int]string, error) {
+	resp, err := dnsRequest(ctx, http.MethodPatch, "", sets)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusBadRequest {
+		return nil, classifyDNSResponse(resp)
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	var itemErrors []map[string]any
+	if json.Unmarshal(body, &itemErrors) == nil && len(itemErrors) == len(sets) {
+		rejected := map[int]string{}
+		for i, e := range itemErrors {
+			if len(e) > 0 {
+				msg, _ := json.Marshal(e)
+				rejected[i] = string(msg)
+			}
+		}
+		if len(rejected) > 0 {
+			return rejected, nil
+		}
+	}
+	return nil, &DNSError{Kind: dnsErrInvalidName, Status: resp.StatusCode, Detail: strings.TrimSpace(string(body))}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// dnsErrorKind classifies what went wrong at the DNS provider, so handlers
+// can tell users something actionable and support can see the cause.
+type dnsErrorKind string
+
+const (
+	dnsErrExists      dnsErrorKind = "exists"       // the record set already exists
+	dnsErrNotFound    dnsErrorKind = "not_found"    // the record set does not exist
+	dnsErrInvalidName dnsErrorKind = "invalid_name" // the provider rejected the name or records
+	dnsErrQuota       dnsErrorKind = "quota"        // the account's record limit is reached
+	dnsErrThrottled   dnsErrorKind = "throttled"    // rate limited beyond what was retried
+	dnsErrAuth        dnsErrorKind = "auth"         // token invalid or lacking permission
+	dnsErrConfig      dnsErrorKind = "config"       // DNS API not configured
+	dnsErrUnavailable dnsErrorKind = "unavailable"  // network error or 5xx
+	dnsErrUnknown     dnsErrorKind = "unknown"
+)
+
+// DNSError is an error from the DNS provider. errors.Is matches on the kind:
+// errors.Is(err, &DNSError{Kind: dnsErrExists}).
+type DNSError struct {
+	Kind   dnsErrorKind
+	Status int    // HTTP status of the provider, 0 without a response
+	Detail string // the provider's message, for logs only
+}
+
+func (e *DNSError) Error() string {
+	if e.Status == 0 {
+		return fmt.Sprintf("DNS %s: %s", e.Kind, e.Detail)
+	}
+	return fmt.Sprintf("DNS %s (status %d): %s", e.Kind, e.Status, e.Detail)
+}
+
+func (e *DNSError) Is(target error) bool {
+	t, ok := target.(*DNSError)
+	return ok && t.Kind == e.Kind
+}
+
+// classifyDNSResponse turns an unexpected deSEC response into a DNSError,
+// using the status and the wording of deSEC's error details.
+func classifyDNSResponse(resp *http.Response) *DNSError {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 2048))
+	detail := strings.TrimSpace(string(body))
+	lower := strings.ToLower(detail)
+	e := &DNSError{Kind: dnsErrUnknown, Status: resp.StatusCode, Detail: detail}
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests:
+		e.Kind = dnsErrThrottled
+	case resp.StatusCode == http.StatusUnauthorized:
+		e.Kind = dnsErrAuth
+	case strings.Contains(lower, "limit") || strings.Contains(lower, "quota"):
+		e.Kind = dnsErrQuota
+	case resp.StatusCode == http.StatusForbidden:
+		e.Kind = dnsErrAuth
+	case resp.StatusCode == http.StatusNotFound:
+		e.Kind = dnsErrNotFound
+	case resp.StatusCode == http.StatusConflict || strings.Contains(lower, "already exists") || strings.Contains(lower, "same subdomain and type exists"):
+		e.Kind = dnsErrExists
+	case resp.StatusCode == http.StatusBadRequest:
+		e.Kind = dnsErrInvalidName
+	case resp.StatusCode >= 500:
+		e.Kind = dnsErrUnavailable
+	}
+	return e
+}
+
+// dnsErrorResponse maps an error of a DNS operation to the status code and
+// message for API clients. Details stay in the logs.
+func dnsErrorResponse(err error) (status int, message string) {
+	var dnsErr *DNSError
+	if !errors.As(err, &dnsErr) {
+		return http.StatusInternalServerError, "Internal Server Error"
+	}
+	switch dnsErr.Kind {
+	case dnsErrExists:
+		return http.StatusConflict, "A DNS record for this name already exists"
+	case dnsErrNotFound:
+		return http.StatusNotFound, "The DNS record does not exist"
+	case dnsErrInvalidName:
+		return http.StatusUnprocessableEntity, "The DNS provider does not accept this name"
+	case dnsErrQuota:
+		return http.StatusInsufficientStorage, "The DNS record limit is reached, please contact support"
+	case dnsErrThrottled:
+		return http.StatusServiceUnavailable, "The DNS provider is busy, please try again in a few minutes"
+	case dnsErrAuth, dnsErrConfig:
+		// Our misconfiguration, not the user's fault.
+		return http.StatusBadGateway, "DNS is misconfigured on our side, support has been notified"
+	default:
+		return http.StatusBadGateway, "The DNS provider is unavailable, please try again later"
+	}
+}
+
+// writeDNSError answers a request with the dnsErrorResponse of err.
+func writeDNSError(w http.ResponseWriter, r *http.Request, err error) {
+	status, message := dnsErrorResponse(err)
+	e := &APIError{Message: message}
+	var dnsErr *DNSError
+	if errors.As(err, &dnsErr) {
+		e.Code, e.Details = codeDNSProvisionFailed, map[string]any{"dnsErrorKind": dnsErr.Kind}
+	}
+	writeAPIError(w, r, status, e)
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+// mockProvider is dns.provider "mock", for staging and integration tests:
+// no API is called, the intended operations are recorded in
+// .dns-mock.json in the sites directory together with the resulting
+// record sets, so later requests (reconcile, deletion) see a consistent
+// zone. GET /api/v1/dns/mock shows both.
+type mockProvider struct {
+	mu sync.Mutex
+}
+
+const (
+	dnsMockFile          = ".dns-mock.json" // in sitesBaseDir
+	maxDNSMockOperations = 1000
+)
+
+// mockRRSet is a record set of the mock zone; unlike real providers without
+// record metadata it keeps the owner tag.
+type mockRRSet struct {
+	rrset
+	Owner *recordOwner `json:"owner,omitempty"`
+}
+
+type mockOperation struct {
+	Time      time.Time    `json:"time"`
+	Op        string       `json:"op"` // create, update, delete or apply
+	Subname   string       `json:"subname"`
+	Type      string       `json:"type"`
+	Records   []string     `json:"records,omitempty"`
+	Owner     *recordOwner `json:"owner,omitempty"`
+	Error     string       `json:"error,omitempty"`
+	RequestID string       `json:"requestId,omitempty"` // of the API request the operation was made for
+}
+
+type mockZone struct {
+	Records []mockRRSet `json:"records"`
+	// Operations are the latest maxDNSMockOperations, oldest first.
+	Operations []mockOperation `json:"operations"`
+}
+
+func readMockZone() (*mockZone, error) {
+	zone := &mockZone{Records: []mockRRSet{}, Operations: []mockOperation{}}
+	data, err := os.ReadFile(filepath.Join(sitesBaseDir, dnsMockFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return zone, nil
+		}
+		return nil, err
+	}
+	err = json.Unmarshal(data, zone)
+	return zone, err
+}
+
+func writeMockZone(zone *mockZone) error {
+	if n := len(zone.Operations); n > maxDNSMockOperations {
+		zone.Operations = zone.Operations[n-maxDNSMockOperations:]
+	}
+	data, err := json.MarshalIndent(zone, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(sitesBaseDir, dnsMockFile)
+	return writeFileAtomic(path, data, 0644)
+}
+
+func (z *mockZone) index(subname, recordType string) int {
+	return slices.IndexFunc(z.Records, func(rr mockRRSet) bool { return rr.Subname == subname && rr.Type == recordType })
+}
+
+// apply performs and records one operation, failing like a real provider
+// would for existing or missing record sets.
+func (z *mockZone) apply(op string, rr rrset) error {
+	i := z.index(rr.Subname, rr.Type)
+	var err error
+	switch {
+	case op == "create" && i >= 0:
+		err = &DNSError{Kind: dnsErrExists, Detail: fmt.Sprintf("%s %s exists", rr.Type, rr.Subname)}
+	case op == "update" && i < 0:
+		err = &DNSError{Kind: dnsErrNotFound, Detail: fmt.Sprintf("%s %s does not exist", rr.Type, rr.Subname)}
+	case op == "delete" || (op == "apply" && len(rr.Records) == 0):
+		if i >= 0 {
+			z.Records = slices.Delete(z.Records, i, i+1)
+		}
+	case i >= 0:
+		owner := rr.Owner
+		if owner == nil {
+			owner = z.Records[i].Owner // an update without owner keeps it
+		}
+		z.Records[i] = mockRRSet{rrset: rr, Owner: owner}
+	default:
+		z.Records = append(z.Records, mockRRSet{rrset: rr, Owner: rr.Owner})
+	}
+	o := mockOperation{Time: time.Now().UTC(), Op: op, Subname: rr.Subname, Type: rr.Type, Records: rr.Records, Owner: rr.Owner}
+	if err != nil {
+		o.Error = err.Error()
+	}
+	z.Operations = append(z.Operations, o)
+	return err
+}
+
+// change runs fn on the stored zone and saves it.
+func (p *mockProvider) change(ctx context.Context, fn func(z *mockZone) error) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	zone, err := readMockZone()
+	if err != nil {
+		return fmt.Errorf("failed to read mock zone: %v", err)
+	}
+	n := len(zone.Operations)
+	opErr := fn(zone)
+	for i := range zone.Operations[n:] {
+		zone.Operations[n+i].RequestID = requestIDFrom(ctx)
+	}
+	if err := writeMockZone(zone); err != nil {
+		return fmt.Errorf("failed to write mock zone: %v", err)
+	}
+	return opErr
+}
+
+func (p *mockProvider) CreateRecord(ctx context.Context, rr rrset) error {
+	return p.change(ctx, func(z *mockZone) error { return z.apply("create", rr) })
+}
+
+func (p *mockProvider) UpdateRecord(ctx context.Context, rr rrset) error {
+	return p.change(ctx, func(z *mockZone) error { return z.apply("update", rr) })
+}
+
+func (p *mockProvider) DeleteRecord(ctx context.Context, subname, recordType string) error {
+	return p.change(ctx, func(z *mockZone) error { return z.apply("delete", rrset{Subname: subname, Type: recordType}) })
+}
+
+func (p *mockProvider) ListRecords(ctx context.Context) ([]rrset, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	zone, err := readMockZone()
+	if err != nil {
+		return nil, err
+	}
+	sets := make([]rrset, len(zone.Records))
+	for i, rr := range zone.Records {
+		sets[i] = rr.rrset
+		sets[i].Owner = rr.Owner
+	}
+	return sets, nil
+}
+
+// ApplyRecords records a bulk change; the mock rejects nothing.
+func (p *mockProvider) ApplyRecords(ctx context.Context, sets []rrset) (map[int]string, error) {
+	return nil, p.change(ctx, func(z *mockZone) error {
+		for _, rr := range sets {
+			z.apply("apply", rr)
+		}
+		return nil
+	})
+}
+
+// getDNSMockHandler returns the mock zone: its record sets and the recorded
+// operations.
+func getDNSMockHandler(w http.ResponseWriter, r *http.Request) {
+	p, ok := dnsProvider.(*mockProvider)
+	if !ok {
+		http.Error(w, "dns.provider is not mock", http.StatusNotFound)
+		return
+	}
+	p.mu.Lock()
+	zone, err := readMockZone()
+	p.mu.Unlock()
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error reading mock zone", "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	respondJSON(w, zone)
+}
+
+// resetDNSMockHandler empties the mock zone, e.g. between test runs.
+func resetDNSMockHandler(w http.ResponseWriter, r *http.Request) {
+	p, ok := dnsProvider.(*mockProvider)
+	if !ok {
+		http.Error(w, "dns.provider is not mock", http.StatusNotFound)
+		return
+	}
+	p.mu.Lock()
+	err := os.Remove(filepath.Join(sitesBaseDir, dnsMockFile))
+	p.mu.Unlock()
+	if err != nil && !os.IsNotExist(err) {
+		slog.ErrorContext(r.Context(), "error resetting mock zone", "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
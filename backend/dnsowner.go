@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Record sets created by flox are tagged with their owner, so that
+// reconciliation can tell them from records created by hand (or by another
+// instance sharing the zone) and never deletes what it does not own.
+// Providers with record metadata store the tag with the records (Cloudflare:
+// the comment); for all providers the owners are also kept in
+// .dns-owners.json, as deSEC and Route 53 have no place for it.
+
+const dnsOwnersFile = ".dns-owners.json" // in sitesBaseDir
+
+// recordOwnerPrefix starts the tag in a provider's record comment.
+const recordOwnerPrefix = "flox "
+
+type recordOwner struct {
+	Instance string `json:"instance"`
+	Site     string `json:"site"`
+}
+
+func siteRecordOwner(siteName string) *recordOwner {
+	return &recordOwner{Instance: config.Registry.Instance, Site: siteName}
+}
+
+// ours reports whether the record set belongs to this instance.
+func (o recordOwner) ours() bool {
+	return o.Instance == config.Registry.Instance
+}
+
+// comment is the tag as stored at the provider.
+func (o recordOwner) comment() string {
+	return recordOwnerPrefix + "instance=" + o.Instance + " site=" + o.Site
+}
+
+// parseRecordOwner reads a tag written by comment; other comments are not
+// ours and return nil.
+func parseRecordOwner(comment string) *recordOwner {
+	rest, ok := strings.CutPrefix(comment, recordOwnerPrefix)
+	if !ok {
+		return nil
+	}
+	var o recordOwner
+	for _, field := range strings.Fields(rest) {
+		key, value, _ := strings.Cut(field, "=")
+		switch key {
+		case "instance":
+			o.Instance = value
+		case "site":
+			o.Site = value
+		}
+	}
+	if o.Instance == "" {
+		return nil
+	}
+	return &o
+}
+
+func dnsOwnerKey(subname, recordType string) string {
+	return recordType + " " + subname
+}
+
+var dnsOwnersMu sync.Mutex
+
+func readDNSOwners() (map[string]recordOwner, error) {
+	owners := map[string]recordOwner{}
+	data, err := os.ReadFile(filepath.Join(sitesBaseDir, dnsOwnersFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return owners, nil
+		}
+		return nil, err
+	}
+	err = json.Unmarshal(data, &owners)
+	return owners, err
+}
+
+func writeDNSOwners(owners map[string]recordOwner) error {
+	data, err := json.MarshalIndent(owners, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(sitesBaseDir, dnsOwnersFile)
+	return writeFileAtomic(path, data, 0644)
+}
+
+// ownRecords updates the registry after record sets were written: sets with
+// an owner are registered, deleted ones (empty records) are removed. A
+// failure is logged; the records themselves were written.
+func ownRecords(sets []rrset) {
+	dnsOwnersMu.Lock()
+	defer dnsOwnersMu.Unlock()
+	owners, err := readDNSOwners()
+	if err == nil {
+		for _, rr := range sets {
+			key := dnsOwnerKey(rr.Subname, rr.Type)
+			switch {
+			case len(rr.Records) == 0:
+				delete(owners, key)
+			case rr.Owner != nil:
+				owners[key] = *rr.Owner
+			}
+		}
+		err = writeDNSOwners(owners)
+	}
+	if err != nil {
+		slog.Error("error updating DNS record owners", "error", err)
+	}
+}
+
+// recordOwnerOf returns the owner of a listed record set: the tag stored at
+// the provider, else the registry entry.
+func recordOwnerOf(rr rrset, owners map[string]recordOwner) (recordOwner, bool) {
+	if rr.Owner != nil {
+		return *rr.Owner, true
+	}
+	o, ok := owners[dnsOwnerKey(rr.Subname, rr.Type)]
+	return o, ok
+}
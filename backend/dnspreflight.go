@@ -0,0 +1,229 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// Site DNS records are only written after a pre-flight check of the DNS
+// provider. If the provider is down or our credentials are broken, the site
+// is created with its record queued (dnsPending) and the scheduler creates
+// it once the check passes again, instead of leaving a site without a
+// record and an error only in the log.
+
+// errDNSPending wraps the cause when a record was queued.
+var errDNSPending = errors.New("the DNS record is queued")
+
+// Failed checks are cached for a shorter time so a recovery is noticed soon.
+const dnsPreflightFailureTTL = 15 * time.Second
+
+var dnsPreflightCache struct {
+	mu        sync.Mutex
+	checkedAt time.Time
+	err       error
+}
+
+// dnsPreflight checks that the DNS API is configured, reachable and accepts
+// our token. The result is cached for dns.preflight_ttl.
+func dnsPreflight(ctx context.Context) error {
+	dnsPreflightCache.mu.Lock()
+	defer dnsPreflightCache.mu.Unlock()
+	ttl := currentConfig().DNS.PreflightTTL
+	if dnsPreflightCache.err != nil {
+		ttl = min(ttl, dnsPreflightFailureTTL)
+	}
+	if !dnsPreflightCache.checkedAt.IsZero() && time.Since(dnsPreflightCache.checkedAt) < ttl {
+		return dnsPreflightCache.err
+	}
+	err := checkDNSProvider(ctx)
+	if err != nil && dnsPreflightCache.err == nil {
+		slog.Error("error: DNS pre-flight check failed, queueing new records", "error", err)
+	} else if err == nil && dnsPreflightCache.err != nil {
+		slog.Info("DNS pre-flight check passed again")
+	}
+	dnsPreflightCache.checkedAt = time.Now()
+	dnsPreflightCache.err = err
+	return err
+}
+
+// dnsRetryable reports whether a failed record creation is worth queueing:
+// the provider or our configuration failed, not the record itself.
+func dnsRetryable(err error) bool {
+	if errors.Is(err, errCreationLimited) {
+		return true
+	}
+	var dnsErr *DNSError
+	if !errors.As(err, &dnsErr) {
+		return false
+	}
+	switch dnsErr.Kind {
+	case dnsErrUnavailable, dnsErrThrottled, dnsErrAuth, dnsErrConfig:
+		return true
+	}
+	return false
+}
+
+// publishSiteRecords is the dns step of the provisioning pipeline: it
+// creates the records of a site after the pre-flight check, with their undo
+// registered in tx. When the record was queued the returned error wraps
+// errDNSPending.
+func publishSiteRecords(ctx context.Context, siteName string, tx *provisioningTx) error {
+	siteIP := os.Getenv("SITE_IP")
+	if siteIP == "" {
+		fatal("SITE_IP is not set in environment")
+	}
+	start := time.Now()
+	err := injectFault(siteName, "dns.preflight")
+	if err == nil {
+		err = dnsPreflight(ctx)
+	}
+	logStep(siteName, "dns.preflight", config.DNS.Provider, start, err)
+	if err == nil && currentConfig().Limits.SiteCreationPolicy == "queue" && !takeCreationSlot(siteName) {
+		err = errCreationLimited
+	}
+	if err == nil {
+		err = createSiteRecords(ctx, siteName, siteIP, tx)
+	}
+	if err == nil || !dnsRetryable(err) {
+		return err
+	}
+	if qerr := setDNSPending(siteName, true); qerr != nil {
+		slog.Error("error queueing DNS record", "site", siteName, "error", qerr)
+		return err
+	}
+	recordSiteEvent(siteName, SiteEvent{Type: "dns.pending", Message: err.Error()})
+	return fmt.Errorf("%w: %w", errDNSPending, err)
+}
+
+// createSiteRecords creates the A and, if configured, AAAA record of a site
+// and stores the created ones in the site config for its deletion. Without
+// a transaction, a record that already exists is updated (queued records
+// may be partly created).
+func createSiteRecords(ctx context.Context, siteName, siteIP string, tx *provisioningTx) error {
+	var created []rrset
+	var err error
+	for _, rr := range siteRecords(siteName, siteIP) {
+		detail := fmt.Sprintf("%s %s %s -> %s", config.DNS.Provider, rr.Type, siteName, rr.Records[0])
+		start := time.Now()
+		err = injectFault(siteName, "dns.create")
+		if err == nil {
+			err = createRecord(ctx, rr)
+		}
+		logStep(siteName, "dns.create", detail, start, err)
+		if tx == nil && errors.Is(err, &DNSError{Kind: dnsErrExists}) {
+			start = time.Now()
+			err = updateRecord(ctx, rr)
+			logStep(siteName, "dns.update", detail, start, err)
+		}
+		if err != nil {
+			break
+		}
+		tx.onRollback("dns."+rr.Type, func() error { return deleteRecord(ctx, siteName, rr.Type) })
+		created = append(created, rr)
+	}
+	if len(created) == 0 {
+		return err
+	}
+	ownRecords(created)
+	if _, rerr := updateSiteConfig(siteName, func(siteConfig *SiteConfig) error {
+		siteConfig.DNSRecords = created
+		return nil
+	}); rerr != nil {
+		slog.Error("error storing DNS records", "site", siteName, "error", rerr)
+	}
+	return err
+}
+
+func setDNSPending(siteName string, pending bool) error {
+	_, err := updateSiteConfig(siteName, func(siteConfig *SiteConfig) error {
+		siteConfig.DNSPending = pending
+		return nil
+	})
+	return err
+}
+
+// runPendingDNS creates the queued records once the provider is back. It is
+// called by the scheduler.
+func runPendingDNS() {
+	siteNames, err := listSiteNames()
+	if err != nil {
+		slog.Error("scheduler: error listing sites", "error", err)
+		return
+	}
+	var pending []string
+	for _, siteName := range siteNames {
+		if siteConfig, err := readSiteConfig(siteName); err == nil && siteConfig.DNSPending {
+			pending = append(pending, siteName)
+		}
+	}
+	if len(pending) == 0 || dnsPreflight(context.Background()) != nil {
+		return
+	}
+	siteIP := os.Getenv("SITE_IP")
+	for _, siteName := range pending {
+		if currentConfig().Limits.SiteCreationPolicy == "queue" && !takeCreationSlot(siteName) {
+			return // over the creation limit, wait for the next run
+		}
+		if !createPendingRecord(siteName, siteIP) {
+			return // the provider failed again, wait for the next run
+		}
+	}
+}
+
+// createPendingRecord creates the queued records of one site and reports
+// whether the provider worked.
+func createPendingRecord(siteName, siteIP string) bool {
+	endRun := beginRun(context.Background(), siteName, "dns")
+	err := createSiteRecords(context.Background(), siteName, siteIP, nil)
+	var warmupErr error
+	if err == nil {
+		warmupErr = warmUpSite(context.Background(), siteName)
+	}
+	endRun(cmp.Or(err, warmupErr))
+	if err != nil {
+		slog.Error("scheduler: error creating queued DNS record", "site", siteName, "error", err)
+		if dnsRetryable(err) {
+			return false
+		}
+		recordSiteEvent(siteName, SiteEvent{Type: "dns.failed", Message: err.Error()})
+	} else {
+		recordSiteEvent(siteName, SiteEvent{Type: "dns.created"})
+	}
+	if err := setDNSPending(siteName, false); err != nil {
+		slog.Error("scheduler: error writing site config", "site", siteName, "error", err)
+	}
+	notifyPendingRecord(siteName, err)
+	return true
+}
+
+// notifyPendingRecord tells the owner of a site whose record was queued
+// that it is online, or that it failed.
+func notifyPendingRecord(siteName string, recordErr error) {
+	siteConfig, err := readSiteConfig(siteName)
+	if err != nil || siteConfig.OwnerEmail == "" {
+		return
+	}
+	name, data := "provisioned", map[string]any{"SiteName": siteName, "SiteURL": siteURL(siteName)}
+	if recordErr != nil {
+		_, message := dnsErrorResponse(recordErr)
+		name, data["Error"] = "failure", message
+	}
+	if err := sendTemplateEmail(siteConfig.OwnerEmail, name, data); err != nil {
+		slog.Error("scheduler: error notifying the owner", "site", siteName, "template", name, "error", err)
+	}
+}
+
+// dnsHealth is the DNS status of the health endpoint.
+func dnsHealth() (status string, healthy bool) {
+	if err := dnsPreflight(context.Background()); err != nil {
+		_, message := dnsErrorResponse(err)
+		return message, false
+	}
+	return "OK", true
+}
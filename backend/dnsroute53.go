@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+// route53Provider manages the hosted zone dns.route53.hosted_zone_id through
+// the Route 53 REST API with an access key (route53:ChangeResourceRecordSets,
+// route53:ListResourceRecordSets and route53:GetHostedZone). Requests are
+// signed with AWS Signature Version 4.
+type route53Provider struct{}
+
+// route53APIURL is a variable for tests against a fake API.
+var route53APIURL = "https://route53.amazonaws.com/2013-04-01"
+
+const route53XMLNS = "https://route53.amazonaws.com/doc/2013-04-01/"
+
+type route53RRSet struct {
+	Name            string          `xml:"Name"`
+	Type            string          `xml:"Type"`
+	TTL             int             `xml:"TTL,omitempty"`
+	ResourceRecords []route53Record `xml:"ResourceRecords>ResourceRecord"`
+}
+
+type route53Record struct {
+	Value string `xml:"Value"`
+}
+
+type route53ChangeRequest struct {
+	XMLName xml.Name        `xml:"ChangeResourceRecordSetsRequest"`
+	XMLNS   string          `xml:"xmlns,attr"`
+	Changes []route53Change `xml:"ChangeBatch>Changes>Change"`
+}
+
+type route53Change struct {
+	Action string       `xml:"Action"` // CREATE, UPSERT or DELETE
+	RRSet  route53RRSet `xml:"ResourceRecordSet"`
+}
+
+type route53ListResponse struct {
+	RRSets         []route53RRSet `xml:"ResourceRecordSets>ResourceRecordSet"`
+	IsTruncated    bool           `xml:"IsTruncated"`
+	NextRecordName string         `xml:"NextRecordName"`
+	NextRecordType string         `xml:"NextRecordType"`
+}
+
+func (p *route53Provider) request(ctx context.Context, method, path string, query url.Values, body any, result any) error {
+	r := config.DNS.Route53
+	if r.HostedZoneID == "" || r.AccessKeyID == "" || r.SecretAccessKey == "" {
+		return &DNSError{Kind: dnsErrConfig, Detail: "dns.route53.hosted_zone_id, access_key_id or secret_access_key missing"}
+	}
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = xml.Marshal(body); err != nil {
+			return fmt.Errorf("failed to marshal XML: %v", err)
+		}
+		data = append([]byte(xml.Header), data...)
+	}
+	apiURL := route53APIURL + "/hostedzone/" + url.PathEscape(strings.TrimPrefix(r.HostedZoneID, "/hostedzone/")) + path
+	if len(query) > 0 {
+		apiURL += "?" + query.Encode()
+	}
+	resp, err := dnsDo(ctx, func() (*http.Request, error) {
+		req, err := http.NewRequest(method, apiURL, bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		if body != nil {
+			req.Header.Set("Content-Type", "text/xml")
+		}
+		signAWSRequest(req, data, "route53", r.Region, r.AccessKeyID, r.SecretAccessKey, time.Now())
+		return req, nil
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	raw, _ := io.ReadAll(io.LimitReader(resp.Body, 16<<20))
+	if resp.StatusCode != http.StatusOK {
+		return classifyRoute53Response(resp.StatusCode, raw)
+	}
+	if result != nil {
+		if err := xml.Unmarshal(raw, result); err != nil {
+			return fmt.Errorf("failed to decode response: %v", err)
+		}
+	}
+	return nil
+}
+
+// classifyRoute53Response uses the error codes of the ErrorResponse and the
+// wording of InvalidChangeBatch messages.
+func classifyRoute53Response(status int, raw []byte) *DNSError {
+	detail := strings.TrimSpace(string(raw))
+	if len(detail) > 2048 {
+		detail = detail[:2048]
+	}
+	e := &DNSError{Kind: dnsErrUnknown, Status: status, Detail: detail}
+	has := func(words ...string) bool {
+		return slices.ContainsFunc(words, func(w string) bool { return strings.Contains(detail, w) })
+	}
+	switch {
+	case has("Throttling", "PriorRequestNotComplete") || status == http.StatusTooManyRequests:
+		e.Kind = dnsErrThrottled
+	case has("InvalidClientTokenId", "SignatureDoesNotMatch", "AccessDenied", "ExpiredToken") || status == http.StatusForbidden:
+		e.Kind = dnsErrAuth
+	case has("NoSuchHostedZone"):
+		e.Kind = dnsErrConfig
+	case has("but it already exists"):
+		e.Kind = dnsErrExists
+	case has("but it was not found"):
+		e.Kind = dnsErrNotFound
+	case has("TooManyRecords", "LimitsExceeded", "limit"):
+		e.Kind = dnsErrQuota
+	case status == http.StatusBadRequest:
+		e.Kind = dnsErrInvalidName
+	case status >= 500:
+		e.Kind = dnsErrUnavailable
+	}
+	return e
+}
+
+func (p *route53Provider) fqdn(subname string) string {
+	if subname == "" {
+		return config.DNS.Domain + "."
+	}
+	return subname + "." + config.DNS.Domain + "."
+}
+
+// subname turns a Route 53 name, absolute and with octal escapes such as
+// \052 for *, into a subname; ok is false outside the domain.
+func (p *route53Provider) subname(name string) (string, bool) {
+	name = strings.ReplaceAll(name, `\052`, "*")
+	if name == config.DNS.Domain+"." {
+		return "", true
+	}
+	return strings.CutSuffix(name, "."+config.DNS.Domain+".")
+}
+
+func (p *route53Provider) change(ctx context.Context, action string, rr rrset) error {
+	set := route53RRSet{Name: p.fqdn(rr.Subname), Type: rr.Type, TTL: rr.TTL}
+	for _, record := range rr.Records {
+		set.ResourceRecords = append(set.ResourceRecords, route53Record{Value: record})
+	}
+	req := route53ChangeRequest{XMLNS: route53XMLNS, Changes: []route53Change{{Action: action, RRSet: set}}}
+	return p.request(ctx, http.MethodPost, "/rrset", nil, req, nil)
+}
+
+func (p *route53Provider) CreateRecord(ctx context.Context, rr rrset) error {
+	return p.change(ctx, "CREATE", rr)
+}
+
+// UpdateRecord uses UPSERT, which also creates missing record sets.
+func (p *route53Provider) UpdateRecord(ctx context.Context, rr rrset) error {
+	return p.change(ctx, "UPSERT", rr)
+}
+
+// DeleteRecord looks the record set up first: Route 53 only deletes a set
+// given with its current TTL and values.
+func (p *route53Provider) DeleteRecord(ctx context.Context, subname, recordType string) error {
+	var list route53ListResponse
+	query := url.Values{"name": {p.fqdn(subname)}, "type": {recordType}, "maxitems": {"1"}}
+	if err := p.request(ctx, http.MethodGet, "/rrset", query, nil, &list); err != nil {
+		return err
+	}
+	for _, set := range list.RRSets {
+		if s, ok := p.subname(set.Name); ok && s == subname && set.Type == recordType {
+			req := route53ChangeRequest{XMLNS: route53XMLNS, Changes: []route53Change{{Action: "DELETE", RRSet: set}}}
+			return p.request(ctx, http.MethodPost, "/rrset", nil, req, nil)
+		}
+	}
+	return nil
+}
+
+func (p *route53Provider) ListRecords(ctx context.Context) ([]rrset, error) {
+	var sets []rrset
+	query := url.Values{}
+	for {
+		var list route53ListResponse
+		if err := p.request(ctx, http.MethodGet, "/rrset", query, nil, &list); err != nil {
+			return nil, err
+		}
+		for _, set := range list.RRSets {
+			subname, ok := p.subname(set.Name)
+			if !ok {
+				continue
+			}
+			rr := rrset{Subname: subname, Type: set.Type, TTL: set.TTL, Records: []string{}}
+			for _, record := range set.ResourceRecords {
+				rr.Records = append(rr.Records, record.Value)
+			}
+			sets = append(sets, rr)
+		}
+		if !list.IsTruncated {
+			return sets, nil
+		}
+		query = url.Values{"name": {list.NextRecordName}, "type": {list.NextRecordType}}
+	}
+}
+
+// Check reads the hosted zone, which needs valid keys with access to it.
+func (p *route53Provider) Check(ctx context.Context) error {
+	return p.request(ctx, http.MethodGet, "", nil, nil, nil)
+}
+
+// signAWSRequest adds an AWS Signature Version 4 to req.
+func signAWSRequest(req *http.Request, body []byte, service, region, accessKeyID, secretAccessKey string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	payloadHash := sha256Hex(body)
+	req.Header.Set("X-Amz-Date", amzDate)
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{
+		"host":       host,
+		"x-amz-date": amzDate,
+	}
+	if ct := req.Header.Get("Content-Type"); ct != "" {
+		headers["content-type"] = ct
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(headers[name]) + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		cmp.Or(req.URL.EscapedPath(), "/"),
+		awsCanonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+secretAccessKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKeyID, scope, signedHeaders, signature))
+}
+
+// awsCanonicalQuery sorts and encodes the query as SigV4 requires: RFC 3986
+// escaping, spaces as %20.
+func awsCanonicalQuery(query url.Values) string {
+	escape := func(s string) string {
+		return strings.ReplaceAll(strings.ReplaceAll(url.QueryEscape(s), "+", "%20"), "%7E", "~")
+	}
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	var pairs []string
+	for _, key := range keys {
+		values := slices.Sorted(slices.Values(query[key]))
+		for _, value := range values {
+			pairs = append(pairs, escape(key)+"="+escape(value))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
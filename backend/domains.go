@@ -0,0 +1,365 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Owners can point their own domains at a site. A domain is added with a
+// token the owner publishes in a TXT record; once the TXT record is found
+// the domain is verified, added to the vhost and served by self-hosted
+// mode, and the owner points its A/AAAA (or CNAME) records at us.
+
+const (
+	domainChallengePrefix = "_flox-challenge."
+	domainTokenPrefix     = "flox-site-verification="
+	maxSiteDomains        = 10
+)
+
+var domainLabelRegex = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+// CustomDomain is an owner's domain of a site.
+type CustomDomain struct {
+	Domain     string     `json:"domain"`
+	Token      string     `json:"token"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	VerifiedAt *time.Time `json:"verifiedAt,omitempty"`
+}
+
+func (d CustomDomain) verified() bool {
+	return d.VerifiedAt != nil
+}
+
+// domainRecord is a DNS record the owner has to create.
+type domainRecord struct {
+	Type  string `json:"type"`
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type domainView struct {
+	ID         string     `json:"id"` // siteName/domain
+	Domain     string     `json:"domain"`
+	Verified   bool       `json:"verified"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	VerifiedAt *time.Time `json:"verifiedAt,omitempty"`
+	// Verification is the TXT record proving ownership.
+	Verification domainRecord `json:"verification"`
+	// Records point the domain at the site, once verified. A subdomain can
+	// use CNAME instead.
+	Records []domainRecord `json:"records"`
+	CNAME   domainRecord   `json:"cname"`
+}
+
+func newDomainView(siteName string, d CustomDomain) domainView {
+	v := domainView{
+		ID:           siteName + "/" + d.Domain,
+		Domain:       d.Domain,
+		Verified:     d.verified(),
+		CreatedAt:    d.CreatedAt,
+		VerifiedAt:   d.VerifiedAt,
+		Verification: domainRecord{Type: "TXT", Name: domainChallengePrefix + d.Domain, Value: domainTokenPrefix + d.Token},
+		Records:      []domainRecord{},
+		CNAME:        domainRecord{Type: "CNAME", Name: d.Domain, Value: siteName + "." + config.DNS.Domain},
+	}
+	for _, rr := range siteRecords(siteName, os.Getenv("SITE_IP")) {
+		v.Records = append(v.Records, domainRecord{Type: rr.Type, Name: d.Domain, Value: rr.Records[0]})
+	}
+	return v
+}
+
+// normalizeDomain validates a domain name given by an owner and returns it
+// in lower case without a trailing dot.
+func normalizeDomain(domain string) (string, error) {
+	domain = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(domain), "."))
+	if len(domain) > 253 {
+		return "", errors.New("domain is too long")
+	}
+	labels := strings.Split(domain, ".")
+	if len(labels) < 2 {
+		return "", errors.New("domain must be a fully qualified name, e.g. www.example.com")
+	}
+	for _, label := range labels {
+		if !domainLabelRegex.MatchString(label) {
+			return "", fmt.Errorf("%q is not a valid domain name", domain)
+		}
+	}
+	if flox := strings.ToLower(config.DNS.Domain); domain == flox || strings.HasSuffix(domain, "."+flox) {
+		return "", fmt.Errorf("subdomains of %s cannot be added", config.DNS.Domain)
+	}
+	return domain, nil
+}
+
+// customDomainIndex maps verified domains to their sites for self-hosted
+// mode. It is rebuilt from the site configs after changes and at most every
+// customDomainIndexTTL, to notice sites deleted in between.
+const customDomainIndexTTL = time.Minute
+
+var customDomainIndex struct {
+	mu      sync.Mutex
+	builtAt time.Time
+	sites   map[string]string
+}
+
+func invalidateCustomDomains() {
+	customDomainIndex.mu.Lock()
+	customDomainIndex.builtAt = time.Time{}
+	customDomainIndex.mu.Unlock()
+}
+
+// siteForCustomDomain returns the site a verified domain belongs to.
+func siteForCustomDomain(domain string) (string, bool) {
+	customDomainIndex.mu.Lock()
+	defer customDomainIndex.mu.Unlock()
+	if time.Since(customDomainIndex.builtAt) > customDomainIndexTTL {
+		siteNames, err := listSiteNames()
+		if err != nil {
+			slog.Error("error listing sites", "error", err)
+			return "", false
+		}
+		sites := map[string]string{}
+		for _, siteName := range siteNames {
+			siteConfig, err := readSiteConfig(siteName)
+			if err != nil {
+				continue
+			}
+			for _, d := range siteConfig.Domains {
+				if d.verified() {
+					sites[d.Domain] = siteName
+				}
+			}
+		}
+		customDomainIndex.sites = sites
+		customDomainIndex.builtAt = time.Now()
+	}
+	siteName, ok := customDomainIndex.sites[domain]
+	return siteName, ok
+}
+
+// lookupDomainToken checks the TXT records of the domain's challenge name
+// for the token, through domains.resolver if set.
+func lookupDomainToken(domain, token string) (bool, error) {
+	resolver := net.DefaultResolver
+	if addr := config.Domains.Resolver; addr != "" {
+		resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, addr)
+			},
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	values, err := resolver.LookupTXT(ctx, domainChallengePrefix+domain)
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return slices.Contains(values, domainTokenPrefix+token), nil
+}
+
+// domainFromPath reads the {domain} path value of a site's domain.
+func domainFromPath(w http.ResponseWriter, r *http.Request, siteConfig SiteConfig) (int, bool) {
+	domain := strings.ToLower(strings.TrimSuffix(r.PathValue("domain"), "."))
+	i := siteConfig.findDomain(domain)
+	if i < 0 {
+		http.Error(w, errDomainNotFound.message, errDomainNotFound.status)
+		return 0, false
+	}
+	return i, true
+}
+
+var errDomainNotFound = &httpError{http.StatusNotFound, "Domain not found"}
+
+// findDomain returns the index of a custom domain of the site, -1 if it has
+// no such domain.
+func (sc SiteConfig) findDomain(domain string) int {
+	return slices.IndexFunc(sc.Domains, func(d CustomDomain) bool { return d.Domain == domain })
+}
+
+func listDomainsHandler(w http.ResponseWriter, r *http.Request) {
+	siteName, ok := siteNameFromPath(w, r)
+	if !ok {
+		return
+	}
+	siteConfig, err := readSiteConfig(siteName)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error reading site config", "site", siteName, "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	views := make([]domainView, 0, len(siteConfig.Domains))
+	for _, d := range siteConfig.Domains {
+		views = append(views, newDomainView(siteName, d))
+	}
+	respondJSON(w, views)
+}
+
+type domainRequest struct {
+	Domain string `json:"domain"`
+}
+
+// addDomainHandler adds a domain to a site and returns the TXT record that
+// proves ownership.
+func addDomainHandler(w http.ResponseWriter, r *http.Request) {
+	siteName, ok := siteNameFromPath(w, r)
+	if !ok {
+		return
+	}
+	var req domainRequest
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON request", http.StatusBadRequest)
+		return
+	}
+	domain, err := normalizeDomain(req.Domain)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	siteConfig, err := readSiteConfig(siteName)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error reading site config", "site", siteName, "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if err := checkDomainEntitlement(siteConfig); err != nil {
+		writeEntitlementError(w, r, err)
+		return
+	}
+	if other, ok := siteForCustomDomain(domain); ok {
+		slog.InfoContext(r.Context(), "domain requested", "domain", domain, "other", other, "site", siteName)
+		http.Error(w, "The domain is already used by another site", http.StatusConflict)
+		return
+	}
+
+	d := CustomDomain{Domain: domain, Token: newID() + newID(), CreatedAt: time.Now().UTC()}
+	if _, err := updateSiteConfig(siteName, func(siteConfig *SiteConfig) error {
+		if siteConfig.findDomain(domain) >= 0 {
+			return &httpError{http.StatusConflict, "The domain is already added to this site"}
+		}
+		if len(siteConfig.Domains) >= maxSiteDomains {
+			return &httpError{http.StatusBadRequest, fmt.Sprintf("A site can have at most %d domains", maxSiteDomains)}
+		}
+		siteConfig.Domains = append(siteConfig.Domains, d)
+		return nil
+	}); err != nil {
+		writeSiteUpdateError(w, r, siteName, err)
+		return
+	}
+	recordSiteEvent(siteName, SiteEvent{Type: "domain.added", Message: domain})
+	respondJSONStatus(w, http.StatusCreated, newDomainView(siteName, d))
+}
+
+// verifyDomainHandler looks up the TXT record of a domain. Once it is found
+// the domain is verified and the site rebuilt to serve it.
+func verifyDomainHandler(w http.ResponseWriter, r *http.Request) {
+	siteName, ok := siteNameFromPath(w, r)
+	if !ok {
+		return
+	}
+	siteConfig, err := readSiteConfig(siteName)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error reading site config", "site", siteName, "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	i, ok := domainFromPath(w, r, siteConfig)
+	if !ok {
+		return
+	}
+	d := siteConfig.Domains[i]
+	if d.verified() {
+		respondJSON(w, newDomainView(siteName, d))
+		return
+	}
+
+	start := time.Now()
+	found, err := lookupDomainToken(d.Domain, d.Token)
+	logStep(siteName, "domain.verify", d.Domain, start, err)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error looking up TXT record", "domain", d.Domain, "error", err)
+		http.Error(w, "The DNS lookup failed, please try again later", http.StatusBadGateway)
+		return
+	}
+	if !found {
+		http.Error(w, fmt.Sprintf("TXT record %s%s with the value %s%s not found yet; DNS changes can take a while", domainChallengePrefix, d.Domain, domainTokenPrefix, d.Token), http.StatusConflict)
+		return
+	}
+	if other, ok := siteForCustomDomain(d.Domain); ok && other != siteName {
+		http.Error(w, "The domain is already used by another site", http.StatusConflict)
+		return
+	}
+
+	now := time.Now().UTC()
+	d.VerifiedAt = &now
+	if _, err := updateSiteConfig(siteName, func(siteConfig *SiteConfig) error {
+		i := siteConfig.findDomain(d.Domain)
+		if i < 0 {
+			return errDomainNotFound
+		}
+		siteConfig.Domains[i].VerifiedAt = &now
+		return nil
+	}); err != nil {
+		writeSiteUpdateError(w, r, siteName, err)
+		return
+	}
+	invalidateCustomDomains()
+	recordSiteEvent(siteName, SiteEvent{Type: "domain.verified", Message: d.Domain})
+	if _, err := buildSite(siteName); err != nil {
+		slog.ErrorContext(r.Context(), "error building site", "site", siteName, "error", err)
+	}
+	respondJSON(w, newDomainView(siteName, d))
+}
+
+func deleteDomainHandler(w http.ResponseWriter, r *http.Request) {
+	siteName, ok := siteNameFromPath(w, r)
+	if !ok {
+		return
+	}
+	siteConfig, err := readSiteConfig(siteName)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error reading site config", "site", siteName, "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	i, ok := domainFromPath(w, r, siteConfig)
+	if !ok {
+		return
+	}
+	d := siteConfig.Domains[i]
+	if _, err := updateSiteConfig(siteName, func(siteConfig *SiteConfig) error {
+		i := siteConfig.findDomain(d.Domain)
+		if i < 0 {
+			return errDomainNotFound
+		}
+		siteConfig.Domains = slices.Delete(siteConfig.Domains, i, i+1)
+		return nil
+	}); err != nil {
+		writeSiteUpdateError(w, r, siteName, err)
+		return
+	}
+	invalidateCustomDomains()
+	recordSiteEvent(siteName, SiteEvent{Type: "domain.removed", Message: d.Domain})
+	if d.verified() {
+		if _, err := buildSite(siteName); err != nil {
+			slog.ErrorContext(r.Context(), "error building site", "site", siteName, "error", err)
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// Plans decide which features a site may enable. They are defined in the
+// config (entitlements.plans) and every site is on one, the default plan
+// unless an admin or the billing system set another:
+//
+//	entitlements:
+//	  default_plan: free
+//	  plans:
+//	    free: {sections: [hero, features, contact], max_pages: 1}
+//	    pro:  {sections: ["*"], custom_domains: true}
+//
+// The checks run when a feature is enabled (sections at creation and on
+// update, pages, custom domains), so a site moved to a smaller plan keeps
+// what it has but cannot add more. A feature another plan includes is
+// answered with 402 naming that plan, one no plan includes with 403.
+// Without entitlements.default_plan everything is allowed.
+
+// planConfig is what a plan includes. The field names are those of the
+// config file, also in config bundles.
+type planConfig struct {
+	// Sections are the optional sections of the plan, "*" for all; the
+	// mandatory ones are always included.
+	Sections      []string `mapstructure:"sections" json:"sections"`
+	MaxPages      int      `mapstructure:"max_pages" json:"max_pages"` // 0 = unlimited
+	CustomDomains bool     `mapstructure:"custom_domains" json:"custom_domains"`
+	DNSDelegation bool     `mapstructure:"dns_delegation" json:"dns_delegation"`
+	// PremiumTiers are the tiers of premium names (see premium.go) new
+	// sites on the plan may have without buying them, "*" for all.
+	PremiumTiers []string `mapstructure:"premium_tiers" json:"premium_tiers"`
+}
+
+func entitlementsEnabled() bool {
+	return currentConfig().Entitlements.DefaultPlan != ""
+}
+
+func (p planConfig) allowsSection(id string) bool {
+	if s, ok := findSection(id); ok && s.Mandatory {
+		return true
+	}
+	return slices.Contains(p.Sections, "*") || slices.Contains(p.Sections, id)
+}
+
+func (p planConfig) allowsPremiumTier(tier string) bool {
+	return slices.Contains(p.PremiumTiers, "*") || slices.Contains(p.PremiumTiers, tier)
+}
+
+func (p planConfig) allowsPages(count int) bool {
+	return p.MaxPages == 0 || count <= p.MaxPages
+}
+
+// validatePlans checks the plans of a config.
+func validatePlans(c *Config) error {
+	if c.Entitlements.DefaultPlan == "" {
+		return nil
+	}
+	if _, ok := c.Entitlements.Plans[c.Entitlements.DefaultPlan]; !ok {
+		return fmt.Errorf("entitlements.default_plan %q is not in entitlements.plans", c.Entitlements.DefaultPlan)
+	}
+	for name, p := range c.Entitlements.Plans {
+		for _, id := range p.Sections {
+			if _, ok := findSection(id); !ok && id != "*" {
+				return fmt.Errorf("entitlements.plans.%s: unknown section %q", name, id)
+			}
+		}
+		if p.MaxPages < 0 {
+			return fmt.Errorf("entitlements.plans.%s: max_pages must not be negative", name)
+		}
+	}
+	return nil
+}
+
+// sitePlan returns the plan of a site. A site whose plan was removed from
+// the config is on the default plan.
+func sitePlan(sc SiteConfig) (string, planConfig) {
+	entitlements := currentConfig().Entitlements
+	if p, ok := entitlements.Plans[sc.Plan]; ok && sc.Plan != "" {
+		return sc.Plan, p
+	}
+	return entitlements.DefaultPlan, entitlements.Plans[entitlements.DefaultPlan]
+}
+
+// entitlementError is a feature the site's plan does not include.
+type entitlementError struct {
+	feature string
+	plan    string   // of the site
+	plans   []string // that include the feature
+}
+
+func (e entitlementError) Error() string {
+	switch len(e.plans) {
+	case 0:
+		return fmt.Sprintf("%s not available on any plan", e.feature)
+	case 1:
+		return fmt.Sprintf("%s not included in the %s plan, upgrade to the %s plan", e.feature, e.plan, e.plans[0])
+	}
+	return fmt.Sprintf("%s not included in the %s plan, upgrade to one of the plans %s", e.feature, e.plan, strings.Join(e.plans, ", "))
+}
+
+// status is 402 if an upgrade helps, 403 otherwise.
+func (e entitlementError) status() int {
+	if len(e.plans) == 0 {
+		return http.StatusForbidden
+	}
+	return http.StatusPaymentRequired
+}
+
+func (e entitlementError) code() string {
+	if len(e.plans) == 0 {
+		return codeFeatureUnavailable
+	}
+	return codePlanRequired
+}
+
+// checkEntitlement returns an entitlementError if the site's plan does not
+// allow something.
+func checkEntitlement(sc SiteConfig, feature string, allows func(planConfig) bool) error {
+	if !entitlementsEnabled() {
+		return nil
+	}
+	name, plan := sitePlan(sc)
+	if allows(plan) {
+		return nil
+	}
+	e := entitlementError{feature: feature, plan: name}
+	plans := currentConfig().Entitlements.Plans
+	for _, other := range slices.Sorted(maps.Keys(plans)) {
+		if allows(plans[other]) {
+			e.plans = append(e.plans, other)
+		}
+	}
+	return e
+}
+
+// checkSectionEntitlements checks the sections of ids the site does not
+// have yet.
+func checkSectionEntitlements(sc SiteConfig, ids []string) error {
+	for _, id := range ids {
+		if slices.Contains(sc.InitialContent, id) {
+			continue
+		}
+		s, _ := findSection(id)
+		if err := checkEntitlement(sc, fmt.Sprintf("The %s section is", s.Name), func(p planConfig) bool { return p.allowsSection(id) }); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkPageEntitlement(sc SiteConfig, count int) error {
+	return checkEntitlement(sc, fmt.Sprintf("A site with %d pages is", count), func(p planConfig) bool { return p.allowsPages(count) })
+}
+
+func checkDomainEntitlement(sc SiteConfig) error {
+	return checkEntitlement(sc, "Custom domains are", func(p planConfig) bool { return p.CustomDomains })
+}
+
+func checkDelegationEntitlement(sc SiteConfig) error {
+	return checkEntitlement(sc, "Delegating the subdomain is", func(p planConfig) bool { return p.DNSDelegation })
+}
+
+// writeEntitlementError answers a request with an entitlementError and
+// reports whether err was one.
+func writeEntitlementError(w http.ResponseWriter, r *http.Request, err error) bool {
+	var e entitlementError
+	if !errors.As(err, &e) {
+		return false
+	}
+	writeAPIError(w, r, e.status(), &APIError{
+		Code:    e.code(),
+		Message: e.Error(),
+		Details: map[string]any{"plan": e.plan, "plans": e.plans},
+	})
+	return true
+}
+
+// --- Handlers ---
+
+type planView struct {
+	Enabled       bool     `json:"enabled"` // false: no plans, everything is allowed
+	Plan          string   `json:"plan,omitempty"`
+	Sections      []string `json:"sections,omitempty"` // optional sections of the plan, "*" for all
+	MaxPages      int      `json:"maxPages,omitempty"` // 0 = unlimited
+	CustomDomains bool     `json:"customDomains"`
+	DNSDelegation bool     `json:"dnsDelegation"`
+	PremiumTiers  []string `json:"premiumTiers,omitempty"` // of premium names, "*" for all
+}
+
+func newPlanView(sc SiteConfig) planView {
+	if !entitlementsEnabled() {
+		return planView{CustomDomains: true, DNSDelegation: true}
+	}
+	name, p := sitePlan(sc)
+	return planView{Enabled: true, Plan: name, Sections: p.Sections, MaxPages: p.MaxPages, CustomDomains: p.CustomDomains, DNSDelegation: p.DNSDelegation, PremiumTiers: p.PremiumTiers}
+}
+
+// getSitePlanHandler returns the plan of a site and what it includes.
+func getSitePlanHandler(w http.ResponseWriter, r *http.Request) {
+	siteName, ok := siteNameFromPath(w, r)
+	if !ok {
+		return
+	}
+	sc, err := readSiteConfig(siteName)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error reading site config", "site", siteName, "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	respondJSON(w, newPlanView(sc))
+}
+
+// setSitePlan moves a site to a plan and returns the previous one.
+func setSitePlan(siteName, plan string) (string, error) {
+	var previous string
+	if _, err := updateSiteConfig(siteName, func(sc *SiteConfig) error {
+		previous, _ = sitePlan(*sc)
+		sc.Plan = plan
+		return nil
+	}); err != nil {
+		return "", err
+	}
+	if previous != plan {
+		recordSiteEvent(siteName, SiteEvent{Type: "plan.changed", Message: previous + " to " + plan})
+	}
+	return previous, nil
+}
+
+type sitePlanRequest struct {
+	Plan string `json:"plan"`
+}
+
+// putSitePlanHandler sets the plan of a site, for admins and the billing
+// system (with admin.token).
+func putSitePlanHandler(w http.ResponseWriter, r *http.Request) {
+	siteName := strings.ToLower(r.PathValue("siteName"))
+	var req sitePlanRequest
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON request", http.StatusBadRequest)
+		return
+	}
+	if !entitlementsEnabled() {
+		http.Error(w, "No plans are configured (entitlements.default_plan)", http.StatusConflict)
+		return
+	}
+	if _, ok := currentConfig().Entitlements.Plans[req.Plan]; !ok {
+		http.Error(w, fmt.Sprintf("unknown plan %q", req.Plan), http.StatusBadRequest)
+		return
+	}
+	if exists, err := siteExists(siteName); err != nil || !exists {
+		http.Error(w, "Site not found", http.StatusNotFound)
+		return
+	}
+	if _, err := setSitePlan(siteName, req.Plan); err != nil {
+		slog.ErrorContext(r.Context(), "error setting the plan", "site", siteName, "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	sc, err := readSiteConfig(siteName)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error reading site config", "site", siteName, "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	respondJSON(w, newPlanView(sc))
+}
+
+// --- Command ---
+
+func runSitePlan(args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("usage: site plan <siteName> <plan>")
+	}
+	siteName, plan := strings.ToLower(args[0]), args[1]
+	if !entitlementsEnabled() {
+		return errors.New("no plans are configured (entitlements.default_plan)")
+	}
+	if _, ok := config.Entitlements.Plans[plan]; !ok {
+		return fmt.Errorf("unknown plan %q, configured are %s", plan, strings.Join(slices.Sorted(maps.Keys(config.Entitlements.Plans)), ", "))
+	}
+	previous, err := setSitePlan(siteName, plan)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s is now on the %s plan (was %s)\n", siteName, plan, previous)
+	return nil
+}
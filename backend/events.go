@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const siteEventsFile = "events.jsonl"
+
+// SiteEvent is an entry in a site's timeline.
+type SiteEvent struct {
+	Time    time.Time `json:"time"`
+	Type    string    `json:"type"`
+	Section string    `json:"section,omitempty"`
+	Message string    `json:"message,omitempty"`
+}
+
+// siteEventTypes are the types of the events recorded in the timelines, for
+// validating hook manifests.
+var siteEventTypes = []string{
+	"site.created", "site.verified", "site.updated", "site.assigned", "site.config_restored", "site.unreachable", "gitops.drift",
+	"site.suspended", "site.unsuspended", "moderation.flagged",
+	"build.succeeded", "build.failed", "provisioning.step_failed",
+	"dns.created", "dns.pending", "dns.failed", "dns.delegated", "dns.undelegated",
+	"domain.added", "domain.verified", "domain.removed",
+	"certificate.issued", "certificate.failed",
+	"section.published", "section.unpublished", "section.scheduled",
+	"page.saved", "page.deleted", "plan.changed",
+	"post.created", "post.updated", "post.deleted",
+	"comment.created", "comment.moderated", "comment.deleted", "comments.configured",
+	"form.updated", "form.deleted",
+	"booking.created", "booking.configured",
+	"product.created", "product.updated", "product.deleted",
+	"newsletter.subscribed", "newsletter.configured",
+	"social.feed_updated", "social.feed_deleted", "social.token_refreshed",
+	"location.updated", "hours.updated", "headers.updated", "region_rules.updated",
+	"rest_hook.subscribed", "rest_hook.unsubscribed",
+}
+
+// Serializes appends to the events files; events are small and rare enough
+// that one lock for all sites is fine.
+var eventsMu sync.Mutex
+
+// recordSiteEvent appends an event to the site's timeline. Failures are only
+// logged, the timeline must never break the operation it describes.
+func recordSiteEvent(siteName string, event SiteEvent) {
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+	data, err := json.Marshal(event)
+	if err != nil {
+		slog.Error("error encoding event", "site", siteName, "error", err)
+		return
+	}
+	defer runSiteHooks(siteName, event)
+	defer fireWebhooks(siteName, event)
+
+	eventsMu.Lock()
+	defer eventsMu.Unlock()
+	path := filepath.Join(sitesBaseDir, siteName, siteEventsFile)
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		slog.Error("error opening events file", "site", siteName, "error", err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		slog.Error("error writing event", "site", siteName, "error", err)
+	}
+}
+
+func readSiteEvents(siteName string) ([]SiteEvent, error) {
+	return readEventsFile(siteName, filepath.Join(sitesBaseDir, siteName, siteEventsFile))
+}
+
+// readEventsFile reads the timeline of siteName from path, also used for
+// archived sites.
+func readEventsFile(siteName, path string) ([]SiteEvent, error) {
+	events := []SiteEvent{}
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return events, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var event SiteEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			slog.Warn("skipping malformed event", "site", siteName, "error", err)
+			continue
+		}
+		events = append(events, event)
+	}
+	return events, scanner.Err()
+}
+
+type timelineResponse struct {
+	SiteName string      `json:"siteName"`
+	Events   []SiteEvent `json:"events"`
+	Upcoming []SiteEvent `json:"upcoming"`
+}
+
+// getTimelineHandler returns the past events of a site together with the
+// scheduled section changes that have not happened yet.
+func getTimelineHandler(w http.ResponseWriter, r *http.Request) {
+	siteName, ok := siteNameFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	events, err := readSiteEvents(siteName)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error reading events", "site", siteName, "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	siteConfig, err := readSiteConfig(siteName)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error reading site config", "site", siteName, "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	respondJSON(w, timelineResponse{
+		SiteName: siteName,
+		Events:   events,
+		Upcoming: upcomingScheduleEvents(siteConfig, time.Now().UTC()),
+	})
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Fault injection, for testing the provisioning pipeline: rollbacks,
+// queued DNS records, retries and the status reported to clients. A step
+// of a provisioning run can be made to fail, with a DNS error of a given
+// kind for the dns.* steps, or to be delayed. Faults come from the rules of
+// faults.rules, e.g.
+//
+//	faults:
+//	  enabled: true
+//	  rules:
+//	    - {step: dns.create, sites: "chaos-*", dns_error_kind: unavailable}
+//	    - {step: build, delay: 5s}
+//
+// or, for the run a request starts, from its X-Flox-Fault header, e.g.
+// "dns.create=fail:unavailable, build=delay:5s". Faults only exist in
+// binaries built with -tags faults (make build-test-binary); other builds
+// refuse faults.enabled and ignore the header.
+
+// faultInjectionBuilt is set in binaries built with -tags faults.
+var faultInjectionBuilt bool
+
+const faultHeader = "X-Flox-Fault"
+
+// faultSteps are the steps faults can be injected into, named like their
+// entries in the provisioning log.
+var faultSteps = []string{"name.allocate", "directory", "build", "dns.preflight", "dns.create", "warmup", "certificate.issue"}
+
+var faultDNSErrorKinds = []dnsErrorKind{dnsErrExists, dnsErrNotFound, dnsErrInvalidName, dnsErrQuota, dnsErrThrottled, dnsErrAuth, dnsErrConfig, dnsErrUnavailable, dnsErrUnknown}
+
+var errInjectedFault = errors.New("injected fault")
+
+// faultRule is an entry of faults.rules.
+type faultRule struct {
+	Step  string `mapstructure:"step" json:"step"`
+	Sites string `mapstructure:"sites" json:"sites"` // glob of the site names, empty for all
+	Fail  bool   `mapstructure:"fail" json:"fail"`
+	// DNSErrorKind fails a dns.* step with a DNS error of this kind, e.g.
+	// unavailable, which queues the record, or quota, which does not.
+	DNSErrorKind string        `mapstructure:"dns_error_kind" json:"dns_error_kind"`
+	Delay        time.Duration `mapstructure:"delay" json:"delay"` // before the step runs or fails
+}
+
+func (f faultRule) validate() error {
+	if !slices.Contains(faultSteps, f.Step) {
+		return fmt.Errorf("step must be one of %s, not %q", strings.Join(faultSteps, ", "), f.Step)
+	}
+	if _, err := path.Match(f.Sites, ""); err != nil {
+		return fmt.Errorf("invalid sites pattern %q", f.Sites)
+	}
+	if f.DNSErrorKind != "" && !strings.HasPrefix(f.Step, "dns.") {
+		return fmt.Errorf("dns_error_kind needs a dns.* step, not %s", f.Step)
+	}
+	if f.DNSErrorKind != "" && !slices.Contains(faultDNSErrorKinds, dnsErrorKind(f.DNSErrorKind)) {
+		return fmt.Errorf("unknown DNS error kind %q", f.DNSErrorKind)
+	}
+	if f.Delay < 0 {
+		return errors.New("delay must not be negative")
+	}
+	if !f.Fail && f.DNSErrorKind == "" && f.Delay == 0 {
+		return errors.New("needs fail, dns_error_kind or delay")
+	}
+	return nil
+}
+
+func (f faultRule) matches(siteName, step string) bool {
+	if f.Step != step {
+		return false
+	}
+	ok, _ := path.Match(f.Sites, siteName)
+	return f.Sites == "" || ok
+}
+
+func (f faultRule) err() error {
+	if f.DNSErrorKind != "" {
+		return &DNSError{Kind: dnsErrorKind(f.DNSErrorKind), Detail: errInjectedFault.Error()}
+	}
+	if f.Fail {
+		return fmt.Errorf("%w in %s", errInjectedFault, f.Step)
+	}
+	return nil
+}
+
+// validateFaults checks the fault settings of a config.
+func validateFaults(c *Config) error {
+	if !c.Faults.Enabled {
+		return nil
+	}
+	if !faultInjectionBuilt {
+		return errors.New("faults.enabled needs a binary built with -tags faults")
+	}
+	for i, f := range c.Faults.Rules {
+		if err := f.validate(); err != nil {
+			return fmt.Errorf("faults.rules[%d]: %w", i, err)
+		}
+	}
+	return nil
+}
+
+func faultsEnabled() bool {
+	return faultInjectionBuilt && currentConfig().Faults.Enabled
+}
+
+// parseFaultHeader parses an X-Flox-Fault header, comma-separated
+// step=action with the actions fail, fail:<DNS error kind> and
+// delay:<duration>.
+func parseFaultHeader(header string) ([]faultRule, error) {
+	var faults []faultRule
+	for _, part := range strings.Split(header, ",") {
+		step, action, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			return nil, fmt.Errorf("%q is not step=action", part)
+		}
+		f := faultRule{Step: step}
+		switch name, arg, _ := strings.Cut(action, ":"); name {
+		case "fail":
+			f.Fail, f.DNSErrorKind = true, arg
+		case "delay":
+			d, err := time.ParseDuration(arg)
+			if err != nil {
+				return nil, fmt.Errorf("invalid delay %q", arg)
+			}
+			f.Delay = d
+		default:
+			return nil, fmt.Errorf("action of %s must be fail, fail:<kind> or delay:<duration>", step)
+		}
+		if err := f.validate(); err != nil {
+			return nil, err
+		}
+		faults = append(faults, f)
+	}
+	return faults, nil
+}
+
+type faultsKey struct{}
+
+// faultHeaders puts the faults of a request's X-Flox-Fault header into its
+// context, for the provisioning run it starts.
+func faultHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header := r.Header.Get(faultHeader)
+		if header == "" || !faultsEnabled() {
+			next.ServeHTTP(w, r)
+			return
+		}
+		faults, err := parseFaultHeader(header)
+		if err != nil {
+			http.Error(w, "Invalid "+faultHeader+": "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), faultsKey{}, faults)))
+	})
+}
+
+func faultsFrom(ctx context.Context) []faultRule {
+	faults, _ := ctx.Value(faultsKey{}).([]faultRule)
+	return faults
+}
+
+// injectFault runs the faults for a step of a site: it waits for their
+// delays and returns the error of the first failing one.
+func injectFault(siteName, step string) error {
+	if !faultsEnabled() {
+		return nil
+	}
+	faults := currentConfig().Faults.Rules
+	activeRuns.Lock()
+	if run, ok := activeRuns.bySite[siteName]; ok {
+		faults = append(slices.Clone(run.faults), faults...)
+	}
+	activeRuns.Unlock()
+	for _, f := range faults {
+		if !f.matches(siteName, step) {
+			continue
+		}
+		slog.Warn("injecting fault", "site", siteName, "step", step, "fail", f.Fail, "dnsErrorKind", f.DNSErrorKind, "delay", f.Delay)
+		time.Sleep(f.Delay)
+		if err := f.err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,10 @@
+//go:build faults
+
+package main
+
+// Built by "make build-test-binary": faults.enabled and X-Flox-Fault work,
+// see faults.go.
+
+func init() {
+	faultInjectionBuilt = true
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	siteFormsDir         = "forms" // submissions, one JSON lines file per form
+	maxSubmissionBytes   = 64 << 10
+	defaultFieldMaxChars = 1000
+)
+
+var formIDRegex = regexp.MustCompile(`^[a-z0-9][a-z0-9\-_]{0,62}$`)
+
+// FormDefinition is an owner-defined form rendered into the "form" section.
+type FormDefinition struct {
+	ID          string      `json:"id"`
+	Title       string      `json:"title"`
+	SubmitLabel string      `json:"submitLabel,omitempty"`
+	Fields      []FormField `json:"fields"`
+}
+
+type FormField struct {
+	Name      string   `json:"name"`
+	Label     string   `json:"label"`
+	Type      string   `json:"type"` // text, select or checkbox
+	Required  bool     `json:"required,omitempty"`
+	Options   []string `json:"options,omitempty"`   // select only
+	MaxLength int      `json:"maxLength,omitempty"` // text only, defaults to 1000
+}
+
+type FormSubmission struct {
+	ID          string            `json:"id"`
+	SubmittedAt time.Time         `json:"submittedAt"`
+	Values      map[string]string `json:"values"`
+}
+
+type formSubmissionResponse struct {
+	Success bool              `json:"success"`
+	Errors  map[string]string `json:"errors,omitempty"`
+}
+
+var submissionsMu sync.Mutex
+
+func (fd FormDefinition) validate() error {
+	if !formIDRegex.MatchString(fd.ID) {
+		return errors.New("form id must be 1-63 lowercase letters, digits, hyphens or underscores")
+	}
+	if len(fd.Fields) == 0 {
+		return errors.New("form must have at least one field")
+	}
+	seen := map[string]bool{}
+	for _, field := range fd.Fields {
+		if !formIDRegex.MatchString(field.Name) {
+			return fmt.Errorf("invalid field name %q", field.Name)
+		}
+		if seen[field.Name] {
+			return fmt.Errorf("duplicate field name %q", field.Name)
+		}
+		seen[field.Name] = true
+		if strings.TrimSpace(field.Label) == "" {
+			return fmt.Errorf("field %q needs a label", field.Name)
+		}
+		switch field.Type {
+		case "text", "checkbox":
+		case "select":
+			if len(field.Options) == 0 {
+				return fmt.Errorf("select field %q needs options", field.Name)
+			}
+		default:
+			return fmt.Errorf("field %q has unsupported type %q", field.Name, field.Type)
+		}
+	}
+	return nil
+}
+
+// validateSubmission checks the submitted values against the form definition
+// and returns the normalized values to store. Unknown fields are dropped.
+func (fd FormDefinition) validateSubmission(input map[string]string) (map[string]string, map[string]string) {
+	values := map[string]string{}
+	fieldErrors := map[string]string{}
+	for _, field := range fd.Fields {
+		value := strings.TrimSpace(input[field.Name])
+		switch field.Type {
+		case "checkbox":
+			checked := value == "on" || value == "true" || value == "1"
+			if field.Required && !checked {
+				fieldErrors[field.Name] = "must be checked"
+			}
+			values[field.Name] = fmt.Sprint(checked)
+			continue
+		case "select":
+			if value != "" && !slices.Contains(field.Options, value) {
+				fieldErrors[field.Name] = "not a valid option"
+				continue
+			}
+		case "text":
+			maxLength := field.MaxLength
+			if maxLength <= 0 {
+				maxLength = defaultFieldMaxChars
+			}
+			if len([]rune(value)) > maxLength {
+				fieldErrors[field.Name] = fmt.Sprintf("must be at most %d characters", maxLength)
+				continue
+			}
+		}
+		if field.Required && value == "" {
+			fieldErrors[field.Name] = "is required"
+			continue
+		}
+		values[field.Name] = value
+	}
+	return values, fieldErrors
+}
+
+func (sc SiteConfig) findForm(formID string) (FormDefinition, int) {
+	for i, form := range sc.Forms {
+		if form.ID == formID {
+			return form, i
+		}
+	}
+	return FormDefinition{}, -1
+}
+
+func listFormsHandler(w http.ResponseWriter, r *http.Request) {
+	siteName, ok := siteNameFromPath(w, r)
+	if !ok {
+		return
+	}
+	siteConfig, err := readSiteConfig(siteName)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error reading site config", "site", siteName, "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	forms := siteConfig.Forms
+	if forms == nil {
+		forms = []FormDefinition{}
+	}
+	respondJSON(w, forms)
+}
+
+// putFormHandler creates or replaces a form definition and rebuilds the site.
+func putFormHandler(w http.ResponseWriter, r *http.Request) {
+	siteName, ok := siteNameFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	var form FormDefinition
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&form); err != nil {
+		http.Error(w, "Invalid JSON request", http.StatusBadRequest)
+		return
+	}
+	form.ID = r.PathValue("formId")
+	if err := form.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if _, err := updateSiteConfig(siteName, func(siteConfig *SiteConfig) error {
+		if _, i := siteConfig.findForm(form.ID); i >= 0 {
+			siteConfig.Forms[i] = form
+		} else {
+			siteConfig.Forms = append(siteConfig.Forms, form)
+		}
+		return nil
+	}); err != nil {
+		writeSiteUpdateError(w, r, siteName, err)
+		return
+	}
+	recordSiteEvent(siteName, SiteEvent{Type: "form.updated", Message: form.ID})
+
+	if _, err := buildSite(siteName); err != nil {
+		slog.ErrorContext(r.Context(), "error building site", "site", siteName, "error", err)
+	}
+	respondJSON(w, form)
+}
+
+// deleteFormHandler removes a form definition. Stored submissions are kept
+// so they can still be exported.
+func deleteFormHandler(w http.ResponseWriter, r *http.Request) {
+	siteName, ok := siteNameFromPath(w, r)
+	if !ok {
+		return
+	}
+	if _, err := updateSiteConfig(siteName, func(siteConfig *SiteConfig) error {
+		_, i := siteConfig.findForm(r.PathValue("formId"))
+		if i < 0 {
+			return &httpError{http.StatusNotFound, "Form not found"}
+		}
+		siteConfig.Forms = slices.Delete(siteConfig.Forms, i, i+1)
+		return nil
+	}); err != nil {
+		writeSiteUpdateError(w, r, siteName, err)
+		return
+	}
+	recordSiteEvent(siteName, SiteEvent{Type: "form.deleted", Message: r.PathValue("formId")})
+
+	if _, err := buildSite(siteName); err != nil {
+		slog.ErrorContext(r.Context(), "error building site", "site", siteName, "error", err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// submitFormHandler is the public endpoint the generated sites post to. It
+// accepts JSON as well as regular urlencoded form posts; the latter are
+// redirected back to the page they came from.
+func submitFormHandler(w http.ResponseWriter, r *http.Request) {
+	siteName, ok := siteNameFromPath(w, r)
+	if !ok {
+		return
+	}
+	siteConfig, err := readSiteConfig(siteName)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error reading site config", "site", siteName, "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	form, i := siteConfig.findForm(r.PathValue("formId"))
+	if i < 0 {
+		http.Error(w, "Form not found", http.StatusNotFound)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxSubmissionBytes)
+	defer r.Body.Close()
+	input := map[string]string{}
+	isJSON := false
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "application/json" {
+		isJSON = true
+		if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+			http.Error(w, "Invalid JSON request", http.StatusBadRequest)
+			return
+		}
+	} else {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, "Invalid form data", http.StatusBadRequest)
+			return
+		}
+		for key := range r.PostForm {
+			input[key] = r.PostForm.Get(key)
+		}
+	}
+
+	values, fieldErrors := form.validateSubmission(input)
+	if len(fieldErrors) > 0 {
+		respondJSONStatus(w, http.StatusUnprocessableEntity, formSubmissionResponse{Success: false, Errors: fieldErrors})
+		return
+	}
+
+	submission := FormSubmission{ID: newID(), SubmittedAt: time.Now().UTC(), Values: values}
+	if err := appendFormSubmission(siteName, form.ID, submission); err != nil {
+		slog.ErrorContext(r.Context(), "error storing submission", "site", siteName, "form", form.ID, "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	fireRESTHooks(siteName, "form.submitted", submission.ID, form.ID, formSubmissionData{FormID: form.ID, FormSubmission: submission})
+
+	if referer := r.Referer(); !isJSON && referer != "" {
+		http.Redirect(w, r, referer, http.StatusSeeOther)
+		return
+	}
+	respondJSON(w, formSubmissionResponse{Success: true})
+}
+
+// listSubmissionsHandler returns the submissions of a form as JSON, or as a
+// CSV download with ?format=csv.
+func listSubmissionsHandler(w http.ResponseWriter, r *http.Request) {
+	siteName, ok := siteNameFromPath(w, r)
+	if !ok {
+		return
+	}
+	formID := r.PathValue("formId")
+	if !formIDRegex.MatchString(formID) {
+		http.Error(w, "Form not found", http.StatusNotFound)
+		return
+	}
+	submissions, err := readFormSubmissions(siteName, formID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error reading submissions", "site", siteName, "form", formID, "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	if r.URL.Query().Get("format") != "csv" {
+		respondJSON(w, submissions)
+		return
+	}
+
+	// Column order follows the current form definition; fields that only
+	// exist in older submissions are appended.
+	var columns []string
+	if siteConfig, err := readSiteConfig(siteName); err == nil {
+		if form, i := siteConfig.findForm(formID); i >= 0 {
+			for _, field := range form.Fields {
+				columns = append(columns, field.Name)
+			}
+		}
+	}
+	for _, s := range submissions {
+		for key := range s.Values {
+			if !slices.Contains(columns, key) {
+				columns = append(columns, key)
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", siteName+"-"+formID+".csv"))
+	cw := csv.NewWriter(w)
+	cw.Write(append([]string{"id", "submittedAt"}, columns...))
+	for _, s := range submissions {
+		row := []string{s.ID, s.SubmittedAt.Format(time.RFC3339)}
+		for _, col := range columns {
+			row = append(row, csvSafe(s.Values[col]))
+		}
+		cw.Write(row)
+	}
+	cw.Flush()
+}
+
+// csvSafe defuses values that spreadsheet applications would interpret as
+// formulas.
+func csvSafe(value string) string {
+	if value != "" && strings.ContainsRune("=+-@\t\r", rune(value[0])) {
+		return "'" + value
+	}
+	return value
+}
+
+// newID returns a random 64 bit hex identifier.
+func newID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func appendFormSubmission(siteName, formID string, submission FormSubmission) error {
+	data, err := json.Marshal(submission)
+	if err != nil {
+		return err
+	}
+
+	submissionsMu.Lock()
+	defer submissionsMu.Unlock()
+	dir := filepath.Join(sitesBaseDir, siteName, siteFormsDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, formID+".jsonl"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0640)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(append(data, '\n'))
+	return err
+}
+
+func readFormSubmissions(siteName, formID string) ([]FormSubmission, error) {
+	submissions := []FormSubmission{}
+	f, err := os.Open(filepath.Join(sitesBaseDir, siteName, siteFormsDir, formID+".jsonl"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return submissions, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64<<10), maxSubmissionBytes*2)
+	for scanner.Scan() {
+		var s FormSubmission
+		if err := json.Unmarshal(scanner.Bytes(), &s); err != nil {
+			slog.Warn("skipping malformed submission", "site", siteName, "form", formID, "error", err)
+			continue
+		}
+		submissions = append(submissions, s)
+	}
+	return submissions, scanner.Err()
+}
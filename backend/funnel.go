@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Site creation funnel: the wizard sends a random session ID per visitor in
+// the X-Flox-Session header. Nothing else about the visitor is stored.
+
+const (
+	funnelDir           = ".funnel" // in sitesBaseDir, one JSONL file per day
+	funnelSessionHeader = "X-Flox-Session"
+)
+
+// funnelSteps in wizard order. name_validated and created are recorded by
+// the backend, the others are sent by the wizard.
+var funnelSteps = []string{"name_validated", "draft_started", "theme_chosen", "created"}
+
+var clientFunnelSteps = []string{"draft_started", "theme_chosen"}
+
+var funnelSessionRegex = regexp.MustCompile(`^[A-Za-z0-9_-]{8,64}$`)
+
+type funnelEvent struct {
+	Time    time.Time `json:"time"`
+	Session string    `json:"session"`
+	Step    string    `json:"step"`
+}
+
+var funnelMu sync.Mutex
+
+func funnelFile(day time.Time) string {
+	return filepath.Join(sitesBaseDir, funnelDir, day.UTC().Format(dateLayout)+".jsonl")
+}
+
+// recordFunnelStep appends a step for the request's session, if it has one.
+// Failures are only logged, the funnel must never break the wizard.
+func recordFunnelStep(r *http.Request, step string) {
+	session := r.Header.Get(funnelSessionHeader)
+	if !funnelSessionRegex.MatchString(session) {
+		return
+	}
+	e := funnelEvent{Time: time.Now().UTC(), Session: session, Step: step}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	funnelMu.Lock()
+	defer funnelMu.Unlock()
+	path := funnelFile(e.Time)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		slog.ErrorContext(r.Context(), "error recording funnel step", "error", err)
+		return
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error recording funnel step", "error", err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		slog.ErrorContext(r.Context(), "error recording funnel step", "error", err)
+	}
+}
+
+func readFunnelEvents(from, to time.Time) ([]funnelEvent, error) {
+	var events []funnelEvent
+	for day := from.UTC().Truncate(24 * time.Hour); day.Before(to); day = day.AddDate(0, 0, 1) {
+		f, err := os.Open(funnelFile(day))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			var e funnelEvent
+			if json.Unmarshal(scanner.Bytes(), &e) == nil && !e.Time.Before(from) && e.Time.Before(to) {
+				events = append(events, e)
+			}
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return events, nil
+}
+
+type funnelStepReport struct {
+	Step     string `json:"step"`
+	Sessions int    `json:"sessions"`
+	// Conversion from the first step and from the previous step, 0-1.
+	Conversion     float64 `json:"conversion"`
+	StepConversion float64 `json:"stepConversion"`
+}
+
+type funnelReport struct {
+	From  time.Time          `json:"from"`
+	To    time.Time          `json:"to"`
+	Steps []funnelStepReport `json:"steps"`
+}
+
+// buildFunnelReport counts the sessions that reached each step. A session
+// counts for a step only if it also reached all earlier ones, so every step
+// is a subset of the one before and drop-outs are visible.
+func buildFunnelReport(events []funnelEvent, from, to time.Time) funnelReport {
+	reached := map[string]map[string]bool{} // session -> steps
+	for _, e := range events {
+		if reached[e.Session] == nil {
+			reached[e.Session] = map[string]bool{}
+		}
+		reached[e.Session][e.Step] = true
+	}
+	report := funnelReport{From: from, To: to}
+	counts := make([]int, len(funnelSteps))
+	for _, steps := range reached {
+		for i, step := range funnelSteps {
+			if !steps[step] {
+				break
+			}
+			counts[i]++
+		}
+	}
+	for i, step := range funnelSteps {
+		sr := funnelStepReport{Step: step, Sessions: counts[i]}
+		if counts[0] > 0 {
+			sr.Conversion = float64(counts[i]) / float64(counts[0])
+		}
+		if i == 0 {
+			sr.StepConversion = sr.Conversion
+		} else if counts[i-1] > 0 {
+			sr.StepConversion = float64(counts[i]) / float64(counts[i-1])
+		}
+		report.Steps = append(report.Steps, sr)
+	}
+	return report
+}
+
+// --- Handlers ---
+
+type funnelEventRequest struct {
+	Step string `json:"step"`
+}
+
+// funnelEventHandler records the wizard steps the backend cannot see.
+func funnelEventHandler(w http.ResponseWriter, r *http.Request) {
+	var req funnelEventRequest
+	defer r.Body.Close()
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1024)).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON request", http.StatusBadRequest)
+		return
+	}
+	if !slices.Contains(clientFunnelSteps, req.Step) {
+		http.Error(w, "unknown step", http.StatusBadRequest)
+		return
+	}
+	if !funnelSessionRegex.MatchString(r.Header.Get(funnelSessionHeader)) {
+		http.Error(w, funnelSessionHeader+" header must be 8-64 letters, digits, - or _", http.StatusBadRequest)
+		return
+	}
+	recordFunnelStep(r, req.Step)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// getFunnelHandler reports the conversion of each wizard step over
+// ?range= (default 30d).
+func getFunnelHandler(w http.ResponseWriter, r *http.Request) {
+	d, err := parseAnalyticsRange(r.URL.Query().Get("range"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	to := time.Now().UTC()
+	from := to.Add(-d)
+	events, err := readFunnelEvents(from, to)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error reading funnel events", "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	respondJSON(w, buildFunnelReport(events, from, to))
+}
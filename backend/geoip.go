@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oschwald/geoip2-golang"
+)
+
+var (
+	geoipMu      sync.RWMutex
+	geoipDB      *geoip2.Reader
+	geoipModTime time.Time // of the loaded file, to detect updates
+	geoipErr     error     // last load error, reported by the health check
+)
+
+// RegionRules restrict the public endpoints of a site (form submissions,
+// bookings, comments, ...) by the visitor's country.
+type RegionRules struct {
+	AllowCountries []string `json:"allowCountries,omitempty"` // if set, only these
+	DenyCountries  []string `json:"denyCountries,omitempty"`
+	// Whether visitors whose country cannot be resolved pass an allow list.
+	AllowUnknown bool `json:"allowUnknown,omitempty"`
+}
+
+// openGeoIP loads the MaxMind country (or city) database and watches the file
+// for updates (e.g. by geoipupdate). Without a database countries are
+// reported as unknown.
+func openGeoIP(path string, refreshInterval time.Duration) {
+	if path == "" {
+		slog.Info("geoip.database_path not set, countries are not resolved")
+		return
+	}
+	if err := loadGeoIP(path); err != nil {
+		slog.Warn("failed to open GeoIP database", "path", path, "error", err)
+	}
+	if refreshInterval > 0 {
+		go watchGeoIP(path, refreshInterval)
+	}
+}
+
+func loadGeoIP(path string) error {
+	info, err := os.Stat(path)
+	if err == nil {
+		var db *geoip2.Reader
+		if db, err = geoip2.Open(path); err == nil {
+			geoipMu.Lock()
+			old := geoipDB
+			geoipDB, geoipModTime, geoipErr = db, info.ModTime(), nil
+			geoipMu.Unlock()
+			if old != nil {
+				old.Close()
+			}
+			slog.Info("Loaded GeoIP database", "path", path, "type", db.Metadata().DatabaseType,
+				"built", time.Unix(int64(db.Metadata().BuildEpoch), 0).UTC().Format(dateLayout))
+			return nil
+		}
+	}
+	geoipMu.Lock()
+	geoipErr = err
+	geoipMu.Unlock()
+	return err
+}
+
+// watchGeoIP reloads the database when the file changes. A failed reload
+// keeps the previously loaded database.
+func watchGeoIP(path string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		info, err := os.Stat(path)
+		geoipMu.RLock()
+		changed := err == nil && !info.ModTime().Equal(geoipModTime)
+		geoipMu.RUnlock()
+		if !changed {
+			continue
+		}
+		if err := loadGeoIP(path); err != nil {
+			slog.Warn("failed to reload GeoIP database", "path", path, "error", err)
+		}
+	}
+}
+
+// geoipHealth reports the state of the database for the health check.
+func geoipHealth() (status string, healthy bool) {
+	geoipMu.RLock()
+	defer geoipMu.RUnlock()
+	switch {
+	case config.GeoIP.DatabasePath == "":
+		return "disabled", true
+	case geoipErr != nil:
+		if geoipDB != nil {
+			return "stale: " + geoipErr.Error(), true
+		}
+		return "error: " + geoipErr.Error(), false
+	case geoipDB == nil:
+		return "not loaded", false
+	}
+	built := time.Unix(int64(geoipDB.Metadata().BuildEpoch), 0)
+	if age := time.Since(built); config.GeoIP.MaxAge > 0 && age > config.GeoIP.MaxAge {
+		return fmt.Sprintf("outdated: built %s", built.UTC().Format(dateLayout)), true
+	}
+	return "ok", true
+}
+
+// countryForIP returns the ISO country code of ip, or "" if it is unknown.
+func countryForIP(ip string) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ""
+	}
+	geoipMu.RLock()
+	defer geoipMu.RUnlock()
+	if geoipDB == nil {
+		return ""
+	}
+	record, err := geoipDB.Country(parsed)
+	if err != nil {
+		return ""
+	}
+	return record.Country.IsoCode
+}
+
+func normalizeCountries(codes []string) ([]string, error) {
+	normalized := make([]string, 0, len(codes))
+	for _, c := range codes {
+		c = strings.ToUpper(strings.TrimSpace(c))
+		if len(c) != 2 || strings.IndexFunc(c, func(r rune) bool { return r < 'A' || r > 'Z' }) >= 0 {
+			return nil, fmt.Errorf("invalid country code %q, use ISO 3166-1 alpha-2", c)
+		}
+		normalized = append(normalized, c)
+	}
+	return normalized, nil
+}
+
+func (rr *RegionRules) validate() error {
+	var err error
+	if rr.AllowCountries, err = normalizeCountries(rr.AllowCountries); err != nil {
+		return err
+	}
+	if rr.DenyCountries, err = normalizeCountries(rr.DenyCountries); err != nil {
+		return err
+	}
+	if len(rr.AllowCountries) > 0 && len(rr.DenyCountries) > 0 {
+		return errors.New("use either allowCountries or denyCountries")
+	}
+	return nil
+}
+
+func (rr *RegionRules) allows(country string) bool {
+	if rr == nil {
+		return true
+	}
+	if country == "" {
+		return len(rr.AllowCountries) == 0 || rr.AllowUnknown
+	}
+	if len(rr.AllowCountries) > 0 {
+		return slices.Contains(rr.AllowCountries, country)
+	}
+	return !slices.Contains(rr.DenyCountries, country)
+}
+
+// regionGuard wraps the public endpoints of a site. It applies the site's
+// region rules and rejects submissions from geoip.blocked_countries, which
+// operators use against abuse waves.
+func regionGuard(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		country := countryForIP(clientIP(r))
+		if country != "" && r.Method != http.MethodGet && slices.Contains(currentConfig().GeoIP.BlockedCountries, country) {
+			slog.InfoContext(r.Context(), "blocked by geoip.blocked_countries", "country", country)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		siteName := r.PathValue("siteName")
+		if siteNameRegex.MatchString(siteName) {
+			if siteConfig, err := readSiteConfig(siteName); err == nil && !siteConfig.RegionRules.allows(country) {
+				http.Error(w, "Not available in your region", http.StatusForbidden)
+				return
+			}
+		}
+		h(w, r)
+	}
+}
+
+func putRegionRulesHandler(w http.ResponseWriter, r *http.Request) {
+	siteName, ok := siteNameFromPath(w, r)
+	if !ok {
+		return
+	}
+	var rules RegionRules
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&rules); err != nil {
+		http.Error(w, "Invalid JSON request", http.StatusBadRequest)
+		return
+	}
+	if err := rules.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, err := updateSiteConfig(siteName, func(siteConfig *SiteConfig) error {
+		siteConfig.RegionRules = &rules
+		if len(rules.AllowCountries) == 0 && len(rules.DenyCountries) == 0 {
+			siteConfig.RegionRules = nil
+		}
+		return nil
+	}); err != nil {
+		writeSiteUpdateError(w, r, siteName, err)
+		return
+	}
+	recordSiteEvent(siteName, SiteEvent{Type: "region_rules.updated"})
+	respondJSON(w, rules)
+}
@@ -0,0 +1,503 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// GitOps: with gitops.repo set, the sites are declared in a git repository,
+// one YAML file per site in gitops.path:
+//
+//	# bakery-berlin.yaml; the name defaults to the file name
+//	name: bakery-berlin
+//	description: Fresh bread every morning
+//	style: light
+//	sections: [header, hero, hours, location, footer]
+//	email: owner@bakery.example   # owner, mailed on creation
+//	adopt: false                  # take over an existing site made outside git
+//
+// Every gitops.interval the branch is fetched and the sites reconciled with
+// it: missing sites are created, the managed fields (description, style,
+// sections) of existing ones updated, and with gitops.prune sites whose
+// definition was removed are deleted (otherwise they are reported as
+// orphaned). Fields left out of a definition are not managed.
+//
+// Managed sites carry the definition and the fields as last applied in their
+// config (gitops). The API refuses to change their managed fields or delete
+// them; a change made anyway, e.g. by editing config.json, is drift: it is
+// reported, recorded as gitops.drift in the timeline and left alone until
+// git matches it or an admin forces a sync, which overwrites it. Sites that
+// exist outside git are only taken over with adopt: true.
+//
+// GET /api/v1/admin/gitops returns the report of the last sync and POST
+// /api/v1/admin/gitops/sync runs one now, with ?dryRun=true to only report
+// what would change and ?force=true to overwrite drift.
+
+const gitOpsDir = ".gitops" // checkout of the repo in sitesBaseDir
+
+const gitOpsTimeout = 2 * time.Minute
+
+// Statuses of a site in a sync report; in a dry run they tell what a sync
+// would do.
+const (
+	gitOpsInSync    = "in_sync"
+	gitOpsCreated   = "created"
+	gitOpsUpdated   = "updated"
+	gitOpsDeleted   = "deleted"
+	gitOpsDrifted   = "drifted"   // changed outside git, left alone
+	gitOpsUnmanaged = "unmanaged" // exists outside git, not adopted
+	gitOpsOrphaned  = "orphaned"  // definition removed, gitops.prune is off
+	gitOpsInvalid   = "invalid"
+	gitOpsFailed    = "failed"
+)
+
+// managedSiteFields are the fields of a site that its definition manages.
+type managedSiteFields struct {
+	Description string   `json:"description"`
+	Style       string   `json:"style"`
+	Sections    []string `json:"sections"`
+}
+
+func siteFields(sc SiteConfig) managedSiteFields {
+	return managedSiteFields{Description: sc.Description, Style: sc.Style, Sections: sc.InitialContent}
+}
+
+// diff returns the names of the fields that differ.
+func (f managedSiteFields) diff(o managedSiteFields) []string {
+	var fields []string
+	if f.Description != o.Description {
+		fields = append(fields, "description")
+	}
+	if f.Style != o.Style {
+		fields = append(fields, "style")
+	}
+	if !slices.Equal(f.Sections, o.Sections) {
+		fields = append(fields, "sections")
+	}
+	return fields
+}
+
+// GitOpsState is the definition a site is managed by.
+type GitOpsState struct {
+	File    string            `json:"file"`   // path in the repo
+	Commit  string            `json:"commit"` // that last changed the site
+	Applied managedSiteFields `json:"applied"`
+	Drift   []string          `json:"drift,omitempty"` // fields changed outside git
+}
+
+// siteDefinition is a site file of the repo.
+type siteDefinition struct {
+	Name        string   `mapstructure:"name"`
+	Description *string  `mapstructure:"description"`
+	Style       *string  `mapstructure:"style"`
+	Sections    []string `mapstructure:"sections"`
+	Email       string   `mapstructure:"email"`
+	Adopt       bool     `mapstructure:"adopt"`
+
+	file string
+}
+
+// apply returns the fields of a site with those of the definition.
+func (d *siteDefinition) apply(f managedSiteFields) managedSiteFields {
+	if d.Description != nil {
+		f.Description = strings.TrimSpace(*d.Description)
+	}
+	if d.Style != nil {
+		f.Style = *d.Style
+	}
+	if d.Sections != nil {
+		f.Sections = d.Sections
+	}
+	return f
+}
+
+func (d *siteDefinition) validate() error {
+	// Whether the name is free is for creation to tell.
+	if d.Name != strings.ToLower(d.Name) || !siteNameRegex.MatchString(d.Name) {
+		return fmt.Errorf("%q is not a valid site name", d.Name)
+	}
+	fields := d.apply(managedSiteFields{})
+	req := siteCreationRequest{Description: fields.Description, Style: fields.Style, InitialContent: fields.Sections}
+	return validateCreationFields(&req)
+}
+
+type gitOpsSiteStatus struct {
+	SiteName string   `json:"siteName"`
+	File     string   `json:"file,omitempty"`
+	Status   string   `json:"status"`
+	Changes  []string `json:"changes,omitempty"` // fields changed, or to change in a dry run
+	Drift    []string `json:"drift,omitempty"`   // fields changed outside git
+	Error    string   `json:"error,omitempty"`
+}
+
+type gitOpsReport struct {
+	Repo       string             `json:"repo"` // without credentials
+	Branch     string             `json:"branch"`
+	Commit     string             `json:"commit,omitempty"`
+	DryRun     bool               `json:"dryRun,omitempty"`
+	Force      bool               `json:"force,omitempty"`
+	StartedAt  time.Time          `json:"startedAt"`
+	FinishedAt time.Time          `json:"finishedAt"`
+	Error      string             `json:"error,omitempty"` // the repo could not be read
+	Sites      []gitOpsSiteStatus `json:"sites"`
+}
+
+var gitOps = struct {
+	syncing sync.Mutex // held by a sync
+	sync.Mutex
+	last *gitOpsReport
+}{}
+
+func validateGitOps(c *Config) error {
+	g := c.GitOps
+	if g.Repo == "" {
+		return nil
+	}
+	if g.Branch == "" {
+		return errors.New("gitops.branch must not be empty")
+	}
+	if g.Interval < 10*time.Second {
+		return errors.New("gitops.interval must be at least 10s")
+	}
+	if !filepath.IsLocal(cmp.Or(g.Path, ".")) {
+		return fmt.Errorf("gitops.path must be a directory in the repo, not %q", g.Path)
+	}
+	if _, err := exec.LookPath("git"); err != nil {
+		return errors.New("gitops.repo needs git installed")
+	}
+	return nil
+}
+
+// gitOpsRepoName is the repo URL without a password or token in it.
+func gitOpsRepoName() string {
+	repo := currentConfig().GitOps.Repo
+	if u, err := url.Parse(repo); err == nil && u.User != nil {
+		return u.Redacted()
+	}
+	return repo
+}
+
+func runGit(ctx context.Context, dir string, args ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		msg := strings.ReplaceAll(strings.TrimSpace(string(out)), currentConfig().GitOps.Repo, gitOpsRepoName())
+		return "", fmt.Errorf("git %s: %v: %s", args[0], err, redactSecrets(msg))
+	}
+	return string(out), nil
+}
+
+// pullGitOpsRepo checks out the head of gitops.branch and returns its
+// commit. The repo is fetched by URL, so a changed gitops.repo just works.
+func pullGitOpsRepo(ctx context.Context) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, gitOpsTimeout)
+	defer cancel()
+	g := currentConfig().GitOps
+	dir := filepath.Join(sitesBaseDir, gitOpsDir)
+	if _, err := os.Stat(filepath.Join(dir, ".git")); os.IsNotExist(err) {
+		if _, err := runGit(ctx, sitesBaseDir, "init", "--quiet", gitOpsDir); err != nil {
+			return "", err
+		}
+	}
+	if _, err := runGit(ctx, dir, "fetch", "--quiet", "--depth", "1", "--", g.Repo, g.Branch); err != nil {
+		return "", err
+	}
+	if _, err := runGit(ctx, dir, "reset", "--quiet", "--hard", "FETCH_HEAD"); err != nil {
+		return "", err
+	}
+	out, err := runGit(ctx, dir, "rev-parse", "HEAD")
+	return strings.TrimSpace(out), err
+}
+
+// loadSiteDefinitions reads the site files of the checkout. Files that do
+// not parse or validate are returned as invalid statuses.
+func loadSiteDefinitions() (map[string]*siteDefinition, []gitOpsSiteStatus, error) {
+	rel := currentConfig().GitOps.Path
+	entries, err := os.ReadDir(filepath.Join(sitesBaseDir, gitOpsDir, rel))
+	if err != nil {
+		return nil, nil, err
+	}
+	defs := map[string]*siteDefinition{}
+	var invalid []gitOpsSiteStatus
+	for _, e := range entries {
+		ext := filepath.Ext(e.Name())
+		if e.IsDir() || (ext != ".yaml" && ext != ".yml") {
+			continue
+		}
+		d := &siteDefinition{Name: strings.TrimSuffix(e.Name(), ext), file: filepath.ToSlash(filepath.Join(rel, e.Name()))}
+		v := viper.New()
+		v.SetConfigFile(filepath.Join(sitesBaseDir, gitOpsDir, rel, e.Name()))
+		err := v.ReadInConfig()
+		if err == nil {
+			err = v.UnmarshalExact(d)
+		}
+		if err == nil {
+			err = d.validate()
+		}
+		if err == nil && defs[d.Name] != nil {
+			err = fmt.Errorf("%s is also defined in %s", d.Name, defs[d.Name].file)
+		}
+		if err != nil {
+			invalid = append(invalid, gitOpsSiteStatus{SiteName: d.Name, File: d.file, Status: gitOpsInvalid, Error: err.Error()})
+			continue
+		}
+		defs[d.Name] = d
+	}
+	return defs, invalid, nil
+}
+
+type gitOpsOptions struct {
+	dryRun bool
+	force  bool // overwrite drift
+}
+
+// syncGitOps reconciles the sites with the head of the branch.
+func syncGitOps(ctx context.Context, opts gitOpsOptions) gitOpsReport {
+	gitOps.syncing.Lock()
+	defer gitOps.syncing.Unlock()
+	g := currentConfig().GitOps
+	report := gitOpsReport{Repo: gitOpsRepoName(), Branch: g.Branch, DryRun: opts.dryRun, Force: opts.force, StartedAt: time.Now().UTC(), Sites: []gitOpsSiteStatus{}}
+	defer func() {
+		report.FinishedAt = time.Now().UTC()
+		if !opts.dryRun {
+			gitOps.Lock()
+			gitOps.last = &report
+			gitOps.Unlock()
+		}
+	}()
+
+	var err error
+	report.Commit, err = pullGitOpsRepo(ctx)
+	var defs map[string]*siteDefinition
+	if err == nil {
+		defs, report.Sites, err = loadSiteDefinitions()
+	}
+	if err != nil {
+		report.Error = err.Error()
+		slog.ErrorContext(ctx, "error reading the GitOps repo", "repo", report.Repo, "error", err)
+		return report
+	}
+	for _, name := range slices.Sorted(maps.Keys(defs)) {
+		report.Sites = append(report.Sites, reconcileSite(ctx, defs[name], report.Commit, opts))
+	}
+
+	siteNames, err := listSiteNames()
+	if err != nil {
+		report.Error = err.Error()
+		return report
+	}
+	for _, siteName := range siteNames {
+		sc, err := readSiteConfig(siteName)
+		if err != nil || sc.GitOps == nil || defs[siteName] != nil || slices.ContainsFunc(report.Sites, func(s gitOpsSiteStatus) bool { return s.SiteName == siteName }) {
+			continue
+		}
+		st := gitOpsSiteStatus{SiteName: siteName, File: sc.GitOps.File, Status: gitOpsOrphaned}
+		if g.Prune {
+			st.Status = gitOpsDeleted
+			if !opts.dryRun {
+				if resp := deleteSite(ctx, siteName); !resp.Deleted {
+					st.Status, st.Error = gitOpsFailed, "the site could not be deleted"
+				}
+			}
+		}
+		report.Sites = append(report.Sites, st)
+	}
+	return report
+}
+
+// reconcileSite brings a site in line with its definition.
+func reconcileSite(ctx context.Context, d *siteDefinition, commit string, opts gitOpsOptions) gitOpsSiteStatus {
+	st := gitOpsSiteStatus{SiteName: d.Name, File: d.file}
+	fail := func(err error) gitOpsSiteStatus {
+		slog.ErrorContext(ctx, "error reconciling site with git", "site", d.Name, "error", err)
+		st.Status, st.Error = gitOpsFailed, err.Error()
+		return st
+	}
+	exists, err := siteExists(d.Name)
+	if err != nil {
+		return fail(err)
+	}
+	if !exists {
+		st.Status = gitOpsCreated
+		if opts.dryRun {
+			return st
+		}
+		return createDefinedSite(ctx, d, commit, st)
+	}
+
+	sc, err := readSiteConfig(d.Name)
+	if err != nil {
+		return fail(err)
+	}
+	actual := siteFields(sc)
+	if sc.GitOps == nil {
+		if !d.Adopt {
+			st.Status, st.Error = gitOpsUnmanaged, "the site exists and is not managed in git; set adopt: true to take it over"
+			return st
+		}
+		sc.GitOps = &GitOpsState{Applied: actual}
+	}
+	st.Drift = actual.diff(sc.GitOps.Applied)
+	want := d.apply(actual)
+	st.Changes = actual.diff(want)
+	switch {
+	case len(st.Changes) == 0:
+		st.Status = gitOpsInSync
+	case len(st.Drift) > 0 && !opts.force:
+		st.Status = gitOpsDrifted
+	default:
+		st.Status = gitOpsUpdated
+	}
+	if opts.dryRun {
+		return st
+	}
+
+	if st.Status == gitOpsDrifted {
+		if !slices.Equal(sc.GitOps.Drift, st.Drift) {
+			slog.WarnContext(ctx, "site changed outside git", "site", d.Name, "fields", st.Drift)
+			recordSiteEvent(d.Name, SiteEvent{Type: "gitops.drift", Message: strings.Join(st.Drift, ", ") + " changed outside git"})
+			sc.GitOps.Drift = st.Drift
+			if _, err := updateSiteConfig(d.Name, func(siteConfig *SiteConfig) error {
+				siteConfig.GitOps = sc.GitOps
+				return nil
+			}); err != nil {
+				return fail(err)
+			}
+		}
+		return st
+	}
+	if st.Status == gitOpsUpdated {
+		if err := validateSiteSections(sc, want.Sections); err != nil {
+			return fail(err)
+		}
+		if err := checkSectionEntitlements(sc, want.Sections); err != nil {
+			return fail(err)
+		}
+		sc.Description, sc.Style, sc.InitialContent = want.Description, want.Style, want.Sections
+		sc.GitOps.Commit = commit
+	}
+	// In sync after a drift git caught up with, or an adoption, is only
+	// written down.
+	if st.Status == gitOpsUpdated || sc.GitOps.File != d.file || len(st.Drift) > 0 || sc.GitOps.Commit == "" {
+		sc.GitOps.File, sc.GitOps.Applied, sc.GitOps.Drift = d.file, want, nil
+		sc.GitOps.Commit = cmp.Or(sc.GitOps.Commit, commit)
+		if _, err := updateSiteConfig(d.Name, func(siteConfig *SiteConfig) error {
+			siteConfig.Description, siteConfig.Style, siteConfig.InitialContent = sc.Description, sc.Style, sc.InitialContent
+			siteConfig.GitOps = sc.GitOps
+			return nil
+		}); err != nil {
+			return fail(err)
+		}
+	}
+	if st.Status == gitOpsUpdated {
+		recordSiteEvent(d.Name, SiteEvent{Type: "site.updated", Message: strings.Join(st.Changes, ", ") + " from git " + shortCommit(commit)})
+		recordAudit(ctx, "site.update", d.Name, want)
+		if _, err := buildSite(d.Name); err != nil {
+			slog.ErrorContext(ctx, "error building site", "site", d.Name, "error", err)
+		}
+	}
+	return st
+}
+
+func shortCommit(commit string) string {
+	return commit[:min(len(commit), 7)]
+}
+
+// createDefinedSite creates a site like the API does for an admin token,
+// and marks it as managed.
+func createDefinedSite(ctx context.Context, d *siteDefinition, commit string, st gitOpsSiteStatus) gitOpsSiteStatus {
+	r, err := http.NewRequestWithContext(context.WithValue(ctx, adminTokenKey{}, true), http.MethodPost, "/api/"+currentAPIVersion+"/sites", nil)
+	if err != nil {
+		st.Status, st.Error = gitOpsFailed, err.Error()
+		return st
+	}
+	fields := d.apply(managedSiteFields{})
+	resp, status := createSite(r, siteCreationRequest{SiteName: d.Name, Description: fields.Description, Style: fields.Style, InitialContent: fields.Sections, Email: d.Email})
+	if status != http.StatusOK || !resp.Success {
+		slog.ErrorContext(ctx, "error creating site from git", "site", d.Name, "error", resp.Error)
+		st.Status, st.Error = gitOpsFailed, resp.Error
+		return st
+	}
+	st.Error = cmp.Or(resp.DNSError, resp.WarmupError)
+	if _, err := updateSiteConfig(d.Name, func(sc *SiteConfig) error {
+		sc.GitOps = &GitOpsState{File: d.file, Commit: commit, Applied: siteFields(*sc)}
+		return nil
+	}); err != nil {
+		st.Status, st.Error = gitOpsFailed, "created, but not marked as managed: "+err.Error()
+	}
+	return st
+}
+
+// runGitOps syncs every gitops.interval; it is started with gitops.repo.
+func runGitOps() {
+	for {
+		report := syncGitOps(context.Background(), gitOpsOptions{})
+		counts := map[string]int{}
+		for _, s := range report.Sites {
+			counts[s.Status]++
+		}
+		slog.Info("GitOps sync", "commit", shortCommit(report.Commit), "sites", counts)
+		time.Sleep(currentConfig().GitOps.Interval)
+	}
+}
+
+// writeSiteManagedError refuses a change of a site managed in git.
+func writeSiteManagedError(w http.ResponseWriter, r *http.Request, sc SiteConfig) {
+	writeAPIError(w, r, http.StatusConflict, &APIError{
+		Code:    codeSiteManaged,
+		Message: fmt.Sprintf("This site is managed in git, change %s instead", sc.GitOps.File),
+		Details: map[string]any{"repo": gitOpsRepoName(), "file": sc.GitOps.File},
+	})
+}
+
+// --- Handlers ---
+
+// getGitOpsHandler returns the report of the last sync.
+func getGitOpsHandler(w http.ResponseWriter, r *http.Request) {
+	if currentConfig().GitOps.Repo == "" {
+		http.Error(w, "GitOps is not enabled (gitops.repo)", http.StatusNotFound)
+		return
+	}
+	gitOps.Lock()
+	last := gitOps.last
+	gitOps.Unlock()
+	if last == nil {
+		http.Error(w, "No sync has finished yet", http.StatusNotFound)
+		return
+	}
+	respondJSON(w, last)
+}
+
+// syncGitOpsHandler syncs now, or with ?dryRun=true reports what a sync
+// would do; ?force=true overwrites drift.
+func syncGitOpsHandler(w http.ResponseWriter, r *http.Request) {
+	if currentConfig().GitOps.Repo == "" {
+		http.Error(w, "GitOps is not enabled (gitops.repo)", http.StatusNotFound)
+		return
+	}
+	opts := gitOpsOptions{dryRun: r.URL.Query().Get("dryRun") == "true", force: r.URL.Query().Get("force") == "true"}
+	report := syncGitOps(context.WithoutCancel(r.Context()), opts)
+	if report.Error != "" {
+		respondJSONStatus(w, http.StatusBadGateway, report)
+		return
+	}
+	recordAudit(r.Context(), "gitops.sync", "", opts)
+	respondJSON(w, report)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+)
+
+// Health endpoints: /api/v1/health summarizes the state of the instance for
+// people. Orchestrators use the probes: /api/v1/health/live answers as long as
+// the process serves requests, /api/v1/health/ready only while the instance
+// can create sites, i.e. every check of readinessChecks passes. Each check
+// is reported on its own, so a failing probe says what is wrong.
+
+// readinessCheck returns a status for people and whether it passed.
+type readinessCheck struct {
+	name  string
+	check func() (status string, ok bool)
+}
+
+var readinessChecks = []readinessCheck{
+	{"sitesDir", sitesDirHealth},
+	{"dns", dnsHealth},
+}
+
+type probeResult struct {
+	OK     bool   `json:"ok"`
+	Status string `json:"status"`
+}
+
+// sitesDirHealth writes and removes a file in the sites directory.
+func sitesDirHealth() (status string, healthy bool) {
+	f, err := os.CreateTemp(sitesBaseDir, ".ready-*")
+	if err != nil {
+		return "not writable: " + err.Error(), false
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write([]byte("ok\n"))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "not writable: " + err.Error(), false
+	}
+	return "OK", true
+}
+
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	geoipStatus, geoipHealthy := geoipHealth()
+	dnsStatus, dnsHealthy := dnsHealth()
+	creationsStatus, creationsHealthy := creationLimitHealth()
+	diskStatus, diskHealthy := diskHealth()
+	configsStatus, configsHealthy := configsHealth()
+	integrityStatus, integrityHealthy := integrityHealth()
+	status := "OK"
+	if !geoipHealthy || !dnsHealthy || !creationsHealthy || !diskHealthy || !configsHealthy || !integrityHealthy {
+		status = "DEGRADED"
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"status":    status,
+		"version":   Version,
+		"geoip":     geoipStatus,
+		"dns":       dnsStatus,
+		"creations": creationsStatus,
+		"disk":      diskStatus,
+		"configs":   configsStatus,
+		"integrity": integrityStatus,
+	})
+}
+
+// liveHandler is the liveness probe; it checks nothing else, so a broken
+// dependency does not get the process restarted.
+func liveHandler(w http.ResponseWriter, r *http.Request) {
+	respondJSON(w, map[string]string{"status": "OK"})
+}
+
+// readyHandler is the readiness probe: 200 if all checks pass, 503 with the
+// failed ones otherwise.
+func readyHandler(w http.ResponseWriter, r *http.Request) {
+	checks := map[string]probeResult{}
+	ready := true
+	for _, c := range readinessChecks {
+		status, ok := c.check()
+		checks[c.name] = probeResult{OK: ok, Status: status}
+		ready = ready && ok
+	}
+	resp := map[string]any{"status": "OK", "checks": checks}
+	if !ready {
+		resp["status"] = "NOT READY"
+		respondJSONStatus(w, http.StatusServiceUnavailable, resp)
+		return
+	}
+	respondJSON(w, resp)
+}
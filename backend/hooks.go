@@ -0,0 +1,443 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Hooks are executables run on site events, e.g. to install a CMS when a
+// site is created or to tell another system about a new domain. Each hook is
+// a directory in <paths.script_dir>/hooks with a manifest.json:
+//
+//	{
+//	  "name": "cms-install",
+//	  "description": "Installs the CMS",
+//	  "run": "install.sh",
+//	  "events": ["site.created"],
+//	  "requiredConfig": ["email.smtp_host"],
+//	  "exitCodes": [0],
+//	  "outputs": ["cmsUrl"],
+//	  "timeout": "2m"
+//	}
+//
+// The manifests are validated at startup; invalid hooks are logged and not
+// run. A hook gets the event and the site config (without credentials) as
+// JSON on stdin, and FLOX_* variables including its required config keys in
+// its environment. It may print a JSON object: its declared outputs are
+// merged into the site config (hookOutputs.<hook>), anything else is
+// dropped. Exit codes outside exitCodes (default 0) and timeouts are
+// recorded as hook.failed events in the site's timeline.
+
+const (
+	siteHooksDir       = "hooks" // in paths.script_dir
+	hookManifestFile   = "manifest.json"
+	defaultHookTimeout = 30 * time.Second
+	maxHookTimeout     = 10 * time.Minute
+	maxHookOutput      = 64 << 10
+)
+
+var (
+	hookNameRegex   = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,62}$`)
+	hookOutputRegex = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9_]{0,63}$`)
+)
+
+type hookManifest struct {
+	Name           string   `json:"name"`
+	Description    string   `json:"description,omitempty"`
+	Version        string   `json:"version,omitempty"`
+	Run            string   `json:"run"`                      // executable, relative to the hook directory
+	Events         []string `json:"events"`                   // event types, "post.*" or "*"
+	RequiredConfig []string `json:"requiredConfig,omitempty"` // config keys that must be set, passed as FLOX_<KEY>
+	ExitCodes      []int    `json:"exitCodes,omitempty"`      // successful exit codes, default [0]
+	Outputs        []string `json:"outputs,omitempty"`        // keys of the stdout JSON kept in the site config
+	Timeout        string   `json:"timeout,omitempty"`        // default 30s, at most 10m
+}
+
+type siteHook struct {
+	hookManifest
+	Dir     string        `json:"dir"`
+	Error   string        `json:"error,omitempty"` // why the hook is not run
+	timeout time.Duration // parsed Timeout
+}
+
+// siteHooks are loaded at startup and not changed afterwards.
+var siteHooks []siteHook
+
+// loadSiteHooks reads and validates the hooks in dir. Hooks with an invalid
+// manifest are returned with their Error set.
+func loadSiteHooks(dir string) ([]siteHook, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var hooks []siteHook
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		h := siteHook{Dir: filepath.Join(dir, e.Name())}
+		h.Name = e.Name()
+		if err := h.load(); err != nil {
+			h.Error = err.Error()
+		}
+		hooks = append(hooks, h)
+	}
+	return hooks, nil
+}
+
+func (h *siteHook) load() error {
+	data, err := os.ReadFile(filepath.Join(h.Dir, hookManifestFile))
+	if err != nil {
+		return err
+	}
+	dirName := h.Name
+	if err := json.Unmarshal(data, &h.hookManifest); err != nil {
+		return fmt.Errorf("%s: %w", hookManifestFile, err)
+	}
+	if h.Name != dirName {
+		return fmt.Errorf("name %q differs from the directory name %q", h.Name, dirName)
+	}
+	if !hookNameRegex.MatchString(h.Name) {
+		return fmt.Errorf("invalid name %q", h.Name)
+	}
+
+	if h.Run == "" || !filepath.IsLocal(h.Run) {
+		return fmt.Errorf("run must be a file in the hook directory, not %q", h.Run)
+	}
+	info, err := os.Stat(filepath.Join(h.Dir, h.Run))
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() || info.Mode()&0111 == 0 {
+		return fmt.Errorf("%s is not an executable file", h.Run)
+	}
+
+	if len(h.Events) == 0 {
+		return errors.New("no events")
+	}
+	for _, event := range h.Events {
+		if !validHookEvent(event) {
+			return fmt.Errorf("unknown event %q", event)
+		}
+	}
+
+	values := configValues(currentConfig())
+	for _, key := range h.RequiredConfig {
+		value, ok := values[key]
+		if !ok {
+			return fmt.Errorf("unknown config key %q", key)
+		}
+		if reflect.ValueOf(value).IsZero() {
+			return fmt.Errorf("config key %q is not set", key)
+		}
+	}
+
+	if len(h.ExitCodes) == 0 {
+		h.ExitCodes = []int{0}
+	}
+	for _, code := range h.ExitCodes {
+		if code < 0 || code > 255 {
+			return fmt.Errorf("invalid exit code %d", code)
+		}
+	}
+
+	for i, output := range h.Outputs {
+		if !hookOutputRegex.MatchString(output) {
+			return fmt.Errorf("invalid output name %q", output)
+		}
+		if slices.Contains(h.Outputs[:i], output) {
+			return fmt.Errorf("output %q is declared twice", output)
+		}
+	}
+
+	h.timeout = defaultHookTimeout
+	if h.Timeout != "" {
+		if h.timeout, err = time.ParseDuration(h.Timeout); err != nil {
+			return fmt.Errorf("invalid timeout: %w", err)
+		}
+		if h.timeout <= 0 || h.timeout > maxHookTimeout {
+			return fmt.Errorf("the timeout must be between 0 and %s", maxHookTimeout)
+		}
+	}
+	return nil
+}
+
+// validHookEvent reports whether a manifest event names a site event type,
+// a category of them ("post.*") or all of them ("*").
+func validHookEvent(event string) bool {
+	if event == "*" {
+		return true
+	}
+	if category, ok := strings.CutSuffix(event, ".*"); ok {
+		return slices.ContainsFunc(siteEventTypes, func(t string) bool { return strings.HasPrefix(t, category+".") })
+	}
+	return slices.Contains(siteEventTypes, event)
+}
+
+// runsOn reports whether the hook is run on events of the type.
+func (h siteHook) runsOn(eventType string) bool {
+	if h.Error != "" {
+		return false
+	}
+	for _, event := range h.Events {
+		category, wildcard := strings.CutSuffix(event, "*")
+		if event == eventType || wildcard && strings.HasPrefix(eventType, category) {
+			return true
+		}
+	}
+	return false
+}
+
+// siteHooksPath is the directory of the hooks, "" without paths.script_dir.
+func siteHooksPath() string {
+	if config.Paths.ScriptDir == "" {
+		return ""
+	}
+	return filepath.Join(config.Paths.ScriptDir, siteHooksDir)
+}
+
+// initSiteHooks loads the hooks at startup.
+func initSiteHooks() {
+	if siteHooksPath() == "" {
+		return
+	}
+	hooks, err := loadSiteHooks(siteHooksPath())
+	if err != nil {
+		slog.Error("error loading hooks", "error", err)
+		return
+	}
+	for _, h := range hooks {
+		if h.Error != "" {
+			slog.Error("error in hook, it is not run", "hook", h.Name, "error", h.Error)
+			continue
+		}
+		slog.Info("Hook registered", "hook", h.Name, "events", strings.Join(h.Events, ", "))
+	}
+	siteHooks = hooks
+}
+
+// runSiteHooks runs the hooks of an event in the background, one after the
+// other in the order of their names.
+func runSiteHooks(siteName string, event SiteEvent) {
+	// Hooks do not run on their own events.
+	if strings.HasPrefix(event.Type, "hook.") {
+		return
+	}
+	var hooks []siteHook
+	for _, h := range siteHooks {
+		if h.runsOn(event.Type) {
+			hooks = append(hooks, h)
+		}
+	}
+	if len(hooks) == 0 {
+		return
+	}
+	go func() {
+		for _, h := range hooks {
+			if err := h.run(siteName, event); err != nil {
+				slog.Error("error running hook", "hook", h.Name, "site", siteName, "event", event.Type, "error", err)
+				recordSiteEvent(siteName, SiteEvent{Type: "hook.failed", Message: h.Name + ": " + err.Error()})
+			}
+		}
+	}()
+}
+
+type hookInput struct {
+	Event    SiteEvent  `json:"event"`
+	SiteName string     `json:"siteName"`
+	Site     SiteConfig `json:"site"`
+}
+
+func (h siteHook) run(siteName string, event SiteEvent) error {
+	site, err := readSiteConfig(siteName)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	input, err := json.Marshal(hookInput{Event: event, SiteName: siteName, Site: site.public()})
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, filepath.Join(h.Dir, h.Run))
+	cmd.Dir = h.Dir
+	cmd.Env = h.environment(siteName, event)
+	cmd.Stdin = bytes.NewReader(input)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	err = cmd.Run()
+	if ctx.Err() != nil {
+		return fmt.Errorf("timed out after %s", h.timeout)
+	}
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		return err
+	}
+	if code := cmd.ProcessState.ExitCode(); !slices.Contains(h.ExitCodes, code) {
+		return fmt.Errorf("exit code %d: %s", code, truncateHookOutput(stderr.String()))
+	}
+	return h.storeOutputs(siteName, stdout.Bytes())
+}
+
+// environment is the hook's environment: PATH, the event and the required
+// config keys.
+func (h siteHook) environment(siteName string, event SiteEvent) []string {
+	env := []string{
+		"PATH=" + os.Getenv("PATH"),
+		"FLOX_HOOK=" + h.Name,
+		"FLOX_EVENT=" + event.Type,
+		"FLOX_SITE_NAME=" + siteName,
+		"FLOX_SITE_DIR=" + filepath.Join(sitesBaseDir, siteName),
+		"FLOX_DOMAIN=" + config.DNS.Domain,
+	}
+	values := configValues(currentConfig())
+	for _, key := range h.RequiredConfig {
+		value := values[key]
+		if list, ok := value.([]string); ok {
+			value = strings.Join(list, ",")
+		}
+		env = append(env, fmt.Sprintf("%s=%v", envConfigVariable(key), value))
+	}
+	return env
+}
+
+// storeOutputs merges the declared outputs printed by the hook into the
+// site config.
+func (h siteHook) storeOutputs(siteName string, stdout []byte) error {
+	stdout = bytes.TrimSpace(stdout)
+	if len(h.Outputs) == 0 || len(stdout) == 0 {
+		return nil
+	}
+	if len(stdout) > maxHookOutput {
+		return fmt.Errorf("output is larger than %d bytes", maxHookOutput)
+	}
+	var printed map[string]any
+	if err := json.Unmarshal(stdout, &printed); err != nil {
+		return fmt.Errorf("output is not a JSON object: %w", err)
+	}
+	outputs := map[string]any{}
+	for key, value := range printed {
+		if slices.Contains(h.Outputs, key) {
+			outputs[key] = value
+		} else {
+			slog.Warn("hook printed an undeclared output, dropped", "hook", h.Name, "key", key, "site", siteName)
+		}
+	}
+	if len(outputs) == 0 {
+		return nil
+	}
+	_, err := updateSiteConfig(siteName, func(siteConfig *SiteConfig) error {
+		if siteConfig.HookOutputs == nil {
+			siteConfig.HookOutputs = map[string]map[string]any{}
+		}
+		if siteConfig.HookOutputs[h.Name] == nil {
+			siteConfig.HookOutputs[h.Name] = map[string]any{}
+		}
+		for key, value := range outputs {
+			siteConfig.HookOutputs[h.Name][key] = value
+		}
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return nil // deleted meanwhile
+	}
+	return err
+}
+
+func truncateHookOutput(s string) string {
+	s = strings.TrimSpace(s)
+	if len(s) > 500 {
+		return s[:500] + "..."
+	}
+	return s
+}
+
+// hookEventsView maps each event type to the hooks run on it.
+func hookEventsView(hooks []siteHook) map[string][]string {
+	events := map[string][]string{}
+	for _, eventType := range siteEventTypes {
+		for _, h := range hooks {
+			if h.runsOn(eventType) {
+				events[eventType] = append(events[eventType], h.Name)
+			}
+		}
+	}
+	return events
+}
+
+// --- Handler ---
+
+// listHooksHandler shows the hooks, invalid ones with their error, and which
+// run for which events.
+func listHooksHandler(w http.ResponseWriter, r *http.Request) {
+	hooks := siteHooks
+	if hooks == nil {
+		hooks = []siteHook{}
+	}
+	respondJSON(w, map[string]any{"hooks": hooks, "events": hookEventsView(hooks)})
+}
+
+// --- Command ---
+
+var hooksCommand = command{
+	subcommands: map[string]command{
+		"list": {
+			usage: "hooks list",
+			run:   runHooksList,
+		},
+	},
+}
+
+// runHooksList validates the hooks like the server does at startup and
+// prints which run for which events.
+func runHooksList(args []string) error {
+	dir := siteHooksPath()
+	if dir == "" {
+		return errors.New("paths.script_dir is not set")
+	}
+	hooks, err := loadSiteHooks(dir)
+	if err != nil {
+		return err
+	}
+	if len(hooks) == 0 {
+		fmt.Printf("no hooks in %s\n", dir)
+		return nil
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "HOOK\tVERSION\tEVENTS\tSTATUS")
+	for _, h := range hooks {
+		status := "ok"
+		if h.Error != "" {
+			status = "invalid: " + h.Error
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", h.Name, h.Version, strings.Join(h.Events, ","), status)
+	}
+	tw.Flush()
+	events := hookEventsView(hooks)
+	fmt.Println()
+	tw = tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "EVENT\tHOOKS")
+	for _, eventType := range siteEventTypes {
+		if names := events[eventType]; len(names) > 0 {
+			fmt.Fprintf(tw, "%s\t%s\n", eventType, strings.Join(names, ", "))
+		}
+	}
+	return tw.Flush()
+}
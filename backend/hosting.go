@@ -0,0 +1,222 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Self-hosted mode: the backend serves the generated sites itself, for
+// installations without nginx. Sites are selected by the Host header.
+
+// siteForHost maps a request host to the site it belongs to.
+func siteForHost(host string) (string, bool) {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	siteName, ok := strings.CutSuffix(host, "."+strings.ToLower(config.DNS.Domain))
+	if !ok {
+		return siteForCustomDomain(host)
+	}
+	if !siteNameRegex.MatchString(siteName) {
+		return "", false
+	}
+	exists, err := siteExists(siteName)
+	if err != nil {
+		slog.Error("error checking site existence", "error", err)
+	}
+	return siteName, exists
+}
+
+type cachedSite struct {
+	modTime   time.Time
+	headers   []CustomHeader
+	suspended bool
+}
+
+// siteHeaderCache holds the effective headers and the suspension per site,
+// re-read when the site config changes.
+var (
+	siteHeaderMu    sync.Mutex
+	siteHeaderCache = map[string]cachedSite{}
+)
+
+func siteResponseHeaders(siteName string) []CustomHeader {
+	return cachedSiteState(siteName).headers
+}
+
+func cachedSiteState(siteName string) cachedSite {
+	info, err := os.Stat(filepath.Join(sitesBaseDir, siteName, "config.json"))
+	if err != nil {
+		return cachedSite{headers: (*HeaderSettings)(nil).effectiveHeaders()}
+	}
+	siteHeaderMu.Lock()
+	defer siteHeaderMu.Unlock()
+	if c, ok := siteHeaderCache[siteName]; ok && c.modTime.Equal(info.ModTime()) {
+		return c
+	}
+	siteConfig, err := readSiteConfig(siteName)
+	if err != nil {
+		slog.Error("error reading site config", "site", siteName, "error", err)
+		return cachedSite{headers: (*HeaderSettings)(nil).effectiveHeaders()}
+	}
+	c := cachedSite{modTime: info.ModTime(), headers: siteConfig.HeaderSettings.effectiveHeaders(), suspended: siteConfig.Suspended != nil}
+	siteHeaderCache[siteName] = c
+	return c
+}
+
+// siteRootForHost resolves a host to the site's public directory.
+func siteRootForHost(host string) (siteName, root string, ok bool) {
+	siteName, ok = siteForHost(host)
+	return siteName, filepath.Join(sitesBaseDir, siteName, sitePublicDir), ok
+}
+
+// hostingHandler serves the site named by the Host header, with the same
+// response headers and suspensions the nginx vhost would have.
+func hostingHandler() http.Handler {
+	return &staticServer{
+		resolve:     siteRootForHost,
+		headers:     siteResponseHeaders,
+		suspended:   siteSuspended,
+		assetMaxAge: config.Hosting.AssetMaxAge,
+	}
+}
+
+// --- Certificates ---
+
+// certStore loads TLS certificates from <dir>/<hostname>/fullchain.pem and
+// privkey.pem, the layout certbot uses. Certificates are reloaded when the
+// files change, so renewals need no restart.
+type certStore struct {
+	dir   string
+	mu    sync.Mutex
+	certs map[string]cachedCert
+}
+
+type cachedCert struct {
+	modTime time.Time
+	cert    *tls.Certificate
+}
+
+func newCertStore(dir string) *certStore {
+	return &certStore{dir: dir, certs: map[string]cachedCert{}}
+}
+
+// GetCertificate implements tls.Config.GetCertificate. A site's subdomain
+// uses the certificate issued for the site (see acme.go) if it has one. A
+// host without its own certificate falls back to its parent domain, which
+// is where certbot keeps wildcard certificates.
+func (s *certStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	host := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if host == "" {
+		return nil, errors.New("no server name")
+	}
+	if siteName, ok := strings.CutSuffix(host, "."+strings.ToLower(config.DNS.Domain)); ok && siteNameRegex.MatchString(siteName) {
+		certFile, keyFile := siteCertPaths(siteName)
+		if cert, err := s.loadFiles("site:"+siteName, certFile, keyFile); err == nil {
+			return cert, nil
+		}
+	}
+	for name := host; name != ""; {
+		cert, err := s.load(name)
+		if err == nil {
+			return cert, nil
+		}
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+		_, parent, ok := strings.Cut(name, ".")
+		if !ok || !strings.Contains(parent, ".") {
+			break
+		}
+		name = parent
+	}
+	return nil, fmt.Errorf("no certificate for %s", host)
+}
+
+func (s *certStore) load(name string) (*tls.Certificate, error) {
+	if strings.ContainsAny(name, `/\`) || strings.HasPrefix(name, ".") {
+		return nil, os.ErrNotExist
+	}
+	return s.loadFiles(name, filepath.Join(s.dir, name, "fullchain.pem"), filepath.Join(s.dir, name, "privkey.pem"))
+}
+
+// loadFiles loads a certificate, cached under name until the file changes.
+func (s *certStore) loadFiles(name, certFile, keyFile string) (*tls.Certificate, error) {
+	info, err := os.Stat(certFile)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if c, ok := s.certs[name]; ok && c.modTime.Equal(info.ModTime()) {
+		return c.cert, nil
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load certificate for %s: %v", name, err)
+	}
+	s.certs[name] = cachedCert{modTime: info.ModTime(), cert: &cert}
+	return &cert, nil
+}
+
+// --- Listeners ---
+
+// serveSites runs the listeners for self-hosted mode until one of them fails.
+func serveSites() error {
+	if config.Hosting.HTTPAddress == "" && config.Hosting.HTTPSAddress == "" {
+		return errors.New("neither hosting.http_address nor hosting.https_address is set")
+	}
+	handler := accessLogMiddleware(hostingHandler())
+	errs := make(chan error, 2)
+
+	if addr := config.Hosting.HTTPSAddress; addr != "" {
+		tlsConfig := &tls.Config{GetCertificate: newCertStore(config.Hosting.CertDir).GetCertificate}
+		go func(handler http.Handler) {
+			ln, err := net.Listen("tcp", addr)
+			if err != nil {
+				errs <- err
+				return
+			}
+			slog.Info("Serving sites over HTTPS", "addr", addr)
+			errs <- serveTLS(&http.Server{Handler: handler}, ln, tlsConfig)
+		}(handler)
+		if config.Hosting.RedirectHTTP {
+			handler = http.HandlerFunc(redirectToHTTPS)
+		}
+	}
+
+	if addr := config.Hosting.HTTPAddress; addr != "" {
+		server := &http.Server{Addr: addr, Handler: handler}
+		go func() {
+			slog.Info("Serving sites over HTTP", "addr", addr)
+			errs <- server.ListenAndServe()
+		}()
+	}
+	return <-errs
+}
+
+func redirectToHTTPS(w http.ResponseWriter, r *http.Request) {
+	if _, ok := siteForHost(r.Host); !ok {
+		http.NotFound(w, r)
+		return
+	}
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if _, port, err := net.SplitHostPort(config.Hosting.HTTPSAddress); err == nil && port != "443" {
+		host = net.JoinHostPort(host, port)
+	}
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	dateLayout = "2006-01-02"
+	// How far ahead the status endpoint looks for the next opening.
+	nextOpeningSearchDays = 14
+	// Exceptions are listed on the site once they are this close.
+	upcomingExceptionDays = 60
+)
+
+// OpeningHours is the structured weekly schedule of a site plus holidays and
+// other exceptions.
+type OpeningHours struct {
+	Timezone   string                  `json:"timezone,omitempty"` // IANA name, defaults to UTC
+	Regular    []OpeningHoursRange     `json:"regular"`
+	Exceptions []OpeningHoursException `json:"exceptions,omitempty"`
+}
+
+// OpeningHoursRange is a weekly recurring opening. Closes at or before Opens
+// means the range ends after midnight.
+type OpeningHoursRange struct {
+	Weekday time.Weekday `json:"weekday"` // 0 = Sunday
+	Opens   string       `json:"opens"`   // "09:00"
+	Closes  string       `json:"closes"`  // "17:00"
+}
+
+// OpeningHoursException replaces the regular hours on the days From to Until
+// (inclusive). Without Opens/Closes the site is closed on these days.
+type OpeningHoursException struct {
+	From   string `json:"from"`            // "2025-12-24"
+	Until  string `json:"until,omitempty"` // defaults to From
+	Opens  string `json:"opens,omitempty"`
+	Closes string `json:"closes,omitempty"`
+	Note   string `json:"note,omitempty"` // e.g. "Christmas"
+}
+
+type openingStatus struct {
+	Open     bool       `json:"open"`
+	Until    *time.Time `json:"until,omitempty"`    // when the current opening ends
+	NextOpen *time.Time `json:"nextOpen,omitempty"` // when closed
+	Note     string     `json:"note,omitempty"`     // note of an exception in effect today
+}
+
+type openInterval struct {
+	start, end time.Time
+}
+
+func (oh *OpeningHours) location() *time.Location {
+	if oh.Timezone == "" {
+		return time.UTC
+	}
+	loc, err := time.LoadLocation(oh.Timezone)
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
+func (oh *OpeningHours) validate() error {
+	if oh.Timezone != "" {
+		if _, err := time.LoadLocation(oh.Timezone); err != nil {
+			return fmt.Errorf("unknown timezone %q", oh.Timezone)
+		}
+	}
+	for _, r := range oh.Regular {
+		if r.Weekday < time.Sunday || r.Weekday > time.Saturday {
+			return fmt.Errorf("invalid weekday %d", r.Weekday)
+		}
+		if err := validateOpeningTimes(r.Opens, r.Closes); err != nil {
+			return err
+		}
+	}
+	for i := range oh.Exceptions {
+		ex := &oh.Exceptions[i]
+		if ex.Until == "" {
+			ex.Until = ex.From
+		}
+		from, err1 := time.Parse(dateLayout, ex.From)
+		until, err2 := time.Parse(dateLayout, ex.Until)
+		if err1 != nil || err2 != nil || until.Before(from) {
+			return fmt.Errorf("invalid exception dates %s to %s", ex.From, ex.Until)
+		}
+		if ex.Opens != "" || ex.Closes != "" {
+			if err := validateOpeningTimes(ex.Opens, ex.Closes); err != nil {
+				return err
+			}
+		}
+		if len(ex.Note) > 200 {
+			return errors.New("exception note must be at most 200 characters")
+		}
+	}
+	return nil
+}
+
+func validateOpeningTimes(opens, closes string) error {
+	start, err1 := parseClock(opens)
+	end, err2 := parseClock(closes)
+	if err1 != nil || err2 != nil || start == end {
+		return fmt.Errorf("invalid hours %s-%s", opens, closes)
+	}
+	return nil
+}
+
+// openingInterval returns the opening on the given local day, using time.Date so
+// DST changes are handled.
+func openingInterval(day time.Time, opens, closes string) openInterval {
+	start, _ := parseClock(opens)
+	end, _ := parseClock(closes)
+	endDay := day
+	if end <= start {
+		endDay = day.AddDate(0, 0, 1)
+	}
+	at := func(d time.Time, offset time.Duration) time.Time {
+		return time.Date(d.Year(), d.Month(), d.Day(), int(offset.Hours()), int(offset.Minutes())%60, 0, 0, d.Location())
+	}
+	return openInterval{start: at(day, start), end: at(endDay, end)}
+}
+
+// exceptionOn returns the exception covering the local day, if any.
+func (oh *OpeningHours) exceptionOn(day time.Time) *OpeningHoursException {
+	date := day.Format(dateLayout)
+	for i, ex := range oh.Exceptions {
+		// ISO dates compare correctly as strings.
+		if ex.From <= date && date <= ex.Until {
+			return &oh.Exceptions[i]
+		}
+	}
+	return nil
+}
+
+// intervalsOn lists the openings starting on the local day.
+func (oh *OpeningHours) intervalsOn(day time.Time) []openInterval {
+	if ex := oh.exceptionOn(day); ex != nil {
+		if ex.Opens == "" {
+			return nil
+		}
+		return []openInterval{openingInterval(day, ex.Opens, ex.Closes)}
+	}
+	var intervals []openInterval
+	for _, r := range oh.Regular {
+		if r.Weekday == day.Weekday() {
+			intervals = append(intervals, openingInterval(day, r.Opens, r.Closes))
+		}
+	}
+	return intervals
+}
+
+// status computes whether the site is open at now and when that changes.
+func (oh *OpeningHours) status(now time.Time) openingStatus {
+	loc := oh.location()
+	local := now.In(loc)
+	today := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, loc)
+
+	var st openingStatus
+	if ex := oh.exceptionOn(today); ex != nil {
+		st.Note = ex.Note
+	}
+	// Yesterday's openings may last past midnight.
+	for d := -1; d <= nextOpeningSearchDays; d++ {
+		day := today.AddDate(0, 0, d)
+		for _, iv := range oh.intervalsOn(day) {
+			if !now.Before(iv.start) && now.Before(iv.end) {
+				st.Open = true
+				if st.Until == nil || iv.end.After(*st.Until) {
+					until := iv.end
+					st.Until = &until
+				}
+			}
+			if iv.start.After(now) && (st.NextOpen == nil || iv.start.Before(*st.NextOpen)) {
+				next := iv.start
+				st.NextOpen = &next
+			}
+		}
+		if st.NextOpen != nil && d >= 0 {
+			break
+		}
+	}
+	if st.Open {
+		st.NextOpen = nil
+	}
+	return st
+}
+
+// exceptionsChanged reports whether the list of upcoming exceptions shown on
+// the site may differ between the two times, i.e. a day has passed.
+func (oh *OpeningHours) exceptionsChanged(built, now time.Time) bool {
+	loc := oh.location()
+	return len(oh.Exceptions) > 0 && built.In(loc).Format(dateLayout) != now.In(loc).Format(dateLayout)
+}
+
+// --- Build output ---
+
+type openingHoursRow struct {
+	Day   string
+	Hours []string
+}
+
+type openingHoursView struct {
+	Rows       []openingHoursRow
+	Exceptions []OpeningHoursException
+	JSONLD     template.JS
+}
+
+// weekOrder lists the days starting on Monday for display.
+var weekOrder = []time.Weekday{time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday, time.Saturday, time.Sunday}
+
+func newOpeningHoursView(siteConfig SiteConfig, now time.Time) (*openingHoursView, error) {
+	oh := siteConfig.OpeningHours
+	view := &openingHoursView{}
+	for _, wd := range weekOrder {
+		row := openingHoursRow{Day: wd.String()}
+		for _, r := range oh.Regular {
+			if r.Weekday == wd {
+				row.Hours = append(row.Hours, r.Opens+"–"+r.Closes)
+			}
+		}
+		view.Rows = append(view.Rows, row)
+	}
+	today := now.In(oh.location()).Format(dateLayout)
+	horizon := now.In(oh.location()).AddDate(0, 0, upcomingExceptionDays).Format(dateLayout)
+	for _, ex := range oh.Exceptions {
+		if ex.Until >= today && ex.From <= horizon {
+			view.Exceptions = append(view.Exceptions, ex)
+		}
+	}
+
+	// schema.org markup for search engines. Exceptions become specifications
+	// with validity dates; closed days use opens = closes = 00:00.
+	specs := []map[string]any{}
+	for _, r := range oh.Regular {
+		specs = append(specs, map[string]any{
+			"@type":     "OpeningHoursSpecification",
+			"dayOfWeek": "https://schema.org/" + r.Weekday.String(),
+			"opens":     r.Opens,
+			"closes":    r.Closes,
+		})
+	}
+	for _, ex := range oh.Exceptions {
+		opens, closes := ex.Opens, ex.Closes
+		if opens == "" {
+			opens, closes = "00:00", "00:00"
+		}
+		specs = append(specs, map[string]any{
+			"@type":        "OpeningHoursSpecification",
+			"opens":        opens,
+			"closes":       closes,
+			"validFrom":    ex.From,
+			"validThrough": ex.Until,
+		})
+	}
+	data, err := json.Marshal(map[string]any{
+		"@context":                  "https://schema.org",
+		"@type":                     "LocalBusiness",
+		"name":                      siteConfig.SiteName,
+		"url":                       siteURL(siteConfig.SiteName),
+		"openingHoursSpecification": specs,
+	})
+	if err != nil {
+		return nil, err
+	}
+	// json.Marshal escapes <, > and &, so the data cannot end the script.
+	view.JSONLD = template.JS(data)
+	return view, nil
+}
+
+// --- Handlers ---
+
+func putOpeningHoursHandler(w http.ResponseWriter, r *http.Request) {
+	siteName, ok := siteNameFromPath(w, r)
+	if !ok {
+		return
+	}
+	var oh OpeningHours
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&oh); err != nil {
+		http.Error(w, "Invalid JSON request", http.StatusBadRequest)
+		return
+	}
+	if err := oh.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if _, err := updateSiteConfig(siteName, func(siteConfig *SiteConfig) error {
+		siteConfig.OpeningHours = &oh
+		return nil
+	}); err != nil {
+		writeSiteUpdateError(w, r, siteName, err)
+		return
+	}
+	recordSiteEvent(siteName, SiteEvent{Type: "hours.updated"})
+
+	if _, err := buildSite(siteName); err != nil {
+		slog.ErrorContext(r.Context(), "error building site", "site", siteName, "error", err)
+	}
+	respondJSON(w, oh)
+}
+
+func getOpeningHoursHandler(w http.ResponseWriter, r *http.Request) {
+	siteName, ok := siteNameFromPath(w, r)
+	if !ok {
+		return
+	}
+	siteConfig, err := readSiteConfig(siteName)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error reading site config", "site", siteName, "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if siteConfig.OpeningHours == nil {
+		http.Error(w, "No opening hours configured", http.StatusNotFound)
+		return
+	}
+	respondJSON(w, siteConfig.OpeningHours)
+}
+
+// openingStatusHandler tells widgets whether the site is open now, or at the
+// time given in ?at= (RFC 3339).
+func openingStatusHandler(w http.ResponseWriter, r *http.Request) {
+	siteName, ok := siteNameFromPath(w, r)
+	if !ok {
+		return
+	}
+	at := time.Now()
+	if s := strings.TrimSpace(r.URL.Query().Get("at")); s != "" {
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			http.Error(w, "at must be an RFC 3339 timestamp", http.StatusBadRequest)
+			return
+		}
+		at = t
+	}
+	siteConfig, err := readSiteConfig(siteName)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error reading site config", "site", siteName, "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if siteConfig.OpeningHours == nil {
+		http.Error(w, "No opening hours configured", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Cache-Control", "public, max-age=60")
+	respondJSON(w, siteConfig.OpeningHours.status(at))
+}
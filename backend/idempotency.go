@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Idempotency keys make site creation safe to retry: a client sends a
+// random Idempotency-Key with POST /api/v1/sites and, when the connection
+// drops before the answer, retries with the same key and body. The first
+// request's response is stored and replayed to the retries, marked with
+// Idempotent-Replayed, for idempotency.ttl (24h), so a retry neither
+// creates a second site nor fails with SITE_EXISTS. While the first request
+// is still running, retries are answered 409; a key reused with a different
+// body is answered 422.
+//
+// Keys are scoped to the user or admin.token, or shared by anonymous
+// clients, and to the endpoint. Server errors and 429 are not stored, as the
+// creation was rolled back or never started and may be retried with the
+// same key.
+
+const idempotencyFile = ".idempotency.json" // in sitesBaseDir
+
+const (
+	idempotencyKeyHeader     = "Idempotency-Key"
+	idempotentReplayedHeader = "Idempotent-Replayed"
+	idempotencyKeyMaxLength  = 255
+)
+
+// idempotentResponse is a stored response, by the hash of its scoped key.
+type idempotentResponse struct {
+	RequestHash string    `json:"requestHash"` // of the request body
+	Status      int       `json:"status"`
+	ContentType string    `json:"contentType,omitempty"`
+	Body        string    `json:"body"`
+	CreatedAt   time.Time `json:"createdAt"`
+}
+
+// idempotency serializes the read-modify-write of the idempotency file and
+// holds the keys of the requests still running.
+var idempotency = struct {
+	sync.Mutex
+	running map[string]bool
+}{running: map[string]bool{}}
+
+func readIdempotentResponses() (map[string]*idempotentResponse, error) {
+	responses := map[string]*idempotentResponse{}
+	data, err := os.ReadFile(filepath.Join(sitesBaseDir, idempotencyFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return responses, nil
+		}
+		return nil, err
+	}
+	err = json.Unmarshal(data, &responses)
+	return responses, err
+}
+
+// writeIdempotentResponses stores the responses, dropping the expired ones.
+func writeIdempotentResponses(responses map[string]*idempotentResponse) error {
+	cutoff := time.Now().Add(-currentConfig().Idempotency.TTL)
+	for id, resp := range responses {
+		if resp.CreatedAt.Before(cutoff) {
+			delete(responses, id)
+		}
+	}
+	data, err := json.MarshalIndent(responses, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(sitesBaseDir, idempotencyFile), data, 0600)
+}
+
+func validIdempotencyKey(key string) bool {
+	if len(key) > idempotencyKeyMaxLength {
+		return false
+	}
+	for _, c := range []byte(key) {
+		if c < 0x21 || c > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+func hashHex(parts ...string) string {
+	h := sha256.New()
+	for _, p := range parts {
+		h.Write([]byte(p))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// idempotent replays the stored response to requests repeating the
+// Idempotency-Key of an earlier one; requests without a key, or with
+// idempotency.ttl 0, go to the handler as usual.
+func idempotent(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(idempotencyKeyHeader)
+		ttl := currentConfig().Idempotency.TTL
+		if key == "" || ttl <= 0 {
+			next(w, r)
+			return
+		}
+		if !validIdempotencyKey(key) {
+			apiError(w, r, http.StatusBadRequest, codeIdempotencyKeyInvalid, "Idempotency-Key must be 1-255 printable ASCII characters")
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		scope := "anonymous"
+		if userID := currentUserID(r); userID != "" {
+			scope = "user:" + userID
+		} else if r.Context().Value(adminTokenKey{}) != nil {
+			scope = "admin-token"
+		}
+		id := hashHex(scope, r.Pattern, key)
+		requestHash := hashHex(string(body))
+
+		idempotency.Lock()
+		responses, err := readIdempotentResponses()
+		if err != nil {
+			idempotency.Unlock()
+			slog.ErrorContext(r.Context(), "error reading idempotent responses", "error", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		stored := responses[id]
+		if stored != nil && time.Since(stored.CreatedAt) > ttl {
+			stored = nil
+		}
+		running := idempotency.running[id]
+		if stored == nil && !running {
+			idempotency.running[id] = true
+		}
+		idempotency.Unlock()
+
+		switch {
+		case stored != nil && stored.RequestHash != requestHash:
+			apiError(w, r, http.StatusUnprocessableEntity, codeIdempotencyKeyReused, "This Idempotency-Key was used with a different request")
+		case stored != nil:
+			if stored.ContentType != "" {
+				w.Header().Set("Content-Type", stored.ContentType)
+			}
+			w.Header().Set(idempotentReplayedHeader, "true")
+			w.WriteHeader(stored.Status)
+			io.WriteString(w, stored.Body)
+		case running:
+			w.Header().Set("Retry-After", "1")
+			apiError(w, r, http.StatusConflict, codeIdempotencyConflict, "A request with this Idempotency-Key is still in progress")
+		default:
+			rec := &idempotencyRecorder{ResponseWriter: w}
+			defer finishIdempotentRequest(r, id, requestHash, rec)
+			next(rec, r)
+		}
+	}
+}
+
+// finishIdempotentRequest stores the response of the first request with a
+// key, unless it may be retried or there is none (the handler panicked).
+func finishIdempotentRequest(r *http.Request, id, requestHash string, rec *idempotencyRecorder) {
+	idempotency.Lock()
+	defer idempotency.Unlock()
+	delete(idempotency.running, id)
+	status := rec.status
+	if status == 0 || status >= http.StatusInternalServerError || status == http.StatusTooManyRequests {
+		return
+	}
+	responses, err := readIdempotentResponses()
+	if err == nil {
+		responses[id] = &idempotentResponse{
+			RequestHash: requestHash,
+			Status:      status,
+			ContentType: rec.Header().Get("Content-Type"),
+			Body:        rec.body.String(),
+			CreatedAt:   time.Now().UTC(),
+		}
+		err = writeIdempotentResponses(responses)
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error storing idempotent response", "error", err)
+	}
+}
+
+// idempotencyRecorder passes a response on and keeps a copy.
+type idempotencyRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *idempotencyRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *idempotencyRecorder) Write(p []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	rec.body.Write(p)
+	return rec.ResponseWriter.Write(p)
+}
+
+func (rec *idempotencyRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
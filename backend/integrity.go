@@ -0,0 +1,407 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// The integrity sweep checks every site record (config.json) each
+// integrity.sweep_interval: it must decode without unknown fields, pass the
+// checks of the API (site name, style, sections) and match the checksum
+// writeSiteConfig stores next to it in config.json.sha256. A record that
+// fails is flagged as corrupt (no JSON), invalid (fails the checks) or
+// modified (valid, but changed outside the API, e.g. by hand). Flagged sites
+// are listed by GET /api/v1/admin/integrity and "site check"; an admin restores
+// the previous version (config.json.bak) or accepts a modified record. The
+// sweep changes nothing itself, except stamping records that have no
+// checksum yet.
+
+const siteConfigChecksumFile = "config.json.sha256"
+
+// Integrity states of flagged records.
+const (
+	integrityCorrupt  = "corrupt"
+	integrityInvalid  = "invalid"
+	integrityModified = "modified"
+)
+
+type integrityIssue struct {
+	SiteName   string    `json:"siteName"`
+	Status     string    `json:"status"` // corrupt, invalid or modified
+	Error      string    `json:"error"`
+	Restorable bool      `json:"restorable"` // config.json.bak is valid and can be restored
+	Since      time.Time `json:"since"`
+}
+
+var integrityState = struct {
+	sync.Mutex
+	checkedAt time.Time
+	issues    map[string]integrityIssue // by site name
+}{issues: map[string]integrityIssue{}}
+
+func siteConfigChecksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// writeSiteConfigChecksum stores the checksum of a site record as written.
+func writeSiteConfigChecksum(dir string, data []byte) error {
+	return writeFileAtomic(filepath.Join(dir, siteConfigChecksumFile), []byte(siteConfigChecksum(data)+"\n"), 0644)
+}
+
+// validateSiteRecord decodes a site record strictly and checks it like the
+// API checks its input.
+func validateSiteRecord(siteName string, data []byte) (SiteConfig, error) {
+	var sc SiteConfig
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&sc); err != nil {
+		return sc, err
+	}
+	if sc.SiteName != siteName {
+		return sc, fmt.Errorf("siteName %q does not match the directory", sc.SiteName)
+	}
+	if !siteNameRegex.MatchString(sc.SiteName) {
+		return sc, fmt.Errorf("invalid siteName %q", sc.SiteName)
+	}
+	if sc.CreatedAt.IsZero() {
+		return sc, errors.New("createdAt is missing")
+	}
+	if _, ok := findTheme(sc.Style); sc.Style != "" && !ok {
+		return sc, fmt.Errorf("unknown style %q", sc.Style)
+	}
+	if len(sc.InitialContent) > 0 {
+		if err := validateSiteSections(sc, sc.InitialContent); err != nil {
+			return sc, err
+		}
+	}
+	return sc, nil
+}
+
+// isSyntaxError reports whether a decoding error means the file is no JSON
+// (or not the shape of a site record) rather than a record with bad values.
+func isSyntaxError(err error) bool {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	return errors.As(err, &syntaxErr) || errors.As(err, &typeErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// checkSiteRecord checks the record of one site and returns its issue, nil
+// if it is fine. A valid record without checksum is stamped.
+func checkSiteRecord(siteName string) (*integrityIssue, error) {
+	dir := filepath.Join(sitesBaseDir, siteName)
+	var data []byte
+	var stored []byte
+	var err error
+	// A write between reading the record and its checksum would look like
+	// a modification, so a mismatch is read once more.
+	for attempt := 0; attempt < 2; attempt++ {
+		if attempt > 0 {
+			time.Sleep(100 * time.Millisecond)
+		}
+		if data, err = os.ReadFile(filepath.Join(dir, siteConfigFile)); err != nil {
+			return nil, err
+		}
+		stored, err = os.ReadFile(filepath.Join(dir, siteConfigChecksumFile))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		if err != nil || strings.TrimSpace(string(stored)) == siteConfigChecksum(data) {
+			break
+		}
+	}
+	issue := &integrityIssue{SiteName: siteName, Restorable: backupRestorable(siteName)}
+	if _, verr := validateSiteRecord(siteName, data); verr != nil {
+		issue.Status, issue.Error = integrityInvalid, verr.Error()
+		if isSyntaxError(verr) {
+			issue.Status = integrityCorrupt
+		}
+		return issue, nil
+	}
+	switch {
+	case os.IsNotExist(err):
+		// Written before checksums were stored.
+		if err := writeSiteConfigChecksum(dir, data); err != nil {
+			return nil, err
+		}
+		return nil, nil
+	case strings.TrimSpace(string(stored)) != siteConfigChecksum(data):
+		issue.Status, issue.Error = integrityModified, "changed outside the API, the checksum does not match"
+		return issue, nil
+	}
+	return nil, nil
+}
+
+// backupRestorable reports whether a site has a valid previous record.
+func backupRestorable(siteName string) bool {
+	data, err := os.ReadFile(filepath.Join(sitesBaseDir, siteName, siteConfigBackupFile))
+	if err != nil {
+		return false
+	}
+	_, err = validateSiteRecord(siteName, data)
+	return err == nil
+}
+
+// sweepSiteRecords checks all site records and stores the issues for the
+// admin overview. Newly flagged sites are logged.
+func sweepSiteRecords() ([]integrityIssue, error) {
+	siteNames, err := listSiteNames()
+	if err != nil {
+		return nil, err
+	}
+	issues := map[string]integrityIssue{}
+	for _, siteName := range siteNames {
+		issue, err := checkSiteRecord(siteName)
+		if os.IsNotExist(err) {
+			continue // a creation or deletion in progress
+		}
+		if err != nil {
+			slog.Error("error checking site record", "site", siteName, "error", err)
+			continue
+		}
+		if issue != nil {
+			issues[siteName] = *issue
+		}
+	}
+
+	integrityState.Lock()
+	defer integrityState.Unlock()
+	now := time.Now().UTC()
+	for siteName, issue := range issues {
+		if previous, ok := integrityState.issues[siteName]; ok && previous.Status == issue.Status {
+			issue.Since = previous.Since
+		} else {
+			issue.Since = now
+			level := slog.LevelError
+			if issue.Status == integrityModified {
+				level = slog.LevelWarn
+			}
+			slog.Log(context.Background(), level, "site record flagged by the integrity sweep", "site", siteName, "status", issue.Status, "error", issue.Error)
+		}
+		issues[siteName] = issue
+	}
+	integrityState.issues = issues
+	integrityState.checkedAt = now
+	return sortedIssues(issues), nil
+}
+
+func sortedIssues(issues map[string]integrityIssue) []integrityIssue {
+	list := make([]integrityIssue, 0, len(issues))
+	for _, issue := range issues {
+		list = append(list, issue)
+	}
+	slices.SortFunc(list, func(a, b integrityIssue) int { return strings.Compare(a.SiteName, b.SiteName) })
+	return list
+}
+
+// resolveIssue removes a site from the flagged ones after an admin fixed it.
+func resolveIssue(siteName string) {
+	integrityState.Lock()
+	defer integrityState.Unlock()
+	delete(integrityState.issues, siteName)
+}
+
+// runIntegritySweep sweeps at startup and every interval.
+func runIntegritySweep(interval time.Duration) {
+	if interval <= 0 {
+		slog.Info("Integrity sweep disabled (integrity.sweep_interval <= 0)")
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if _, err := sweepSiteRecords(); err != nil {
+			slog.Error("error sweeping site records", "error", err)
+		}
+		<-ticker.C
+	}
+}
+
+// restoreSiteRecord replaces the record of a site with its valid backup,
+// keeping the replaced file as config.json.corrupt.
+func restoreSiteRecord(siteName, reason string) error {
+	defer lockSiteConfig(siteName)()
+	dir := filepath.Join(sitesBaseDir, siteName)
+	backup, err := os.ReadFile(filepath.Join(dir, siteConfigBackupFile))
+	if err != nil {
+		return fmt.Errorf("no backup: %v", err)
+	}
+	if _, err := validateSiteRecord(siteName, backup); err != nil {
+		return fmt.Errorf("the backup is not valid either: %v", err)
+	}
+	configPath := filepath.Join(dir, siteConfigFile)
+	if err := os.Rename(configPath, filepath.Join(dir, siteConfigCorruptFile)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	err = writeFileAtomic(configPath, backup, 0644)
+	siteDetails.invalidate(siteName)
+	if err != nil {
+		return err
+	}
+	if err := writeSiteConfigChecksum(dir, backup); err != nil {
+		return err
+	}
+	recordSiteEvent(siteName, SiteEvent{Type: "site.config_restored", Message: reason})
+	resolveIssue(siteName)
+	return nil
+}
+
+// acceptSiteRecord stamps a modified but valid record as the current one.
+func acceptSiteRecord(siteName string) error {
+	dir := filepath.Join(sitesBaseDir, siteName)
+	data, err := os.ReadFile(filepath.Join(dir, siteConfigFile))
+	if err != nil {
+		return err
+	}
+	if _, err := validateSiteRecord(siteName, data); err != nil {
+		return fmt.Errorf("the record is not valid, restore it instead: %v", err)
+	}
+	if err := writeSiteConfigChecksum(dir, data); err != nil {
+		return err
+	}
+	resolveIssue(siteName)
+	return nil
+}
+
+// integrityHealth is the sweep status of the health endpoint. Modified
+// records are valid and do not degrade it.
+func integrityHealth() (status string, healthy bool) {
+	integrityState.Lock()
+	defer integrityState.Unlock()
+	if integrityState.checkedAt.IsZero() {
+		if config.Integrity.SweepInterval <= 0 {
+			return "not swept (integrity.sweep_interval is 0)", true
+		}
+		return "not swept yet", true
+	}
+	var broken []string
+	for _, issue := range sortedIssues(integrityState.issues) {
+		if issue.Status != integrityModified {
+			broken = append(broken, issue.SiteName)
+		}
+	}
+	if len(broken) > 0 {
+		return fmt.Sprintf("%d corrupt or invalid: %s", len(broken), strings.Join(broken, ", ")), false
+	}
+	if n := len(integrityState.issues); n > 0 {
+		return fmt.Sprintf("OK, %d modified", n), true
+	}
+	return "OK", true
+}
+
+// --- Handlers ---
+
+type integrityResponse struct {
+	CheckedAt time.Time        `json:"checkedAt,omitzero"`
+	Sites     []integrityIssue `json:"sites"`
+}
+
+// getIntegrityHandler lists the sites flagged by the last sweep.
+func getIntegrityHandler(w http.ResponseWriter, r *http.Request) {
+	integrityState.Lock()
+	resp := integrityResponse{CheckedAt: integrityState.checkedAt, Sites: sortedIssues(integrityState.issues)}
+	integrityState.Unlock()
+	respondJSON(w, resp)
+}
+
+// sweepIntegrityHandler runs a sweep now.
+func sweepIntegrityHandler(w http.ResponseWriter, r *http.Request) {
+	issues, err := sweepSiteRecords()
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error sweeping site records", "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	integrityState.Lock()
+	checkedAt := integrityState.checkedAt
+	integrityState.Unlock()
+	respondJSON(w, integrityResponse{CheckedAt: checkedAt, Sites: issues})
+}
+
+// siteRecordActionHandler restores or accepts the record of a site.
+func siteRecordActionHandler(action func(siteName string) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		siteName := strings.ToLower(r.PathValue("siteName"))
+		if exists, err := siteExists(siteName); err != nil || !exists {
+			http.Error(w, "Site not found", http.StatusNotFound)
+			return
+		}
+		setRequestSite(r, siteName)
+		if err := action(siteName); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		issue, err := checkSiteRecord(siteName)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "error checking site record", "site", siteName, "error", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		respondJSON(w, map[string]any{"siteName": siteName, "ok": issue == nil, "issue": issue})
+	}
+}
+
+func restoreSiteRecordByAdmin(siteName string) error {
+	return restoreSiteRecord(siteName, "restored from config.json.bak by an admin")
+}
+
+// --- Commands ---
+
+func runSiteCheck(args []string) error {
+	issues, err := sweepSiteRecords()
+	if err != nil {
+		return err
+	}
+	if adminOptions.json {
+		return json.NewEncoder(os.Stdout).Encode(issues)
+	}
+	if len(issues) == 0 {
+		fmt.Println("All site records are intact")
+		return nil
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "SITE\tSTATUS\tRESTORABLE\tERROR")
+	for _, issue := range issues {
+		fmt.Fprintf(tw, "%s\t%s\t%v\t%s\n", issue.SiteName, issue.Status, issue.Restorable, issue.Error)
+	}
+	return tw.Flush()
+}
+
+func runSiteRestoreConfig(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: site restore-config <siteName>")
+	}
+	siteName := strings.ToLower(args[0])
+	if err := restoreSiteRecord(siteName, "restored from config.json.bak with site restore-config"); err != nil {
+		return err
+	}
+	fmt.Printf("Restored the previous record of %s, the replaced one is kept as %s\n", siteName, siteConfigCorruptFile)
+	return nil
+}
+
+func runSiteAcceptConfig(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: site accept-config <siteName>")
+	}
+	siteName := strings.ToLower(args[0])
+	if err := acceptSiteRecord(siteName); err != nil {
+		return err
+	}
+	fmt.Printf("Accepted the current record of %s\n", siteName)
+	return nil
+}
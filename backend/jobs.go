@@ -0,0 +1,245 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Provisioning jobs: a client sending POST /api/v1/sites with
+// "Prefer: respond-async" gets 202 Accepted with a job ID as soon as the
+// request is validated, and the site is created in the background. With
+// acme.enabled the job also issues the site's certificate, so a finished
+// job means the site is served over HTTPS. GET /api/v1/jobs/{jobId} reports
+// the job's phases (name, directory, config, build, dns, warmup, tls), the
+// steps of the provisioning log behind them and, once finished, the
+// creation response or the error, for the frontend to poll.
+//
+// Without the header the creation answers when it is done, as before.
+// Jobs are kept in memory for jobRetention after they finish; a restart
+// forgets them, the provisioning log of the site still has the steps.
+
+const jobRetention = 24 * time.Hour
+
+const (
+	jobRunning   = "running"
+	jobSucceeded = "succeeded"
+	jobFailed    = "failed"
+)
+
+// jobPhases are the phases of a creation job in their order.
+var jobPhases = []string{"name", "directory", "config", "build", "dns", "warmup", "tls"}
+
+// jobPhaseOf returns the phase of a provisioning log step, "" for steps
+// not shown as a phase (e.g. coupon.redeem, rollback.*).
+func jobPhaseOf(step string) string {
+	switch {
+	case step == "name.allocate":
+		return "name"
+	case step == "directory", step == "config", step == "warmup":
+		return step
+	case step == "scaffold":
+		return "config"
+	case step == "build", step == "command", step == "map.static", step == "social.fetch":
+		return "build"
+	case strings.HasPrefix(step, "dns."):
+		return "dns"
+	case strings.HasPrefix(step, "certificate."):
+		return "tls"
+	}
+	return ""
+}
+
+type provisioningJob struct {
+	ID         string
+	Kind       string // site.create
+	SiteName   string
+	Status     string
+	CreatedAt  time.Time
+	FinishedAt time.Time
+	Steps      []provisioningStep
+	Result     *siteCreationResponse
+	Error      *APIError
+
+	userID string // of the requester, empty for anonymous requests
+}
+
+var jobs = struct {
+	sync.Mutex
+	byID   map[string]*provisioningJob
+	bySite map[string]*provisioningJob // running
+}{byID: map[string]*provisioningJob{}, bySite: map[string]*provisioningJob{}}
+
+type jobPhase struct {
+	Name   string `json:"name"`
+	Status string `json:"status"` // pending, running, done, queued (DNS record), failed or skipped
+	Error  string `json:"error,omitempty"`
+}
+
+type jobView struct {
+	JobID      string                `json:"jobId"`
+	Kind       string                `json:"kind"`
+	SiteName   string                `json:"siteName"`
+	Status     string                `json:"status"` // running, succeeded or failed
+	CreatedAt  time.Time             `json:"createdAt"`
+	FinishedAt *time.Time            `json:"finishedAt,omitempty"`
+	Phases     []jobPhase            `json:"phases"`
+	Steps      []provisioningStep    `json:"steps"`
+	Result     *siteCreationResponse `json:"result,omitempty"` // of a succeeded job
+	Error      *APIError             `json:"error,omitempty"`  // of a failed job
+}
+
+// view returns the state of a job. The phase of a step is as its last
+// step; while the job runs, the phase after the last one with a step is
+// running, and phases without a step are skipped once it finished.
+func (j *provisioningJob) view() jobView {
+	v := jobView{
+		JobID:     j.ID,
+		Kind:      j.Kind,
+		SiteName:  j.SiteName,
+		Status:    j.Status,
+		CreatedAt: j.CreatedAt,
+		Steps:     append([]provisioningStep{}, j.Steps...),
+		Result:    j.Result,
+		Error:     j.Error,
+	}
+	if !j.FinishedAt.IsZero() {
+		v.FinishedAt = &j.FinishedAt
+	}
+	last := -1
+	for i, name := range jobPhases {
+		phase := jobPhase{Name: name, Status: "pending"}
+		for _, s := range j.Steps {
+			if jobPhaseOf(s.Step) != name {
+				continue
+			}
+			phase.Status, phase.Error = "done", ""
+			if !s.OK {
+				phase.Status, phase.Error = "failed", s.Error
+			}
+			last = i
+		}
+		if name == "dns" && j.Result != nil && j.Result.DNSPending {
+			phase.Status = "queued"
+		}
+		v.Phases = append(v.Phases, phase)
+	}
+	for i := range v.Phases {
+		switch {
+		case v.Phases[i].Status != "pending":
+		case j.Status != jobRunning:
+			v.Phases[i].Status = "skipped"
+		case i == last+1:
+			v.Phases[i].Status = "running"
+		}
+	}
+	return v
+}
+
+// prefersAsync reports whether the client asked for an asynchronous
+// response with "Prefer: respond-async".
+func prefersAsync(r *http.Request) bool {
+	for _, header := range r.Header.Values("Prefer") {
+		for _, pref := range strings.Split(header, ",") {
+			token, _, _ := strings.Cut(pref, ";")
+			if strings.EqualFold(strings.TrimSpace(token), "respond-async") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// startSiteCreationJob validates a creation request, answers 202 with the
+// job and creates the site in the background.
+func startSiteCreationJob(w http.ResponseWriter, r *http.Request, req siteCreationRequest) {
+	if resp, status, ok := checkSiteCreation(r, &req); !ok {
+		countSiteCreation(resp, status)
+		writeSiteCreation(w, r, resp, status)
+		return
+	}
+	now := time.Now().UTC()
+	job := &provisioningJob{ID: newID(), Kind: "site.create", SiteName: req.SiteName, Status: jobRunning, CreatedAt: now, Steps: []provisioningStep{}, userID: currentUserID(r)}
+	jobs.Lock()
+	if _, ok := jobs.bySite[req.SiteName]; ok {
+		jobs.Unlock()
+		apiError(w, r, http.StatusConflict, codeSiteExists, "This site is already being created")
+		return
+	}
+	for id, j := range jobs.byID {
+		if !j.FinishedAt.IsZero() && now.Sub(j.FinishedAt) > jobRetention {
+			delete(jobs.byID, id)
+		}
+	}
+	jobs.byID[job.ID] = job
+	jobs.bySite[job.SiteName] = job
+	view := job.view()
+	jobs.Unlock()
+
+	// The request outlives its handler, but not its context's values:
+	// the session, request ID and trace go on into the job.
+	bg := r.Clone(context.WithoutCancel(r.Context()))
+	go runSiteCreationJob(bg, job, req)
+
+	w.Header().Set("Preference-Applied", "respond-async")
+	w.Header().Set("Location", "/api/"+currentAPIVersion+"/jobs/"+job.ID)
+	respondJSONStatus(w, http.StatusAccepted, view)
+}
+
+func runSiteCreationJob(r *http.Request, job *provisioningJob, req siteCreationRequest) {
+	resp, status := createSite(r, req)
+	if status == http.StatusOK && resp.Success && config.ACME.Enabled {
+		if sc, err := readSiteConfig(req.SiteName); err == nil && certificateDue(sc, time.Now()) {
+			// A failure is in the tls phase and the site config; the
+			// scheduler tries again later.
+			issueCertificate(r.Context(), req.SiteName)
+		}
+	}
+
+	jobs.Lock()
+	defer jobs.Unlock()
+	delete(jobs.bySite, job.SiteName)
+	job.FinishedAt = time.Now().UTC()
+	if status == http.StatusOK && resp.Success {
+		job.Status = jobSucceeded
+		job.Result = &resp
+		return
+	}
+	job.Status = jobFailed
+	job.Error = siteCreationError(resp)
+	job.Error.Code = cmp.Or(job.Error.Code, statusErrorCode(status))
+	job.Error.RequestID = requestIDFrom(r.Context())
+}
+
+// recordJobStep adds a provisioning log step to the running job of the
+// site, if there is one.
+func recordJobStep(siteName string, s provisioningStep) {
+	jobs.Lock()
+	defer jobs.Unlock()
+	if job, ok := jobs.bySite[siteName]; ok {
+		job.Steps = append(job.Steps, s)
+	}
+}
+
+// getJobHandler reports the state of a job to its requester and admins.
+func getJobHandler(w http.ResponseWriter, r *http.Request) {
+	jobs.Lock()
+	job, ok := jobs.byID[r.PathValue("jobId")]
+	var view jobView
+	if ok {
+		ok = job.userID == "" || job.userID == currentUserID(r) || isAdmin(r) || r.Context().Value(adminTokenKey{}) != nil
+		view = job.view()
+	}
+	jobs.Unlock()
+	if !ok {
+		apiError(w, r, http.StatusNotFound, codeJobNotFound, "Job not found")
+		return
+	}
+	if view.Status == jobRunning {
+		w.Header().Set("Retry-After", "1")
+	}
+	respondJSON(w, view)
+}
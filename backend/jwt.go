@@ -0,0 +1,124 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Sessions are JSON Web Tokens signed with HS256. The key is
+// auth.jwt_secret, or else a random key generated on first use and kept in
+// .jwt-secret in the sites directory, so tokens survive restarts.
+
+const (
+	jwtSecretFile = ".jwt-secret" // in sitesBaseDir
+	jwtIssuer     = "flox"
+)
+
+var errInvalidToken = errors.New("invalid or expired token")
+
+type sessionClaims struct {
+	Subject   string `json:"sub"` // user ID
+	Email     string `json:"email"`
+	Issuer    string `json:"iss"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+	// Role is resolved per request, from the user store or the OIDC token,
+	// and never read from a session token.
+	Role string `json:"-"`
+}
+
+var jwtKey struct {
+	once sync.Once
+	key  []byte
+	err  error
+}
+
+func jwtSigningKey() ([]byte, error) {
+	jwtKey.once.Do(func() {
+		if config.Auth.JWTSecret != "" {
+			jwtKey.key = []byte(config.Auth.JWTSecret)
+			return
+		}
+		jwtKey.key, jwtKey.err = loadOrCreateJWTSecret(filepath.Join(sitesBaseDir, jwtSecretFile))
+	})
+	return jwtKey.key, jwtKey.err
+}
+
+func loadOrCreateJWTSecret(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		return base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return key, writeFileAtomic(path, []byte(base64.StdEncoding.EncodeToString(key)+"\n"), 0600)
+}
+
+var jwtHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+// issueSessionToken returns a token for the user, valid for auth.token_ttl.
+func issueSessionToken(user User) (token string, expiresAt time.Time, err error) {
+	key, err := jwtSigningKey()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	now := time.Now()
+	expiresAt = now.Add(config.Auth.TokenTTL).UTC().Truncate(time.Second)
+	payload, err := json.Marshal(sessionClaims{
+		Subject:   user.ID,
+		Email:     user.Email,
+		Issuer:    jwtIssuer,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: expiresAt.Unix(),
+	})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	signed := jwtHeader + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return signed + "." + jwtSignature(key, signed), expiresAt, nil
+}
+
+func jwtSignature(key []byte, signed string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(signed))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// parseSessionToken verifies a token and returns its claims.
+func parseSessionToken(token string) (sessionClaims, error) {
+	var claims sessionClaims
+	key, err := jwtSigningKey()
+	if err != nil {
+		return claims, err
+	}
+	header, rest, ok := strings.Cut(token, ".")
+	if !ok || header != jwtHeader {
+		return claims, errInvalidToken // only our own HS256 header is accepted
+	}
+	payload, signature, ok := strings.Cut(rest, ".")
+	if !ok || !hmac.Equal([]byte(signature), []byte(jwtSignature(key, header+"."+payload))) {
+		return claims, errInvalidToken
+	}
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil || json.Unmarshal(data, &claims) != nil {
+		return claims, errInvalidToken
+	}
+	if claims.Issuer != jwtIssuer || claims.Subject == "" || time.Now().Unix() >= claims.ExpiresAt {
+		return claims, errInvalidToken
+	}
+	return claims, nil
+}
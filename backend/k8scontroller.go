@@ -0,0 +1,681 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+// Kubernetes controller: "flox-backend k8s-controller" manages sites
+// declared as FloxSite custom resources (kubernetes/floxsite-crd.yaml), so
+// platform teams can manage flox sites with kubectl and Argo CD:
+//
+//	apiVersion: flox.click/v1alpha1
+//	kind: FloxSite
+//	metadata:
+//	  name: bakery-berlin
+//	spec:
+//	  siteName: bakery-berlin # defaults to metadata.name, cannot change
+//	  description: Fresh bread every morning
+//	  style: light
+//	  sections: [header, hero, hours, footer]
+//	  email: owner@bakery.example
+//	  adopt: false            # manage a site that exists already
+//	  deletionPolicy: Delete  # Retain keeps the site when the resource is deleted
+//
+// The controller watches the resources and makes the API calls for them
+// against the backend with admin.token: it creates missing sites in the
+// background (Prefer: respond-async, with an Idempotency-Key derived from
+// the resource, so a retry after a lost status update does not create the
+// site twice) and follows the job, updates the description, style and
+// sections given in the spec when the site differs, and deletes the site
+// when the resource is deleted, which a finalizer holds until then. Fields
+// left out of the spec are not managed.
+//
+// The outcome is written into the status of the resource: phase (Pending,
+// Provisioning, Ready, Failed, Deleting), reason, message, the site's name
+// and URL, and a Ready condition. A failure, e.g. an invalid style or a site
+// name taken by a site the resource did not create, is final until the
+// spec changes; unavailable APIs are retried.
+//
+// The controller is a process of its own, usually a Deployment next to the
+// backend (kubernetes/controller.yaml). In a pod it talks to the cluster
+// with its service account; elsewhere --kube-api names the API server,
+// e.g. "kubectl proxy" on http://127.0.0.1:8001.
+
+const (
+	floxSiteGroup     = "flox.click"
+	floxSiteVersion   = "v1alpha1"
+	floxSiteResource  = "floxsites"
+	floxSiteFinalizer = "flox.click/site"
+)
+
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+const (
+	k8sReconcileTimeout = time.Minute
+	k8sRequeueDelay     = 5 * time.Second // while a creation job runs
+	k8sRetryDelay       = 10 * time.Second
+)
+
+// Phases of a FloxSite.
+const (
+	floxSitePending      = "Pending"
+	floxSiteProvisioning = "Provisioning"
+	floxSiteReady        = "Ready"
+	floxSiteFailed       = "Failed"
+	floxSiteDeleting     = "Deleting"
+)
+
+type floxSite struct {
+	Metadata struct {
+		Name              string     `json:"name"`
+		Namespace         string     `json:"namespace"`
+		UID               string     `json:"uid"`
+		ResourceVersion   string     `json:"resourceVersion"`
+		Generation        int64      `json:"generation"`
+		DeletionTimestamp *time.Time `json:"deletionTimestamp,omitempty"`
+		Finalizers        []string   `json:"finalizers,omitempty"`
+	} `json:"metadata"`
+	Spec   floxSiteSpec   `json:"spec"`
+	Status floxSiteStatus `json:"status"`
+}
+
+type floxSiteSpec struct {
+	SiteName       string   `json:"siteName,omitempty"`
+	Description    *string  `json:"description,omitempty"`
+	Style          *string  `json:"style,omitempty"`
+	Sections       []string `json:"sections,omitempty"`
+	Email          string   `json:"email,omitempty"`
+	Adopt          bool     `json:"adopt,omitempty"`
+	DeletionPolicy string   `json:"deletionPolicy,omitempty"` // Delete (default) or Retain
+}
+
+type floxSiteStatus struct {
+	Phase              string              `json:"phase,omitempty"`
+	Reason             string              `json:"reason,omitempty"`
+	Message            string              `json:"message,omitempty"`
+	SiteName           string              `json:"siteName,omitempty"` // of the site the resource manages
+	URL                string              `json:"url,omitempty"`
+	JobID              string              `json:"jobId,omitempty"` // of the last creation
+	ObservedGeneration int64               `json:"observedGeneration,omitempty"`
+	Conditions         []floxSiteCondition `json:"conditions,omitempty"`
+}
+
+type floxSiteCondition struct {
+	Type               string    `json:"type"`
+	Status             string    `json:"status"` // True or False
+	Reason             string    `json:"reason,omitempty"`
+	Message            string    `json:"message,omitempty"`
+	LastTransitionTime time.Time `json:"lastTransitionTime"`
+}
+
+func (st floxSiteStatus) with(phase, reason, message string) floxSiteStatus {
+	st.Phase, st.Reason, st.Message = phase, reason, message
+	return st
+}
+
+// failure returns the status for an error of the backend API: rejected
+// requests fail the resource, other errors are returned to try again.
+func (st floxSiteStatus) failure(err error) (floxSiteStatus, error) {
+	var apiErr *floxAPIError
+	if !errors.As(err, &apiErr) || apiErr.Status >= http.StatusInternalServerError || apiErr.Status == http.StatusTooManyRequests {
+		return st, err
+	}
+	message := apiErr.Message
+	if apiErr.Code == codeSiteExists {
+		message += "; set spec.adopt to manage the existing site"
+	}
+	return st.with(floxSiteFailed, reasonOf(apiErr.Code), message), nil
+}
+
+// setReadyCondition sets the Ready condition from the phase, keeping its
+// transition time from old unless it flipped.
+func (st *floxSiteStatus) setReadyCondition(old floxSiteStatus) {
+	cond := floxSiteCondition{Type: "Ready", Status: "False", Reason: st.Reason, Message: st.Message}
+	if st.Phase == floxSiteReady {
+		cond.Status = "True"
+	}
+	cond.LastTransitionTime = time.Now().UTC().Truncate(time.Second)
+	for _, c := range old.Conditions {
+		if c.Type == cond.Type && c.Status == cond.Status {
+			cond.LastTransitionTime = c.LastTransitionTime
+		}
+	}
+	st.Conditions = []floxSiteCondition{cond}
+}
+
+// reasonOf turns an API error code into a condition reason, SITE_EXISTS
+// into SiteExists.
+func reasonOf(code string) string {
+	var b strings.Builder
+	for _, word := range strings.Split(strings.ToLower(code), "_") {
+		if word != "" {
+			b.WriteString(strings.ToUpper(word[:1]) + word[1:])
+		}
+	}
+	return b.String()
+}
+
+// --- Backend API ---
+
+// floxClient calls the backend API with admin.token.
+type floxClient struct {
+	baseURL string
+	token   string
+}
+
+// floxAPIError is an error response of the backend API.
+type floxAPIError struct {
+	Status int
+	APIError
+}
+
+func (e *floxAPIError) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.Status, e.Code, e.Message)
+}
+
+func floxAPIStatus(err error) int {
+	var apiErr *floxAPIError
+	if errors.As(err, &apiErr) {
+		return apiErr.Status
+	}
+	return 0
+}
+
+func (c *floxClient) request(ctx context.Context, method, path string, header http.Header, body, result any) error {
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			return fmt.Errorf("failed to marshal JSON: %v", err)
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+"/api/"+currentAPIVersion+path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, 4<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 300 {
+		apiErr := &floxAPIError{Status: resp.StatusCode}
+		if json.Unmarshal(raw, &apiErr.APIError) != nil || apiErr.Code == "" {
+			apiErr.APIError = APIError{Code: statusErrorCode(resp.StatusCode), Message: strings.TrimSpace(string(raw))}
+		}
+		return apiErr
+	}
+	if result != nil {
+		return json.Unmarshal(raw, result)
+	}
+	return nil
+}
+
+// --- Kubernetes API ---
+
+type kubeClient struct {
+	baseURL   string
+	tokenFile string // of the service account, read per request as it is rotated
+	client    *http.Client
+}
+
+// kubeError is an error response of the Kubernetes API, a Status object.
+type kubeError struct {
+	Code    int    `json:"code"`
+	Reason  string `json:"reason"`
+	Message string `json:"message"`
+}
+
+func (e *kubeError) Error() string {
+	return fmt.Sprintf("kubernetes API: %d %s: %s", e.Code, e.Reason, e.Message)
+}
+
+const jsonPatchType = "application/json-patch+json"
+
+type jsonPatchOp struct {
+	Op    string `json:"op"`
+	Path  string `json:"path"`
+	Value any    `json:"value"`
+}
+
+// newKubeClient returns a client of the API server at apiURL, without
+// credentials, or, without apiURL, of the cluster the pod runs in.
+func newKubeClient(apiURL string) (*kubeClient, error) {
+	if apiURL != "" {
+		return &kubeClient{baseURL: strings.TrimSuffix(apiURL, "/"), client: &http.Client{}}, nil
+	}
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("not running in a Kubernetes pod, give the API server with --kube-api (e.g. of kubectl proxy)")
+	}
+	ca, err := os.ReadFile(filepath.Join(serviceAccountDir, "ca.crt"))
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, errors.New("no certificate in the service account's ca.crt")
+	}
+	return &kubeClient{
+		baseURL:   "https://" + net.JoinHostPort(host, port),
+		tokenFile: filepath.Join(serviceAccountDir, "token"),
+		client:    &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}},
+	}, nil
+}
+
+// send makes a request and returns the response of a success.
+func (k *kubeClient) send(ctx context.Context, method, path, contentType string, body any) (*http.Response, error) {
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			return nil, fmt.Errorf("failed to marshal JSON: %v", err)
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, method, k.baseURL+path, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if k.tokenFile != "" {
+		token, err := os.ReadFile(k.tokenFile)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+	req.Header.Set("Accept", "application/json")
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		raw, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+		kerr := &kubeError{}
+		if json.Unmarshal(raw, kerr) != nil || kerr.Message == "" {
+			kerr.Message = strings.TrimSpace(string(raw))
+		}
+		kerr.Code = resp.StatusCode
+		return nil, kerr
+	}
+	return resp, nil
+}
+
+func (k *kubeClient) request(ctx context.Context, method, path, contentType string, body, result any) error {
+	resp, err := k.send(ctx, method, path, contentType, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if result == nil {
+		return nil
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 64<<20)).Decode(result)
+}
+
+// --- Controller ---
+
+type k8sController struct {
+	kube      *kubeClient
+	flox      *floxClient
+	namespace string // empty for all
+}
+
+// resourcePath is the API path of the FloxSites of a namespace, or of one.
+func (c *k8sController) resourcePath(namespace, name string) string {
+	path := "/apis/" + floxSiteGroup + "/" + floxSiteVersion
+	if namespace != "" {
+		path += "/namespaces/" + url.PathEscape(namespace)
+	}
+	path += "/" + floxSiteResource
+	if name != "" {
+		path += "/" + url.PathEscape(name)
+	}
+	return path
+}
+
+func runK8sController() error {
+	if config.Admin.Token == "" {
+		return errors.New("the controller calls the API with admin.token, set it (FLOX_ADMIN_TOKEN) like on the backend")
+	}
+	kube, err := newKubeClient(k8sOptions.kubeAPI)
+	if err != nil {
+		return err
+	}
+	apiURL := cmp.Or(k8sOptions.apiURL, fmt.Sprintf("http://localhost:%d", config.Server.Port))
+	c := &k8sController{kube: kube, flox: &floxClient{baseURL: strings.TrimSuffix(apiURL, "/"), token: config.Admin.Token}, namespace: k8sOptions.namespace}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+	slog.Info("Kubernetes controller started", "api", c.flox.baseURL, "kubernetes", kube.baseURL, "namespace", cmp.Or(c.namespace, "all"))
+	for ctx.Err() == nil {
+		resourceVersion, requeue, err := c.reconcileAll(ctx)
+		if err != nil {
+			slog.Error("error listing FloxSites", "error", err)
+			select {
+			case <-ctx.Done():
+			case <-time.After(k8sRetryDelay):
+			}
+			continue
+		}
+		c.watch(ctx, resourceVersion, requeue)
+	}
+	return nil
+}
+
+// reconcileAll reconciles every resource and returns the resource version
+// of the list to watch from, and whether one is to be looked at again soon.
+func (c *k8sController) reconcileAll(ctx context.Context) (string, bool, error) {
+	var list struct {
+		Metadata struct {
+			ResourceVersion string `json:"resourceVersion"`
+		} `json:"metadata"`
+		Items []floxSite `json:"items"`
+	}
+	if err := c.kube.request(ctx, http.MethodGet, c.resourcePath(c.namespace, ""), "", nil, &list); err != nil {
+		return "", false, err
+	}
+	requeue := false
+	for i := range list.Items {
+		if c.reconcile(ctx, &list.Items[i]) {
+			requeue = true
+		}
+	}
+	return list.Metadata.ResourceVersion, requeue, nil
+}
+
+// watch reconciles the resources changed after resourceVersion until
+// --resync passed, or k8sRequeueDelay once a resource is to be looked at
+// again, when all are listed again.
+func (c *k8sController) watch(ctx context.Context, resourceVersion string, requeue bool) {
+	watchCtx, cancel := context.WithTimeout(ctx, k8sOptions.resync)
+	defer cancel()
+	if requeue {
+		time.AfterFunc(k8sRequeueDelay, cancel)
+	}
+	query := url.Values{"watch": {"true"}, "resourceVersion": {resourceVersion}}
+	resp, err := c.kube.send(watchCtx, http.MethodGet, c.resourcePath(c.namespace, "")+"?"+query.Encode(), "", nil)
+	if err != nil {
+		if watchCtx.Err() == nil {
+			slog.Error("error watching FloxSites", "error", err)
+		}
+		return
+	}
+	defer resp.Body.Close()
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var event struct {
+			Type   string          `json:"type"`
+			Object json.RawMessage `json:"object"`
+		}
+		if err := dec.Decode(&event); err != nil {
+			if watchCtx.Err() == nil && !errors.Is(err, io.EOF) {
+				slog.Error("error watching FloxSites", "error", err)
+			}
+			return
+		}
+		switch event.Type {
+		case "ADDED", "MODIFIED":
+			var fs floxSite
+			if err := json.Unmarshal(event.Object, &fs); err != nil {
+				slog.Error("error decoding FloxSite", "error", err)
+				continue
+			}
+			if c.reconcile(ctx, &fs) && !requeue {
+				requeue = true
+				time.AfterFunc(k8sRequeueDelay, cancel)
+			}
+		case "ERROR":
+			// Mostly 410 Gone: the resource version is too old to watch
+			// from, so the resources are listed again.
+			return
+		}
+	}
+}
+
+// reconcile brings the site of a resource in line with it and writes the
+// outcome into its status. It reports whether to look at it again soon.
+func (c *k8sController) reconcile(ctx context.Context, fs *floxSite) bool {
+	ctx, cancel := context.WithTimeout(ctx, k8sReconcileTimeout)
+	defer cancel()
+	log := slog.With("floxsite", fs.Metadata.Namespace+"/"+fs.Metadata.Name)
+
+	var st floxSiteStatus
+	var err error
+	if fs.Metadata.DeletionTimestamp != nil {
+		var gone bool
+		st, gone, err = c.finalize(ctx, fs)
+		if gone {
+			log.Info("FloxSite deleted", "site", fs.Status.SiteName, "deletionPolicy", cmp.Or(fs.Spec.DeletionPolicy, "Delete"))
+			return false
+		}
+	} else if err = c.addFinalizer(ctx, fs); err == nil {
+		st, err = c.sync(ctx, fs)
+	}
+	if err != nil {
+		// The backend or Kubernetes is unavailable; the status stays.
+		log.Error("error reconciling FloxSite", "error", err)
+		return true
+	}
+	if st.Phase != fs.Status.Phase || st.Message != fs.Status.Message {
+		log.Info("FloxSite "+strings.ToLower(st.Phase), "site", st.SiteName, "reason", st.Reason, "message", st.Message)
+	}
+	if err := c.writeStatus(ctx, fs, st); err != nil {
+		log.Error("error writing FloxSite status", "error", err)
+		return true
+	}
+	return st.Phase == floxSiteProvisioning || st.Phase == floxSiteDeleting
+}
+
+// sync creates or updates the site of a resource and returns its status.
+func (c *k8sController) sync(ctx context.Context, fs *floxSite) (floxSiteStatus, error) {
+	st := fs.Status
+	st.ObservedGeneration = fs.Metadata.Generation
+	if st.Phase == floxSiteFailed && fs.Status.ObservedGeneration == fs.Metadata.Generation {
+		return st, nil
+	}
+	siteName := cmp.Or(fs.Spec.SiteName, fs.Metadata.Name)
+	if st.SiteName != "" && st.SiteName != siteName {
+		return st.with(floxSiteFailed, "SiteNameChanged", "spec.siteName cannot change, the resource manages "+st.SiteName), nil
+	}
+
+	if st.Phase == floxSiteProvisioning && st.JobID != "" {
+		var job jobView
+		err := c.flox.request(ctx, http.MethodGet, "/jobs/"+url.PathEscape(st.JobID), nil, nil, &job)
+		switch {
+		case floxAPIStatus(err) == http.StatusNotFound:
+			// The backend restarted and forgot the job; the site tells.
+		case err != nil:
+			return st.failure(err)
+		case job.Status == jobRunning:
+			return st.with(floxSiteProvisioning, "Provisioning", "Creating the site"), nil
+		case job.Status == jobFailed:
+			st.SiteName = ""
+			return st.with(floxSiteFailed, reasonOf(job.Error.Code), job.Error.Message), nil
+		case job.Result != nil:
+			st.URL = job.Result.SiteURL
+		}
+	}
+
+	if st.SiteName != "" || fs.Spec.Adopt {
+		var site struct {
+			Description    string   `json:"description"`
+			Style          string   `json:"style"`
+			InitialContent []string `json:"initialContent"`
+		}
+		err := c.flox.request(ctx, http.MethodGet, "/sites/"+url.PathEscape(siteName), nil, nil, &site)
+		switch {
+		case floxAPIStatus(err) == http.StatusNotFound:
+			// Deleted outside Kubernetes: it is created again.
+			st.SiteName = ""
+		case err != nil:
+			return st.failure(err)
+		default:
+			st.SiteName = siteName
+			var req siteUpdateRequest
+			if d := fs.Spec.Description; d != nil && strings.TrimSpace(*d) != site.Description {
+				req.Description = d
+			}
+			if s := fs.Spec.Style; s != nil && *s != site.Style {
+				req.Style = s
+			}
+			if fs.Spec.Sections != nil && !slices.Equal(fs.Spec.Sections, site.InitialContent) {
+				req.InitialContent = &fs.Spec.Sections
+			}
+			if req.Description != nil || req.Style != nil || req.InitialContent != nil {
+				if err := c.flox.request(ctx, http.MethodPatch, "/sites/"+url.PathEscape(siteName), nil, req, nil); err != nil {
+					return st.failure(err)
+				}
+			}
+			return st.with(floxSiteReady, "SiteReady", ""), nil
+		}
+	}
+
+	// A retry of a creation whose status was not written gets the same
+	// key and so the same job; a new attempt, after a failed job or the
+	// site's deletion, a new one.
+	req := siteCreationRequest{SiteName: siteName, InitialContent: fs.Spec.Sections, Email: fs.Spec.Email}
+	if fs.Spec.Description != nil {
+		req.Description = *fs.Spec.Description
+	}
+	if fs.Spec.Style != nil {
+		req.Style = *fs.Spec.Style
+	}
+	header := http.Header{
+		"Prefer":             {"respond-async"},
+		idempotencyKeyHeader: {fmt.Sprintf("%s/%d/%s", fs.Metadata.UID, fs.Metadata.Generation, st.JobID)},
+	}
+	var body json.RawMessage
+	if err := c.flox.request(ctx, http.MethodPost, "/sites", header, req, &body); err != nil {
+		return st.failure(err)
+	}
+	// Invalid requests are answered with 200 and success false.
+	var rejected siteCreationResponse
+	if json.Unmarshal(body, &rejected) == nil && rejected.Error != "" {
+		return st.failure(&floxAPIError{Status: http.StatusBadRequest, APIError: APIError{Code: rejected.Code, Message: rejected.Error}})
+	}
+	var job jobView
+	if err := json.Unmarshal(body, &job); err != nil {
+		return st, err
+	}
+	st.SiteName, st.JobID, st.URL = siteName, job.JobID, ""
+	return st.with(floxSiteProvisioning, "Provisioning", "Creating the site"), nil
+}
+
+// finalize deletes the site of a deleted resource, unless its
+// deletionPolicy is Retain, and then lets the resource go.
+func (c *k8sController) finalize(ctx context.Context, fs *floxSite) (st floxSiteStatus, gone bool, err error) {
+	st = fs.Status
+	if !slices.Contains(fs.Metadata.Finalizers, floxSiteFinalizer) {
+		return st, true, nil
+	}
+	if fs.Spec.DeletionPolicy != "Retain" && st.SiteName != "" {
+		if st.Phase == floxSiteProvisioning || st.Phase == floxSiteDeleting {
+			var job jobView
+			err := c.flox.request(ctx, http.MethodGet, "/jobs/"+url.PathEscape(st.JobID), nil, nil, &job)
+			if err == nil && job.Status == jobRunning {
+				return st.with(floxSiteDeleting, "Deleting", "Waiting for the creation to finish"), false, nil
+			}
+		}
+		err := c.flox.request(ctx, http.MethodDelete, "/sites/"+url.PathEscape(st.SiteName), nil, nil, nil)
+		if err != nil && floxAPIStatus(err) != http.StatusNotFound {
+			st, err = st.failure(err)
+			return st, false, err
+		}
+	}
+	finalizers := slices.DeleteFunc(slices.Clone(fs.Metadata.Finalizers), func(f string) bool { return f == floxSiteFinalizer })
+	ops := []jsonPatchOp{
+		{Op: "test", Path: "/metadata/resourceVersion", Value: fs.Metadata.ResourceVersion},
+		{Op: "replace", Path: "/metadata/finalizers", Value: finalizers},
+	}
+	if err := c.kube.request(ctx, http.MethodPatch, c.resourcePath(fs.Metadata.Namespace, fs.Metadata.Name), jsonPatchType, ops, nil); err != nil {
+		return st, false, err
+	}
+	return st, true, nil
+}
+
+// addFinalizer makes Kubernetes wait for the controller to delete the
+// site before it deletes the resource.
+func (c *k8sController) addFinalizer(ctx context.Context, fs *floxSite) error {
+	if slices.Contains(fs.Metadata.Finalizers, floxSiteFinalizer) {
+		return nil
+	}
+	ops := []jsonPatchOp{{Op: "test", Path: "/metadata/resourceVersion", Value: fs.Metadata.ResourceVersion}}
+	if len(fs.Metadata.Finalizers) == 0 {
+		ops = append(ops, jsonPatchOp{Op: "add", Path: "/metadata/finalizers", Value: []string{floxSiteFinalizer}})
+	} else {
+		ops = append(ops, jsonPatchOp{Op: "add", Path: "/metadata/finalizers/-", Value: floxSiteFinalizer})
+	}
+	return c.kube.request(ctx, http.MethodPatch, c.resourcePath(fs.Metadata.Namespace, fs.Metadata.Name), jsonPatchType, ops, fs)
+}
+
+// writeStatus replaces the status of a resource, if it changed.
+func (c *k8sController) writeStatus(ctx context.Context, fs *floxSite, st floxSiteStatus) error {
+	st.Phase = cmp.Or(st.Phase, floxSitePending)
+	st.setReadyCondition(fs.Status)
+	before, _ := json.Marshal(fs.Status)
+	after, err := json.Marshal(st)
+	if err != nil || bytes.Equal(before, after) {
+		return err
+	}
+	ops := []jsonPatchOp{{Op: "add", Path: "/status", Value: st}}
+	return c.kube.request(ctx, http.MethodPatch, c.resourcePath(fs.Metadata.Namespace, fs.Metadata.Name)+"/status", jsonPatchType, ops, nil)
+}
+
+// --- Command ---
+
+var k8sControllerCommand = command{
+	usage: "k8s-controller [--api URL] [--namespace NS] [--kube-api URL] [--resync DURATION]",
+	flags: func(fs *pflag.FlagSet) {
+		fs.StringVar(&k8sOptions.apiURL, "api", "", "Base URL of the backend (default http://localhost:<server.port>)")
+		fs.StringVar(&k8sOptions.namespace, "namespace", "", "Namespace of the FloxSites to manage (default all)")
+		fs.StringVar(&k8sOptions.kubeAPI, "kube-api", "", "Kubernetes API server without authentication, e.g. kubectl proxy (default the cluster of the pod)")
+		fs.DurationVar(&k8sOptions.resync, "resync", 5*time.Minute, "How often all FloxSites are reconciled")
+	},
+	run: func(args []string) error {
+		if k8sOptions.resync < k8sRequeueDelay {
+			return fmt.Errorf("--resync must be at least %s", k8sRequeueDelay)
+		}
+		return runK8sController()
+	},
+}
+
+var k8sOptions struct {
+	apiURL    string
+	namespace string
+	kubeAPI   string
+	resync    time.Duration
+}
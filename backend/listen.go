@@ -0,0 +1,200 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// The API listens on TCP (server.listen_address and server.port) unless
+// server.listen names a Unix domain socket, e.g. unix:///run/flox/backend.sock
+// for a reverse proxy on the same host. The socket file gets
+// server.socket_mode and, if set, server.socket_group, so the proxy's user
+// can connect without the socket being open to everyone. A socket file left
+// behind by a crashed process is replaced; one another process still
+// listens on is not.
+//
+// Started by a systemd socket unit, the API uses the socket systemd passes
+// (LISTEN_FDS) and ignores those settings. systemd keeps that socket open
+// while the service restarts, and on SIGTERM the API finishes the requests
+// it has before exiting, so a restart refuses no connection.
+
+const unixListenPrefix = "unix://"
+
+// systemdListenFDsStart is the first descriptor passed by systemd.
+const systemdListenFDsStart = 3
+
+// shutdownTimeout is how long running requests may take after SIGTERM.
+const shutdownTimeout = 30 * time.Second
+
+// unixSocketPath returns the socket of server.listen, "" for TCP.
+func unixSocketPath(c *Config) string {
+	return strings.TrimPrefix(c.Server.Listen, unixListenPrefix)
+}
+
+// validateListen checks the listener settings of a config.
+func validateListen(c *Config) error {
+	if c.Server.Listen == "" {
+		return nil
+	}
+	path := unixSocketPath(c)
+	if !strings.HasPrefix(c.Server.Listen, unixListenPrefix) || !filepath.IsAbs(path) {
+		return fmt.Errorf("server.listen must be unix:// with an absolute path, e.g. unix:///run/flox/backend.sock, not %q", c.Server.Listen)
+	}
+	if _, err := parseSocketMode(c.Server.SocketMode); err != nil {
+		return err
+	}
+	if c.Server.HTTP3 {
+		return errors.New("server.http3 needs a TCP listener, not server.listen")
+	}
+	if c.Server.TLS.AutocertHost != "" {
+		return errors.New("server.tls.autocert_host needs a TCP listener on port 443, not server.listen")
+	}
+	return nil
+}
+
+func parseSocketMode(s string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, fmt.Errorf("server.socket_mode must be octal permissions like 0660, not %q", s)
+	}
+	return os.FileMode(mode), nil
+}
+
+// listenAPI opens the listener of the API.
+func listenAPI() (net.Listener, error) {
+	if ln, err := systemdListener(); ln != nil || err != nil {
+		return ln, err
+	}
+	if path := unixSocketPath(&config); path != "" {
+		return listenUnix(path)
+	}
+	host := cmp.Or(config.Server.ListenAddress, "127.0.0.1")
+	// Port 0 lets the OS pick a free port
+	return net.Listen("tcp", net.JoinHostPort(host, fmt.Sprint(port)))
+}
+
+// listenUnix listens on the socket path with the configured permissions.
+func listenUnix(path string) (net.Listener, error) {
+	mode, err := parseSocketMode(config.Server.SocketMode)
+	if err != nil {
+		return nil, err
+	}
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := setSocketPermissions(path, mode, config.Server.SocketGroup); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+// removeStaleSocket removes a socket file nobody listens on.
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+	conn, err := net.Dial("unix", path)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("%s is in use by another process", path)
+	}
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		return err
+	}
+	return os.Remove(path)
+}
+
+func setSocketPermissions(path string, mode os.FileMode, group string) error {
+	if group != "" {
+		g, err := user.LookupGroup(group)
+		if err != nil {
+			return fmt.Errorf("server.socket_group: %w", err)
+		}
+		gid, err := strconv.Atoi(g.Gid)
+		if err != nil {
+			return fmt.Errorf("server.socket_group: %w", err)
+		}
+		if err := os.Chown(path, -1, gid); err != nil {
+			return err
+		}
+	}
+	return os.Chmod(path, mode)
+}
+
+// systemdListener returns the socket passed by systemd socket activation,
+// nil if the process was not socket-activated.
+func systemdListener() (net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	fds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || fds < 1 {
+		return nil, nil
+	}
+	// Commands and hooks started later must not take the socket for theirs.
+	for _, name := range []string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+		os.Unsetenv(name)
+	}
+	if fds > 1 {
+		slog.Warn("systemd passed more than one socket, using the first", "sockets", fds)
+	}
+	for fd := systemdListenFDsStart + 1; fd < systemdListenFDsStart+fds; fd++ {
+		syscall.CloseOnExec(fd)
+	}
+	f := os.NewFile(uintptr(systemdListenFDsStart), "systemd socket")
+	defer f.Close()
+	ln, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("socket passed by systemd: %w", err)
+	}
+	slog.Info("Using the socket passed by systemd", "addr", ln.Addr())
+	return ln, nil
+}
+
+// shutdownOnSignal stops server gracefully on SIGTERM or SIGINT and closes
+// the returned channel once the running requests are done.
+func shutdownOnSignal(server *http.Server) <-chan struct{} {
+	done := make(chan struct{})
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		defer close(done)
+		<-ctx.Done()
+		stop()
+		slog.Info("Shutting down, finishing running requests", "timeout", shutdownTimeout)
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			slog.Error("error shutting down, requests were cut off", "error", err)
+		}
+	}()
+	return done
+}
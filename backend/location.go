@@ -0,0 +1,319 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	geocodeCacheFile = ".geocode-cache.json" // in the sites base dir
+	staticMapFile    = "location-map.png"    // below the public dir
+)
+
+var errAddressNotFound = errors.New("address not found")
+
+// Location is the address shown by the location section. Coordinates come
+// from geocoding the address unless they were entered manually.
+type Location struct {
+	Address     string    `json:"address"`
+	Latitude    float64   `json:"latitude"`
+	Longitude   float64   `json:"longitude"`
+	DisplayName string    `json:"displayName,omitempty"` // address as returned by the geocoder
+	Provider    string    `json:"provider,omitempty"`    // geocoder used, empty for manual coordinates
+	GeocodedAt  time.Time `json:"geocodedAt"`
+	// "embed" (OpenStreetMap iframe, default) or "static" (image rendered at
+	// build time, needs geocoding.google_api_key)
+	MapStyle string `json:"mapStyle,omitempty"`
+}
+
+type locationRequest struct {
+	Address   string   `json:"address"`
+	Latitude  *float64 `json:"latitude,omitempty"`
+	Longitude *float64 `json:"longitude,omitempty"`
+	MapStyle  string   `json:"mapStyle,omitempty"`
+}
+
+type geocodeResult struct {
+	Latitude    float64   `json:"latitude"`
+	Longitude   float64   `json:"longitude"`
+	DisplayName string    `json:"displayName"`
+	Provider    string    `json:"provider"`
+	CachedAt    time.Time `json:"cachedAt"`
+}
+
+var (
+	// geocodeMu guards the cache and spaces out requests to the geocoder;
+	// Nominatim allows at most one request per second.
+	geocodeMu          sync.Mutex
+	geocodeCache       map[string]geocodeResult
+	lastGeocodeRequest time.Time
+)
+
+func geocodeCacheKey(address string) string {
+	return config.Geocoding.Provider + ":" + strings.ToLower(strings.Join(strings.Fields(address), " "))
+}
+
+func loadGeocodeCache() map[string]geocodeResult {
+	if geocodeCache != nil {
+		return geocodeCache
+	}
+	geocodeCache = map[string]geocodeResult{}
+	data, err := os.ReadFile(filepath.Join(sitesBaseDir, geocodeCacheFile))
+	if err == nil {
+		if err := json.Unmarshal(data, &geocodeCache); err != nil {
+			slog.Error("error reading geocode cache, starting empty", "error", err)
+		}
+	}
+	return geocodeCache
+}
+
+func saveGeocodeCache() error {
+	return writeJSONAtomic(filepath.Join(sitesBaseDir, geocodeCacheFile), geocodeCache, 0644)
+}
+
+// geocode resolves an address to coordinates. Results are cached on disk for
+// geocoding.cache_ttl and requests are rate limited to one per
+// geocoding.min_interval.
+func geocode(address string, now time.Time) (geocodeResult, error) {
+	geocodeMu.Lock()
+	defer geocodeMu.Unlock()
+
+	key := geocodeCacheKey(address)
+	cache := loadGeocodeCache()
+	if cached, ok := cache[key]; ok && now.Sub(cached.CachedAt) < config.Geocoding.CacheTTL {
+		return cached, nil
+	}
+
+	if wait := config.Geocoding.MinInterval - time.Since(lastGeocodeRequest); wait > 0 {
+		time.Sleep(wait)
+	}
+	lastGeocodeRequest = time.Now()
+
+	var result geocodeResult
+	var err error
+	switch config.Geocoding.Provider {
+	case "google":
+		result, err = geocodeGoogle(address)
+	case "nominatim":
+		result, err = geocodeNominatim(address)
+	default:
+		err = fmt.Errorf("unknown geocoding provider %q", config.Geocoding.Provider)
+	}
+	if err != nil {
+		return geocodeResult{}, err
+	}
+	result.Provider = config.Geocoding.Provider
+	result.CachedAt = now
+	cache[key] = result
+	if err := saveGeocodeCache(); err != nil {
+		slog.Error("error writing geocode cache", "error", err)
+	}
+	return result, nil
+}
+
+func geocodeGetJSON(rawURL string, out any) error {
+	req, err := http.NewRequest(http.MethodGet, rawURL, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %v", err)
+	}
+	// Nominatim's usage policy requires an identifying user agent.
+	req.Header.Set("User-Agent", config.Geocoding.UserAgent)
+	req.Header.Set("Accept", "application/json")
+	client := http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("HTTP request to %s failed", req.URL.Host)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code from %s: %d", req.URL.Host, resp.StatusCode)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(out)
+}
+
+func geocodeNominatim(address string) (geocodeResult, error) {
+	var results []struct {
+		Lat         string `json:"lat"`
+		Lon         string `json:"lon"`
+		DisplayName string `json:"display_name"`
+	}
+	q := url.Values{"q": {address}, "format": {"jsonv2"}, "limit": {"1"}}
+	if err := geocodeGetJSON(strings.TrimSuffix(config.Geocoding.NominatimURL, "/")+"/search?"+q.Encode(), &results); err != nil {
+		return geocodeResult{}, err
+	}
+	if len(results) == 0 {
+		return geocodeResult{}, errAddressNotFound
+	}
+	lat, err1 := strconv.ParseFloat(results[0].Lat, 64)
+	lon, err2 := strconv.ParseFloat(results[0].Lon, 64)
+	if err1 != nil || err2 != nil {
+		return geocodeResult{}, errors.New("invalid coordinates in geocoder response")
+	}
+	return geocodeResult{Latitude: lat, Longitude: lon, DisplayName: results[0].DisplayName}, nil
+}
+
+func geocodeGoogle(address string) (geocodeResult, error) {
+	if config.Geocoding.GoogleAPIKey == "" {
+		return geocodeResult{}, errors.New("geocoding.google_api_key is not configured")
+	}
+	var response struct {
+		Status  string `json:"status"`
+		Results []struct {
+			FormattedAddress string `json:"formatted_address"`
+			Geometry         struct {
+				Location struct {
+					Lat float64 `json:"lat"`
+					Lng float64 `json:"lng"`
+				} `json:"location"`
+			} `json:"geometry"`
+		} `json:"results"`
+	}
+	q := url.Values{"address": {address}, "key": {config.Geocoding.GoogleAPIKey}}
+	if err := geocodeGetJSON("https://maps.googleapis.com/maps/api/geocode/json?"+q.Encode(), &response); err != nil {
+		return geocodeResult{}, err
+	}
+	switch {
+	case response.Status == "ZERO_RESULTS" || (response.Status == "OK" && len(response.Results) == 0):
+		return geocodeResult{}, errAddressNotFound
+	case response.Status != "OK":
+		return geocodeResult{}, fmt.Errorf("geocoding failed: %s", response.Status)
+	}
+	r := response.Results[0]
+	return geocodeResult{Latitude: r.Geometry.Location.Lat, Longitude: r.Geometry.Location.Lng, DisplayName: r.FormattedAddress}, nil
+}
+
+// --- Build output ---
+
+type locationView struct {
+	Location
+	EmbedURL  string // OpenStreetMap iframe
+	StaticMap string // path of the rendered image below the public dir
+	MapURL    string // link to the full map
+}
+
+func newLocationView(loc Location) locationView {
+	lat, lon := loc.Latitude, loc.Longitude
+	const d = 0.005 // roughly street level
+	bbox := fmt.Sprintf("%f,%f,%f,%f", lon-d, lat-d, lon+d, lat+d)
+	return locationView{
+		Location: loc,
+		EmbedURL: "https://www.openstreetmap.org/export/embed.html?" + url.Values{
+			"bbox": {bbox}, "layer": {"mapnik"}, "marker": {fmt.Sprintf("%f,%f", lat, lon)},
+		}.Encode(),
+		MapURL: fmt.Sprintf("https://www.openstreetmap.org/?mlat=%f&mlon=%f#map=17/%f/%f", lat, lon, lat, lon),
+	}
+}
+
+// renderStaticMap fetches a map image once per location so the API key stays
+// on the server. The image is removed whenever the location changes.
+func renderStaticMap(loc Location, publicDir string) error {
+	path := filepath.Join(publicDir, staticMapFile)
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+	if config.Geocoding.GoogleAPIKey == "" {
+		return errors.New("static maps need geocoding.google_api_key")
+	}
+	center := fmt.Sprintf("%f,%f", loc.Latitude, loc.Longitude)
+	q := url.Values{
+		"center":  {center},
+		"zoom":    {"16"},
+		"size":    {"640x320"},
+		"markers": {center},
+		"key":     {config.Geocoding.GoogleAPIKey},
+	}
+	client := http.Client{Timeout: 15 * time.Second}
+	resp, err := client.Get("https://maps.googleapis.com/maps/api/staticmap?" + q.Encode())
+	if err != nil {
+		return errors.New("static map request failed")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("static map request failed: unexpected status code: %d", resp.StatusCode)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 5<<20))
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data, 0644)
+}
+
+// --- Handlers ---
+
+func putLocationHandler(w http.ResponseWriter, r *http.Request) {
+	siteName, ok := siteNameFromPath(w, r)
+	if !ok {
+		return
+	}
+	var req locationRequest
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON request", http.StatusBadRequest)
+		return
+	}
+	req.Address = strings.TrimSpace(req.Address)
+	if req.Address == "" || len(req.Address) > 300 {
+		http.Error(w, "address must be 1-300 characters", http.StatusBadRequest)
+		return
+	}
+	if req.MapStyle != "" && req.MapStyle != "embed" && req.MapStyle != "static" {
+		http.Error(w, `mapStyle must be "embed" or "static"`, http.StatusBadRequest)
+		return
+	}
+	if (req.Latitude == nil) != (req.Longitude == nil) {
+		http.Error(w, "latitude and longitude must be given together", http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now().UTC()
+	loc := Location{Address: req.Address, MapStyle: req.MapStyle, GeocodedAt: now}
+	if req.Latitude != nil {
+		if *req.Latitude < -90 || *req.Latitude > 90 || *req.Longitude < -180 || *req.Longitude > 180 {
+			http.Error(w, "coordinates out of range", http.StatusBadRequest)
+			return
+		}
+		loc.Latitude, loc.Longitude = *req.Latitude, *req.Longitude
+	} else {
+		result, err := geocode(req.Address, now)
+		if errors.Is(err, errAddressNotFound) {
+			http.Error(w, "Address could not be found, please check it or enter coordinates", http.StatusUnprocessableEntity)
+			return
+		}
+		if err != nil {
+			slog.ErrorContext(r.Context(), "error geocoding address", "site", siteName, "error", err)
+			http.Error(w, "Geocoding is currently unavailable", http.StatusBadGateway)
+			return
+		}
+		loc.Latitude, loc.Longitude = result.Latitude, result.Longitude
+		loc.DisplayName, loc.Provider = result.DisplayName, result.Provider
+	}
+
+	if _, err := updateSiteConfig(siteName, func(siteConfig *SiteConfig) error {
+		siteConfig.Location = &loc
+		return nil
+	}); err != nil {
+		writeSiteUpdateError(w, r, siteName, err)
+		return
+	}
+	mapPath := filepath.Join(sitesBaseDir, siteName, sitePublicDir, staticMapFile)
+	if err := os.Remove(mapPath); err != nil && !os.IsNotExist(err) {
+		slog.ErrorContext(r.Context(), "error removing static map", "site", siteName, "error", err)
+	}
+	recordSiteEvent(siteName, SiteEvent{Type: "location.updated", Message: loc.Address})
+
+	if _, err := buildSite(siteName); err != nil {
+		slog.ErrorContext(r.Context(), "error building site", "site", siteName, "error", err)
+	}
+	respondJSON(w, loc)
+}
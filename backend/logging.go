@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"time"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// Everything is logged with log/slog, as text or JSON lines (logging.format)
+// from logging.level up. Records logged with the context of an API request
+// carry its ID, method, path and, once the handler resolved it, site name;
+// every request also ends with one "request" record with status and
+// duration.
+// Errors are copied to logging.error_file. Lines of the log package (from
+// libraries) end up in the same handler as info records.
+
+// logLevel is logging.level, which can be reloaded.
+var logLevel slog.LevelVar
+
+var logLevels = map[string]slog.Level{
+	"debug": slog.LevelDebug,
+	"info":  slog.LevelInfo,
+	"warn":  slog.LevelWarn,
+	"error": slog.LevelError,
+}
+
+func validateLogging(c *Config) error {
+	if f := c.Logging.Format; f != "text" && f != "json" {
+		return fmt.Errorf("logging.format must be text or json, not %q", f)
+	}
+	if _, ok := logLevels[c.Logging.Level]; !ok {
+		return fmt.Errorf("logging.level must be debug, info, warn or error, not %q", c.Logging.Level)
+	}
+	return nil
+}
+
+func newRotatingLog(path string) *lumberjack.Logger {
+	return &lumberjack.Logger{
+		Filename:   path,
+		MaxSize:    config.Logging.MaxSize,
+		MaxBackups: config.Logging.MaxBackups,
+		MaxAge:     config.Logging.MaxAge,
+		Compress:   config.Logging.Compress,
+		LocalTime:  true,
+	}
+}
+
+func newLogHandler(w io.Writer, level slog.Leveler) slog.Handler {
+	opts := &slog.HandlerOptions{Level: level}
+	if config.Logging.Format == "json" {
+		return slog.NewJSONHandler(w, opts)
+	}
+	return slog.NewTextHandler(w, opts)
+}
+
+// setupLogging installs the slog handler: to stderr, or to the configured
+// files (rotated by size and additionally every logging.rotate_interval)
+// and to stdout unless that is turned off.
+func setupLogging() {
+	logLevel.Set(logLevels[config.Logging.Level])
+	level := &logLevel
+	var files []*lumberjack.Logger
+	var handlers []slog.Handler
+	if config.Logging.File == "" && config.Logging.ErrorFile == "" {
+		handlers = append(handlers, newLogHandler(os.Stderr, level))
+	} else {
+		var outputs []io.Writer
+		if config.Logging.Stdout {
+			outputs = append(outputs, os.Stdout)
+		}
+		if config.Logging.File != "" {
+			f := newRotatingLog(config.Logging.File)
+			files = append(files, f)
+			outputs = append(outputs, f)
+		}
+		if len(outputs) > 0 {
+			handlers = append(handlers, newLogHandler(io.MultiWriter(outputs...), level))
+		}
+		if config.Logging.ErrorFile != "" {
+			f := newRotatingLog(config.Logging.ErrorFile)
+			files = append(files, f)
+			handlers = append(handlers, newLogHandler(f, slog.LevelError))
+		}
+	}
+	slog.SetDefault(slog.New(requestLogHandler{multiLogHandler(handlers)}))
+
+	if interval := config.Logging.RotateInterval; interval > 0 {
+		go func() {
+			for range time.Tick(interval) {
+				for _, f := range files {
+					if err := f.Rotate(); err != nil {
+						slog.Error("error rotating log file", "file", f.Filename, "error", err)
+					}
+				}
+			}
+		}()
+	}
+}
+
+// fatal logs an error and exits.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// multiLogHandler passes records to every handler that takes their level.
+type multiLogHandler []slog.Handler
+
+func (m multiLogHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	for _, h := range m {
+		if h.Enabled(ctx, level) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m multiLogHandler) Handle(ctx context.Context, r slog.Record) error {
+	var errs []error
+	for _, h := range m {
+		if h.Enabled(ctx, r.Level) {
+			// Losing a copy is better than failing the others.
+			errs = append(errs, h.Handle(ctx, r.Clone()))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (m multiLogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	handlers := make(multiLogHandler, len(m))
+	for i, h := range m {
+		handlers[i] = h.WithAttrs(attrs)
+	}
+	return handlers
+}
+
+func (m multiLogHandler) WithGroup(name string) slog.Handler {
+	handlers := make(multiLogHandler, len(m))
+	for i, h := range m {
+		handlers[i] = h.WithGroup(name)
+	}
+	return handlers
+}
+
+// --- Request fields ---
+
+type requestLogKey struct{}
+
+// requestIDHeader carries the ID of a request. One sent by the client (or a
+// proxy in front) is kept if it is usable, otherwise one is generated. It is
+// sent back with every response, errors included, and forwarded to the DNS
+// provider API, see dnsDo.
+const requestIDHeader = "X-Request-ID"
+
+var requestIDRegex = regexp.MustCompile(`^[A-Za-z0-9._:+/=-]{1,128}$`)
+
+func requestIDFor(r *http.Request) string {
+	if id := r.Header.Get(requestIDHeader); requestIDRegex.MatchString(id) {
+		return id
+	}
+	return newID() + newID()
+}
+
+// requestLog holds the fields of an API request for its records. The site
+// is filled in by siteNameFromPath, the trace by tracingMiddleware.
+type requestLog struct {
+	id           string
+	method, path string
+	remote       string
+	site         string
+	traceID      string
+}
+
+// attrs returns the fields; the site only if the record does not name one.
+func (l *requestLog) attrs(r slog.Record) []slog.Attr {
+	attrs := []slog.Attr{slog.String("request_id", l.id), slog.String("method", l.method), slog.String("path", l.path)}
+	if l.traceID != "" {
+		attrs = append(attrs, slog.String("trace_id", l.traceID))
+	}
+	if l.site == "" {
+		return attrs
+	}
+	hasSite := false
+	r.Attrs(func(a slog.Attr) bool {
+		hasSite = a.Key == "site"
+		return !hasSite
+	})
+	if !hasSite {
+		attrs = append(attrs, slog.String("site", l.site))
+	}
+	return attrs
+}
+
+func requestLogFrom(ctx context.Context) *requestLog {
+	l, _ := ctx.Value(requestLogKey{}).(*requestLog)
+	return l
+}
+
+// requestIDFrom returns the ID of the API request of ctx, "" outside one.
+func requestIDFrom(ctx context.Context) string {
+	if l := requestLogFrom(ctx); l != nil {
+		return l.id
+	}
+	return ""
+}
+
+// setRequestSite adds the site name to the records of the request.
+func setRequestSite(r *http.Request, siteName string) {
+	if l := requestLogFrom(r.Context()); l != nil {
+		l.site = siteName
+	}
+}
+
+// requestLogHandler adds the request fields of the context to records.
+type requestLogHandler struct {
+	slog.Handler
+}
+
+func (h requestLogHandler) Handle(ctx context.Context, r slog.Record) error {
+	if l := requestLogFrom(ctx); l != nil {
+		r.AddAttrs(l.attrs(r)...)
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h requestLogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return requestLogHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h requestLogHandler) WithGroup(name string) slog.Handler {
+	return requestLogHandler{h.Handler.WithGroup(name)}
+}
+
+// loggingMiddleware sets up the request ID and fields and logs every request
+// when it is done, server errors at level error.
+func loggingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		l := &requestLog{id: requestIDFor(r), method: r.Method, path: r.URL.Path, remote: clientIP(r)}
+		w.Header().Set(requestIDHeader, l.id)
+		r = r.WithContext(context.WithValue(r.Context(), requestLogKey{}, l))
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+
+		status := max(rec.status, http.StatusOK)
+		level := slog.LevelInfo
+		if status >= http.StatusInternalServerError {
+			level = slog.LevelError
+		}
+		slog.LogAttrs(r.Context(), level, "request",
+			slog.Int("status", status),
+			slog.Duration("duration", time.Since(start)),
+			slog.String("remote", l.remote),
+		)
+	})
+}
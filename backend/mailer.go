@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sendEmail sends a plain text email via the configured SMTP server. If no
+// server is configured the message is only logged, which keeps development
+// setups working without a mail relay.
+func sendEmail(to, subject, body string) error {
+	if config.Email.SMTPHost == "" {
+		slog.Info("email not configured, not sending", "subject", subject, "to", to)
+		return nil
+	}
+	if strings.ContainsAny(to, "\r\n") || strings.ContainsAny(subject, "\r\n") {
+		return fmt.Errorf("invalid email header value")
+	}
+
+	from := config.Email.From
+	msg := strings.Join([]string{
+		"From: " + from,
+		"To: " + to,
+		"Subject: " + subject,
+		"Date: " + time.Now().Format(time.RFC1123Z),
+		"MIME-Version: 1.0",
+		"Content-Type: text/plain; charset=utf-8",
+		"",
+		body,
+	}, "\r\n")
+
+	addr := net.JoinHostPort(config.Email.SMTPHost, strconv.Itoa(config.Email.SMTPPort))
+	var auth smtp.Auth
+	if config.Email.Username != "" {
+		auth = smtp.PlainAuth("", config.Email.Username, config.Email.Password, config.Email.SMTPHost)
+	}
+	if err := smtp.SendMail(addr, auth, from, []string{to}, []byte(msg)); err != nil {
+		return fmt.Errorf("failed to send email to %s: %v", to, err)
+	}
+	return nil
+}
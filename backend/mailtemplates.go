@@ -0,0 +1,440 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"text/template"
+)
+
+// Email templates: every mail the backend sends is rendered from one of
+// emailTemplates, a Go text/template for the subject and one for the body
+// with a fixed set of variables. The built-in text can be replaced without a
+// deploy by a file <paths.template_dir>/email/<name>.txt:
+//
+//	Subject: Your site {{.SiteName}} is online
+//
+//	Hello, ...
+//
+// Files are read at every send, so an edit applies to the next mail. A file
+// that does not parse or uses a variable the template does not have is
+// logged and the built-in text is sent instead, so a typo loses no mail.
+// Admins can list the templates, preview a file or a draft with example or
+// given values and send a test mail through /api/v1/admin/email-templates.
+
+const emailTemplateDir = "email" // in paths.template_dir
+
+// templateVar is a variable of an email template.
+type templateVar struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Example     string `json:"example"`
+}
+
+type emailTemplate struct {
+	Name        string
+	Description string
+	Subject     string // built-in
+	Body        string // built-in
+	Vars        []templateVar
+}
+
+var emailTemplates = []emailTemplate{
+	{
+		Name:        "verification",
+		Description: "Link to confirm the owner's email, sent at creation with verification.required",
+		Subject:     "Confirm your email to publish {{.SiteName}}",
+		Body:        "Hello,\n\nplease confirm your email address to publish {{.SiteURL}}:\n\n{{.Link}}\n\nThe link is valid until {{.ExpiresAt}}. If you did not create this site, you can ignore this mail.\n",
+		Vars: []templateVar{
+			{"SiteName", "name of the site", "mysite"},
+			{"SiteURL", "URL of the site", "https://mysite.flox.click"},
+			{"Link", "confirmation link", "https://api.flox.click/api/v1/sites/mysite/verify?token=..."},
+			{"ExpiresAt", "end of the link's validity", "Mon, 02 Jan 2006 15:04:05 UTC"},
+		},
+	},
+	{
+		Name:        "provisioned",
+		Description: "The queued DNS record of a site was created, sent to the owner",
+		Subject:     "Your site {{.SiteName}} is online",
+		Body:        "Hello,\n\nyour site is now reachable at {{.SiteURL}}.\n",
+		Vars: []templateVar{
+			{"SiteName", "name of the site", "mysite"},
+			{"SiteURL", "URL of the site", "https://mysite.flox.click"},
+		},
+	},
+	{
+		Name:        "failure",
+		Description: "The queued DNS record of a site could not be created, sent to the owner",
+		Subject:     "Your site {{.SiteName}} could not be published",
+		Body:        "Hello,\n\nthe address {{.SiteURL}} of your site could not be set up: {{.Error}}\n\nPlease get in touch with us, we will look into it.\n",
+		Vars: []templateVar{
+			{"SiteName", "name of the site", "mysite"},
+			{"SiteURL", "URL of the site", "https://mysite.flox.click"},
+			{"Error", "what failed", "The DNS provider rejected the record"},
+		},
+	},
+	{
+		Name:        "booking_confirmation",
+		Description: "Confirmation of an appointment, sent to the visitor who booked it",
+		Subject:     "Your appointment is confirmed",
+		Body:        "Hello {{.Name}},\n\nyour appointment at {{.SiteURL}} on {{.When}} is confirmed.\n",
+		Vars: []templateVar{
+			{"Name", "name of the visitor", "Jane Doe"},
+			{"SiteURL", "URL of the site", "https://mysite.flox.click"},
+			{"When", "start of the appointment in the site's time zone", "Mon, 02 Jan 2006 15:04 CET"},
+		},
+	},
+	{
+		Name:        "booking_notification",
+		Description: "New appointment, sent to the booking notification address of the site",
+		Subject:     "New booking: {{.When}}",
+		Body:        "New booking on {{.SiteName}}:\n\n{{.Name}} <{{.Email}}>\n{{.When}}\n\n{{.Note}}\n",
+		Vars: []templateVar{
+			{"SiteName", "name of the site", "mysite"},
+			{"Name", "name of the visitor", "Jane Doe"},
+			{"Email", "email of the visitor", "jane@example.com"},
+			{"When", "start of the appointment in the site's time zone", "Mon, 02 Jan 2006 15:04 CET"},
+			{"Note", "note of the visitor, may be empty", "First visit"},
+		},
+	},
+	{
+		Name:        "comment_notification",
+		Description: "New blog comment, sent to the comment notification address of the site",
+		Subject:     "New comment on {{.PostTitle}}",
+		Body:        "New comment ({{.Status}}) on {{printf \"%q\" .PostTitle}} by {{.AuthorName}}:\n\n{{.Content}}\n",
+		Vars: []templateVar{
+			{"PostTitle", "title of the blog post", "Hello world"},
+			{"Status", "approved or pending", "pending"},
+			{"AuthorName", "name given by the commenter", "Jane Doe"},
+			{"Content", "text of the comment", "Nice post!"},
+		},
+	},
+	{
+		Name:        "account_deletion_scheduled",
+		Description: "The deletion of an account was requested, sent to the account's email",
+		Subject:     "Your account will be deleted on {{.DeleteAt}}",
+		Body: "Hello,\n\nthe deletion of your account {{.Email}} was requested. On {{.DeleteAt}} it will be deleted together with your sites ({{.Sites}}) and all their data.\n\n" +
+			"Until then you can log in and cancel the deletion. If you did not ask for it, please get in touch with us.\n",
+		Vars: []templateVar{
+			{"Email", "email of the account", "jane@example.com"},
+			{"DeleteAt", "time of the deletion", "Mon, 02 Jan 2006 15:04:05 UTC"},
+			{"Sites", "names of the account's sites, comma-separated, may be empty", "mysite, myblog"},
+		},
+	},
+	{
+		Name:        "account_deleted",
+		Description: "An account was deleted with everything it owned, sent to the account's email",
+		Subject:     "Your account has been deleted",
+		Body:        "Hello,\n\nyour account {{.Email}} has been deleted, together with your sites ({{.Sites}}) and all their data. This is the last mail you get from us.\n",
+		Vars: []templateVar{
+			{"Email", "email of the account", "jane@example.com"},
+			{"Sites", "names of the deleted sites, comma-separated, may be empty", "mysite, myblog"},
+		},
+	},
+	{
+		Name:        "site_suspended",
+		Description: "A site was taken offline for its content, sent to the site's owner email",
+		Subject:     "Your site {{.SiteName}} has been suspended",
+		Body: "Hello,\n\nyour site {{.SiteURL}} has been suspended because its content appears to violate our terms of service, e.g. as phishing or prohibited content. It is not reachable until we have reviewed it.\n\n" +
+			"If you think this is a mistake, please reply to this mail.\n",
+		Vars: []templateVar{
+			{"SiteName", "name of the site", "mysite"},
+			{"SiteURL", "address of the site", "https://mysite.flox.click"},
+		},
+	},
+	{
+		Name:        "moderation_flagged",
+		Description: "The content scanner flagged a site, sent to limits.alert_email",
+		Subject:     "flox: site {{.SiteName}} {{.Effect}}",
+		Body: "The content scan of site {{.SiteName}} found: {{.Findings}} (confidence {{.Confidence}}). The site was {{.Effect}}.\n\n" +
+			"Review it with GET /api/v1/admin/moderation/{{.SiteName}} and approve or suspend it.\n",
+		Vars: []templateVar{
+			{"SiteName", "name of the site", "mysite"},
+			{"Effect", "suspended or queued for review", "queued for review"},
+			{"Confidence", "combined confidence of the findings, 0 to 1", "0.70"},
+			{"Findings", "kinds and matches of the findings", "password_field input type=password, external_form evil.example"},
+		},
+	},
+	{
+		Name:        "creation_limit",
+		Description: "The instance reached limits.site_creations_per_hour, sent to limits.alert_email",
+		Subject:     "flox: site creation limit reached",
+		Body: "Instance {{.Instance}} reached its limit of {{.Limit}} new sites per hour at the creation of {{.SiteName}}.\n\n" +
+			"Further creations are {{.Effect}} until the rate drops. If this is expected, raise limits.site_creations_per_hour; otherwise look for the client creating the sites.\n",
+		Vars: []templateVar{
+			{"Instance", "registry.instance", "flox-1"},
+			{"Limit", "limits.site_creations_per_hour", "100"},
+			{"SiteName", "site whose creation hit the limit", "mysite"},
+			{"Effect", "what happens to further creations", "rejected"},
+		},
+	},
+	{
+		Name:        "disk_alert",
+		Description: "The sites volume is almost full and the API read-only, sent to limits.alert_email",
+		Subject:     "flox: sites volume almost full, API read-only",
+		Body: "The sites volume {{.Dir}} of instance {{.Instance}} is almost full: {{.Shortage}}.\n\n" +
+			"The API is read-only until there is room again: new sites, edits and public submissions are rejected. " +
+			"Free space (old builds, archives, logs) or grow the volume.\n",
+		Vars: []templateVar{
+			{"Dir", "the sites directory", "/var/lib/flox/sites"},
+			{"Instance", "registry.instance", "flox-1"},
+			{"Shortage", "what is short", "3.2% free space"},
+		},
+	},
+}
+
+func findEmailTemplate(name string) (emailTemplate, bool) {
+	i := slices.IndexFunc(emailTemplates, func(t emailTemplate) bool { return t.Name == name })
+	if i < 0 {
+		return emailTemplate{}, false
+	}
+	return emailTemplates[i], true
+}
+
+// path returns the file replacing the built-in text, "" without
+// paths.template_dir.
+func (t emailTemplate) path() string {
+	if config.Paths.TemplateDir == "" {
+		return ""
+	}
+	return filepath.Join(config.Paths.TemplateDir, emailTemplateDir, t.Name+".txt")
+}
+
+// source returns the subject and body of the template's file if there is
+// one, the built-in text otherwise.
+func (t emailTemplate) source() (subject, body string, custom bool, err error) {
+	path := t.path()
+	if path == "" {
+		return t.Subject, t.Body, false, nil
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return t.Subject, t.Body, false, nil
+	}
+	if err != nil {
+		return "", "", true, err
+	}
+	subject, body, err = parseEmailTemplateFile(string(data))
+	return subject, body, true, err
+}
+
+// parseEmailTemplateFile splits a template file into the template of the
+// subject, its first line, and that of the body after the blank line.
+func parseEmailTemplateFile(text string) (subject, body string, err error) {
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	head, body, ok := strings.Cut(text, "\n\n")
+	subject, found := strings.CutPrefix(head, "Subject:")
+	if !ok || !found || strings.Contains(head, "\n") {
+		return "", "", errors.New(`the file must start with a line "Subject: ..." and a blank line`)
+	}
+	return strings.TrimSpace(subject), body, nil
+}
+
+// render executes subject and body with data, which must have exactly the
+// template's variables.
+func (t emailTemplate) render(subject, body string, data map[string]any) (string, string, error) {
+	for key := range data {
+		if !slices.ContainsFunc(t.Vars, func(v templateVar) bool { return v.Name == key }) {
+			return "", "", fmt.Errorf("%s has no variable %s", t.Name, key)
+		}
+	}
+	var out [2]string
+	for i, text := range []string{subject, body} {
+		tmpl, err := template.New(t.Name).Option("missingkey=error").Parse(text)
+		if err != nil {
+			return "", "", err
+		}
+		var b strings.Builder
+		if err := tmpl.Execute(&b, data); err != nil {
+			return "", "", err
+		}
+		out[i] = b.String()
+	}
+	if strings.ContainsAny(out[0], "\r\n") {
+		return "", "", errors.New("the subject must be one line")
+	}
+	return out[0], out[1], nil
+}
+
+// examples returns the example values of the template's variables.
+func (t emailTemplate) examples() map[string]any {
+	data := map[string]any{}
+	for _, v := range t.Vars {
+		data[v.Name] = v.Example
+	}
+	return data
+}
+
+// sendTemplateEmail renders the template name with data and sends it to to.
+func sendTemplateEmail(to, name string, data map[string]any) error {
+	t, ok := findEmailTemplate(name)
+	if !ok {
+		return fmt.Errorf("unknown email template %q", name)
+	}
+	subject, body, custom, err := t.source()
+	if err == nil {
+		subject, body, err = t.render(subject, body, data)
+	}
+	if err != nil && custom {
+		slog.Error("error rendering email template, sending the built-in text", "template", name, "file", t.path(), "error", err)
+		subject, body, err = t.render(t.Subject, t.Body, data)
+	}
+	if err != nil {
+		return err
+	}
+	return sendEmail(to, subject, body)
+}
+
+// --- Handlers ---
+
+type emailTemplateView struct {
+	Name        string        `json:"name"`
+	Description string        `json:"description"`
+	Variables   []templateVar `json:"variables"`
+	File        string        `json:"file,omitempty"`    // replacing the built-in text
+	Custom      bool          `json:"custom"`            // the file exists
+	Subject     string        `json:"subject,omitempty"` // with GET of one template
+	Body        string        `json:"body,omitempty"`
+	Error       string        `json:"error,omitempty"` // of the file
+}
+
+func newEmailTemplateView(t emailTemplate) emailTemplateView {
+	v := emailTemplateView{Name: t.Name, Description: t.Description, Variables: t.Vars, File: t.path()}
+	var err error
+	v.Subject, v.Body, v.Custom, err = t.source()
+	if err == nil {
+		_, _, err = t.render(v.Subject, v.Body, t.examples())
+	}
+	if err != nil {
+		v.Error = err.Error()
+	}
+	return v
+}
+
+// emailTemplateFromPath answers 404 for an unknown template.
+func emailTemplateFromPath(w http.ResponseWriter, r *http.Request) (emailTemplate, bool) {
+	t, ok := findEmailTemplate(r.PathValue("name"))
+	if !ok {
+		http.Error(w, "Email template not found", http.StatusNotFound)
+	}
+	return t, ok
+}
+
+// listEmailTemplatesHandler returns the templates without their text.
+func listEmailTemplatesHandler(w http.ResponseWriter, r *http.Request) {
+	list := make([]emailTemplateView, 0, len(emailTemplates))
+	for _, t := range emailTemplates {
+		v := newEmailTemplateView(t)
+		v.Subject, v.Body = "", ""
+		list = append(list, v)
+	}
+	respondJSON(w, list)
+}
+
+// getEmailTemplateHandler returns a template with the text sent now.
+func getEmailTemplateHandler(w http.ResponseWriter, r *http.Request) {
+	t, ok := emailTemplateFromPath(w, r)
+	if !ok {
+		return
+	}
+	respondJSON(w, newEmailTemplateView(t))
+}
+
+// emailTemplateRequest is the body of preview and test: a draft to render
+// instead of the current text (the content of a template file), and values
+// replacing the examples.
+type emailTemplateRequest struct {
+	Draft string            `json:"draft,omitempty"`
+	Data  map[string]string `json:"data,omitempty"`
+	To    string            `json:"to,omitempty"` // of the test mail
+}
+
+// renderEmailTemplateRequest renders the template for a preview or test,
+// answering 400 if it does not render.
+func renderEmailTemplateRequest(w http.ResponseWriter, r *http.Request, t emailTemplate, req emailTemplateRequest) (subject, body string, ok bool) {
+	data := t.examples()
+	for key, value := range req.Data {
+		data[key] = value
+	}
+	var err error
+	if req.Draft != "" {
+		subject, body, err = parseEmailTemplateFile(req.Draft)
+	} else {
+		subject, body, _, err = t.source()
+	}
+	if err == nil {
+		subject, body, err = t.render(subject, body, data)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return "", "", false
+	}
+	return subject, body, true
+}
+
+func decodeEmailTemplateRequest(w http.ResponseWriter, r *http.Request) (emailTemplateRequest, bool) {
+	var req emailTemplateRequest
+	defer r.Body.Close()
+	if r.ContentLength == 0 {
+		return req, true
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON request", http.StatusBadRequest)
+		return req, false
+	}
+	return req, true
+}
+
+// previewEmailTemplateHandler renders a template, or a draft of it, with
+// the example values or those given.
+func previewEmailTemplateHandler(w http.ResponseWriter, r *http.Request) {
+	t, ok := emailTemplateFromPath(w, r)
+	if !ok {
+		return
+	}
+	req, ok := decodeEmailTemplateRequest(w, r)
+	if !ok {
+		return
+	}
+	subject, body, ok := renderEmailTemplateRequest(w, r, t, req)
+	if !ok {
+		return
+	}
+	respondJSON(w, map[string]string{"subject": subject, "body": body})
+}
+
+// testEmailTemplateHandler sends a preview to an address, with "[Test]"
+// before the subject.
+func testEmailTemplateHandler(w http.ResponseWriter, r *http.Request) {
+	t, ok := emailTemplateFromPath(w, r)
+	if !ok {
+		return
+	}
+	req, ok := decodeEmailTemplateRequest(w, r)
+	if !ok {
+		return
+	}
+	addr, err := mail.ParseAddress(strings.TrimSpace(req.To))
+	if err != nil {
+		http.Error(w, "a valid \"to\" address is required", http.StatusBadRequest)
+		return
+	}
+	subject, body, ok := renderEmailTemplateRequest(w, r, t, req)
+	if !ok {
+		return
+	}
+	subject = "[Test] " + subject
+	if err := sendEmail(addr.Address, subject, body); err != nil {
+		slog.ErrorContext(r.Context(), "error sending test email", "template", t.Name, "error", err)
+		http.Error(w, "The test mail could not be sent", http.StatusBadGateway)
+		return
+	}
+	respondJSON(w, map[string]any{"to": addr.Address, "subject": subject, "sent": config.Email.SMTPHost != ""})
+}
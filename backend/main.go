@@ -1,23 +1,28 @@
 package main
 
 import (
-	"bytes"
+	"cmp"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net"
 	"net/http"
+	"net/mail"
+	"net/url"
 	"os"
 	"path/filepath"
 	"regexp"
+	"slices"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/joho/godotenv"
 	"github.com/rs/cors"
 	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
+	"golang.org/x/crypto/acme"
 )
 
 var Version = "dev"
@@ -33,34 +38,304 @@ var siteNameBlacklist = map[string]struct{}{
 	// Add more reserved names if needed
 }
 
+// siteNameReservedPrefixes cannot start a site name; "xn--" marks
+// internationalized (punycode) DNS labels.
+var siteNameReservedPrefixes = []string{"xn--"}
+
 var sitesBaseDir string
+
+// baseConfigFile is the config file read at startup, "" without one.
+var baseConfigFile string
 var port int
 
 type Config struct {
 	Server struct {
 		ListenAddress string `mapstructure:"listen_address"`
 		Port          int    `mapstructure:"port"`
+		PublicURL     string `mapstructure:"public_url"`  // base URL of this API as seen from generated sites
+		CORSDebug     bool   `mapstructure:"cors_debug"`  // defaults to on in the dev profile only
+		ServeUI       bool   `mapstructure:"serve_ui"`    // serve the embedded frontend on /, if built in
+		HTTP2         bool   `mapstructure:"http2"`       // offer HTTP/2 on TLS listeners
+		HTTP3         bool   `mapstructure:"http3"`       // also serve HTTP/3 (QUIC) on TLS listeners
+		SignupForm    bool   `mapstructure:"signup_form"` // server-rendered signup on /signup, works without the frontend
+		RateLimit     struct {
+			RequestsPerMinute int `mapstructure:"requests_per_minute"` // per client on name checks, creation, signup and login; 0 disables; defaults per profile
+			Burst             int `mapstructure:"burst"`               // requests a client may send at once; defaults per profile
+		} `mapstructure:"rate_limit"`
+		CORS struct {
+			AllowedOrigins   []string `mapstructure:"allowed_origins"`   // of the dashboard routes; "*" or one wildcard like https://*.example.com
+			AllowedMethods   []string `mapstructure:"allowed_methods"`   // of the dashboard routes
+			AllowedHeaders   []string `mapstructure:"allowed_headers"`   // request headers, X-Flox-Session, X-Request-ID, Idempotency-Key and Prefer are always allowed
+			AllowCredentials bool     `mapstructure:"allow_credentials"` // cookies and Authorization headers; not with "*"
+		} `mapstructure:"cors"`
+		Listen      string `mapstructure:"listen"`       // unix:///path/to.sock serves the API on a Unix socket instead of TCP, see listen.go
+		SocketMode  string `mapstructure:"socket_mode"`  // octal permissions of the socket
+		SocketGroup string `mapstructure:"socket_group"` // group of the socket, e.g. that of nginx
+		TLS         struct {
+			CertFile     string `mapstructure:"cert_file"`     // serve the API over HTTPS with this certificate
+			KeyFile      string `mapstructure:"key_file"`      // reloaded together with cert_file when it changes
+			AutocertHost string `mapstructure:"autocert_host"` // or get a certificate for this hostname over ACME
+		} `mapstructure:"tls"`
+		// Reverse proxies that may name the client in X-Forwarded-For, see clientip.go
+		TrustedProxies []string `mapstructure:"trusted_proxies"`
 	} `mapstructure:"server"`
 	Sites struct {
-		BaseDir string `mapstructure:"base_dir"`
+		BaseDir        string   `mapstructure:"base_dir"`
+		ArchiveDeleted bool     `mapstructure:"archive_deleted"` // keep deleted sites in .archive for retention.archive_days
+		ReservedNames  []string `mapstructure:"reserved_names"`  // names nobody can create, in addition to siteNameBlacklist
 	} `mapstructure:"sites"`
 	DNS struct {
+		Provider  string `mapstructure:"provider"` // desec, cloudflare, route53 or mock
 		APIRRSets string `mapstructure:"api_rrsets"`
 		APIAuth   string `mapstructure:"api_auth"`
 		Domain    string `mapstructure:"domain"`
+		// Pacing and bulk changes, see dns.go
+		Bulk         bool          `mapstructure:"bulk"`           // the provider has a bulk rrsets endpoint (deSEC does)
+		BatchSize    int           `mapstructure:"batch_size"`     // record sets per bulk request
+		MinInterval  time.Duration `mapstructure:"min_interval"`   // between two requests to the API
+		MaxRetries   int           `mapstructure:"max_retries"`    // retries of throttled (429) requests
+		MaxRetryWait time.Duration `mapstructure:"max_retry_wait"` // longer Retry-After delays fail instead
+		PreflightTTL time.Duration `mapstructure:"preflight_ttl"`  // how long a provider check before record writes is cached
+		IPv6         string        `mapstructure:"ipv6"`           // AAAA record address of sites; SITE_IPV6 overrides it
+		Cloudflare   struct {
+			ZoneID   string `mapstructure:"zone_id"`
+			APIToken string `mapstructure:"api_token"` // needs Zone.DNS:Edit
+		} `mapstructure:"cloudflare"`
+		Route53 struct {
+			HostedZoneID    string `mapstructure:"hosted_zone_id"`
+			AccessKeyID     string `mapstructure:"access_key_id"`
+			SecretAccessKey string `mapstructure:"secret_access_key"`
+			Region          string `mapstructure:"region"` // signing region, us-east-1 for the global endpoint
+		} `mapstructure:"route53"`
+		// Hostname collisions with the zone, see namecollision.go
+		CollisionCheck bool          `mapstructure:"collision_check"` // check new names against record sets flox did not create
+		ZoneCacheTTL   time.Duration `mapstructure:"zone_cache_ttl"`  // how long the zone listing for the check is cached
 	} `mapstructure:"dns"`
 	Database struct {
 		AdminPath string `mapstructure:"admin_path"`
 	} `mapstructure:"database"`
 	Paths struct {
-		TemplateDir string `mapstructure:"template_dir"`
+		TemplateDir string `mapstructure:"template_dir"` // email/<name>.txt replace the built-in email texts, see mailtemplates.go; themes/<id>/manifest.yaml the themes, see themes.go; sites/<style> are scaffolds, see scaffold.go
 		ScriptDir   string `mapstructure:"script_dir"`
 	} `mapstructure:"paths"`
+	Scheduler struct {
+		Interval time.Duration `mapstructure:"interval"`
+	} `mapstructure:"scheduler"`
+	Email struct {
+		SMTPHost string `mapstructure:"smtp_host"`
+		SMTPPort int    `mapstructure:"smtp_port"`
+		Username string `mapstructure:"username"`
+		Password string `mapstructure:"password"`
+		From     string `mapstructure:"from"`
+	} `mapstructure:"email"`
+	Comments struct {
+		SpamCheckURL string `mapstructure:"spam_check_url"` // Akismet-compatible comment-check endpoint
+		SpamCheckKey string `mapstructure:"spam_check_key"`
+	} `mapstructure:"comments"`
+	Payments struct {
+		StripeSecretKey string `mapstructure:"stripe_secret_key"`
+	} `mapstructure:"payments"`
+	Social struct {
+		CacheTTL          time.Duration `mapstructure:"cache_ttl"`
+		FacebookAppID     string        `mapstructure:"facebook_app_id"` // needed to refresh Facebook tokens
+		FacebookAppSecret string        `mapstructure:"facebook_app_secret"`
+	} `mapstructure:"social"`
+	Geocoding struct {
+		Provider     string        `mapstructure:"provider"` // nominatim or google
+		NominatimURL string        `mapstructure:"nominatim_url"`
+		GoogleAPIKey string        `mapstructure:"google_api_key"` // also used for static maps
+		UserAgent    string        `mapstructure:"user_agent"`
+		CacheTTL     time.Duration `mapstructure:"cache_ttl"`
+		MinInterval  time.Duration `mapstructure:"min_interval"` // between geocoder requests
+	} `mapstructure:"geocoding"`
+	GeoIP struct {
+		DatabasePath     string        `mapstructure:"database_path"`     // MaxMind GeoLite2/GeoIP2 Country or City .mmdb
+		RefreshInterval  time.Duration `mapstructure:"refresh_interval"`  // how often the file is checked for updates
+		MaxAge           time.Duration `mapstructure:"max_age"`           // health check reports older databases as outdated
+		BlockedCountries []string      `mapstructure:"blocked_countries"` // public submissions from these are rejected
+	} `mapstructure:"geoip"`
+	Nginx struct {
+		VhostDir   string `mapstructure:"vhost_dir"`   // e.g. /etc/nginx/sites-available, empty disables vhosts
+		EnabledDir string `mapstructure:"enabled_dir"` // sites-enabled, vhosts are linked there
+		Reload     bool   `mapstructure:"reload"`      // enable, test and reload nginx via sudo
+	} `mapstructure:"nginx"`
+	Hosting struct {
+		Enabled             bool          `mapstructure:"enabled"`                // serve the generated sites without nginx
+		HTTPAddress         string        `mapstructure:"http_address"`           // e.g. ":80", empty disables plain HTTP
+		HTTPSAddress        string        `mapstructure:"https_address"`          // e.g. ":443", empty disables TLS
+		CertDir             string        `mapstructure:"cert_dir"`               // <cert_dir>/<hostname>/{fullchain,privkey}.pem
+		RedirectHTTP        bool          `mapstructure:"redirect_http"`          // redirect HTTP to HTTPS when both are enabled
+		AssetMaxAge         time.Duration `mapstructure:"asset_max_age"`          // browser cache lifetime of non-HTML files
+		AccessLog           string        `mapstructure:"access_log"`             // combined, json or off
+		AccessLogMaxSize    int           `mapstructure:"access_log_max_size"`    // MB before the log is rotated
+		AccessLogMaxBackups int           `mapstructure:"access_log_max_backups"` // rotated logs kept per site
+	} `mapstructure:"hosting"`
+	Logging struct {
+		Format         string        `mapstructure:"format"`          // text or json (for Loki and the like)
+		Level          string        `mapstructure:"level"`           // debug, info, warn or error
+		File           string        `mapstructure:"file"`            // empty logs to stderr only
+		ErrorFile      string        `mapstructure:"error_file"`      // copy of error lines, kept longer in practice
+		Stdout         bool          `mapstructure:"stdout"`          // also log to stdout, for containers and journald
+		MaxSize        int           `mapstructure:"max_size"`        // MB before a file is rotated
+		MaxBackups     int           `mapstructure:"max_backups"`     // rotated files kept, 0 keeps all
+		MaxAge         int           `mapstructure:"max_age"`         // days rotated files are kept, 0 keeps all
+		Compress       bool          `mapstructure:"compress"`        // gzip rotated files
+		RotateInterval time.Duration `mapstructure:"rotate_interval"` // also rotate on a schedule, e.g. 24h; 0 rotates by size only
+	} `mapstructure:"logging"`
+	Retention struct {
+		EventsDays    int `mapstructure:"events_days"`    // site timeline events, 0 keeps them forever
+		AnalyticsDays int `mapstructure:"analytics_days"` // daily pageview files
+		ArchiveDays   int `mapstructure:"archive_days"`   // archives of deleted sites
+		AuditDays     int `mapstructure:"audit_days"`     // day files of the audit log
+	} `mapstructure:"retention"`
+	Registry struct {
+		Instance     string `mapstructure:"instance"`      // name of this instance, e.g. "eu"; defaults to the hostname
+		AllocatorURL string `mapstructure:"allocator_url"` // instance that allocates site names, empty = this one
+		Token        string `mapstructure:"token"`         // shared secret of the allocation endpoints
+	} `mapstructure:"registry"`
+	Migrations struct {
+		AutoApply bool `mapstructure:"auto_apply"` // apply pending migrations on startup; defaults per profile
+	} `mapstructure:"migrations"`
+	Secrets struct {
+		EncryptionKey string `mapstructure:"encryption_key"` // base64, 32 bytes
+	} `mapstructure:"secrets"`
+	Verification struct {
+		Required bool          `mapstructure:"required"`  // new sites are only published once their email is confirmed
+		TokenTTL time.Duration `mapstructure:"token_ttl"` // validity of a verification link
+	} `mapstructure:"verification"`
+	Domains struct {
+		Resolver string `mapstructure:"resolver"` // host:port of the DNS server for TXT checks; empty uses the system resolver
+	} `mapstructure:"domains"`
+	ACME struct {
+		Enabled         bool          `mapstructure:"enabled"`          // issue and renew site certificates, see acme.go
+		DirectoryURL    string        `mapstructure:"directory_url"`    // the CA, Let's Encrypt production by default
+		Email           string        `mapstructure:"email"`            // account contact for expiry notices
+		RenewBefore     time.Duration `mapstructure:"renew_before"`     // renew certificates expiring within this time
+		PropagationWait time.Duration `mapstructure:"propagation_wait"` // between writing the challenge record and asking the CA to check it
+	} `mapstructure:"acme"`
+	Limits struct {
+		SiteCreationsPerHour int    `mapstructure:"site_creations_per_hour"` // instance-wide, 0 disables the limit
+		SiteCreationPolicy   string `mapstructure:"site_creation_policy"`    // over the limit: reject, or queue the DNS records
+		AlertEmail           string `mapstructure:"alert_email"`             // notified when the limit is hit
+	} `mapstructure:"limits"`
+	Entitlements struct {
+		DefaultPlan string                `mapstructure:"default_plan"` // plan of sites without one; empty allows everything
+		Plans       map[string]planConfig `mapstructure:"plans"`        // by name, see entitlements.go
+	} `mapstructure:"entitlements"`
+	Warmup struct {
+		Enabled bool          `mapstructure:"enabled"` // request new and rebuilt sites until they answer, see warmup.go
+		URLs    []string      `mapstructure:"urls"`    // requested besides the site URL, e.g. on the CDN; {site} is the site name
+		Timeout time.Duration `mapstructure:"timeout"` // how long each URL is retried
+	} `mapstructure:"warmup"`
+	Maintenance struct {
+		Windows []maintenanceWindow `mapstructure:"windows"` // announced in the calendar feeds, see calendar.go
+	} `mapstructure:"maintenance"`
+	GitOps struct {
+		Repo     string        `mapstructure:"repo"`     // git URL of the site definitions, empty disables GitOps; see gitops.go
+		Branch   string        `mapstructure:"branch"`   // synced branch
+		Path     string        `mapstructure:"path"`     // directory of the site files in the repo, empty for the root
+		Interval time.Duration `mapstructure:"interval"` // between syncs
+		Prune    bool          `mapstructure:"prune"`    // delete managed sites whose file was removed
+	} `mapstructure:"gitops"`
+	Webhooks struct {
+		Endpoints     []webhookEndpoint `mapstructure:"endpoints"`      // URLs that get the site events POSTed, see webhooks.go
+		SigningSecret string            `mapstructure:"signing_secret"` // signs the deliveries of endpoints
+	} `mapstructure:"webhooks"`
+	Idempotency struct {
+		TTL time.Duration `mapstructure:"ttl"` // how long responses are replayed to retries with the same Idempotency-Key, 0 ignores the header; see idempotency.go
+	} `mapstructure:"idempotency"`
+	Faults struct {
+		Enabled bool        `mapstructure:"enabled"` // inject faults into provisioning, only in test builds, see faults.go
+		Rules   []faultRule `mapstructure:"rules"`
+	} `mapstructure:"faults"`
+	Premium struct {
+		Rules []premiumRule `mapstructure:"rules"` // tiers of premium site names, the first matching rule counts; see premium.go
+	} `mapstructure:"premium"`
+	Moderation struct {
+		Enabled          bool          `mapstructure:"enabled"`           // scan every build for prohibited content, see moderation.go
+		Keywords         []string      `mapstructure:"keywords"`          // words and phrases flagged in the text, case-insensitive
+		BlockedHosts     []string      `mapstructure:"blocked_hosts"`     // links, forms, scripts and images to these hosts or their subdomains are flagged
+		APIURL           string        `mapstructure:"api_url"`           // external moderation service asked for a verdict; empty for none
+		APIToken         string        `mapstructure:"api_token"`         // sent to it as bearer token
+		APITimeout       time.Duration `mapstructure:"api_timeout"`       // of its answer
+		SuspendThreshold float64       `mapstructure:"suspend_threshold"` // confidence from which a site is suspended, lower ones are queued for review
+	} `mapstructure:"moderation"`
+	Provisioning struct {
+		Concurrency int            `mapstructure:"concurrency"`  // creations and rebuilds running at once, 0 = unlimited
+		ClassLimits map[string]int `mapstructure:"class_limits"` // slots a class may use at most, by priority, standard or bulk; 0 = all
+		MaxWait     time.Duration  `mapstructure:"max_wait"`     // after which a waiting job goes ahead of higher classes, 0 = never
+		Steps       []pipelineStep `mapstructure:"steps"`        // of the publication of a site, default build and dns; see pipeline.go
+	} `mapstructure:"provisioning"`
+	Audit struct {
+		Dir string `mapstructure:"dir"` // of the audit log, default .audit in the sites directory
+	} `mapstructure:"audit"`
+	Metrics struct {
+		Token string `mapstructure:"token"` // bearer token Prometheus has to send to /metrics; empty leaves it open
+	} `mapstructure:"metrics"`
+	Tracing struct {
+		Endpoint    string            `mapstructure:"endpoint"`     // OTLP/HTTP URL, e.g. http://localhost:4318; empty turns tracing off
+		Headers     map[string]string `mapstructure:"headers"`      // sent with every export, e.g. the API key of a hosted backend
+		ServiceName string            `mapstructure:"service_name"` // service.name of the spans
+		SampleRatio float64           `mapstructure:"sample_ratio"` // share of new traces recorded, 1 records all
+	} `mapstructure:"tracing"`
+	Cache struct {
+		SiteDetails int `mapstructure:"site_details"` // sites whose GET /api/v1/sites/{siteName} response is kept in memory, 0 disables the cache
+	} `mapstructure:"cache"`
+	Integrity struct {
+		SweepInterval time.Duration `mapstructure:"sweep_interval"` // of the site record check, 0 disables it
+	} `mapstructure:"integrity"`
+	Disk struct {
+		CheckInterval        time.Duration `mapstructure:"check_interval"`          // of the sites volume, 0 disables the monitor
+		MinFreePercent       float64       `mapstructure:"min_free_percent"`        // below, the API turns read-only
+		MinFreeInodesPercent float64       `mapstructure:"min_free_inodes_percent"` // likewise for inodes
+	} `mapstructure:"disk"`
+	Quotas struct {
+		SitesPerUser int `mapstructure:"sites_per_user"` // sites a user may own, 0 = unlimited; admins are not limited
+	} `mapstructure:"quotas"`
+	Auth struct {
+		Required  bool          `mapstructure:"required"`   // creating and listing sites needs a login, sites without owner are locked
+		JWTSecret string        `mapstructure:"jwt_secret"` // signs session tokens; empty uses a generated key in the sites directory
+		TokenTTL  time.Duration `mapstructure:"token_ttl"`  // validity of a session token
+		Passwords bool          `mapstructure:"passwords"`  // local accounts with email and password
+		// DeletionGrace is the time between the request to delete an account
+		// and its deletion, see accountdeletion.go
+		DeletionGrace time.Duration `mapstructure:"deletion_grace"`
+		OIDC          struct {
+			Issuer    string `mapstructure:"issuer"`     // OpenID Connect provider whose access tokens are accepted
+			ClientID  string `mapstructure:"client_id"`  // the tokens' audience or authorized party
+			AdminRole string `mapstructure:"admin_role"` // realm or client role of admins
+		} `mapstructure:"oidc"`
+	} `mapstructure:"auth"`
+	Admin struct {
+		Token string `mapstructure:"token"` // shared bearer token of the admin endpoints, for scripts; admins can also log in
+	} `mapstructure:"admin"`
+	Frontend struct {
+		CaptchaProvider string   `mapstructure:"captcha_provider"` // hcaptcha, turnstile or recaptcha; empty: no captcha
+		CaptchaSiteKey  string   `mapstructure:"captcha_site_key"` // public key of the widget
+		Locales         []string `mapstructure:"locales"`          // offered by the frontend, BCP 47 tags
+		DefaultLocale   string   `mapstructure:"default_locale"`   // one of locales
+	} `mapstructure:"frontend"`
+	Themes struct {
+		AssetDir string `mapstructure:"asset_dir"` // static files of the themes, <asset_dir>/<theme>/; empty: themes have none
+		CDNDir   string `mapstructure:"cdn_dir"`   // published versions; defaults to <sites.base_dir>/.theme-assets
+		CDNURL   string `mapstructure:"cdn_url"`   // public URL of cdn_dir; empty serves it on <public_url>/theme-assets/
+	} `mapstructure:"themes"`
 }
 
 var config Config
 
 func initViper() {
+	// Define flags
+	pflag.String("sites-dir", "", "Base directory to store site configs")
+	pflag.BoolVar(&devMode, "dev", false, "Run with a fake DNS API, a temporary sites dir and demo sites")
+	// Bind the flag to a Viper key. The flag name becomes the key if not specified otherwise.
+	// This makes the flag value available via viper.GetString("sites-dir")
+	// and gives it the highest precedence (after explicit viper.Set calls).
+	viper.BindPFlag("sites.dir_flag", pflag.CommandLine.Lookup("sites-dir")) // Use a distinct key
+
+	// Parse command-line flags, after those of a subcommand were registered
+	pflag.CommandLine.Parse(commandArgs(os.Args[1:]))
+
 	viper.SetConfigName("backend")
 	viper.SetConfigType("yaml")
 	viper.AddConfigPath("/etc/flox/")
@@ -68,6 +343,7 @@ func initViper() {
 	viper.AddConfigPath(".")
 
 	viper.SetEnvPrefix("flox")
+	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_")) // server.port -> FLOX_SERVER_PORT
 	viper.AutomaticEnv()
 	viper.BindEnv("server.port", "FLOX_SERVER_PORT") // should be automatic, but alas, we had to bind it manually
 
@@ -75,27 +351,142 @@ func initViper() {
 	if err := viper.ReadInConfig(); err != nil {
 		var configFileNotFoundError viper.ConfigFileNotFoundError
 		if errors.As(err, &configFileNotFoundError) {
-			log.Println("Info: Config file not found, relying on environment variables and defaults.")
+			slog.Info("Config file not found, relying on environment variables and defaults")
 		} else {
 			// Config file was found but another error was produced
-			log.Fatalf("Fatal error reading config file: %v", err)
+			fatal("error reading config file", "error", err)
 		}
 	} else {
-		log.Printf("Using config file: %s", viper.ConfigFileUsed())
+		baseConfigFile = viper.ConfigFileUsed()
+		slog.Info("Using config file", "file", baseConfigFile)
 	}
+	selectProfile()
+	mergeProfileConfig()
 
 	viper.SetDefault("sites.base_dir", "./sites") // Default for development
 	viper.SetDefault("server.port", 0)            // Default to 0 (auto-select) if not specified
-
-	// Define flags
-	pflag.String("sites-dir", "", "Base directory to store site configs")
-	// Bind the flag to a Viper key. The flag name becomes the key if not specified otherwise.
-	// This makes the flag value available via viper.GetString("sites-dir")
-	// and gives it the highest precedence (after explicit viper.Set calls).
-	viper.BindPFlag("sites.dir_flag", pflag.CommandLine.Lookup("sites-dir")) // Use a distinct key
-
-	// Parse command-line flags
-	pflag.Parse()
+	viper.SetDefault("scheduler.interval", time.Minute)
+	viper.SetDefault("dns.provider", "desec")
+	viper.SetDefault("dns.domain", "flox.click")
+	viper.SetDefault("dns.bulk", true)
+	viper.SetDefault("dns.batch_size", 100)
+	viper.SetDefault("dns.min_interval", 500*time.Millisecond)
+	viper.SetDefault("dns.max_retries", 3)
+	viper.SetDefault("dns.max_retry_wait", time.Minute)
+	viper.SetDefault("dns.preflight_ttl", time.Minute)
+	viper.SetDefault("dns.collision_check", true)
+	viper.SetDefault("dns.zone_cache_ttl", 5*time.Minute)
+	viper.SetDefault("dns.route53.region", "us-east-1")
+	viper.SetDefault("server.serve_ui", true)
+	viper.SetDefault("server.http2", true)
+	viper.SetDefault("server.http3", false)
+	viper.SetDefault("server.signup_form", true)
+	viper.SetDefault("server.socket_mode", "0660")
+	viper.SetDefault("server.trusted_proxies", []string{"127.0.0.1", "::1"})
+	viper.SetDefault("server.cors.allowed_origins", []string{
+		"https://flox.click",
+		"https://www.flox.click",
+		"https://app.flox.click",
+		"http://localhost:3000", // For local development
+		"http://127.0.0.1:3000", // For local development
+	})
+	viper.SetDefault("server.cors.allowed_methods", []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"})
+	viper.SetDefault("server.cors.allowed_headers", []string{"Content-Type", "Authorization"})
+	viper.SetDefault("server.cors.allow_credentials", true)
+	viper.SetDefault("frontend.locales", []string{"en"})
+	viper.SetDefault("frontend.default_locale", "en")
+	viper.SetDefault("comments.spam_check_url", "https://rest.akismet.com/1.1/comment-check")
+	viper.SetDefault("email.smtp_port", 587)
+	viper.SetDefault("email.from", "flox <noreply@flox.click>")
+	viper.SetDefault("social.cache_ttl", 15*time.Minute)
+	viper.SetDefault("geocoding.provider", "nominatim")
+	viper.SetDefault("geocoding.nominatim_url", "https://nominatim.openstreetmap.org")
+	viper.SetDefault("geocoding.user_agent", "flox-backend (https://flox.click)")
+	viper.SetDefault("geocoding.cache_ttl", 30*24*time.Hour)
+	viper.SetDefault("geocoding.min_interval", time.Second)
+	viper.SetDefault("geoip.refresh_interval", time.Hour)
+	viper.SetDefault("nginx.enabled_dir", "/etc/nginx/sites-enabled")
+	viper.SetDefault("nginx.reload", false)
+	viper.SetDefault("geoip.max_age", 45*24*time.Hour)
+	viper.SetDefault("hosting.enabled", false)
+	viper.SetDefault("hosting.http_address", ":80")
+	viper.SetDefault("hosting.https_address", "")
+	viper.SetDefault("hosting.cert_dir", "/etc/letsencrypt/live")
+	viper.SetDefault("hosting.redirect_http", true)
+	viper.SetDefault("hosting.asset_max_age", time.Hour)
+	viper.SetDefault("hosting.access_log", "combined")
+	viper.SetDefault("hosting.access_log_max_size", 10)
+	viper.SetDefault("hosting.access_log_max_backups", 5)
+	viper.SetDefault("integrity.sweep_interval", time.Hour)
+	viper.SetDefault("cache.site_details", 1000)
+	viper.SetDefault("provisioning.concurrency", 4)
+	viper.SetDefault("provisioning.class_limits", map[string]int{"bulk": 1})
+	viper.SetDefault("provisioning.max_wait", 2*time.Minute)
+	viper.SetDefault("moderation.api_timeout", defaultModerationTimeout)
+	viper.SetDefault("moderation.suspend_threshold", defaultSuspendThreshold)
+	viper.SetDefault("tracing.service_name", "flox-backend")
+	viper.SetDefault("tracing.sample_ratio", 1.0)
+	viper.SetDefault("logging.format", "text")
+	viper.SetDefault("logging.level", "info")
+	viper.SetDefault("logging.stdout", true)
+	viper.SetDefault("logging.max_size", 100)
+	viper.SetDefault("logging.max_backups", 10)
+	viper.SetDefault("logging.max_age", 90)
+	viper.SetDefault("logging.compress", true)
+	viper.SetDefault("logging.rotate_interval", time.Duration(0))
+	viper.SetDefault("retention.events_days", 90)
+	viper.SetDefault("retention.analytics_days", 396) // 13 months, for year-over-year comparison
+	viper.SetDefault("retention.archive_days", 30)
+	viper.SetDefault("retention.audit_days", 730)
+	viper.SetDefault("sites.archive_deleted", true)
+	viper.SetDefault("sites.reserved_names", []string{})
+	viper.SetDefault("verification.required", false)
+	viper.SetDefault("verification.token_ttl", 48*time.Hour)
+	viper.SetDefault("warmup.enabled", false)
+	viper.SetDefault("warmup.urls", []string{})
+	viper.SetDefault("warmup.timeout", time.Minute)
+	viper.SetDefault("faults.enabled", false)
+	viper.SetDefault("idempotency.ttl", 24*time.Hour)
+	viper.SetDefault("gitops.branch", "main")
+	viper.SetDefault("gitops.interval", time.Minute)
+	viper.SetDefault("gitops.prune", false)
+	viper.SetDefault("acme.enabled", false)
+	viper.SetDefault("acme.directory_url", acme.LetsEncryptURL)
+	viper.SetDefault("acme.renew_before", 30*24*time.Hour)
+	viper.SetDefault("acme.propagation_wait", 30*time.Second)
+	viper.SetDefault("limits.site_creations_per_hour", 100)
+	viper.SetDefault("limits.site_creation_policy", "reject")
+	viper.SetDefault("quotas.sites_per_user", 0)
+	viper.SetDefault("disk.check_interval", time.Minute)
+	viper.SetDefault("disk.min_free_percent", 5)
+	viper.SetDefault("disk.min_free_inodes_percent", 5)
+	viper.SetDefault("auth.required", false)
+	viper.SetDefault("auth.token_ttl", 24*time.Hour)
+	viper.SetDefault("auth.passwords", true)
+	viper.SetDefault("auth.deletion_grace", 14*24*time.Hour)
+	viper.SetDefault("auth.oidc.admin_role", "flox-admin")
+	if hostname, err := os.Hostname(); err == nil {
+		viper.SetDefault("registry.instance", hostname)
+	}
+	// Settings without a default are registered empty so viper.Unmarshal also
+	// picks them up from the environment (e.g. FLOX_SECRETS_ENCRYPTION_KEY).
+	for _, key := range []string{
+		"email.username", "email.password", "comments.spam_check_key",
+		"payments.stripe_secret_key", "secrets.encryption_key",
+		"social.facebook_app_id", "social.facebook_app_secret",
+		"geocoding.google_api_key", "geoip.database_path", "nginx.vhost_dir",
+		"logging.file", "logging.error_file", "registry.allocator_url", "registry.token",
+		"dns.cloudflare.zone_id", "dns.cloudflare.api_token", "dns.route53.hosted_zone_id",
+		"dns.route53.access_key_id", "dns.route53.secret_access_key", "dns.ipv6",
+		"domains.resolver", "acme.email", "limits.alert_email",
+		"server.public_url", "server.tls.cert_file", "server.tls.key_file", "server.tls.autocert_host", "auth.jwt_secret",
+		"auth.oidc.issuer", "auth.oidc.client_id", "admin.token", "paths.script_dir", "paths.template_dir",
+		"themes.asset_dir", "themes.cdn_dir", "themes.cdn_url", "entitlements.default_plan", "metrics.token", "tracing.endpoint", "audit.dir",
+		"frontend.captcha_provider", "frontend.captcha_site_key", "server.listen", "server.socket_group",
+		"gitops.repo", "gitops.path", "webhooks.signing_secret",
+	} {
+		viper.SetDefault(key, "")
+	}
 
 	// --- Determine final values using Viper ---
 	// Priority order (highest to lowest):
@@ -110,6 +501,12 @@ func initViper() {
 	flagSitesDir := viper.GetString("sites.dir_flag")
 	if flagSitesDir != "" {
 		sitesBaseDir = flagSitesDir
+	} else if devMode {
+		dir, err := os.MkdirTemp("", "flox-dev-sites-")
+		if err != nil {
+			fatal("unable to create temporary sites directory", "error", err)
+		}
+		sitesBaseDir = dir
 	} else {
 		// Fall back to config file or env var
 		sitesBaseDir = viper.GetString("sites.base_dir")
@@ -117,10 +514,10 @@ func initViper() {
 	// If it's still empty (unlikely due to default), use cwd logic as final fallback
 	// (This logic is mostly covered by the default now, but kept for robustness)
 	if sitesBaseDir == "" {
-		log.Println("Warning: sites.base_dir is empty, using current directory logic.")
+		slog.Warn("sites.base_dir is empty, using current directory logic")
 		cwd, err := os.Getwd()
 		if err != nil {
-			log.Fatalf("Fatal: unable to get working directory: %v", err)
+			fatal("unable to get working directory", "error", err)
 		}
 		sitesBaseDir = filepath.Join(cwd, "sites")
 	}
@@ -131,27 +528,112 @@ func initViper() {
 	configuredPort := viper.GetInt("server.port")
 	if configuredPort > 0 && configuredPort <= 65535 {
 		port = configuredPort
-		log.Printf("DEBUG: initViper set global 'port' variable to: %d", port)
+		slog.Debug("initViper set global port variable", "port", port)
 	} else if configuredPort == 0 {
 		// Zero is treated as "use default/auto-select"
 		port = 0
-		log.Printf("DEBUG: initViper set global 'port' variable to: %d (auto-select)", port)
+		slog.Debug("initViper set global port variable (auto-select)", "port", port)
 	} else {
-		log.Printf("Warning: Invalid server.port %d from config/env, falling back to automatic port selection", configuredPort)
+		slog.Warn("Invalid server.port from config/env, falling back to automatic port selection", "port", configuredPort)
 		port = 0 // Default to auto-select
 	}
 
+	if err := viper.Unmarshal(&config); err != nil {
+		fatal("error decoding config", "error", err)
+	}
+	if ipv6 := os.Getenv("SITE_IPV6"); ipv6 != "" {
+		config.DNS.IPv6 = ipv6
+	}
+	if err := validateConfig(&config); err != nil {
+		fatal("invalid config", "error", err)
+	}
+	provider, err := newDNSProvider(config.DNS.Provider)
+	if err != nil {
+		fatal("invalid DNS provider", "error", err)
+	}
+	dnsProvider = provider
+	siteDetails.size = config.Cache.SiteDetails
+
 	// --- Ensure the sites directory exists ---
-	log.Printf("Using sites base directory: %s", sitesBaseDir)
+	slog.Info("Using sites base directory", "dir", sitesBaseDir)
 	if err := os.MkdirAll(sitesBaseDir, 0755); err != nil {
-		log.Fatalf("Failed to create sites base directory '%s': %v", sitesBaseDir, err)
+		fatal("Failed to create sites base directory", "dir", sitesBaseDir, "error", err)
 	}
 }
 
+// validateConfig checks the settings that decode but make no sense, at
+// startup and for imported config bundles.
+func validateConfig(c *Config) error {
+	if ip := net.ParseIP(c.DNS.IPv6); c.DNS.IPv6 != "" && (ip == nil || ip.To4() != nil) {
+		return fmt.Errorf("%q is not an IPv6 address (dns.ipv6 / SITE_IPV6)", c.DNS.IPv6)
+	}
+	if p := c.Limits.SiteCreationPolicy; p != "reject" && p != "queue" {
+		return fmt.Errorf("limits.site_creation_policy must be reject or queue, not %q", p)
+	}
+	if c.Auth.OIDC.Issuer != "" && c.Auth.OIDC.ClientID == "" {
+		return errors.New("auth.oidc.issuer needs auth.oidc.client_id")
+	}
+	if !c.Auth.Passwords && c.Auth.OIDC.Issuer == "" {
+		return errors.New("auth.passwords: false needs auth.oidc.issuer, nobody could log in")
+	}
+	if c.Auth.DeletionGrace < 0 {
+		return errors.New("auth.deletion_grace must not be negative")
+	}
+	if err := validatePlans(c); err != nil {
+		return err
+	}
+	if err := validatePremiumRules(c); err != nil {
+		return err
+	}
+	if err := validateMaintenance(c); err != nil {
+		return err
+	}
+	if err := validateFaults(c); err != nil {
+		return err
+	}
+	if err := validateGitOps(c); err != nil {
+		return err
+	}
+	if err := validateWebhooks(c); err != nil {
+		return err
+	}
+	if err := validateCORS(c); err != nil {
+		return err
+	}
+	if err := validateFrontend(c); err != nil {
+		return err
+	}
+	if err := validateTrustedProxies(c); err != nil {
+		return err
+	}
+	if err := validateListen(c); err != nil {
+		return err
+	}
+	if err := validateLogging(c); err != nil {
+		return err
+	}
+	if err := validateProvisioning(c); err != nil {
+		return err
+	}
+	if err := validatePipeline(c); err != nil {
+		return err
+	}
+	if err := validateModeration(c); err != nil {
+		return err
+	}
+	if err := validateTracing(c); err != nil {
+		return err
+	}
+	if u, err := url.Parse(c.Themes.CDNURL); c.Themes.CDNURL != "" && (err != nil || u.Host == "" || (u.Scheme != "https" && u.Scheme != "http")) {
+		return fmt.Errorf("themes.cdn_url must be an http(s) URL, not %q", c.Themes.CDNURL)
+	}
+	return nil
+}
+
 func init() {
 	err := godotenv.Load("../.env")
 	if err != nil {
-		log.Println("Info: .env file not found or could not be loaded")
+		slog.Info(".env file not found or could not be loaded")
 	}
 	initViper()
 }
@@ -160,11 +642,16 @@ func validateSiteName(siteName string) error {
 	siteName = strings.ToLower(siteName)
 
 	if !siteNameRegex.MatchString(siteName) {
-		return errors.New("site name must be 1-63 characters, letters, digits, or hyphens; cannot start or end with hyphen")
+		return &APIError{Code: codeNameInvalid, Message: "site name must be 1-63 characters, letters, digits, or hyphens; cannot start or end with hyphen"}
 	}
 
-	if _, forbidden := siteNameBlacklist[siteName]; forbidden {
-		return errors.New("site name is reserved or forbidden")
+	if _, forbidden := siteNameBlacklist[siteName]; forbidden || slices.ContainsFunc(currentConfig().Sites.ReservedNames, func(name string) bool { return strings.EqualFold(name, siteName) }) {
+		return &APIError{Code: codeNameReserved, Message: "site name is reserved or forbidden"}
+	}
+	for _, prefix := range siteNameReservedPrefixes {
+		if strings.HasPrefix(siteName, prefix) {
+			return &APIError{Code: codeNameReserved, Message: fmt.Sprintf("site names cannot start with %q", prefix)}
+		}
 	}
 
 	exists, err := siteExists(siteName)
@@ -172,11 +659,35 @@ func validateSiteName(siteName string) error {
 		return fmt.Errorf("error checking site existence: %v", err)
 	}
 	if exists {
-		return errors.New("site name already exists")
+		return &APIError{Code: codeSiteExists, Message: "site name already exists"}
+	}
+	// Another instance may have it.
+	taken, err := siteNameAllocated(siteName)
+	if err != nil {
+		slog.Error("error checking site name allocation", "error", err)
+		return errors.New("could not check whether the name is available, try again later")
+	}
+	if taken {
+		return errNameTaken
 	}
 	return nil
 }
 
+// listSiteNames returns the names of all site directories under sitesBaseDir.
+func listSiteNames() ([]string, error) {
+	entries, err := os.ReadDir(sitesBaseDir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, e := range entries {
+		if e.IsDir() && siteNameRegex.MatchString(e.Name()) {
+			names = append(names, e.Name())
+		}
+	}
+	return names, nil
+}
+
 func siteExists(siteName string) (bool, error) {
 	path := filepath.Join(sitesBaseDir, siteName)
 	_, err := os.Stat(path)
@@ -196,6 +707,12 @@ type validationRequest struct {
 type validationResponse struct {
 	Valid bool   `json:"valid"`
 	Error string `json:"error,omitempty"`
+	Code  string `json:"code,omitempty"` // of Error, see apierror.go
+	// Tier of a valid name, "standard" or that of its premium rule
+	Tier      string `json:"tier,omitempty"`
+	PriceHint string `json:"priceHint,omitempty"`
+	// The premium name has to be bought before the site can be created
+	PurchaseRequired bool `json:"purchaseRequired,omitempty"`
 }
 
 func validateSiteNameHandler(w http.ResponseWriter, r *http.Request) {
@@ -210,17 +727,28 @@ func validateSiteNameHandler(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
 	if err := decoder.Decode(&req); err != nil {
 		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(validationResponse{Valid: false, Error: "Invalid JSON request"})
+		json.NewEncoder(w).Encode(validationResponse{Valid: false, Error: "Invalid JSON request", Code: statusErrorCode(http.StatusBadRequest)})
 		return
 	}
 
-	err := validateSiteName(req.SiteName)
+	err := validateSiteNameFor(r, req.SiteName)
 	resp := validationResponse{}
 	if err != nil {
 		resp.Valid = false
 		resp.Error = err.Error()
+		resp.Code = errorCode(err, codeNameInvalid)
 	} else {
 		resp.Valid = true
+		resp.Tier = standardTier
+		if rule, ok := premiumRuleFor(req.SiteName); ok {
+			resp.Tier, resp.PriceHint = rule.Tier, rule.Price
+			access, err := checkPremiumAccess(r, req.SiteName, rule.Tier)
+			if err != nil {
+				slog.ErrorContext(r.Context(), "error checking premium access", "site", req.SiteName, "error", err)
+			}
+			resp.PurchaseRequired = access == premiumDenied
+		}
+		recordFunnelStep(r, "name_validated")
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -233,12 +761,32 @@ type siteCreationRequest struct {
 	Description    string   `json:"description,omitempty"`
 	Style          string   `json:"style,omitempty"`
 	InitialContent []string `json:"initialContent,omitempty"`
+	// Optional referral or coupon code
+	Code string `json:"code,omitempty"`
+	// Requester's email, required with verification.required
+	Email string `json:"email,omitempty"`
+	// Admins only: create the site even though its name collides with
+	// hostnames in the zone, see namecollision.go
+	AllowCollision bool `json:"allowCollision,omitempty"`
 }
 
 type siteCreationResponse struct {
 	Success bool   `json:"success"`
 	SiteURL string `json:"siteUrl,omitempty"`
 	Error   string `json:"error,omitempty"`
+	// Code of Error, see apierror.go
+	Code string `json:"code,omitempty"`
+	// DNSError explains why the site is not reachable yet, when it was
+	// created but its DNS record was not.
+	DNSError     string       `json:"dnsError,omitempty"`
+	DNSErrorKind dnsErrorKind `json:"dnsErrorKind,omitempty"`
+	// The site is a draft until the link mailed to the requester is opened
+	VerificationRequired bool `json:"verificationRequired,omitempty"`
+	// The DNS record is queued until the DNS provider is available again
+	DNSPending bool `json:"dnsPending,omitempty"`
+	// WarmupError explains why the created site did not answer yet, see
+	// warmup.go.
+	WarmupError string `json:"warmupError,omitempty"`
 }
 
 type SiteConfig struct {
@@ -247,6 +795,58 @@ type SiteConfig struct {
 	Style          string    `json:"style,omitempty"`
 	InitialContent []string  `json:"initialContent,omitempty"`
 	CreatedAt      time.Time `json:"createdAt"`
+
+	// Optional publish windows, keyed by section ID
+	SectionSchedules map[string]PublishWindow `json:"sectionSchedules,omitempty"`
+	// Owner-defined forms rendered into the "form" section
+	Forms []FormDefinition `json:"forms,omitempty"`
+	// Appointment booking, nil if not enabled
+	Booking *BookingConfig `json:"booking,omitempty"`
+	// Blog comment settings, nil means comments are closed
+	Comments *CommentSettings `json:"comments,omitempty"`
+	// Mailing list provider of the newsletter section
+	Newsletter *NewsletterConfig `json:"newsletter,omitempty"`
+	// Feeds shown in the social section
+	SocialFeeds []SocialFeed `json:"socialFeeds,omitempty"`
+	// Address and coordinates of the location section
+	Location *Location `json:"location,omitempty"`
+	// Weekly opening hours and exceptions of the hours section
+	OpeningHours *OpeningHours `json:"openingHours,omitempty"`
+	// Pages of a multi-page site; empty for one-pagers
+	Pages []Page `json:"pages,omitempty"`
+	// Country restrictions of the public endpoints
+	RegionRules *RegionRules `json:"regionRules,omitempty"`
+	// Owner-managed response headers of the vhost
+	HeaderSettings *HeaderSettings `json:"headerSettings,omitempty"`
+	// Referral or coupon code redeemed at creation
+	Coupon string `json:"coupon,omitempty"`
+	// Requester's email; Unverified sites are drafts until it is confirmed
+	OwnerEmail string `json:"ownerEmail,omitempty"`
+	// UserID is the account owning the site, see users.go.
+	UserID     string     `json:"userId,omitempty"`
+	Unverified bool       `json:"unverified,omitempty"`
+	VerifiedAt *time.Time `json:"verifiedAt,omitempty"`
+	// The DNS record is queued, see dnspreflight.go
+	DNSPending bool `json:"dnsPending,omitempty"`
+	// Record sets created for the site, deleted with it
+	DNSRecords []rrset `json:"dnsRecords,omitempty"`
+	// Subdomain delegated to the owner's nameservers, see dnsdelegation.go
+	DNSDelegation *DNSDelegation `json:"dnsDelegation,omitempty"`
+	// Owner's own domains, see domains.go
+	Domains []CustomDomain `json:"domains,omitempty"`
+	// TLS certificate of the subdomain, see acme.go
+	Certificate *CertificateStatus `json:"certificate,omitempty"`
+	// Plan deciding the features the site may enable, see entitlements.go;
+	// empty is the default plan
+	Plan string `json:"plan,omitempty"`
+	// Tier of the premium name the site was created with, see premium.go
+	PremiumTier string `json:"premiumTier,omitempty"`
+	// Declared outputs of hooks by hook name, see hooks.go
+	HookOutputs map[string]map[string]any `json:"hookOutputs,omitempty"`
+	// Definition in git the site is managed by, see gitops.go
+	GitOps *GitOpsState `json:"gitops,omitempty"`
+	// Set while the site is taken offline for its content, see moderation.go
+	Suspended *Suspension `json:"suspended,omitempty"`
 }
 
 // Helper for JSON response with Content-Type and encoding
@@ -255,7 +855,44 @@ func respondJSON(w http.ResponseWriter, data any) {
 	json.NewEncoder(w).Encode(data)
 }
 
+// Same as respondJSON, but with a non-200 status code
+func respondJSONStatus(w http.ResponseWriter, status int, data any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(data)
+}
+
+// siteNameFromPath extracts the {siteName} path value and checks that it
+// refers to an existing site the request may access. On failure an error
+// response has already been written and ok is false.
+func siteNameFromPath(w http.ResponseWriter, r *http.Request) (siteName string, ok bool) {
+	siteName = r.PathValue("siteName")
+	if !siteNameRegex.MatchString(siteName) {
+		http.Error(w, "Invalid site name", http.StatusBadRequest)
+		return "", false
+	}
+	exists, err := siteExists(siteName)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error checking site existence", "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return "", false
+	}
+	if !exists {
+		apiError(w, r, http.StatusNotFound, codeSiteNotFound, "Site not found")
+		return "", false
+	}
+	// Public routes serve the site's visitors, all others its owner.
+	if !publicRoutes[r.Pattern] && !authorizeSite(w, r, siteName) {
+		return "", false
+	}
+	setRequestSite(r, siteName)
+	return siteName, true
+}
+
 func createSiteDir(siteName string) error {
+	if err := injectFault(siteName, "directory"); err != nil {
+		return err
+	}
 	path := filepath.Join(sitesBaseDir, siteName)
 	// Use os.Mkdir with proper mode; will fail if directory exists, which helps atomically lock
 	err := os.Mkdir(path, 0755)
@@ -268,64 +905,120 @@ func createSiteDir(siteName string) error {
 	return nil
 }
 
+// writeSiteConfig replaces config.json through a temporary file, so readers
+// never see a half-written config, and keeps the previous one as
+// config.json.bak (see recovery.go). Changes of an existing site go through
+// updateSiteConfig.
 func writeSiteConfig(baseDir, siteName string, config SiteConfig) error {
-	configPath := filepath.Join(baseDir, siteName, "config.json")
-	f, err := os.Create(configPath)
+	data, err := json.MarshalIndent(config, "", "  ") // pretty print JSON with indentation
 	if err != nil {
 		return err
 	}
-	defer f.Close()
+	configPath := filepath.Join(baseDir, siteName, siteConfigFile)
+	backupPath := filepath.Join(baseDir, siteName, siteConfigBackupFile)
+	if err := os.Remove(backupPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Link(configPath, backupPath); err != nil && !os.IsNotExist(err) {
+		slog.Error("error keeping the previous config", "site", siteName, "error", err)
+	}
+	data = append(data, '\n')
+	err = writeFileAtomic(configPath, data, 0644)
+	siteDetails.invalidate(siteName)
+	if err != nil {
+		return err
+	}
+	return writeSiteConfigChecksum(filepath.Join(baseDir, siteName), data)
+}
 
-	encoder := json.NewEncoder(f)
-	encoder.SetIndent("", "  ") // pretty print JSON with indentation
-	return encoder.Encode(config)
+func readSiteConfig(siteName string) (SiteConfig, error) {
+	var config SiteConfig
+	data, err := os.ReadFile(filepath.Join(sitesBaseDir, siteName, siteConfigFile))
+	if err != nil {
+		return config, err
+	}
+	err = json.Unmarshal(data, &config)
+	return config, err
 }
 
-func createARecord(subdomain, ip string) error {
-	apiURL := os.Getenv("DNS_API_RRSETS")
-	apiToken := os.Getenv("DNS_API_AUTH")
+// siteLocks is a mutex per site, created on first use.
+type siteLocks struct {
+	mu    sync.Mutex
+	sites map[string]*sync.Mutex
+}
 
-	if apiURL == "" || apiToken == "" {
-		return fmt.Errorf("DNS API config missing")
+func (l *siteLocks) lock(siteName string) (unlock func()) {
+	l.mu.Lock()
+	mu, ok := l.sites[siteName]
+	if !ok {
+		mu = &sync.Mutex{}
+		l.sites[siteName] = mu
 	}
+	l.mu.Unlock()
+	mu.Lock()
+	return mu.Unlock
+}
 
-	// Clean token string (in case of extra quotes)
-	apiToken = strings.Trim(apiToken, `"`)
+// siteConfigLocks serialize the changes of a site's config, one per site.
+var siteConfigLocks = &siteLocks{sites: map[string]*sync.Mutex{}}
 
-	payload := map[string]interface{}{
-		"subname": subdomain,
-		"type":    "A",
-		"ttl":     3600,
-		"records": []string{ip},
-	}
+func lockSiteConfig(siteName string) (unlock func()) {
+	return siteConfigLocks.lock(siteName)
+}
 
-	jsonData, err := json.Marshal(payload)
+// updateSiteConfig reads the config of a site, changes it with update and
+// writes it back, holding the site's lock throughout, so that concurrent
+// changes (an owner's edit, the scheduler, a suspension) cannot overwrite
+// each other with a config read before. If update fails nothing is written
+// and its error is returned as it is. update must not write the config
+// itself or build the site; builds come after, with the returned config.
+func updateSiteConfig(siteName string, update func(*SiteConfig) error) (SiteConfig, error) {
+	defer lockSiteConfig(siteName)()
+	siteConfig, err := readSiteConfig(siteName)
 	if err != nil {
-		return fmt.Errorf("failed to marshal JSON: %v", err)
+		return siteConfig, err
 	}
-
-	req, err := http.NewRequest("POST", "https://"+apiURL, bytes.NewBuffer(jsonData))
-	if err != nil {
-		return fmt.Errorf("failed to create request: %v", err)
+	if err := update(&siteConfig); err != nil {
+		return siteConfig, err
 	}
+	return siteConfig, writeSiteConfig(sitesBaseDir, siteName, siteConfig)
+}
 
-	req.Header.Set("Authorization", apiToken)
-	req.Header.Set("Content-Type", "application/json")
+// httpError is an error of the client found by an update function, answered
+// with its status.
+type httpError struct {
+	status  int
+	message string
+}
 
-	client := http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return fmt.Errorf("HTTP request failed: %v", err)
-	}
-	defer resp.Body.Close()
+func (e *httpError) Error() string {
+	return e.message
+}
 
-	if resp.StatusCode != http.StatusCreated {
-		return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+// writeSiteUpdateError answers a request whose updateSiteConfig failed: an
+// httpError with its status, an entitlementError like writeEntitlementError,
+// anything else with 500.
+func writeSiteUpdateError(w http.ResponseWriter, r *http.Request, siteName string, err error) {
+	if writeEntitlementError(w, r, err) {
+		return
 	}
+	var he *httpError
+	if errors.As(err, &he) {
+		http.Error(w, he.message, he.status)
+		return
+	}
+	slog.ErrorContext(r.Context(), "error updating site config", "site", siteName, "error", err)
+	http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+}
 
-	return nil
+// siteURL returns the public base URL of a site, without trailing slash.
+func siteURL(siteName string) string {
+	return fmt.Sprintf("https://%s.%s", siteName, config.DNS.Domain)
 }
 
+// dnsHTTPClient talks to the DNS API; dev mode makes it trust the fake API.
+var dnsHTTPClient = &http.Client{}
+
 func createSiteHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -340,36 +1033,155 @@ func createSiteHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Validate site name syntax & blacklist
-	if err := validateSiteName(req.SiteName); err != nil {
-		respondJSON(w, siteCreationResponse{Success: false, Error: err.Error()})
+	if prefersAsync(r) {
+		startSiteCreationJob(w, r, req)
+		return
+	}
+	resp, status := createSite(r, req)
+	writeSiteCreation(w, r, resp, status)
+}
+
+// writeSiteCreation answers a creation request with the result of
+// createSite.
+func writeSiteCreation(w http.ResponseWriter, r *http.Request, resp siteCreationResponse, status int) {
+	if status == http.StatusTooManyRequests {
+		w.Header().Set("Retry-After", fmt.Sprint(int(creationRetryAfter().Seconds())+1))
+	}
+	if status != http.StatusOK {
+		writeAPIError(w, r, status, siteCreationError(resp))
 		return
 	}
+	respondJSON(w, resp)
+}
+
+// siteCreationError is the APIError of a failed creation.
+func siteCreationError(resp siteCreationResponse) *APIError {
+	e := &APIError{Code: resp.Code, Message: resp.Error}
+	if resp.DNSErrorKind != "" {
+		e.Details = map[string]any{"dnsErrorKind": resp.DNSErrorKind}
+	}
+	return e
+}
+
+// createSite creates a site for the JSON API and the signup form. Invalid
+// requests are answered with Success false; when the server fails, status
+// is the HTTP error status and Error its message.
+func createSite(r *http.Request, req siteCreationRequest) (resp siteCreationResponse, status int) {
+	defer func() { countSiteCreation(resp, status) }()
+	if resp, status, ok := checkSiteCreation(r, &req); !ok {
+		return resp, status
+	}
+	premium, isPremium := premiumRuleFor(req.SiteName)
+	var access premiumAccess
+	if isPremium {
+		var err error
+		access, err = checkPremiumAccess(r, req.SiteName, premium.Tier)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "error checking premium access", "site", req.SiteName, "error", err)
+			return siteCreationResponse{Error: "Internal Server Error"}, http.StatusInternalServerError
+		}
+		if access == premiumDenied {
+			return siteCreationResponse{Code: codePremiumName, Error: premiumNameError(req.SiteName, premium)}, http.StatusPaymentRequired
+		}
+	}
+	releaseQuota, reason, err := reserveSiteQuota(r)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error checking the site quota", "error", err)
+		return siteCreationResponse{Error: "Internal Server Error"}, http.StatusInternalServerError
+	}
+	if reason != "" {
+		return siteCreationResponse{Code: codeQuotaExceeded, Error: reason}, http.StatusForbidden
+	}
+	defer releaseQuota()
+	endRun := beginRun(r.Context(), req.SiteName, "create")
+	defer func() {
+		switch {
+		case status != http.StatusOK || !resp.Success:
+			endRun(errors.New(resp.Error))
+		case resp.DNSError != "":
+			endRun(errors.New(resp.DNSError))
+		case resp.WarmupError != "":
+			endRun(errors.New(resp.WarmupError))
+		default:
+			endRun(nil)
+		}
+	}()
 
 	// Check if site exists (redundant to mkdir but nicer UX errors)
 	exists, err := siteExists(req.SiteName)
 	if err != nil {
-		log.Printf("error checking site existence: %v", err)
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-		return
+		slog.ErrorContext(r.Context(), "error checking site existence", "error", err)
+		return siteCreationResponse{Error: "Internal Server Error"}, http.StatusInternalServerError
 	}
 	if exists {
-		respondJSON(w, siteCreationResponse{Success: false, Error: "site name already exists"})
-		return
+		return siteCreationResponse{Success: false, Code: codeSiteExists, Error: "site name already exists"}, http.StatusOK
 	}
+	if currentConfig().Limits.SiteCreationPolicy == "reject" && !takeCreationSlot(req.SiteName) {
+		return siteCreationResponse{Code: codeCreationLimited, Error: "Too many sites are being created right now, please try again later"}, http.StatusTooManyRequests
+	}
+
+	// Every step from here on is undone if a later one fails, so a failed
+	// creation leaves no directory, record or name reservation behind.
+	tx := newProvisioningTx(req.SiteName)
 
-	// Now try to create the directory atomically (acts as lock)
+	// Reserve the name across instances, then create the directory
+	// atomically (acts as the local lock)
+	start := time.Now()
+	err = allocateSiteName(req.SiteName)
+	logStep(req.SiteName, "name.allocate", cmp.Or(config.Registry.AllocatorURL, "local"), start, err)
+	if err != nil {
+		if errors.Is(err, errNameTaken) {
+			return siteCreationResponse{Success: false, Code: codeSiteExists, Error: err.Error()}, http.StatusOK
+		}
+		slog.ErrorContext(r.Context(), "error allocating site name", "site", req.SiteName, "error", err)
+		return siteCreationResponse{Error: "Site names cannot be allocated right now"}, http.StatusServiceUnavailable
+	}
+	tx.onRollback("name", func() error { releaseSiteName(req.SiteName); return nil })
+	if req.Code != "" {
+		start := time.Now()
+		err := redeemCoupon(req.Code, req.SiteName)
+		logStep(req.SiteName, "coupon.redeem", normalizeCouponCode(req.Code), start, err)
+		if err != nil {
+			tx.rollback()
+			if isCouponError(err) {
+				return siteCreationResponse{Success: false, Code: codeInvalidCoupon, Error: err.Error()}, http.StatusOK
+			}
+			slog.ErrorContext(r.Context(), "error redeeming code", "code", req.Code, "error", err)
+			return siteCreationResponse{Error: "Internal Server Error"}, http.StatusInternalServerError
+		}
+		tx.onRollback("coupon", func() error { unredeemCoupon(req.Code, req.SiteName); return nil })
+	}
+	if access == premiumByPurchase {
+		start := time.Now()
+		err := usePremiumPurchase(req.SiteName)
+		logStep(req.SiteName, "premium.purchase", premium.Tier, start, err)
+		if err != nil {
+			tx.rollback()
+			if errors.Is(err, errPremiumPurchaseUsed) {
+				return siteCreationResponse{Code: codePremiumName, Error: premiumNameError(req.SiteName, premium)}, http.StatusPaymentRequired
+			}
+			slog.ErrorContext(r.Context(), "error using premium purchase", "site", req.SiteName, "error", err)
+			return siteCreationResponse{Error: "Internal Server Error"}, http.StatusInternalServerError
+		}
+		tx.onRollback("premium", func() error { unusePremiumPurchase(req.SiteName); return nil })
+	}
+	start = time.Now()
 	err = createSiteDir(req.SiteName)
+	logStep(req.SiteName, "directory", "", start, err)
 	if err != nil {
+		tx.rollback()
 		if strings.Contains(err.Error(), "already exists") {
-			respondJSON(w, siteCreationResponse{Success: false, Error: "site name already exists"})
-			return
+			return siteCreationResponse{Success: false, Code: codeSiteExists, Error: "site name already exists"}, http.StatusOK
 		}
-		log.Printf("error creating site directory: %v", err)
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-		return
+		slog.ErrorContext(r.Context(), "error creating site directory", "error", err)
+		return siteCreationResponse{Error: "Internal Server Error"}, http.StatusInternalServerError
 	}
+	tx.onRollback("directory", func() error {
+		forgetSite(req.SiteName)
+		return removeSiteDir(req.SiteName)
+	})
 
+	unverified := config.Verification.Required
 	config := SiteConfig{
 		SiteName:       req.SiteName,
 		Description:    req.Description,
@@ -377,125 +1189,405 @@ func createSiteHandler(w http.ResponseWriter, r *http.Request) {
 		InitialContent: req.InitialContent,
 		CreatedAt:      time.Now().UTC(),
 	}
-	if err := writeSiteConfig(sitesBaseDir, req.SiteName, config); err != nil {
-		log.Printf("error writing site config: %v", err)
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-		return
+	if req.Code != "" {
+		config.Coupon = normalizeCouponCode(req.Code)
 	}
-	siteIP := os.Getenv("SITE_IP")
-	if siteIP == "" {
-		log.Fatal("SITE_IP is not set in environment")
+	if isPremium {
+		config.PremiumTier = premium.Tier
+	}
+	config.OwnerEmail = req.Email
+	config.UserID = currentUserID(r)
+	config.Unverified = unverified
+	start = time.Now()
+	err = writeSiteConfig(sitesBaseDir, req.SiteName, config)
+	logStep(req.SiteName, "config", "", start, err)
+	if err != nil {
+		tx.rollback()
+		slog.ErrorContext(r.Context(), "error writing site config", "error", err)
+		return siteCreationResponse{Error: "Internal Server Error"}, http.StatusInternalServerError
 	}
-	err = createARecord(req.SiteName, siteIP)
+	start = time.Now()
+	scaffold, err := scaffoldSite(config)
+	logStep(req.SiteName, "scaffold", scaffold, start, err)
 	if err != nil {
-		log.Printf("failed to create DNS A record: %v", err)
-		// handle error, maybe rollback or return 500
+		tx.rollback()
+		slog.ErrorContext(r.Context(), "error scaffolding site", "site", req.SiteName, "error", err)
+		return siteCreationResponse{Error: "Internal Server Error"}, http.StatusInternalServerError
+	}
+	recordSiteEvent(req.SiteName, SiteEvent{Type: "site.created"})
+	resp = siteCreationResponse{Success: true, SiteURL: siteURL(req.SiteName)}
+
+	// Unverified sites are published by verifySiteHandler
+	if config.Unverified {
+		resp.VerificationRequired = true
+		start := time.Now()
+		err := sendSiteVerification(r, req.SiteName, req.Email)
+		logStep(req.SiteName, "verification.mail", "to "+req.Email, start, err)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "error sending verification", "site", req.SiteName, "error", err)
+		}
+		recordFunnelStep(r, "created")
+		recordAudit(r.Context(), "site.create", req.SiteName, req)
+		return resp, http.StatusOK
 	}
-	// TODO: Initialize site - create config files, provision CMS, create DNS records, etc.
+	release := acquireJobSlot(req.SiteName, jobClassFor(r, config))
+	err = provisionSite(r.Context(), req.SiteName, tx)
+	release()
+	var dnsErr *DNSError
+	switch {
+	case errors.Is(err, errDNSPending):
+		// The site is up, only its record waits for the DNS provider.
+		slog.WarnContext(r.Context(), "queued DNS A record", "site", req.SiteName, "error", err)
+		resp.DNSPending = true
+		resp.DNSError = "Your site will be reachable as soon as our DNS provider is available again"
+		if errors.Is(err, errCreationLimited) {
+			resp.DNSError = "Many sites are being created right now, your site will be reachable within the hour"
+		}
+		if errors.As(err, &dnsErr) {
+			resp.DNSErrorKind = dnsErr.Kind
+		}
+	case err != nil:
+		slog.ErrorContext(r.Context(), "error provisioning site", "site", req.SiteName, "error", err)
+		tx.rollback()
+		status, message := dnsErrorResponse(err)
+		if errors.As(err, &dnsErr) {
+			return siteCreationResponse{Code: codeDNSProvisionFailed, Error: message, DNSErrorKind: dnsErr.Kind}, status
+		}
+		return siteCreationResponse{Error: message}, status
+	default:
+		if err := warmUpSite(r.Context(), req.SiteName); err != nil {
+			slog.WarnContext(r.Context(), "site did not answer after creation", "site", req.SiteName, "error", err)
+			resp.WarmupError = "Your site was created but does not answer yet, it should be reachable within a few minutes"
+		}
+	}
+	recordFunnelStep(r, "created")
+	recordAudit(r.Context(), "site.create", req.SiteName, req)
 
 	// Respond with success and constructed site URL
-	siteURL := fmt.Sprintf("https://%s.flox.click", req.SiteName)
-	respondJSON(w, siteCreationResponse{Success: true, SiteURL: siteURL})
+	return resp, http.StatusOK
 }
 
-func getSectionsHandler(w http.ResponseWriter, r *http.Request) {
-	sections := []struct {
-		ID          string `json:"id"`
-		Name        string `json:"name"`
-		Description string `json:"description"`
-		Mandatory   bool   `json:"mandatory"`
-	}{
-		{ID: "header", Name: "Header", Description: "Navigation bar", Mandatory: true},
-		{ID: "footer", Name: "Footer", Description: "Impressum and privacy", Mandatory: true},
-		{ID: "hero", Name: "Hero Section", Description: "Full-width banner", Mandatory: false},
-		{ID: "features", Name: "Features", Description: "Services showcase", Mandatory: false},
-		{ID: "testimonials", Name: "Testimonials", Description: "Customer reviews", Mandatory: false},
-		{ID: "contact", Name: "Contact Form", Description: "Visitor contact", Mandatory: false},
+// checkSiteCreation validates a creation request and normalizes its email
+// address. When it fails, it returns the response.
+func checkSiteCreation(r *http.Request, req *siteCreationRequest) (resp siteCreationResponse, status int, ok bool) {
+	if config.Auth.Required && currentUserID(r) == "" && r.Context().Value(adminTokenKey{}) == nil {
+		return siteCreationResponse{Code: codeLoginRequired, Error: "Login required"}, http.StatusUnauthorized, false
+	}
+	if req.Email == "" {
+		req.Email = currentUserEmail(r)
+	}
+	// Validate site name syntax & blacklist
+	if err := validateSiteNameFor(r, req.SiteName); err != nil && !collisionOverridden(r, *req, err) {
+		return siteCreationResponse{Success: false, Code: errorCode(err, codeNameInvalid), Error: err.Error()}, http.StatusOK, false
+	}
+	if req.Email != "" || config.Verification.Required {
+		addr, err := mail.ParseAddress(strings.TrimSpace(req.Email))
+		if err != nil {
+			return siteCreationResponse{Success: false, Code: codeInvalidField, Error: "a valid email address is required"}, http.StatusOK, false
+		}
+		req.Email = addr.Address
+	}
+	if err := validateCreationFields(req); err != nil {
+		return siteCreationResponse{Success: false, Code: codeInvalidField, Error: err.Error()}, http.StatusOK, false
+	}
+	if err := checkSectionEntitlements(SiteConfig{}, req.InitialContent); err != nil {
+		var e entitlementError
+		errors.As(err, &e)
+		return siteCreationResponse{Code: e.code(), Error: e.Error()}, e.status(), false
 	}
+	return siteCreationResponse{}, http.StatusOK, true
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(sections)
+type sectionInfo struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Mandatory   bool   `json:"mandatory"`
 }
 
-func getThemesHandler(w http.ResponseWriter, r *http.Request) {
-	themes := []struct {
-		ID    string `json:"id"`
-		Name  string `json:"name"`
-		Image string `json:"image,omitempty"`
-	}{
-		{ID: "light", Name: "Light Theme"},
-		{ID: "dark", Name: "Dark Theme"},
-		{ID: "material", Name: "Material Design"},
-		{ID: "minimal", Name: "Minimalist"},
+var sections = []sectionInfo{
+	{ID: "header", Name: "Header", Description: "Navigation bar", Mandatory: true},
+	{ID: "footer", Name: "Footer", Description: "Impressum and privacy", Mandatory: true},
+	{ID: "hero", Name: "Hero Section", Description: "Full-width banner", Mandatory: false},
+	{ID: "features", Name: "Features", Description: "Services showcase", Mandatory: false},
+	{ID: "testimonials", Name: "Testimonials", Description: "Customer reviews", Mandatory: false},
+	{ID: "contact", Name: "Contact Form", Description: "Visitor contact", Mandatory: false},
+	{ID: "form", Name: "Forms", Description: "Custom forms built from fields", Mandatory: false},
+	{ID: "booking", Name: "Book an Appointment", Description: "Appointment booking", Mandatory: false},
+	{ID: "blog", Name: "Blog", Description: "News and articles", Mandatory: false},
+	{ID: "shop", Name: "Shop", Description: "Products with payment links", Mandatory: false},
+	{ID: "newsletter", Name: "Newsletter", Description: "Newsletter signup", Mandatory: false},
+	{ID: "social", Name: "Social Media", Description: "Recent posts from Instagram, Facebook or Mastodon", Mandatory: false},
+	{ID: "location", Name: "Location", Description: "Address with a map", Mandatory: false},
+	{ID: "hours", Name: "Opening Hours", Description: "Weekly opening hours and holidays", Mandatory: false},
+}
+
+func findSection(id string) (sectionInfo, bool) {
+	for _, s := range sections {
+		if s.ID == id {
+			return s, true
+		}
 	}
+	return sectionInfo{}, false
+}
 
+func getSectionsHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(themes)
+	json.NewEncoder(w).Encode(sections)
 }
 
 func main() {
+	setupLogging()
+	// migrate must run on any schema, all else needs the current one.
+	if !strings.HasPrefix(commandName, "migrate") {
+		if err := checkSchema(); err != nil {
+			fatal("schema check failed", "error", err)
+		}
+	}
+	loadThemes()
+	if selectedCommand != nil {
+		if err := selectedCommand.run(pflag.Args()); err != nil {
+			fatal("command failed", "command", commandName, "error", err)
+		}
+		return
+	}
+	if err := setupTracing(); err != nil {
+		fatal("error setting up tracing", "error", err)
+	}
+	checkSiteConfigs()
+	initSiteHooks()
+	if err := loadWebhooks(); err != nil {
+		fatal("error loading webhooks", "error", err)
+	}
+	publishThemes()
+
 	mux := http.NewServeMux()
-	mux.HandleFunc("/api/sites/validate-name", validateSiteNameHandler)
-	mux.HandleFunc("/api/sites", createSiteHandler)
-	mux.HandleFunc("/api/sections", getSectionsHandler)
-	mux.HandleFunc("/api/themes", getThemesHandler)
-
-	mux.HandleFunc("/api/health", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]string{
-			"status":  "OK",
-			"version": Version,
-		})
-	})
-	c := cors.New(cors.Options{
-
-		AllowedOrigins: []string{
-			"https://flox.click",
-			"https://www.flox.click",
-			"https://app.flox.click",
-			"http://localhost:3000", // For local development
-			"http://127.0.0.1:3000", // For local development
-		},
-		AllowedMethods:   []string{"GET", "POST", "OPTIONS"},
-		AllowedHeaders:   []string{"Content-Type"},
-		AllowCredentials: true,
-		Debug:            true, // Enable for troubleshooting
-	})
+	handlePublic(mux, "POST /api/v1/sites/validate-name", rateLimited(validateSiteNameHandler))
+	mux.HandleFunc("GET /api/v1/sites", listSitesHandler)
+	mux.HandleFunc("GET /api/v1/quota", getQuotaHandler)
+	mux.HandleFunc("GET /api/v1/sites/{siteName}/plan", getSitePlanHandler)
+	handleToken(mux, "POST /api/v1/sites", withAdminToken(idempotent(rateLimited(createSiteHandler))))
+	handleToken(mux, "GET /api/v1/jobs/{jobId}", withAdminToken(getJobHandler))
+	handleToken(mux, "GET /api/v1/sites/{siteName}", withAdminToken(getSiteHandler))
+	handleToken(mux, "PATCH /api/v1/sites/{siteName}", withAdminToken(patchSiteHandler))
+	handleToken(mux, "DELETE /api/v1/sites/{siteName}", withAdminToken(deleteSiteHandler))
+	handleToken(mux, "GET /api/v1/terraform/sites/{siteName}", withAdminToken(getTerraformSiteHandler))
+	handleToken(mux, "PUT /api/v1/terraform/sites/{siteName}", withAdminToken(idempotent(rateLimited(putTerraformSiteHandler))))
+	handleToken(mux, "DELETE /api/v1/terraform/sites/{siteName}", withAdminToken(deleteTerraformSiteHandler))
+	handleToken(mux, "GET /api/v1/terraform/sites/{siteName}/dns", withAdminToken(getDelegationHandler))
+	handleToken(mux, "PUT /api/v1/terraform/sites/{siteName}/dns", withAdminToken(putTerraformDNSHandler))
+	handleToken(mux, "DELETE /api/v1/terraform/sites/{siteName}/dns", withAdminToken(deleteTerraformDNSHandler))
+	handleToken(mux, "GET /api/v1/terraform/sites/{siteName}/domains/{domain}", withAdminToken(getTerraformDomainHandler))
+	handleToken(mux, "PUT /api/v1/terraform/sites/{siteName}/domains/{domain}", withAdminToken(putTerraformDomainHandler))
+	handleToken(mux, "DELETE /api/v1/terraform/sites/{siteName}/domains/{domain}", withAdminToken(deleteTerraformDomainHandler))
+	mux.HandleFunc("/api/v1/sections", getSectionsHandler)
+	mux.HandleFunc("/api/v1/themes", getThemesHandler)
+	handlePublic(mux, "GET /api/v1/themes/{themeId}/preview", getThemePreviewHandler)
+	if config.Themes.CDNURL == "" {
+		handlePublic(mux, "GET "+themeAssetsPath, themeAssetsHandler().ServeHTTP)
+	}
+	handlePublic(mux, "GET /api/v1/meta/validation", getValidationSchemaHandler)
+	handlePublic(mux, "GET /api/v1/config/bootstrap", getBootstrapConfigHandler)
+	handlePublic(mux, "GET /api/v1/openapi.json", openAPIHandler(mux))
+	handlePublic(mux, "GET /api/v1/docs", apiDocsHandler)
+	mux.HandleFunc("POST /api/v1/sites/{siteName}/build", buildSiteHandler)
+	mux.HandleFunc("GET /api/v1/sites/{siteName}/accessibility", getAccessibilityHandler)
+	mux.HandleFunc("GET /api/v1/sites/{siteName}/timeline", getTimelineHandler)
+	mux.HandleFunc("GET /api/v1/sites/{siteName}/provisioning-log", getProvisioningLogHandler)
+	mux.HandleFunc("GET /api/v1/sites/{siteName}/domains", listDomainsHandler)
+	mux.HandleFunc("POST /api/v1/sites/{siteName}/domains", addDomainHandler)
+	mux.HandleFunc("POST /api/v1/sites/{siteName}/domains/{domain}/verify", verifyDomainHandler)
+	mux.HandleFunc("DELETE /api/v1/sites/{siteName}/domains/{domain}", deleteDomainHandler)
+	mux.HandleFunc("POST /api/v1/sites/{siteName}/certificate", issueCertificateHandler)
+	mux.HandleFunc("GET /api/v1/sites/{siteName}/dns/delegation", getDelegationHandler)
+	mux.HandleFunc("PUT /api/v1/sites/{siteName}/dns/delegation", putDelegationHandler)
+	mux.HandleFunc("DELETE /api/v1/sites/{siteName}/dns/delegation", deleteDelegationHandler)
+	mux.HandleFunc("PUT /api/v1/sites/{siteName}/sections/{sectionId}/schedule", setSectionScheduleHandler)
+	mux.HandleFunc("GET /api/v1/sites/{siteName}/forms", listFormsHandler)
+	mux.HandleFunc("PUT /api/v1/sites/{siteName}/forms/{formId}", putFormHandler)
+	mux.HandleFunc("DELETE /api/v1/sites/{siteName}/forms/{formId}", deleteFormHandler)
+	handlePublic(mux, "POST /api/v1/sites/{siteName}/forms/{formId}/submissions", regionGuard(submitFormHandler))
+	mux.HandleFunc("GET /api/v1/sites/{siteName}/forms/{formId}/submissions", listSubmissionsHandler)
+	mux.HandleFunc("PUT /api/v1/sites/{siteName}/booking", putBookingConfigHandler)
+	handlePublic(mux, "GET /api/v1/sites/{siteName}/booking/slots", regionGuard(getBookingSlotsHandler))
+	mux.HandleFunc("GET /api/v1/sites/{siteName}/booking/bookings", listBookingsHandler)
+	handlePublic(mux, "POST /api/v1/sites/{siteName}/booking/bookings", regionGuard(createBookingHandler))
+	mux.HandleFunc("GET /api/v1/sites/{siteName}/posts", listPostsHandler)
+	mux.HandleFunc("POST /api/v1/sites/{siteName}/posts", createPostHandler)
+	mux.HandleFunc("GET /api/v1/sites/{siteName}/posts/{slug}", getPostHandler)
+	mux.HandleFunc("PUT /api/v1/sites/{siteName}/posts/{slug}", updatePostHandler)
+	mux.HandleFunc("DELETE /api/v1/sites/{siteName}/posts/{slug}", deletePostHandler)
+	handlePublic(mux, "GET /api/v1/sites/{siteName}/posts/{slug}/comments", regionGuard(listPostCommentsHandler))
+	handlePublic(mux, "POST /api/v1/sites/{siteName}/posts/{slug}/comments", regionGuard(createCommentHandler))
+	mux.HandleFunc("PUT /api/v1/sites/{siteName}/comments/settings", putCommentSettingsHandler)
+	mux.HandleFunc("GET /api/v1/sites/{siteName}/comments", listCommentsHandler)
+	mux.HandleFunc("PATCH /api/v1/sites/{siteName}/comments/{commentId}", moderateCommentHandler)
+	mux.HandleFunc("DELETE /api/v1/sites/{siteName}/comments/{commentId}", deleteCommentHandler)
+	mux.HandleFunc("GET /api/v1/sites/{siteName}/products", listProductsHandler)
+	mux.HandleFunc("POST /api/v1/sites/{siteName}/products", createProductHandler)
+	mux.HandleFunc("GET /api/v1/sites/{siteName}/products/{productId}", getProductHandler)
+	mux.HandleFunc("PUT /api/v1/sites/{siteName}/products/{productId}", updateProductHandler)
+	mux.HandleFunc("DELETE /api/v1/sites/{siteName}/products/{productId}", deleteProductHandler)
+	mux.HandleFunc("PUT /api/v1/sites/{siteName}/newsletter", putNewsletterConfigHandler)
+	handlePublic(mux, "POST /api/v1/sites/{siteName}/newsletter/subscribe", regionGuard(subscribeNewsletterHandler))
+	mux.HandleFunc("PUT /api/v1/sites/{siteName}/social-feeds/{feedId}", putSocialFeedHandler)
+	mux.HandleFunc("DELETE /api/v1/sites/{siteName}/social-feeds/{feedId}", deleteSocialFeedHandler)
+	handlePublic(mux, "GET /api/v1/sites/{siteName}/social-feeds/{feedId}/posts", regionGuard(getSocialPostsHandler))
+	mux.HandleFunc("PUT /api/v1/sites/{siteName}/location", putLocationHandler)
+	handlePublic(mux, "POST /api/v1/sites/{siteName}/pageviews", regionGuard(collectPageviewHandler))
+	mux.HandleFunc("GET /api/v1/sites/{siteName}/analytics", getAnalyticsHandler)
+	mux.HandleFunc("GET /api/v1/sites/{siteName}/pages", listPagesHandler)
+	mux.HandleFunc("POST /api/v1/sites/{siteName}/pages", createPageHandler)
+	mux.HandleFunc("GET /api/v1/sites/{siteName}/pages/{slug}", getPageHandler)
+	mux.HandleFunc("PUT /api/v1/sites/{siteName}/pages/{slug}", updatePageHandler)
+	mux.HandleFunc("DELETE /api/v1/sites/{siteName}/pages/{slug}", deletePageHandler)
+	mux.HandleFunc("GET /api/v1/sites/{siteName}/opening-hours", getOpeningHoursHandler)
+	mux.HandleFunc("PUT /api/v1/sites/{siteName}/opening-hours", putOpeningHoursHandler)
+	handlePublic(mux, "GET /api/v1/sites/{siteName}/opening-hours/status", regionGuard(openingStatusHandler))
+	mux.HandleFunc("PUT /api/v1/sites/{siteName}/region-rules", putRegionRulesHandler)
+	mux.HandleFunc("GET /api/v1/sites/{siteName}/settings/headers", getHeaderSettingsHandler)
+	mux.HandleFunc("PUT /api/v1/sites/{siteName}/settings/headers", putHeaderSettingsHandler)
+	mux.HandleFunc("GET /api/v1/rest-hooks/triggers", listRESTHookTriggersHandler)
+	mux.HandleFunc("GET /api/v1/sites/{siteName}/rest-hooks", listRESTHooksHandler)
+	mux.HandleFunc("POST /api/v1/sites/{siteName}/rest-hooks", subscribeRESTHookHandler)
+	mux.HandleFunc("DELETE /api/v1/sites/{siteName}/rest-hooks/{hookId}", unsubscribeRESTHookHandler)
+	mux.HandleFunc("GET /api/v1/sites/{siteName}/rest-hooks/samples/{trigger}", getRESTHookSamplesHandler)
+
+	mux.HandleFunc("GET /api/v1/version", versionHandler)
+	mux.HandleFunc("POST /api/v1/auth/register", rateLimited(registerHandler))
+	mux.HandleFunc("POST /api/v1/auth/login", rateLimited(loginHandler))
+	mux.HandleFunc("GET /api/v1/auth/me", getCurrentUserHandler)
+	mux.HandleFunc("DELETE /api/v1/auth/me", deleteCurrentUserHandler)
+	mux.HandleFunc("GET /api/v1/auth/me/deletion", getAccountDeletionHandler)
+	mux.HandleFunc("DELETE /api/v1/auth/me/deletion", cancelAccountDeletionHandler)
+	mux.HandleFunc("GET /api/v1/auth/config", getAuthConfigHandler)
+	handleToken(mux, "GET /api/v1/retention", adminAuth(getRetentionHandler))
+	handleToken(mux, "GET /api/v1/archive", adminAuth(listArchivesHandler))
+	handleToken(mux, "GET /api/v1/archive/{siteName}/{archiveId}", adminAuth(getArchiveHandler))
+	mux.HandleFunc("POST /api/v1/funnel/events", funnelEventHandler)
+	handleToken(mux, "GET /api/v1/funnel", adminAuth(getFunnelHandler))
+	handleToken(mux, "GET /api/v1/coupons", adminAuth(listCouponsHandler))
+	handleToken(mux, "PUT /api/v1/coupons/{code}", adminAuth(putCouponHandler))
+	handleToken(mux, "DELETE /api/v1/coupons/{code}", adminAuth(deleteCouponHandler))
+	mux.HandleFunc("GET /api/v1/coupons/{code}/check", checkCouponHandler)
+	handleToken(mux, "GET /api/v1/dns/mock", adminAuth(getDNSMockHandler))
+	handleToken(mux, "DELETE /api/v1/dns/mock", adminAuth(resetDNSMockHandler))
+	handlePublic(mux, "GET /api/v1/sites/{siteName}/verify", verifySiteHandler) // link in the verification mail
+	mux.HandleFunc("POST /api/v1/sites/{siteName}/verification", resendVerificationHandler)
+	if config.Registry.Token != "" {
+		// This instance allocates site names for the others.
+		handleToken(mux, "GET /api/v1/allocations/{siteName}", allocatorAuth(getAllocationHandler))
+		handleToken(mux, "PUT /api/v1/allocations/{siteName}", allocatorAuth(putAllocationHandler))
+		handleToken(mux, "DELETE /api/v1/allocations/{siteName}", allocatorAuth(deleteAllocationHandler))
+	}
+	handleToken(mux, "GET /api/v1/admin/config", adminAuth(exportConfigHandler))
+	handleToken(mux, "POST /api/v1/admin/config", adminAuth(importConfigHandler))
+	handleToken(mux, "GET /api/v1/admin/hooks", adminAuth(listHooksHandler))
+	handleToken(mux, "GET /metrics", metricsHandler)
+	handleToken(mux, "PUT /api/v1/admin/sites/{siteName}/plan", adminAuth(putSitePlanHandler))
+	handleToken(mux, "GET /api/v1/admin/integrity", adminAuth(getIntegrityHandler))
+	handleToken(mux, "GET /api/v1/admin/gitops", adminAuth(getGitOpsHandler))
+	handleToken(mux, "POST /api/v1/admin/gitops/sync", adminAuth(syncGitOpsHandler))
+	handleToken(mux, "GET /api/v1/admin/audit", adminAuth(getAuditHandler))
+	mux.HandleFunc("GET /api/v1/calendar", listCalendarFeedsHandler)
+	mux.HandleFunc("GET /api/v1/calendar/admin/events.ics", adminCalendarHandler)
+	mux.HandleFunc("GET /api/v1/calendar/orgs/{orgId}/events.ics", orgCalendarHandler)
+	handleToken(mux, "GET /api/v1/admin/orgs", adminAuth(listOrgsHandler))
+	handleToken(mux, "PUT /api/v1/admin/orgs/{orgId}", adminAuth(putOrgHandler))
+	handleToken(mux, "DELETE /api/v1/admin/orgs/{orgId}", adminAuth(deleteOrgHandler))
+	handleToken(mux, "GET /api/v1/admin/premium-names", adminAuth(listPremiumPurchasesHandler))
+	handleToken(mux, "PUT /api/v1/admin/premium-names/{siteName}", adminAuth(putPremiumPurchaseHandler))
+	handleToken(mux, "DELETE /api/v1/admin/premium-names/{siteName}", adminAuth(deletePremiumPurchaseHandler))
+	handleToken(mux, "GET /api/v1/admin/email-templates", adminAuth(listEmailTemplatesHandler))
+	handleToken(mux, "GET /api/v1/admin/email-templates/{name}", adminAuth(getEmailTemplateHandler))
+	handleToken(mux, "POST /api/v1/admin/email-templates/{name}/preview", adminAuth(previewEmailTemplateHandler))
+	handleToken(mux, "POST /api/v1/admin/email-templates/{name}/test", adminAuth(testEmailTemplateHandler))
+	handleToken(mux, "POST /api/v1/admin/integrity", adminAuth(sweepIntegrityHandler))
+	handleToken(mux, "POST /api/v1/admin/sites/{siteName}/config/restore", adminAuth(siteRecordActionHandler(restoreSiteRecordByAdmin)))
+	handleToken(mux, "POST /api/v1/admin/sites/{siteName}/config/accept", adminAuth(siteRecordActionHandler(acceptSiteRecord)))
+	handleToken(mux, "POST /api/v1/admin/themes/reload", adminAuth(reloadThemesHandler))
+	handleToken(mux, "GET /api/v1/admin/moderation", adminAuth(listModerationHandler))
+	handleToken(mux, "GET /api/v1/admin/moderation/{siteName}", adminAuth(getModerationHandler))
+	handleToken(mux, "POST /api/v1/admin/moderation/{siteName}/scan", adminAuth(scanModerationHandler))
+	handleToken(mux, "POST /api/v1/admin/moderation/{siteName}/approve", adminAuth(approveModerationHandler))
+	handleToken(mux, "POST /api/v1/admin/moderation/{siteName}/suspend", adminAuth(suspendModerationHandler))
+	handleToken(mux, "GET /api/v1/admin/account-deletions", adminAuth(listAccountDeletionsHandler))
+	handleToken(mux, "DELETE /api/v1/admin/users/{userId}", adminAuth(deleteUserHandler))
+	handleToken(mux, "DELETE /api/v1/admin/users/{userId}/deletion", adminAuth(cancelAccountDeletionHandler))
+	handleToken(mux, "GET /api/v1/admin/webhooks", adminAuth(listWebhooksHandler))
+	handleToken(mux, "POST /api/v1/admin/webhooks", adminAuth(createWebhookHandler))
+	handleToken(mux, "DELETE /api/v1/admin/webhooks/{webhookId}", adminAuth(deleteWebhookHandler))
+	handleToken(mux, "GET /api/v1/admin/webhooks/{webhookId}/deliveries", adminAuth(listWebhookDeliveriesHandler))
+	handleToken(mux, "POST /api/v1/admin/webhooks/{webhookId}/deliveries/{deliveryId}/redeliver", adminAuth(redeliverWebhookHandler))
+	handleToken(mux, "POST /api/v1/admin/webhooks/{webhookId}/ping", adminAuth(pingWebhookHandler))
+	if config.Server.SignupForm {
+		mux.HandleFunc("GET /signup", signupFormHandler)
+		mux.HandleFunc("POST /signup", rateLimited(signupSubmitHandler))
+	}
+	mux.HandleFunc("/api/v1/health", healthHandler)
+	mux.HandleFunc("GET /api/v1/health/live", liveHandler)
+	mux.HandleFunc("GET /api/v1/health/ready", readyHandler)
+	if uiFiles != nil && config.Server.ServeUI {
+		// Registered without a method, a "GET /" pattern would conflict with
+		// the method-less API routes.
+		mux.Handle("/", spaHandler(uiFiles))
+		slog.Info("Serving the embedded frontend on /")
+	}
 
-	var listener net.Listener
-	var err error
+	c := dashboardCORS
 
-	if port > 0 {
-		addr := fmt.Sprintf("127.0.0.1:%d", port)
-		listener, err = net.Listen("tcp", addr)
-		if err != nil {
-			log.Fatalf("Failed to bind to port %d: %v", port, err)
-		}
-		fmt.Printf("Server is listening on %s\n", addr)
+	listener, err := listenAPI()
+	if err != nil {
+		fatal("Failed to listen", "listen", cmp.Or(config.Server.Listen, "tcp"), "port", port, "error", err)
+	}
+	fmt.Printf("Server is listening on %s\n", listener.Addr())
+	if port > 0 || config.Server.Listen != "" {
 		fmt.Printf("VERSION: %q\n", Version)
-	} else {
-		// Let OS pick free port
-		listener, err = net.Listen("tcp", "127.0.0.1:0")
-		if err != nil {
-			log.Fatalf("Failed to listen on a free port: %v", err)
-		}
-		addr := listener.Addr().(*net.TCPAddr)
-		fmt.Printf("Server is listening on 127.0.0.1:%d\n", addr.Port)
 	}
 	defer listener.Close()
 
-	handler := c.Handler(mux)
+	if devMode {
+		startDevEnvironment()
+		// The frontend dev server may run on any port.
+		allowAll := cors.AllowAll()
+		c = func() *cors.Cors { return allowAll }
+	}
+	openGeoIP(config.GeoIP.DatabasePath, config.GeoIP.RefreshInterval)
+	watchConfig()
+	go runScheduler(config.Scheduler.Interval)
+	go runDiskMonitor(config.Disk.CheckInterval)
+	go runIntegritySweep(config.Integrity.SweepInterval)
+	if config.GitOps.Repo != "" {
+		go runGitOps()
+	}
+	if config.Hosting.Enabled {
+		go func() {
+			fatal("Site server error", "error", serveSites())
+		}()
+	}
+
+	handler := corsHandler(mux, readOnlyGuard(mux, authenticate(mux)), c, publicCORS())
+	handler = faultHeaders(handler)
+	handler = metricsMiddleware(mux, handler)
+	handler = tracingMiddleware(mux, handler)
+	handler = apiVersioning(mux, handler)
+	handler = apiErrors(handler)
 	handler = loggingMiddleware(handler)
 
-	if err := http.Serve(listener, handler); err != nil {
-		log.Fatalf("Server error: %v", err)
+	tlsConfig, err := apiTLSConfig()
+	if err != nil {
+		fatal("invalid API TLS config", "error", err)
 	}
-}
-
-// Simple logging middleware
-func loggingMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		log.Printf("%s %s %s", r.RemoteAddr, r.Method, r.URL)
-		next.ServeHTTP(w, r)
-	})
+	server := &http.Server{Handler: handler}
+	done := shutdownOnSignal(server)
+	if tlsConfig != nil {
+		slog.Info("Serving the API over HTTPS")
+		err = serveTLS(server, listener, tlsConfig)
+	} else {
+		err = server.Serve(listener)
+	}
+	if !errors.Is(err, http.ErrServerClosed) {
+		fatal("Server error", "error", err)
+	}
+	<-done
 }
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// The validation schema lets clients such as the wizard check a creation
+// request locally with the server's own rules instead of a copy that drifts.
+// It is built from the values the handlers check against, so a policy
+// change (a reserved name, a new theme or section) shows up here at once.
+// The bootstrap config is what the frontend needs at startup besides it: the
+// domain, which features are on and the frontend settings of the config.
+// Both only contain what any visitor may see.
+
+var localeRegex = regexp.MustCompile(`^[a-z]{2,3}(-[A-Za-z0-9]{2,8})*$`)
+
+// validateFrontend checks the frontend settings of a config.
+func validateFrontend(c *Config) error {
+	switch c.Frontend.CaptchaProvider {
+	case "", "hcaptcha", "turnstile", "recaptcha":
+	default:
+		return fmt.Errorf("frontend.captcha_provider must be hcaptcha, turnstile or recaptcha, not %q", c.Frontend.CaptchaProvider)
+	}
+	if (c.Frontend.CaptchaProvider == "") != (c.Frontend.CaptchaSiteKey == "") {
+		return fmt.Errorf("frontend.captcha_provider and frontend.captcha_site_key are needed together")
+	}
+	for _, locale := range c.Frontend.Locales {
+		if !localeRegex.MatchString(locale) {
+			return fmt.Errorf("frontend.locales: %q is not a language tag like en or pt-BR", locale)
+		}
+	}
+	if !slices.Contains(c.Frontend.Locales, c.Frontend.DefaultLocale) {
+		return fmt.Errorf("frontend.default_locale %q is not in frontend.locales", c.Frontend.DefaultLocale)
+	}
+	return nil
+}
+
+type siteNamePolicy struct {
+	Pattern          string   `json:"pattern"`
+	MinLength        int      `json:"minLength"`
+	MaxLength        int      `json:"maxLength"`
+	CaseInsensitive  bool     `json:"caseInsensitive"` // names are checked lowercased
+	Reserved         []string `json:"reserved"`
+	ReservedPrefixes []string `json:"reservedPrefixes"`
+}
+
+// fieldRule describes one field of a creation request, in the vocabulary of
+// JSON Schema where there is one.
+type fieldRule struct {
+	Type            string     `json:"type"` // string or array
+	Required        bool       `json:"required"`
+	Pattern         string     `json:"pattern,omitempty"`
+	CaseInsensitive bool       `json:"caseInsensitive,omitempty"`
+	MinLength       int        `json:"minLength,omitempty"`
+	MaxLength       int        `json:"maxLength,omitempty"`
+	Format          string     `json:"format,omitempty"`
+	Enum            []string   `json:"enum,omitempty"`
+	Items           *fieldRule `json:"items,omitempty"`
+	UniqueItems     bool       `json:"uniqueItems,omitempty"`
+	// MustContain are items an array has to include, e.g. the mandatory
+	// sections.
+	MustContain []string `json:"mustContain,omitempty"`
+}
+
+type validationSchema struct {
+	SiteName siteNamePolicy `json:"siteName"`
+	// Fields are those of POST /api/v1/sites.
+	Fields map[string]fieldRule `json:"fields"`
+}
+
+func currentValidationSchema() validationSchema {
+	reserved := make([]string, 0, len(siteNameBlacklist))
+	for name := range siteNameBlacklist {
+		reserved = append(reserved, name)
+	}
+	for _, name := range currentConfig().Sites.ReservedNames {
+		reserved = append(reserved, strings.ToLower(name))
+	}
+	slices.Sort(reserved)
+	reserved = slices.Compact(reserved)
+	var themeIDs, sectionIDs, mandatory []string
+	for _, t := range currentThemes() {
+		themeIDs = append(themeIDs, t.ID)
+	}
+	for _, s := range sections {
+		sectionIDs = append(sectionIDs, s.ID)
+		if s.Mandatory {
+			mandatory = append(mandatory, s.ID)
+		}
+	}
+
+	name := siteNamePolicy{
+		Pattern:          siteNameRegex.String(),
+		MinLength:        1,
+		MaxLength:        63,
+		CaseInsensitive:  true,
+		Reserved:         reserved,
+		ReservedPrefixes: siteNameReservedPrefixes,
+	}
+	return validationSchema{
+		SiteName: name,
+		Fields: map[string]fieldRule{
+			"siteName":    {Type: "string", Required: true, Pattern: name.Pattern, MinLength: name.MinLength, MaxLength: name.MaxLength},
+			"description": {Type: "string", MaxLength: maxSiteDescriptionLength},
+			"style":       {Type: "string", Enum: themeIDs},
+			"initialContent": {
+				Type:        "array",
+				Items:       &fieldRule{Type: "string", Enum: sectionIDs},
+				UniqueItems: true,
+				MustContain: mandatory,
+			},
+			"code":  {Type: "string", Pattern: couponCodeRegex.String(), CaseInsensitive: true},
+			"email": {Type: "string", Format: "email", Required: config.Verification.Required},
+		},
+	}
+}
+
+// getValidationSchemaHandler serves the validation schema of site creation.
+func getValidationSchemaHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	respondJSON(w, currentValidationSchema())
+}
+
+type captchaConfig struct {
+	Provider string `json:"provider"`
+	SiteKey  string `json:"siteKey"`
+}
+
+type oidcBootstrap struct {
+	Issuer   string `json:"issuer"`
+	ClientID string `json:"clientId"`
+}
+
+type bootstrapConfig struct {
+	Version       string         `json:"version"`
+	Domain        string         `json:"domain"`              // sites are <name>.<domain>
+	PublicURL     string         `json:"publicUrl,omitempty"` // of this API
+	Locales       []string       `json:"locales"`
+	DefaultLocale string         `json:"defaultLocale"`
+	Captcha       *captchaConfig `json:"captcha,omitempty"`
+	OIDC          *oidcBootstrap `json:"oidc,omitempty"`
+	// Features that are on, by name
+	Features   map[string]bool  `json:"features"`
+	Validation validationSchema `json:"validation"`
+}
+
+func currentBootstrapConfig() bootstrapConfig {
+	c := currentConfig()
+	b := bootstrapConfig{
+		Version:       Version,
+		Domain:        c.DNS.Domain,
+		PublicURL:     c.Server.PublicURL,
+		Locales:       c.Frontend.Locales,
+		DefaultLocale: c.Frontend.DefaultLocale,
+		Features: map[string]bool{
+			"signupForm":        c.Server.SignupForm,
+			"loginRequired":     c.Auth.Required,
+			"passwords":         c.Auth.Passwords,
+			"emailVerification": c.Verification.Required,
+			"plans":             entitlementsEnabled(),
+			"premiumNames":      len(c.Premium.Rules) > 0,
+			"payments":          c.Payments.StripeSecretKey != "",
+			"certificates":      c.ACME.Enabled,
+			"hosting":           c.Hosting.Enabled,
+		},
+		Validation: currentValidationSchema(),
+	}
+	if c.Frontend.CaptchaProvider != "" {
+		b.Captcha = &captchaConfig{Provider: c.Frontend.CaptchaProvider, SiteKey: c.Frontend.CaptchaSiteKey}
+	}
+	if c.Auth.OIDC.Issuer != "" {
+		b.OIDC = &oidcBootstrap{Issuer: c.Auth.OIDC.Issuer, ClientID: c.Auth.OIDC.ClientID}
+	}
+	return b
+}
+
+// getBootstrapConfigHandler serves the settings the frontend needs at
+// startup.
+func getBootstrapConfigHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "public, max-age=60")
+	respondJSON(w, currentBootstrapConfig())
+}
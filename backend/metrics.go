@@ -0,0 +1,201 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// GET /metrics serves counters and histograms in the Prometheus text format:
+// API requests by route pattern, site creations by result and the calls to
+// the DNS provider API. A few metrics do not need the client library, so
+// they are kept here. With metrics.token set, scrapes need it as bearer
+// token.
+
+var defaultDurationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+var (
+	httpRequests = newCounterVec("flox_http_requests_total",
+		"API requests by route pattern, method and status code.", "handler", "method", "code")
+	httpDuration = newHistogramVec("flox_http_request_duration_seconds",
+		"Latency of API requests by route pattern.", defaultDurationBuckets, "handler")
+	siteCreations = newCounterVec("flox_site_creations_total",
+		"Site creations by result: success, dns_failed (created, DNS record failed), failed (server error) or rejected (invalid or over a limit).", "result")
+	dnsRequests = newCounterVec("flox_dns_api_requests_total",
+		"Requests to the DNS provider API by provider, method and status code (error without response).", "provider", "method", "code")
+	dnsDuration = newHistogramVec("flox_dns_api_request_duration_seconds",
+		"Duration of requests to the DNS provider API.", defaultDurationBuckets, "provider", "method")
+	jobQueueWait = newHistogramVec("flox_provisioning_queue_wait_seconds",
+		"Time provisioning jobs waited for a slot by class.", defaultDurationBuckets, "class")
+	siteDetailCacheRequests = newCounterVec("flox_site_detail_cache_requests_total",
+		"Lookups of site details in the response cache by result: hit or miss.", "result")
+	deprecatedAPIRequests = newCounterVec("flox_api_deprecated_requests_total",
+		"Requests to the deprecated unversioned API paths by the route pattern they alias.", "handler")
+)
+
+// metrics are written in this order.
+var metrics = []interface{ write(io.Writer) }{httpRequests, httpDuration, siteCreations, dnsRequests, dnsDuration, jobQueueWait, siteDetailCacheRequests, deprecatedAPIRequests}
+
+// labelKey joins label values into a map key.
+func labelKey(values []string) string {
+	return strings.Join(values, "\xff")
+}
+
+// formatLabels returns {name="value",...} for the values of a labelKey.
+func formatLabels(names []string, key string, extra ...string) string {
+	var pairs []string
+	if len(names) > 0 {
+		for i, v := range strings.Split(key, "\xff") {
+			pairs = append(pairs, names[i]+"="+strconv.Quote(v))
+		}
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+"="+strconv.Quote(extra[i+1]))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+type counterVec struct {
+	name, help string
+	labels     []string
+	mu         sync.Mutex
+	values     map[string]float64
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, values: map[string]float64{}}
+}
+
+func (c *counterVec) inc(labelValues ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[labelKey(labelValues)]++
+}
+
+func (c *counterVec) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	for _, key := range slices.Sorted(maps.Keys(c.values)) {
+		fmt.Fprintf(w, "%s%s %g\n", c.name, formatLabels(c.labels, key), c.values[key])
+	}
+}
+
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+type histogramVec struct {
+	name, help string
+	labels     []string
+	buckets    []float64
+	mu         sync.Mutex
+	values     map[string]*histogram
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, labels: labels, buckets: buckets, values: map[string]*histogram{}}
+}
+
+func (h *histogramVec) observe(d time.Duration, labelValues ...string) {
+	seconds := d.Seconds()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	key := labelKey(labelValues)
+	v, ok := h.values[key]
+	if !ok {
+		v = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.values[key] = v
+	}
+	if i, _ := slices.BinarySearch(h.buckets, seconds); i < len(h.buckets) {
+		v.counts[i]++
+	}
+	v.sum += seconds
+	v.count++
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	for _, key := range slices.Sorted(maps.Keys(h.values)) {
+		v := h.values[key]
+		var cumulative uint64
+		for i, le := range h.buckets {
+			cumulative += v.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, key, "le", strconv.FormatFloat(le, 'g', -1, 64)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, key, "le", "+Inf"), v.count)
+		fmt.Fprintf(w, "%s_sum%s %g\n", h.name, formatLabels(h.labels, key), v.sum)
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, key), v.count)
+	}
+}
+
+// metricsMiddleware counts the API requests by the mux pattern they match,
+// which keeps the number of series small; next is mux with its middleware.
+func metricsMiddleware(mux *http.ServeMux, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		_, pattern := mux.Handler(r)
+		if pattern == "" {
+			pattern = "unmatched"
+		}
+		httpRequests.inc(pattern, r.Method, strconv.Itoa(max(rec.status, http.StatusOK)))
+		httpDuration.observe(time.Since(start), pattern)
+	})
+}
+
+// countSiteCreation counts the outcome of createSite.
+func countSiteCreation(resp siteCreationResponse, status int) {
+	result := "rejected"
+	switch {
+	case status >= http.StatusInternalServerError:
+		result = "failed"
+	case status == http.StatusOK && resp.Success && resp.DNSError != "":
+		result = "dns_failed"
+	case status == http.StatusOK && resp.Success:
+		result = "success"
+	}
+	siteCreations.inc(result)
+}
+
+// countDNSRequest records a call to the DNS provider API; resp is nil if
+// it failed without a response.
+func countDNSRequest(method string, resp *http.Response, d time.Duration) {
+	code := "error"
+	if resp != nil {
+		code = strconv.Itoa(resp.StatusCode)
+	}
+	dnsRequests.inc(config.DNS.Provider, method, code)
+	dnsDuration.observe(d, config.DNS.Provider, method)
+}
+
+// metricsHandler serves the metrics for Prometheus.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	if config.Metrics.Token != "" {
+		token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(config.Metrics.Token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Invalid metrics token", http.StatusUnauthorized)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	for _, m := range metrics {
+		m.write(w)
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+// The sites directory is the registry of all sites. Changes to its layout
+// or to the stored formats are made by migrations, applied in version order.
+// Every migration must be reversible by its down function.
+type migration struct {
+	version     int
+	description string
+	up          func() error
+	down        func() error
+}
+
+var migrations = []migration{
+	{
+		version:     1,
+		description: "baseline: start tracking the schema version of the sites directory",
+		up:          func() error { return nil },
+		down:        func() error { return nil },
+	},
+}
+
+const schemaVersionFile = ".schema-version.json"
+
+type schemaState struct {
+	Version   int       `json:"version"`
+	UpdatedAt time.Time `json:"updatedAt"`
+	// Binary is the version of flox-backend that last migrated.
+	Binary string `json:"binary,omitempty"`
+}
+
+func latestSchemaVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+func readSchemaState() (schemaState, error) {
+	var state schemaState
+	data, err := os.ReadFile(filepath.Join(sitesBaseDir, schemaVersionFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return state, nil // before migrations existed
+		}
+		return state, err
+	}
+	err = json.Unmarshal(data, &state)
+	return state, err
+}
+
+func writeSchemaState(version int) error {
+	data, err := json.MarshalIndent(schemaState{Version: version, UpdatedAt: time.Now().UTC(), Binary: Version}, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(sitesBaseDir, schemaVersionFile)
+	return writeFileAtomic(path, data, 0644)
+}
+
+// migrateTo applies the up or down functions between the current version and
+// target. The state is written after every step, so a failed migration can
+// be retried from where it stopped.
+func migrateTo(target int) error {
+	state, err := readSchemaState()
+	if err != nil {
+		return fmt.Errorf("failed to read schema version: %v", err)
+	}
+	if state.Version > latestSchemaVersion() {
+		// Neither direction is safe: the binary does not know the newer
+		// migrations, so it can neither apply nor revert them.
+		return fmt.Errorf("the sites directory has schema version %d, newer than this binary supports (%d); use the flox-backend that migrated it", state.Version, latestSchemaVersion())
+	}
+	if target < 0 || target > latestSchemaVersion() {
+		return fmt.Errorf("unknown schema version %d, this binary knows 0-%d", target, latestSchemaVersion())
+	}
+	for _, m := range migrations {
+		if m.version > state.Version && m.version <= target {
+			slog.Info("migrate: applying", "version", m.version, "description", m.description)
+			if err := m.up(); err != nil {
+				return fmt.Errorf("migration %d failed: %v", m.version, err)
+			}
+			if err := writeSchemaState(m.version); err != nil {
+				return err
+			}
+			state.Version = m.version
+		}
+	}
+	for i := len(migrations) - 1; i >= 0; i-- {
+		m := migrations[i]
+		if m.version <= state.Version && m.version > target {
+			slog.Info("migrate: reverting", "version", m.version, "description", m.description)
+			if err := m.down(); err != nil {
+				return fmt.Errorf("reverting migration %d failed: %v", m.version, err)
+			}
+			previous := 0
+			if i > 0 {
+				previous = migrations[i-1].version
+			}
+			if err := writeSchemaState(previous); err != nil {
+				return err
+			}
+			state.Version = previous
+		}
+	}
+	return nil
+}
+
+// checkSchema runs before the server or a command touches the sites
+// directory. It refuses a schema newer than this binary, since the stored
+// data may not be understood, and applies pending migrations if
+// migrations.auto_apply is set.
+func checkSchema() error {
+	state, err := readSchemaState()
+	if err != nil {
+		return fmt.Errorf("failed to read schema version: %v", err)
+	}
+	latest := latestSchemaVersion()
+	switch {
+	case state.Version > latest:
+		return fmt.Errorf("the sites directory has schema version %d, newer than this binary supports (%d); upgrade flox-backend", state.Version, latest)
+	case state.Version == latest:
+		return nil
+	}
+	if sites, err := listSiteNames(); err == nil && len(sites) == 0 && state.Version == 0 {
+		// A new installation has nothing to migrate.
+		return writeSchemaState(latest)
+	}
+	if !config.Migrations.AutoApply {
+		return fmt.Errorf("the sites directory has schema version %d, this binary needs %d; run \"flox-backend migrate up\" (or set migrations.auto_apply)", state.Version, latest)
+	}
+	return migrateTo(latest)
+}
+
+// --- Commands ---
+
+var migrateCommand = command{
+	subcommands: map[string]command{
+		"status": {
+			usage: "migrate status",
+			run:   runMigrateStatus,
+		},
+		"up": {
+			usage: "migrate up [--to VERSION]",
+			flags: func(fs *pflag.FlagSet) {
+				fs.IntVar(&migrateOptions.to, "to", 0, "Target version (default: latest)")
+			},
+			run: func(args []string) error {
+				target := migrateOptions.to
+				if target == 0 {
+					target = latestSchemaVersion()
+				}
+				return migrateTo(target)
+			},
+		},
+		"down": {
+			usage: "migrate down --to VERSION",
+			flags: func(fs *pflag.FlagSet) {
+				fs.IntVar(&migrateOptions.to, "to", -1, "Target version (required); stop the server first")
+			},
+			run: func(args []string) error {
+				if migrateOptions.to < 0 {
+					return errors.New("--to is required")
+				}
+				state, err := readSchemaState()
+				if err != nil {
+					return err
+				}
+				if migrateOptions.to > state.Version {
+					return fmt.Errorf("--to %d is above the current version %d, use migrate up", migrateOptions.to, state.Version)
+				}
+				return migrateTo(migrateOptions.to)
+			},
+		},
+	},
+}
+
+var migrateOptions struct {
+	to int
+}
+
+func runMigrateStatus(args []string) error {
+	state, err := readSchemaState()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Sites directory: %s\n", sitesBaseDir)
+	fmt.Printf("Schema version:  %d (this binary: %d)\n", state.Version, latestSchemaVersion())
+	if !state.UpdatedAt.IsZero() {
+		fmt.Printf("Last migrated:   %s by %s\n", state.UpdatedAt.Format(time.DateTime), state.Binary)
+	}
+	if state.Version > latestSchemaVersion() {
+		fmt.Println("The schema is newer than this binary; upgrade flox-backend.")
+	}
+	for _, m := range migrations {
+		mark := "pending"
+		if m.version <= state.Version {
+			mark = "applied"
+		}
+		fmt.Printf("  %3d  %-8s %s\n", m.version, mark, m.description)
+	}
+	return nil
+}
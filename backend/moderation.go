@@ -0,0 +1,704 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// Content moderation: with moderation.enabled every build is scanned for
+// prohibited content before its vhost is written. The scanner looks for the
+// operator's moderation.keywords in the text of the pages, links, forms,
+// scripts and images pointing to moderation.blocked_hosts, and the marks of
+// a phishing kit: password fields and forms posting somewhere other than
+// the site or our API. moderation.api_url optionally adds the verdict of an
+// external moderation service. Each finding has a confidence; they add up
+// to the site's, 1 - (1-c1)(1-c2)... A site at or above
+// moderation.suspend_threshold is suspended at once: its vhost answers 451
+// and the owner and limits.alert_email get a mail. Any other flagged site
+// is queued for review. An admin approves a site, which lifts a suspension
+// and keeps the same findings from flagging it again, or suspends it by
+// hand. The last scan is kept in <site>/moderation.json.
+
+const (
+	moderationFile       = "moderation.json"
+	maxModerationAPIText = 100 << 10
+)
+
+// Confidences of the built-in findings.
+const (
+	keywordConfidence        = 0.5
+	blockedHostConfidence    = 0.9
+	passwordFieldConfidence  = 0.5
+	externalFormConfidence   = 0.4
+	defaultSuspendThreshold  = 0.9
+	defaultModerationTimeout = 10 * time.Second
+)
+
+// Moderation states of a scanned site.
+const (
+	moderationClean     = "clean"
+	moderationReview    = "review"
+	moderationSuspended = "suspended"
+	moderationApproved  = "approved"
+)
+
+// Suspension takes a site offline, see moderation.go.
+type Suspension struct {
+	At     time.Time `json:"at"`
+	Reason string    `json:"reason"`
+	By     string    `json:"by"` // moderation or the user ID of the admin
+}
+
+type moderationFinding struct {
+	Kind       string  `json:"kind"` // keyword, blocked_host, password_field, external_form or api
+	Match      string  `json:"match"`
+	Page       string  `json:"page,omitempty"` // in the build
+	Confidence float64 `json:"confidence"`
+}
+
+type moderationScan struct {
+	SiteName   string              `json:"siteName"`
+	BuildID    string              `json:"buildId,omitempty"`
+	ScannedAt  time.Time           `json:"scannedAt"`
+	Status     string              `json:"status"` // clean, review, suspended or approved
+	Confidence float64             `json:"confidence"`
+	Findings   []moderationFinding `json:"findings"`
+	APIError   string              `json:"apiError,omitempty"` // the external check failed, its verdict is missing
+	// Fingerprint identifies the findings; approving a site approves them.
+	Fingerprint         string     `json:"fingerprint,omitempty"`
+	ApprovedFingerprint string     `json:"approvedFingerprint,omitempty"`
+	ReviewedBy          string     `json:"reviewedBy,omitempty"`
+	ReviewedAt          *time.Time `json:"reviewedAt,omitempty"`
+	Note                string     `json:"note,omitempty"`
+}
+
+func validateModeration(c *Config) error {
+	m := c.Moderation
+	if m.SuspendThreshold <= 0 || m.SuspendThreshold > 1 {
+		return fmt.Errorf("moderation.suspend_threshold must be above 0 and at most 1")
+	}
+	if u, err := url.Parse(m.APIURL); m.APIURL != "" && (err != nil || u.Host == "" || (u.Scheme != "https" && u.Scheme != "http")) {
+		return fmt.Errorf("moderation.api_url must be an http(s) URL, not %q", m.APIURL)
+	}
+	if m.APITimeout < 0 {
+		return fmt.Errorf("moderation.api_timeout must not be negative")
+	}
+	for _, host := range m.BlockedHosts {
+		if host == "" || strings.ContainsAny(host, "/: ") {
+			return fmt.Errorf("moderation.blocked_hosts: %q is not a host name", host)
+		}
+	}
+	return nil
+}
+
+func moderationPath(siteName string) string {
+	return filepath.Join(sitesBaseDir, siteName, moderationFile)
+}
+
+// readModerationScan returns the last scan of a site, nil if it was never
+// scanned.
+func readModerationScan(siteName string) (*moderationScan, error) {
+	data, err := os.ReadFile(moderationPath(siteName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var scan moderationScan
+	if err := json.Unmarshal(data, &scan); err != nil {
+		return nil, err
+	}
+	return &scan, nil
+}
+
+func writeModerationScan(scan *moderationScan) error {
+	data, err := json.MarshalIndent(scan, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(moderationPath(scan.SiteName), append(data, '\n'), 0644)
+}
+
+// --- Scanner ---
+
+// scannedPage is the content of a built page the scanner looks at.
+type scannedPage struct {
+	Page      string   `json:"page"`
+	Text      string   `json:"text"`
+	Links     []string `json:"links"` // href, src and form actions
+	password  bool
+	formHosts []string // hosts of the form actions
+}
+
+// readScannedPages parses the HTML files below dir.
+func readScannedPages(dir string) ([]scannedPage, error) {
+	var pages []scannedPage
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !strings.HasSuffix(strings.ToLower(d.Name()), ".html") {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		doc, err := html.Parse(f)
+		if err != nil {
+			return fmt.Errorf("failed to parse %s: %v", rel, err)
+		}
+		page := scannedPage{Page: filepath.ToSlash(rel), Text: strings.Join(strings.Fields(textContent(doc)), " ")}
+		page.collect(doc)
+		pages = append(pages, page)
+		return nil
+	})
+	return pages, err
+}
+
+func (p *scannedPage) collect(n *html.Node) {
+	if n.Type == html.ElementNode {
+		for _, key := range []string{"href", "src", "action"} {
+			if v := strings.TrimSpace(attr(n, key)); v != "" && !slices.Contains(p.Links, v) {
+				p.Links = append(p.Links, v)
+			}
+		}
+		switch n.DataAtom {
+		case atom.Input:
+			p.password = p.password || strings.EqualFold(attr(n, "type"), "password")
+		case atom.Form:
+			if u, err := url.Parse(attr(n, "action")); err == nil && u.Host != "" {
+				p.formHosts = append(p.formHosts, strings.ToLower(u.Hostname()))
+			}
+		}
+	}
+	for child := n.FirstChild; child != nil; child = child.NextSibling {
+		p.collect(child)
+	}
+}
+
+// hostMatches reports whether host is blocked or a subdomain of it.
+func hostMatches(host, blocked string) bool {
+	blocked = strings.ToLower(strings.TrimSuffix(blocked, "."))
+	return host == blocked || strings.HasSuffix(host, "."+blocked)
+}
+
+// ownHosts are the hosts the forms of a site may post to: the site itself
+// and the API.
+func ownHosts(siteConfig SiteConfig) []string {
+	hosts := siteHostnames(siteConfig)
+	if u, err := url.Parse(config.Server.PublicURL); err == nil && u.Host != "" {
+		hosts = append(hosts, strings.ToLower(u.Hostname()))
+	}
+	return hosts
+}
+
+// scanPages returns the findings of the built-in checks, one per keyword,
+// host and kind of phishing mark, on the first page it is found on.
+func scanPages(siteConfig SiteConfig, pages []scannedPage) []moderationFinding {
+	m := currentConfig().Moderation
+	var findings []moderationFinding
+	add := func(f moderationFinding) {
+		if !slices.ContainsFunc(findings, func(o moderationFinding) bool { return o.Kind == f.Kind && o.Match == f.Match }) {
+			findings = append(findings, f)
+		}
+	}
+	own := ownHosts(siteConfig)
+	for _, p := range pages {
+		text := strings.ToLower(p.Text)
+		for _, keyword := range m.Keywords {
+			if k := strings.ToLower(strings.TrimSpace(keyword)); k != "" && strings.Contains(text, k) {
+				add(moderationFinding{Kind: "keyword", Match: keyword, Page: p.Page, Confidence: keywordConfidence})
+			}
+		}
+		for _, link := range p.Links {
+			u, err := url.Parse(link)
+			if err != nil || u.Host == "" {
+				continue
+			}
+			host := strings.ToLower(u.Hostname())
+			for _, blocked := range m.BlockedHosts {
+				if hostMatches(host, blocked) {
+					add(moderationFinding{Kind: "blocked_host", Match: blocked, Page: p.Page, Confidence: blockedHostConfidence})
+				}
+			}
+		}
+		if p.password {
+			add(moderationFinding{Kind: "password_field", Match: "input type=password", Page: p.Page, Confidence: passwordFieldConfidence})
+		}
+		for _, host := range p.formHosts {
+			if !slices.Contains(own, host) {
+				add(moderationFinding{Kind: "external_form", Match: host, Page: p.Page, Confidence: externalFormConfidence})
+			}
+		}
+	}
+	return findings
+}
+
+type moderationAPIRequest struct {
+	SiteName string        `json:"siteName"`
+	URL      string        `json:"url"`
+	Pages    []scannedPage `json:"pages"`
+}
+
+type moderationAPIResponse struct {
+	Confidence float64  `json:"confidence"` // 0 to 1 that the site is prohibited content
+	Categories []string `json:"categories"` // e.g. phishing
+	Reason     string   `json:"reason"`
+}
+
+// checkModerationAPI asks moderation.api_url for its verdict on the pages.
+// The text sent is capped at maxModerationAPIText.
+func checkModerationAPI(ctx context.Context, siteName string, pages []scannedPage) (*moderationFinding, error) {
+	m := currentConfig().Moderation
+	req := moderationAPIRequest{SiteName: siteName, URL: siteURL(siteName)}
+	budget := maxModerationAPIText
+	for _, p := range pages {
+		if len(p.Text) > budget {
+			p.Text = p.Text[:budget]
+		}
+		budget -= len(p.Text)
+		req.Pages = append(req.Pages, p)
+	}
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, cmp.Or(m.APITimeout, defaultModerationTimeout))
+	defer cancel()
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, m.APIURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	if m.APIToken != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+m.APIToken)
+	}
+	resp, err := http.DefaultClient.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("moderation API: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+		return nil, fmt.Errorf("moderation API: status %d", resp.StatusCode)
+	}
+	var verdict moderationAPIResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&verdict); err != nil {
+		return nil, fmt.Errorf("moderation API: %w", err)
+	}
+	if verdict.Confidence < 0 || verdict.Confidence > 1 {
+		return nil, fmt.Errorf("moderation API: confidence %v is not between 0 and 1", verdict.Confidence)
+	}
+	if verdict.Confidence == 0 {
+		return nil, nil
+	}
+	match := cmp.Or(strings.Join(verdict.Categories, ", "), verdict.Reason, "flagged")
+	return &moderationFinding{Kind: "api", Match: match, Confidence: verdict.Confidence}, nil
+}
+
+// combinedConfidence is the confidence that at least one finding is right.
+func combinedConfidence(findings []moderationFinding) float64 {
+	clean := 1.0
+	for _, f := range findings {
+		clean *= 1 - f.Confidence
+	}
+	return 1 - clean
+}
+
+func findingsFingerprint(findings []moderationFinding) string {
+	if len(findings) == 0 {
+		return ""
+	}
+	keys := make([]string, len(findings))
+	for i, f := range findings {
+		keys[i] = f.Kind + ":" + f.Match
+	}
+	slices.Sort(keys)
+	sum := sha256.Sum256([]byte(strings.Join(keys, "\n")))
+	return hex.EncodeToString(sum[:8])
+}
+
+// moderateBuild scans the build of a site in publicDir and suspends it or
+// queues it for review. It is called by renderSite before the vhost is
+// written, so a suspension takes effect with the new build.
+func moderateBuild(ctx context.Context, siteConfig *SiteConfig, publicDir, buildID string) (*moderationScan, error) {
+	siteName := siteConfig.SiteName
+	previous, err := readModerationScan(siteName)
+	if err != nil {
+		slog.ErrorContext(ctx, "error reading moderation scan", "site", siteName, "error", err)
+	}
+	start := time.Now()
+	scan, err := scanSite(ctx, *siteConfig, previous, publicDir, buildID)
+	detail := ""
+	if scan != nil {
+		detail = fmt.Sprintf("%s, confidence %.2f, %d findings", scan.Status, scan.Confidence, len(scan.Findings))
+	}
+	logStep(siteName, "moderation.scan", detail, start, err)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeModerationScan(scan); err != nil {
+		return nil, err
+	}
+	switch {
+	case scan.Status == moderationSuspended && siteConfig.Suspended == nil:
+		reason := fmt.Sprintf("prohibited content (confidence %.2f): %s", scan.Confidence, describeFindings(scan.Findings))
+		err := suspendSite(ctx, siteConfig, reason, suspendedByModeration)
+		if errors.Is(err, errAlreadySuspended) {
+			break // by an admin meanwhile
+		}
+		if err != nil {
+			return scan, err
+		}
+		alertModeration(siteName, scan, "suspended")
+	case scan.Status == moderationReview && (previous == nil || previous.Status != moderationReview || previous.Fingerprint != scan.Fingerprint):
+		// Rebuilds of a site waiting for review do not alert again.
+		recordSiteEvent(siteName, SiteEvent{Type: "moderation.flagged", Message: fmt.Sprintf("confidence %.2f: %s", scan.Confidence, describeFindings(scan.Findings))})
+		alertModeration(siteName, scan, "queued for review")
+	}
+	return scan, nil
+}
+
+// scanSite runs the checks on a build and decides its status. The review
+// of the previous scan carries over.
+func scanSite(ctx context.Context, siteConfig SiteConfig, previous *moderationScan, publicDir, buildID string) (*moderationScan, error) {
+	siteName := siteConfig.SiteName
+	pages, err := readScannedPages(publicDir)
+	if err != nil {
+		return nil, err
+	}
+	scan := &moderationScan{SiteName: siteName, BuildID: buildID, ScannedAt: time.Now().UTC()}
+	scan.Findings = scanPages(siteConfig, pages)
+	if currentConfig().Moderation.APIURL != "" {
+		finding, err := checkModerationAPI(ctx, siteName, pages)
+		if err != nil {
+			slog.WarnContext(ctx, "moderation API failed, scanning without it", "site", siteName, "error", err)
+			scan.APIError = err.Error()
+		} else if finding != nil {
+			scan.Findings = append(scan.Findings, *finding)
+		}
+	}
+	if scan.Findings == nil {
+		scan.Findings = []moderationFinding{}
+	}
+	scan.Confidence = combinedConfidence(scan.Findings)
+	scan.Fingerprint = findingsFingerprint(scan.Findings)
+	if previous != nil {
+		scan.ApprovedFingerprint = previous.ApprovedFingerprint
+		scan.ReviewedBy, scan.ReviewedAt, scan.Note = previous.ReviewedBy, previous.ReviewedAt, previous.Note
+	}
+	switch {
+	case siteConfig.Suspended != nil:
+		scan.Status = moderationSuspended // until an admin lifts it
+	case len(scan.Findings) == 0:
+		scan.Status = moderationClean
+	case scan.Fingerprint == scan.ApprovedFingerprint:
+		scan.Status = moderationApproved
+	case scan.Confidence >= currentConfig().Moderation.SuspendThreshold:
+		scan.Status = moderationSuspended
+	default:
+		scan.Status = moderationReview
+	}
+	return scan, nil
+}
+
+// describeFindings lists the findings for events and mails.
+func describeFindings(findings []moderationFinding) string {
+	parts := make([]string, len(findings))
+	for i, f := range findings {
+		parts[i] = f.Kind + " " + f.Match
+	}
+	return strings.Join(parts, ", ")
+}
+
+const (
+	suspendedByModeration = "moderation"
+	// suspendedSiteMessage is served instead of a suspended site.
+	suspendedSiteMessage = "This site has been suspended for violating the terms of service."
+)
+
+var errAlreadySuspended = errors.New("site already suspended")
+
+// suspendSite takes a site offline: its vhost answers 451 and it is no
+// longer served in self-hosted mode. The owner gets a mail. siteConfig is
+// updated to the stored config.
+func suspendSite(ctx context.Context, siteConfig *SiteConfig, reason, by string) error {
+	suspension := &Suspension{At: time.Now().UTC(), Reason: reason, By: by}
+	updated, err := updateSiteConfig(siteConfig.SiteName, func(sc *SiteConfig) error {
+		if sc.Suspended != nil {
+			return errAlreadySuspended
+		}
+		sc.Suspended = suspension
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	*siteConfig = updated
+	slog.WarnContext(ctx, "suspended site", "site", siteConfig.SiteName, "reason", reason, "by", by)
+	recordSiteEvent(siteConfig.SiteName, SiteEvent{Type: "site.suspended", Message: reason})
+	recordAudit(ctx, "site.suspend", siteConfig.SiteName, siteConfig.Suspended)
+	if siteConfig.OwnerEmail != "" {
+		data := map[string]any{"SiteName": siteConfig.SiteName, "SiteURL": siteURL(siteConfig.SiteName)}
+		if err := sendTemplateEmail(siteConfig.OwnerEmail, "site_suspended", data); err != nil {
+			slog.ErrorContext(ctx, "error sending suspension mail", "site", siteConfig.SiteName, "error", err)
+		}
+	}
+	return nil
+}
+
+// alertModeration tells limits.alert_email about a flagged site.
+func alertModeration(siteName string, scan *moderationScan, effect string) {
+	to := currentConfig().Limits.AlertEmail
+	if to == "" {
+		return
+	}
+	data := map[string]any{
+		"SiteName":   siteName,
+		"Effect":     effect,
+		"Confidence": fmt.Sprintf("%.2f", scan.Confidence),
+		"Findings":   describeFindings(scan.Findings),
+	}
+	if err := sendTemplateEmail(to, "moderation_flagged", data); err != nil {
+		slog.Error("error sending moderation alert", "to", to, "site", siteName, "error", err)
+	}
+}
+
+// siteSuspended reports whether a site must not be served, from the cached
+// state of its config, see hosting.go.
+func siteSuspended(siteName string) bool {
+	return cachedSiteState(siteName).suspended
+}
+
+// --- Handlers ---
+
+// listModerationHandler returns the review queue: the scans of the sites
+// waiting for review or suspended, highest confidence first. ?status=
+// selects one of them, or "all" for every scanned site.
+func listModerationHandler(w http.ResponseWriter, r *http.Request) {
+	status := r.URL.Query().Get("status")
+	if !slices.Contains([]string{"", "all", moderationClean, moderationReview, moderationSuspended, moderationApproved}, status) {
+		apiError(w, r, http.StatusBadRequest, codeInvalidField, "status must be review, suspended, approved, clean or all")
+		return
+	}
+	siteNames, err := listSiteNames()
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error listing sites", "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	scans := []moderationScan{}
+	for _, siteName := range siteNames {
+		scan, err := readModerationScan(siteName)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "error reading moderation scan", "site", siteName, "error", err)
+			continue
+		}
+		if scan == nil {
+			continue
+		}
+		switch status {
+		case "":
+			if scan.Status != moderationReview && scan.Status != moderationSuspended {
+				continue
+			}
+		case "all":
+		default:
+			if scan.Status != status {
+				continue
+			}
+		}
+		scans = append(scans, *scan)
+	}
+	slices.SortFunc(scans, func(a, b moderationScan) int {
+		return cmp.Or(cmp.Compare(b.Confidence, a.Confidence), strings.Compare(a.SiteName, b.SiteName))
+	})
+	respondJSON(w, scans)
+}
+
+// moderatedSite resolves the {siteName} of an admin moderation request.
+func moderatedSite(w http.ResponseWriter, r *http.Request) (SiteConfig, bool) {
+	siteName := strings.ToLower(r.PathValue("siteName"))
+	siteConfig, err := readSiteConfig(siteName)
+	if os.IsNotExist(err) {
+		apiError(w, r, http.StatusNotFound, codeSiteNotFound, "Site not found")
+		return siteConfig, false
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error reading site config", "site", siteName, "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return siteConfig, false
+	}
+	setRequestSite(r, siteName)
+	return siteConfig, true
+}
+
+// getModerationHandler returns the last scan of a site.
+func getModerationHandler(w http.ResponseWriter, r *http.Request) {
+	siteConfig, ok := moderatedSite(w, r)
+	if !ok {
+		return
+	}
+	scan, err := readModerationScan(siteConfig.SiteName)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error reading moderation scan", "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if scan == nil {
+		http.Error(w, "The site has not been scanned", http.StatusNotFound)
+		return
+	}
+	respondJSON(w, scan)
+}
+
+// scanModerationHandler scans the current build of a site again, e.g. after
+// the blocklists changed.
+func scanModerationHandler(w http.ResponseWriter, r *http.Request) {
+	siteConfig, ok := moderatedSite(w, r)
+	if !ok {
+		return
+	}
+	publicDir := filepath.Join(sitesBaseDir, siteConfig.SiteName, sitePublicDir)
+	buildID := ""
+	if record, err := latestBuildRecord(siteConfig.SiteName); err == nil && record != nil {
+		buildID = record.ID
+	}
+	scan, err := moderateBuild(r.Context(), &siteConfig, publicDir, buildID)
+	if err == nil && siteConfig.Suspended != nil {
+		err = applyVhost(siteConfig)
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error scanning site", "site", siteConfig.SiteName, "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	respondJSON(w, scan)
+}
+
+type moderationDecision struct {
+	Note string `json:"note"`
+}
+
+// approveModerationHandler clears a site: a suspension is lifted and its
+// current findings no longer flag it.
+func approveModerationHandler(w http.ResponseWriter, r *http.Request) {
+	siteConfig, ok := moderatedSite(w, r)
+	if !ok {
+		return
+	}
+	var req moderationDecision
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON request", http.StatusBadRequest)
+			return
+		}
+	}
+	scan, err := readModerationScan(siteConfig.SiteName)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error reading moderation scan", "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if scan == nil {
+		scan = &moderationScan{SiteName: siteConfig.SiteName, ScannedAt: time.Now().UTC(), Findings: []moderationFinding{}}
+	}
+	now := time.Now().UTC()
+	scan.Status, scan.ApprovedFingerprint = moderationApproved, scan.Fingerprint
+	scan.ReviewedBy, scan.ReviewedAt, scan.Note = cmp.Or(currentUserID(r), auditActorAdminToken), &now, req.Note
+	if len(scan.Findings) == 0 {
+		scan.Status = moderationClean
+	}
+	if err := writeModerationScan(scan); err != nil {
+		slog.ErrorContext(r.Context(), "error writing moderation scan", "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	recordAudit(r.Context(), "moderation.approve", siteConfig.SiteName, req)
+	if siteConfig.Suspended != nil {
+		lifted := false
+		updated, err := updateSiteConfig(siteConfig.SiteName, func(sc *SiteConfig) error {
+			lifted, sc.Suspended = sc.Suspended != nil, nil
+			return nil
+		})
+		if err == nil {
+			err = applyVhost(updated)
+		}
+		if err != nil {
+			slog.ErrorContext(r.Context(), "error lifting suspension", "site", siteConfig.SiteName, "error", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		if lifted {
+			recordSiteEvent(siteConfig.SiteName, SiteEvent{Type: "site.unsuspended", Message: req.Note})
+			recordAudit(r.Context(), "site.unsuspend", siteConfig.SiteName, req)
+		}
+	}
+	respondJSON(w, scan)
+}
+
+// suspendModerationHandler suspends a site by hand, with the note as
+// reason.
+func suspendModerationHandler(w http.ResponseWriter, r *http.Request) {
+	siteConfig, ok := moderatedSite(w, r)
+	if !ok {
+		return
+	}
+	var req moderationDecision
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || strings.TrimSpace(req.Note) == "" {
+		apiError(w, r, http.StatusBadRequest, codeInvalidField, "Give the reason of the suspension as \"note\"")
+		return
+	}
+	if siteConfig.Suspended != nil {
+		http.Error(w, "The site is already suspended", http.StatusConflict)
+		return
+	}
+	err := suspendSite(r.Context(), &siteConfig, strings.TrimSpace(req.Note), cmp.Or(currentUserID(r), auditActorAdminToken))
+	if errors.Is(err, errAlreadySuspended) {
+		http.Error(w, "The site is already suspended", http.StatusConflict)
+		return
+	}
+	if err == nil {
+		err = applyVhost(siteConfig)
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error suspending site", "site", siteConfig.SiteName, "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	scan, err := readModerationScan(siteConfig.SiteName)
+	if err == nil && scan != nil {
+		scan.Status = moderationSuspended
+		err = writeModerationScan(scan)
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error writing moderation scan", "site", siteConfig.SiteName, "error", err)
+	}
+	respondJSON(w, siteConfig.Suspended)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Hostname collisions: the blacklist and sites.reserved_names only know the
+// names someone thought of. A new site name is also checked against the
+// record sets in the zone that flox did not create, such as mail, mx,
+// autodiscover or a VPN, at the name itself or below it (smtp.mail). The
+// zone is listed at the DNS provider and cached for dns.zone_cache_ttl. A
+// colliding name is rejected with NAME_COLLISION, listing the record sets in
+// the details; an admin can create the site anyway with
+// "allowCollision": true, which is audited. If the zone cannot be listed the
+// check is skipped, as sites are created while the provider is down
+// (dnspreflight.go).
+
+var zoneCache struct {
+	mu       sync.Mutex
+	listedAt time.Time
+	foreign  []rrset // record sets not created by this instance
+	err      error
+}
+
+// foreignRecordSets returns the record sets of the zone that this instance
+// did not create. Failures are cached for a shorter time, like the
+// pre-flight check's.
+func foreignRecordSets(ctx context.Context) ([]rrset, error) {
+	zoneCache.mu.Lock()
+	defer zoneCache.mu.Unlock()
+	ttl := currentConfig().DNS.ZoneCacheTTL
+	if zoneCache.err != nil {
+		ttl = min(ttl, dnsPreflightFailureTTL)
+	}
+	if !zoneCache.listedAt.IsZero() && time.Since(zoneCache.listedAt) < ttl {
+		return zoneCache.foreign, zoneCache.err
+	}
+	foreign, err := listForeignRecordSets(ctx)
+	if err != nil && zoneCache.err == nil {
+		slog.Warn("could not list the DNS zone, skipping hostname collision checks", "error", err)
+	}
+	zoneCache.listedAt = time.Now()
+	zoneCache.foreign, zoneCache.err = foreign, err
+	return foreign, err
+}
+
+func listForeignRecordSets(ctx context.Context) ([]rrset, error) {
+	sets, err := listRRSets(ctx)
+	if err != nil {
+		return nil, err
+	}
+	owners, err := readDNSOwners()
+	if err != nil {
+		return nil, err
+	}
+	var foreign []rrset
+	for _, rr := range sets {
+		if owner, ok := recordOwnerOf(rr, owners); ok && owner.ours() {
+			continue
+		}
+		foreign = append(foreign, rr)
+	}
+	return foreign, nil
+}
+
+// checkHostnameCollision fails with NAME_COLLISION if record sets of the
+// zone that flox did not create are at the name or below it.
+func checkHostnameCollision(ctx context.Context, siteName string) error {
+	if !currentConfig().DNS.CollisionCheck {
+		return nil
+	}
+	sets, err := foreignRecordSets(ctx)
+	if err != nil {
+		return nil
+	}
+	name := strings.ToLower(siteName)
+	var records []string
+	for _, rr := range sets {
+		subname := strings.ToLower(rr.Subname)
+		if subname == name || strings.HasSuffix(subname, "."+name) {
+			records = append(records, rr.Type+" "+subname)
+		}
+	}
+	if len(records) == 0 {
+		return nil
+	}
+	slices.Sort(records)
+	return &APIError{
+		Code:    codeNameCollision,
+		Message: fmt.Sprintf("%s.%s is already used by other services in the zone", name, config.DNS.Domain),
+		Details: map[string]any{"records": slices.Compact(records)},
+	}
+}
+
+// collisionOverridden reports whether err is a hostname collision an admin
+// overrides with allowCollision; the override is audited.
+func collisionOverridden(r *http.Request, req siteCreationRequest, err error) bool {
+	var e *APIError
+	if !req.AllowCollision || !errors.As(err, &e) || e.Code != codeNameCollision {
+		return false
+	}
+	if !isAdmin(r) && r.Context().Value(adminTokenKey{}) == nil {
+		return false
+	}
+	slog.WarnContext(r.Context(), "creating site despite hostname collision", "site", req.SiteName, "records", e.Details["records"])
+	recordAudit(r.Context(), "site.collision_override", req.SiteName, e.Details)
+	return true
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/mail"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// NewsletterConfig connects the newsletter section of a site to a mailing
+// list provider. The API credentials are only stored encrypted.
+type NewsletterConfig struct {
+	Provider    string `json:"provider"` // mailchimp, brevo or listmonk
+	ListID      string `json:"listId"`
+	BaseURL     string `json:"baseUrl,omitempty"` // listmonk instance URL
+	DoubleOptIn bool   `json:"doubleOptIn"`
+	// Brevo sends double opt-in mails from a template and redirects to this URL
+	// after confirmation.
+	DOITemplateID int    `json:"doiTemplateId,omitempty"`
+	RedirectURL   string `json:"redirectUrl,omitempty"`
+
+	EncryptedCredentials string `json:"encryptedCredentials,omitempty"`
+}
+
+type newsletterConfigRequest struct {
+	NewsletterConfig
+	// Mailchimp/Brevo API key, or "user:token" for listmonk. Omit to keep the
+	// stored credentials.
+	APIKey string `json:"apiKey,omitempty"`
+}
+
+type newsletterSubscribeRequest struct {
+	Email string `json:"email"`
+	Name  string `json:"name,omitempty"`
+}
+
+type newsletterProvider interface {
+	Subscribe(ctx context.Context, email, name string) error
+}
+
+var newsletterProviders = []string{"mailchimp", "brevo", "listmonk"}
+
+func (nc NewsletterConfig) validate() error {
+	if !slices.Contains(newsletterProviders, nc.Provider) {
+		return fmt.Errorf("provider must be one of %s", strings.Join(newsletterProviders, ", "))
+	}
+	if nc.ListID == "" {
+		return errors.New("listId is required")
+	}
+	if nc.Provider == "listmonk" {
+		if err := validateOwnerURL(nc.BaseURL, "baseUrl"); err != nil {
+			return fmt.Errorf("%v, the URL of the listmonk instance", err)
+		}
+	}
+	if nc.Provider == "brevo" && nc.DoubleOptIn && (nc.DOITemplateID == 0 || nc.RedirectURL == "") {
+		return errors.New("brevo double opt-in needs doiTemplateId and redirectUrl")
+	}
+	return nil
+}
+
+// public returns the config without the encrypted credentials.
+func (nc NewsletterConfig) public() NewsletterConfig {
+	nc.EncryptedCredentials = ""
+	return nc
+}
+
+func newNewsletterProvider(nc NewsletterConfig) (newsletterProvider, error) {
+	credentials, err := decryptSecret(nc.EncryptedCredentials)
+	if err != nil {
+		return nil, err
+	}
+	switch nc.Provider {
+	case "mailchimp":
+		// Mailchimp keys end in the data center, e.g. "...-us6".
+		_, dc, ok := strings.Cut(credentials, "-")
+		if !ok {
+			return nil, errors.New("mailchimp API key lacks the data center suffix")
+		}
+		return &mailchimpProvider{apiKey: credentials, dc: dc, listID: nc.ListID, doubleOptIn: nc.DoubleOptIn}, nil
+	case "brevo":
+		listID, err := strconv.Atoi(nc.ListID)
+		if err != nil {
+			return nil, errors.New("brevo listId must be numeric")
+		}
+		return &brevoProvider{apiKey: credentials, listID: listID, config: nc}, nil
+	case "listmonk":
+		user, token, ok := strings.Cut(credentials, ":")
+		if !ok {
+			return nil, errors.New(`listmonk credentials must be "user:token"`)
+		}
+		listID, err := strconv.Atoi(nc.ListID)
+		if err != nil {
+			return nil, errors.New("listmonk listId must be numeric")
+		}
+		return &listmonkProvider{baseURL: strings.TrimSuffix(nc.BaseURL, "/"), user: user, token: token, listID: listID, doubleOptIn: nc.DoubleOptIn}, nil
+	}
+	return nil, fmt.Errorf("unknown newsletter provider %q", nc.Provider)
+}
+
+// providerJSONRequest sends a JSON request and treats the listed status codes
+// (besides 2xx) as success, e.g. "already subscribed".
+func providerJSONRequest(ctx context.Context, method, url string, payload any, setAuth func(*http.Request), okStatus ...int) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to marshal JSON: %v", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	setAuth(req)
+
+	// The listmonk instance is chosen by the site owner.
+	resp, err := ownerURLClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("HTTP request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 300 || slices.Contains(okStatus, resp.StatusCode) {
+		return nil
+	}
+	detail, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	return fmt.Errorf("unexpected status code: %d: %s", resp.StatusCode, strings.TrimSpace(string(detail)))
+}
+
+type mailchimpProvider struct {
+	apiKey, dc, listID string
+	doubleOptIn        bool
+}
+
+func (p *mailchimpProvider) Subscribe(ctx context.Context, email, name string) error {
+	status := "subscribed"
+	if p.doubleOptIn {
+		status = "pending" // Mailchimp sends the confirmation mail itself
+	}
+	// PUT on the member hash is an upsert, so repeated signups don't fail.
+	hash := md5.Sum([]byte(strings.ToLower(email)))
+	url := fmt.Sprintf("https://%s.api.mailchimp.com/3.0/lists/%s/members/%s", p.dc, p.listID, hex.EncodeToString(hash[:]))
+	payload := map[string]any{
+		"email_address": email,
+		"status_if_new": status,
+		"merge_fields":  map[string]string{"FNAME": name},
+	}
+	return providerJSONRequest(ctx, http.MethodPut, url, payload, func(r *http.Request) {
+		r.SetBasicAuth("flox", p.apiKey)
+	})
+}
+
+type brevoProvider struct {
+	apiKey string
+	listID int
+	config NewsletterConfig
+}
+
+func (p *brevoProvider) Subscribe(ctx context.Context, email, name string) error {
+	setAuth := func(r *http.Request) { r.Header.Set("api-key", p.apiKey) }
+	attributes := map[string]string{}
+	if name != "" {
+		attributes["FIRSTNAME"] = name
+	}
+	if p.config.DoubleOptIn {
+		return providerJSONRequest(ctx, http.MethodPost, "https://api.brevo.com/v3/contacts/doubleOptinConfirmation", map[string]any{
+			"email":          email,
+			"attributes":     attributes,
+			"includeListIds": []int{p.listID},
+			"templateId":     p.config.DOITemplateID,
+			"redirectionUrl": p.config.RedirectURL,
+		}, setAuth)
+	}
+	return providerJSONRequest(ctx, http.MethodPost, "https://api.brevo.com/v3/contacts", map[string]any{
+		"email":         email,
+		"attributes":    attributes,
+		"listIds":       []int{p.listID},
+		"updateEnabled": true,
+	}, setAuth)
+}
+
+type listmonkProvider struct {
+	baseURL, user, token string
+	listID               int
+	doubleOptIn          bool
+}
+
+func (p *listmonkProvider) Subscribe(ctx context.Context, email, name string) error {
+	if name == "" {
+		name = strings.Split(email, "@")[0] // listmonk requires a name
+	}
+	return providerJSONRequest(ctx, http.MethodPost, p.baseURL+"/api/subscribers", map[string]any{
+		"email":                    email,
+		"name":                     name,
+		"status":                   "enabled",
+		"lists":                    []int{p.listID},
+		"preconfirm_subscriptions": !p.doubleOptIn, // listmonk sends the opt-in mail otherwise
+	}, func(r *http.Request) {
+		r.SetBasicAuth(p.user, p.token)
+	}, http.StatusConflict) // already subscribed
+}
+
+// --- Handlers ---
+
+func putNewsletterConfigHandler(w http.ResponseWriter, r *http.Request) {
+	siteName, ok := siteNameFromPath(w, r)
+	if !ok {
+		return
+	}
+	var req newsletterConfigRequest
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON request", http.StatusBadRequest)
+		return
+	}
+	nc := req.NewsletterConfig
+	if err := nc.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if req.APIKey != "" {
+		credentials, err := encryptSecret(req.APIKey)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "error encrypting newsletter credentials", "site", siteName, "error", err)
+			http.Error(w, "Credentials cannot be stored on this server", http.StatusInternalServerError)
+			return
+		}
+		nc.EncryptedCredentials = credentials
+	}
+
+	if _, err := updateSiteConfig(siteName, func(siteConfig *SiteConfig) error {
+		if req.APIKey == "" {
+			if siteConfig.Newsletter == nil || siteConfig.Newsletter.Provider != nc.Provider {
+				return &httpError{http.StatusBadRequest, "apiKey is required"}
+			}
+			nc.EncryptedCredentials = siteConfig.Newsletter.EncryptedCredentials
+		}
+		siteConfig.Newsletter = &nc
+		return nil
+	}); err != nil {
+		writeSiteUpdateError(w, r, siteName, err)
+		return
+	}
+	recordSiteEvent(siteName, SiteEvent{Type: "newsletter.configured", Message: nc.Provider})
+
+	if _, err := buildSite(siteName); err != nil {
+		slog.ErrorContext(r.Context(), "error building site", "site", siteName, "error", err)
+	}
+	respondJSON(w, nc.public())
+}
+
+// subscribeNewsletterHandler is the public signup endpoint. It accepts JSON or
+// urlencoded form posts, the latter are redirected back to the referring page.
+func subscribeNewsletterHandler(w http.ResponseWriter, r *http.Request) {
+	siteName, ok := siteNameFromPath(w, r)
+	if !ok {
+		return
+	}
+	siteConfig, err := readSiteConfig(siteName)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error reading site config", "site", siteName, "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if siteConfig.Newsletter == nil {
+		http.Error(w, "Newsletter is not enabled for this site", http.StatusNotFound)
+		return
+	}
+
+	var req newsletterSubscribeRequest
+	r.Body = http.MaxBytesReader(w, r.Body, maxSubmissionBytes)
+	defer r.Body.Close()
+	isJSON := false
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "application/json" {
+		isJSON = true
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON request", http.StatusBadRequest)
+			return
+		}
+	} else {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, "Invalid form data", http.StatusBadRequest)
+			return
+		}
+		req = newsletterSubscribeRequest{Email: r.PostForm.Get("email"), Name: r.PostForm.Get("name")}
+	}
+	addr, err := mail.ParseAddress(strings.TrimSpace(req.Email))
+	if err != nil {
+		http.Error(w, "invalid email address", http.StatusBadRequest)
+		return
+	}
+	if len(req.Name) > 100 {
+		http.Error(w, "name is too long", http.StatusBadRequest)
+		return
+	}
+
+	provider, err := newNewsletterProvider(*siteConfig.Newsletter)
+	if err == nil {
+		err = provider.Subscribe(r.Context(), addr.Address, strings.TrimSpace(req.Name))
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error subscribing to newsletter", "site", siteName, "provider", siteConfig.Newsletter.Provider, "error", err)
+		http.Error(w, "Subscription failed, please try again later", http.StatusBadGateway)
+		return
+	}
+	recordSiteEvent(siteName, SiteEvent{Type: "newsletter.subscribed"})
+	fireRESTHooks(siteName, "newsletter.subscribed", newID(), "", newsletterSubscriberData{Email: addr.Address, Name: strings.TrimSpace(req.Name)})
+
+	if referer := r.Referer(); !isJSON && referer != "" {
+		http.Redirect(w, r, referer, http.StatusSeeOther)
+		return
+	}
+	respondJSON(w, map[string]bool{"success": true, "confirmationRequired": siteConfig.Newsletter.DoubleOptIn})
+}
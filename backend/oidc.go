@@ -0,0 +1,305 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// With auth.oidc.issuer set, the API also accepts access tokens of an
+// external OpenID Connect provider (Keycloak, ...) as bearer tokens. The
+// token's subject is the user ID, so sites created with it belong to the
+// subject (SiteConfig.UserID) like those of local accounts; users log in at
+// the provider and never give flox a password. Signing keys are read from
+// the provider's discovery document and JWKS and cached until a token names
+// an unknown key. auth.passwords: false turns the local accounts off.
+
+const (
+	oidcClockSkew      = time.Minute
+	oidcMinKeyRefresh  = time.Minute // between fetches of the JWKS for unknown keys
+	maxOIDCDocumentLen = 1 << 20
+)
+
+var oidcClient = &http.Client{Timeout: 10 * time.Second}
+
+func oidcEnabled() bool {
+	return config.Auth.OIDC.Issuer != ""
+}
+
+// oidcClaims are the claims read from an access token of the provider.
+type oidcClaims struct {
+	Issuer          string   `json:"iss"`
+	Subject         string   `json:"sub"`
+	Audience        audience `json:"aud"`
+	AuthorizedParty string   `json:"azp"`
+	ExpiresAt       int64    `json:"exp"`
+	NotBefore       int64    `json:"nbf"`
+	IssuedAt        int64    `json:"iat"`
+	Email           string   `json:"email"`
+	// Roles as Keycloak puts them, see roles
+	RealmAccess struct {
+		Roles []string `json:"roles"`
+	} `json:"realm_access"`
+	ResourceAccess map[string]struct {
+		Roles []string `json:"roles"`
+	} `json:"resource_access"`
+	Roles []string `json:"roles"`
+}
+
+// roles are the realm roles, the roles for our client and a plain "roles"
+// claim.
+func (c oidcClaims) roles() []string {
+	roles := slices.Concat(c.RealmAccess.Roles, c.Roles)
+	return append(roles, c.ResourceAccess[config.Auth.OIDC.ClientID].Roles...)
+}
+
+// audience is the "aud" claim, a string or an array of strings.
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]string)(a))
+}
+
+var oidcKeys struct {
+	sync.Mutex
+	jwksURI string
+	keys    map[string]jsonWebKey // by kid
+	fetched time.Time
+}
+
+type jsonWebKey struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func fetchOIDCJSON(url string, v any) error {
+	resp, err := oidcClient.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxOIDCDocumentLen)).Decode(v); err != nil {
+		return fmt.Errorf("GET %s: %w", url, err)
+	}
+	return nil
+}
+
+// oidcKey returns the provider's signing key kid, fetching the discovery
+// document and the JWKS if the key is not cached yet.
+func oidcKey(kid string) (jsonWebKey, error) {
+	oidcKeys.Lock()
+	defer oidcKeys.Unlock()
+	if key, ok := oidcKeys.keys[kid]; ok {
+		return key, nil
+	}
+	if time.Since(oidcKeys.fetched) < oidcMinKeyRefresh {
+		return jsonWebKey{}, errInvalidToken
+	}
+	oidcKeys.fetched = time.Now()
+	if oidcKeys.jwksURI == "" {
+		var discovery struct {
+			Issuer  string `json:"issuer"`
+			JWKSURI string `json:"jwks_uri"`
+		}
+		issuer := strings.TrimSuffix(config.Auth.OIDC.Issuer, "/")
+		if err := fetchOIDCJSON(issuer+"/.well-known/openid-configuration", &discovery); err != nil {
+			return jsonWebKey{}, fmt.Errorf("OIDC discovery: %w", err)
+		}
+		if strings.TrimSuffix(discovery.Issuer, "/") != issuer || discovery.JWKSURI == "" {
+			return jsonWebKey{}, fmt.Errorf("OIDC discovery: issuer %q does not match auth.oidc.issuer or has no jwks_uri", discovery.Issuer)
+		}
+		oidcKeys.jwksURI = discovery.JWKSURI
+	}
+	var jwks struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := fetchOIDCJSON(oidcKeys.jwksURI, &jwks); err != nil {
+		return jsonWebKey{}, fmt.Errorf("OIDC keys: %w", err)
+	}
+	oidcKeys.keys = map[string]jsonWebKey{}
+	for _, k := range jwks.Keys {
+		if k.Use == "" || k.Use == "sig" {
+			oidcKeys.keys[k.Kid] = k
+		}
+	}
+	if key, ok := oidcKeys.keys[kid]; ok {
+		return key, nil
+	}
+	return jsonWebKey{}, errInvalidToken
+}
+
+// verify checks the signature of a token signed with alg by this key.
+func (k jsonWebKey) verify(alg, signed string, signature []byte) error {
+	if k.Alg != "" && k.Alg != alg {
+		return errInvalidToken
+	}
+	var hash crypto.Hash
+	switch alg {
+	case "RS256", "ES256":
+		hash = crypto.SHA256
+	case "RS384", "ES384":
+		hash = crypto.SHA384
+	case "RS512":
+		hash = crypto.SHA512
+	default:
+		return errInvalidToken // "none", HMAC with the public key, ...
+	}
+	h := hash.New()
+	h.Write([]byte(signed))
+	digest := h.Sum(nil)
+
+	switch {
+	case strings.HasPrefix(alg, "RS") && k.Kty == "RSA":
+		n, err1 := base64.RawURLEncoding.DecodeString(k.N)
+		e, err2 := base64.RawURLEncoding.DecodeString(k.E)
+		if err1 != nil || err2 != nil || len(e) > 4 {
+			return errInvalidToken
+		}
+		pub := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		if rsa.VerifyPKCS1v15(pub, hash, digest, signature) != nil {
+			return errInvalidToken
+		}
+		return nil
+	case strings.HasPrefix(alg, "ES") && k.Kty == "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		default:
+			return errInvalidToken
+		}
+		x, err1 := base64.RawURLEncoding.DecodeString(k.X)
+		y, err2 := base64.RawURLEncoding.DecodeString(k.Y)
+		size := (curve.Params().BitSize + 7) / 8
+		if err1 != nil || err2 != nil || len(signature) != 2*size {
+			return errInvalidToken
+		}
+		pub := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		r, s := new(big.Int).SetBytes(signature[:size]), new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(pub, digest, r, s) {
+			return errInvalidToken
+		}
+		return nil
+	}
+	return errInvalidToken
+}
+
+// parseOIDCToken verifies an access token of the provider and returns it as
+// session claims with the subject as user ID.
+func parseOIDCToken(token string) (sessionClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return sessionClaims{}, errInvalidToken
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	data, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || json.Unmarshal(data, &header) != nil {
+		return sessionClaims{}, errInvalidToken
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return sessionClaims{}, errInvalidToken
+	}
+	key, err := oidcKey(header.Kid)
+	if err != nil {
+		return sessionClaims{}, err
+	}
+	if err := key.verify(header.Alg, parts[0]+"."+parts[1], signature); err != nil {
+		return sessionClaims{}, err
+	}
+
+	var claims oidcClaims
+	data, err = base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || json.Unmarshal(data, &claims) != nil {
+		return sessionClaims{}, errInvalidToken
+	}
+	now := time.Now()
+	switch {
+	case strings.TrimSuffix(claims.Issuer, "/") != strings.TrimSuffix(config.Auth.OIDC.Issuer, "/"),
+		claims.Subject == "",
+		now.Add(-oidcClockSkew).Unix() >= claims.ExpiresAt,
+		claims.NotBefore != 0 && now.Add(oidcClockSkew).Unix() < claims.NotBefore,
+		// Keycloak access tokens name the client in azp, the audience
+		// is usually "account".
+		!slices.Contains(claims.Audience, config.Auth.OIDC.ClientID) && claims.AuthorizedParty != config.Auth.OIDC.ClientID:
+		return sessionClaims{}, errInvalidToken
+	}
+	return sessionClaims{
+		Subject:   claims.Subject,
+		Email:     claims.Email,
+		Issuer:    claims.Issuer,
+		IssuedAt:  claims.IssuedAt,
+		ExpiresAt: claims.ExpiresAt,
+		Role:      oidcRole(claims.roles()),
+	}, nil
+}
+
+// parseBearerToken verifies a bearer token: a session token of a local
+// account or, with OIDC, an access token of the provider.
+func parseBearerToken(token string) (sessionClaims, error) {
+	if strings.HasPrefix(token, jwtHeader+".") {
+		if !config.Auth.Passwords {
+			return sessionClaims{}, errInvalidToken
+		}
+		return parseSessionToken(token)
+	}
+	if oidcEnabled() {
+		return parseOIDCToken(token)
+	}
+	return sessionClaims{}, errInvalidToken
+}
+
+// isOIDCSession reports whether the claims are those of a provider token.
+func (c sessionClaims) isOIDCSession() bool {
+	return oidcEnabled() && c.Issuer != jwtIssuer
+}
+
+type oidcProviderInfo struct {
+	Issuer   string `json:"issuer"`
+	ClientID string `json:"clientId"`
+}
+
+type authConfigResponse struct {
+	Passwords bool              `json:"passwords"` // local accounts with register and login
+	OIDC      *oidcProviderInfo `json:"oidc"`
+}
+
+// getAuthConfigHandler tells the frontend how users log in.
+func getAuthConfigHandler(w http.ResponseWriter, r *http.Request) {
+	resp := authConfigResponse{Passwords: config.Auth.Passwords}
+	if oidcEnabled() {
+		resp.OIDC = &oidcProviderInfo{Issuer: config.Auth.OIDC.Issuer, ClientID: config.Auth.OIDC.ClientID}
+	}
+	respondJSON(w, resp)
+}
@@ -0,0 +1,447 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// GET /api/v1/openapi.json describes the API as an OpenAPI 3 document, so
+// the frontend and integrators can generate clients; GET /api/v1/docs shows
+// it in Swagger UI. The operations are listed in apiOperations with the Go
+// types of their request and response bodies, and the schemas are generated
+// from those types' JSON encoding, so they follow the structs. Whether an
+// operation needs a login is taken from how its route is registered, and
+// operations whose route is not registered on this instance (e.g. the
+// allocator endpoints without registry.token) are left out.
+
+// apiOperation documents a route of the mux.
+type apiOperation struct {
+	Pattern     string // as registered, "POST /api/v1/sites"; without a method it is documented as GET
+	Summary     string
+	Tag         string
+	Query       []string // query parameters
+	Headers     []string // request header parameters
+	Request     any      // JSON body, nil for none
+	Response    any      // JSON body of a success, nil for none or an unspecified object
+	Status      int      // of a success, default 200
+	ContentType string   // of a non-JSON success response
+}
+
+var apiOperations = []apiOperation{
+	// Sites
+	{Pattern: "POST /api/v1/sites/validate-name", Tag: "sites", Summary: "Check whether a site name is valid and available", Request: validationRequest{}, Response: validationResponse{}},
+	{Pattern: "GET /api/v1/sites", Tag: "sites", Summary: "List the sites of the user", Query: []string{"page", "limit", "sort"}, Response: siteListResponse{}},
+	{Pattern: "POST /api/v1/sites", Tag: "sites", Summary: "Create a site", Headers: []string{idempotencyKeyHeader, "Prefer"}, Request: siteCreationRequest{}, Response: siteCreationResponse{}},
+	{Pattern: "GET /api/v1/jobs/{jobId}", Tag: "sites", Summary: "Get the state of an asynchronous site creation", Response: jobView{}},
+	{Pattern: "GET /api/v1/sites/{siteName}", Tag: "sites", Summary: "Get a site", Response: siteDetail{}},
+	{Pattern: "PATCH /api/v1/sites/{siteName}", Tag: "sites", Summary: "Update description, style and sections of a site", Request: siteUpdateRequest{}, Response: SiteConfig{}},
+	{Pattern: "DELETE /api/v1/sites/{siteName}", Tag: "sites", Summary: "Delete a site", Response: siteDeletionResponse{}},
+	{Pattern: "GET /api/v1/terraform/sites/{siteName}", Tag: "terraform", Summary: "Read a site resource", Response: terraformSite{}},
+	{Pattern: "PUT /api/v1/terraform/sites/{siteName}", Tag: "terraform", Summary: "Create a site or bring it to the declared state", Headers: []string{idempotencyKeyHeader, "If-None-Match"}, Request: terraformSiteRequest{}, Response: terraformSite{}},
+	{Pattern: "DELETE /api/v1/terraform/sites/{siteName}", Tag: "terraform", Summary: "Delete a site, if it exists", Response: siteDeletionResponse{}},
+	{Pattern: "GET /api/v1/terraform/sites/{siteName}/dns", Tag: "terraform", Summary: "Read the DNS delegation resource of a site", Response: delegationView{}},
+	{Pattern: "PUT /api/v1/terraform/sites/{siteName}/dns", Tag: "terraform", Summary: "Delegate the subdomain of a site to the declared nameservers", Request: terraformDNSRequest{}, Response: delegationView{}},
+	{Pattern: "DELETE /api/v1/terraform/sites/{siteName}/dns", Tag: "terraform", Summary: "Roll the delegation of a site back, if there is one", Response: delegationView{}},
+	{Pattern: "GET /api/v1/terraform/sites/{siteName}/domains/{domain}", Tag: "terraform", Summary: "Read a domain resource", Response: domainView{}},
+	{Pattern: "PUT /api/v1/terraform/sites/{siteName}/domains/{domain}", Tag: "terraform", Summary: "Add a domain to a site, if it does not have it", Response: domainView{}},
+	{Pattern: "DELETE /api/v1/terraform/sites/{siteName}/domains/{domain}", Tag: "terraform", Summary: "Remove a domain from a site, if it has it", Status: http.StatusNoContent},
+	{Pattern: "GET /api/v1/quota", Tag: "sites", Summary: "Get the site quota of the user", Response: quotaResponse{}},
+	{Pattern: "GET /api/v1/sites/{siteName}/plan", Tag: "sites", Summary: "Get the plan and entitlements of a site", Response: planView{}},
+	{Pattern: "POST /api/v1/sites/{siteName}/build", Tag: "sites", Summary: "Rebuild a site", Response: BuildRecord{}},
+	{Pattern: "GET /api/v1/sites/{siteName}/accessibility", Tag: "sites", Summary: "Get the accessibility report of the last build", Response: a11yReport{}},
+	{Pattern: "GET /api/v1/sites/{siteName}/timeline", Tag: "sites", Summary: "Get the events of a site", Response: timelineResponse{}},
+	{Pattern: "GET /api/v1/sites/{siteName}/provisioning-log", Tag: "sites", Summary: "Download the provisioning log of a site", ContentType: "application/x-ndjson"},
+	{Pattern: "PUT /api/v1/sites/{siteName}/sections/{sectionId}/schedule", Tag: "sites", Summary: "Schedule the publication of a section", Request: PublishWindow{}, Response: SiteConfig{}},
+	{Pattern: "GET /api/v1/sites/{siteName}/verify", Tag: "sites", Summary: "Confirm the email address of a site (link of the verification mail)", Query: []string{"token"}, ContentType: "text/html"},
+	{Pattern: "POST /api/v1/sites/{siteName}/verification", Tag: "sites", Summary: "Send the verification mail again"},
+	{Pattern: "GET /api/v1/sites/{siteName}/settings/headers", Tag: "sites", Summary: "Get the response headers of a site"},
+	{Pattern: "PUT /api/v1/sites/{siteName}/settings/headers", Tag: "sites", Summary: "Set the response headers of a site", Request: HeaderSettings{}},
+	{Pattern: "PUT /api/v1/sites/{siteName}/region-rules", Tag: "sites", Summary: "Set the countries a site's widgets are available in", Request: RegionRules{}, Response: RegionRules{}},
+
+	// Domains and DNS
+	{Pattern: "GET /api/v1/sites/{siteName}/domains", Tag: "domains", Summary: "List the custom domains of a site", Response: []domainView{}},
+	{Pattern: "POST /api/v1/sites/{siteName}/domains", Tag: "domains", Summary: "Add a custom domain", Request: domainRequest{}, Response: domainView{}, Status: http.StatusCreated},
+	{Pattern: "POST /api/v1/sites/{siteName}/domains/{domain}/verify", Tag: "domains", Summary: "Verify the ownership of a custom domain", Response: domainView{}},
+	{Pattern: "DELETE /api/v1/sites/{siteName}/domains/{domain}", Tag: "domains", Summary: "Remove a custom domain", Status: http.StatusNoContent},
+	{Pattern: "POST /api/v1/sites/{siteName}/certificate", Tag: "domains", Summary: "Issue a TLS certificate for the custom domains", Response: CertificateStatus{}},
+	{Pattern: "GET /api/v1/sites/{siteName}/dns/delegation", Tag: "domains", Summary: "Get the DNS delegation of a site", Response: delegationView{}},
+	{Pattern: "PUT /api/v1/sites/{siteName}/dns/delegation", Tag: "domains", Summary: "Delegate a site's subdomain to other nameservers", Request: delegationRequest{}, Response: delegationView{}},
+	{Pattern: "DELETE /api/v1/sites/{siteName}/dns/delegation", Tag: "domains", Summary: "Remove the DNS delegation of a site", Response: delegationView{}},
+
+	// Content
+	{Pattern: "GET /api/v1/sites/{siteName}/pages", Tag: "content", Summary: "List the pages of a site", Response: []Page{}},
+	{Pattern: "POST /api/v1/sites/{siteName}/pages", Tag: "content", Summary: "Create a page", Request: Page{}, Response: Page{}, Status: http.StatusCreated},
+	{Pattern: "GET /api/v1/sites/{siteName}/pages/{slug}", Tag: "content", Summary: "Get a page", Response: Page{}},
+	{Pattern: "PUT /api/v1/sites/{siteName}/pages/{slug}", Tag: "content", Summary: "Update a page", Request: Page{}, Response: Page{}},
+	{Pattern: "DELETE /api/v1/sites/{siteName}/pages/{slug}", Tag: "content", Summary: "Delete a page", Status: http.StatusNoContent},
+	{Pattern: "GET /api/v1/sites/{siteName}/posts", Tag: "content", Summary: "List the blog posts of a site", Query: []string{"tag"}, Response: []Post{}},
+	{Pattern: "POST /api/v1/sites/{siteName}/posts", Tag: "content", Summary: "Create a blog post", Request: postRequest{}, Response: Post{}, Status: http.StatusCreated},
+	{Pattern: "GET /api/v1/sites/{siteName}/posts/{slug}", Tag: "content", Summary: "Get a blog post", Response: Post{}},
+	{Pattern: "PUT /api/v1/sites/{siteName}/posts/{slug}", Tag: "content", Summary: "Update a blog post", Request: postRequest{}, Response: Post{}},
+	{Pattern: "DELETE /api/v1/sites/{siteName}/posts/{slug}", Tag: "content", Summary: "Delete a blog post", Status: http.StatusNoContent},
+	{Pattern: "GET /api/v1/sites/{siteName}/posts/{slug}/comments", Tag: "content", Summary: "List the approved comments of a post", Response: []publicComment{}},
+	{Pattern: "POST /api/v1/sites/{siteName}/posts/{slug}/comments", Tag: "content", Summary: "Comment on a post", Request: commentRequest{}, Status: http.StatusCreated},
+	{Pattern: "PUT /api/v1/sites/{siteName}/comments/settings", Tag: "content", Summary: "Set the comment settings of a site", Request: CommentSettings{}, Response: CommentSettings{}},
+	{Pattern: "GET /api/v1/sites/{siteName}/comments", Tag: "content", Summary: "List the comments of a site", Query: []string{"status"}, Response: []Comment{}},
+	{Pattern: "PATCH /api/v1/sites/{siteName}/comments/{commentId}", Tag: "content", Summary: "Moderate a comment", Request: commentModerationRequest{}, Response: Comment{}},
+	{Pattern: "DELETE /api/v1/sites/{siteName}/comments/{commentId}", Tag: "content", Summary: "Delete a comment", Status: http.StatusNoContent},
+	{Pattern: "GET /api/v1/sites/{siteName}/products", Tag: "content", Summary: "List the products of a site", Response: []Product{}},
+	{Pattern: "POST /api/v1/sites/{siteName}/products", Tag: "content", Summary: "Create a product", Request: productRequest{}, Response: Product{}, Status: http.StatusCreated},
+	{Pattern: "GET /api/v1/sites/{siteName}/products/{productId}", Tag: "content", Summary: "Get a product", Response: Product{}},
+	{Pattern: "PUT /api/v1/sites/{siteName}/products/{productId}", Tag: "content", Summary: "Update a product", Request: productRequest{}, Response: Product{}},
+	{Pattern: "DELETE /api/v1/sites/{siteName}/products/{productId}", Tag: "content", Summary: "Delete a product", Status: http.StatusNoContent},
+	{Pattern: "PUT /api/v1/sites/{siteName}/location", Tag: "content", Summary: "Set the address of a site", Request: locationRequest{}, Response: Location{}},
+	{Pattern: "GET /api/v1/sites/{siteName}/opening-hours", Tag: "content", Summary: "Get the opening hours of a site", Response: OpeningHours{}},
+	{Pattern: "PUT /api/v1/sites/{siteName}/opening-hours", Tag: "content", Summary: "Set the opening hours of a site", Request: OpeningHours{}, Response: OpeningHours{}},
+	{Pattern: "GET /api/v1/sites/{siteName}/opening-hours/status", Tag: "content", Summary: "Whether a site is open now", Query: []string{"at"}, Response: openingStatus{}},
+	{Pattern: "PUT /api/v1/sites/{siteName}/social-feeds/{feedId}", Tag: "content", Summary: "Connect a social media feed", Request: socialFeedRequest{}, Response: SocialFeed{}},
+	{Pattern: "DELETE /api/v1/sites/{siteName}/social-feeds/{feedId}", Tag: "content", Summary: "Remove a social media feed", Status: http.StatusNoContent},
+	{Pattern: "GET /api/v1/sites/{siteName}/social-feeds/{feedId}/posts", Tag: "content", Summary: "Get the recent posts of a social media feed", Response: []SocialPost{}},
+
+	// Forms, bookings, newsletter and analytics
+	{Pattern: "GET /api/v1/sites/{siteName}/forms", Tag: "forms", Summary: "List the forms of a site", Response: []FormDefinition{}},
+	{Pattern: "PUT /api/v1/sites/{siteName}/forms/{formId}", Tag: "forms", Summary: "Create or update a form", Request: FormDefinition{}, Response: FormDefinition{}},
+	{Pattern: "DELETE /api/v1/sites/{siteName}/forms/{formId}", Tag: "forms", Summary: "Delete a form", Status: http.StatusNoContent},
+	{Pattern: "POST /api/v1/sites/{siteName}/forms/{formId}/submissions", Tag: "forms", Summary: "Submit a form (JSON or urlencoded)", Request: map[string]string{}, Response: formSubmissionResponse{}},
+	{Pattern: "GET /api/v1/sites/{siteName}/forms/{formId}/submissions", Tag: "forms", Summary: "List the submissions of a form", Query: []string{"format"}, Response: []FormSubmission{}},
+	{Pattern: "PUT /api/v1/sites/{siteName}/booking", Tag: "forms", Summary: "Set the booking settings of a site", Request: BookingConfig{}, Response: BookingConfig{}},
+	{Pattern: "GET /api/v1/sites/{siteName}/booking/slots", Tag: "forms", Summary: "List the free appointment slots", Query: []string{"from", "days"}, Response: []bookingSlot{}},
+	{Pattern: "GET /api/v1/sites/{siteName}/booking/bookings", Tag: "forms", Summary: "List the bookings of a site", Response: []Booking{}},
+	{Pattern: "POST /api/v1/sites/{siteName}/booking/bookings", Tag: "forms", Summary: "Book an appointment", Request: bookingRequest{}, Response: Booking{}, Status: http.StatusCreated},
+	{Pattern: "PUT /api/v1/sites/{siteName}/newsletter", Tag: "forms", Summary: "Connect a newsletter provider", Request: newsletterConfigRequest{}, Response: NewsletterConfig{}},
+	{Pattern: "POST /api/v1/sites/{siteName}/newsletter/subscribe", Tag: "forms", Summary: "Subscribe to the newsletter of a site", Request: newsletterSubscribeRequest{}},
+	{Pattern: "POST /api/v1/sites/{siteName}/pageviews", Tag: "forms", Summary: "Count a pageview", Request: pageviewRequest{}, Status: http.StatusNoContent},
+	{Pattern: "GET /api/v1/sites/{siteName}/analytics", Tag: "forms", Summary: "Get the pageview report of a site", Query: []string{"range", "source", "format"}, Response: analyticsReport{}},
+
+	// REST hooks
+	{Pattern: "GET /api/v1/rest-hooks/triggers", Tag: "rest-hooks", Summary: "List the REST hook triggers with sample data", Response: restHookTriggersResponse{}},
+	{Pattern: "GET /api/v1/sites/{siteName}/rest-hooks", Tag: "rest-hooks", Summary: "List the REST hook subscriptions of a site", Response: []RESTHook{}},
+	{Pattern: "POST /api/v1/sites/{siteName}/rest-hooks", Tag: "rest-hooks", Summary: "Subscribe a target URL to a trigger", Request: restHookRequest{}, Response: RESTHook{}, Status: http.StatusCreated},
+	{Pattern: "DELETE /api/v1/sites/{siteName}/rest-hooks/{hookId}", Tag: "rest-hooks", Summary: "Unsubscribe", Status: http.StatusNoContent},
+	{Pattern: "GET /api/v1/sites/{siteName}/rest-hooks/samples/{trigger}", Tag: "rest-hooks", Summary: "Get the latest items of a trigger", Query: []string{"formId"}, Response: []restHookPayload{}},
+	{Pattern: "GET /api/v1/calendar", Tag: "calendar", Summary: "Get the URLs of the user's calendar feeds", Response: calendarFeedsResponse{}},
+	{Pattern: "GET /api/v1/calendar/admin/events.ics", Tag: "calendar", Summary: "Get the calendar of scheduled events of all sites", Query: []string{"token"}, ContentType: "text/calendar"},
+	{Pattern: "GET /api/v1/calendar/orgs/{orgId}/events.ics", Tag: "calendar", Summary: "Get the calendar of scheduled events of an organization", Query: []string{"token"}, ContentType: "text/calendar"},
+
+	// Accounts
+	{Pattern: "POST /api/v1/auth/register", Tag: "auth", Summary: "Create an account", Request: credentialsRequest{}, Response: sessionResponse{}, Status: http.StatusCreated},
+	{Pattern: "POST /api/v1/auth/login", Tag: "auth", Summary: "Log in", Request: credentialsRequest{}, Response: sessionResponse{}},
+	{Pattern: "GET /api/v1/auth/me", Tag: "auth", Summary: "Get the logged-in user", Response: userView{}},
+	{Pattern: "DELETE /api/v1/auth/me", Tag: "auth", Summary: "Schedule the deletion of the logged-in user's account", Request: accountDeletionRequest{}, Response: accountDeletion{}, Status: http.StatusAccepted},
+	{Pattern: "GET /api/v1/auth/me/deletion", Tag: "auth", Summary: "Get the scheduled deletion of the account", Response: accountDeletion{}},
+	{Pattern: "DELETE /api/v1/auth/me/deletion", Tag: "auth", Summary: "Cancel the deletion of the account", Status: http.StatusNoContent},
+	{Pattern: "GET /api/v1/auth/config", Tag: "auth", Summary: "Get the login methods", Response: authConfigResponse{}},
+
+	// Instance
+	{Pattern: "/api/v1/sections", Tag: "meta", Summary: "List the sections a site can have", Response: []sectionInfo{}},
+	{Pattern: "/api/v1/themes", Tag: "meta", Summary: "List the themes", Response: []themeInfo{}},
+	{Pattern: "GET /api/v1/themes/{themeId}/preview", Tag: "meta", Summary: "Get the preview image of a theme"},
+	{Pattern: "GET /api/v1/meta/validation", Tag: "meta", Summary: "Get the validation rules of site creation", Response: validationSchema{}},
+	{Pattern: "GET /api/v1/config/bootstrap", Tag: "meta", Summary: "Get the settings the frontend needs at startup", Response: bootstrapConfig{}},
+	{Pattern: "GET /api/v1/version", Tag: "meta", Summary: "Get the version of the backend"},
+	{Pattern: "GET /api/v1/openapi.json", Tag: "meta", Summary: "Get this document"},
+	{Pattern: "GET /api/v1/docs", Tag: "meta", Summary: "Browse this document in Swagger UI", ContentType: "text/html"},
+	{Pattern: "/api/v1/health", Tag: "meta", Summary: "Get the state of the instance"},
+	{Pattern: "GET /api/v1/health/live", Tag: "meta", Summary: "Liveness probe"},
+	{Pattern: "GET /api/v1/health/ready", Tag: "meta", Summary: "Readiness probe"},
+	{Pattern: "POST /api/v1/funnel/events", Tag: "meta", Summary: "Record a step of the signup funnel", Request: funnelEventRequest{}, Status: http.StatusNoContent},
+	{Pattern: "GET /api/v1/coupons/{code}/check", Tag: "meta", Summary: "Check a coupon or referral code", Response: validationResponse{}},
+
+	// Operators
+	{Pattern: "GET /api/v1/funnel", Tag: "admin", Summary: "Get the signup funnel report", Query: []string{"range"}, Response: funnelReport{}},
+	{Pattern: "GET /api/v1/coupons", Tag: "admin", Summary: "List the coupons with their statistics", Response: []couponStats{}},
+	{Pattern: "PUT /api/v1/coupons/{code}", Tag: "admin", Summary: "Create or update a coupon", Request: Coupon{}, Response: couponStats{}},
+	{Pattern: "DELETE /api/v1/coupons/{code}", Tag: "admin", Summary: "Delete a coupon", Status: http.StatusNoContent},
+	{Pattern: "GET /api/v1/retention", Tag: "admin", Summary: "Get the retention policies and what they would remove"},
+	{Pattern: "GET /api/v1/archive", Tag: "admin", Summary: "List the archived sites", Query: []string{"siteName"}},
+	{Pattern: "GET /api/v1/archive/{siteName}/{archiveId}", Tag: "admin", Summary: "Get an archived site", Response: archiveDetail{}},
+	{Pattern: "GET /api/v1/dns/mock", Tag: "admin", Summary: "Get the records of the mock DNS provider", Response: mockZone{}},
+	{Pattern: "DELETE /api/v1/dns/mock", Tag: "admin", Summary: "Reset the mock DNS provider", Status: http.StatusNoContent},
+	{Pattern: "GET /api/v1/allocations/{siteName}", Tag: "admin", Summary: "Get the allocation of a site name", Query: []string{"instance"}, Response: nameAllocation{}},
+	{Pattern: "PUT /api/v1/allocations/{siteName}", Tag: "admin", Summary: "Allocate a site name to an instance", Query: []string{"instance"}, Response: nameAllocation{}, Status: http.StatusCreated},
+	{Pattern: "DELETE /api/v1/allocations/{siteName}", Tag: "admin", Summary: "Release a site name", Query: []string{"instance"}, Status: http.StatusNoContent},
+	{Pattern: "GET /api/v1/admin/config", Tag: "admin", Summary: "Export the instance config", Response: configBundle{}},
+	{Pattern: "POST /api/v1/admin/config", Tag: "admin", Summary: "Import an instance config", Query: []string{"dryRun"}, Request: configBundle{}, Response: configImportResult{}},
+	{Pattern: "GET /api/v1/admin/hooks", Tag: "admin", Summary: "List the site hooks"},
+	{Pattern: "PUT /api/v1/admin/sites/{siteName}/plan", Tag: "admin", Summary: "Move a site to a plan", Request: sitePlanRequest{}, Response: planView{}},
+	{Pattern: "GET /api/v1/admin/integrity", Tag: "admin", Summary: "List the site configs changed outside the API", Response: integrityResponse{}},
+	{Pattern: "POST /api/v1/admin/integrity", Tag: "admin", Summary: "Check the site configs now", Response: integrityResponse{}},
+	{Pattern: "POST /api/v1/admin/sites/{siteName}/config/restore", Tag: "admin", Summary: "Restore the last config written by the API"},
+	{Pattern: "POST /api/v1/admin/sites/{siteName}/config/accept", Tag: "admin", Summary: "Accept a config changed outside the API"},
+	{Pattern: "GET /api/v1/admin/gitops", Tag: "admin", Summary: "Get the report of the last GitOps sync", Response: gitOpsReport{}},
+	{Pattern: "POST /api/v1/admin/gitops/sync", Tag: "admin", Summary: "Sync the sites with the GitOps repo now", Query: []string{"dryRun", "force"}, Response: gitOpsReport{}},
+	{Pattern: "POST /api/v1/admin/themes/reload", Tag: "admin", Summary: "Read the themes from disk again", Response: themeReloadResponse{}},
+	{Pattern: "GET /api/v1/admin/moderation", Tag: "admin", Summary: "List the sites flagged by the content scanner", Query: []string{"status"}, Response: []moderationScan{}},
+	{Pattern: "GET /api/v1/admin/moderation/{siteName}", Tag: "admin", Summary: "Get the last content scan of a site", Response: moderationScan{}},
+	{Pattern: "POST /api/v1/admin/moderation/{siteName}/scan", Tag: "admin", Summary: "Scan the current build of a site again", Response: moderationScan{}},
+	{Pattern: "POST /api/v1/admin/moderation/{siteName}/approve", Tag: "admin", Summary: "Approve a flagged site, lifting its suspension", Request: moderationDecision{}, Response: moderationScan{}},
+	{Pattern: "POST /api/v1/admin/moderation/{siteName}/suspend", Tag: "admin", Summary: "Suspend a site", Request: moderationDecision{}, Response: Suspension{}},
+	{Pattern: "GET /api/v1/admin/account-deletions", Tag: "admin", Summary: "List the scheduled account deletions", Response: []accountDeletion{}},
+	{Pattern: "DELETE /api/v1/admin/users/{userId}", Tag: "admin", Summary: "Schedule the deletion of an account, or delete it now", Query: []string{"immediate"}, Response: accountDeletionReport{}, Status: http.StatusAccepted},
+	{Pattern: "DELETE /api/v1/admin/users/{userId}/deletion", Tag: "admin", Summary: "Cancel the deletion of an account", Status: http.StatusNoContent},
+	{Pattern: "GET /api/v1/admin/webhooks", Tag: "admin", Summary: "List the webhooks with their last delivery", Response: []webhookView{}},
+	{Pattern: "POST /api/v1/admin/webhooks", Tag: "admin", Summary: "Register a webhook", Request: webhookEndpoint{}, Response: Webhook{}, Status: http.StatusCreated},
+	{Pattern: "DELETE /api/v1/admin/webhooks/{webhookId}", Tag: "admin", Summary: "Remove a webhook", Status: http.StatusNoContent},
+	{Pattern: "GET /api/v1/admin/webhooks/{webhookId}/deliveries", Tag: "admin", Summary: "List the deliveries of a webhook", Query: []string{"status"}, Response: []webhookDelivery{}},
+	{Pattern: "POST /api/v1/admin/webhooks/{webhookId}/deliveries/{deliveryId}/redeliver", Tag: "admin", Summary: "Send a delivery again", Response: webhookDelivery{}, Status: http.StatusAccepted},
+	{Pattern: "POST /api/v1/admin/webhooks/{webhookId}/ping", Tag: "admin", Summary: "Send a ping event to a webhook", Response: webhookDelivery{}, Status: http.StatusAccepted},
+	{Pattern: "GET /api/v1/admin/audit", Tag: "admin", Summary: "List the audit log", Query: []string{"site", "actor", "action", "since", "until", "limit"}},
+	{Pattern: "GET /api/v1/admin/orgs", Tag: "admin", Summary: "List the organizations", Response: []Organization{}},
+	{Pattern: "PUT /api/v1/admin/orgs/{orgId}", Tag: "admin", Summary: "Create or update an organization", Request: Organization{}, Response: Organization{}},
+	{Pattern: "DELETE /api/v1/admin/orgs/{orgId}", Tag: "admin", Summary: "Delete an organization", Status: http.StatusNoContent},
+	{Pattern: "GET /api/v1/admin/premium-names", Tag: "admin", Summary: "List the premium name purchases", Response: []PremiumPurchase{}},
+	{Pattern: "PUT /api/v1/admin/premium-names/{siteName}", Tag: "admin", Summary: "Confirm the purchase of a premium name", Request: premiumPurchaseRequest{}, Response: PremiumPurchase{}},
+	{Pattern: "DELETE /api/v1/admin/premium-names/{siteName}", Tag: "admin", Summary: "Cancel a premium name purchase", Status: http.StatusNoContent},
+	{Pattern: "GET /api/v1/admin/email-templates", Tag: "admin", Summary: "List the email templates", Response: []emailTemplateView{}},
+	{Pattern: "GET /api/v1/admin/email-templates/{name}", Tag: "admin", Summary: "Get an email template", Response: emailTemplateView{}},
+	{Pattern: "POST /api/v1/admin/email-templates/{name}/preview", Tag: "admin", Summary: "Render an email template", Request: emailTemplateRequest{}},
+	{Pattern: "POST /api/v1/admin/email-templates/{name}/test", Tag: "admin", Summary: "Send an email template to an address", Request: emailTemplateRequest{}},
+}
+
+var openAPIPathParam = regexp.MustCompile(`\{([a-zA-Z]+)\}`)
+
+// openAPIDocument builds the document of the operations registered on mux.
+func openAPIDocument(mux *http.ServeMux) map[string]any {
+	schemas := map[string]any{}
+	paths := map[string]map[string]any{}
+	for _, op := range apiOperations {
+		method, path, found := strings.Cut(op.Pattern, " ")
+		if !found {
+			method, path = http.MethodGet, op.Pattern
+		}
+		probe, err := http.NewRequest(method, openAPIPathParam.ReplaceAllString(path, "x"), nil)
+		if err != nil {
+			continue
+		}
+		if _, pattern := mux.Handler(probe); pattern != op.Pattern {
+			continue // not registered here
+		}
+		operation := map[string]any{
+			"operationId": openAPIOperationID(method, path),
+			"summary":     op.Summary,
+			"tags":        []string{op.Tag},
+			"responses":   openAPIResponses(op, schemas),
+		}
+		var params []map[string]any
+		for _, m := range openAPIPathParam.FindAllStringSubmatch(path, -1) {
+			params = append(params, map[string]any{"name": m[1], "in": "path", "required": true, "schema": map[string]any{"type": "string"}})
+		}
+		for _, q := range op.Query {
+			params = append(params, map[string]any{"name": q, "in": "query", "schema": map[string]any{"type": "string"}})
+		}
+		for _, h := range op.Headers {
+			params = append(params, map[string]any{"name": h, "in": "header", "schema": map[string]any{"type": "string"}})
+		}
+		if len(params) > 0 {
+			operation["parameters"] = params
+		}
+		if op.Request != nil {
+			operation["requestBody"] = map[string]any{
+				"required": true,
+				"content":  map[string]any{"application/json": map[string]any{"schema": openAPISchema(reflect.TypeOf(op.Request), schemas)}},
+			}
+		}
+		if publicRoutes[op.Pattern] {
+			operation["security"] = []any{}
+		}
+		if paths[path] == nil {
+			paths[path] = map[string]any{}
+		}
+		paths[path][strings.ToLower(method)] = operation
+	}
+
+	doc := map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":       "flox backend API",
+			"version":     Version,
+			"description": "Site creation and management API of flox. Without a session, operations are anonymous; sites with an owner need the owner's session, the admin endpoints an admin session or admin.token.",
+		},
+		"paths": paths,
+		"components": map[string]any{
+			"schemas": schemas,
+			"securitySchemes": map[string]any{
+				"bearerAuth": map[string]any{"type": "http", "scheme": "bearer", "bearerFormat": "JWT"},
+			},
+		},
+		"security": []any{map[string]any{}, map[string]any{"bearerAuth": []string{}}},
+	}
+	if config.Server.PublicURL != "" {
+		doc["servers"] = []any{map[string]any{"url": strings.TrimSuffix(config.Server.PublicURL, "/")}}
+	}
+	return doc
+}
+
+func openAPIResponses(op apiOperation, schemas map[string]any) map[string]any {
+	status := op.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	success := map[string]any{"description": http.StatusText(status)}
+	switch {
+	case op.ContentType != "":
+		success["content"] = map[string]any{op.ContentType: map[string]any{"schema": map[string]any{"type": "string"}}}
+	case op.Response != nil:
+		success["content"] = map[string]any{"application/json": map[string]any{"schema": openAPISchema(reflect.TypeOf(op.Response), schemas)}}
+	case status != http.StatusNoContent:
+		success["content"] = map[string]any{"application/json": map[string]any{"schema": map[string]any{"type": "object"}}}
+	}
+	return map[string]any{
+		strconv.Itoa(status): success,
+		"default": map[string]any{
+			"description": "Error, see the code",
+			"content":     map[string]any{"application/json": map[string]any{"schema": openAPISchema(reflect.TypeOf(APIError{}), schemas)}},
+		},
+	}
+}
+
+// openAPIOperationID derives an ID like getSitesBySiteName from a route.
+func openAPIOperationID(method, path string) string {
+	id := strings.ToLower(method)
+	for _, segment := range strings.Split(strings.TrimPrefix(path, "/api/v1/"), "/") {
+		if name, ok := strings.CutPrefix(segment, "{"); ok {
+			segment = "by-" + strings.TrimSuffix(name, "}")
+		}
+		for _, word := range strings.FieldsFunc(segment, func(r rune) bool { return r == '-' || r == '.' || r == '_' }) {
+			id += strings.ToUpper(word[:1]) + word[1:]
+		}
+	}
+	return id
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// openAPISchema returns the schema of the JSON encoding of t. Named structs
+// are added to schemas and referenced.
+func openAPISchema(t reflect.Type, schemas map[string]any) map[string]any {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch {
+	case t == timeType:
+		return map[string]any{"type": "string", "format": "date-time"}
+	case t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Uint8:
+		return map[string]any{"type": "string", "format": "byte"}
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return map[string]any{"type": "integer"}
+	case reflect.Int64, reflect.Uint64:
+		return map[string]any{"type": "integer", "format": "int64"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return map[string]any{"type": "array", "items": openAPISchema(t.Elem(), schemas)}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": openAPISchema(t.Elem(), schemas)}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return openAPIStructSchema(t, schemas)
+		}
+		ref := map[string]any{"$ref": "#/components/schemas/" + t.Name()}
+		if _, ok := schemas[t.Name()]; !ok {
+			schemas[t.Name()] = map[string]any{} // placeholder against recursion
+			schemas[t.Name()] = openAPIStructSchema(t, schemas)
+		}
+		return ref
+	}
+	return map[string]any{} // any value
+}
+
+func openAPIStructSchema(t reflect.Type, schemas map[string]any) map[string]any {
+	properties := map[string]any{}
+	var required []string
+	var addFields func(t reflect.Type)
+	addFields = func(t reflect.Type) {
+		for i := range t.NumField() {
+			f := t.Field(i)
+			tag := f.Tag.Get("json")
+			if tag == "-" {
+				continue
+			}
+			name, opts, _ := strings.Cut(tag, ",")
+			if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+				addFields(f.Type)
+				continue
+			}
+			if !f.IsExported() {
+				continue
+			}
+			if name == "" {
+				name = f.Name
+			}
+			properties[name] = openAPISchema(f.Type, schemas)
+			if !strings.Contains(opts, "omitempty") && !strings.Contains(opts, "omitzero") {
+				required = append(required, name)
+			}
+		}
+	}
+	addFields(t)
+	schema := map[string]any{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
+
+var openAPICache struct {
+	sync.Mutex
+	config *Config
+	body   []byte
+}
+
+// openAPIHandler serves the document of mux, built once per config
+// snapshot.
+func openAPIHandler(mux *http.ServeMux) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		openAPICache.Lock()
+		if c := currentConfig(); openAPICache.config != c {
+			body, err := json.MarshalIndent(openAPIDocument(mux), "", "  ")
+			if err != nil {
+				openAPICache.Unlock()
+				slog.ErrorContext(r.Context(), "error encoding OpenAPI document", "error", err)
+				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+				return
+			}
+			openAPICache.config, openAPICache.body = c, body
+		}
+		body := openAPICache.body
+		openAPICache.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body)
+	}
+}
+
+const swaggerUIPage = `<!DOCTYPE html>
+<html lang="en">
+<head>
+  <meta charset="utf-8">
+  <title>flox API</title>
+  <link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@5/swagger-ui.css">
+</head>
+<body>
+  <div id="swagger-ui"></div>
+  <script src="https://unpkg.com/swagger-ui-dist@5/swagger-ui-bundle.js" crossorigin></script>
+  <script>
+    window.ui = SwaggerUIBundle({url: "openapi.json", dom_id: "#swagger-ui"});
+  </script>
+</body>
+</html>
+`
+
+// apiDocsHandler serves Swagger UI for the document next to it.
+func apiDocsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write([]byte(swaggerUIPage))
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Organizations reserve site name prefixes for their members, so nobody else
+// can create e.g. acme-shop once "acme-" belongs to Acme. Admins manage them
+// with /api/v1/admin/orgs; members are user IDs or emails of logged-in users.
+// The prefixes are checked wherever a name is validated for creation, admins
+// may use any name. Sites that already match a prefix are kept.
+
+const orgsFile = ".orgs.json" // in sitesBaseDir
+
+var (
+	orgIDRegex     = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,62}$`)
+	orgPrefixRegex = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{2,61}$`)
+)
+
+type Organization struct {
+	ID       string   `json:"id"`
+	Name     string   `json:"name"`
+	Members  []string `json:"members"`  // user IDs or emails
+	Prefixes []string `json:"prefixes"` // e.g. "acme-"; "acme-*" is accepted
+	// CreatedAt is set by the server.
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+func (o *Organization) validate() error {
+	if !orgIDRegex.MatchString(o.ID) {
+		return errors.New("id must be 1-63 lowercase letters, digits or hyphens")
+	}
+	o.Name = strings.TrimSpace(o.Name)
+	if o.Name == "" || len(o.Name) > 100 {
+		return errors.New("name must be 1-100 characters")
+	}
+	if len(o.Prefixes) == 0 {
+		return errors.New("at least one prefix is needed")
+	}
+	var prefixes []string
+	for _, p := range o.Prefixes {
+		p = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(p)), "*")
+		if !orgPrefixRegex.MatchString(p) {
+			return fmt.Errorf("prefix %q must be 3-62 letters, digits or hyphens", p)
+		}
+		if !slices.Contains(prefixes, p) {
+			prefixes = append(prefixes, p)
+		}
+	}
+	o.Prefixes = prefixes
+	var members []string
+	for _, m := range o.Members {
+		m = strings.ToLower(strings.TrimSpace(m))
+		if m == "" {
+			return errors.New("members must not be empty")
+		}
+		if !slices.Contains(members, m) {
+			members = append(members, m)
+		}
+	}
+	o.Members = members
+	if o.Members == nil {
+		o.Members = []string{}
+	}
+	return nil
+}
+
+// isMember reports whether the logged-in user of claims belongs to the
+// organization.
+func (o *Organization) isMember(claims sessionClaims) bool {
+	return claims.Subject != "" && slices.ContainsFunc(o.Members, func(m string) bool {
+		return m == strings.ToLower(claims.Subject) || (claims.Email != "" && m == strings.ToLower(claims.Email))
+	})
+}
+
+// overlap returns a prefix of o that one of p's prefixes starts with or the
+// other way round, and that prefix of p.
+func (o *Organization) overlap(p *Organization) (string, string, bool) {
+	for _, a := range o.Prefixes {
+		for _, b := range p.Prefixes {
+			if strings.HasPrefix(a, b) || strings.HasPrefix(b, a) {
+				return a, b, true
+			}
+		}
+	}
+	return "", "", false
+}
+
+var orgsMu sync.Mutex
+
+func readOrgs() (map[string]*Organization, error) {
+	orgs := map[string]*Organization{}
+	data, err := os.ReadFile(filepath.Join(sitesBaseDir, orgsFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return orgs, nil
+		}
+		return nil, err
+	}
+	err = json.Unmarshal(data, &orgs)
+	return orgs, err
+}
+
+func writeOrgs(orgs map[string]*Organization) error {
+	data, err := json.MarshalIndent(orgs, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(sitesBaseDir, orgsFile)
+	return writeFileAtomic(path, data, 0644)
+}
+
+// validateSiteNameFor is validateSiteName for the user of r, who may not
+// take a name with the prefix of an organization they do not belong to.
+func validateSiteNameFor(r *http.Request, siteName string) error {
+	if err := validateSiteName(siteName); err != nil {
+		return err
+	}
+	// Admins may override a collision, so no check for them comes after it.
+	if err := checkHostnameCollision(r.Context(), siteName); err != nil {
+		return err
+	}
+	if isAdmin(r) {
+		return nil
+	}
+	orgs, err := readOrgs()
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error reading organizations", "error", err)
+		return errors.New("could not check whether the name is available, try again later")
+	}
+	name, claims := strings.ToLower(siteName), currentSession(r)
+	for _, org := range orgs {
+		for _, prefix := range org.Prefixes {
+			if strings.HasPrefix(name, prefix) && !org.isMember(claims) {
+				return &APIError{Code: codeNameReserved, Message: fmt.Sprintf("site names starting with %q are reserved for %s", prefix, org.Name)}
+			}
+		}
+	}
+	return nil
+}
+
+// --- Handlers ---
+
+// listOrgsHandler returns all organizations sorted by ID.
+func listOrgsHandler(w http.ResponseWriter, r *http.Request) {
+	orgs, err := readOrgs()
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error reading organizations", "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	list := make([]*Organization, 0, len(orgs))
+	for _, org := range orgs {
+		list = append(list, org)
+	}
+	slices.SortFunc(list, func(a, b *Organization) int { return strings.Compare(a.ID, b.ID) })
+	respondJSON(w, list)
+}
+
+// putOrgHandler creates or replaces an organization. A prefix overlapping
+// one of another organization is refused.
+func putOrgHandler(w http.ResponseWriter, r *http.Request) {
+	var org Organization
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&org); err != nil {
+		http.Error(w, "Invalid JSON request", http.StatusBadRequest)
+		return
+	}
+	org.ID = r.PathValue("orgId")
+	if err := org.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	orgsMu.Lock()
+	defer orgsMu.Unlock()
+	orgs, err := readOrgs()
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error reading organizations", "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	for _, other := range orgs {
+		if other.ID == org.ID {
+			continue
+		}
+		if a, b, ok := org.overlap(other); ok {
+			http.Error(w, fmt.Sprintf("prefix %q overlaps %q of organization %s", a, b, other.ID), http.StatusConflict)
+			return
+		}
+	}
+	org.CreatedAt = time.Now().UTC()
+	if existing, ok := orgs[org.ID]; ok {
+		org.CreatedAt = existing.CreatedAt
+	}
+	orgs[org.ID] = &org
+	if err := writeOrgs(orgs); err != nil {
+		slog.ErrorContext(r.Context(), "error writing organizations", "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	writeAuditEntry(r.Context(), auditEntry{Action: "org.update", Target: org.ID, Digest: payloadDigest(org)})
+	respondJSON(w, org)
+}
+
+// deleteOrgHandler deletes an organization, which frees its prefixes.
+func deleteOrgHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("orgId")
+	orgsMu.Lock()
+	defer orgsMu.Unlock()
+	orgs, err := readOrgs()
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error reading organizations", "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if _, ok := orgs[id]; !ok {
+		http.Error(w, "Organization not found", http.StatusNotFound)
+		return
+	}
+	delete(orgs, id)
+	if err := writeOrgs(orgs); err != nil {
+		slog.ErrorContext(r.Context(), "error writing organizations", "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	writeAuditEntry(r.Context(), auditEntry{Action: "org.delete", Target: id})
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"syscall"
+	"time"
+)
+
+// Outbound requests to hosts chosen by site owners: REST hook targets,
+// booking calendar feeds, listmonk instances and Mastodon instances. They
+// go through ownerURLClient, which only connects to public addresses. The
+// address is checked when the connection is made, after DNS resolution, so
+// a hostname pointing at an internal address (also one that changes after
+// the URL was accepted) is refused like a literal one. Redirects are not
+// followed, and HTTP(S)_PROXY is not used, as the proxy would connect for
+// us. Without this a site owner could make the backend reach the cloud
+// metadata service or hosts on the internal network and read the answer
+// from the delivery status.
+
+var errNonPublicAddress = errors.New("connecting to non-public addresses is not allowed")
+
+// nonPublicPrefixes are ranges not covered by the netip predicates.
+var nonPublicPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"), // carrier-grade NAT
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"), // benchmarking
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("64:ff9b::/96"), // NAT64 of any IPv4 address
+}
+
+// publicAddress reports whether addr may be connected to for a site owner:
+// not loopback, private (including IPv6 ULA), link-local, multicast or
+// otherwise reserved.
+func publicAddress(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if !addr.IsGlobalUnicast() || addr.IsPrivate() {
+		return false
+	}
+	for _, p := range nonPublicPrefixes {
+		if p.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+// dialPublicOnly is the Control hook of the dialer, called with the
+// resolved address of every connection attempt.
+func dialPublicOnly(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil || !publicAddress(addr) {
+		return fmt.Errorf("%w: %s", errNonPublicAddress, host)
+	}
+	return nil
+}
+
+// newOwnerURLClient returns a client for URLs of site owners.
+func newOwnerURLClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{Timeout: timeout, Control: dialPublicOnly}
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: timeout,
+			ForceAttemptHTTP2:   true,
+			MaxIdleConns:        20,
+			IdleConnTimeout:     90 * time.Second,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return fmt.Errorf("redirect to %s not followed", req.URL.Redacted())
+		},
+	}
+}
+
+var ownerURLClient = newOwnerURLClient(10 * time.Second)
+
+// validateOwnerURL checks a URL given by a site owner: https, a host and no
+// credentials in it. A literal address must be public; hostnames are
+// checked when connecting.
+func validateOwnerURL(raw, field string) error {
+	u, err := url.Parse(raw)
+	if err != nil || u.Scheme != "https" || u.Hostname() == "" || u.User != nil || len(raw) > 2048 {
+		return fmt.Errorf("%s must be an https:// URL", field)
+	}
+	if addr, err := netip.ParseAddr(u.Hostname()); err == nil && !publicAddress(addr) {
+		return fmt.Errorf("%s must not point to a non-public address", field)
+	}
+	return nil
+}
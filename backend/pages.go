@@ -0,0 +1,293 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// homePageSlug is the page rendered at the site root.
+const homePageSlug = "index"
+
+var pageSlugRegex = regexp.MustCompile(`^[a-z0-9]([a-z0-9\-]{0,62}[a-z0-9])?$`)
+
+// reservedPageSlugs collide with other build output.
+var reservedPageSlugs = []string{blogOutputDir, shopOutputDir, "api", "assets"}
+
+// Page is one page of a multi-page site. Sites without pages are one-pagers
+// showing all sections of InitialContent.
+type Page struct {
+	Slug     string   `json:"slug"`
+	Title    string   `json:"title"`
+	Sections []string `json:"sections"`
+	NavOrder int      `json:"navOrder"`
+	// Hidden pages are built but not linked in the navigation.
+	Hidden bool `json:"hidden,omitempty"`
+}
+
+type navItem struct {
+	Title   string
+	URL     string
+	Current bool
+}
+
+func (p Page) outputPath() string {
+	if p.Slug == homePageSlug {
+		return "index.html"
+	}
+	return path.Join(p.Slug, "index.html")
+}
+
+func (p Page) url() string {
+	if p.Slug == homePageSlug {
+		return "/"
+	}
+	return "/" + p.Slug + "/"
+}
+
+func (p *Page) validate(siteConfig SiteConfig) error {
+	p.Title = strings.TrimSpace(p.Title)
+	if !pageSlugRegex.MatchString(p.Slug) {
+		return errors.New("slug must be lowercase letters, digits and hyphens")
+	}
+	if slices.Contains(reservedPageSlugs, p.Slug) {
+		return fmt.Errorf("slug %q is reserved", p.Slug)
+	}
+	if p.Title == "" || len(p.Title) > 100 {
+		return errors.New("title must be 1-100 characters")
+	}
+	seen := map[string]bool{}
+	for _, id := range p.Sections {
+		if _, ok := findSection(id); !ok {
+			return fmt.Errorf("unknown section %q", id)
+		}
+		if !slices.Contains(siteConfig.InitialContent, id) {
+			return fmt.Errorf("section %q is not enabled for this site", id)
+		}
+		if seen[id] {
+			return fmt.Errorf("section %q is listed twice", id)
+		}
+		seen[id] = true
+	}
+	return nil
+}
+
+func (sc SiteConfig) findPage(slug string) (*Page, int) {
+	for i := range sc.Pages {
+		if sc.Pages[i].Slug == slug {
+			return &sc.Pages[i], i
+		}
+	}
+	return nil, -1
+}
+
+// sortedPages returns the pages in navigation order.
+func (sc SiteConfig) sortedPages() []Page {
+	pages := slices.Clone(sc.Pages)
+	slices.SortStableFunc(pages, func(a, b Page) int { return a.NavOrder - b.NavOrder })
+	return pages
+}
+
+// renderPages writes the site's pages into publicDir. data carries the
+// section content shared by all pages; published limits the sections to
+// those currently scheduled.
+func renderPages(siteConfig SiteConfig, publicDir string, data sitePageData, published []string, record *BuildRecord) error {
+	layout, err := siteTemplate(siteConfig.SiteName)
+	if err != nil {
+		return err
+	}
+	pages := siteConfig.sortedPages()
+	if len(pages) == 0 {
+		// One-pager: every published section on the home page.
+		pages = []Page{{Slug: homePageSlug, Title: siteConfig.SiteName, Sections: published}}
+	}
+
+	for _, page := range pages {
+		var sections []string
+		for _, id := range page.Sections {
+			if slices.Contains(published, id) {
+				sections = append(sections, id)
+			}
+		}
+		pageData := data
+		pageData.Sections = sectionViews(sections)
+		if page.Slug != homePageSlug {
+			pageData.Title = page.Title + " – " + siteConfig.SiteName
+		}
+		if len(siteConfig.Pages) > 0 {
+			for _, p := range pages {
+				if !p.Hidden {
+					pageData.Nav = append(pageData.Nav, navItem{Title: p.Title, URL: p.url(), Current: p.Slug == page.Slug})
+				}
+			}
+		}
+		rel := page.outputPath()
+		if err := executeToFile(layout, "site", filepath.Join(publicDir, rel), pageData); err != nil {
+			return err
+		}
+		record.Pages = append(record.Pages, rel)
+	}
+	return removeStalePages(record.SiteName, publicDir, pages)
+}
+
+// removeStalePages deletes the output of pages that existed in the previous
+// build but are gone now.
+func removeStalePages(siteName, publicDir string, pages []Page) error {
+	previous, err := latestBuildRecord(siteName)
+	if err != nil || previous == nil {
+		return err
+	}
+	for _, rel := range previous.Pages {
+		dir, file := path.Split(rel)
+		slug := strings.TrimSuffix(dir, "/")
+		if file != "index.html" || slug == "" || strings.Contains(slug, "/") || slices.Contains(reservedPageSlugs, slug) {
+			continue
+		}
+		if !slices.ContainsFunc(pages, func(p Page) bool { return p.Slug == slug }) {
+			if err := os.RemoveAll(filepath.Join(publicDir, slug)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// --- Handlers ---
+
+func listPagesHandler(w http.ResponseWriter, r *http.Request) {
+	siteName, ok := siteNameFromPath(w, r)
+	if !ok {
+		return
+	}
+	siteConfig, err := readSiteConfig(siteName)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error reading site config", "site", siteName, "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	pages := siteConfig.sortedPages()
+	if pages == nil {
+		pages = []Page{}
+	}
+	respondJSON(w, pages)
+}
+
+func getPageHandler(w http.ResponseWriter, r *http.Request) {
+	siteName, ok := siteNameFromPath(w, r)
+	if !ok {
+		return
+	}
+	siteConfig, err := readSiteConfig(siteName)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error reading site config", "site", siteName, "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	page, _ := siteConfig.findPage(r.PathValue("slug"))
+	if page == nil {
+		http.Error(w, "Page not found", http.StatusNotFound)
+		return
+	}
+	respondJSON(w, page)
+}
+
+// savePage validates and stores a page. oldSlug is empty for new pages.
+func savePage(w http.ResponseWriter, r *http.Request, oldSlug string) {
+	siteName, ok := siteNameFromPath(w, r)
+	if !ok {
+		return
+	}
+	var page Page
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&page); err != nil {
+		http.Error(w, "Invalid JSON request", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := updateSiteConfig(siteName, func(siteConfig *SiteConfig) error {
+		if err := page.validate(*siteConfig); err != nil {
+			return &httpError{http.StatusBadRequest, err.Error()}
+		}
+		i := -1
+		if oldSlug != "" {
+			if _, i = siteConfig.findPage(oldSlug); i < 0 {
+				return &httpError{http.StatusNotFound, "Page not found"}
+			}
+			if oldSlug == homePageSlug && page.Slug != homePageSlug {
+				return &httpError{http.StatusBadRequest, "The home page cannot be renamed"}
+			}
+		}
+		if existing, j := siteConfig.findPage(page.Slug); existing != nil && j != i {
+			return &httpError{http.StatusConflict, fmt.Sprintf("A page with slug %q already exists", page.Slug)}
+		}
+		if i >= 0 {
+			siteConfig.Pages[i] = page
+		} else {
+			if err := checkPageEntitlement(*siteConfig, len(siteConfig.Pages)+1); err != nil {
+				return err
+			}
+			siteConfig.Pages = append(siteConfig.Pages, page)
+		}
+		if _, home := siteConfig.findPage(homePageSlug); home < 0 {
+			return &httpError{http.StatusBadRequest, fmt.Sprintf("Create the home page (slug %q) first", homePageSlug)}
+		}
+		return nil
+	}); err != nil {
+		writeSiteUpdateError(w, r, siteName, err)
+		return
+	}
+	recordSiteEvent(siteName, SiteEvent{Type: "page.saved", Message: page.Slug})
+
+	if _, err := buildSite(siteName); err != nil {
+		slog.ErrorContext(r.Context(), "error building site", "site", siteName, "error", err)
+	}
+	if oldSlug == "" {
+		respondJSONStatus(w, http.StatusCreated, page)
+		return
+	}
+	respondJSON(w, page)
+}
+
+func createPageHandler(w http.ResponseWriter, r *http.Request) {
+	savePage(w, r, "")
+}
+
+func updatePageHandler(w http.ResponseWriter, r *http.Request) {
+	savePage(w, r, r.PathValue("slug"))
+}
+
+func deletePageHandler(w http.ResponseWriter, r *http.Request) {
+	siteName, ok := siteNameFromPath(w, r)
+	if !ok {
+		return
+	}
+	slug := r.PathValue("slug")
+	if _, err := updateSiteConfig(siteName, func(siteConfig *SiteConfig) error {
+		_, i := siteConfig.findPage(slug)
+		if i < 0 {
+			return &httpError{http.StatusNotFound, "Page not found"}
+		}
+		if slug == homePageSlug && len(siteConfig.Pages) > 1 {
+			return &httpError{http.StatusConflict, "Delete the other pages before the home page"}
+		}
+		siteConfig.Pages = slices.Delete(siteConfig.Pages, i, i+1)
+		return nil
+	}); err != nil {
+		writeSiteUpdateError(w, r, siteName, err)
+		return
+	}
+	recordSiteEvent(siteName, SiteEvent{Type: "page.deleted", Message: slug})
+
+	if _, err := buildSite(siteName); err != nil {
+		slog.ErrorContext(r.Context(), "error building site", "site", siteName, "error", err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
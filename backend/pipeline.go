@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// Provisioning pipeline: a site is published by the steps in
+// provisioning.steps, in their order. build and dns are built in; any other
+// step runs an executable from <paths.script_dir>/provision, e.g. to install
+// a CMS before the site gets its DNS record:
+//
+//	provisioning:
+//	  steps:
+//	    - name: build
+//	    - {name: cms, run: cms-install.sh, undo: cms-remove.sh, timeout: 2m}
+//	    - name: dns
+//
+// A script gets the site config (without credentials) as JSON on stdin and
+// FLOX_* variables naming the site in its environment; a non-zero exit code
+// or a timeout fails it. A failed step with on_failure abort (the default)
+// fails the creation, which undoes the steps before it, scripts by running
+// their undo; with continue it is recorded as a provisioning.step_failed
+// event and the next step runs. Unlike hooks (hooks.go), which run in the
+// background after an event, the steps are part of the creation and its
+// provisioning log.
+
+const (
+	provisionScriptsDir = "provision" // in paths.script_dir
+
+	stepBuild = "build"
+	stepDNS   = "dns"
+
+	onFailureAbort    = "abort"
+	onFailureContinue = "continue"
+)
+
+// pipelineStep is an entry of provisioning.steps.
+type pipelineStep struct {
+	Name      string        `mapstructure:"name" json:"name"`             // build, dns or the name of a script step
+	Run       string        `mapstructure:"run" json:"run"`               // executable in <paths.script_dir>/provision, for script steps
+	Undo      string        `mapstructure:"undo" json:"undo"`             // executable run when a later step fails the creation
+	Timeout   time.Duration `mapstructure:"timeout" json:"timeout"`       // of run and undo each, default 30s, at most 10m
+	OnFailure string        `mapstructure:"on_failure" json:"on_failure"` // abort (default) or continue
+}
+
+// defaultPipeline is used when provisioning.steps is empty.
+var defaultPipeline = []pipelineStep{{Name: stepBuild}, {Name: stepDNS}}
+
+func provisioningPipeline() []pipelineStep {
+	if steps := currentConfig().Provisioning.Steps; len(steps) > 0 {
+		return steps
+	}
+	return defaultPipeline
+}
+
+func validatePipeline(c *Config) error {
+	if len(c.Provisioning.Steps) == 0 {
+		return nil
+	}
+	var names []string
+	for i, s := range c.Provisioning.Steps {
+		if slices.Contains(names, s.Name) {
+			return fmt.Errorf("provisioning.steps: step %q is listed twice", s.Name)
+		}
+		names = append(names, s.Name)
+		if s.Name == stepBuild || s.Name == stepDNS {
+			if s.Run != "" || s.Undo != "" || s.Timeout != 0 || s.OnFailure != "" {
+				return fmt.Errorf("provisioning.steps: the built-in step %s takes no run, undo, timeout or on_failure", s.Name)
+			}
+			continue
+		}
+		if !hookNameRegex.MatchString(s.Name) {
+			return fmt.Errorf("provisioning.steps[%d]: invalid name %q, use build, dns or lowercase letters, digits and dashes", i, s.Name)
+		}
+		if c.Paths.ScriptDir == "" {
+			return fmt.Errorf("provisioning.steps: the step %s needs paths.script_dir", s.Name)
+		}
+		if s.Run == "" {
+			return fmt.Errorf("provisioning.steps: the step %s has nothing to run", s.Name)
+		}
+		for _, script := range []string{s.Run, s.Undo} {
+			if script == "" {
+				continue
+			}
+			if err := checkProvisionScript(c, script); err != nil {
+				return fmt.Errorf("provisioning.steps: step %s: %w", s.Name, err)
+			}
+		}
+		if s.Timeout < 0 || s.Timeout > maxHookTimeout {
+			return fmt.Errorf("provisioning.steps: the timeout of step %s must be between 0 and %s", s.Name, maxHookTimeout)
+		}
+		if s.OnFailure != "" && s.OnFailure != onFailureAbort && s.OnFailure != onFailureContinue {
+			return fmt.Errorf("provisioning.steps: on_failure of step %s must be abort or continue, not %q", s.Name, s.OnFailure)
+		}
+	}
+	for _, required := range []string{stepBuild, stepDNS} {
+		if !slices.Contains(names, required) {
+			return fmt.Errorf("provisioning.steps must include the built-in step %s", required)
+		}
+	}
+	return nil
+}
+
+// checkProvisionScript checks that script is an executable file in the
+// provision scripts directory.
+func checkProvisionScript(c *Config, script string) error {
+	if !filepath.IsLocal(script) {
+		return fmt.Errorf("%q must be a file in %s", script, filepath.Join(c.Paths.ScriptDir, provisionScriptsDir))
+	}
+	info, err := os.Stat(filepath.Join(c.Paths.ScriptDir, provisionScriptsDir, script))
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() || info.Mode()&0111 == 0 {
+		return fmt.Errorf("%s is not an executable file", script)
+	}
+	return nil
+}
+
+// provisionSite publishes a site by running the pipeline, with the undo of
+// every step registered in tx. Without a transaction a failed build is only
+// logged and the site is provisioned anyway. When the record was queued the
+// returned error wraps errDNSPending; that is not a failure to roll back,
+// and the steps after dns still run.
+func provisionSite(ctx context.Context, siteName string, tx *provisioningTx) error {
+	var pending error
+	for _, step := range provisioningPipeline() {
+		var err error
+		switch step.Name {
+		case stepBuild:
+			_, err = buildSite(siteName)
+			tx.onRollback("vhost", func() error { return removeVhost(siteName) })
+			if err != nil && tx == nil {
+				slog.Error("error building site", "site", siteName, "error", err)
+				err = nil
+			} else if err != nil {
+				err = fmt.Errorf("failed to build site: %w", err)
+			}
+		case stepDNS:
+			err = publishSiteRecords(ctx, siteName, tx)
+			if errors.Is(err, errDNSPending) {
+				pending, err = err, nil
+			}
+		default:
+			err = runProvisionStep(ctx, siteName, step, tx)
+			if err != nil && step.OnFailure == onFailureContinue {
+				slog.Warn("provisioning step failed, continuing", "step", step.Name, "site", siteName, "error", err)
+				recordSiteEvent(siteName, SiteEvent{Type: "provisioning.step_failed", Message: step.Name + ": " + err.Error()})
+				err = nil
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return pending
+}
+
+// runProvisionStep runs the script of a step and registers its undo.
+func runProvisionStep(ctx context.Context, siteName string, step pipelineStep, tx *provisioningTx) error {
+	start := time.Now()
+	err := step.runScript(ctx, siteName, step.Run)
+	logStep(siteName, "step."+step.Name, step.Run, start, err)
+	if err != nil {
+		return fmt.Errorf("step %s: %w", step.Name, err)
+	}
+	if step.Undo != "" {
+		// The undo runs after the request may have been cancelled.
+		tx.onRollback("step."+step.Name, func() error {
+			return step.runScript(context.WithoutCancel(ctx), siteName, step.Undo)
+		})
+	}
+	return nil
+}
+
+type provisionScriptInput struct {
+	SiteName string     `json:"siteName"`
+	Site     SiteConfig `json:"site"`
+}
+
+// runScript runs one of the step's executables in the provision scripts
+// directory.
+func (s pipelineStep) runScript(ctx context.Context, siteName, script string) error {
+	site, err := readSiteConfig(siteName)
+	if err != nil {
+		return err
+	}
+	input, err := json.Marshal(provisionScriptInput{SiteName: siteName, Site: site.public()})
+	if err != nil {
+		return err
+	}
+	timeout := s.Timeout
+	if timeout == 0 {
+		timeout = defaultHookTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	dir := filepath.Join(config.Paths.ScriptDir, provisionScriptsDir)
+	cmd := exec.CommandContext(ctx, filepath.Join(dir, script))
+	cmd.Dir = dir
+	cmd.Env = []string{
+		"PATH=" + os.Getenv("PATH"),
+		"FLOX_STEP=" + s.Name,
+		"FLOX_SITE_NAME=" + siteName,
+		"FLOX_SITE_DIR=" + filepath.Join(sitesBaseDir, siteName),
+		"FLOX_SITE_URL=" + siteURL(siteName),
+		"FLOX_DOMAIN=" + config.DNS.Domain,
+	}
+	cmd.Stdin = bytes.NewReader(input)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	err = cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("timed out after %s", timeout)
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return fmt.Errorf("exit code %d: %s", exitErr.ExitCode(), truncateHookOutput(stderr.String()))
+	}
+	return err
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Premium names: like registrars with premium domains, short or sought-after
+// names can be put into tiers by the rules of premium.rules, the first rule
+// that matches decides:
+//
+//	premium:
+//	  rules:
+//	    - {tier: platinum, max_length: 2, price: "99 EUR/year"}
+//	    - {tier: gold, max_length: 3, words_file: /etc/flox/words.txt, price: "29 EUR/year"}
+//
+// The name check reports the tier and price hint. A premium name can only be
+// created by admins, on a plan whose premium_tiers include the tier, or with
+// a purchase the billing system confirmed for the name through
+// /api/v1/admin/premium-names; the confirmation is used up by the creation.
+// Existing sites are not affected by the rules.
+
+const premiumNamesFile = ".premium-names.json" // in sitesBaseDir
+
+// standardTier is the tier of names no rule matches.
+const standardTier = "standard"
+
+var premiumTierRegex = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,31}$`)
+
+// premiumRule puts the names matching any of its criteria into a tier.
+type premiumRule struct {
+	Tier      string   `mapstructure:"tier" json:"tier"`
+	MaxLength int      `mapstructure:"max_length" json:"max_length"` // names of at most this many characters
+	Names     []string `mapstructure:"names" json:"names"`
+	Pattern   string   `mapstructure:"pattern" json:"pattern"`       // regular expression matched against the whole name
+	WordsFile string   `mapstructure:"words_file" json:"words_file"` // dictionary, one word per line
+	Price     string   `mapstructure:"price" json:"price"`           // hint shown to users, e.g. "29 EUR/year"
+}
+
+// validatePremiumRules checks the premium rules of a config.
+func validatePremiumRules(c *Config) error {
+	for i, rule := range c.Premium.Rules {
+		if !premiumTierRegex.MatchString(rule.Tier) || rule.Tier == standardTier {
+			return fmt.Errorf("premium.rules[%d]: tier must be 1-32 lowercase letters, digits, hyphens or underscores other than %q", i, standardTier)
+		}
+		if rule.MaxLength == 0 && len(rule.Names) == 0 && rule.Pattern == "" && rule.WordsFile == "" {
+			return fmt.Errorf("premium.rules[%d]: needs max_length, names, pattern or words_file", i)
+		}
+		if rule.MaxLength < 0 {
+			return fmt.Errorf("premium.rules[%d]: max_length must not be negative", i)
+		}
+		if _, err := regexp.Compile("^(?:" + rule.Pattern + ")$"); err != nil {
+			return fmt.Errorf("premium.rules[%d]: invalid pattern: %w", i, err)
+		}
+		if rule.WordsFile != "" {
+			if _, err := premiumWords(rule.WordsFile); err != nil {
+				return fmt.Errorf("premium.rules[%d]: %w", i, err)
+			}
+		}
+	}
+	return nil
+}
+
+// premiumWordLists caches the words files, by path; a file is read again
+// when it changes.
+var premiumWordLists = struct {
+	sync.Mutex
+	m map[string]premiumWordList
+}{m: map[string]premiumWordList{}}
+
+type premiumWordList struct {
+	modTime time.Time
+	words   map[string]bool
+}
+
+func premiumWords(path string) (map[string]bool, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	premiumWordLists.Lock()
+	defer premiumWordLists.Unlock()
+	if l, ok := premiumWordLists.m[path]; ok && l.modTime.Equal(info.ModTime()) {
+		return l.words, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	words := map[string]bool{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if word := strings.ToLower(strings.TrimSpace(scanner.Text())); word != "" && !strings.HasPrefix(word, "#") {
+			words[word] = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	premiumWordLists.m[path] = premiumWordList{modTime: info.ModTime(), words: words}
+	return words, nil
+}
+
+func (rule premiumRule) matches(name string) bool {
+	if rule.MaxLength > 0 && len(name) <= rule.MaxLength {
+		return true
+	}
+	if slices.ContainsFunc(rule.Names, func(n string) bool { return strings.EqualFold(n, name) }) {
+		return true
+	}
+	if rule.Pattern != "" {
+		if re, err := regexp.Compile("^(?:" + rule.Pattern + ")$"); err == nil && re.MatchString(name) {
+			return true
+		}
+	}
+	if rule.WordsFile != "" {
+		words, err := premiumWords(rule.WordsFile)
+		if err != nil {
+			slog.Error("error reading premium words", "file", rule.WordsFile, "error", err)
+			return false
+		}
+		return words[name]
+	}
+	return false
+}
+
+// premiumRuleFor returns the first premium rule matching a site name.
+func premiumRuleFor(siteName string) (premiumRule, bool) {
+	name := strings.ToLower(siteName)
+	for _, rule := range currentConfig().Premium.Rules {
+		if rule.matches(name) {
+			return rule, true
+		}
+	}
+	return premiumRule{}, false
+}
+
+// PremiumPurchase is a premium name the billing system confirmed as bought.
+type PremiumPurchase struct {
+	SiteName string `json:"siteName"`
+	Tier     string `json:"tier"`
+	// Buyer is the user ID or email that may create the site, empty
+	// lets anyone.
+	Buyer       string     `json:"buyer,omitempty"`
+	Reference   string     `json:"reference,omitempty"` // of the billing system, e.g. an invoice number
+	ConfirmedAt time.Time  `json:"confirmedAt"`
+	UsedAt      *time.Time `json:"usedAt,omitempty"` // set when the site was created
+}
+
+func (p *PremiumPurchase) isBuyer(claims sessionClaims) bool {
+	if p.Buyer == "" {
+		return true
+	}
+	return (claims.Subject != "" && strings.EqualFold(p.Buyer, claims.Subject)) || (claims.Email != "" && strings.EqualFold(p.Buyer, claims.Email))
+}
+
+var premiumNamesMu sync.Mutex
+
+func readPremiumPurchases() (map[string]*PremiumPurchase, error) {
+	purchases := map[string]*PremiumPurchase{}
+	data, err := os.ReadFile(filepath.Join(sitesBaseDir, premiumNamesFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return purchases, nil
+		}
+		return nil, err
+	}
+	err = json.Unmarshal(data, &purchases)
+	return purchases, err
+}
+
+func writePremiumPurchases(purchases map[string]*PremiumPurchase) error {
+	data, err := json.MarshalIndent(purchases, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(sitesBaseDir, premiumNamesFile)
+	return writeFileAtomic(path, data, 0644)
+}
+
+// premiumAccess is how the user of r may create a premium name.
+type premiumAccess int
+
+const (
+	premiumDenied premiumAccess = iota
+	premiumByAdmin
+	premiumByPlan
+	premiumByPurchase
+)
+
+// checkPremiumAccess returns how the user of r may create a site with a
+// premium name of tier.
+func checkPremiumAccess(r *http.Request, siteName, tier string) (premiumAccess, error) {
+	if isAdmin(r) {
+		return premiumByAdmin, nil
+	}
+	if entitlementsEnabled() {
+		_, plan := sitePlan(SiteConfig{})
+		if plan.allowsPremiumTier(tier) {
+			return premiumByPlan, nil
+		}
+	}
+	purchases, err := readPremiumPurchases()
+	if err != nil {
+		return premiumDenied, err
+	}
+	if p, ok := purchases[strings.ToLower(siteName)]; ok && p.UsedAt == nil && p.isBuyer(currentSession(r)) {
+		return premiumByPurchase, nil
+	}
+	return premiumDenied, nil
+}
+
+// premiumNameError explains how to get a premium name.
+func premiumNameError(siteName string, rule premiumRule) string {
+	message := fmt.Sprintf("%s is a premium name (%s tier", strings.ToLower(siteName), rule.Tier)
+	if rule.Price != "" {
+		message += ", " + rule.Price
+	}
+	message += "), buy it first"
+	var plans []string
+	if entitlementsEnabled() {
+		for name, p := range currentConfig().Entitlements.Plans {
+			if p.allowsPremiumTier(rule.Tier) {
+				plans = append(plans, name)
+			}
+		}
+	}
+	slices.Sort(plans)
+	switch len(plans) {
+	case 0:
+		return message
+	case 1:
+		return message + " or upgrade to the " + plans[0] + " plan"
+	}
+	return message + " or upgrade to one of the plans " + strings.Join(plans, ", ")
+}
+
+var errPremiumPurchaseUsed = errors.New("the purchase of this name has been used already")
+
+// usePremiumPurchase marks the purchase of a name as used by its creation.
+func usePremiumPurchase(siteName string) error {
+	premiumNamesMu.Lock()
+	defer premiumNamesMu.Unlock()
+	purchases, err := readPremiumPurchases()
+	if err != nil {
+		return err
+	}
+	p, ok := purchases[strings.ToLower(siteName)]
+	if !ok || p.UsedAt != nil {
+		return errPremiumPurchaseUsed
+	}
+	now := time.Now().UTC()
+	p.UsedAt = &now
+	return writePremiumPurchases(purchases)
+}
+
+// unusePremiumPurchase makes a purchase usable again when the site creation
+// failed.
+func unusePremiumPurchase(siteName string) {
+	premiumNamesMu.Lock()
+	defer premiumNamesMu.Unlock()
+	purchases, err := readPremiumPurchases()
+	if err == nil {
+		if p, ok := purchases[strings.ToLower(siteName)]; ok {
+			p.UsedAt = nil
+			err = writePremiumPurchases(purchases)
+		}
+	}
+	if err != nil {
+		slog.Error("error taking back the use of a premium purchase", "site", siteName, "error", err)
+	}
+}
+
+// --- Handlers ---
+
+// listPremiumPurchasesHandler returns the confirmed purchases sorted by name.
+func listPremiumPurchasesHandler(w http.ResponseWriter, r *http.Request) {
+	purchases, err := readPremiumPurchases()
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error reading premium purchases", "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	list := make([]*PremiumPurchase, 0, len(purchases))
+	for _, p := range purchases {
+		list = append(list, p)
+	}
+	slices.SortFunc(list, func(a, b *PremiumPurchase) int { return strings.Compare(a.SiteName, b.SiteName) })
+	respondJSON(w, list)
+}
+
+type premiumPurchaseRequest struct {
+	Buyer     string `json:"buyer"`
+	Reference string `json:"reference"`
+}
+
+// putPremiumPurchaseHandler confirms the purchase of a premium name, for the
+// billing system. A purchase that was used is not replaced.
+func putPremiumPurchaseHandler(w http.ResponseWriter, r *http.Request) {
+	siteName := strings.ToLower(r.PathValue("siteName"))
+	var req premiumPurchaseRequest
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON request", http.StatusBadRequest)
+		return
+	}
+	if !siteNameRegex.MatchString(siteName) {
+		http.Error(w, "Invalid site name", http.StatusBadRequest)
+		return
+	}
+	rule, ok := premiumRuleFor(siteName)
+	if !ok {
+		http.Error(w, siteName+" is not a premium name", http.StatusBadRequest)
+		return
+	}
+
+	premiumNamesMu.Lock()
+	defer premiumNamesMu.Unlock()
+	purchases, err := readPremiumPurchases()
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error reading premium purchases", "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if p, ok := purchases[siteName]; ok && p.UsedAt != nil {
+		http.Error(w, errPremiumPurchaseUsed.Error(), http.StatusConflict)
+		return
+	}
+	p := &PremiumPurchase{
+		SiteName:    siteName,
+		Tier:        rule.Tier,
+		Buyer:       strings.TrimSpace(req.Buyer),
+		Reference:   strings.TrimSpace(req.Reference),
+		ConfirmedAt: time.Now().UTC(),
+	}
+	purchases[siteName] = p
+	if err := writePremiumPurchases(purchases); err != nil {
+		slog.ErrorContext(r.Context(), "error writing premium purchases", "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	recordAudit(r.Context(), "premium.confirm", siteName, p)
+	respondJSON(w, p)
+}
+
+// deletePremiumPurchaseHandler withdraws the confirmation of a purchase,
+// e.g. after a refund. The site of a used one is kept.
+func deletePremiumPurchaseHandler(w http.ResponseWriter, r *http.Request) {
+	siteName := strings.ToLower(r.PathValue("siteName"))
+	premiumNamesMu.Lock()
+	defer premiumNamesMu.Unlock()
+	purchases, err := readPremiumPurchases()
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error reading premium purchases", "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if _, ok := purchases[siteName]; !ok {
+		http.Error(w, "Purchase not found", http.StatusNotFound)
+		return
+	}
+	delete(purchases, siteName)
+	if err := writePremiumPurchases(purchases); err != nil {
+		slog.ErrorContext(r.Context(), "error writing premium purchases", "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	recordAudit(r.Context(), "premium.withdraw", siteName, nil)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+
+	"github.com/spf13/viper"
+)
+
+const (
+	profileProduction = "production"
+	profileStaging    = "staging"
+	profileDev        = "dev"
+)
+
+var profiles = []string{profileProduction, profileStaging, profileDev}
+
+// profile is the active environment profile, selected with FLOX_ENV.
+var profile = profileDev
+
+// profileConfigFile is the merged profile config file, "" without one.
+var profileConfigFile string
+
+// profileDefaults are the defaults that differ between environments. They are
+// overridden by the config files and the environment like any other default.
+var profileDefaults = map[string]map[string]any{
+	profileProduction: {
+		"server.cors_debug":                     false,
+		"server.rate_limit.requests_per_minute": 30,
+		"server.rate_limit.burst":               10,
+		"migrations.auto_apply":                 false,
+	},
+	profileStaging: {
+		"server.cors_debug":                     false,
+		"server.rate_limit.requests_per_minute": 60,
+		"server.rate_limit.burst":               20,
+		"migrations.auto_apply":                 true,
+	},
+	profileDev: {
+		"server.cors_debug":                     true,
+		"server.rate_limit.requests_per_minute": 600, // test scripts and hot reloads
+		"server.rate_limit.burst":               100,
+		"migrations.auto_apply":                 true,
+	},
+}
+
+// selectProfile reads FLOX_ENV and applies the profile's defaults.
+func selectProfile() {
+	if env := os.Getenv("FLOX_ENV"); env != "" {
+		if !slices.Contains(profiles, env) {
+			fatal("invalid FLOX_ENV", "env", env, "profiles", profiles)
+		}
+		profile = env
+	}
+	if devMode && profile != profileDev {
+		slog.Warn("--dev overrides FLOX_ENV", "profile", profile)
+		profile = profileDev
+	}
+	for key, value := range profileDefaults[profile] {
+		viper.SetDefault(key, value)
+	}
+	slog.Info("Using config profile", "profile", profile)
+}
+
+// mergeProfileConfig overlays backend.<profile>.yaml, if present, on the base
+// config file.
+func mergeProfileConfig() {
+	viper.SetConfigName("backend." + profile)
+	err := viper.MergeInConfig()
+	var configFileNotFoundError viper.ConfigFileNotFoundError
+	switch {
+	case errors.As(err, &configFileNotFoundError):
+		return
+	case err != nil:
+		fatal("error reading profile config", "profile", profile, "error", err)
+	}
+	profileConfigFile = viper.ConfigFileUsed()
+	slog.Info("Merged profile config file", "file", profileConfigFile)
+}
+
+func versionHandler(w http.ResponseWriter, r *http.Request) {
+	respondJSON(w, map[string]string{
+		"version": Version,
+		"profile": profile,
+	})
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Provisioning log: every creation, verification, build and queued DNS run
+// of a site is recorded step by step, with durations, the commands run and a
+// summary of every call to an external service, for support escalations.
+// Steps are collected for the run active for the site name, so code deep in
+// a build can add to it without passing the run around; a build started by
+// a creation becomes part of the creation's run.
+
+const (
+	provisioningLogFile    = "provisioning.jsonl" // in the site dir, one run per line
+	provisioningLogMaxSize = 1 << 20              // rotated to provisioning.jsonl.1 beyond this
+)
+
+type provisioningStep struct {
+	Time       time.Time `json:"time"`
+	Step       string    `json:"step"` // e.g. "dns.create", "command", "build"
+	DurationMs int64     `json:"durationMs"`
+	OK         bool      `json:"ok"`
+	Detail     string    `json:"detail,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+type provisioningRun struct {
+	ID         string             `json:"id"`
+	SiteName   string             `json:"siteName"`
+	Kind       string             `json:"kind"` // create, verify, build or dns
+	StartedAt  time.Time          `json:"startedAt"`
+	FinishedAt time.Time          `json:"finishedAt"`
+	DurationMs int64              `json:"durationMs"`
+	OK         bool               `json:"ok"`
+	Steps      []provisioningStep `json:"steps"`
+	Error      string             `json:"error,omitempty"`
+	RequestID  string             `json:"requestId,omitempty"` // of the API request that started the run
+
+	ctx    context.Context // of the run's span, parent of the steps' spans
+	faults []faultRule     // of the X-Flox-Fault header of the request, see faults.go
+}
+
+var activeRuns = struct {
+	sync.Mutex
+	bySite map[string]*provisioningRun
+}{bySite: map[string]*provisioningRun{}}
+
+// beginRun starts a provisioning run of a site, traced below ctx. If one is
+// already running for the site, the steps are added to it and end does
+// nothing. end records the outcome and appends the run to the site's log.
+func beginRun(ctx context.Context, siteName, kind string) (end func(err error)) {
+	activeRuns.Lock()
+	defer activeRuns.Unlock()
+	if _, ok := activeRuns.bySite[siteName]; ok {
+		return func(error) {}
+	}
+	now := time.Now().UTC()
+	ctx, span := startRunSpan(ctx, siteName, kind)
+	run := &provisioningRun{ID: now.Format("20060102T150405.000000000Z"), SiteName: siteName, Kind: kind, StartedAt: now, Steps: []provisioningStep{}, RequestID: requestIDFrom(ctx), ctx: ctx, faults: faultsFrom(ctx)}
+	activeRuns.bySite[siteName] = run
+	return func(err error) {
+		endSpan(span, err)
+		activeRuns.Lock()
+		delete(activeRuns.bySite, siteName)
+		activeRuns.Unlock()
+		run.FinishedAt = time.Now().UTC()
+		run.DurationMs = run.FinishedAt.Sub(run.StartedAt).Milliseconds()
+		run.OK = err == nil
+		if err != nil {
+			run.Error = redactSecrets(err.Error())
+		}
+		writeProvisioningRun(run)
+	}
+}
+
+// logStep adds a step that started at start to the site's active run, if
+// there is one. Details and errors are redacted.
+func logStep(siteName, step, detail string, start time.Time, err error) {
+	s := provisioningStep{
+		Time:       start.UTC(),
+		Step:       step,
+		DurationMs: time.Since(start).Milliseconds(),
+		OK:         err == nil,
+		Detail:     redactSecrets(detail),
+	}
+	if err != nil {
+		s.Error = redactSecrets(err.Error())
+	}
+	recordJobStep(siteName, s)
+	activeRuns.Lock()
+	defer activeRuns.Unlock()
+	if run, ok := activeRuns.bySite[siteName]; ok {
+		run.Steps = append(run.Steps, s)
+		traceStep(run.ctx, siteName, s, time.Now())
+	}
+}
+
+// secretPatterns catch credentials in provider messages and URLs that are
+// not in the config, e.g. per-site tokens.
+var secretPatterns = regexp.MustCompile(`(?i)((?:token|bearer|key|secret|password|signature)[=: ]+)[^\s&",]+`)
+
+// redactSecrets removes the configured secrets and anything looking like a
+// credential from a log text.
+func redactSecrets(s string) string {
+	for _, secret := range []string{
+		strings.Trim(os.Getenv("DNS_API_AUTH"), `"`), config.DNS.Cloudflare.APIToken,
+		config.DNS.Route53.SecretAccessKey, config.DNS.Route53.AccessKeyID,
+		config.Email.Password, config.Payments.StripeSecretKey, config.Registry.Token,
+		config.Comments.SpamCheckKey, config.Secrets.EncryptionKey,
+		config.Social.FacebookAppSecret, config.Geocoding.GoogleAPIKey,
+	} {
+		if len(secret) >= 4 {
+			s = strings.ReplaceAll(s, secret, "[redacted]")
+		}
+	}
+	return secretPatterns.ReplaceAllString(s, "${1}[redacted]")
+}
+
+var provisioningLogMu sync.Mutex
+
+// writeProvisioningRun appends a run to the site's log. Runs of sites whose
+// directory does not exist (failed creations) are only logged.
+func writeProvisioningRun(run *provisioningRun) {
+	data, err := json.Marshal(run)
+	if err != nil {
+		slog.Error("error encoding provisioning run", "site", run.SiteName, "error", err)
+		return
+	}
+	dir := filepath.Join(sitesBaseDir, run.SiteName)
+	if _, err := os.Stat(dir); err != nil {
+		slog.Warn("provisioning run not stored", "site", run.SiteName, "run", data)
+		return
+	}
+
+	provisioningLogMu.Lock()
+	defer provisioningLogMu.Unlock()
+	path := filepath.Join(dir, provisioningLogFile)
+	if info, err := os.Stat(path); err == nil && info.Size() > provisioningLogMaxSize {
+		if err := os.Rename(path, path+".1"); err != nil {
+			slog.Error("error rotating provisioning log", "site", run.SiteName, "error", err)
+		}
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		slog.Error("error opening provisioning log", "site", run.SiteName, "error", err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		slog.Error("error writing provisioning log", "site", run.SiteName, "error", err)
+	}
+}
+
+// getProvisioningLogHandler downloads the site's provisioning log as JSON
+// lines, oldest run first, including the rotated part.
+func getProvisioningLogHandler(w http.ResponseWriter, r *http.Request) {
+	siteName, ok := siteNameFromPath(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s-provisioning-log.jsonl"`, siteName))
+
+	provisioningLogMu.Lock()
+	defer provisioningLogMu.Unlock()
+	path := filepath.Join(sitesBaseDir, siteName, provisioningLogFile)
+	for _, p := range []string{path + ".1", path} {
+		f, err := os.Open(p)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			slog.ErrorContext(r.Context(), "error reading provisioning log", "site", siteName, "error", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		_, err = io.Copy(w, f)
+		f.Close()
+		if err != nil {
+			slog.ErrorContext(r.Context(), "error sending provisioning log", "site", siteName, "error", err)
+			return
+		}
+	}
+}
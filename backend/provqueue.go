@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Provisioning queue: site creations and verifications, rebuilds requested
+// with POST /api/v1/sites/{siteName}/build and the scheduler's rebuilds run in
+// at most provisioning.concurrency slots, so a burst of background work
+// cannot delay a launch. Waiting jobs get a free slot by class: priority
+// (admins, sites on a plan other than the default plan), then standard,
+// then bulk (the scheduler), first come first served within a class. A class
+// can be limited to fewer slots with provisioning.class_limits, and a job
+// waiting longer than provisioning.max_wait goes ahead of the classes above
+// it, so bulk work is slowed down but never starved. Rebuilds after an edit
+// of a section are not queued.
+
+type jobClass string
+
+const (
+	jobPriority jobClass = "priority"
+	jobStandard jobClass = "standard"
+	jobBulk     jobClass = "bulk"
+)
+
+// jobClasses in the order they get free slots.
+var jobClasses = []jobClass{jobPriority, jobStandard, jobBulk}
+
+type queuedJob struct {
+	class jobClass
+	since time.Time
+	ready chan struct{}
+}
+
+var jobQueue = struct {
+	sync.Mutex
+	running map[jobClass]int
+	total   int
+	waiting []*queuedJob // in arrival order
+}{running: map[jobClass]int{}}
+
+func validateProvisioning(c *Config) error {
+	if c.Provisioning.Concurrency < 0 {
+		return fmt.Errorf("provisioning.concurrency must not be negative")
+	}
+	for class, limit := range c.Provisioning.ClassLimits {
+		if !slices.Contains(jobClasses, jobClass(class)) {
+			return fmt.Errorf("provisioning.class_limits: unknown class %q, use priority, standard or bulk", class)
+		}
+		if limit < 0 {
+			return fmt.Errorf("provisioning.class_limits.%s must not be negative", class)
+		}
+	}
+	return nil
+}
+
+// jobClassFor returns the class of provisioning work on a site requested
+// with r, nil for background work.
+func jobClassFor(r *http.Request, sc SiteConfig) jobClass {
+	if r == nil {
+		return jobBulk
+	}
+	if isAdmin(r) || r.Context().Value(adminTokenKey{}) != nil {
+		return jobPriority
+	}
+	if plan, _ := sitePlan(sc); entitlementsEnabled() && plan != currentConfig().Entitlements.DefaultPlan {
+		return jobPriority
+	}
+	return jobStandard
+}
+
+// acquireJobSlot waits for a slot for work on a site and returns the
+// function that gives it back. The wait is logged as a step of the site's
+// provisioning run, if one is active.
+func acquireJobSlot(siteName string, class jobClass) (release func()) {
+	if config.Provisioning.Concurrency == 0 {
+		return func() {}
+	}
+	job := &queuedJob{class: class, since: time.Now(), ready: make(chan struct{})}
+	jobQueue.Lock()
+	jobQueue.waiting = append(jobQueue.waiting, job)
+	startQueuedJobs()
+	jobQueue.Unlock()
+	<-job.ready
+	logStep(siteName, "queue", string(class), job.since, nil)
+	jobQueueWait.observe(time.Since(job.since), string(class))
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			jobQueue.Lock()
+			defer jobQueue.Unlock()
+			jobQueue.total--
+			jobQueue.running[class]--
+			startQueuedJobs()
+		})
+	}
+}
+
+// startQueuedJobs hands free slots to waiting jobs. The caller holds the
+// lock.
+func startQueuedJobs() {
+	for jobQueue.total < config.Provisioning.Concurrency {
+		i := nextQueuedJob(time.Now())
+		if i < 0 {
+			return
+		}
+		job := jobQueue.waiting[i]
+		jobQueue.waiting = slices.Delete(jobQueue.waiting, i, i+1)
+		jobQueue.total++
+		jobQueue.running[job.class]++
+		close(job.ready)
+	}
+}
+
+// nextQueuedJob returns the index of the job to start, -1 if none may: the
+// oldest job waiting longer than provisioning.max_wait, otherwise the oldest
+// of the first class, skipping classes at their limit.
+func nextQueuedJob(now time.Time) int {
+	next := -1
+	nextStarved := false
+	for i, job := range jobQueue.waiting {
+		if limit := config.Provisioning.ClassLimits[string(job.class)]; limit > 0 && jobQueue.running[job.class] >= limit {
+			continue
+		}
+		starved := config.Provisioning.MaxWait > 0 && now.Sub(job.since) >= config.Provisioning.MaxWait
+		switch {
+		case next < 0,
+			starved && !nextStarved,
+			!starved && !nextStarved && slices.Index(jobClasses, job.class) < slices.Index(jobClasses, jobQueue.waiting[next].class):
+			next, nextStarved = i, starved
+		}
+	}
+	return next
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+)
+
+// With quotas.sites_per_user set, a user may own at most that many sites;
+// creating another is answered with 403. Admins and anonymous creations
+// (without auth.required) are not limited. Sites being created count too,
+// so parallel requests cannot pass the quota together.
+
+var siteQuota = struct {
+	sync.Mutex
+	pending map[string]int // creations in progress by user ID
+}{pending: map[string]int{}}
+
+type quotaUsage struct {
+	Used      int  `json:"used"`
+	Limit     *int `json:"limit"`     // null: unlimited
+	Remaining *int `json:"remaining"` // null: unlimited
+}
+
+type quotaResponse struct {
+	Sites quotaUsage `json:"sites"`
+}
+
+// userSiteCount is the number of sites owned by a user.
+func userSiteCount(userID string) (int, error) {
+	siteNames, err := listSiteNames()
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, siteName := range siteNames {
+		sc, err := readSiteConfig(siteName)
+		if err != nil {
+			continue // being created or deleted, counted as pending
+		}
+		if sc.UserID == userID {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// siteLimit is the number of sites the user of the request may own, or -1
+// if there is no limit.
+func siteLimit(r *http.Request) int {
+	limit := currentConfig().Quotas.SitesPerUser
+	if limit <= 0 || currentUserID(r) == "" || isAdmin(r) {
+		return -1
+	}
+	return limit
+}
+
+// reserveSiteQuota counts a site creation against the quota of the request's
+// user. It returns the reason if the quota is used up, otherwise a function
+// to call once the creation finished or failed.
+func reserveSiteQuota(r *http.Request) (release func(), reason string, err error) {
+	limit := siteLimit(r)
+	if limit < 0 {
+		return func() {}, "", nil
+	}
+	userID := currentUserID(r)
+	siteQuota.Lock()
+	defer siteQuota.Unlock()
+	count, err := userSiteCount(userID)
+	if err != nil {
+		return nil, "", err
+	}
+	if count+siteQuota.pending[userID] >= limit {
+		return nil, fmt.Sprintf("Site quota exceeded: your account may have at most %d sites, delete one to create another", limit), nil
+	}
+	siteQuota.pending[userID]++
+	return func() {
+		siteQuota.Lock()
+		defer siteQuota.Unlock()
+		if siteQuota.pending[userID]--; siteQuota.pending[userID] <= 0 {
+			delete(siteQuota.pending, userID)
+		}
+	}, "", nil
+}
+
+// getQuotaHandler returns the quota of the logged-in user and its usage.
+func getQuotaHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireLogin(w, r) {
+		return
+	}
+	used, err := userSiteCount(currentUserID(r))
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error counting sites", "user", currentUserID(r), "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	usage := quotaUsage{Used: used}
+	if limit := siteLimit(r); limit >= 0 {
+		remaining := max(limit-used, 0)
+		usage.Limit, usage.Remaining = &limit, &remaining
+	}
+	respondJSON(w, quotaResponse{Sites: usage})
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// The endpoints bots like to hammer (name checks, site creation, signup,
+// login) are rate limited with a token bucket per client and endpoint: per
+// user for requests with a session or provider token, per IP address
+// otherwise, so checking names does not use up the client's signups.
+// A bucket holds server.rate_limit.burst requests and refills with
+// requests_per_minute; an empty bucket is answered with 429 and the
+// seconds until the next request is allowed in Retry-After.
+
+// rateLimitIdle is how long an unused bucket is kept; a full one is the
+// same as none.
+const rateLimitIdle = 10 * time.Minute
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+var rateLimiter = struct {
+	sync.Mutex
+	buckets map[string]*tokenBucket
+	swept   time.Time
+}{buckets: map[string]*tokenBucket{}}
+
+// rateLimitKey identifies the client and the endpoint of a request.
+func rateLimitKey(r *http.Request) string {
+	if userID := currentUserID(r); userID != "" {
+		return r.Pattern + " user:" + userID
+	}
+	return r.Pattern + " ip:" + clientIP(r)
+}
+
+// takeRateToken takes a request from the client's bucket. If it is empty,
+// it returns false and how long until the next request is allowed.
+func takeRateToken(key string, now time.Time) (bool, time.Duration) {
+	rateLimit := currentConfig().Server.RateLimit
+	perSecond := float64(rateLimit.RequestsPerMinute) / 60
+	burst := float64(max(rateLimit.Burst, 1))
+
+	rateLimiter.Lock()
+	defer rateLimiter.Unlock()
+	if now.Sub(rateLimiter.swept) > rateLimitIdle {
+		for k, b := range rateLimiter.buckets {
+			if now.Sub(b.last) > rateLimitIdle {
+				delete(rateLimiter.buckets, k)
+			}
+		}
+		rateLimiter.swept = now
+	}
+	b, ok := rateLimiter.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: burst, last: now}
+		rateLimiter.buckets[key] = b
+	}
+	b.tokens = min(burst, b.tokens+now.Sub(b.last).Seconds()*perSecond)
+	b.last = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / perSecond * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// rateLimited limits the requests of each client to the handler; with
+// server.rate_limit.requests_per_minute 0 it is not limited.
+func rateLimited(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if currentConfig().Server.RateLimit.RequestsPerMinute <= 0 {
+			next(w, r)
+			return
+		}
+		if ok, wait := takeRateToken(rateLimitKey(r), time.Now()); !ok {
+			w.Header().Set("Retry-After", fmt.Sprint(int(math.Ceil(wait.Seconds()))))
+			apiError(w, r, http.StatusTooManyRequests, codeRateLimited, "Too many requests, please try again later")
+			return
+		}
+		next(w, r)
+	}
+}
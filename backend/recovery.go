@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// State files are written to a temporary file in the same directory, synced
+// to disk and renamed over the old file, so a crash or a full disk leaves
+// either the old or the new version, never a torn one. writeSiteConfig also
+// keeps the previous config.json as config.json.bak. At startup every
+// site's config is read; a corrupt one (from before these writes or a
+// failing disk) is replaced by the backup if that is intact and kept as
+// config.json.corrupt, otherwise it is reported in the log and by
+// /api/v1/health until it is fixed by hand. Leftover temporary files of
+// interrupted writes are removed.
+
+const (
+	siteConfigFile        = "config.json"
+	siteConfigBackupFile  = "config.json.bak"
+	siteConfigCorruptFile = "config.json.corrupt"
+)
+
+// writeFileAtomic replaces a file with data.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+	f, err := os.CreateTemp(dir, "."+filepath.Base(path)+"-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name()) // fails harmlessly after the rename
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(perm); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// writeJSONAtomic replaces a file with v as indented JSON.
+func writeJSONAtomic(path string, v any, perm os.FileMode) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, append(data, '\n'), perm)
+}
+
+// syncDir makes a rename in dir durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// isTempStateFile reports whether a file name is one of a write that did
+// not finish: of writeFileAtomic or of the earlier ".config-*.json".
+func isTempStateFile(name string) bool {
+	return strings.HasPrefix(name, ".") &&
+		(strings.HasSuffix(name, ".tmp") || strings.HasPrefix(name, ".config-") && strings.HasSuffix(name, ".json"))
+}
+
+var corruptConfigs = struct {
+	sync.Mutex
+	sites map[string]string // error by site name
+}{sites: map[string]string{}}
+
+// checkSiteConfig reads the config of a site, restoring the backup if it
+// is corrupt. restored reports whether the backup was restored.
+func checkSiteConfig(siteName string) (restored bool, err error) {
+	dir := filepath.Join(sitesBaseDir, siteName)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return false, err
+	}
+	for _, e := range entries {
+		if !e.IsDir() && isTempStateFile(e.Name()) {
+			os.Remove(filepath.Join(dir, e.Name()))
+		}
+	}
+
+	_, err = readSiteConfig(siteName)
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	if err == nil || !(errors.As(err, &syntaxErr) || errors.As(err, &typeErr)) {
+		return false, err
+	}
+	if err := restoreSiteRecord(siteName, err.Error()); err != nil {
+		return false, fmt.Errorf("corrupt %s and not restored: %v", siteConfigFile, err)
+	}
+	return true, nil
+}
+
+// checkSiteConfigs checks the configs of all sites at startup.
+func checkSiteConfigs() {
+	siteNames, err := listSiteNames()
+	if err != nil {
+		slog.Error("error listing sites for the config check", "error", err)
+		return
+	}
+	corrupt := map[string]string{}
+	for _, siteName := range siteNames {
+		restored, err := checkSiteConfig(siteName)
+		switch {
+		case restored:
+			slog.Error("error: site config was corrupt and is restored from the backup", "site", siteName,
+				"backup", siteConfigBackupFile, "kept_as", siteConfigCorruptFile)
+		case os.IsNotExist(err):
+			// A creation that did not finish; rollback or purge clean it up.
+		case err != nil:
+			slog.Error("error: the site config cannot be read, fix or restore it", "site", siteName,
+				"file", filepath.Join(sitesBaseDir, siteName, siteConfigFile), "error", err)
+			corrupt[siteName] = err.Error()
+		}
+	}
+	corruptConfigs.Lock()
+	corruptConfigs.sites = corrupt
+	corruptConfigs.Unlock()
+}
+
+// configsHealth is the site config status of the health endpoint. Configs
+// fixed since the startup check are healthy again.
+func configsHealth() (status string, healthy bool) {
+	corruptConfigs.Lock()
+	defer corruptConfigs.Unlock()
+	for siteName := range corruptConfigs.sites {
+		if _, err := readSiteConfig(siteName); err == nil || os.IsNotExist(err) {
+			delete(corruptConfigs.sites, siteName)
+		}
+	}
+	if len(corruptConfigs.sites) == 0 {
+		return "OK", true
+	}
+	names := slices.Sorted(maps.Keys(corruptConfigs.sites))
+	return fmt.Sprintf("%d corrupt: %s", len(names), strings.Join(names, ", ")), false
+}
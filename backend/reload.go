@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/spf13/viper"
+)
+
+// Config reload: the config file and the profile's config file are watched.
+// When one changes, the config is read again like at startup (files,
+// environment, defaults) and validated; a config that does not decode or
+// validate is logged and the running one kept. Changed settings listed in
+// reloadableConfigKeys take effect at once: their readers use
+// currentConfig(), a snapshot swapped atomically, so a request sees either
+// the old or the new values. Changes of other settings are logged as
+// needing a restart.
+
+// reloadableConfigKeys are the settings read per request or per call; an
+// entry ending in "." covers a section.
+var reloadableConfigKeys = []string{
+	"sites.reserved_names", "server.cors.", "frontend.",
+	"dns.bulk", "dns.batch_size", "dns.min_interval", "dns.max_retries", "dns.max_retry_wait", "dns.preflight_ttl", "dns.collision_check", "dns.zone_cache_ttl",
+	"server.rate_limit.", "server.trusted_proxies", "limits.", "entitlements.", "premium.", "quotas.", "maintenance.", "warmup.", "faults.", "idempotency.", "webhooks.", "moderation.",
+	"geoip.blocked_countries", "logging.level", "provisioning.steps",
+}
+
+// configReloadDelay lets an editor finish writing the file.
+const configReloadDelay = 200 * time.Millisecond
+
+var configSnapshot atomic.Pointer[Config]
+
+// currentConfig returns the config with the latest reloadable settings.
+func currentConfig() *Config {
+	if c := configSnapshot.Load(); c != nil {
+		return c
+	}
+	return &config
+}
+
+func isReloadableConfigKey(key string) bool {
+	return slices.ContainsFunc(reloadableConfigKeys, func(k string) bool {
+		return key == k || (strings.HasSuffix(k, ".") && strings.HasPrefix(key, k))
+	})
+}
+
+// copyConfigValue sets the setting key of dst to its value in src.
+func copyConfigValue(dst, src *Config, key string) {
+	d, s := reflect.ValueOf(dst).Elem(), reflect.ValueOf(src).Elem()
+	for _, name := range strings.Split(key, ".") {
+		for i := range d.NumField() {
+			if d.Type().Field(i).Tag.Get("mapstructure") == name {
+				d, s = d.Field(i), s.Field(i)
+				break
+			}
+		}
+	}
+	d.Set(s)
+}
+
+var configReload struct {
+	sync.Mutex
+	timer *time.Timer
+}
+
+// watchConfig reloads the config when its files change.
+func watchConfig() {
+	var files []string
+	for _, file := range []string{baseConfigFile, profileConfigFile} {
+		if file != "" {
+			files = append(files, file)
+		}
+	}
+	if len(files) == 0 {
+		slog.Info("No config file to watch, changes need a restart")
+		return
+	}
+	for _, file := range files {
+		v := viper.New()
+		v.SetConfigFile(file)
+		v.OnConfigChange(func(fsnotify.Event) {
+			configReload.Lock()
+			defer configReload.Unlock()
+			if configReload.timer != nil {
+				configReload.timer.Stop()
+			}
+			configReload.timer = time.AfterFunc(configReloadDelay, reloadConfig)
+		})
+		v.WatchConfig()
+	}
+	slog.Info("Watching config files for changes", "files", files)
+}
+
+// readConfigFiles reads the config files again into viper, which keeps the
+// defaults and environment bindings of startup, and decodes the result.
+func readConfigFiles() (*Config, error) {
+	viper.SetConfigFile(baseConfigFile)
+	if err := viper.ReadInConfig(); err != nil {
+		return nil, err
+	}
+	if profileConfigFile != "" {
+		viper.SetConfigFile(profileConfigFile)
+		if err := viper.MergeInConfig(); err != nil {
+			return nil, err
+		}
+	}
+	var c Config
+	if err := viper.Unmarshal(&c); err != nil {
+		return nil, err
+	}
+	if ipv6 := os.Getenv("SITE_IPV6"); ipv6 != "" {
+		c.DNS.IPv6 = ipv6
+	}
+	if err := validateConfig(&c); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// reloadConfig applies the reloadable settings of the config files.
+func reloadConfig() {
+	configReload.Lock()
+	defer configReload.Unlock()
+	candidate, err := readConfigFiles()
+	if err != nil {
+		slog.Error("error reloading config, keeping the running config", "error", err)
+		return
+	}
+	current := currentConfig()
+	next := *current
+	from, to := configValues(current), configValues(candidate)
+	var applied, restart []string
+	for _, key := range slices.Sorted(maps.Keys(to)) {
+		if reflect.DeepEqual(from[key], to[key]) {
+			continue
+		}
+		if !isReloadableConfigKey(key) {
+			restart = append(restart, key)
+			continue
+		}
+		copyConfigValue(&next, candidate, key)
+		applied = append(applied, key)
+		slog.Info("config setting reloaded", "key", key, "from", redactConfigValue(key, from[key]), "to", redactConfigValue(key, to[key]))
+	}
+	if len(restart) > 0 {
+		slog.Warn("changed config settings take effect after a restart", "keys", restart)
+	}
+	if len(applied) == 0 {
+		return
+	}
+	if err := validateConfig(&next); err != nil {
+		slog.Error("error reloading config, keeping the running config", "error", fmt.Errorf("with the running settings: %w", err))
+		return
+	}
+	configSnapshot.Store(&next)
+	logLevel.Set(logLevels[next.Logging.Level])
+}
@@ -0,0 +1,468 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+// REST hooks (the subscription pattern of resthooks.org, used by Zapier and
+// Make): instead of polling, an integration subscribes a target URL to a
+// trigger of a site, e.g. new form submissions, and gets each new item
+// POSTed there as JSON. GET /api/v1/rest-hooks/triggers lists the triggers
+// with a sample payload; a site's subscriptions are created, listed and
+// deleted under /api/v1/sites/{siteName}/rest-hooks by its owner, and
+// .../rest-hooks/samples/{trigger} returns the latest real items for
+// setting up a zap. A target answering 410 Gone is unsubscribed, as the
+// pattern asks. Each delivery is signed with the subscription's secret in
+// X-Flox-Signature (hex HMAC-SHA256 of the body) so the receiver can check
+// it came from us.
+
+const (
+	siteRESTHooksFile     = "rest-hooks.json"
+	maxRESTHooksPerSite   = 20
+	restHookSignature     = "X-Flox-Signature"
+	restHookSampleResults = 3
+)
+
+// RESTHook is a subscription of a target URL to a trigger of a site.
+type RESTHook struct {
+	ID        string    `json:"id"`
+	Trigger   string    `json:"trigger"`
+	TargetURL string    `json:"targetUrl"`
+	FormID    string    `json:"formId,omitempty"` // form.submitted only: just this form
+	Secret    string    `json:"secret,omitempty"` // shown once, on creation
+	CreatedAt time.Time `json:"createdAt"`
+	// Filled by the deliveries.
+	LastDeliveryAt *time.Time `json:"lastDeliveryAt,omitempty"`
+	LastStatus     int        `json:"lastStatus,omitempty"` // HTTP status, 0 if the request failed
+	LastError      string     `json:"lastError,omitempty"`
+}
+
+// restHookPayload is the body of a delivery; id identifies the item, so
+// integrations can drop duplicates.
+type restHookPayload struct {
+	ID       string    `json:"id"`
+	Trigger  string    `json:"trigger"`
+	SiteName string    `json:"siteName"`
+	Time     time.Time `json:"time"`
+	Data     any       `json:"data"`
+}
+
+type restHookTrigger struct {
+	Key         string `json:"key"`
+	Label       string `json:"label"`
+	Description string `json:"description"`
+	Sample      any    `json:"sample"` // data of a payload
+	// recent returns the latest items of a site, newest first; nil if they
+	// are not stored.
+	recent func(siteName, formID string) ([]restHookPayload, error)
+}
+
+var restHookSampleTime = time.Date(2025, 1, 6, 10, 30, 0, 0, time.UTC)
+
+var restHookTriggers = []restHookTrigger{
+	{
+		Key:         "form.submitted",
+		Label:       "New Form Submission",
+		Description: "A visitor submitted a form of the site.",
+		Sample: formSubmissionData{FormID: "contact", FormSubmission: FormSubmission{
+			ID: "9f86d081884c7d65", SubmittedAt: restHookSampleTime,
+			Values: map[string]string{"name": "Jane Doe", "email": "jane@example.com", "message": "Hello!"},
+		}},
+		recent: recentFormSubmissions,
+	},
+	{
+		Key:         "booking.created",
+		Label:       "New Booking",
+		Description: "A visitor booked an appointment.",
+		Sample: Booking{
+			ID: "2c26b46b68ffc68f", Start: restHookSampleTime.AddDate(0, 0, 2), End: restHookSampleTime.AddDate(0, 0, 2).Add(30 * time.Minute),
+			Name: "Jane Doe", Email: "jane@example.com", Note: "First visit", CreatedAt: restHookSampleTime,
+		},
+		recent: recentBookings,
+	},
+	{
+		Key:         "comment.created",
+		Label:       "New Comment",
+		Description: "A visitor commented on a blog post; spam is left out.",
+		Sample: Comment{
+			ID: "fcde2b2edba56bf4", PostSlug: "hello-world", AuthorName: "Jane Doe", AuthorEmail: "jane@example.com",
+			Content: "Great post!", Status: commentPending, CreatedAt: restHookSampleTime,
+		},
+		recent: recentComments,
+	},
+	{
+		Key:         "newsletter.subscribed",
+		Label:       "New Newsletter Subscriber",
+		Description: "A visitor signed up for the newsletter.",
+		Sample:      newsletterSubscriberData{Email: "jane@example.com", Name: "Jane Doe"},
+	},
+}
+
+type formSubmissionData struct {
+	FormID string `json:"formId"`
+	FormSubmission
+}
+
+type newsletterSubscriberData struct {
+	Email string `json:"email"`
+	Name  string `json:"name,omitempty"`
+}
+
+func findRESTHookTrigger(key string) (restHookTrigger, bool) {
+	i := slices.IndexFunc(restHookTriggers, func(t restHookTrigger) bool { return t.Key == key })
+	if i < 0 {
+		return restHookTrigger{}, false
+	}
+	return restHookTriggers[i], true
+}
+
+// Serializes read-modify-write of the subscription files.
+var restHooksMu sync.Mutex
+
+func readRESTHooks(siteName string) ([]RESTHook, error) {
+	hooks := []RESTHook{}
+	data, err := os.ReadFile(filepath.Join(sitesBaseDir, siteName, siteRESTHooksFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return hooks, nil
+		}
+		return nil, err
+	}
+	err = json.Unmarshal(data, &hooks)
+	return hooks, err
+}
+
+// writeRESTHooks stores the subscriptions, which hold their secrets, readable
+// for the backend only.
+func writeRESTHooks(siteName string, hooks []RESTHook) error {
+	data, err := json.MarshalIndent(hooks, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(sitesBaseDir, siteName, siteRESTHooksFile), data, 0600)
+}
+
+func (h RESTHook) public() RESTHook {
+	h.Secret = ""
+	return h
+}
+
+type restHookRequest struct {
+	Trigger   string `json:"trigger"`
+	TargetURL string `json:"targetUrl"`
+	FormID    string `json:"formId"`
+}
+
+func (req restHookRequest) validate() error {
+	if _, ok := findRESTHookTrigger(req.Trigger); !ok {
+		return fmt.Errorf("unknown trigger %q", req.Trigger)
+	}
+	if err := validateOwnerURL(req.TargetURL, "targetUrl"); err != nil {
+		return err
+	}
+	if req.FormID != "" && req.Trigger != "form.submitted" {
+		return errors.New("formId is only allowed for form.submitted")
+	}
+	if req.FormID != "" && !formIDRegex.MatchString(req.FormID) {
+		return errors.New("invalid formId")
+	}
+	return nil
+}
+
+// --- Delivery ---
+
+// fireRESTHooks delivers an item to the subscriptions of a trigger in the
+// background; formID is that of a form submission. Failures are only
+// recorded on the subscription.
+func fireRESTHooks(siteName, trigger, id, formID string, data any) {
+	hooks, err := readRESTHooks(siteName)
+	if err != nil {
+		slog.Error("error reading REST hooks", "site", siteName, "error", err)
+		return
+	}
+	payload := restHookPayload{ID: id, Trigger: trigger, SiteName: siteName, Time: time.Now().UTC(), Data: data}
+	for _, h := range hooks {
+		if h.Trigger != trigger || (h.FormID != "" && h.FormID != formID) {
+			continue
+		}
+		go deliverRESTHook(siteName, h, payload)
+	}
+}
+
+func deliverRESTHook(siteName string, h RESTHook, payload restHookPayload) {
+	status, err := postRESTHook(h, payload)
+	if err != nil {
+		slog.Warn("error delivering REST hook", "site", siteName, "hook", h.ID, "trigger", h.Trigger, "error", err)
+	}
+
+	restHooksMu.Lock()
+	defer restHooksMu.Unlock()
+	hooks, rerr := readRESTHooks(siteName)
+	if rerr != nil {
+		slog.Error("error reading REST hooks", "site", siteName, "error", rerr)
+		return
+	}
+	i := slices.IndexFunc(hooks, func(o RESTHook) bool { return o.ID == h.ID })
+	if i < 0 {
+		return // unsubscribed meanwhile
+	}
+	if status == http.StatusGone {
+		hooks = slices.Delete(hooks, i, i+1)
+		recordSiteEvent(siteName, SiteEvent{Type: "rest_hook.unsubscribed", Message: h.Trigger + " " + h.TargetURL + " (410 Gone)"})
+	} else {
+		now := time.Now().UTC()
+		hooks[i].LastDeliveryAt, hooks[i].LastStatus, hooks[i].LastError = &now, status, ""
+		if err != nil {
+			hooks[i].LastError = err.Error()
+		}
+	}
+	if err := writeRESTHooks(siteName, hooks); err != nil {
+		slog.Error("error writing REST hooks", "site", siteName, "error", err)
+	}
+}
+
+// postRESTHook sends a payload to the target of h and returns the response
+// status.
+func postRESTHook(h RESTHook, payload restHookPayload) (int, error) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequest(http.MethodPost, h.TargetURL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	mac := hmac.New(sha256.New, []byte(h.Secret))
+	mac.Write(body)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(restHookSignature, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	resp, err := ownerURLClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 && resp.StatusCode != http.StatusGone {
+		return resp.StatusCode, fmt.Errorf("target answered %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// --- Recent items ---
+
+func recentFormSubmissions(siteName, formID string) ([]restHookPayload, error) {
+	formIDs := []string{formID}
+	if formID == "" {
+		sc, err := readSiteConfig(siteName)
+		if err != nil {
+			return nil, err
+		}
+		formIDs = nil
+		for _, f := range sc.Forms {
+			formIDs = append(formIDs, f.ID)
+		}
+	}
+	var payloads []restHookPayload
+	for _, id := range formIDs {
+		submissions, err := readFormSubmissions(siteName, id)
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range submissions {
+			payloads = append(payloads, restHookPayload{ID: s.ID, Time: s.SubmittedAt, Data: formSubmissionData{FormID: id, FormSubmission: s}})
+		}
+	}
+	return payloads, nil
+}
+
+func recentBookings(siteName, _ string) ([]restHookPayload, error) {
+	bookings, err := readBookings(siteName)
+	if err != nil {
+		return nil, err
+	}
+	var payloads []restHookPayload
+	for _, b := range bookings {
+		payloads = append(payloads, restHookPayload{ID: b.ID, Time: b.CreatedAt, Data: b})
+	}
+	return payloads, nil
+}
+
+func recentComments(siteName, _ string) ([]restHookPayload, error) {
+	comments, err := readComments(siteName)
+	if err != nil {
+		return nil, err
+	}
+	var payloads []restHookPayload
+	for _, c := range comments {
+		if c.Status != commentSpam {
+			payloads = append(payloads, restHookPayload{ID: c.ID, Time: c.CreatedAt, Data: c.restHookData()})
+		}
+	}
+	return payloads, nil
+}
+
+// restHookData is a comment without the client details kept against spam.
+func (c Comment) restHookData() Comment {
+	c.ClientIP, c.UserAgent = "", ""
+	return c
+}
+
+// --- Handlers ---
+
+type restHookTriggersResponse struct {
+	Triggers []restHookTrigger `json:"triggers"`
+}
+
+// listRESTHookTriggersHandler lists the triggers with a sample payload each.
+func listRESTHookTriggersHandler(w http.ResponseWriter, r *http.Request) {
+	respondJSON(w, restHookTriggersResponse{Triggers: restHookTriggers})
+}
+
+func listRESTHooksHandler(w http.ResponseWriter, r *http.Request) {
+	siteName, ok := siteNameFromPath(w, r)
+	if !ok {
+		return
+	}
+	hooks, err := readRESTHooks(siteName)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error reading REST hooks", "site", siteName, "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	for i := range hooks {
+		hooks[i] = hooks[i].public()
+	}
+	respondJSON(w, hooks)
+}
+
+// subscribeRESTHookHandler creates a subscription; the response is the only
+// one containing its secret.
+func subscribeRESTHookHandler(w http.ResponseWriter, r *http.Request) {
+	siteName, ok := siteNameFromPath(w, r)
+	if !ok {
+		return
+	}
+	var req restHookRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON request", http.StatusBadRequest)
+		return
+	}
+	if err := req.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		slog.ErrorContext(r.Context(), "error generating REST hook secret", "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	restHooksMu.Lock()
+	defer restHooksMu.Unlock()
+	hooks, err := readRESTHooks(siteName)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error reading REST hooks", "site", siteName, "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if len(hooks) >= maxRESTHooksPerSite {
+		http.Error(w, fmt.Sprintf("A site may have at most %d REST hooks", maxRESTHooksPerSite), http.StatusConflict)
+		return
+	}
+	hook := RESTHook{
+		ID:        newID(),
+		Trigger:   req.Trigger,
+		TargetURL: req.TargetURL,
+		FormID:    req.FormID,
+		Secret:    hex.EncodeToString(secret),
+		CreatedAt: time.Now().UTC(),
+	}
+	if err := writeRESTHooks(siteName, append(hooks, hook)); err != nil {
+		slog.ErrorContext(r.Context(), "error writing REST hooks", "site", siteName, "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	recordSiteEvent(siteName, SiteEvent{Type: "rest_hook.subscribed", Message: hook.Trigger + " " + hook.TargetURL})
+	respondJSONStatus(w, http.StatusCreated, hook)
+}
+
+func unsubscribeRESTHookHandler(w http.ResponseWriter, r *http.Request) {
+	siteName, ok := siteNameFromPath(w, r)
+	if !ok {
+		return
+	}
+	restHooksMu.Lock()
+	defer restHooksMu.Unlock()
+	hooks, err := readRESTHooks(siteName)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error reading REST hooks", "site", siteName, "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	i := slices.IndexFunc(hooks, func(h RESTHook) bool { return h.ID == r.PathValue("hookId") })
+	if i < 0 {
+		http.Error(w, "REST hook not found", http.StatusNotFound)
+		return
+	}
+	hook := hooks[i]
+	if err := writeRESTHooks(siteName, slices.Delete(hooks, i, i+1)); err != nil {
+		slog.ErrorContext(r.Context(), "error writing REST hooks", "site", siteName, "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	recordSiteEvent(siteName, SiteEvent{Type: "rest_hook.unsubscribed", Message: hook.Trigger + " " + hook.TargetURL})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// getRESTHookSamplesHandler returns the latest items of a trigger in the
+// delivered format, newest first, or the trigger's sample if the site has
+// none yet; ?formId= narrows form submissions to a form.
+func getRESTHookSamplesHandler(w http.ResponseWriter, r *http.Request) {
+	siteName, ok := siteNameFromPath(w, r)
+	if !ok {
+		return
+	}
+	trigger, ok := findRESTHookTrigger(r.PathValue("trigger"))
+	if !ok {
+		http.Error(w, "Trigger not found", http.StatusNotFound)
+		return
+	}
+	formID := r.URL.Query().Get("formId")
+	if formID != "" && !formIDRegex.MatchString(formID) {
+		http.Error(w, "invalid formId", http.StatusBadRequest)
+		return
+	}
+	var payloads []restHookPayload
+	if trigger.recent != nil {
+		var err error
+		payloads, err = trigger.recent(siteName, formID)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "error reading REST hook samples", "site", siteName, "trigger", trigger.Key, "error", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+	}
+	if len(payloads) == 0 {
+		payloads = []restHookPayload{{ID: "sample", Time: restHookSampleTime, Data: trigger.Sample}}
+	}
+	slices.SortStableFunc(payloads, func(a, b restHookPayload) int { return b.Time.Compare(a.Time) })
+	payloads = payloads[:min(len(payloads), restHookSampleResults)]
+	for i := range payloads {
+		payloads[i].Trigger, payloads[i].SiteName = trigger.Key, siteName
+	}
+	respondJSON(w, payloads)
+}
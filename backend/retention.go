@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+// retentionPolicy removes one kind of data older than a cutoff. With dryRun
+// nothing is removed, only counted.
+type retentionPolicy struct {
+	name  string
+	days  func() int // 0 keeps the data forever
+	purge func(siteName string, cutoff time.Time, dryRun bool) (purgeCount, error)
+}
+
+var retentionPolicies = []retentionPolicy{
+	{name: "events", days: func() int { return config.Retention.EventsDays }, purge: purgeSiteEvents},
+	{name: "analytics", days: func() int { return config.Retention.AnalyticsDays }, purge: purgeAnalytics},
+}
+
+type purgeCount struct {
+	Items int   `json:"items"` // events or files, depending on the policy
+	Bytes int64 `json:"bytes"`
+}
+
+func (c *purgeCount) add(o purgeCount) {
+	c.Items += o.Items
+	c.Bytes += o.Bytes
+}
+
+type policyReport struct {
+	Days   int                   `json:"days"`
+	Cutoff time.Time             `json:"cutoff"`
+	Total  purgeCount            `json:"total"`
+	Sites  map[string]purgeCount `json:"sites,omitempty"` // sites with something to purge
+}
+
+type retentionReport struct {
+	DryRun   bool                    `json:"dryRun"`
+	RanAt    time.Time               `json:"ranAt"`
+	Policies map[string]policyReport `json:"policies"`
+}
+
+// Purge totals since startup, reported by GET /api/v1/retention.
+var (
+	retentionMu      sync.Mutex
+	retentionTotals  = map[string]purgeCount{}
+	lastRetentionRun *retentionReport
+)
+
+// runRetention applies all policies to all sites.
+func runRetention(now time.Time, dryRun bool) (retentionReport, error) {
+	report := retentionReport{DryRun: dryRun, RanAt: now, Policies: map[string]policyReport{}}
+	siteNames, err := listSiteNames()
+	if err != nil {
+		return report, err
+	}
+	for _, policy := range retentionPolicies {
+		days := policy.days()
+		if days <= 0 {
+			continue
+		}
+		pr := policyReport{Days: days, Cutoff: now.AddDate(0, 0, -days), Sites: map[string]purgeCount{}}
+		for _, siteName := range siteNames {
+			count, err := policy.purge(siteName, pr.Cutoff, dryRun)
+			if err != nil {
+				slog.Error("retention: error purging", "data", policy.name, "site", siteName, "error", err)
+			}
+			if count.Items > 0 {
+				pr.Sites[siteName] = count
+				pr.Total.add(count)
+			}
+		}
+		report.Policies[policy.name] = pr
+	}
+	// Archives are not per live site, they are purged on their own.
+	if days := config.Retention.ArchiveDays; days > 0 {
+		pr := policyReport{Days: days, Cutoff: now.AddDate(0, 0, -days)}
+		pr.Sites, err = purgeArchives(pr.Cutoff, dryRun)
+		if err != nil {
+			slog.Error("retention: error purging archives", "error", err)
+		}
+		for _, count := range pr.Sites {
+			pr.Total.add(count)
+		}
+		report.Policies["archives"] = pr
+	}
+	// So is the audit log.
+	if days := config.Retention.AuditDays; days > 0 {
+		pr := policyReport{Days: days, Cutoff: now.AddDate(0, 0, -days)}
+		pr.Total, err = purgeAuditLog(pr.Cutoff, dryRun)
+		if err != nil {
+			slog.Error("retention: error purging the audit log", "error", err)
+		}
+		report.Policies["audit"] = pr
+	}
+
+	if !dryRun {
+		retentionMu.Lock()
+		for name, pr := range report.Policies {
+			total := retentionTotals[name]
+			total.add(pr.Total)
+			retentionTotals[name] = total
+		}
+		lastRetentionRun = &report
+		retentionMu.Unlock()
+	}
+	return report, nil
+}
+
+// purgeSiteEvents rewrites the events file without the events before cutoff.
+// Lines that cannot be parsed are kept.
+func purgeSiteEvents(siteName string, cutoff time.Time, dryRun bool) (purgeCount, error) {
+	var count purgeCount
+	path := filepath.Join(sitesBaseDir, siteName, siteEventsFile)
+	eventsMu.Lock()
+	defer eventsMu.Unlock()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return count, nil
+		}
+		return count, err
+	}
+
+	var kept bytes.Buffer
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		var event SiteEvent
+		if json.Unmarshal(line, &event) == nil && event.Time.Before(cutoff) {
+			count.Items++
+			count.Bytes += int64(len(line) + 1)
+			continue
+		}
+		kept.Write(line)
+		kept.WriteByte('\n')
+	}
+	if err := scanner.Err(); err != nil {
+		return count, err
+	}
+	if dryRun || count.Items == 0 {
+		return count, nil
+	}
+	return count, writeFileAtomic(path, kept.Bytes(), 0644)
+}
+
+// purgeAnalytics removes the daily pageview files of days before cutoff.
+func purgeAnalytics(siteName string, cutoff time.Time, dryRun bool) (purgeCount, error) {
+	var count purgeCount
+	dir := filepath.Join(sitesBaseDir, siteName, siteAnalyticsDir)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return count, nil
+		}
+		return count, err
+	}
+	cutoffDay := cutoff.UTC().Truncate(24 * time.Hour)
+	for _, e := range entries {
+		name := strings.TrimSuffix(e.Name(), ".jsonl")
+		// Files are <date>.jsonl or <source>-<date>.jsonl.
+		day, err := time.Parse(dateLayout, name[max(0, len(name)-len(dateLayout)):])
+		if err != nil || e.IsDir() || !day.Before(cutoffDay) {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			return count, err
+		}
+		if !dryRun {
+			if err := os.Remove(filepath.Join(dir, e.Name())); err != nil {
+				return count, err
+			}
+		}
+		count.Items++
+		count.Bytes += info.Size()
+	}
+	return count, nil
+}
+
+// runRetentionIfDue is called by the scheduler and purges once a day.
+func runRetentionIfDue(now time.Time) {
+	retentionMu.Lock()
+	due := lastRetentionRun == nil || now.Sub(lastRetentionRun.RanAt) >= 24*time.Hour
+	retentionMu.Unlock()
+	if !due {
+		return
+	}
+	report, err := runRetention(now, false)
+	if err != nil {
+		slog.Error("retention: error", "error", err)
+		return
+	}
+	for name, pr := range report.Policies {
+		if pr.Total.Items > 0 {
+			slog.Info("retention: purged", "data", name, "items", pr.Total.Items, "bytes", pr.Total.Bytes, "older_than_days", pr.Days)
+		}
+	}
+}
+
+// getRetentionHandler reports what a purge would remove now, the last run
+// and the purge totals since startup.
+func getRetentionHandler(w http.ResponseWriter, r *http.Request) {
+	pending, err := runRetention(time.Now().UTC(), true)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error computing retention report", "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	retentionMu.Lock()
+	defer retentionMu.Unlock()
+	respondJSON(w, map[string]any{
+		"pending": pending,
+		"lastRun": lastRetentionRun,
+		"totals":  retentionTotals,
+	})
+}
+
+// --- Command ---
+
+var purgeCommand = command{
+	usage: "purge [--dry-run]",
+	flags: func(fs *pflag.FlagSet) {
+		fs.BoolVar(&purgeOptions.dryRun, "dry-run", false, "Only report what would be purged")
+	},
+	run: func(args []string) error {
+		report, err := runRetention(time.Now().UTC(), purgeOptions.dryRun)
+		if err != nil {
+			return err
+		}
+		data, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(data))
+		return nil
+	},
+}
+
+var purgeOptions struct {
+	dryRun bool
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/pflag"
+)
+
+// Users have one of two roles. Regular users only see and change their own
+// sites; admins can see, change and delete every site and use the admin
+// endpoints. The role of a local account is kept in the user store and set
+// with "flox-backend user role" (or "user create --admin" for a new one),
+// and read on every request so a change takes effect at once; users of the
+// OIDC provider are admins if their token carries auth.oidc.admin_role as
+// realm or client role.
+
+const (
+	roleUser  = "user"
+	roleAdmin = "admin"
+)
+
+var roles = []string{roleUser, roleAdmin}
+
+// isAdmin reports whether the request is of a logged-in admin.
+func isAdmin(r *http.Request) bool {
+	return currentSession(r).Role == roleAdmin
+}
+
+// oidcRole is the role of a provider token with these roles.
+func oidcRole(tokenRoles []string) string {
+	if config.Auth.OIDC.AdminRole != "" && slices.Contains(tokenRoles, config.Auth.OIDC.AdminRole) {
+		return roleAdmin
+	}
+	return roleUser
+}
+
+// adminAuth lets requests with admin.token or of an admin through.
+func adminAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if config.Admin.Token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(config.Admin.Token)) == 1 {
+			next(w, r.WithContext(context.WithValue(r.Context(), adminTokenKey{}, true)))
+			return
+		}
+		if !requireLogin(w, r) {
+			return
+		}
+		if !isAdmin(r) {
+			apiError(w, r, http.StatusForbidden, codeAdminRequired, "Only admins may do this")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// withAdminToken lets requests with admin.token manage sites like an admin,
+// for automation such as the Kubernetes controller (k8scontroller.go).
+// Requests with a session go on as they are, other bearer tokens are
+// rejected like an expired session.
+func withAdminToken(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || currentUserID(r) != "" {
+			next(w, r)
+			return
+		}
+		if config.Admin.Token != "" && subtle.ConstantTimeCompare([]byte(strings.TrimSpace(token)), []byte(config.Admin.Token)) == 1 {
+			next(w, r.WithContext(context.WithValue(r.Context(), adminTokenKey{}, true)))
+			return
+		}
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		apiError(w, r, http.StatusUnauthorized, codeInvalidToken, "Invalid or expired session, please log in again")
+	}
+}
+
+// --- Commands ---
+
+var userCommand = command{
+	subcommands: map[string]command{
+		"list": {
+			usage: "user list",
+			run:   runUserList,
+		},
+		"role": {
+			usage: "user role <email> <user|admin>",
+			run:   runUserRole,
+		},
+		"create": {
+			usage: "user create <email> [--admin]",
+			flags: func(fs *pflag.FlagSet) {
+				fs.BoolVar(&userCreateOptions.admin, "admin", false, "Make the user an admin")
+			},
+			run: runUserCreate,
+		},
+	},
+}
+
+var userCreateOptions struct {
+	admin bool
+}
+
+func runUserList(args []string) error {
+	users, err := readUsers()
+	if err != nil {
+		return err
+	}
+	list := make([]User, 0, len(users))
+	for _, u := range users {
+		list = append(list, u)
+	}
+	slices.SortFunc(list, func(a, b User) int { return a.CreatedAt.Compare(b.CreatedAt) })
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "EMAIL\tROLE\tID\tCREATED")
+	for _, u := range list {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", u.Email, u.role(), u.ID, u.CreatedAt.Format("2006-01-02"))
+	}
+	return tw.Flush()
+}
+
+// runUserRole sets the role of a local account, e.g. to make the first
+// admin.
+func runUserRole(args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("usage: user role <email> <user|admin>")
+	}
+	email, role := args[0], args[1]
+	if !slices.Contains(roles, role) {
+		return fmt.Errorf("unknown role %q, use user or admin", role)
+	}
+	usersMu.Lock()
+	defer usersMu.Unlock()
+	users, err := readUsers()
+	if err != nil {
+		return err
+	}
+	user, ok := findUserByEmail(users, email)
+	if !ok {
+		return fmt.Errorf("no user with email %s", email)
+	}
+	user.Role = role
+	users[user.ID] = user
+	if err := writeUsers(users); err != nil {
+		return err
+	}
+	fmt.Printf("%s is now %s\n", user.Email, role)
+	return nil
+}
+
+// runUserCreate creates a local account, e.g. the first admin of a new
+// instance. The password is read from stdin so it stays out of the shell
+// history.
+func runUserCreate(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: user create <email> [--admin]")
+	}
+	if !config.Auth.Passwords {
+		return fmt.Errorf("password accounts are disabled (auth.passwords)")
+	}
+	fmt.Fprint(os.Stderr, "Password: ")
+	password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && (err != io.EOF || password == "") {
+		return fmt.Errorf("reading the password: %v", err)
+	}
+	password = strings.TrimRight(password, "\r\n")
+	email, err := validateCredentials(args[0], password)
+	if err != nil {
+		return err
+	}
+	user, err := newPasswordUser(email, password)
+	if err != nil {
+		return err
+	}
+	if userCreateOptions.admin {
+		user.Role = roleAdmin
+	}
+	if err := addUser(user); err != nil {
+		return err
+	}
+	fmt.Printf("%s created as %s, ID %s\n", user.Email, user.role(), user.ID)
+	return nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"log/slog"
+	"time"
+)
+
+// provisioningTx collects how to undo each completed step of a site creation,
+// so that a failing step leaves neither a directory nor DNS records behind.
+// A nil transaction is valid and records nothing, for provisioning outside
+// of a creation (e.g. after email verification).
+type provisioningTx struct {
+	siteName string
+	steps    []rollbackStep
+}
+
+type rollbackStep struct {
+	name string
+	undo func() error
+}
+
+func newProvisioningTx(siteName string) *provisioningTx {
+	return &provisioningTx{siteName: siteName}
+}
+
+// onRollback registers the undo of a step that just succeeded.
+func (tx *provisioningTx) onRollback(name string, undo func() error) {
+	if tx == nil {
+		return
+	}
+	tx.steps = append(tx.steps, rollbackStep{name: name, undo: undo})
+}
+
+// rollback undoes the registered steps in reverse order. Every step is
+// attempted; failures are logged, as the caller already reports the error
+// that caused the rollback.
+func (tx *provisioningTx) rollback() {
+	if tx == nil {
+		return
+	}
+	for i := len(tx.steps) - 1; i >= 0; i-- {
+		s := tx.steps[i]
+		start := time.Now()
+		err := s.undo()
+		logStep(tx.siteName, "rollback."+s.name, "", start, err)
+		if err != nil {
+			slog.Error("error rolling back", "step", s.name, "site", tx.siteName, "error", err)
+		}
+	}
+	tx.steps = nil
+	slog.Info("rolled back creation of site", "site", tx.siteName)
+}
@@ -13,7 +13,7 @@ TEST_BINARY="./flox-backend-test"
 TEST_PORT="8099"
 TEST_SITES_DIR="./test-sites-local"
 TEST_SITE_IP="127.0.0.1"
-HEALTH_ENDPOINT="http://localhost:${TEST_PORT}/api/health"
+HEALTH_ENDPOINT="http://localhost:${TEST_PORT}/api/v1/health"
 # --- End Configuration ---
 
 # Check if the test binary exists
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Site scaffolding: a new site gets the starter files of its style from
+// <paths.template_dir>/sites/<style> (or sites/default), so it has content
+// from the first build. In the tree, layout.html is the template of the
+// site's pages: it is copied to the site directory and the builds render
+// every page with it instead of the built-in one, with the same data. Every
+// other .html file is rendered once with html/template (SiteName,
+// Description, Style, SiteURL and the selected Sections) into the public
+// directory, e.g. about.html; all other files, like stylesheets and images,
+// are copied there as they are. Builds overwrite the files they generate
+// themselves (index.html, the pages, blog/ and shop/) and leave the rest.
+
+const (
+	siteScaffoldDir     = "sites"   // in paths.template_dir, one directory per style
+	defaultScaffold     = "default" // used for styles without their own tree
+	siteLayoutFile      = "layout.html"
+	maxScaffoldFileSize = 10 << 20
+)
+
+// scaffoldData is what the .html files of a tree are rendered with.
+type scaffoldData struct {
+	SiteName    string
+	Description string
+	Style       string
+	SiteURL     string
+	Sections    []sectionView
+	CreatedAt   time.Time
+}
+
+// scaffoldPath returns the tree for a style, "" if there is none.
+func scaffoldPath(style string) string {
+	if config.Paths.TemplateDir == "" {
+		return ""
+	}
+	for _, name := range []string{style, defaultScaffold} {
+		if name == "" || !filepath.IsLocal(name) {
+			continue
+		}
+		dir := filepath.Join(config.Paths.TemplateDir, siteScaffoldDir, name)
+		if info, err := os.Stat(dir); err == nil && info.IsDir() {
+			return dir
+		}
+	}
+	return ""
+}
+
+// scaffoldSite renders the tree of the site's style into its directory.
+// It returns the tree used, "" if there was none.
+func scaffoldSite(siteConfig SiteConfig) (string, error) {
+	src := scaffoldPath(siteConfig.Style)
+	if src == "" {
+		return "", nil
+	}
+	siteDir := filepath.Join(sitesBaseDir, siteConfig.SiteName)
+	publicDir := filepath.Join(siteDir, sitePublicDir)
+	data := scaffoldData{
+		SiteName:    siteConfig.SiteName,
+		Description: siteConfig.Description,
+		Style:       siteConfig.Style,
+		SiteURL:     siteURL(siteConfig.SiteName),
+		Sections:    sectionViews(siteConfig.InitialContent),
+		CreatedAt:   siteConfig.CreatedAt,
+	}
+	err := filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if strings.HasPrefix(d.Name(), ".") && rel != "." {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if strings.HasPrefix(d.Name(), ".") || !d.Type().IsRegular() {
+			return nil // no dotfiles, no symlinks out of the tree
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if info.Size() > maxScaffoldFileSize {
+			return fmt.Errorf("%s is larger than %d bytes", rel, maxScaffoldFileSize)
+		}
+		switch {
+		case rel == siteLayoutFile:
+			if _, err := parseSiteLayout(path); err != nil {
+				return err
+			}
+			return copyScaffoldFile(path, filepath.Join(siteDir, siteLayoutFile))
+		case strings.EqualFold(filepath.Ext(rel), ".html"):
+			t, err := template.ParseFiles(path)
+			if err != nil {
+				return err
+			}
+			return executeToFile(t, filepath.Base(path), filepath.Join(publicDir, rel), data)
+		default:
+			return copyScaffoldFile(path, filepath.Join(publicDir, rel))
+		}
+	})
+	if err != nil {
+		return src, fmt.Errorf("failed to scaffold site from %s: %w", src, err)
+	}
+	return src, nil
+}
+
+func copyScaffoldFile(src, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func parseSiteLayout(path string) (*template.Template, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return template.New("site").Parse(string(data))
+}
+
+// siteTemplate is the template the pages of a site are rendered with: its
+// scaffolded layout.html, or the built-in one.
+func siteTemplate(siteName string) (*template.Template, error) {
+	t, err := parseSiteLayout(filepath.Join(sitesBaseDir, siteName, siteLayoutFile))
+	if os.IsNotExist(err) {
+		return defaultSiteTemplate, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", siteLayoutFile, err)
+	}
+	return t, nil
+}
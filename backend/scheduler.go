@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sort"
+	"time"
+)
+
+// PublishWindow limits when a section is visible on the built site. Either
+// bound may be omitted.
+type PublishWindow struct {
+	PublishFrom  *time.Time `json:"publishFrom,omitempty"`
+	PublishUntil *time.Time `json:"publishUntil,omitempty"`
+}
+
+func (pw PublishWindow) contains(t time.Time) bool {
+	if pw.PublishFrom != nil && t.Before(*pw.PublishFrom) {
+		return false
+	}
+	if pw.PublishUntil != nil && !t.Before(*pw.PublishUntil) {
+		return false
+	}
+	return true
+}
+
+// publishedSections returns the sections of the site that are visible at t,
+// in their configured order.
+func (sc SiteConfig) publishedSections(t time.Time) []string {
+	published := []string{}
+	for _, id := range sc.InitialContent {
+		if window, ok := sc.SectionSchedules[id]; ok && !window.contains(t) {
+			continue
+		}
+		published = append(published, id)
+	}
+	return published
+}
+
+// upcomingScheduleEvents lists the publish/unpublish boundaries after now.
+func upcomingScheduleEvents(sc SiteConfig, now time.Time) []SiteEvent {
+	upcoming := []SiteEvent{}
+	for id, window := range sc.SectionSchedules {
+		if window.PublishFrom != nil && window.PublishFrom.After(now) {
+			upcoming = append(upcoming, SiteEvent{Time: *window.PublishFrom, Type: "section.published", Section: id})
+		}
+		if window.PublishUntil != nil && window.PublishUntil.After(now) {
+			upcoming = append(upcoming, SiteEvent{Time: *window.PublishUntil, Type: "section.unpublished", Section: id})
+		}
+	}
+	sort.Slice(upcoming, func(i, j int) bool { return upcoming[i].Time.Before(upcoming[j].Time) })
+	return upcoming
+}
+
+// runScheduler periodically rebuilds sites whose set of published sections
+// changed since their last build, or that have blog posts due, and creates
+// queued DNS records and due certificates. Once a day it also purges data
+// past its retention. Comparing against the last build instead of tracking
+// boundaries keeps it correct across restarts.
+func runScheduler(interval time.Duration) {
+	if interval <= 0 {
+		slog.Info("Scheduler disabled (scheduler.interval <= 0)")
+		return
+	}
+	slog.Info("Scheduler running", "interval", interval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		now := time.Now().UTC()
+		runScheduledRebuilds(now)
+		runPendingDNS()
+		runCertificateRenewals(now)
+		runRetentionIfDue(now)
+		runAccountDeletions(now)
+	}
+}
+
+func runScheduledRebuilds(now time.Time) {
+	siteNames, err := listSiteNames()
+	if err != nil {
+		slog.Error("scheduler: error listing sites", "error", err)
+		return
+	}
+
+	for _, siteName := range siteNames {
+		siteConfig, err := readSiteConfig(siteName)
+		if err != nil {
+			slog.Error("scheduler: error reading site config", "site", siteName, "error", err)
+			continue
+		}
+		lastBuild, err := latestBuildRecord(siteName)
+		if err != nil {
+			slog.Error("scheduler: error reading build record", "site", siteName, "error", err)
+			continue
+		}
+		if lastBuild == nil {
+			continue // never built, nothing scheduled can have changed
+		}
+
+		reason := ""
+		want := siteConfig.publishedSections(now)
+		if !slices.Equal(lastBuild.Sections, want) {
+			recordSectionChanges(siteName, lastBuild.Sections, want, now)
+			reason = "scheduled section change"
+		} else if slices.Contains(want, "blog") && postsDueSince(siteName, lastBuild.StartedAt, now) {
+			reason = "scheduled post"
+		} else if slices.Contains(want, "social") && refreshSocialFeeds(siteName, siteConfig, now) {
+			reason = "social feed update"
+		} else if slices.Contains(want, "hours") && siteConfig.OpeningHours != nil && siteConfig.OpeningHours.exceptionsChanged(lastBuild.StartedAt, now) {
+			reason = "opening hours exceptions"
+		}
+		if reason == "" {
+			continue
+		}
+
+		slog.Info("scheduler: rebuilding", "site", siteName, "reason", reason)
+		release := acquireJobSlot(siteName, jobBulk)
+		if _, err := buildSite(siteName); err != nil {
+			slog.Error("scheduler: error rebuilding", "site", siteName, "error", err)
+		}
+		release()
+	}
+}
+
+// postsDueSince reports whether a post became visible between the last build
+// and now.
+func postsDueSince(siteName string, since, now time.Time) bool {
+	posts, err := readPosts(siteName)
+	if err != nil {
+		slog.Error("scheduler: error reading posts", "site", siteName, "error", err)
+		return false
+	}
+	for _, p := range posts {
+		if p.PublishedAt != nil && p.PublishedAt.After(since) && !p.PublishedAt.After(now) {
+			return true
+		}
+	}
+	return false
+}
+
+func recordSectionChanges(siteName string, before, after []string, now time.Time) {
+	for _, id := range after {
+		if !slices.Contains(before, id) {
+			recordSiteEvent(siteName, SiteEvent{Time: now, Type: "section.published", Section: id})
+		}
+	}
+	for _, id := range before {
+		if !slices.Contains(after, id) {
+			recordSiteEvent(siteName, SiteEvent{Time: now, Type: "section.unpublished", Section: id})
+		}
+	}
+}
+
+// setSectionScheduleHandler sets or clears (empty body object) the publish
+// window of one section and rebuilds the site.
+func setSectionScheduleHandler(w http.ResponseWriter, r *http.Request) {
+	siteName, ok := siteNameFromPath(w, r)
+	if !ok {
+		return
+	}
+	sectionID := r.PathValue("sectionId")
+
+	var window PublishWindow
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&window); err != nil {
+		http.Error(w, "Invalid JSON request", http.StatusBadRequest)
+		return
+	}
+	if window.PublishFrom != nil && window.PublishUntil != nil && !window.PublishUntil.After(*window.PublishFrom) {
+		http.Error(w, "publishUntil must be after publishFrom", http.StatusBadRequest)
+		return
+	}
+
+	siteConfig, err := updateSiteConfig(siteName, func(siteConfig *SiteConfig) error {
+		if !slices.Contains(siteConfig.InitialContent, sectionID) {
+			return &httpError{http.StatusNotFound, "Section not found on this site"}
+		}
+		if window.PublishFrom == nil && window.PublishUntil == nil {
+			delete(siteConfig.SectionSchedules, sectionID)
+		} else {
+			if siteConfig.SectionSchedules == nil {
+				siteConfig.SectionSchedules = map[string]PublishWindow{}
+			}
+			siteConfig.SectionSchedules[sectionID] = window
+		}
+		return nil
+	})
+	if err != nil {
+		writeSiteUpdateError(w, r, siteName, err)
+		return
+	}
+	recordSiteEvent(siteName, SiteEvent{Type: "section.scheduled", Section: sectionID})
+
+	if _, err := buildSite(siteName); err != nil {
+		slog.ErrorContext(r.Context(), "error building site", "site", siteName, "error", err)
+	}
+	respondJSON(w, siteConfig)
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+)
+
+var errNoEncryptionKey = errors.New("secrets.encryption_key is not configured")
+
+// secretsCipher returns the AEAD used for credentials stored in site configs.
+// The key is a base64 encoded 32 byte value from secrets.encryption_key.
+func secretsCipher() (cipher.AEAD, error) {
+	if config.Secrets.EncryptionKey == "" {
+		return nil, errNoEncryptionKey
+	}
+	key, err := base64.StdEncoding.DecodeString(config.Secrets.EncryptionKey)
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("secrets.encryption_key must be 32 bytes, base64 encoded")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptSecret encrypts a credential with AES-256-GCM. The result is
+// base64(nonce || ciphertext).
+func encryptSecret(plaintext string) (string, error) {
+	aead, err := secretsCipher()
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(plaintext), nil)
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func decryptSecret(encoded string) (string, error) {
+	aead, err := secretsCipher()
+	if err != nil {
+		return "", err
+	}
+	sealed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return "", errors.New("malformed encrypted secret")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return "", errors.New("failed to decrypt secret (wrong encryption key?)")
+	}
+	return string(plaintext), nil
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"slices"
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+var seedCommand = command{
+	usage: "seed [--sites N] [--seed S] [--dns]",
+	flags: func(fs *pflag.FlagSet) {
+		fs.IntVar(&seedOptions.sites, "sites", 10, "Number of demo sites to generate")
+		fs.Uint64Var(&seedOptions.seed, "seed", 0, "Random seed for reproducible data (0 = random)")
+		fs.BoolVar(&seedOptions.dns, "dns", false, "Also create DNS records for the generated sites")
+	},
+	run: runSeedCommand,
+}
+
+var seedOptions struct {
+	sites int
+	seed  uint64
+	dns   bool
+}
+
+var (
+	seedTrades = []string{"bakery", "studio", "cafe", "florist", "yoga", "plumbing", "dental", "books", "bikes", "photo", "salon", "garden"}
+	seedTowns  = []string{"berlin", "hamburg", "munich", "cologne", "leipzig", "dresden", "bremen", "kiel", "mainz", "ulm"}
+	seedWords  = []string{"fresh", "local", "handmade", "friendly", "seasonal", "open", "new", "quality", "family", "weekend", "crafted", "community"}
+	seedNames  = []string{"Anna", "Ben", "Clara", "Deniz", "Emil", "Fatma", "Greta", "Hannes", "Ida", "Jonas", "Kemal", "Lena"}
+	// Optional sections with content the generator knows how to fill.
+	seedSections = []string{"hero", "features", "testimonials", "contact", "form", "booking", "blog", "hours", "location"}
+)
+
+// seedGenerator produces plausible demo data from a seeded random source.
+type seedGenerator struct {
+	rnd *rand.Rand
+	now time.Time
+}
+
+func pick[T any](g *seedGenerator, items []T) T {
+	return items[g.rnd.IntN(len(items))]
+}
+
+func (g *seedGenerator) sentence(words int) string {
+	s := ""
+	for i := range words {
+		w := pick(g, seedWords)
+		if i == 0 {
+			w = string(w[0]-'a'+'A') + w[1:]
+		}
+		if i > 0 {
+			s += " "
+		}
+		s += w
+	}
+	return s + "."
+}
+
+// pastTime returns a time up to maxAgo before now.
+func (g *seedGenerator) pastTime(maxAgo time.Duration) time.Time {
+	return g.now.Add(-time.Duration(g.rnd.Int64N(int64(maxAgo)))).Truncate(time.Second)
+}
+
+func (g *seedGenerator) siteConfig(name string) SiteConfig {
+	sc := SiteConfig{
+		SiteName:    name,
+		Description: g.sentence(3 + g.rnd.IntN(4)),
+		Style:       pick(g, currentThemes()).ID,
+		CreatedAt:   g.pastTime(365 * 24 * time.Hour),
+	}
+	optional := slices.Clone(seedSections)
+	g.rnd.Shuffle(len(optional), func(i, j int) { optional[i], optional[j] = optional[j], optional[i] })
+	sc.InitialContent = append([]string{"header"}, optional[:2+g.rnd.IntN(4)]...)
+	sc.InitialContent = append(sc.InitialContent, "footer")
+
+	// Some sections are scheduled, so sites differ in what is live.
+	if g.rnd.IntN(4) == 0 {
+		id := sc.InitialContent[1]
+		from := g.now.Add(time.Duration(g.rnd.IntN(14*24)) * time.Hour)
+		sc.SectionSchedules = map[string]PublishWindow{id: {PublishFrom: &from}}
+	}
+	if slices.Contains(sc.InitialContent, "form") {
+		sc.Forms = []FormDefinition{{
+			ID:    "contact",
+			Title: "Get in touch",
+			Fields: []FormField{
+				{Name: "name", Label: "Name", Type: "text", Required: true},
+				{Name: "topic", Label: "Topic", Type: "select", Options: []string{"Question", "Offer", "Other"}},
+				{Name: "message", Label: "Message", Type: "text"},
+			},
+		}}
+	}
+	if slices.Contains(sc.InitialContent, "booking") {
+		bc := &BookingConfig{Timezone: "Europe/Berlin", SlotMinutes: 30}
+		for wd := time.Monday; wd <= time.Friday; wd++ {
+			bc.Hours = append(bc.Hours, BookingHours{Weekday: wd, Start: "09:00", End: "17:00"})
+		}
+		sc.Booking = bc
+	}
+	if slices.Contains(sc.InitialContent, "hours") {
+		oh := &OpeningHours{Timezone: "Europe/Berlin"}
+		opens := pick(g, []string{"07:00", "08:00", "09:00", "10:00"})
+		for wd := time.Monday; wd <= time.Saturday; wd++ {
+			oh.Regular = append(oh.Regular, OpeningHoursRange{Weekday: wd, Opens: opens, Closes: "18:00"})
+		}
+		sc.OpeningHours = oh
+	}
+	if slices.Contains(sc.InitialContent, "location") {
+		sc.Location = &Location{
+			Address:    fmt.Sprintf("Hauptstraße %d", 1+g.rnd.IntN(120)),
+			Latitude:   47.5 + g.rnd.Float64()*7,
+			Longitude:  6 + g.rnd.Float64()*9,
+			GeocodedAt: sc.CreatedAt,
+		}
+	}
+	if slices.Contains(sc.InitialContent, "blog") {
+		sc.Comments = &CommentSettings{Mode: pick(g, []string{"closed", "moderated", "open"})}
+	}
+	return sc
+}
+
+// seedContent writes posts, comments and form submissions and back-dated
+// events for a site created by seedSite.
+func (g *seedGenerator) seedContent(sc SiteConfig) error {
+	if slices.Contains(sc.InitialContent, "blog") {
+		var comments []Comment
+		for i := range 1 + g.rnd.IntN(8) {
+			created := sc.CreatedAt.Add(time.Duration(i+1) * 72 * time.Hour)
+			post := Post{
+				Slug:      fmt.Sprintf("post-%d", i+1),
+				Title:     g.sentence(3),
+				Content:   g.sentence(12) + "\n\n" + g.sentence(20),
+				Tags:      []string{pick(g, seedWords)},
+				CreatedAt: created,
+				UpdatedAt: created,
+			}
+			// Mostly published, some drafts and some scheduled.
+			switch g.rnd.IntN(6) {
+			case 0: // draft
+			case 1:
+				due := g.now.Add(time.Duration(1+g.rnd.IntN(10)) * 24 * time.Hour)
+				post.PublishedAt = &due
+			default:
+				post.PublishedAt = &created
+			}
+			if err := writePost(sc.SiteName, post); err != nil {
+				return err
+			}
+			recordSiteEvent(sc.SiteName, SiteEvent{Time: created, Type: "post.created", Message: post.Slug})
+			for range g.rnd.IntN(4) {
+				comments = append(comments, Comment{
+					ID:         newID(),
+					PostSlug:   post.Slug,
+					AuthorName: pick(g, seedNames),
+					Content:    g.sentence(8),
+					Status:     pick(g, []string{commentApproved, commentApproved, commentPending, commentSpam}),
+					CreatedAt:  created.Add(time.Duration(g.rnd.IntN(48)) * time.Hour),
+				})
+			}
+		}
+		if len(comments) > 0 {
+			if err := writeComments(sc.SiteName, comments); err != nil {
+				return err
+			}
+		}
+	}
+	for _, form := range sc.Forms {
+		for range g.rnd.IntN(15) {
+			err := appendFormSubmission(sc.SiteName, form.ID, FormSubmission{
+				ID:          newID(),
+				SubmittedAt: g.pastTime(g.now.Sub(sc.CreatedAt)),
+				Values:      map[string]string{"name": pick(g, seedNames), "topic": "Question", "message": g.sentence(10)},
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func runSeedCommand(args []string) error {
+	if seedOptions.sites < 1 || seedOptions.sites > 10000 {
+		return errors.New("--sites must be between 1 and 10000")
+	}
+	seed := seedOptions.seed
+	if seed == 0 {
+		seed = rand.Uint64()
+	}
+	g := &seedGenerator{rnd: rand.New(rand.NewPCG(seed, seed)), now: time.Now().UTC()}
+	slog.Info("Seeding demo sites", "sites", seedOptions.sites, "dir", sitesBaseDir, "seed", seed)
+
+	created := 0
+	for attempts := 0; created < seedOptions.sites && attempts < seedOptions.sites*10; attempts++ {
+		name := fmt.Sprintf("%s-%s", pick(g, seedTrades), pick(g, seedTowns))
+		if g.rnd.IntN(2) == 0 {
+			name = fmt.Sprintf("%s-%d", name, 1+g.rnd.IntN(99))
+		}
+		if exists, err := siteExists(name); err != nil {
+			return err
+		} else if exists {
+			continue
+		}
+		sc := g.siteConfig(name)
+		if err := seedSite(sc, seedOptions.dns); err != nil {
+			return fmt.Errorf("seeding %s: %v", name, err)
+		}
+		if err := g.seedContent(sc); err != nil {
+			return fmt.Errorf("seeding content of %s: %v", name, err)
+		}
+		if _, err := buildSite(name); err != nil {
+			slog.Error("error building site", "site", name, "error", err)
+		}
+		created++
+	}
+	slog.Info("Created demo sites", "sites", created)
+	return nil
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	siteProductsFile = "products.json"
+	shopOutputDir    = "shop" // below the public dir
+)
+
+var currencyRegex = regexp.MustCompile(`^[A-Z]{3}$`)
+
+// Product is an item of a site's shop. Checkout happens on a payment link,
+// either generated through Stripe or entered by the owner.
+type Product struct {
+	ID                  string    `json:"id"`
+	Name                string    `json:"name"`
+	Description         string    `json:"description,omitempty"`
+	PriceCents          int64     `json:"priceCents"`
+	Currency            string    `json:"currency"`
+	ImageURL            string    `json:"imageUrl,omitempty"`
+	PaymentLink         string    `json:"paymentLink,omitempty"`
+	StripePaymentLinkID string    `json:"stripePaymentLinkId,omitempty"`
+	CreatedAt           time.Time `json:"createdAt"`
+	UpdatedAt           time.Time `json:"updatedAt"`
+}
+
+type productRequest struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	PriceCents  int64  `json:"priceCents"`
+	Currency    string `json:"currency"`
+	ImageURL    string `json:"imageUrl,omitempty"`
+	// Optional manual payment link; if empty and Stripe is configured a link
+	// is generated.
+	PaymentLink string `json:"paymentLink,omitempty"`
+}
+
+var productsMu sync.Mutex
+
+func (req *productRequest) validate() error {
+	req.Name = strings.TrimSpace(req.Name)
+	req.Currency = strings.ToUpper(strings.TrimSpace(req.Currency))
+	if req.Name == "" || len(req.Name) > 200 {
+		return errors.New("name must be 1-200 characters")
+	}
+	if len(req.Description) > 5000 {
+		return errors.New("description must be at most 5000 characters")
+	}
+	if req.PriceCents <= 0 {
+		return errors.New("priceCents must be positive")
+	}
+	if !currencyRegex.MatchString(req.Currency) {
+		return errors.New("currency must be a three-letter ISO code")
+	}
+	if req.ImageURL != "" && !strings.HasPrefix(req.ImageURL, "https://") {
+		return errors.New("imageUrl must be an https URL")
+	}
+	if req.PaymentLink != "" && !strings.HasPrefix(req.PaymentLink, "https://") {
+		return errors.New("paymentLink must be an https URL")
+	}
+	return nil
+}
+
+func (p Product) formattedPrice() string {
+	return fmt.Sprintf("%d.%02d %s", p.PriceCents/100, p.PriceCents%100, p.Currency)
+}
+
+func readProducts(siteName string) ([]Product, error) {
+	products := []Product{}
+	data, err := os.ReadFile(filepath.Join(sitesBaseDir, siteName, siteProductsFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return products, nil
+		}
+		return nil, err
+	}
+	err = json.Unmarshal(data, &products)
+	return products, err
+}
+
+func writeProducts(siteName string, products []Product) error {
+	return writeJSONAtomic(filepath.Join(sitesBaseDir, siteName, siteProductsFile), products, 0644)
+}
+
+// syncPaymentLink generates a Stripe payment link for the product unless
+// the owner provided one. An existing generated link is deactivated when it
+// is replaced.
+func syncPaymentLink(siteName string, p *Product, manualLink string) error {
+	oldLinkID := p.StripePaymentLinkID
+	if manualLink != "" || config.Payments.StripeSecretKey == "" {
+		p.PaymentLink, p.StripePaymentLinkID = manualLink, ""
+	} else {
+		linkID, linkURL, err := createStripePaymentLink(siteName, *p)
+		if err != nil {
+			return err
+		}
+		p.PaymentLink, p.StripePaymentLinkID = linkURL, linkID
+	}
+	if oldLinkID != "" && oldLinkID != p.StripePaymentLinkID {
+		if err := deactivateStripePaymentLink(oldLinkID); err != nil {
+			slog.Error("error deactivating payment link", "link", oldLinkID, "site", siteName, "error", err)
+		}
+	}
+	return nil
+}
+
+// --- Build output ---
+
+type productView struct {
+	Product
+	Price string
+}
+
+type shopPageData struct {
+	Site     SiteConfig
+	Title    string
+	Products []productView
+}
+
+var shopTemplate = template.Must(template.New("shop").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+  <meta charset="utf-8">
+  <meta name="viewport" content="width=device-width, initial-scale=1">
+  <title>{{.Title}}</title>
+  {{range .Site.ThemeAssets}}
+  {{if eq .Type "css"}}<link rel="stylesheet" href="{{.URL}}" integrity="{{.Integrity}}" crossorigin="anonymous">{{else}}<script src="{{.URL}}" integrity="{{.Integrity}}" crossorigin="anonymous" defer></script>{{end}}
+  {{- end}}
+</head>
+<body class="theme-{{.Site.Style}}">
+  <header>
+    <p><a href="/">{{.Site.SiteName}}</a></p>
+  </header>
+  <main>
+    <h1>Shop</h1>
+    {{range .Products}}
+    <article class="product" id="product-{{.ID}}">
+      <h2>{{.Name}}</h2>
+      {{if .ImageURL}}<img src="{{.ImageURL}}" alt="{{.Name}}">{{end}}
+      {{with .Description}}<p>{{.}}</p>{{end}}
+      <p class="price">{{.Price}}</p>
+      {{with .PaymentLink}}<p><a href="{{.}}" rel="noopener">Buy now</a></p>{{end}}
+    </article>
+    {{else}}
+    <p>No products available.</p>
+    {{end}}
+  </main>
+</body>
+</html>
+`))
+
+func renderShop(siteConfig SiteConfig, publicDir string, products []Product, record *BuildRecord) error {
+	outDir := filepath.Join(publicDir, shopOutputDir)
+	if err := os.RemoveAll(outDir); err != nil {
+		return err
+	}
+	data := shopPageData{Site: siteConfig, Title: "Shop – " + siteConfig.SiteName}
+	for _, p := range products {
+		data.Products = append(data.Products, productView{Product: p, Price: p.formattedPrice()})
+	}
+	rel := filepath.Join(shopOutputDir, "index.html")
+	if err := executeToFile(shopTemplate, "shop", filepath.Join(publicDir, rel), data); err != nil {
+		return err
+	}
+	record.Pages = append(record.Pages, filepath.ToSlash(rel))
+	return nil
+}
+
+// --- Handlers ---
+
+func listProductsHandler(w http.ResponseWriter, r *http.Request) {
+	siteName, ok := siteNameFromPath(w, r)
+	if !ok {
+		return
+	}
+	products, err := readProducts(siteName)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error reading products", "site", siteName, "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	respondJSON(w, products)
+}
+
+func getProductHandler(w http.ResponseWriter, r *http.Request) {
+	siteName, ok := siteNameFromPath(w, r)
+	if !ok {
+		return
+	}
+	products, err := readProducts(siteName)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error reading products", "site", siteName, "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	i := slices.IndexFunc(products, func(p Product) bool { return p.ID == r.PathValue("productId") })
+	if i < 0 {
+		http.Error(w, "Product not found", http.StatusNotFound)
+		return
+	}
+	respondJSON(w, products[i])
+}
+
+func createProductHandler(w http.ResponseWriter, r *http.Request) {
+	siteName, ok := siteNameFromPath(w, r)
+	if !ok {
+		return
+	}
+	var req productRequest
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON request", http.StatusBadRequest)
+		return
+	}
+	if err := req.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now().UTC()
+	product := Product{
+		ID:          newID(),
+		Name:        req.Name,
+		Description: req.Description,
+		PriceCents:  req.PriceCents,
+		Currency:    req.Currency,
+		ImageURL:    req.ImageURL,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+	if err := syncPaymentLink(siteName, &product, req.PaymentLink); err != nil {
+		slog.ErrorContext(r.Context(), "error creating payment link", "site", siteName, "error", err)
+		http.Error(w, "Failed to create payment link", http.StatusBadGateway)
+		return
+	}
+
+	productsMu.Lock()
+	products, err := readProducts(siteName)
+	if err == nil {
+		err = writeProducts(siteName, append(products, product))
+	}
+	productsMu.Unlock()
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error writing products", "site", siteName, "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	recordSiteEvent(siteName, SiteEvent{Type: "product.created", Message: product.ID})
+
+	if _, err := buildSite(siteName); err != nil {
+		slog.ErrorContext(r.Context(), "error building site", "site", siteName, "error", err)
+	}
+	respondJSONStatus(w, http.StatusCreated, product)
+}
+
+func updateProductHandler(w http.ResponseWriter, r *http.Request) {
+	siteName, ok := siteNameFromPath(w, r)
+	if !ok {
+		return
+	}
+	var req productRequest
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON request", http.StatusBadRequest)
+		return
+	}
+	if err := req.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	productsMu.Lock()
+	defer productsMu.Unlock()
+	products, err := readProducts(siteName)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error reading products", "site", siteName, "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	i := slices.IndexFunc(products, func(p Product) bool { return p.ID == r.PathValue("productId") })
+	if i < 0 {
+		http.Error(w, "Product not found", http.StatusNotFound)
+		return
+	}
+
+	product := products[i]
+	needsNewLink := product.Name != req.Name || product.PriceCents != req.PriceCents ||
+		product.Currency != req.Currency || product.ImageURL != req.ImageURL ||
+		req.PaymentLink != "" || product.StripePaymentLinkID == ""
+	product.Name = req.Name
+	product.Description = req.Description
+	product.PriceCents = req.PriceCents
+	product.Currency = req.Currency
+	product.ImageURL = req.ImageURL
+	product.UpdatedAt = time.Now().UTC()
+	if needsNewLink {
+		if err := syncPaymentLink(siteName, &product, req.PaymentLink); err != nil {
+			slog.ErrorContext(r.Context(), "error creating payment link", "site", siteName, "error", err)
+			http.Error(w, "Failed to create payment link", http.StatusBadGateway)
+			return
+		}
+	}
+	products[i] = product
+	if err := writeProducts(siteName, products); err != nil {
+		slog.ErrorContext(r.Context(), "error writing products", "site", siteName, "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	recordSiteEvent(siteName, SiteEvent{Type: "product.updated", Message: product.ID})
+
+	if _, err := buildSite(siteName); err != nil {
+		slog.ErrorContext(r.Context(), "error building site", "site", siteName, "error", err)
+	}
+	respondJSON(w, product)
+}
+
+func deleteProductHandler(w http.ResponseWriter, r *http.Request) {
+	siteName, ok := siteNameFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	productsMu.Lock()
+	products, err := readProducts(siteName)
+	var removed *Product
+	if err == nil {
+		if i := slices.IndexFunc(products, func(p Product) bool { return p.ID == r.PathValue("productId") }); i >= 0 {
+			p := products[i]
+			removed = &p
+			err = writeProducts(siteName, slices.Delete(products, i, i+1))
+		}
+	}
+	productsMu.Unlock()
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error deleting product", "site", siteName, "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if removed == nil {
+		http.Error(w, "Product not found", http.StatusNotFound)
+		return
+	}
+	if removed.StripePaymentLinkID != "" {
+		if err := deactivateStripePaymentLink(removed.StripePaymentLinkID); err != nil {
+			slog.ErrorContext(r.Context(), "error deactivating payment link", "link", removed.StripePaymentLinkID, "site", siteName, "error", err)
+		}
+	}
+	recordSiteEvent(siteName, SiteEvent{Type: "product.deleted", Message: removed.ID})
+
+	if _, err := buildSite(siteName); err != nil {
+		slog.ErrorContext(r.Context(), "error building site", "site", siteName, "error", err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"html/template"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// Server-rendered signup: plain HTML forms for name validation and site
+// creation on /signup, served by the backend itself. They need neither
+// JavaScript nor CORS, so signing up keeps working when the frontend or its
+// CORS configuration is broken. Enabled with server.signup_form.
+
+const maxSignupFormSize = 64 << 10
+
+type signupPage struct {
+	Form                 siteCreationRequest
+	Themes               []themeInfo
+	Sections             []sectionInfo
+	VerificationRequired bool
+	// Result of the last action
+	NameOK  string
+	Error   string
+	Created *siteCreationResponse
+}
+
+func (p signupPage) Selected(id string) bool {
+	return slices.Contains(p.Form.InitialContent, id)
+}
+
+var signupTemplate = template.Must(template.New("signup").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Create your site - flox</title>
+<style>
+body { font-family: sans-serif; max-width: 36em; margin: 2em auto; padding: 0 1em; line-height: 1.4; }
+label { display: block; margin-top: 1em; font-weight: bold; }
+input[type=text], input[type=email], textarea, select { width: 100%; box-sizing: border-box; padding: .4em; }
+fieldset { margin-top: 1em; }
+fieldset label { font-weight: normal; margin-top: .3em; }
+.error { color: #b00020; }
+.ok { color: #1b5e20; }
+button { margin-top: 1.5em; padding: .5em 1em; }
+</style>
+</head>
+<body>
+<h1>Create your site</h1>
+{{with .Created}}
+<p class="ok">Your site was created.</p>
+<p><a href="{{.SiteURL}}">{{.SiteURL}}</a></p>
+{{if .VerificationRequired}}<p>We sent you an email. Please open the link in it to publish your site.</p>{{end}}
+{{if .DNSError}}<p class="error">{{.DNSError}}</p>{{end}}
+{{else}}
+{{if .Error}}<p class="error" role="alert">{{.Error}}</p>{{end}}
+<form method="post" action="/signup">
+<label for="siteName">Site name</label>
+<input type="text" id="siteName" name="siteName" value="{{.Form.SiteName}}" required maxlength="63" pattern="[a-zA-Z0-9]([a-zA-Z0-9\-]*[a-zA-Z0-9])?" autocomplete="off">
+{{if .NameOK}}<p class="ok">{{.NameOK}}</p>{{end}}
+<button type="submit" name="action" value="check" formnovalidate>Check availability</button>
+
+<label for="description">Description</label>
+<textarea id="description" name="description" rows="3">{{.Form.Description}}</textarea>
+
+<label for="style">Theme</label>
+<select id="style" name="style">
+{{range .Themes}}<option value="{{.ID}}"{{if eq .ID $.Form.Style}} selected{{end}}>{{.Name}}</option>
+{{end}}</select>
+
+<fieldset>
+<legend>Sections</legend>
+{{range .Sections}}<label><input type="checkbox" name="sections" value="{{.ID}}"{{if or .Mandatory ($.Selected .ID)}} checked{{end}}{{if .Mandatory}} disabled{{end}}> {{.Name}} <small>{{.Description}}</small></label>
+{{end}}</fieldset>
+
+<label for="email">Email{{if not .VerificationRequired}} (optional){{end}}</label>
+<input type="email" id="email" name="email" value="{{.Form.Email}}"{{if .VerificationRequired}} required{{end}}>
+
+<label for="code">Referral or coupon code (optional)</label>
+<input type="text" id="code" name="code" value="{{.Form.Code}}">
+
+<button type="submit" name="action" value="create">Create site</button>
+</form>
+{{end}}
+</body>
+</html>
+`))
+
+func renderSignup(w http.ResponseWriter, status int, page signupPage) {
+	page.Themes = currentThemes()
+	page.Sections = sections
+	page.VerificationRequired = config.Verification.Required
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if err := signupTemplate.Execute(w, page); err != nil {
+		slog.Error("error rendering signup form", "error", err)
+	}
+}
+
+func signupFormHandler(w http.ResponseWriter, r *http.Request) {
+	renderSignup(w, http.StatusOK, signupPage{Form: siteCreationRequest{Style: currentThemes()[0].ID}})
+}
+
+// signupSubmitHandler checks the name or creates the site, depending on the
+// button used, and renders the form again with the result.
+func signupSubmitHandler(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxSignupFormSize)
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Invalid form", http.StatusBadRequest)
+		return
+	}
+	req := siteCreationRequest{
+		SiteName:    strings.TrimSpace(r.PostForm.Get("siteName")),
+		Description: strings.TrimSpace(r.PostForm.Get("description")),
+		Style:       r.PostForm.Get("style"),
+		Code:        strings.TrimSpace(r.PostForm.Get("code")),
+		Email:       strings.TrimSpace(r.PostForm.Get("email")),
+	}
+	// Disabled checkboxes are not submitted, mandatory sections are added here.
+	for _, s := range sections {
+		if s.Mandatory || slices.Contains(r.PostForm["sections"], s.ID) {
+			req.InitialContent = append(req.InitialContent, s.ID)
+		}
+	}
+	page := signupPage{Form: req}
+
+	if r.PostForm.Get("action") == "check" {
+		if err := validateSiteNameFor(r, req.SiteName); err != nil {
+			page.Error = err.Error()
+		} else if exists, err := siteExists(req.SiteName); err != nil {
+			slog.ErrorContext(r.Context(), "error checking site existence", "error", err)
+			page.Error = "The name could not be checked, please try again."
+		} else if exists {
+			page.Error = "site name already exists"
+		} else if rule, ok := premiumRuleFor(req.SiteName); ok {
+			page.NameOK = req.SiteName + " is available as a premium name (" + rule.Tier + " tier"
+			if rule.Price != "" {
+				page.NameOK += ", " + rule.Price
+			}
+			page.NameOK += ")."
+		} else {
+			page.NameOK = req.SiteName + " is available."
+		}
+		renderSignup(w, http.StatusOK, page)
+		return
+	}
+
+	if _, ok := findTheme(req.Style); !ok {
+		page.Error = "please choose a theme"
+		renderSignup(w, http.StatusOK, page)
+		return
+	}
+	resp, status := createSite(r, req)
+	if status == http.StatusPaymentRequired || status == http.StatusForbidden {
+		page.Error = resp.Error
+		renderSignup(w, status, page)
+		return
+	}
+	if status != http.StatusOK {
+		page.Error = "Your site could not be created right now, please try again later."
+		renderSignup(w, status, page)
+		return
+	}
+	if !resp.Success {
+		page.Error = resp.Error
+		renderSignup(w, http.StatusOK, page)
+		return
+	}
+	page.Created = &resp
+	renderSignup(w, http.StatusOK, page)
+}
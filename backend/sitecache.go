@@ -0,0 +1,140 @@
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// The dashboard polls GET /api/v1/sites/{siteName} while a site is being
+// provisioned, so the encoded responses are kept in memory, up to
+// cache.site_details sites, least recently used first out. An entry is valid
+// for one revision of config.json (its modification time and size), so edits
+// by the CLI or by hand are picked up like those of the API; writes through
+// the API, builds and deletions also drop the entry right away.
+
+// siteRevision identifies a version of a site's config.json.
+type siteRevision struct {
+	modTime time.Time
+	size    int64
+}
+
+func statSiteRevision(siteName string) (siteRevision, error) {
+	info, err := os.Stat(filepath.Join(sitesBaseDir, siteName, siteConfigFile))
+	if err != nil {
+		return siteRevision{}, err
+	}
+	return siteRevision{modTime: info.ModTime(), size: info.Size()}, nil
+}
+
+type siteDetailEntry struct {
+	siteName string
+	revision siteRevision
+	body     []byte
+}
+
+// siteDetailCache is an LRU of encoded site details by site name.
+type siteDetailCache struct {
+	mu      sync.Mutex
+	size    int
+	order   *list.List // of *siteDetailEntry, most recently used first
+	entries map[string]*list.Element
+	// invalidations counts invalidate calls, so that a response encoded
+	// while an entry was dropped is not stored.
+	invalidations uint64
+}
+
+var siteDetails = &siteDetailCache{order: list.New(), entries: map[string]*list.Element{}}
+
+// get returns the cached body for revision, or on a miss the invalidation
+// count to pass to put.
+func (c *siteDetailCache) get(siteName string, revision siteRevision) ([]byte, uint64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[siteName]
+	if !ok {
+		return nil, c.invalidations, false
+	}
+	entry := e.Value.(*siteDetailEntry)
+	if entry.revision != revision {
+		return nil, c.invalidations, false
+	}
+	c.order.MoveToFront(e)
+	return entry.body, 0, true
+}
+
+func (c *siteDetailCache) put(siteName string, revision siteRevision, invalidations uint64, body []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.size <= 0 || c.invalidations != invalidations {
+		return
+	}
+	if e, ok := c.entries[siteName]; ok {
+		e.Value = &siteDetailEntry{siteName: siteName, revision: revision, body: body}
+		c.order.MoveToFront(e)
+		return
+	}
+	c.entries[siteName] = c.order.PushFront(&siteDetailEntry{siteName: siteName, revision: revision, body: body})
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*siteDetailEntry).siteName)
+	}
+}
+
+func (c *siteDetailCache) invalidate(siteName string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.invalidations++
+	if e, ok := c.entries[siteName]; ok {
+		c.order.Remove(e)
+		delete(c.entries, siteName)
+	}
+}
+
+// siteDetail is the response of GET /api/v1/sites/{siteName}: the public
+// config and the accessibility summary of the latest build, if any.
+type siteDetail struct {
+	SiteConfig
+	Accessibility *a11ySummary `json:"accessibility,omitempty"`
+}
+
+// siteDetailJSON returns the encoded detail of a site, from the cache if
+// config.json did not change and the site was not built since.
+func siteDetailJSON(siteName string) ([]byte, error) {
+	revision, err := statSiteRevision(siteName)
+	if err != nil {
+		return nil, err
+	}
+	body, invalidations, ok := siteDetails.get(siteName, revision)
+	if ok {
+		siteDetailCacheRequests.inc("hit")
+		return body, nil
+	}
+	siteDetailCacheRequests.inc("miss")
+	siteConfig, err := readSiteConfig(siteName)
+	if err != nil {
+		return nil, err
+	}
+	detail := siteDetail{SiteConfig: siteConfig.public()}
+	record, err := latestBuildRecord(siteName)
+	if err != nil {
+		return nil, err
+	}
+	if record != nil {
+		detail.Accessibility = summarizeAccessibility(record)
+	}
+	body, err = json.Marshal(detail)
+	if err != nil {
+		return nil, err
+	}
+	body = append(body, '\n')
+	// A write between the stat and the read is caught by the next stat,
+	// as the revision stored is the older one; a build in between drops
+	// the entry, which put notices.
+	siteDetails.put(siteName, revision, invalidations, body)
+	return body, nil
+}
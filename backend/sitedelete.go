@@ -0,0 +1,129 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// teardownStep is one part of deleting a site, reported to the caller so
+// leftovers (e.g. a DNS record) can be cleaned up by hand.
+type teardownStep struct {
+	Step  string `json:"step"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+type siteDeletionResponse struct {
+	SiteName string `json:"siteName"`
+	// Deleted is true once the site's data is gone; Complete additionally
+	// means nothing was left behind.
+	Deleted  bool           `json:"deleted"`
+	Complete bool           `json:"complete"`
+	Steps    []teardownStep `json:"steps"`
+	// ArchiveID is set when the data was archived (sites.archive_deleted)
+	// rather than removed, see archive.go.
+	ArchiveID string `json:"archiveId,omitempty"`
+}
+
+// removeSiteDir renames the site directory out of the way first, so a
+// partially removed directory never shows up as a site.
+func removeSiteDir(siteName string) error {
+	dir := filepath.Join(sitesBaseDir, siteName)
+	trash := filepath.Join(sitesBaseDir, fmt.Sprintf(".deleted-%s-%d", siteName, time.Now().UnixNano()))
+	if err := os.Rename(dir, trash); err != nil {
+		return err
+	}
+	return os.RemoveAll(trash)
+}
+
+// forgetSite drops the in-memory state kept per site.
+func forgetSite(siteName string) {
+	siteHeaderMu.Lock()
+	delete(siteHeaderCache, siteName)
+	siteHeaderMu.Unlock()
+	siteDetails.invalidate(siteName)
+	accessLogsMu.Lock()
+	delete(accessLogs, siteName)
+	accessLogsMu.Unlock()
+	invalidateCustomDomains()
+}
+
+// deleteSiteHandler deletes a site, see deleteSite. Sites managed in git
+// are deleted by removing their definition.
+func deleteSiteHandler(w http.ResponseWriter, r *http.Request) {
+	siteName, ok := siteNameFromPath(w, r)
+	if !ok {
+		return
+	}
+	if siteConfig, err := readSiteConfig(siteName); err == nil && siteConfig.GitOps != nil {
+		writeSiteManagedError(w, r, siteConfig)
+		return
+	}
+	resp := deleteSite(r.Context(), siteName)
+	if !resp.Deleted {
+		respondJSONStatus(w, http.StatusInternalServerError, resp)
+		return
+	}
+	respondJSON(w, resp)
+}
+
+// deleteSite tears a site down: DNS record, vhost, data (archived with
+// sites.archive_deleted) and the name allocation. External resources go
+// first, but a failure there does not stop the teardown: the data is still
+// deleted and the record or vhost left behind is reported as a failed step,
+// with Complete false. Only when the data cannot be deleted does the site
+// stay in place.
+func deleteSite(ctx context.Context, siteName string) siteDeletionResponse {
+	resp := siteDeletionResponse{SiteName: siteName}
+	step := func(name string, err error, message string) {
+		s := teardownStep{Step: name, OK: err == nil}
+		if err != nil {
+			slog.ErrorContext(ctx, "error deleting site data", "data", name, "site", siteName, "error", err)
+			s.Error = message
+		}
+		resp.Steps = append(resp.Steps, s)
+	}
+
+	// A site without a readable config still gets its A record removed.
+	siteConfig, _ := readSiteConfig(siteName)
+	var err error
+	for _, recordType := range siteRecordTypes(siteConfig) {
+		derr := deleteRecord(ctx, siteName, recordType)
+		if derr != nil && !errors.Is(derr, &DNSError{Kind: dnsErrNotFound}) && err == nil {
+			err = derr // a missing record is nothing to remove
+		}
+	}
+	_, dnsMessage := dnsErrorResponse(err)
+	step("dns", err, "The DNS record was left behind: "+dnsMessage)
+	step("vhost", removeVhost(siteName), "The web server configuration was left behind")
+
+	if config.Sites.ArchiveDeleted {
+		resp.ArchiveID, err = archiveSiteDir(siteName)
+	} else {
+		err = removeSiteDir(siteName)
+	}
+	if err != nil {
+		step("data", err, "The site data could not be deleted")
+		return resp
+	}
+	step("data", nil, "")
+	resp.Deleted = true
+	recordAudit(ctx, "site.delete", siteName, nil)
+	forgetSite(siteName)
+	releaseSiteName(siteName)
+
+	resp.Complete = true
+	for _, s := range resp.Steps {
+		resp.Complete = resp.Complete && s.OK
+	}
+	slog.InfoContext(ctx, "deleted site", "site", siteName, "complete", resp.Complete)
+	fireWebhooks(siteName, SiteEvent{Type: "site.deleted", Message: cmp.Or(resp.ArchiveID, "removed")})
+	return resp
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultSitesPageSize = 20
+	maxSitesPageSize     = 100
+)
+
+// public returns the config without stored credentials, for API responses.
+func (sc SiteConfig) public() SiteConfig {
+	if sc.Newsletter != nil {
+		nc := sc.Newsletter.public()
+		sc.Newsletter = &nc
+	}
+	feeds := make([]SocialFeed, len(sc.SocialFeeds))
+	for i, f := range sc.SocialFeeds {
+		feeds[i] = f.public()
+	}
+	sc.SocialFeeds = feeds
+	sc.OwnerEmail = ""
+	return sc
+}
+
+// siteSorts are the accepted ?sort= values; "-" sorts descending.
+var siteSorts = map[string]func(a, b SiteConfig) int{
+	"createdAt": func(a, b SiteConfig) int {
+		return cmp.Or(a.CreatedAt.Compare(b.CreatedAt), strings.Compare(a.SiteName, b.SiteName))
+	},
+	"siteName": func(a, b SiteConfig) int { return strings.Compare(a.SiteName, b.SiteName) },
+}
+
+type siteListResponse struct {
+	Sites []SiteConfig `json:"sites"`
+	Page  int          `json:"page"`
+	Limit int          `json:"limit"`
+	Total int          `json:"total"`
+}
+
+// positiveIntParam parses an optional positive query parameter.
+func positiveIntParam(r *http.Request, name string, fallback int) (int, bool) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return fallback, true
+	}
+	n, err := strconv.Atoi(v)
+	return n, err == nil && n > 0
+}
+
+// listSitesHandler returns the sites one page at a time, sorted by ?sort=
+// (createdAt, siteName, prefixed with "-" for descending; default newest
+// first).
+func listSitesHandler(w http.ResponseWriter, r *http.Request) {
+	if config.Auth.Required && !requireLogin(w, r) {
+		return
+	}
+	page, ok := positiveIntParam(r, "page", 1)
+	if !ok {
+		http.Error(w, "page must be a positive number", http.StatusBadRequest)
+		return
+	}
+	limit, ok := positiveIntParam(r, "limit", defaultSitesPageSize)
+	if !ok || limit > maxSitesPageSize {
+		http.Error(w, "limit must be between 1 and "+strconv.Itoa(maxSitesPageSize), http.StatusBadRequest)
+		return
+	}
+	sortParam := cmp.Or(r.URL.Query().Get("sort"), "-createdAt")
+	field, descending := strings.CutPrefix(sortParam, "-")
+	compare, ok := siteSorts[field]
+	if !ok {
+		http.Error(w, "sort must be createdAt or siteName, optionally prefixed with -", http.StatusBadRequest)
+		return
+	}
+
+	siteNames, err := listSiteNames()
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error listing sites", "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	sites := make([]SiteConfig, 0, len(siteNames))
+	for _, siteName := range siteNames {
+		sc, err := readSiteConfig(siteName)
+		if err != nil {
+			// A site being created or deleted has no readable config.
+			slog.ErrorContext(r.Context(), "error reading site config", "site", siteName, "error", err)
+			continue
+		}
+		// A user sees their own sites, anonymous requests those without
+		// owner and admins all sites.
+		if isAdmin(r) || sc.UserID == currentUserID(r) && canAccessSite(r, sc) {
+			sites = append(sites, sc)
+		}
+	}
+	slices.SortFunc(sites, func(a, b SiteConfig) int {
+		if descending {
+			return compare(b, a)
+		}
+		return compare(a, b)
+	})
+
+	resp := siteListResponse{Sites: []SiteConfig{}, Page: page, Limit: limit, Total: len(sites)}
+	start := min((page-1)*limit, len(sites))
+	for _, sc := range sites[start:min(start+limit, len(sites))] {
+		resp.Sites = append(resp.Sites, sc.public())
+	}
+	respondJSON(w, resp)
+}
+
+// getSiteHandler returns the stored configuration of one site, without its
+// credentials. The response is cached, see sitecache.go.
+func getSiteHandler(w http.ResponseWriter, r *http.Request) {
+	siteName, ok := siteNameFromPath(w, r)
+	if !ok {
+		return
+	}
+	body, err := siteDetailJSON(siteName)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error reading site config", "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+// siteUpdateRequest is a partial update; absent fields are left unchanged.
+type siteUpdateRequest struct {
+	Description    *string   `json:"description"`
+	Style          *string   `json:"style"`
+	InitialContent *[]string `json:"initialContent"`
+}
+
+const maxSiteDescriptionLength = 500
+
+// validateCreationFields checks the optional fields of a creation request
+// like a PATCH would, see also the schema in meta.go. The description is
+// trimmed.
+func validateCreationFields(req *siteCreationRequest) error {
+	req.Description = strings.TrimSpace(req.Description)
+	if len(req.Description) > maxSiteDescriptionLength {
+		return fmt.Errorf("description must be at most %d characters", maxSiteDescriptionLength)
+	}
+	if _, ok := findTheme(req.Style); req.Style != "" && !ok {
+		return fmt.Errorf("unknown style %q", req.Style)
+	}
+	if len(req.InitialContent) > 0 {
+		if err := validateSiteSections(SiteConfig{}, req.InitialContent); err != nil {
+			return err
+		}
+	}
+	theme, _ := findTheme(req.Style)
+	return theme.checkSections(req.InitialContent)
+}
+
+// validateSiteSections checks the enabled sections of a site: all known,
+// none twice, the mandatory ones included and none missing that a page
+// still shows.
+func validateSiteSections(siteConfig SiteConfig, ids []string) error {
+	seen := map[string]bool{}
+	for _, id := range ids {
+		if _, ok := findSection(id); !ok {
+			return fmt.Errorf("unknown section %q", id)
+		}
+		if seen[id] {
+			return fmt.Errorf("section %q is listed twice", id)
+		}
+		seen[id] = true
+	}
+	for _, s := range sections {
+		if s.Mandatory && !seen[s.ID] {
+			return fmt.Errorf("section %q is mandatory", s.ID)
+		}
+	}
+	for _, p := range siteConfig.Pages {
+		for _, id := range p.Sections {
+			if !seen[id] {
+				return fmt.Errorf("section %q is still used by page %q", id, p.Slug)
+			}
+		}
+	}
+	return nil
+}
+
+// patchSiteHandler updates description, style and sections of a site and
+// rebuilds it.
+func patchSiteHandler(w http.ResponseWriter, r *http.Request) {
+	siteName, ok := siteNameFromPath(w, r)
+	if !ok {
+		return
+	}
+	var req siteUpdateRequest
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON request", http.StatusBadRequest)
+		return
+	}
+	if req.Description == nil && req.Style == nil && req.InitialContent == nil {
+		http.Error(w, "Nothing to update: give description, style or initialContent", http.StatusBadRequest)
+		return
+	}
+	siteConfig, err := readSiteConfig(siteName)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error reading site config", "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if siteConfig.GitOps != nil {
+		writeSiteManagedError(w, r, siteConfig)
+		return
+	}
+
+	changed, err := applySiteUpdate(&siteConfig, req)
+	if err != nil {
+		if !writeEntitlementError(w, r, err) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+		return
+	}
+	siteConfig, err = saveSiteUpdate(r.Context(), siteName, siteConfig, changed, req)
+	if err != nil {
+		writeSiteUpdateError(w, r, siteName, err)
+		return
+	}
+	respondJSON(w, siteConfig.public())
+}
+
+// applySiteUpdate validates an update and applies it to siteConfig. It
+// returns the names of the changed fields; errors are the request's fault,
+// entitlement errors among them.
+func applySiteUpdate(siteConfig *SiteConfig, req siteUpdateRequest) ([]string, error) {
+	var changed []string
+	if req.Description != nil {
+		description := strings.TrimSpace(*req.Description)
+		if len(description) > maxSiteDescriptionLength {
+			return nil, fmt.Errorf("description must be at most %d characters", maxSiteDescriptionLength)
+		}
+		if description != siteConfig.Description {
+			siteConfig.Description = description
+			changed = append(changed, "description")
+		}
+	}
+	if req.Style != nil {
+		if _, ok := findTheme(*req.Style); !ok {
+			return nil, fmt.Errorf("unknown style %q", *req.Style)
+		}
+		if *req.Style != siteConfig.Style {
+			siteConfig.Style = *req.Style
+			changed = append(changed, "style")
+		}
+	}
+	if req.InitialContent != nil {
+		if err := validateSiteSections(*siteConfig, *req.InitialContent); err != nil {
+			return nil, err
+		}
+		if err := checkSectionEntitlements(*siteConfig, *req.InitialContent); err != nil {
+			return nil, err
+		}
+		if !slices.Equal(*req.InitialContent, siteConfig.InitialContent) {
+			siteConfig.InitialContent = *req.InitialContent
+			changed = append(changed, "sections")
+		}
+	}
+	if req.Style != nil || req.InitialContent != nil {
+		theme, _ := findTheme(siteConfig.Style)
+		if err := theme.checkSections(siteConfig.InitialContent); err != nil {
+			return nil, err
+		}
+	}
+	return changed, nil
+}
+
+// saveSiteUpdate applies an update checked by applySiteUpdate on
+// siteConfig to the stored site and rebuilds it, if anything changed. It
+// returns the updated site.
+func saveSiteUpdate(ctx context.Context, siteName string, siteConfig SiteConfig, changed []string, req siteUpdateRequest) (SiteConfig, error) {
+	if len(changed) == 0 {
+		return siteConfig, nil
+	}
+	siteConfig, err := updateSiteConfig(siteName, func(siteConfig *SiteConfig) error {
+		// Again, the site may have changed since.
+		if _, err := applySiteUpdate(siteConfig, req); err != nil {
+			var e entitlementError
+			if errors.As(err, &e) {
+				return err
+			}
+			return &httpError{http.StatusConflict, err.Error()}
+		}
+		return nil
+	})
+	if err != nil {
+		return siteConfig, err
+	}
+	recordSiteEvent(siteName, SiteEvent{Type: "site.updated", Message: strings.Join(changed, ", ")})
+	recordAudit(ctx, "site.update", siteName, req)
+	if _, err := buildSite(siteName); err != nil {
+		slog.ErrorContext(ctx, "error building site", "site", siteName, "error", err)
+	}
+	return siteConfig, nil
+}
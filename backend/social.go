@@ -0,0 +1,519 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/html"
+)
+
+const (
+	siteSocialDir = "social" // cached feed posts, one file per feed
+	// Tokens are refreshed when they expire within this window.
+	socialTokenRefreshWindow = 7 * 24 * time.Hour
+	socialDefaultLimit       = 6
+	socialMaxLimit           = 20
+	// Meta's Graph API timestamps, e.g. 2024-05-01T10:00:00+0000
+	graphTimeLayout = "2006-01-02T15:04:05-0700"
+)
+
+var socialProviders = []string{"instagram", "facebook", "mastodon"}
+
+// SocialFeed pulls recent posts of an account into the social section. All
+// API calls happen server-side, the access token never reaches the site.
+type SocialFeed struct {
+	ID       string `json:"id"`
+	Provider string `json:"provider"` // instagram, facebook or mastodon
+	// Facebook page ID or Mastodon handle (user@instance). Instagram uses the
+	// account the token belongs to.
+	Account        string     `json:"account,omitempty"`
+	Limit          int        `json:"limit,omitempty"`
+	EncryptedToken string     `json:"encryptedToken,omitempty"`
+	TokenExpiresAt *time.Time `json:"tokenExpiresAt,omitempty"`
+}
+
+type socialFeedRequest struct {
+	SocialFeed
+	// Access token; optional for public Mastodon accounts. Omit to keep the
+	// stored token.
+	AccessToken string `json:"accessToken,omitempty"`
+}
+
+type SocialPost struct {
+	ID          string    `json:"id"`
+	Text        string    `json:"text,omitempty"`
+	URL         string    `json:"url"`
+	ImageURL    string    `json:"imageUrl,omitempty"`
+	PublishedAt time.Time `json:"publishedAt"`
+}
+
+type socialFeedCache struct {
+	FetchedAt time.Time    `json:"fetchedAt"`
+	Posts     []SocialPost `json:"posts"`
+}
+
+// socialMu serializes fetches and token refreshes, which rewrite the cache
+// files and the site config.
+var socialMu sync.Mutex
+
+func (f *SocialFeed) validate() error {
+	if !formIDRegex.MatchString(f.ID) {
+		return errors.New("feed id must be lowercase letters, digits, - or _")
+	}
+	if !slices.Contains(socialProviders, f.Provider) {
+		return fmt.Errorf("provider must be one of %s", strings.Join(socialProviders, ", "))
+	}
+	switch f.Provider {
+	case "facebook":
+		if f.Account == "" {
+			return errors.New("account (page ID) is required for facebook")
+		}
+	case "mastodon":
+		user, instance, ok := strings.Cut(strings.TrimPrefix(f.Account, "@"), "@")
+		if !ok || user == "" || instance == "" {
+			return errors.New("account must be a mastodon handle like user@instance")
+		}
+		// The instance is a bare hostname on a public address.
+		if u, err := url.Parse("https://" + instance); err != nil || u.Host != instance || u.Port() != "" {
+			return errors.New("account must be a mastodon handle like user@instance")
+		}
+		if err := validateOwnerURL("https://"+instance+"/", "the mastodon instance"); err != nil {
+			return err
+		}
+	}
+	if f.Limit == 0 {
+		f.Limit = socialDefaultLimit
+	}
+	if f.Limit < 1 || f.Limit > socialMaxLimit {
+		return fmt.Errorf("limit must be between 1 and %d", socialMaxLimit)
+	}
+	return nil
+}
+
+func (sc SiteConfig) findSocialFeed(id string) (*SocialFeed, int) {
+	for i := range sc.SocialFeeds {
+		if sc.SocialFeeds[i].ID == id {
+			return &sc.SocialFeeds[i], i
+		}
+	}
+	return nil, -1
+}
+
+// public returns the feed without the encrypted token.
+func (f SocialFeed) public() SocialFeed {
+	f.EncryptedToken = ""
+	return f
+}
+
+func socialCachePath(siteName, feedID string) string {
+	return filepath.Join(sitesBaseDir, siteName, siteSocialDir, feedID+".json")
+}
+
+func readSocialCache(siteName, feedID string) (*socialFeedCache, error) {
+	data, err := os.ReadFile(socialCachePath(siteName, feedID))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var cache socialFeedCache
+	return &cache, json.Unmarshal(data, &cache)
+}
+
+func writeSocialCache(siteName, feedID string, cache socialFeedCache) error {
+	path := socialCachePath(siteName, feedID)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return writeJSONAtomic(path, cache, 0644)
+}
+
+// socialFeedPosts returns the cached posts of a feed, fetching them first if
+// the cache is older than social.cache_ttl. If the provider is unreachable the
+// stale posts are kept. changed reports whether a fetch returned new posts.
+func socialFeedPosts(siteName string, feed SocialFeed, now time.Time) (posts []SocialPost, changed bool, err error) {
+	socialMu.Lock()
+	defer socialMu.Unlock()
+
+	cache, err := readSocialCache(siteName, feed.ID)
+	if err != nil {
+		return nil, false, err
+	}
+	if cache != nil && now.Sub(cache.FetchedAt) < config.Social.CacheTTL {
+		return cache.Posts, false, nil
+	}
+
+	fetched, err := fetchSocialPosts(siteName, feed, now)
+	if err != nil {
+		if cache == nil {
+			return []SocialPost{}, false, err
+		}
+		slog.Error("error fetching feed, keeping cached posts", "provider", feed.Provider, "feed", feed.ID, "site", siteName, "error", err)
+		return cache.Posts, false, nil
+	}
+	if cache != nil {
+		changed = !slices.EqualFunc(cache.Posts, fetched, func(a, b SocialPost) bool { return a == b })
+	} else {
+		changed = true
+	}
+	if err := writeSocialCache(siteName, feed.ID, socialFeedCache{FetchedAt: now, Posts: fetched}); err != nil {
+		return nil, false, err
+	}
+	return fetched, changed, nil
+}
+
+func fetchSocialPosts(siteName string, feed SocialFeed, now time.Time) ([]SocialPost, error) {
+	token := ""
+	if feed.EncryptedToken != "" {
+		var err error
+		if token, err = decryptSecret(feed.EncryptedToken); err != nil {
+			return nil, err
+		}
+		if feed.TokenExpiresAt != nil && feed.TokenExpiresAt.Sub(now) < socialTokenRefreshWindow {
+			if token, err = refreshSocialToken(siteName, feed, token, now); err != nil {
+				return nil, fmt.Errorf("token refresh failed: %v", err)
+			}
+		}
+	}
+
+	var posts []SocialPost
+	var err error
+	switch feed.Provider {
+	case "instagram":
+		posts, err = fetchInstagramPosts(token, feed.Limit)
+	case "facebook":
+		posts, err = fetchFacebookPosts(feed.Account, token, feed.Limit)
+	case "mastodon":
+		posts, err = fetchMastodonPosts(feed.Account, token, feed.Limit)
+	default:
+		err = fmt.Errorf("unknown social provider %q", feed.Provider)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return posts[:min(len(posts), feed.Limit)], nil
+}
+
+// refreshSocialToken exchanges a long-lived token that is about to expire for
+// a new one and stores it in the site config.
+func refreshSocialToken(siteName string, feed SocialFeed, token string, now time.Time) (string, error) {
+	var refreshed struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	switch feed.Provider {
+	case "instagram":
+		q := url.Values{"grant_type": {"ig_refresh_token"}, "access_token": {token}}
+		if err := socialGetJSON("https://graph.instagram.com/refresh_access_token?"+q.Encode(), "", &refreshed); err != nil {
+			return "", err
+		}
+	case "facebook":
+		if config.Social.FacebookAppID == "" || config.Social.FacebookAppSecret == "" {
+			return token, nil // cannot refresh without app credentials, keep using it
+		}
+		q := url.Values{
+			"grant_type":        {"fb_exchange_token"},
+			"client_id":         {config.Social.FacebookAppID},
+			"client_secret":     {config.Social.FacebookAppSecret},
+			"fb_exchange_token": {token},
+		}
+		if err := socialGetJSON("https://graph.facebook.com/v19.0/oauth/access_token?"+q.Encode(), "", &refreshed); err != nil {
+			return "", err
+		}
+	default:
+		return token, nil
+	}
+	if refreshed.AccessToken == "" {
+		return "", errors.New("no access token in refresh response")
+	}
+
+	encrypted, err := encryptSecret(refreshed.AccessToken)
+	if err != nil {
+		return "", err
+	}
+	if _, err := updateSiteConfig(siteName, func(siteConfig *SiteConfig) error {
+		stored, _ := siteConfig.findSocialFeed(feed.ID)
+		if stored == nil {
+			return errors.New("feed was removed")
+		}
+		stored.EncryptedToken = encrypted
+		stored.TokenExpiresAt = nil
+		if refreshed.ExpiresIn > 0 {
+			expires := now.Add(time.Duration(refreshed.ExpiresIn) * time.Second)
+			stored.TokenExpiresAt = &expires
+		}
+		return nil
+	}); err != nil {
+		return "", err
+	}
+	recordSiteEvent(siteName, SiteEvent{Type: "social.token_refreshed", Message: feed.ID})
+	return refreshed.AccessToken, nil
+}
+
+func socialGetJSON(rawURL, bearer string, out any) error {
+	req, err := http.NewRequest(http.MethodGet, rawURL, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %v", err)
+	}
+	req.Header.Set("Accept", "application/json")
+	if bearer != "" {
+		req.Header.Set("Authorization", "Bearer "+bearer)
+	}
+	// Mastodon instances are chosen by the site owner.
+	resp, err := ownerURLClient.Do(req)
+	if err != nil {
+		// The error contains the URL and with it the access token.
+		return fmt.Errorf("HTTP request to %s failed", req.URL.Host)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code from %s: %d", req.URL.Host, resp.StatusCode)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(out)
+}
+
+func fetchInstagramPosts(token string, limit int) ([]SocialPost, error) {
+	var result struct {
+		Data []struct {
+			ID           string `json:"id"`
+			Caption      string `json:"caption"`
+			MediaType    string `json:"media_type"`
+			MediaURL     string `json:"media_url"`
+			ThumbnailURL string `json:"thumbnail_url"`
+			Permalink    string `json:"permalink"`
+			Timestamp    string `json:"timestamp"`
+		} `json:"data"`
+	}
+	q := url.Values{
+		"fields":       {"id,caption,media_type,media_url,thumbnail_url,permalink,timestamp"},
+		"limit":        {strconv.Itoa(limit)},
+		"access_token": {token},
+	}
+	if err := socialGetJSON("https://graph.instagram.com/me/media?"+q.Encode(), "", &result); err != nil {
+		return nil, err
+	}
+	posts := []SocialPost{}
+	for _, m := range result.Data {
+		image := m.MediaURL
+		if m.MediaType == "VIDEO" {
+			image = m.ThumbnailURL
+		}
+		published, _ := time.Parse(graphTimeLayout, m.Timestamp)
+		posts = append(posts, SocialPost{ID: m.ID, Text: m.Caption, URL: m.Permalink, ImageURL: image, PublishedAt: published})
+	}
+	return posts, nil
+}
+
+func fetchFacebookPosts(pageID, token string, limit int) ([]SocialPost, error) {
+	var result struct {
+		Data []struct {
+			ID          string `json:"id"`
+			Message     string `json:"message"`
+			Permalink   string `json:"permalink_url"`
+			FullPicture string `json:"full_picture"`
+			CreatedTime string `json:"created_time"`
+		} `json:"data"`
+	}
+	q := url.Values{
+		"fields":       {"id,message,permalink_url,full_picture,created_time"},
+		"limit":        {strconv.Itoa(limit)},
+		"access_token": {token},
+	}
+	if err := socialGetJSON("https://graph.facebook.com/v19.0/"+url.PathEscape(pageID)+"/posts?"+q.Encode(), "", &result); err != nil {
+		return nil, err
+	}
+	posts := []SocialPost{}
+	for _, p := range result.Data {
+		published, _ := time.Parse(graphTimeLayout, p.CreatedTime)
+		posts = append(posts, SocialPost{ID: p.ID, Text: p.Message, URL: p.Permalink, ImageURL: p.FullPicture, PublishedAt: published})
+	}
+	return posts, nil
+}
+
+func fetchMastodonPosts(handle, token string, limit int) ([]SocialPost, error) {
+	user, instance, _ := strings.Cut(strings.TrimPrefix(handle, "@"), "@")
+	base := "https://" + instance + "/api/v1"
+
+	var account struct {
+		ID string `json:"id"`
+	}
+	if err := socialGetJSON(base+"/accounts/lookup?acct="+url.QueryEscape(user), token, &account); err != nil {
+		return nil, err
+	}
+	var statuses []struct {
+		ID               string    `json:"id"`
+		URL              string    `json:"url"`
+		Content          string    `json:"content"` // HTML
+		CreatedAt        time.Time `json:"created_at"`
+		MediaAttachments []struct {
+			Type       string `json:"type"`
+			PreviewURL string `json:"preview_url"`
+		} `json:"media_attachments"`
+	}
+	q := url.Values{"limit": {strconv.Itoa(limit)}, "exclude_replies": {"true"}, "exclude_reblogs": {"true"}}
+	if err := socialGetJSON(base+"/accounts/"+url.PathEscape(account.ID)+"/statuses?"+q.Encode(), token, &statuses); err != nil {
+		return nil, err
+	}
+	posts := []SocialPost{}
+	for _, s := range statuses {
+		post := SocialPost{ID: s.ID, Text: htmlToText(s.Content), URL: s.URL, PublishedAt: s.CreatedAt}
+		if len(s.MediaAttachments) > 0 && s.MediaAttachments[0].Type == "image" {
+			post.ImageURL = s.MediaAttachments[0].PreviewURL
+		}
+		posts = append(posts, post)
+	}
+	return posts, nil
+}
+
+func htmlToText(fragment string) string {
+	doc, err := html.Parse(strings.NewReader(fragment))
+	if err != nil {
+		return ""
+	}
+	return strings.Join(strings.Fields(textContent(doc)), " ")
+}
+
+// refreshSocialFeeds updates the caches of all feeds of a site and reports
+// whether any of them changed, so the scheduler can rebuild the site.
+func refreshSocialFeeds(siteName string, siteConfig SiteConfig, now time.Time) bool {
+	changed := false
+	for _, feed := range siteConfig.SocialFeeds {
+		_, feedChanged, err := socialFeedPosts(siteName, feed, now)
+		if err != nil {
+			slog.Error("error refreshing feed", "provider", feed.Provider, "feed", feed.ID, "site", siteName, "error", err)
+		}
+		changed = changed || feedChanged
+	}
+	return changed
+}
+
+// --- Handlers ---
+
+func putSocialFeedHandler(w http.ResponseWriter, r *http.Request) {
+	siteName, ok := siteNameFromPath(w, r)
+	if !ok {
+		return
+	}
+	var req socialFeedRequest
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON request", http.StatusBadRequest)
+		return
+	}
+	feed := req.SocialFeed
+	feed.ID = r.PathValue("feedId")
+	if err := feed.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if req.AccessToken != "" {
+		token, err := encryptSecret(req.AccessToken)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "error encrypting social token", "site", siteName, "error", err)
+			http.Error(w, "Credentials cannot be stored on this server", http.StatusInternalServerError)
+			return
+		}
+		feed.EncryptedToken = token
+	}
+	if _, err := updateSiteConfig(siteName, func(siteConfig *SiteConfig) error {
+		existing, i := siteConfig.findSocialFeed(feed.ID)
+		switch {
+		case req.AccessToken != "":
+		case existing != nil && existing.Provider == feed.Provider:
+			feed.EncryptedToken = existing.EncryptedToken
+			if feed.TokenExpiresAt == nil {
+				feed.TokenExpiresAt = existing.TokenExpiresAt
+			}
+		case feed.Provider != "mastodon":
+			return &httpError{http.StatusBadRequest, "accessToken is required"}
+		}
+		if i >= 0 {
+			siteConfig.SocialFeeds[i] = feed
+		} else {
+			siteConfig.SocialFeeds = append(siteConfig.SocialFeeds, feed)
+		}
+		return nil
+	}); err != nil {
+		writeSiteUpdateError(w, r, siteName, err)
+		return
+	}
+	// Drop the cache so the next build fetches with the new settings.
+	if err := os.Remove(socialCachePath(siteName, feed.ID)); err != nil && !os.IsNotExist(err) {
+		slog.ErrorContext(r.Context(), "error removing social cache", "site", siteName, "error", err)
+	}
+	recordSiteEvent(siteName, SiteEvent{Type: "social.feed_updated", Message: feed.ID})
+
+	if _, err := buildSite(siteName); err != nil {
+		slog.ErrorContext(r.Context(), "error building site", "site", siteName, "error", err)
+	}
+	respondJSON(w, feed.public())
+}
+
+func deleteSocialFeedHandler(w http.ResponseWriter, r *http.Request) {
+	siteName, ok := siteNameFromPath(w, r)
+	if !ok {
+		return
+	}
+	feedID := r.PathValue("feedId")
+	if _, err := updateSiteConfig(siteName, func(siteConfig *SiteConfig) error {
+		_, i := siteConfig.findSocialFeed(feedID)
+		if i < 0 {
+			return &httpError{http.StatusNotFound, "Feed not found"}
+		}
+		siteConfig.SocialFeeds = slices.Delete(siteConfig.SocialFeeds, i, i+1)
+		return nil
+	}); err != nil {
+		writeSiteUpdateError(w, r, siteName, err)
+		return
+	}
+	if err := os.Remove(socialCachePath(siteName, feedID)); err != nil && !os.IsNotExist(err) {
+		slog.ErrorContext(r.Context(), "error removing social cache", "site", siteName, "error", err)
+	}
+	recordSiteEvent(siteName, SiteEvent{Type: "social.feed_deleted", Message: feedID})
+
+	if _, err := buildSite(siteName); err != nil {
+		slog.ErrorContext(r.Context(), "error building site", "site", siteName, "error", err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// getSocialPostsHandler serves the cached posts of a feed to widgets.
+func getSocialPostsHandler(w http.ResponseWriter, r *http.Request) {
+	siteName, ok := siteNameFromPath(w, r)
+	if !ok {
+		return
+	}
+	siteConfig, err := readSiteConfig(siteName)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error reading site config", "site", siteName, "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	feed, _ := siteConfig.findSocialFeed(r.PathValue("feedId"))
+	if feed == nil {
+		http.Error(w, "Feed not found", http.StatusNotFound)
+		return
+	}
+	posts, _, err := socialFeedPosts(siteName, *feed, time.Now().UTC())
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error fetching feed", "provider", feed.Provider, "feed", feed.ID, "site", siteName, "error", err)
+		http.Error(w, "Feed is currently unavailable", http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(config.Social.CacheTTL.Seconds())))
+	respondJSON(w, posts)
+}
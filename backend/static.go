@@ -0,0 +1,187 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+// staticServer serves the build directories of many sites from one listener,
+// picking the site by Host header. It is used by the self-hosted mode and by
+// the standalone "serve-sites" command.
+type staticServer struct {
+	// resolve maps a request host to the site and its web root.
+	resolve func(host string) (siteName, root string, ok bool)
+	// headers returns additional response headers for a site; optional.
+	headers func(siteName string) []CustomHeader
+	// suspended reports whether a site is taken offline; optional.
+	suspended func(siteName string) bool
+	// assetMaxAge is the browser cache lifetime of everything but HTML,
+	// which is always revalidated so publishing takes effect immediately.
+	assetMaxAge time.Duration
+}
+
+const notFoundPage = "404.html"
+
+func (s *staticServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	siteName, rootDir, ok := s.resolve(r.Host)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if s.headers != nil {
+		for _, h := range s.headers(siteName) {
+			w.Header().Set(h.Name, h.Value)
+		}
+	}
+	if s.suspended != nil && s.suspended(siteName) {
+		http.Error(w, suspendedSiteMessage, http.StatusUnavailableForLegalReasons)
+		return
+	}
+
+	// os.Root keeps symlinks in the build directory from escaping it.
+	root, err := os.OpenRoot(rootDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			http.NotFound(w, r) // not built yet
+			return
+		}
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	defer root.Close()
+
+	name, redirect, err := resolveStaticPath(root, r.URL.Path)
+	switch {
+	case redirect != "":
+		if r.URL.RawQuery != "" {
+			redirect += "?" + r.URL.RawQuery
+		}
+		http.Redirect(w, r, redirect, http.StatusMovedPermanently)
+	case errors.Is(err, fs.ErrNotExist):
+		s.serveNotFound(w, r, root)
+	case err != nil:
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	default:
+		s.serveFile(w, r, root, name)
+	}
+}
+
+// resolveStaticPath finds the file for a URL path: the file itself, the
+// index.html of a directory, or "<path>.html". Directories requested without
+// a trailing slash are redirected so relative links keep working.
+func resolveStaticPath(root *os.Root, urlPath string) (name, redirect string, err error) {
+	clean := path.Clean("/" + urlPath)
+	for _, segment := range strings.Split(clean, "/") {
+		if strings.HasPrefix(segment, ".") {
+			return "", "", fs.ErrNotExist // dotfiles are never served
+		}
+	}
+	name = strings.TrimPrefix(clean, "/")
+	if name == "" {
+		name = "."
+	}
+
+	info, err := root.Stat(name)
+	if err == nil && !info.IsDir() {
+		return name, "", nil
+	}
+	if err == nil {
+		index := path.Join(name, "index.html")
+		if _, err := root.Stat(index); err != nil {
+			return "", "", err
+		}
+		if !strings.HasSuffix(urlPath, "/") {
+			return "", path.Base(clean) + "/", nil
+		}
+		return index, "", nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return "", "", err
+	}
+	if html := name + ".html"; !strings.HasSuffix(name, ".html") {
+		if info, err := root.Stat(html); err == nil && !info.IsDir() {
+			return html, "", nil
+		}
+	}
+	return "", "", fs.ErrNotExist
+}
+
+// serveFile serves name with validators and cache headers. Range and
+// conditional requests are handled by http.ServeContent.
+func (s *staticServer) serveFile(w http.ResponseWriter, r *http.Request, root *os.Root, name string) {
+	f, err := root.Open(name)
+	if err != nil {
+		s.serveNotFound(w, r, root)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("ETag", fmt.Sprintf(`"%x-%x"`, info.ModTime().UnixNano(), info.Size()))
+	w.Header().Set("Cache-Control", s.cacheControl(name))
+	http.ServeContent(w, r, name, info.ModTime(), f)
+}
+
+func (s *staticServer) cacheControl(name string) string {
+	if strings.HasSuffix(name, ".html") || s.assetMaxAge <= 0 {
+		return "no-cache"
+	}
+	return fmt.Sprintf("public, max-age=%d", int(s.assetMaxAge.Seconds()))
+}
+
+// serveNotFound answers with the site's own 404.html if it has one.
+func (s *staticServer) serveNotFound(w http.ResponseWriter, r *http.Request, root *os.Root) {
+	f, err := root.Open(notFoundPage)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusNotFound)
+	if r.Method != http.MethodHead {
+		io.Copy(w, f)
+	}
+}
+
+// --- Standalone command ---
+
+var serveSitesCommand = command{
+	usage: "serve-sites [--http ADDR] [--https ADDR]",
+	flags: func(fs *pflag.FlagSet) {
+		fs.StringVar(&serveSitesOptions.http, "http", "", "Plain HTTP address (default hosting.http_address)")
+		fs.StringVar(&serveSitesOptions.https, "https", "", "HTTPS address (default hosting.https_address)")
+	},
+	run: func(args []string) error {
+		if serveSitesOptions.http != "" {
+			config.Hosting.HTTPAddress = serveSitesOptions.http
+		}
+		if serveSitesOptions.https != "" {
+			config.Hosting.HTTPSAddress = serveSitesOptions.https
+		}
+		return serveSites()
+	},
+}
+
+var serveSitesOptions struct {
+	http  string
+	https string
+}
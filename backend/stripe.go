@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const stripeAPIBase = "https://api.stripe.com/v1"
+
+type stripeError struct {
+	Error struct {
+		Message string `json:"message"`
+		Type    string `json:"type"`
+	} `json:"error"`
+}
+
+// stripeRequest calls the Stripe API with form-encoded parameters and decodes
+// the JSON response into out.
+func stripeRequest(method, path string, params url.Values, out any) error {
+	if config.Payments.StripeSecretKey == "" {
+		return fmt.Errorf("Stripe is not configured")
+	}
+	req, err := http.NewRequest(method, stripeAPIBase+path, strings.NewReader(params.Encode()))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+config.Payments.StripeSecretKey)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	client := http.Client{Timeout: 15 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("Stripe request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return fmt.Errorf("Stripe request failed: %v", err)
+	}
+	if resp.StatusCode >= 300 {
+		var se stripeError
+		if json.Unmarshal(body, &se) == nil && se.Error.Message != "" {
+			return fmt.Errorf("Stripe error (%d): %s", resp.StatusCode, se.Error.Message)
+		}
+		return fmt.Errorf("Stripe error: unexpected status code: %d", resp.StatusCode)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(body, out)
+}
+
+// createStripePaymentLink creates a Stripe product, a one-time price and a
+// payment link for it. Prices are immutable in Stripe, so a changed price
+// needs a new link.
+func createStripePaymentLink(siteName string, p Product) (linkID, linkURL string, err error) {
+	var product struct {
+		ID string `json:"id"`
+	}
+	params := url.Values{
+		"name":              {p.Name},
+		"metadata[site]":    {siteName},
+		"metadata[flox_id]": {p.ID},
+	}
+	if p.ImageURL != "" {
+		params.Set("images[0]", p.ImageURL)
+	}
+	if err := stripeRequest(http.MethodPost, "/products", params, &product); err != nil {
+		return "", "", err
+	}
+
+	var price struct {
+		ID string `json:"id"`
+	}
+	err = stripeRequest(http.MethodPost, "/prices", url.Values{
+		"product":     {product.ID},
+		"unit_amount": {strconv.FormatInt(p.PriceCents, 10)},
+		"currency":    {strings.ToLower(p.Currency)},
+	}, &price)
+	if err != nil {
+		return "", "", err
+	}
+
+	var link struct {
+		ID  string `json:"id"`
+		URL string `json:"url"`
+	}
+	err = stripeRequest(http.MethodPost, "/payment_links", url.Values{
+		"line_items[0][price]":    {price.ID},
+		"line_items[0][quantity]": {"1"},
+		"metadata[site]":          {siteName},
+	}, &link)
+	if err != nil {
+		return "", "", err
+	}
+	return link.ID, link.URL, nil
+}
+
+func deactivateStripePaymentLink(linkID string) error {
+	return stripeRequest(http.MethodPost, "/payment_links/"+url.PathEscape(linkID), url.Values{"active": {"false"}}, nil)
+}
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Terraform: the endpoints under /api/v1/terraform back the flox Terraform
+// provider, which manages sites, their DNS delegation and their custom
+// domains as resources. They wrap the regular endpoints with the semantics
+// a provider needs:
+//
+//   - IDs are stable and derived from names: a site's is its name, that of
+//     its DNS delegation too, a domain's is "siteName/domain". terraform
+//     import takes the same IDs.
+//   - PUT declares the state of a resource and creates it if it is missing;
+//     repeating it changes nothing. Fields left out are not managed.
+//     Creating a site with If-None-Match: * fails with 412 SITE_EXISTS when
+//     it exists, so a resource never takes over a site by accident.
+//   - Every response carries the resource as stored, and creation is
+//     synchronous (no Prefer: respond-async), so a read right after a write
+//     returns what was written.
+//   - DELETE of a resource that is already gone succeeds; GET of a missing
+//     one answers 404, which drops it from the state.
+//
+// Errors are the APIErrors of the regular endpoints.
+
+// terraformSite is the site resource.
+type terraformSite struct {
+	ID          string    `json:"id"`
+	SiteName    string    `json:"siteName"`
+	Description string    `json:"description"`
+	Style       string    `json:"style"`
+	Sections    []string  `json:"sections"`
+	URL         string    `json:"url"`
+	Plan        string    `json:"plan,omitempty"`
+	Verified    bool      `json:"verified"`   // false while the owner has not confirmed the email
+	DNSPending  bool      `json:"dnsPending"` // the DNS record is queued
+	GitOpsFile  string    `json:"gitopsFile,omitempty"`
+	CreatedAt   time.Time `json:"createdAt"`
+	// Warnings of the creation, e.g. the DNS record could not be created
+	// yet.
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+func newTerraformSite(siteName string, sc SiteConfig) terraformSite {
+	plan, _ := sitePlan(sc)
+	site := terraformSite{
+		ID:          siteName,
+		SiteName:    siteName,
+		Description: sc.Description,
+		Style:       sc.Style,
+		Sections:    sc.InitialContent,
+		URL:         siteURL(siteName),
+		Plan:        plan,
+		Verified:    !sc.Unverified,
+		DNSPending:  sc.DNSPending,
+		CreatedAt:   sc.CreatedAt,
+	}
+	if site.Sections == nil {
+		site.Sections = []string{}
+	}
+	if sc.GitOps != nil {
+		site.GitOpsFile = sc.GitOps.File
+	}
+	return site
+}
+
+// terraformSiteRequest is the declared state of a site.
+type terraformSiteRequest struct {
+	Description *string   `json:"description"`
+	Style       *string   `json:"style"`
+	Sections    *[]string `json:"sections"`
+	Email       string    `json:"email"` // of the owner, only used on creation
+}
+
+type terraformDNSRequest struct {
+	Nameservers []string `json:"nameservers"` // none for no delegation
+	Force       bool     `json:"force"`       // skip the nameserver check
+}
+
+// terraformSiteExists is siteExists for the paths of the Terraform
+// endpoints, answering the request if it fails.
+func terraformSiteExists(w http.ResponseWriter, r *http.Request) (string, bool, bool) {
+	siteName := r.PathValue("siteName")
+	if !siteNameRegex.MatchString(siteName) {
+		http.Error(w, "Invalid site name", http.StatusBadRequest)
+		return "", false, false
+	}
+	exists, err := siteExists(siteName)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error checking site existence", "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return "", false, false
+	}
+	return siteName, exists, true
+}
+
+// forwardJSON serves r with h, with body instead of the request body, so
+// the Terraform endpoints answer with the checks and errors of the regular
+// ones.
+func forwardJSON(w http.ResponseWriter, r *http.Request, h http.HandlerFunc, body any) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error encoding request", "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	r = r.Clone(r.Context())
+	r.Body, r.ContentLength = io.NopCloser(bytes.NewReader(data)), int64(len(data))
+	h(w, r)
+}
+
+// --- Handlers ---
+
+// getTerraformSiteHandler reads a site resource.
+func getTerraformSiteHandler(w http.ResponseWriter, r *http.Request) {
+	siteName, ok := siteNameFromPath(w, r)
+	if !ok {
+		return
+	}
+	sc, err := readSiteConfig(siteName)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error reading site config", "site", siteName, "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	respondJSON(w, newTerraformSite(siteName, sc))
+}
+
+// putTerraformSiteHandler creates a site or brings it to the declared
+// state.
+func putTerraformSiteHandler(w http.ResponseWriter, r *http.Request) {
+	siteName, exists, ok := terraformSiteExists(w, r)
+	if !ok {
+		return
+	}
+	var req terraformSiteRequest
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON request", http.StatusBadRequest)
+		return
+	}
+	if !exists {
+		createTerraformSite(w, r, siteName, req)
+		return
+	}
+	if r.Header.Get("If-None-Match") == "*" {
+		apiError(w, r, http.StatusPreconditionFailed, codeSiteExists, "The site exists already; import it to manage it")
+		return
+	}
+	if _, ok := siteNameFromPath(w, r); !ok {
+		return
+	}
+	sc, err := readSiteConfig(siteName)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error reading site config", "site", siteName, "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	update := siteUpdateRequest{Description: req.Description, Style: req.Style, InitialContent: req.Sections}
+	want := sc
+	changed, err := applySiteUpdate(&want, update)
+	if err != nil {
+		if !writeEntitlementError(w, r, err) {
+			apiError(w, r, http.StatusBadRequest, codeInvalidField, err.Error())
+		}
+		return
+	}
+	if len(changed) > 0 && sc.GitOps != nil {
+		writeSiteManagedError(w, r, sc)
+		return
+	}
+	want, err = saveSiteUpdate(r.Context(), siteName, want, changed, update)
+	if err != nil {
+		writeSiteUpdateError(w, r, siteName, err)
+		return
+	}
+	respondJSON(w, newTerraformSite(siteName, want))
+}
+
+// createTerraformSite creates a site like POST /api/v1/sites, waiting for
+// it.
+func createTerraformSite(w http.ResponseWriter, r *http.Request, siteName string, req terraformSiteRequest) {
+	creation := siteCreationRequest{SiteName: siteName, Email: req.Email}
+	if req.Description != nil {
+		creation.Description = *req.Description
+	}
+	if req.Style != nil {
+		creation.Style = *req.Style
+	}
+	if req.Sections != nil {
+		creation.InitialContent = *req.Sections
+	}
+	resp, status := createSite(r, creation)
+	if status == http.StatusOK && !resp.Success {
+		// Invalid requests; a concurrent creation of the name is a
+		// conflict.
+		status = http.StatusBadRequest
+		if resp.Code == codeSiteExists || resp.Code == codeNameTaken {
+			status = http.StatusConflict
+		}
+	}
+	if status != http.StatusOK {
+		writeSiteCreation(w, r, resp, status)
+		return
+	}
+	sc, err := readSiteConfig(siteName)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error reading site config", "site", siteName, "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	site := newTerraformSite(siteName, sc)
+	for _, warning := range []string{resp.DNSError, resp.WarmupError} {
+		if warning != "" {
+			site.Warnings = append(site.Warnings, warning)
+		}
+	}
+	respondJSONStatus(w, http.StatusCreated, site)
+}
+
+// deleteTerraformSiteHandler deletes a site, see deleteSiteHandler.
+func deleteTerraformSiteHandler(w http.ResponseWriter, r *http.Request) {
+	_, exists, ok := terraformSiteExists(w, r)
+	if !ok {
+		return
+	}
+	if !exists {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	deleteSiteHandler(w, r)
+}
+
+// putTerraformDNSHandler delegates a site's subdomain to the declared
+// nameservers, or rolls the delegation back if there are none. The
+// declaration stands in for the confirmation of PUT
+// /api/v1/sites/{siteName}/dns/delegation.
+func putTerraformDNSHandler(w http.ResponseWriter, r *http.Request) {
+	siteName, ok := siteNameFromPath(w, r)
+	if !ok {
+		return
+	}
+	var req terraformDNSRequest
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON request", http.StatusBadRequest)
+		return
+	}
+	if len(req.Nameservers) == 0 {
+		deleteTerraformDNSHandler(w, r)
+		return
+	}
+	hostname := siteName + "." + config.DNS.Domain
+	nameservers, err := normalizeNameservers(hostname, req.Nameservers)
+	if err != nil {
+		apiError(w, r, http.StatusBadRequest, codeInvalidField, err.Error())
+		return
+	}
+	sc, err := readSiteConfig(siteName)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error reading site config", "site", siteName, "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if sc.DNSDelegation != nil && slices.Equal(sc.DNSDelegation.Nameservers, nameservers) {
+		respondJSON(w, newDelegationView(siteName, sc))
+		return
+	}
+	forwardJSON(w, r, putDelegationHandler, delegationRequest{Nameservers: nameservers, Confirm: hostname, Force: req.Force})
+}
+
+// deleteTerraformDNSHandler rolls a delegation back, if there is one.
+func deleteTerraformDNSHandler(w http.ResponseWriter, r *http.Request) {
+	siteName, exists, ok := terraformSiteExists(w, r)
+	if !ok {
+		return
+	}
+	if !exists {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if _, ok := siteNameFromPath(w, r); !ok {
+		return
+	}
+	sc, err := readSiteConfig(siteName)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error reading site config", "site", siteName, "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if sc.DNSDelegation == nil {
+		respondJSON(w, newDelegationView(siteName, sc))
+		return
+	}
+	deleteDelegationHandler(w, r)
+}
+
+// getTerraformDomainHandler reads a domain resource.
+func getTerraformDomainHandler(w http.ResponseWriter, r *http.Request) {
+	siteName, ok := siteNameFromPath(w, r)
+	if !ok {
+		return
+	}
+	sc, err := readSiteConfig(siteName)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error reading site config", "site", siteName, "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	i, ok := domainFromPath(w, r, sc)
+	if !ok {
+		return
+	}
+	respondJSON(w, newDomainView(siteName, sc.Domains[i]))
+}
+
+// putTerraformDomainHandler adds a domain to a site unless it has it.
+func putTerraformDomainHandler(w http.ResponseWriter, r *http.Request) {
+	siteName, ok := siteNameFromPath(w, r)
+	if !ok {
+		return
+	}
+	domain, err := normalizeDomain(r.PathValue("domain"))
+	if err != nil {
+		apiError(w, r, http.StatusBadRequest, codeInvalidField, err.Error())
+		return
+	}
+	sc, err := readSiteConfig(siteName)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error reading site config", "site", siteName, "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if i := slices.IndexFunc(sc.Domains, func(d CustomDomain) bool { return d.Domain == domain }); i >= 0 {
+		respondJSON(w, newDomainView(siteName, sc.Domains[i]))
+		return
+	}
+	forwardJSON(w, r, addDomainHandler, domainRequest{Domain: domain})
+}
+
+// deleteTerraformDomainHandler removes a domain from a site, if it has it.
+func deleteTerraformDomainHandler(w http.ResponseWriter, r *http.Request) {
+	siteName, exists, ok := terraformSiteExists(w, r)
+	if !ok {
+		return
+	}
+	if !exists {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if _, ok := siteNameFromPath(w, r); !ok {
+		return
+	}
+	sc, err := readSiteConfig(siteName)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error reading site config", "site", siteName, "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	domain := strings.ToLower(strings.TrimSuffix(r.PathValue("domain"), "."))
+	if !slices.ContainsFunc(sc.Domains, func(d CustomDomain) bool { return d.Domain == domain }) {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	deleteDomainHandler(w, r)
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"text/tabwriter"
+)
+
+// The static assets of a theme (CSS, JS and what they reference) are kept in
+// <themes.asset_dir>/<theme>/ and published once to a shared directory, which
+// a CDN or the API serves, instead of being copied into every site:
+//
+//	<themes.cdn_dir>/<theme>/<version>/theme.css
+//
+// The version is a hash of the theme's files, so a changed theme is published
+// under a new path and cached forever by browsers and the CDN; old versions
+// are kept for the sites built with them until they are rebuilt. Themes are
+// published at startup and, when their files changed, on the next build.
+// The generated pages link the CSS and JS files of the current version with
+// subresource integrity, which needs CORS on the CDN (the API sends it).
+
+const (
+	defaultThemeCDNDir = ".theme-assets" // in sitesBaseDir
+	themeAssetsPath    = "/theme-assets/"
+	themeVersionLen    = 12 // hex digits of the content hash
+)
+
+type themeAsset struct {
+	URL       string
+	Type      string // css or js
+	Integrity string // subresource integrity, sha384-...
+}
+
+// themeVersion is a published version of a theme's assets.
+type themeVersion struct {
+	Theme   string   `json:"theme"`
+	Version string   `json:"version"`
+	Files   []string `json:"files"`
+	assets  []themeAsset
+}
+
+// publishedThemes are the current versions by theme, see ThemeAssets.
+var publishedThemes = struct {
+	sync.Mutex
+	versions map[string]themeVersion
+}{versions: map[string]themeVersion{}}
+
+func themeCDNDir() string {
+	if config.Themes.CDNDir != "" {
+		return config.Themes.CDNDir
+	}
+	return filepath.Join(sitesBaseDir, defaultThemeCDNDir)
+}
+
+// themeCDNURL is the public URL of the CDN directory.
+func themeCDNURL() string {
+	if config.Themes.CDNURL != "" {
+		return strings.TrimSuffix(config.Themes.CDNURL, "/")
+	}
+	return strings.TrimSuffix(config.Server.PublicURL, "/") + strings.TrimSuffix(themeAssetsPath, "/")
+}
+
+// themeSourceFiles returns the files of a theme's asset directory, relative
+// to it and sorted, or none if the theme has no assets.
+func themeSourceFiles(dir string) ([]string, error) {
+	var files []string
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(d.Name(), ".") && p != dir {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.Type().IsRegular() {
+			rel, err := filepath.Rel(dir, p)
+			if err != nil {
+				return err
+			}
+			files = append(files, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	slices.Sort(files)
+	return files, err
+}
+
+// publishTheme publishes the current files of a theme, if that version is
+// not published yet, and returns it. A theme without assets has no version.
+func publishTheme(theme string) (themeVersion, error) {
+	if config.Themes.AssetDir == "" {
+		return themeVersion{}, nil
+	}
+	srcDir := filepath.Join(config.Themes.AssetDir, theme)
+	files, err := themeSourceFiles(srcDir)
+	if err != nil || len(files) == 0 {
+		return themeVersion{}, err
+	}
+
+	contents := make(map[string][]byte, len(files))
+	hash := sha256.New()
+	for _, name := range files {
+		data, err := os.ReadFile(filepath.Join(srcDir, filepath.FromSlash(name)))
+		if err != nil {
+			return themeVersion{}, err
+		}
+		contents[name] = data
+		fmt.Fprintf(hash, "%s\x00%d\x00", name, len(data))
+		hash.Write(data)
+	}
+	v := themeVersion{Theme: theme, Version: hex.EncodeToString(hash.Sum(nil))[:themeVersionLen], Files: files}
+	for _, name := range files {
+		typ := strings.TrimPrefix(path.Ext(name), ".")
+		if typ != "css" && typ != "js" {
+			continue // fonts and images, referenced by the CSS
+		}
+		sum := sha512.Sum384(contents[name])
+		v.assets = append(v.assets, themeAsset{
+			URL:       themeCDNURL() + "/" + theme + "/" + v.Version + "/" + name,
+			Type:      typ,
+			Integrity: "sha384-" + base64.StdEncoding.EncodeToString(sum[:]),
+		})
+	}
+
+	publishedThemes.Lock()
+	defer publishedThemes.Unlock()
+	if publishedThemes.versions[theme].Version == v.Version {
+		return v, nil
+	}
+	themeDir := filepath.Join(themeCDNDir(), theme)
+	versionDir := filepath.Join(themeDir, v.Version)
+	if _, err := os.Stat(versionDir); os.IsNotExist(err) {
+		if err := writeThemeVersion(themeDir, versionDir, contents); err != nil {
+			return themeVersion{}, fmt.Errorf("failed to publish theme %s: %v", theme, err)
+		}
+		slog.Info("Published theme", "theme", theme, "version", v.Version, "files", len(files))
+	} else if err != nil {
+		return themeVersion{}, err
+	}
+	publishedThemes.versions[theme] = v
+	return v, nil
+}
+
+// writeThemeVersion writes the files to a temporary directory and renames
+// it, so a version directory is always complete. Another instance sharing
+// the CDN directory may publish the same version at the same time, which
+// is fine: the files are the same.
+func writeThemeVersion(themeDir, versionDir string, contents map[string][]byte) error {
+	if err := os.MkdirAll(themeDir, 0755); err != nil {
+		return err
+	}
+	tmp, err := os.MkdirTemp(themeDir, ".publish-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	for name, data := range contents {
+		p := filepath.Join(tmp, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(p, data, 0644); err != nil {
+			return err
+		}
+	}
+	if err := os.Chmod(tmp, 0755); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, versionDir); err != nil {
+		if _, serr := os.Stat(versionDir); serr == nil {
+			return nil // published by someone else meanwhile
+		}
+		return err
+	}
+	return nil
+}
+
+// publishThemes publishes all themes at startup.
+func publishThemes() {
+	if config.Themes.AssetDir == "" {
+		return
+	}
+	for _, t := range currentThemes() {
+		if _, err := publishTheme(t.ID); err != nil {
+			slog.Error("error publishing theme", "theme", t.ID, "error", err)
+		}
+	}
+}
+
+// ThemeAssets are the CSS and JS files of the site's theme the pages link,
+// of the version published last.
+func (c SiteConfig) ThemeAssets() []themeAsset {
+	publishedThemes.Lock()
+	defer publishedThemes.Unlock()
+	return publishedThemes.versions[c.Style].assets
+}
+
+// themeAssetsHandler serves the published theme assets when there is no
+// CDN in front of the directory (themes.cdn_url is empty). A version never
+// changes, so it may be cached forever.
+func themeAssetsHandler() http.Handler {
+	files := http.StripPrefix(strings.TrimSuffix(themeAssetsPath, "/"), http.FileServer(http.Dir(themeCDNDir())))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// <theme>/<version>/<file>, no listings and no temporary directories
+		parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, themeAssetsPath), "/", 3)
+		if len(parts) < 3 || parts[2] == "" || strings.HasSuffix(parts[2], "/") || strings.HasPrefix(parts[1], ".") {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+		files.ServeHTTP(w, r)
+	})
+}
+
+// --- Command ---
+
+var themesCommand = command{
+	subcommands: map[string]command{
+		"publish": {
+			usage: "themes publish",
+			run:   runThemesPublish,
+		},
+	},
+}
+
+// runThemesPublish publishes the current version of every theme, e.g. to
+// fill the CDN directory before the servers are updated.
+func runThemesPublish(args []string) error {
+	if config.Themes.AssetDir == "" {
+		return errors.New("themes.asset_dir is not set")
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "THEME\tVERSION\tFILES\tURL")
+	for _, t := range currentThemes() {
+		v, err := publishTheme(t.ID)
+		if err != nil {
+			return err
+		}
+		if v.Version == "" {
+			fmt.Fprintf(tw, "%s\t-\t0\t\n", t.ID)
+			continue
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s/%s/%s/\n", t.ID, v.Version, len(v.Files), themeCDNURL(), t.ID, v.Version)
+	}
+	return tw.Flush()
+}
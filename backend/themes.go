@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/spf13/viper"
+)
+
+// Theme registry: the themes a site can use as its style are read from
+// <paths.template_dir>/themes/, one directory per theme with a
+// manifest.yaml, so designers add themes without a new release:
+//
+//	id: autumn
+//	name: Autumn
+//	preview: preview.png # a file in the directory, or an http(s) URL
+//	sections: [header, hero, features, contact, footer]
+//
+// sections are those the theme can show, including the mandatory ones; a
+// site with this style can only enable these. Without sections the theme
+// shows all. Themes are listed in the order of their directories, the first
+// is preselected on the signup page. They are read at startup and again by
+// POST /api/v1/admin/themes/reload; a directory with an invalid manifest is
+// logged and left out. Without the directory, or without a valid theme in
+// it, the built-in themes are used. The CSS and JS of a theme stay in
+// themes.asset_dir (themeassets.go), its starter files in sites/<id>
+// (scaffold.go).
+
+const (
+	themesDir         = "themes" // in paths.template_dir
+	themeManifestFile = "manifest.yaml"
+)
+
+type themeInfo struct {
+	ID       string   `json:"id"`
+	Name     string   `json:"name"`
+	Image    string   `json:"image,omitempty"`    // preview image URL
+	Sections []string `json:"sections,omitempty"` // supported sections, empty for all
+	preview  string   // file in the theme's directory served as Image
+}
+
+// builtinThemes are used without themes on disk.
+var builtinThemes = []themeInfo{
+	{ID: "light", Name: "Light Theme"},
+	{ID: "dark", Name: "Dark Theme"},
+	{ID: "material", Name: "Material Design"},
+	{ID: "minimal", Name: "Minimalist"},
+}
+
+var themeRegistry = struct {
+	sync.RWMutex
+	themes []themeInfo
+}{themes: builtinThemes}
+
+// currentThemes returns the themes of the registry; the slice is never
+// changed, a reload replaces it.
+func currentThemes() []themeInfo {
+	themeRegistry.RLock()
+	defer themeRegistry.RUnlock()
+	return themeRegistry.themes
+}
+
+func findTheme(id string) (themeInfo, bool) {
+	for _, t := range currentThemes() {
+		if t.ID == id {
+			return t, true
+		}
+	}
+	return themeInfo{}, false
+}
+
+// checkSections fails if the theme cannot show one of the sections.
+func (t themeInfo) checkSections(ids []string) error {
+	if len(t.Sections) == 0 {
+		return nil
+	}
+	for _, id := range ids {
+		if !slices.Contains(t.Sections, id) {
+			return fmt.Errorf("the style %q does not support the section %q", t.ID, id)
+		}
+	}
+	return nil
+}
+
+type themeManifest struct {
+	ID       string   `mapstructure:"id"`
+	Name     string   `mapstructure:"name"`
+	Preview  string   `mapstructure:"preview"`
+	Sections []string `mapstructure:"sections"`
+}
+
+// themeLoadError is a theme directory left out of the registry.
+type themeLoadError struct {
+	Dir   string `json:"dir"`
+	Error string `json:"error"`
+}
+
+// readThemes reads the themes on disk, the built-in ones if there are none.
+func readThemes() ([]themeInfo, []themeLoadError, error) {
+	if config.Paths.TemplateDir == "" {
+		return builtinThemes, nil, nil
+	}
+	dir := filepath.Join(config.Paths.TemplateDir, themesDir)
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return builtinThemes, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	var themes []themeInfo
+	var failed []themeLoadError
+	for _, e := range entries {
+		if !e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		t, err := readThemeManifest(filepath.Join(dir, e.Name()))
+		if err == nil && slices.ContainsFunc(themes, func(other themeInfo) bool { return other.ID == t.ID }) {
+			err = fmt.Errorf("theme %q is defined twice", t.ID)
+		}
+		if err != nil {
+			failed = append(failed, themeLoadError{Dir: e.Name(), Error: err.Error()})
+			continue
+		}
+		themes = append(themes, t)
+	}
+	if len(themes) == 0 {
+		return builtinThemes, failed, nil
+	}
+	return themes, failed, nil
+}
+
+func readThemeManifest(dir string) (themeInfo, error) {
+	v := viper.New()
+	v.SetConfigFile(filepath.Join(dir, themeManifestFile))
+	var m themeManifest
+	if err := v.ReadInConfig(); err != nil {
+		return themeInfo{}, err
+	}
+	if err := v.UnmarshalExact(&m); err != nil {
+		return themeInfo{}, fmt.Errorf("%s: %w", themeManifestFile, err)
+	}
+	if !hookNameRegex.MatchString(m.ID) {
+		return themeInfo{}, fmt.Errorf("invalid id %q, use lowercase letters, digits and dashes", m.ID)
+	}
+	t := themeInfo{ID: m.ID, Name: strings.TrimSpace(m.Name), Sections: m.Sections}
+	if t.Name == "" {
+		return themeInfo{}, fmt.Errorf("theme %s has no name", m.ID)
+	}
+	for _, id := range m.Sections {
+		if _, ok := findSection(id); !ok {
+			return themeInfo{}, fmt.Errorf("theme %s: unknown section %q", m.ID, id)
+		}
+	}
+	if len(m.Sections) > 0 {
+		for _, s := range sections {
+			if s.Mandatory && !slices.Contains(m.Sections, s.ID) {
+				return themeInfo{}, fmt.Errorf("theme %s must support the mandatory section %q", m.ID, s.ID)
+			}
+		}
+	}
+	switch {
+	case m.Preview == "":
+	case strings.HasPrefix(m.Preview, "https://"), strings.HasPrefix(m.Preview, "http://"):
+		t.Image = m.Preview
+	default:
+		if !filepath.IsLocal(m.Preview) {
+			return themeInfo{}, fmt.Errorf("theme %s: the preview %q must be a file in its directory or a URL", m.ID, m.Preview)
+		}
+		t.preview = filepath.Join(dir, m.Preview)
+		if info, err := os.Stat(t.preview); err != nil || !info.Mode().IsRegular() {
+			return themeInfo{}, fmt.Errorf("theme %s: the preview %s is not a file", m.ID, m.Preview)
+		}
+		t.Image = strings.TrimSuffix(config.Server.PublicURL, "/") + "/api/" + currentAPIVersion + "/themes/" + t.ID + "/preview"
+	}
+	return t, nil
+}
+
+// loadThemes replaces the registry with the themes on disk. If the
+// directory cannot be read the registry is left as it is.
+func loadThemes() ([]themeLoadError, error) {
+	themes, failed, err := readThemes()
+	if err != nil {
+		slog.Error("error reading themes", "error", err)
+		return nil, err
+	}
+	for _, f := range failed {
+		slog.Error("invalid theme left out", "dir", f.Dir, "error", f.Error)
+	}
+	themeRegistry.Lock()
+	themeRegistry.themes = themes
+	themeRegistry.Unlock()
+	return failed, nil
+}
+
+// --- Handlers ---
+
+func getThemesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(currentThemes())
+}
+
+// getThemePreviewHandler serves the preview image of a theme on disk.
+func getThemePreviewHandler(w http.ResponseWriter, r *http.Request) {
+	t, ok := findTheme(r.PathValue("themeId"))
+	if !ok || t.preview == "" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	http.ServeFile(w, r, t.preview)
+}
+
+type themeReloadResponse struct {
+	Themes []themeInfo      `json:"themes"`
+	Failed []themeLoadError `json:"failed"`
+}
+
+// reloadThemesHandler reads the themes from disk again and publishes their
+// assets.
+func reloadThemesHandler(w http.ResponseWriter, r *http.Request) {
+	failed, err := loadThemes()
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	publishThemes()
+	slog.InfoContext(r.Context(), "themes reloaded", "themes", len(currentThemes()), "failed", len(failed))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(themeReloadResponse{Themes: currentThemes(), Failed: append([]themeLoadError{}, failed...)})
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"path/filepath"
+	"slices"
+
+	"github.com/quic-go/quic-go/http3"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// apiAutocertDir keeps the certificate of server.tls.autocert_host.
+const apiAutocertDir = ".autocert" // in sitesBaseDir
+
+// serveTLS serves the handler of server over TLS on ln until it fails or
+// is shut down, with HTTP/2 and, if enabled, HTTP/3 on the same UDP port.
+// HTTP/3 is advertised to clients with an Alt-Svc header on the TCP
+// responses.
+func serveTLS(server *http.Server, ln net.Listener, tlsConfig *tls.Config) error {
+	handler := server.Handler
+	server.TLSConfig = tlsConfig
+	if !config.Server.HTTP2 {
+		// A non-nil, empty map turns off the built-in HTTP/2 support.
+		server.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+		// Other protocols stay, e.g. acme-tls/1 of autocert.
+		tlsConfig.NextProtos = slices.DeleteFunc(slices.Clone(tlsConfig.NextProtos), func(p string) bool { return p == "h2" })
+		if len(tlsConfig.NextProtos) == 0 {
+			tlsConfig.NextProtos = []string{"http/1.1"}
+		}
+	}
+	if !config.Server.HTTP3 {
+		return server.ServeTLS(ln, "", "")
+	}
+
+	addr := ln.Addr().String()
+	h3 := &http3.Server{Addr: addr, Handler: handler, TLSConfig: http3.ConfigureTLSConfig(tlsConfig)}
+	server.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := h3.SetQUICHeaders(w.Header()); err != nil {
+			slog.Error("error setting Alt-Svc header", "error", err)
+		}
+		handler.ServeHTTP(w, r)
+	})
+	errs := make(chan error, 2)
+	go func() { errs <- h3.ListenAndServe() }()
+	go func() { errs <- server.ServeTLS(ln, "", "") }()
+	slog.Info("HTTP/3 enabled on UDP", "addr", addr)
+	return <-errs
+}
+
+// apiTLSConfig returns the TLS configuration of the API listener, or nil
+// to serve plain HTTP (behind a reverse proxy). The certificate is either
+// server.tls.cert_file/key_file, reloaded when the files change, or
+// obtained and renewed from the ACME CA (acme.directory_url) for
+// server.tls.autocert_host with the TLS-ALPN-01 challenge, which needs the
+// API to listen on port 443.
+func apiTLSConfig() (*tls.Config, error) {
+	t := config.Server.TLS
+	if t.AutocertHost != "" {
+		if t.CertFile != "" || t.KeyFile != "" {
+			return nil, errors.New("server.tls: set either cert_file and key_file or autocert_host")
+		}
+		m := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(t.AutocertHost),
+			Cache:      autocert.DirCache(filepath.Join(sitesBaseDir, apiAutocertDir)),
+			Email:      config.ACME.Email,
+			Client:     &acme.Client{DirectoryURL: config.ACME.DirectoryURL, UserAgent: "flox-backend/" + Version},
+		}
+		return m.TLSConfig(), nil
+	}
+	if t.CertFile == "" && t.KeyFile == "" {
+		return nil, nil
+	}
+	if t.CertFile == "" || t.KeyFile == "" {
+		return nil, errors.New("server.tls needs both cert_file and key_file")
+	}
+	store := newCertStore("")
+	// Loaded once here so that a bad certificate fails at startup.
+	if _, err := store.loadFiles("api", t.CertFile, t.KeyFile); err != nil {
+		return nil, err
+	}
+	return &tls.Config{GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+		return store.loadFiles("api", t.CertFile, t.KeyFile)
+	}}, nil
+}
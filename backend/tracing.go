@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// With tracing.endpoint set, API requests are traced with OpenTelemetry and
+// exported over OTLP/HTTP (to a collector, Tempo, Jaeger, ...). Every request
+// gets a server span named after its route, continuing the trace of a W3C
+// traceparent header. Provisioning runs (creation, verification, builds,
+// queued DNS records, certificates) get a span below it, and every step of
+// the provisioning log (directory, config, DNS API calls, commands, ...) a
+// child span with the same detail, so the latency of a creation can be
+// broken down. Log records of a request carry its trace_id.
+
+var tracer = otel.Tracer("github.com/cheathuber/flox-backend")
+
+func tracingEnabled() bool {
+	return config.Tracing.Endpoint != ""
+}
+
+func validateTracing(c *Config) error {
+	if c.Tracing.Endpoint == "" {
+		return nil
+	}
+	if u, err := url.Parse(c.Tracing.Endpoint); err != nil || u.Host == "" || (u.Scheme != "https" && u.Scheme != "http") {
+		return fmt.Errorf("tracing.endpoint must be an http(s) URL, not %q", c.Tracing.Endpoint)
+	}
+	if r := c.Tracing.SampleRatio; r < 0 || r > 1 {
+		return fmt.Errorf("tracing.sample_ratio must be between 0 and 1, not %g", r)
+	}
+	return nil
+}
+
+// setupTracing installs the OTLP exporter. Spans are sent in batches in the
+// background; without an endpoint the spans are no-ops.
+func setupTracing() error {
+	if !tracingEnabled() {
+		return nil
+	}
+	endpoint := config.Tracing.Endpoint
+	if u, _ := url.Parse(endpoint); strings.Trim(u.Path, "/") == "" {
+		endpoint = strings.TrimSuffix(endpoint, "/") + "/v1/traces"
+	}
+	opts := []otlptracehttp.Option{otlptracehttp.WithEndpointURL(endpoint)}
+	if len(config.Tracing.Headers) > 0 {
+		opts = append(opts, otlptracehttp.WithHeaders(config.Tracing.Headers))
+	}
+	exporter, err := otlptracehttp.New(context.Background(), opts...)
+	if err != nil {
+		return fmt.Errorf("creating the OTLP exporter: %v", err)
+	}
+	attrs := []attribute.KeyValue{
+		attribute.String("service.name", config.Tracing.ServiceName),
+		attribute.String("service.version", Version),
+	}
+	if config.Registry.Instance != "" {
+		attrs = append(attrs, attribute.String("service.instance.id", config.Registry.Instance))
+	}
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(attrs...)),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(config.Tracing.SampleRatio))),
+	))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+		slog.Error("error exporting traces", "error", err)
+	}))
+	slog.Info("Tracing to OTLP endpoint", "endpoint", endpoint, "sample_ratio", config.Tracing.SampleRatio)
+	return nil
+}
+
+// tracingMiddleware starts the server span of every request; next is mux
+// with its middleware. The span is named after the route pattern, as the
+// metrics are.
+func tracingMiddleware(mux *http.ServeMux, next http.Handler) http.Handler {
+	if !tracingEnabled() {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		_, pattern := mux.Handler(r)
+		route := pattern
+		if _, path, ok := strings.Cut(pattern, " "); ok {
+			route = path
+		}
+		name := r.Method + " " + route
+		if pattern == "" {
+			name = r.Method
+		}
+		ctx, span := tracer.Start(ctx, name, trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(
+			attribute.String("http.request.method", r.Method),
+			attribute.String("http.route", route),
+			attribute.String("url.path", r.URL.Path),
+			attribute.String("client.address", clientIP(r)),
+		))
+		defer span.End()
+		l := requestLogFrom(r.Context())
+		if l != nil && span.SpanContext().IsValid() {
+			l.traceID = span.SpanContext().TraceID().String()
+		}
+
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+		status := max(rec.status, http.StatusOK)
+		span.SetAttributes(attribute.Int("http.response.status_code", status))
+		if l != nil && l.site != "" {
+			span.SetAttributes(attribute.String("flox.site", l.site))
+		}
+		if status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+	})
+}
+
+// startRunSpan starts the span of a provisioning run.
+func startRunSpan(ctx context.Context, siteName, kind string) (context.Context, trace.Span) {
+	return tracer.Start(ctx, "provision "+kind, trace.WithAttributes(
+		attribute.String("flox.site", siteName),
+		attribute.String("flox.run", kind),
+	))
+}
+
+// endSpan ends a span with the outcome of what it covers.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.SetStatus(codes.Error, redactSecrets(err.Error()))
+	}
+	span.End()
+}
+
+// traceStep records a provisioning step as a child span of its run.
+func traceStep(ctx context.Context, siteName string, s provisioningStep, end time.Time) {
+	_, span := tracer.Start(ctx, s.Step, trace.WithTimestamp(s.Time), trace.WithAttributes(
+		attribute.String("flox.site", siteName),
+		attribute.String("flox.detail", s.Detail),
+	))
+	if s.Error != "" {
+		span.SetStatus(codes.Error, s.Error)
+	}
+	span.End(trace.WithTimestamp(end))
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// uiFiles is the embedded frontend build, nil unless the binary was built
+// with "-tags embedui" (see "make build-embedded").
+var uiFiles fs.FS
+
+// spaHandler serves the frontend. Paths that are not a file get index.html,
+// so client-side routes work on reload.
+func spaHandler(fsys fs.FS) http.Handler {
+	fileServer := http.FileServerFS(fsys)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/api/") {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		name := strings.TrimPrefix(path.Clean(r.URL.Path), "/")
+		if name == "" {
+			name = "index.html"
+		}
+		if info, err := fs.Stat(fsys, name); err != nil || info.IsDir() {
+			if err != nil && !errors.Is(err, fs.ErrNotExist) {
+				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+				return
+			}
+			name = "index.html"
+		}
+		if name == "index.html" {
+			// Always revalidate the entry point so deployments take effect.
+			w.Header().Set("Cache-Control", "no-cache")
+			http.ServeFileFS(w, r, fsys, name)
+			return
+		}
+		fileServer.ServeHTTP(w, r)
+	})
+}
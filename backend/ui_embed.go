@@ -0,0 +1,21 @@
+//go:build embedui
+
+package main
+
+import (
+	"embed"
+	"io/fs"
+)
+
+// The frontend build is copied to ui/ by "make build-embedded".
+//
+//go:embed all:ui
+var embeddedUI embed.FS
+
+func init() {
+	sub, err := fs.Sub(embeddedUI, "ui")
+	if err != nil {
+		panic(err)
+	}
+	uiFiles = sub
+}
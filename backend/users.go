@@ -0,0 +1,432 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// User accounts: users register and log in with email and password and get
+// a session token (see jwt.go) to send as "Authorization: Bearer <token>".
+// Sites created by a logged-in user belong to them (SiteConfig.UserID) and
+// only they can see and change them. Sites without an owner, created
+// before accounts existed or anonymously, stay accessible to everyone
+// unless auth.required is set, which also makes creating and listing sites
+// need a login; "flox-backend site assign" gives such sites an owner.
+// Users of an OpenID Connect provider (see oidc.go) are not stored here,
+// their sites carry the token subject as owner.
+
+const (
+	usersFile         = ".users.json" // in sitesBaseDir
+	minPasswordLength = 8
+	maxPasswordLength = 72 // bcrypt ignores the rest
+)
+
+type User struct {
+	ID           string    `json:"id"`
+	Email        string    `json:"email"`
+	PasswordHash string    `json:"passwordHash"`
+	Role         string    `json:"role,omitempty"` // see roles.go, empty is a regular user
+	CreatedAt    time.Time `json:"createdAt"`
+}
+
+// userView is a user in API responses.
+type userView struct {
+	ID        string     `json:"id"`
+	Email     string     `json:"email"`
+	CreatedAt *time.Time `json:"createdAt,omitempty"` // not known for OIDC users
+	Provider  string     `json:"provider"`            // password or oidc
+	Role      string     `json:"role"`
+}
+
+func (u User) view() userView {
+	return userView{ID: u.ID, Email: u.Email, CreatedAt: &u.CreatedAt, Provider: "password", Role: u.role()}
+}
+
+func (u User) role() string {
+	if u.Role == "" {
+		return roleUser
+	}
+	return u.Role
+}
+
+var usersMu sync.Mutex
+
+// readUsers returns the users by ID.
+func readUsers() (map[string]User, error) {
+	users := map[string]User{}
+	data, err := os.ReadFile(filepath.Join(sitesBaseDir, usersFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return users, nil
+		}
+		return nil, err
+	}
+	err = json.Unmarshal(data, &users)
+	return users, err
+}
+
+func writeUsers(users map[string]User) error {
+	data, err := json.MarshalIndent(users, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(sitesBaseDir, usersFile)
+	return writeFileAtomic(path, data, 0600)
+}
+
+func findUserByEmail(users map[string]User, email string) (User, bool) {
+	for _, u := range users {
+		if strings.EqualFold(u.Email, email) {
+			return u, true
+		}
+	}
+	return User{}, false
+}
+
+func newUserID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// validateCredentials checks the email and password of a new account and
+// returns the address without the name.
+func validateCredentials(email, password string) (string, error) {
+	addr, err := mail.ParseAddress(strings.TrimSpace(email))
+	if err != nil {
+		return "", errors.New("a valid email address is required")
+	}
+	if len(password) < minPasswordLength || len(password) > maxPasswordLength {
+		return "", errors.New("the password must have 8 to 72 characters")
+	}
+	return addr.Address, nil
+}
+
+// newPasswordUser returns a regular account with a new ID and the hash of
+// the password.
+func newPasswordUser(email, password string) (User, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return User{}, fmt.Errorf("hashing the password: %v", err)
+	}
+	id, err := newUserID()
+	if err != nil {
+		return User{}, fmt.Errorf("generating the user ID: %v", err)
+	}
+	return User{ID: id, Email: email, PasswordHash: string(hash), CreatedAt: time.Now().UTC()}, nil
+}
+
+var errUserExists = errors.New("an account with this email address exists")
+
+// addUser stores a new account, errUserExists if its email is taken.
+func addUser(user User) error {
+	usersMu.Lock()
+	defer usersMu.Unlock()
+	users, err := readUsers()
+	if err != nil {
+		return err
+	}
+	if _, exists := findUserByEmail(users, user.Email); exists {
+		return errUserExists
+	}
+	users[user.ID] = user
+	return writeUsers(users)
+}
+
+// --- Request context ---
+
+type userContextKey struct{}
+
+// tokenRoutes are the mux patterns registered with handleToken: endpoints
+// that may be called with a shared bearer token (registry.token,
+// admin.token) instead of a session, which the handler checks itself.
+var tokenRoutes = map[string]bool{}
+
+func handleToken(mux *http.ServeMux, pattern string, handler http.HandlerFunc) {
+	mux.HandleFunc(pattern, handler)
+	tokenRoutes[pattern] = true
+}
+
+// authenticate resolves the bearer token of a request to mux, if any, to its
+// user. An invalid or expired token is rejected rather than treated as
+// anonymous, so a client notices it has to log in again.
+func authenticate(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok {
+			mux.ServeHTTP(w, r)
+			return
+		}
+		claims, err := parseBearerToken(strings.TrimSpace(token))
+		if err == nil && !claims.isOIDCSession() {
+			claims.Role, err = localUserRole(claims.Subject)
+		}
+		if err != nil {
+			// Shared tokens are no sessions, the handler checks them.
+			if _, pattern := mux.Handler(r); tokenRoutes[pattern] {
+				mux.ServeHTTP(w, r)
+				return
+			}
+			if !errors.Is(err, errInvalidToken) {
+				slog.Error("error checking session token", "error", err)
+			}
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			apiError(w, r, http.StatusUnauthorized, codeInvalidToken, "Invalid or expired session, please log in again")
+			return
+		}
+		ctx := context.WithValue(r.Context(), userContextKey{}, claims)
+		mux.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// localUserRole returns the role of a local account; an account deleted
+// since its token was issued has no session anymore.
+func localUserRole(userID string) (string, error) {
+	usersMu.Lock()
+	users, err := readUsers()
+	usersMu.Unlock()
+	if err != nil {
+		return "", err
+	}
+	user, ok := users[userID]
+	if !ok {
+		return "", errInvalidToken
+	}
+	return user.role(), nil
+}
+
+func currentSession(r *http.Request) sessionClaims {
+	claims, _ := r.Context().Value(userContextKey{}).(sessionClaims)
+	return claims
+}
+
+// currentUserID returns the ID of the logged-in user, "" for anonymous
+// requests.
+func currentUserID(r *http.Request) string {
+	return currentSession(r).Subject
+}
+
+func currentUserEmail(r *http.Request) string {
+	return currentSession(r).Email
+}
+
+// requireLogin answers 401 for anonymous requests and reports whether the
+// request may go on.
+func requireLogin(w http.ResponseWriter, r *http.Request) bool {
+	if currentUserID(r) != "" {
+		return true
+	}
+	w.Header().Set("WWW-Authenticate", "Bearer")
+	apiError(w, r, http.StatusUnauthorized, codeLoginRequired, "Login required")
+	return false
+}
+
+// canAccessSite reports whether the request may see and change a site: its
+// owner may, anyone may for sites without an owner (unless auth.required),
+// admins and admin.token may for all.
+func canAccessSite(r *http.Request, sc SiteConfig) bool {
+	if isAdmin(r) || r.Context().Value(adminTokenKey{}) != nil {
+		return true
+	}
+	if sc.UserID == "" {
+		return !config.Auth.Required
+	}
+	return sc.UserID == currentUserID(r)
+}
+
+// authorizeSite checks the access of a dashboard request to a site and
+// writes the error response if it is denied.
+func authorizeSite(w http.ResponseWriter, r *http.Request, siteName string) bool {
+	sc, err := readSiteConfig(siteName)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error reading site config", "site", siteName, "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return false
+	}
+	if canAccessSite(r, sc) {
+		return true
+	}
+	if currentUserID(r) == "" {
+		return requireLogin(w, r)
+	}
+	if sc.UserID == "" {
+		apiError(w, r, http.StatusForbidden, codeSiteForbidden, "This site has no owner yet")
+		return false
+	}
+	apiError(w, r, http.StatusForbidden, codeSiteForbidden, "This site belongs to another account")
+	return false
+}
+
+// --- Handlers ---
+
+type credentialsRequest struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+}
+
+type sessionResponse struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expiresAt"`
+	User      userView  `json:"user"`
+}
+
+func respondSession(w http.ResponseWriter, status int, user User) {
+	token, expiresAt, err := issueSessionToken(user)
+	if err != nil {
+		slog.Error("error issuing session token", "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	respondJSONStatus(w, status, sessionResponse{Token: token, ExpiresAt: expiresAt, User: user.view()})
+}
+
+// passwordsEnabled answers 404 if local accounts are turned off and reports
+// whether the request may go on.
+func passwordsEnabled(w http.ResponseWriter) bool {
+	if config.Auth.Passwords {
+		return true
+	}
+	http.Error(w, "Password accounts are disabled, log in through the identity provider", http.StatusNotFound)
+	return false
+}
+
+// registerHandler creates an account and logs it in.
+func registerHandler(w http.ResponseWriter, r *http.Request) {
+	if !passwordsEnabled(w) {
+		return
+	}
+	var req credentialsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON request", http.StatusBadRequest)
+		return
+	}
+	email, err := validateCredentials(req.Email, req.Password)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	user, err := newPasswordUser(email, req.Password)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error creating user", "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	err = addUser(user)
+	if errors.Is(err, errUserExists) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error storing user", "email", user.Email, "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	slog.InfoContext(r.Context(), "registered user", "user", user.ID, "email", user.Email)
+	respondSession(w, http.StatusCreated, user)
+}
+
+// loginHandler exchanges email and password for a session token.
+func loginHandler(w http.ResponseWriter, r *http.Request) {
+	if !passwordsEnabled(w) {
+		return
+	}
+	var req credentialsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON request", http.StatusBadRequest)
+		return
+	}
+	usersMu.Lock()
+	users, err := readUsers()
+	usersMu.Unlock()
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error reading users", "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	user, ok := findUserByEmail(users, strings.TrimSpace(req.Email))
+	if !ok || bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(req.Password)) != nil {
+		http.Error(w, "wrong email address or password", http.StatusUnauthorized)
+		return
+	}
+	respondSession(w, http.StatusOK, user)
+}
+
+// getCurrentUserHandler returns the logged-in user.
+func getCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireLogin(w, r) {
+		return
+	}
+	if session := currentSession(r); session.isOIDCSession() {
+		respondJSON(w, userView{ID: session.Subject, Email: session.Email, Provider: "oidc", Role: session.Role})
+		return
+	}
+	usersMu.Lock()
+	users, err := readUsers()
+	usersMu.Unlock()
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error reading users", "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	user, ok := users[currentUserID(r)]
+	if !ok {
+		http.Error(w, "This account no longer exists", http.StatusUnauthorized)
+		return
+	}
+	respondJSON(w, user.view())
+}
+
+// --- Command ---
+
+// runSiteAssign makes a registered user, or with OIDC the subject of the
+// provider, the owner of a site, e.g. of sites created before accounts
+// existed.
+func runSiteAssign(args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("usage: site assign <siteName> <email or OIDC subject>")
+	}
+	siteName, who := args[0], args[1]
+	users, err := readUsers()
+	if err != nil {
+		return err
+	}
+	var userID, owner string
+	if user, ok := findUserByEmail(users, who); ok {
+		userID, owner = user.ID, user.Email
+	} else if oidcEnabled() && !strings.Contains(who, "@") {
+		userID, owner = who, "OIDC subject "+who
+	} else {
+		return fmt.Errorf("no user with email %s", who)
+	}
+	var previous string
+	if _, err := updateSiteConfig(siteName, func(sc *SiteConfig) error {
+		previous, sc.UserID = sc.UserID, userID
+		return nil
+	}); err != nil {
+		return err
+	}
+	recordSiteEvent(siteName, SiteEvent{Type: "site.assigned", Message: "owner " + owner})
+	if previous != "" && previous != userID {
+		fmt.Printf("%s now belongs to %s (was user %s)\n", siteName, owner, previous)
+	} else {
+		fmt.Printf("%s now belongs to %s\n", siteName, owner)
+	}
+	return nil
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"cmp"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// With verification.required a new site stays a draft until the requester
+// confirms their email: it can be edited, but it is not built and has no DNS
+// record before the link in the verification mail is opened.
+
+const (
+	siteVerificationFile       = "verification.json" // in the site dir while unverified
+	verificationResendInterval = time.Minute
+)
+
+var errSiteUnverified = errors.New("the site is waiting for email verification")
+
+// siteVerification holds the pending token; only its hash is stored.
+type siteVerification struct {
+	Email     string    `json:"email"`
+	TokenHash string    `json:"tokenHash"`
+	SentAt    time.Time `json:"sentAt"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+func siteVerificationPath(siteName string) string {
+	return filepath.Join(sitesBaseDir, siteName, siteVerificationFile)
+}
+
+func hashVerificationToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// apiBaseURL is the URL of this API for links in emails: server.public_url,
+// or else the host the request was sent to.
+func apiBaseURL(r *http.Request) string {
+	if config.Server.PublicURL != "" {
+		return strings.TrimSuffix(config.Server.PublicURL, "/")
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+// sendSiteVerification stores a new token for the site and mails the link.
+func sendSiteVerification(r *http.Request, siteName, email string) error {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return err
+	}
+	token := hex.EncodeToString(buf)
+	now := time.Now().UTC()
+	v := siteVerification{
+		Email:     email,
+		TokenHash: hashVerificationToken(token),
+		SentAt:    now,
+		ExpiresAt: now.Add(config.Verification.TokenTTL),
+	}
+	if err := writeJSONAtomic(siteVerificationPath(siteName), v, 0600); err != nil {
+		return err
+	}
+
+	link := fmt.Sprintf("%s/api/v1/sites/%s/verify?token=%s", apiBaseURL(r), siteName, url.QueryEscape(token))
+	return sendTemplateEmail(email, "verification", map[string]any{
+		"SiteName":  siteName,
+		"SiteURL":   siteURL(siteName),
+		"Link":      link,
+		"ExpiresAt": v.ExpiresAt.Format(time.RFC1123),
+	})
+}
+
+func readSiteVerification(siteName string) (*siteVerification, error) {
+	data, err := os.ReadFile(siteVerificationPath(siteName))
+	if err != nil {
+		return nil, err
+	}
+	var v siteVerification
+	if err := json.Unmarshal(data, &v); err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+var verifiedPage = template.Must(template.New("verified").Parse(`<!DOCTYPE html>
+<html lang="en"><head><meta charset="utf-8"><meta name="viewport" content="width=device-width, initial-scale=1"><title>{{.Title}}</title></head>
+<body style="font-family: sans-serif; max-width: 36em; margin: 4em auto; padding: 0 1em">
+<h1>{{.Title}}</h1>
+<p>{{.Message}}</p>
+{{if .SiteURL}}<p><a href="{{.SiteURL}}">{{.SiteURL}}</a></p>{{end}}
+</body></html>
+`))
+
+func renderVerifiedPage(w http.ResponseWriter, status int, title, message, siteURL string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	verifiedPage.Execute(w, map[string]string{"Title": title, "Message": message, "SiteURL": siteURL})
+}
+
+var errAlreadyVerified = errors.New("site already verified")
+
+// verifySiteHandler is the link in the verification mail. It is opened in a
+// browser, so it answers with a small HTML page.
+func verifySiteHandler(w http.ResponseWriter, r *http.Request) {
+	siteName, ok := siteNameFromPath(w, r)
+	if !ok {
+		return
+	}
+	siteConfig, err := readSiteConfig(siteName)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error reading site config", "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if !siteConfig.Unverified {
+		renderVerifiedPage(w, http.StatusOK, "Already confirmed", "Your email address was already confirmed, the site is published.", siteURL(siteName))
+		return
+	}
+	v, err := readSiteVerification(siteName)
+	if err != nil && !os.IsNotExist(err) {
+		slog.ErrorContext(r.Context(), "error reading verification", "site", siteName, "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	token := r.URL.Query().Get("token")
+	if v == nil || subtle.ConstantTimeCompare([]byte(hashVerificationToken(token)), []byte(v.TokenHash)) != 1 {
+		renderVerifiedPage(w, http.StatusBadRequest, "Invalid link", "This confirmation link is not valid. Please use the link of the most recent mail.", "")
+		return
+	}
+	if time.Now().After(v.ExpiresAt) {
+		renderVerifiedPage(w, http.StatusGone, "Link expired", "This confirmation link has expired. Please request a new mail.", "")
+		return
+	}
+
+	now := time.Now().UTC()
+	siteConfig, err = updateSiteConfig(siteName, func(siteConfig *SiteConfig) error {
+		if !siteConfig.Unverified {
+			return errAlreadyVerified // by a second click meanwhile
+		}
+		siteConfig.Unverified = false
+		siteConfig.VerifiedAt = &now
+		return nil
+	})
+	if errors.Is(err, errAlreadyVerified) {
+		renderVerifiedPage(w, http.StatusOK, "Already confirmed", "Your email address was already confirmed, the site is published.", siteURL(siteName))
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error writing site config", "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if err := os.Remove(siteVerificationPath(siteName)); err != nil {
+		slog.ErrorContext(r.Context(), "error removing verification", "site", siteName, "error", err)
+	}
+	recordSiteEvent(siteName, SiteEvent{Type: "site.verified"})
+
+	message := "Thank you, your email address is confirmed. Your site is being published."
+	endRun := beginRun(r.Context(), siteName, "verify")
+	release := acquireJobSlot(siteName, jobClassFor(r, siteConfig))
+	err = provisionSite(r.Context(), siteName, nil)
+	release()
+	var warmupErr error
+	if err == nil {
+		warmupErr = warmUpSite(r.Context(), siteName)
+	}
+	endRun(cmp.Or(err, warmupErr))
+	if warmupErr != nil {
+		slog.WarnContext(r.Context(), "site did not answer after verification", "site", siteName, "error", warmupErr)
+		message = "Thank you, your email address is confirmed. Your site is published and should be reachable within a few minutes."
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to create DNS A record", "error", err)
+		_, dnsMessage := dnsErrorResponse(err)
+		if errors.Is(err, errDNSPending) {
+			dnsMessage = "it will be reachable as soon as our DNS provider is available again."
+		}
+		message = "Thank you, your email address is confirmed. Your site could not be published yet: " + dnsMessage
+	}
+	renderVerifiedPage(w, http.StatusOK, "Email confirmed", message, siteURL(siteName))
+}
+
+// resendVerificationHandler sends a new verification mail, at most once per
+// verificationResendInterval. Older links stop working.
+func resendVerificationHandler(w http.ResponseWriter, r *http.Request) {
+	siteName, ok := siteNameFromPath(w, r)
+	if !ok {
+		return
+	}
+	siteConfig, err := readSiteConfig(siteName)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error reading site config", "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if !siteConfig.Unverified {
+		http.Error(w, "The site is already verified", http.StatusConflict)
+		return
+	}
+	v, err := readSiteVerification(siteName)
+	if err != nil && !os.IsNotExist(err) {
+		slog.ErrorContext(r.Context(), "error reading verification", "site", siteName, "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if v != nil && time.Since(v.SentAt) < verificationResendInterval {
+		w.Header().Set("Retry-After", fmt.Sprint(int((verificationResendInterval-time.Since(v.SentAt)).Seconds())+1))
+		http.Error(w, "A mail was sent recently, please wait a minute", http.StatusTooManyRequests)
+		return
+	}
+	if err := sendSiteVerification(r, siteName, siteConfig.OwnerEmail); err != nil {
+		slog.ErrorContext(r.Context(), "error sending verification", "site", siteName, "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	respondJSON(w, map[string]bool{"success": true})
+}
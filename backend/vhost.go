@@ -0,0 +1,373 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// CustomHeader is an additional response header of a site's vhost.
+type CustomHeader struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// HeaderSettings are the response headers an owner may change. Only a
+// constrained set is allowed, the rest of the vhost is fixed.
+type HeaderSettings struct {
+	Headers []CustomHeader `json:"headers,omitempty"`
+	// Origins allowed to embed the site in a frame. Replaces X-Frame-Options
+	// with a CSP frame-ancestors directive.
+	FrameAncestors []string `json:"frameAncestors,omitempty"`
+}
+
+var referrerPolicies = []string{
+	"no-referrer", "no-referrer-when-downgrade", "origin", "origin-when-cross-origin",
+	"same-origin", "strict-origin", "strict-origin-when-cross-origin", "unsafe-url",
+}
+
+// allowedHeaders maps the headers owners may set to their value validation.
+var allowedHeaders = map[string]func(string) error{
+	"Content-Security-Policy-Report-Only": validateHeaderText,
+	"Permissions-Policy":                  validateHeaderText,
+	"X-Robots-Tag":                        validateHeaderText,
+	"Referrer-Policy": func(v string) error {
+		if !slices.Contains(referrerPolicies, v) {
+			return fmt.Errorf("must be one of %s", strings.Join(referrerPolicies, ", "))
+		}
+		return nil
+	},
+	"X-Frame-Options": func(v string) error {
+		if v != "DENY" && v != "SAMEORIGIN" {
+			return errors.New(`must be "DENY" or "SAMEORIGIN" (use frameAncestors to allow embedding)`)
+		}
+		return nil
+	},
+}
+
+// validateHeaderText rejects values that could break out of the quoted
+// nginx directive or expand nginx variables.
+func validateHeaderText(v string) error {
+	if v == "" || len(v) > 2048 {
+		return errors.New("must be 1-2048 characters")
+	}
+	for _, r := range v {
+		if r < 0x20 || r > 0x7e || r == '"' || r == '\\' || r == '$' || r == '{' || r == '}' {
+			return fmt.Errorf("must not contain %q", r)
+		}
+	}
+	return nil
+}
+
+func (hs *HeaderSettings) validate() error {
+	seen := map[string]bool{}
+	for i, h := range hs.Headers {
+		name := http.CanonicalHeaderKey(strings.TrimSpace(h.Name))
+		check, ok := allowedHeaders[name]
+		if !ok {
+			return fmt.Errorf("header %q cannot be changed", h.Name)
+		}
+		if seen[name] {
+			return fmt.Errorf("header %s is listed twice", name)
+		}
+		seen[name] = true
+		if err := check(h.Value); err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		hs.Headers[i].Name = name
+	}
+	if seen["X-Frame-Options"] && len(hs.FrameAncestors) > 0 {
+		return errors.New("X-Frame-Options cannot be combined with frameAncestors")
+	}
+	for _, origin := range hs.FrameAncestors {
+		u, err := url.Parse(origin)
+		if err != nil || u.Scheme != "https" || u.Host == "" || (u.Path != "" && u.Path != "/") || validateHeaderText(origin) != nil {
+			return fmt.Errorf("frameAncestors: %q must be an https origin", origin)
+		}
+	}
+	return nil
+}
+
+// effectiveHeaders combines the defaults with the owner's settings.
+func (hs *HeaderSettings) effectiveHeaders() []CustomHeader {
+	headers := []CustomHeader{{Name: "X-Content-Type-Options", Value: "nosniff"}}
+	var custom []CustomHeader
+	if hs != nil {
+		custom = hs.Headers
+	}
+	if hs != nil && len(hs.FrameAncestors) > 0 {
+		origins := make([]string, 0, len(hs.FrameAncestors))
+		for _, o := range hs.FrameAncestors {
+			origins = append(origins, strings.TrimSuffix(o, "/"))
+		}
+		headers = append(headers, CustomHeader{Name: "Content-Security-Policy", Value: "frame-ancestors 'self' " + strings.Join(origins, " ")})
+	} else if !slices.ContainsFunc(custom, func(h CustomHeader) bool { return h.Name == "X-Frame-Options" }) {
+		headers = append(headers, CustomHeader{Name: "X-Frame-Options", Value: "SAMEORIGIN"})
+	}
+	return append(headers, custom...)
+}
+
+// --- nginx vhost ---
+
+var vhostTemplate = template.Must(template.New("vhost").Parse(`# Generated by flox-backend for {{.SiteName}}, do not edit.
+server {
+    listen 80;
+    listen [::]:80;
+{{- if .CertFile}}
+    listen 443 ssl;
+    listen [::]:443 ssl;
+    ssl_certificate {{.CertFile}};
+    ssl_certificate_key {{.KeyFile}};
+{{- end}}
+    server_name {{.ServerName}};
+    root {{.Root}};
+    index index.html;
+{{range .Headers}}
+    add_header {{.Name}} "{{.Value}}" always;{{end}}
+
+{{- if .Suspended}}
+    location / {
+        default_type text/plain;
+        return 451 "{{.Suspended}}\n";
+    }
+{{- else}}
+    location / {
+        try_files $uri $uri/ =404;
+    }
+{{- end}}
+}
+`))
+
+// vhostMu serializes writing vhosts and reloading nginx.
+var vhostMu sync.Mutex
+
+func vhostPath(siteName string) string {
+	return filepath.Join(config.Nginx.VhostDir, "flox-"+siteName+".conf")
+}
+
+// siteHostnames are the names a site is served under: its subdomain and
+// the verified custom domains.
+func siteHostnames(siteConfig SiteConfig) []string {
+	names := []string{strings.TrimPrefix(siteURL(siteConfig.SiteName), "https://")}
+	for _, d := range siteConfig.Domains {
+		if d.verified() {
+			names = append(names, d.Domain)
+		}
+	}
+	return names
+}
+
+// suspendedVhostMessage is the answer of a suspended site's vhost, empty
+// if it is not suspended.
+func suspendedVhostMessage(siteConfig SiteConfig) string {
+	if siteConfig.Suspended == nil {
+		return ""
+	}
+	return suspendedSiteMessage
+}
+
+func renderVhost(siteConfig SiteConfig) ([]byte, error) {
+	root, err := filepath.Abs(filepath.Join(sitesBaseDir, siteConfig.SiteName, sitePublicDir))
+	if err != nil {
+		return nil, err
+	}
+	var certFile, keyFile string
+	if siteConfig.hasCertificate() {
+		certFile, keyFile = siteCertPaths(siteConfig.SiteName)
+		if certFile, err = filepath.Abs(certFile); err != nil {
+			return nil, err
+		}
+		if keyFile, err = filepath.Abs(keyFile); err != nil {
+			return nil, err
+		}
+	}
+	var buf bytes.Buffer
+	err = vhostTemplate.Execute(&buf, map[string]any{
+		"SiteName":   siteConfig.SiteName,
+		"ServerName": strings.Join(siteHostnames(siteConfig), " "),
+		"Root":       root,
+		"Headers":    siteConfig.HeaderSettings.effectiveHeaders(),
+		"CertFile":   certFile,
+		"KeyFile":    keyFile,
+		"Suspended":  suspendedVhostMessage(siteConfig),
+	})
+	return buf.Bytes(), err
+}
+
+// applyVhost writes the site's nginx vhost if it changed, enables it and
+// reloads nginx. A vhost that fails "nginx -t" is rolled back. Nothing happens
+// unless nginx.vhost_dir is configured.
+func applyVhost(siteConfig SiteConfig) error {
+	if config.Nginx.VhostDir == "" {
+		return nil
+	}
+	content, err := renderVhost(siteConfig)
+	if err != nil {
+		return fmt.Errorf("failed to render vhost: %v", err)
+	}
+
+	vhostMu.Lock()
+	defer vhostMu.Unlock()
+	path := vhostPath(siteConfig.SiteName)
+	previous, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if bytes.Equal(previous, content) {
+		return nil
+	}
+	if err := os.WriteFile(path, content, 0644); err != nil {
+		return fmt.Errorf("failed to write vhost: %v", err)
+	}
+	if !config.Nginx.Reload {
+		return nil
+	}
+
+	if err := enableVhost(siteConfig.SiteName, path); err != nil {
+		return err
+	}
+	testErr := runSiteCommand(siteConfig.SiteName, "/usr/sbin/nginx", "-t")
+	if testErr == nil {
+		return runSiteCommand(siteConfig.SiteName, "/bin/systemctl", "reload", "nginx")
+	}
+	// Roll back so the next reload of another site does not fail as well.
+	if previous != nil {
+		if werr := os.WriteFile(path, previous, 0644); werr != nil {
+			slog.Error("error restoring vhost", "path", path, "error", werr)
+		}
+	} else if rerr := os.Remove(path); rerr != nil {
+		slog.Error("error removing vhost", "path", path, "error", rerr)
+	}
+	return fmt.Errorf("nginx rejected the vhost: %v", testErr)
+}
+
+// removeVhost disables and deletes the vhost of a deleted site.
+func removeVhost(siteName string) error {
+	if config.Nginx.VhostDir == "" {
+		return nil
+	}
+	vhostMu.Lock()
+	defer vhostMu.Unlock()
+	path := vhostPath(siteName)
+	if config.Nginx.Reload {
+		link := filepath.Join(config.Nginx.EnabledDir, filepath.Base(path))
+		if _, err := os.Lstat(link); err == nil {
+			if err := runSiteCommand(siteName, "/bin/rm", link); err != nil {
+				return err
+			}
+		}
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if config.Nginx.Reload {
+		return runSiteCommand(siteName, "/bin/systemctl", "reload", "nginx")
+	}
+	return nil
+}
+
+func enableVhost(siteName, path string) error {
+	link := filepath.Join(config.Nginx.EnabledDir, filepath.Base(path))
+	if _, err := os.Lstat(link); err == nil {
+		return nil
+	}
+	return runSiteCommand(siteName, "/bin/ln", "-s", path, config.Nginx.EnabledDir+"/")
+}
+
+// runPrivileged runs one of the commands whitelisted for the flox user in
+// /etc/sudoers.d/flox-backend.
+func runPrivileged(name string, args ...string) error {
+	out, err := exec.Command("sudo", append([]string{"-n", name}, args...)...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %v: %s", name, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// runSiteCommand runs a privileged command for a site and adds it to the
+// site's provisioning log.
+func runSiteCommand(siteName, name string, args ...string) error {
+	start := time.Now()
+	err := runPrivileged(name, args...)
+	logStep(siteName, "command", strings.Join(append([]string{name}, args...), " "), start, err)
+	return err
+}
+
+// --- Handlers ---
+
+func getHeaderSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	siteName, ok := siteNameFromPath(w, r)
+	if !ok {
+		return
+	}
+	siteConfig, err := readSiteConfig(siteName)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error reading site config", "site", siteName, "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	settings := HeaderSettings{}
+	if siteConfig.HeaderSettings != nil {
+		settings = *siteConfig.HeaderSettings
+	}
+	respondJSON(w, map[string]any{
+		"settings":  settings,
+		"effective": siteConfig.HeaderSettings.effectiveHeaders(),
+	})
+}
+
+func putHeaderSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	siteName, ok := siteNameFromPath(w, r)
+	if !ok {
+		return
+	}
+	var settings HeaderSettings
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&settings); err != nil {
+		http.Error(w, "Invalid JSON request", http.StatusBadRequest)
+		return
+	}
+	if err := settings.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var previous *HeaderSettings
+	applied := false
+	siteConfig, err := updateSiteConfig(siteName, func(siteConfig *SiteConfig) error {
+		previous, siteConfig.HeaderSettings = siteConfig.HeaderSettings, &settings
+		if err := applyVhost(*siteConfig); err != nil {
+			slog.ErrorContext(r.Context(), "error applying vhost", "site", siteName, "error", err)
+			return &httpError{http.StatusUnprocessableEntity, "The web server rejected these headers"}
+		}
+		applied = true
+		return nil
+	})
+	if err != nil {
+		if applied { // the config could not be written
+			siteConfig.HeaderSettings = previous
+			if err := applyVhost(siteConfig); err != nil {
+				slog.ErrorContext(r.Context(), "error restoring vhost", "site", siteName, "error", err)
+			}
+		}
+		writeSiteUpdateError(w, r, siteName, err)
+		return
+	}
+	recordSiteEvent(siteName, SiteEvent{Type: "headers.updated"})
+	respondJSON(w, map[string]any{
+		"settings":  settings,
+		"effective": settings.effectiveHeaders(),
+	})
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Warm-up: with warmup.enabled, a provisioned site is requested until it
+// answers 200 with the page of its latest build, so "created" means
+// "reachable" and the first visitor does not hit a cold cache. This runs
+// as the last step of a creation, a verification and a queued DNS record,
+// and after every rebuild of a site that has its records. Besides the site
+// URL, the URLs of warmup.urls are requested, e.g. the site on a CDN, with
+// {site} replaced by the site name.
+//
+// Every build stamps its ID into the home page (meta flox-build), so a CDN
+// still serving the previous build counts as not warm yet. Each URL is
+// retried until warmup.timeout; a failure is a failed step of the
+// provisioning run and the event site.unreachable, but does not undo the
+// creation: the site usually becomes reachable later, e.g. once resolvers
+// forget the missing record.
+
+const warmupRetryInterval = 2 * time.Second
+
+// warmupBodyLimit is how much of a response is searched for the build ID.
+const warmupBodyLimit = 1 << 20
+
+var warmupClient = &http.Client{Timeout: 10 * time.Second}
+
+// warmupURLs returns the URLs requested to warm a site up.
+func warmupURLs(siteName string) []string {
+	urls := []string{siteURL(siteName) + "/"}
+	for _, u := range currentConfig().Warmup.URLs {
+		urls = append(urls, strings.ReplaceAll(u, "{site}", siteName))
+	}
+	return urls
+}
+
+// siteHasRecords reports whether a site's records were created, so that a
+// rebuild can be warmed up; at creation they are created after the build.
+func siteHasRecords(siteName string) bool {
+	sc, err := readSiteConfig(siteName)
+	return err == nil && !sc.DNSPending && (len(sc.DNSRecords) > 0 || sc.DNSDelegation != nil)
+}
+
+// warmUpSite warms a site up with its latest build. It does nothing unless
+// warmup.enabled.
+func warmUpSite(ctx context.Context, siteName string) error {
+	if !currentConfig().Warmup.Enabled {
+		return nil
+	}
+	record, err := latestBuildRecord(siteName)
+	if err != nil {
+		return err
+	}
+	buildID := ""
+	if record != nil && record.Error == "" {
+		buildID = record.ID
+	}
+	return warmUpBuild(ctx, siteName, buildID)
+}
+
+// warmUpBuild requests the warm-up URLs of a site until each answers with
+// the build, any page if buildID is empty.
+func warmUpBuild(ctx context.Context, siteName, buildID string) error {
+	c := currentConfig()
+	if !c.Warmup.Enabled {
+		return nil
+	}
+	for _, u := range warmupURLs(siteName) {
+		start := time.Now()
+		err := injectFault(siteName, "warmup")
+		if err == nil {
+			err = warmUpURL(ctx, u, buildID, start.Add(c.Warmup.Timeout))
+		}
+		logStep(siteName, "warmup", u, start, err)
+		if err != nil {
+			err = fmt.Errorf("%s did not answer: %w", u, err)
+			recordSiteEvent(siteName, SiteEvent{Type: "site.unreachable", Message: err.Error()})
+			return err
+		}
+	}
+	return nil
+}
+
+// warmUpURL requests u until it answers 200 with the build or the deadline
+// passes, and returns the last error.
+func warmUpURL(ctx context.Context, u, buildID string, deadline time.Time) error {
+	marker := ""
+	if buildID != "" {
+		marker = `<meta name="flox-build" content="` + buildID + `">`
+	}
+	for {
+		err := fetchWarmupPage(ctx, u, marker)
+		if err == nil || time.Now().Add(warmupRetryInterval).After(deadline) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return errors.Join(err, ctx.Err())
+		case <-time.After(warmupRetryInterval):
+		}
+	}
+}
+
+func fetchWarmupPage(ctx context.Context, u, marker string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", "flox-backend warm-up")
+	resp, err := warmupClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, warmupBodyLimit))
+	if err != nil {
+		return err
+	}
+	if marker != "" && !strings.Contains(string(body), marker) {
+		return errors.New("the page is not that of the latest build")
+	}
+	return nil
+}
@@ -0,0 +1,555 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Webhooks: operators register URLs that get the lifecycle events of all
+// sites POSTed, to wire flox into Slack, billing or CI without polling.
+// They are listed in the config (webhooks.endpoints, signed with
+// webhooks.signing_secret) or registered by admins with POST
+// /api/v1/admin/webhooks, each with a secret of its own. Every event of a
+// site's timeline (events.go) and site.deleted goes to the webhooks of its
+// type, all types if a webhook names none:
+//
+//	{"id": "5d41402abc4b2a76", "type": "site.created", "siteName": "bakery", "time": "...", "message": "..."}
+//
+// with the headers X-Flox-Event, X-Flox-Delivery (the id, the same on
+// retries, for dropping duplicates) and X-Flox-Signature, the hex
+// HMAC-SHA256 of the body like that of REST hooks. Webhooks with format
+// slack get a Slack message ({"text": ...}) instead.
+//
+// A delivery answered with anything but 2xx, or not at all within
+// webhookTimeout, is retried after webhookRetryDelays. The deliveries, their
+// attempts and the webhooks registered through the API are kept in
+// .webhooks.json in the sites directory, so pending retries survive a
+// restart; the last maxWebhookDeliveries of each webhook are listed with GET
+// /api/v1/admin/webhooks/{webhookId}/deliveries.
+
+const (
+	webhooksFile          = ".webhooks.json" // in sitesBaseDir
+	webhookTimeout        = 10 * time.Second
+	maxWebhookDeliveries  = 100 // finished ones kept per webhook
+	webhookEventHeader    = "X-Flox-Event"
+	webhookDeliveryHeader = "X-Flox-Delivery"
+	webhookPollInterval   = 10 * time.Second
+)
+
+// webhookRetryDelays are the waits before the second, third, ... attempt.
+var webhookRetryDelays = []time.Duration{time.Minute, 5 * time.Minute, 30 * time.Minute, 2 * time.Hour, 6 * time.Hour}
+
+const (
+	webhookFormatJSON  = "json"
+	webhookFormatSlack = "slack"
+)
+
+const (
+	deliveryPending   = "pending"
+	deliveryDelivered = "delivered"
+	deliveryFailed    = "failed" // gave up
+)
+
+// webhookOnlyEvents are the events webhooks may subscribe to besides
+// siteEventTypes: the deletion of a site, which leaves no timeline, hook
+// failures, which hooks do not run on, the deletion of accounts
+// (accountdeletion.go), which concern no site, and ping, sent on request.
+var webhookOnlyEvents = []string{"site.deleted", "hook.failed", "account.deletion_scheduled", "account.deleted", "ping"}
+
+var webhookClient = &http.Client{Timeout: webhookTimeout}
+
+// webhookEndpoint is an entry of webhooks.endpoints.
+type webhookEndpoint struct {
+	URL    string   `mapstructure:"url" json:"url"`
+	Events []string `mapstructure:"events" json:"events"` // empty for all
+	Format string   `mapstructure:"format" json:"format"` // json (default) or slack
+}
+
+func (e webhookEndpoint) validate() error {
+	if u, err := url.Parse(e.URL); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" || len(e.URL) > 2048 {
+		return errors.New("url must be an http:// or https:// URL")
+	}
+	for _, event := range e.Events {
+		if !slices.Contains(siteEventTypes, event) && !slices.Contains(webhookOnlyEvents, event) {
+			return fmt.Errorf("unknown event %q", event)
+		}
+	}
+	if e.Format != "" && e.Format != webhookFormatJSON && e.Format != webhookFormatSlack {
+		return fmt.Errorf("format must be json or slack, not %q", e.Format)
+	}
+	return nil
+}
+
+// Webhook is a webhook of the config or the API.
+type Webhook struct {
+	ID string `json:"id"`
+	webhookEndpoint
+	Source    string     `json:"source"`           // config or api
+	Secret    string     `json:"secret,omitempty"` // of API webhooks, shown once, on creation
+	CreatedAt *time.Time `json:"createdAt,omitempty"`
+}
+
+func (h Webhook) public() Webhook {
+	h.Secret = ""
+	return h
+}
+
+func (h Webhook) subscribes(event string) bool {
+	return len(h.Events) == 0 || slices.Contains(h.Events, event)
+}
+
+// signingSecret is the key of the signatures, empty for none.
+func (h Webhook) signingSecret() string {
+	if h.Source == "config" {
+		return currentConfig().Webhooks.SigningSecret
+	}
+	return h.Secret
+}
+
+type webhookPayload struct {
+	ID       string    `json:"id"`
+	Type     string    `json:"type"`
+	SiteName string    `json:"siteName,omitempty"`
+	Time     time.Time `json:"time"`
+	Section  string    `json:"section,omitempty"`
+	Message  string    `json:"message,omitempty"`
+}
+
+type webhookAttempt struct {
+	Time       time.Time `json:"time"`
+	StatusCode int       `json:"statusCode,omitempty"` // 0 if there was no response
+	Error      string    `json:"error,omitempty"`
+	DurationMS int64     `json:"durationMs"`
+}
+
+type webhookDelivery struct {
+	ID            string           `json:"id"`
+	WebhookID     string           `json:"webhookId"`
+	Event         string           `json:"event"`
+	SiteName      string           `json:"siteName,omitempty"`
+	Status        string           `json:"status"` // pending, delivered or failed
+	Body          string           `json:"body"`
+	CreatedAt     time.Time        `json:"createdAt"`
+	NextAttemptAt *time.Time       `json:"nextAttemptAt,omitempty"`
+	Attempts      []webhookAttempt `json:"attempts"`
+}
+
+type webhookStore struct {
+	Webhooks   []Webhook          `json:"webhooks"` // registered through the API
+	Deliveries []*webhookDelivery `json:"deliveries"`
+}
+
+// webhooks holds the store in memory; changes are written through. Only
+// the server loads it, commands leave deliveries to the server.
+var webhooks = struct {
+	sync.Mutex
+	loaded   bool
+	store    webhookStore
+	inFlight map[string]bool // delivery IDs
+	wake     chan struct{}
+}{inFlight: map[string]bool{}, wake: make(chan struct{}, 1)}
+
+func validateWebhooks(c *Config) error {
+	signed := false
+	for i, e := range c.Webhooks.Endpoints {
+		if err := e.validate(); err != nil {
+			return fmt.Errorf("webhooks.endpoints[%d]: %w", i, err)
+		}
+		signed = signed || e.Format != webhookFormatSlack
+	}
+	if signed && c.Webhooks.SigningSecret == "" {
+		return errors.New("webhooks.signing_secret is needed to sign the deliveries of webhooks.endpoints")
+	}
+	return nil
+}
+
+// configWebhooks are the webhooks of the config; their IDs follow from
+// the URL, so they stay the same across reloads.
+func configWebhooks() []Webhook {
+	var hooks []Webhook
+	for _, e := range currentConfig().Webhooks.Endpoints {
+		hooks = append(hooks, Webhook{ID: "config-" + hashHex(e.URL, strings.Join(e.Events, ","))[:12], webhookEndpoint: e, Source: "config"})
+	}
+	return hooks
+}
+
+// loadWebhooks reads the store at startup and starts the deliveries.
+func loadWebhooks() error {
+	data, err := os.ReadFile(filepath.Join(sitesBaseDir, webhooksFile))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	webhooks.Lock()
+	defer webhooks.Unlock()
+	if err == nil {
+		if err := json.Unmarshal(data, &webhooks.store); err != nil {
+			return fmt.Errorf("%s: %v", webhooksFile, err)
+		}
+	}
+	webhooks.loaded = true
+	go runWebhookDeliveries()
+	return nil
+}
+
+// saveWebhooks writes the store, dropping the finished deliveries beyond
+// the last maxWebhookDeliveries of a webhook. The caller holds the lock.
+func saveWebhooks() error {
+	kept := map[string]int{}
+	var deliveries []*webhookDelivery
+	for _, d := range slices.Backward(webhooks.store.Deliveries) {
+		if d.Status != deliveryPending {
+			if kept[d.WebhookID]++; kept[d.WebhookID] > maxWebhookDeliveries {
+				continue
+			}
+		}
+		deliveries = append(deliveries, d)
+	}
+	slices.Reverse(deliveries)
+	webhooks.store.Deliveries = deliveries
+	data, err := json.MarshalIndent(webhooks.store, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(sitesBaseDir, webhooksFile), data, 0600)
+}
+
+// allWebhooks returns the webhooks of the config and the API.
+func allWebhooks() []Webhook {
+	webhooks.Lock()
+	defer webhooks.Unlock()
+	return append(configWebhooks(), webhooks.store.Webhooks...)
+}
+
+func findWebhook(id string) (Webhook, bool) {
+	hooks := allWebhooks()
+	i := slices.IndexFunc(hooks, func(h Webhook) bool { return h.ID == id })
+	if i < 0 {
+		return Webhook{}, false
+	}
+	return hooks[i], true
+}
+
+// fireWebhooks queues an event for the webhooks subscribed to it.
+func fireWebhooks(siteName string, event SiteEvent) {
+	webhooks.Lock()
+	loaded := webhooks.loaded
+	webhooks.Unlock()
+	if !loaded {
+		return
+	}
+	var targets []Webhook
+	for _, h := range allWebhooks() {
+		if h.subscribes(event.Type) {
+			targets = append(targets, h)
+		}
+	}
+	if len(targets) > 0 {
+		queueWebhookEvent(targets, siteName, event)
+	}
+}
+
+// queueWebhookEvent queues the deliveries of an event and returns them.
+func queueWebhookEvent(targets []Webhook, siteName string, event SiteEvent) []webhookDelivery {
+	payload := webhookPayload{ID: newID(), Type: event.Type, SiteName: siteName, Time: event.Time, Section: event.Section, Message: event.Message}
+	if payload.Time.IsZero() {
+		payload.Time = time.Now().UTC()
+	}
+	now := time.Now().UTC()
+	var queued []webhookDelivery
+	webhooks.Lock()
+	defer webhooks.Unlock()
+	for _, h := range targets {
+		body, err := webhookBody(h, payload)
+		if err != nil {
+			slog.Error("error encoding webhook payload", "webhook", h.ID, "error", err)
+			continue
+		}
+		d := &webhookDelivery{ID: payload.ID, WebhookID: h.ID, Event: event.Type, SiteName: siteName, Status: deliveryPending, Body: string(body), CreatedAt: now, NextAttemptAt: &now, Attempts: []webhookAttempt{}}
+		webhooks.store.Deliveries = append(webhooks.store.Deliveries, d)
+		queued = append(queued, *d)
+	}
+	if err := saveWebhooks(); err != nil {
+		slog.Error("error writing webhooks", "error", err)
+	}
+	select {
+	case webhooks.wake <- struct{}{}:
+	default:
+	}
+	return queued
+}
+
+func webhookBody(h Webhook, payload webhookPayload) ([]byte, error) {
+	if h.Format != webhookFormatSlack {
+		return json.Marshal(payload)
+	}
+	text := fmt.Sprintf("*%s*", payload.Type)
+	if payload.SiteName != "" {
+		text += " " + payload.SiteName
+	}
+	if payload.Message != "" {
+		text += ": " + payload.Message
+	}
+	return json.Marshal(map[string]string{"text": text})
+}
+
+// runWebhookDeliveries makes the due attempts, when an event is queued and
+// every webhookPollInterval for the retries.
+func runWebhookDeliveries() {
+	ticker := time.NewTicker(webhookPollInterval)
+	defer ticker.Stop()
+	for {
+		now := time.Now()
+		webhooks.Lock()
+		for _, d := range webhooks.store.Deliveries {
+			if d.Status == deliveryPending && !webhooks.inFlight[d.ID+d.WebhookID] && d.NextAttemptAt != nil && !d.NextAttemptAt.After(now) {
+				webhooks.inFlight[d.ID+d.WebhookID] = true
+				go attemptWebhookDelivery(*d)
+			}
+		}
+		webhooks.Unlock()
+		select {
+		case <-ticker.C:
+		case <-webhooks.wake:
+		}
+	}
+}
+
+// attemptWebhookDelivery sends a delivery once and records the attempt.
+func attemptWebhookDelivery(d webhookDelivery) {
+	key := d.ID + d.WebhookID
+	attempt := webhookAttempt{Time: time.Now().UTC()}
+	h, ok := findWebhook(d.WebhookID)
+	if ok {
+		attempt.StatusCode, attempt.Error = postWebhook(h, d)
+	} else {
+		attempt.Error = "the webhook was removed"
+	}
+	attempt.DurationMS = time.Since(attempt.Time).Milliseconds()
+
+	webhooks.Lock()
+	defer webhooks.Unlock()
+	delete(webhooks.inFlight, key)
+	i := slices.IndexFunc(webhooks.store.Deliveries, func(o *webhookDelivery) bool { return o.ID == d.ID && o.WebhookID == d.WebhookID })
+	if i < 0 {
+		return
+	}
+	stored := webhooks.store.Deliveries[i]
+	stored.Attempts = append(stored.Attempts, attempt)
+	switch n := len(stored.Attempts); {
+	case attempt.Error == "":
+		stored.Status, stored.NextAttemptAt = deliveryDelivered, nil
+	case !ok || n > len(webhookRetryDelays):
+		stored.Status, stored.NextAttemptAt = deliveryFailed, nil
+		slog.Warn("giving up on webhook delivery", "webhook", d.WebhookID, "event", d.Event, "site", d.SiteName, "attempts", n, "error", attempt.Error)
+	default:
+		next := time.Now().UTC().Add(webhookRetryDelays[n-1])
+		stored.NextAttemptAt = &next
+		slog.Warn("error delivering webhook, retrying", "webhook", d.WebhookID, "event", d.Event, "site", d.SiteName, "attempt", n, "retryAt", next, "error", attempt.Error)
+	}
+	if err := saveWebhooks(); err != nil {
+		slog.Error("error writing webhooks", "error", err)
+	}
+}
+
+// postWebhook sends a delivery and returns the response status and the
+// error, if it failed.
+func postWebhook(h Webhook, d webhookDelivery) (int, string) {
+	req, err := http.NewRequest(http.MethodPost, h.URL, strings.NewReader(d.Body))
+	if err != nil {
+		return 0, err.Error()
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "flox-webhooks/"+Version)
+	req.Header.Set(webhookEventHeader, d.Event)
+	req.Header.Set(webhookDeliveryHeader, d.ID)
+	if secret := h.signingSecret(); secret != "" {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(d.Body))
+		req.Header.Set(restHookSignature, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, redactSecrets(err.Error())
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, "the endpoint answered " + resp.Status
+	}
+	return resp.StatusCode, ""
+}
+
+// --- Handlers ---
+
+type webhookView struct {
+	Webhook
+	Pending      int              `json:"pending"` // deliveries waiting for a retry
+	LastDelivery *webhookDelivery `json:"lastDelivery,omitempty"`
+}
+
+// listWebhooksHandler lists the webhooks with their last delivery.
+func listWebhooksHandler(w http.ResponseWriter, r *http.Request) {
+	hooks := allWebhooks()
+	webhooks.Lock()
+	views := []webhookView{}
+	for _, h := range hooks {
+		v := webhookView{Webhook: h.public()}
+		for _, d := range webhooks.store.Deliveries {
+			if d.WebhookID != h.ID {
+				continue
+			}
+			if d.Status == deliveryPending {
+				v.Pending++
+			}
+			last := *d
+			last.Body = ""
+			v.LastDelivery = &last
+		}
+		views = append(views, v)
+	}
+	webhooks.Unlock()
+	respondJSON(w, views)
+}
+
+// createWebhookHandler registers a webhook; the response is the only one
+// containing its secret.
+func createWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	var req webhookEndpoint
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON request", http.StatusBadRequest)
+		return
+	}
+	if err := req.validate(); err != nil {
+		apiError(w, r, http.StatusBadRequest, codeInvalidField, err.Error())
+		return
+	}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		slog.ErrorContext(r.Context(), "error generating webhook secret", "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	now := time.Now().UTC()
+	hook := Webhook{ID: newID(), webhookEndpoint: req, Source: "api", Secret: hex.EncodeToString(secret), CreatedAt: &now}
+
+	webhooks.Lock()
+	webhooks.store.Webhooks = append(webhooks.store.Webhooks, hook)
+	err := saveWebhooks()
+	if err != nil {
+		webhooks.store.Webhooks = webhooks.store.Webhooks[:len(webhooks.store.Webhooks)-1]
+	}
+	webhooks.Unlock()
+	if err != nil {
+		slog.ErrorContext(r.Context(), "error writing webhooks", "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	recordAudit(r.Context(), "webhook.create", "", hook.public())
+	respondJSONStatus(w, http.StatusCreated, hook)
+}
+
+// deleteWebhookHandler removes a webhook of the API with its deliveries.
+func deleteWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("webhookId")
+	webhooks.Lock()
+	i := slices.IndexFunc(webhooks.store.Webhooks, func(h Webhook) bool { return h.ID == id })
+	var err error
+	if i >= 0 {
+		webhooks.store.Webhooks = slices.Delete(webhooks.store.Webhooks, i, i+1)
+		webhooks.store.Deliveries = slices.DeleteFunc(webhooks.store.Deliveries, func(d *webhookDelivery) bool { return d.WebhookID == id })
+		err = saveWebhooks()
+	}
+	webhooks.Unlock()
+	switch {
+	case i < 0 && strings.HasPrefix(id, "config-"):
+		http.Error(w, "This webhook is defined in the config (webhooks.endpoints)", http.StatusConflict)
+	case i < 0:
+		http.Error(w, "Webhook not found", http.StatusNotFound)
+	case err != nil:
+		slog.ErrorContext(r.Context(), "error writing webhooks", "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	default:
+		recordAudit(r.Context(), "webhook.delete", "", map[string]string{"id": id})
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// listWebhookDeliveriesHandler returns the deliveries of a webhook, newest
+// first, with their attempts; ?status= filters them.
+func listWebhookDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("webhookId")
+	if _, ok := findWebhook(id); !ok {
+		http.Error(w, "Webhook not found", http.StatusNotFound)
+		return
+	}
+	status := r.URL.Query().Get("status")
+	deliveries := []webhookDelivery{}
+	webhooks.Lock()
+	for _, d := range slices.Backward(webhooks.store.Deliveries) {
+		if d.WebhookID == id && (status == "" || d.Status == status) {
+			deliveries = append(deliveries, *d)
+		}
+	}
+	webhooks.Unlock()
+	respondJSON(w, deliveries)
+}
+
+// redeliverWebhookHandler sends a delivery again now, also a failed one.
+func redeliverWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	id, deliveryID := r.PathValue("webhookId"), r.PathValue("deliveryId")
+	webhooks.Lock()
+	i := slices.IndexFunc(webhooks.store.Deliveries, func(d *webhookDelivery) bool { return d.WebhookID == id && d.ID == deliveryID })
+	var d webhookDelivery
+	var err error
+	if i >= 0 {
+		stored := webhooks.store.Deliveries[i]
+		now := time.Now().UTC()
+		// A new round of retries.
+		stored.Status, stored.NextAttemptAt, stored.Attempts = deliveryPending, &now, []webhookAttempt{}
+		d = *stored
+		err = saveWebhooks()
+	}
+	webhooks.Unlock()
+	switch {
+	case i < 0:
+		http.Error(w, "Delivery not found", http.StatusNotFound)
+		return
+	case err != nil:
+		slog.ErrorContext(r.Context(), "error writing webhooks", "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	select {
+	case webhooks.wake <- struct{}{}:
+	default:
+	}
+	respondJSONStatus(w, http.StatusAccepted, d)
+}
+
+// pingWebhookHandler sends a ping event to a webhook, for checking it.
+func pingWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	h, ok := findWebhook(r.PathValue("webhookId"))
+	if !ok {
+		http.Error(w, "Webhook not found", http.StatusNotFound)
+		return
+	}
+	queued := queueWebhookEvent([]Webhook{h}, "", SiteEvent{Type: "ping", Message: "Webhook " + h.ID + " works"})
+	if len(queued) == 0 {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	respondJSONStatus(w, http.StatusAccepted, queued[0])
+}